@@ -1,6 +1,13 @@
 /*
 Usage:
-go run art-app.go [privKey] [miner ip:port]
+go run art-app.go [privKey] [miner ip:port] [delegation]
+go run art-app.go [privKey] tls://[miner ip:port] [delegation miner pubKey]
+
+The delegation is only needed when privKey isn't the miner's key; it is
+printed by: go run ink-miner.go delegate [miner privKey] [pubKey]
+With tls:// the miner's -artnode-tls address is connected to over TLS,
+checking that it has the miner's key, which is privKey's key unless
+given after the delegation.
 */
 
 package main
@@ -9,18 +16,25 @@ import "proj1_b0z8_b4n0b_i5n8_m9r8/blockartlib"
 
 import (
 	"bufio"
+	"crypto/ecdsa"
 	"crypto/md5"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"image"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type App struct {
 	canvas   blockartlib.Canvas
 	settings blockartlib.CanvasSettings
+	privKey  *ecdsa.PrivateKey
 	shapes   map[string]string
 	blocks   map[string]string
 }
@@ -28,7 +42,7 @@ type App struct {
 func main() {
 	args := os.Args[1:]
 	if len(args) < 2 {
-		fmt.Println("Usage: go run art-app.go [privKey] [miner ip:port]")
+		fmt.Println("Usage: go run art-app.go [privKey] [miner ip:port | tls://miner ip:port] [delegation] [miner pubKey]")
 		return
 	}
 
@@ -39,11 +53,28 @@ func main() {
 	}
 
 	app := new(App)
+	app.privKey = privKey
 	app.shapes = make(map[string]string)
 	app.blocks = make(map[string]string)
 
 	minerAddr := args[1]
-	app.canvas, app.settings, err = blockartlib.OpenCanvas(minerAddr, *privKey)
+	if strings.HasPrefix(minerAddr, "tls://") {
+		minerAddr = strings.TrimPrefix(minerAddr, "tls://")
+		minerKey, delegation := privKey.PublicKey, ""
+		if len(args) > 3 {
+			pubBytes, _ := hex.DecodeString(args[3])
+			pubKey, err := x509.ParsePKIXPublicKey(pubBytes)
+			if checkError(err) != nil {
+				return
+			}
+			minerKey, delegation = *pubKey.(*ecdsa.PublicKey), args[2]
+		}
+		app.canvas, app.settings, err = blockartlib.OpenSecureCanvas(minerAddr, *privKey, delegation, minerKey)
+	} else if len(args) > 2 {
+		app.canvas, app.settings, err = blockartlib.OpenDelegatedCanvas(minerAddr, *privKey, args[2])
+	} else {
+		app.canvas, app.settings, err = blockartlib.OpenCanvas(minerAddr, *privKey)
+	}
 	if checkError(err) != nil {
 		return
 	}
@@ -70,8 +101,14 @@ func (app *App) HandleCommand(cmd string) int {
 	switch args[0] {
 	case "AddShape":
 		app.AddShape(args[1:])
+	case "AddStyledShape":
+		app.AddStyledShape(args[1:])
+	case "AddShapeAfter":
+		app.AddShapeAfter(args[1:])
 	case "GetSvgString":
 		app.GetSvgString(args[1:])
+	case "GetSvgStrings":
+		app.GetSvgStrings(args[1:])
 	case "GetInk":
 		app.GetInk(args[1:])
 	case "DeleteShape":
@@ -82,6 +119,50 @@ func (app *App) HandleCommand(cmd string) int {
 		app.GetGenesisBlock(args[1:])
 	case "GetChildren":
 		app.GetChildren(args[1:])
+	case "GetBlocksByOwner":
+		app.GetBlocksByOwner(args[1:])
+	case "GetValidateNumRecommendation":
+		app.GetValidateNumRecommendation(args[1:])
+	case "GetValidationEstimate":
+		app.GetValidationEstimate(args[1:])
+	case "GetShapeProvenance":
+		app.GetShapeProvenance(args[1:])
+	case "GetOpPropagation":
+		app.GetOpPropagation(args[1:])
+	case "GetFinality":
+		app.GetFinality(args[1:])
+	case "GetPresence":
+		app.GetPresence(args[1:])
+	case "AcquireLock":
+		app.AcquireLock(args[1:])
+	case "ReleaseLock":
+		app.ReleaseLock(args[1:])
+	case "GetLocks":
+		app.GetLocks(args[1:])
+	case "SetShapeMetadata":
+		app.SetShapeMetadata(args[1:])
+	case "GetShapeMetadata":
+		app.GetShapeMetadata(args[1:])
+	case "RenderRegionPNG":
+		app.RenderRegionPNG(args[1:])
+	case "GetSettings":
+		app.GetSettings(args[1:])
+	case "GetSupplyStats":
+		app.GetSupplyStats(args[1:])
+	case "GetQuota":
+		app.GetQuota(args[1:])
+	case "DraftShape":
+		app.DraftShape(args[1:])
+	case "SubmitSignedOp":
+		app.SubmitSignedOp(args[1:])
+	case "TracePath":
+		app.TracePath(args[1:])
+	case "AllowInk":
+		app.AllowInk(args[1:])
+	case "GetAllowance":
+		app.GetAllowance(args[1:])
+	case "RevokeToken":
+		app.RevokeToken(args[1:])
 	case "CloseCanvas":
 		err := app.CloseCanvas(args[1:])
 		if err == nil {
@@ -121,7 +202,17 @@ func (app *App) AddShape(args []string) {
 	fill := args[3]
 	stroke := args[4]
 
-	shapeHash, blockHash, inkRemaining, err := app.canvas.AddShape(uint8(validateNum), shapeType, shapeSvgString, fill, stroke)
+	// An optional sixth argument makes the shape expire after that many blocks
+	var expiryBlocks uint64 = 0
+	if len(args) > 5 {
+		expiryBlocks, err = strconv.ParseUint(args[5], 10, 32)
+		if err != nil {
+			fmt.Println(" AddShape: could not parse expiryBlocks.")
+			return
+		}
+	}
+
+	shapeHash, blockHash, inkRemaining, err := app.canvas.AddEphemeralShape(uint32(expiryBlocks), uint8(validateNum), shapeType, shapeSvgString, fill, stroke)
 	if err != nil {
 		fmt.Println(" AddShape: " + err.Error())
 		return
@@ -139,6 +230,97 @@ func (app *App) AddShape(args []string) {
 	fmt.Println(" AddShape: inkRemaining = " + fmt.Sprint(inkRemaining))
 }
 
+// Adds a shape whose stroke is drawn with a dash array, line cap and line
+// join, any of which may be left empty. Lengths in the dash array must be
+// separated by spaces, since commas separate the arguments.
+func (app *App) AddStyledShape(args []string) {
+	if len(args) < 8 {
+		fmt.Println(" AddStyledShape: not enough arguments.")
+		return
+	}
+
+	validateNum, err := strconv.ParseInt(args[0], 10, 8)
+	if err != nil {
+		fmt.Println(" AddStyledShape: could not parse validateNum.")
+		return
+	}
+
+	var shapeType blockartlib.ShapeType
+	if args[1] == "PATH" {
+		shapeType = blockartlib.PATH
+	} else if args[1] == "CIRCLE" {
+		shapeType = blockartlib.CIRCLE
+	} else {
+		fmt.Println(" AddStyledShape: invalid shapeType.")
+		return
+	}
+
+	style := blockartlib.StrokeStyle{Dasharray: args[5], Linecap: args[6], Linejoin: args[7]}
+	shapeHash, blockHash, inkRemaining, err := app.canvas.AddStyledShape(uint8(validateNum), shapeType, args[2], args[3], args[4], style)
+	if err != nil {
+		fmt.Println(" AddStyledShape: " + err.Error())
+		return
+	}
+
+	shapeDoubleHash := md5Hash([]byte(shapeHash))
+	blockDoubleHash := md5Hash([]byte(blockHash))
+
+	app.shapes[shapeDoubleHash] = shapeHash
+	app.blocks[blockDoubleHash] = blockHash
+
+	fmt.Println(" AddStyledShape: OK!")
+	fmt.Println(" AddStyledShape: shapeHash    = " + shapeDoubleHash)
+	fmt.Println(" AddStyledShape: blockHash    = " + blockDoubleHash)
+	fmt.Println(" AddStyledShape: inkRemaining = " + fmt.Sprint(inkRemaining))
+}
+
+// Adds a shape that is only mined after a shape this app added before it
+func (app *App) AddShapeAfter(args []string) {
+	if len(args) < 6 {
+		fmt.Println(" AddShapeAfter: not enough arguments.")
+		return
+	}
+
+	dependsOn, exists := app.shapes[args[0]]
+	if !exists {
+		fmt.Println(" AddShapeAfter: could not find shapeHash.")
+		return
+	}
+
+	validateNum, err := strconv.ParseInt(args[1], 10, 8)
+	if err != nil {
+		fmt.Println(" AddShapeAfter: could not parse validateNum.")
+		return
+	}
+
+	var shapeType blockartlib.ShapeType
+	if args[2] == "PATH" {
+		shapeType = blockartlib.PATH
+	} else if args[2] == "CIRCLE" {
+		shapeType = blockartlib.CIRCLE
+	} else {
+		fmt.Println(" AddShapeAfter: invalid shapeType.")
+		return
+	}
+
+	shapeHash, blockHash, inkRemaining, err := app.canvas.AddShapeAfter(dependsOn, uint8(validateNum), shapeType, args[3], args[4], args[5])
+	if err != nil {
+		fmt.Println(" AddShapeAfter: " + err.Error())
+		return
+	}
+
+	shapeDoubleHash := md5Hash([]byte(shapeHash))
+	blockDoubleHash := md5Hash([]byte(blockHash))
+
+	app.shapes[shapeDoubleHash] = shapeHash
+	app.blocks[blockDoubleHash] = blockHash
+
+	fmt.Println(" AddShapeAfter: OK!")
+	fmt.Println(" AddShapeAfter: shapeHash    = " + shapeDoubleHash)
+	fmt.Println(" AddShapeAfter: blockHash    = " + blockDoubleHash)
+	fmt.Println(" AddShapeAfter: inkRemaining = " + fmt.Sprint(inkRemaining))
+}
+
 func (app *App) GetSvgString(args []string) {
 	if len(args) < 1 {
 		fmt.Println(" GetSvgString: not enough arguments.")
@@ -152,7 +334,15 @@ func (app *App) GetSvgString(args []string) {
 		return
 	}
 
-	svgString, err := app.canvas.GetSvgString(shapeHash)
+	// With "pending", shapes this canvas added that aren't mined yet are found too
+	var svgString string
+	var pending bool
+	var err error
+	if len(args) > 1 && args[1] == "pending" {
+		svgString, pending, err = app.canvas.GetSvgStringWithPending(shapeHash)
+	} else {
+		svgString, err = app.canvas.GetSvgString(shapeHash)
+	}
 	if err != nil {
 		fmt.Println(" GetSvgString: " + err.Error())
 		return
@@ -160,6 +350,39 @@ func (app *App) GetSvgString(args []string) {
 
 	fmt.Println(" GetSvgString: OK!")
 	fmt.Println(" GetSvgString: svgString = " + svgString)
+	fmt.Println(" GetSvgString: pending   = " + fmt.Sprint(pending))
+}
+
+func (app *App) GetSvgStrings(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetSvgStrings: not enough arguments.")
+		return
+	}
+
+	shapeHashes := make([]string, len(args))
+	for i, shapeDoubleHash := range args {
+		shapeHash, exists := app.shapes[shapeDoubleHash]
+		if !exists {
+			fmt.Println(" GetSvgStrings: could not find shapeHash " + shapeDoubleHash + ".")
+			return
+		}
+		shapeHashes[i] = shapeHash
+	}
+
+	svgStrings, errs, err := app.canvas.GetSvgStrings(shapeHashes)
+	if err != nil {
+		fmt.Println(" GetSvgStrings: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetSvgStrings: OK!")
+	for i, shapeDoubleHash := range args {
+		if errs[i] != nil {
+			fmt.Println(" GetSvgStrings: " + shapeDoubleHash + " = " + errs[i].Error())
+		} else {
+			fmt.Println(" GetSvgStrings: " + shapeDoubleHash + " = " + svgStrings[i])
+		}
+	}
 }
 
 func (app *App) GetInk(args []string) {
@@ -173,6 +396,147 @@ func (app *App) GetInk(args []string) {
 	fmt.Println(" GetInk: inkRemaining = " + fmt.Sprint(inkRemaining))
 }
 
+// Signs an op adding a shape without sending it to the miner, and saves it
+// to a file for SubmitSignedOp
+func (app *App) DraftShape(args []string) {
+	if len(args) < 6 {
+		fmt.Println(" DraftShape: not enough arguments.")
+		return
+	}
+
+	validateNum, err := strconv.ParseInt(args[1], 10, 8)
+	if err != nil {
+		fmt.Println(" DraftShape: could not parse validateNum.")
+		return
+	}
+
+	var shapeType blockartlib.ShapeType
+	if args[2] == "PATH" {
+		shapeType = blockartlib.PATH
+	} else if args[2] == "CIRCLE" {
+		shapeType = blockartlib.CIRCLE
+	} else {
+		fmt.Println(" DraftShape: invalid shapeType.")
+		return
+	}
+
+	signedOp, err := blockartlib.DraftShape(*app.privKey, app.settings, uint8(validateNum), shapeType, args[3], args[4], args[5])
+	if err != nil {
+		fmt.Println(" DraftShape: " + err.Error())
+		return
+	}
+	encoded, err := json.Marshal(signedOp)
+	if err == nil {
+		err = ioutil.WriteFile(args[0], encoded, 0644)
+	}
+	if err != nil {
+		fmt.Println(" DraftShape: " + err.Error())
+		return
+	}
+
+	fmt.Println(" DraftShape: OK!")
+}
+
+func (app *App) TracePath(args []string) {
+	if len(args) < 2 {
+		fmt.Println(" TracePath: not enough arguments.")
+		return
+	}
+
+	steps, err := strconv.Atoi(args[1])
+	if err != nil || steps < 1 {
+		fmt.Println(" TracePath: could not parse steps.")
+		return
+	}
+
+	geometry, err := blockartlib.GetPathGeometry(args[0])
+	if err != nil {
+		fmt.Println(" TracePath: " + err.Error())
+		return
+	}
+	length := geometry.TotalLength()
+	for i := 0; i <= steps; i++ {
+		x, y := geometry.PointAtLength(length * float64(i) / float64(steps))
+		fmt.Printf("  %.2f: (%.2f, %.2f)\n", length*float64(i)/float64(steps), x, y)
+	}
+
+	fmt.Println(" TracePath: OK!")
+}
+
+func (app *App) SubmitSignedOp(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" SubmitSignedOp: not enough arguments.")
+		return
+	}
+
+	var signedOp blockartlib.SignedOp
+	encoded, err := ioutil.ReadFile(args[0])
+	if err == nil {
+		err = json.Unmarshal(encoded, &signedOp)
+	}
+	if err != nil {
+		fmt.Println(" SubmitSignedOp: could not read signed op.")
+		return
+	}
+
+	shapeHash, err := app.canvas.SubmitSignedOp(signedOp)
+	if err != nil {
+		fmt.Println(" SubmitSignedOp: " + err.Error())
+		return
+	}
+
+	shapeDoubleHash := md5Hash([]byte(shapeHash))
+	app.shapes[shapeDoubleHash] = shapeHash
+
+	fmt.Println(" SubmitSignedOp: OK!")
+	fmt.Println(" SubmitSignedOp: shapeHash = " + shapeDoubleHash)
+}
+
+func (app *App) AllowInk(args []string) {
+	if len(args) < 3 {
+		fmt.Println(" AllowInk: not enough arguments.")
+		return
+	}
+
+	validateNum, err := strconv.ParseInt(args[0], 10, 8)
+	if err != nil {
+		fmt.Println(" AllowInk: could not parse validateNum.")
+		return
+	}
+
+	spender := args[1]
+	allowance, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		fmt.Println(" AllowInk: could not parse allowance.")
+		return
+	}
+
+	inkRemaining, err := app.canvas.AllowInk(uint8(validateNum), spender, uint32(allowance))
+	if err != nil {
+		fmt.Println(" AllowInk: " + err.Error())
+		return
+	}
+
+	fmt.Println(" AllowInk: OK!")
+	fmt.Println(" AllowInk: inkRemaining = " + fmt.Sprint(inkRemaining))
+}
+
+func (app *App) GetAllowance(args []string) {
+	if len(args) < 2 {
+		fmt.Println(" GetAllowance: not enough arguments.")
+		return
+	}
+
+	allowance, err := app.canvas.GetAllowance(args[0], args[1])
+	if err != nil {
+		fmt.Println(" GetAllowance: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetAllowance: OK!")
+	fmt.Println(" GetAllowance: allowance = " + fmt.Sprint(allowance))
+}
+
 func (app *App) DeleteShape(args []string) {
 	if len(args) < 2 {
 		fmt.Println(" DeleteShape: not enough arguments.")
@@ -257,6 +621,11 @@ func (app *App) GetChildren(args []string) {
 		return
 	}
 
+	if len(args) > 1 {
+		app.GetDescendants(blockHash, args[1:])
+		return
+	}
+
 	blockHashes, err := app.canvas.GetChildren(blockHash)
 	if err != nil {
 		fmt.Println(" GetChildren: " + err.Error())
@@ -272,8 +641,449 @@ func (app *App) GetChildren(args []string) {
 	}
 }
 
+// Lists descendants with their metadata, for GetChildren with a depth and
+// optionally an offset and limit
+func (app *App) GetDescendants(blockHash string, args []string) {
+	query := blockartlib.ChildrenQuery{IncludeMetadata: true}
+	for i, field := range []*uint32{&query.Depth, &query.Offset, &query.Limit} {
+		if i >= len(args) {
+			break
+		}
+		value, err := strconv.ParseUint(args[i], 10, 32)
+		if err != nil {
+			fmt.Println(" GetChildren: could not parse " + args[i] + ".")
+			return
+		}
+		*field = uint32(value)
+	}
+
+	page, err := app.canvas.GetDescendants(blockHash, query)
+	if err != nil {
+		fmt.Println(" GetChildren: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetChildren: OK!")
+	fmt.Println(" GetChildren: " + fmt.Sprint(len(page.Blocks)) + " of " + fmt.Sprint(page.Total) + " blocks (blockNo, blockHash, parent, ops, on longest chain) =")
+	for _, block := range page.Blocks {
+		blockDoubleHash := md5Hash([]byte(block.Hash))
+		app.blocks[blockDoubleHash] = block.Hash
+		fmt.Println(" GetChildren:  "+fmt.Sprint(block.BlockNo), blockDoubleHash, md5Hash([]byte(block.PrevHash)), block.OpCount, block.OnLongestChain)
+	}
+}
+
+// Lists the blocks a key mined, optionally from and to a block number
+func (app *App) GetBlocksByOwner(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetBlocksByOwner: not enough arguments.")
+		return
+	}
+
+	var fromBlockNo, toBlockNo uint32
+	for i, field := range []*uint32{&fromBlockNo, &toBlockNo} {
+		if i+1 >= len(args) {
+			break
+		}
+		value, err := strconv.ParseUint(args[i+1], 10, 32)
+		if err != nil {
+			fmt.Println(" GetBlocksByOwner: could not parse " + args[i+1] + ".")
+			return
+		}
+		*field = uint32(value)
+	}
+
+	blocks, err := app.canvas.GetBlocksByOwner(args[0], fromBlockNo, toBlockNo)
+	if err != nil {
+		fmt.Println(" GetBlocksByOwner: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetBlocksByOwner: OK!")
+	fmt.Println(" GetBlocksByOwner: " + fmt.Sprint(len(blocks)) + " blocks (blockNo, blockHash, ops, on longest chain) =")
+	for _, block := range blocks {
+		blockDoubleHash := md5Hash([]byte(block.Hash))
+		app.blocks[blockDoubleHash] = block.Hash
+		fmt.Println(" GetBlocksByOwner:  "+fmt.Sprint(block.BlockNo), blockDoubleHash, block.OpCount, block.OnLongestChain)
+	}
+}
+
+func (app *App) GetShapeProvenance(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetShapeProvenance: not enough arguments.")
+		return
+	}
+
+	shapeDoubleHash := args[0]
+	shapeHash, exists := app.shapes[shapeDoubleHash]
+	if !exists {
+		fmt.Println(" GetShapeProvenance: could not find shapeHash.")
+		return
+	}
+
+	provenance, err := app.canvas.GetShapeProvenance(shapeHash)
+	if err != nil {
+		fmt.Println(" GetShapeProvenance: " + err.Error())
+		return
+	}
+
+	blockDoubleHash := md5Hash([]byte(provenance.BlockHash))
+	app.blocks[blockDoubleHash] = provenance.BlockHash
+
+	fmt.Println(" GetShapeProvenance: OK!")
+	fmt.Println(" GetShapeProvenance: owner     = " + md5Hash([]byte(provenance.Owner)))
+	fmt.Println(" GetShapeProvenance: artnode   = " + md5Hash([]byte(provenance.Artnode)))
+	fmt.Println(" GetShapeProvenance: blockHash = " + blockDoubleHash)
+}
+
+func (app *App) GetOpPropagation(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetOpPropagation: not enough arguments.")
+		return
+	}
+
+	shapeDoubleHash := args[0]
+	shapeHash, exists := app.shapes[shapeDoubleHash]
+	if !exists {
+		fmt.Println(" GetOpPropagation: could not find shapeHash.")
+		return
+	}
+
+	propagation, err := app.canvas.GetOpPropagation(shapeHash)
+	if err != nil {
+		fmt.Println(" GetOpPropagation: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetOpPropagation: OK!")
+	for i, minerAddr := range propagation.Acknowledged {
+		fmt.Println(" GetOpPropagation: acknowledged   = " + minerAddr + " at " + propagation.AcknowledgedAt[i].Format(time.RFC3339))
+	}
+	for _, minerAddr := range propagation.Unacknowledged {
+		fmt.Println(" GetOpPropagation: unacknowledged = " + minerAddr)
+	}
+	for _, rejection := range propagation.Rejections {
+		fmt.Println(" GetOpPropagation: rejected       = " + rejection)
+	}
+}
+
+func (app *App) GetFinality(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetFinality: not enough arguments.")
+		return
+	}
+
+	blockDoubleHash := args[0]
+	blockHash, exists := app.blocks[blockDoubleHash]
+	if !exists {
+		fmt.Println(" GetFinality: could not find blockHash.")
+		return
+	}
+
+	finality, err := app.canvas.GetFinality(blockHash)
+	if err != nil {
+		fmt.Println(" GetFinality: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetFinality: OK!")
+	fmt.Println(" GetFinality: final        = " + strconv.FormatBool(finality.Final))
+	fmt.Println(" GetFinality: attestations = " + fmt.Sprint(finality.Attestations) + "/" + fmt.Sprint(finality.Quorum))
+	if finality.FinalBlockHash != "" {
+		finalDoubleHash := md5Hash([]byte(finality.FinalBlockHash))
+		app.blocks[finalDoubleHash] = finality.FinalBlockHash
+		fmt.Println(" GetFinality: finalBlock   = " + finalDoubleHash)
+	}
+}
+
+func (app *App) GetPresence(args []string) {
+	sessions, err := app.canvas.GetPresence()
+	if err != nil {
+		fmt.Println(" GetPresence: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetPresence: OK!")
+	fmt.Println(" GetPresence: " + fmt.Sprint(len(sessions)) + " artists online")
+	for _, session := range sessions {
+		fmt.Println(" GetPresence: " + session.TokenHash + " " + session.Scope + " " + fmt.Sprint(session.NumOps) + " ops, last active " + session.LastActive.Format(time.RFC3339))
+	}
+}
+
+// Returns the name of the lock an argument names: the shape hash of a
+// shape's double hash, or else the argument as it is
+func (app *App) getLockName(arg string) string {
+	if shapeHash, exists := app.shapes[arg]; exists {
+		return shapeHash
+	}
+	return arg
+}
+
+func (app *App) AcquireLock(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" AcquireLock: not enough arguments.")
+		return
+	}
+
+	// Without seconds the miner's default is used
+	var seconds uint64
+	if len(args) > 1 {
+		var err error
+		seconds, err = strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			fmt.Println(" AcquireLock: could not parse seconds.")
+			return
+		}
+	}
+
+	expires, err := app.canvas.AcquireLock(app.getLockName(args[0]), uint32(seconds))
+	if err != nil {
+		fmt.Println(" AcquireLock: " + err.Error())
+		return
+	}
+
+	fmt.Println(" AcquireLock: OK!")
+	fmt.Println(" AcquireLock: expires = " + expires.Format(time.RFC3339))
+}
+
+func (app *App) ReleaseLock(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" ReleaseLock: not enough arguments.")
+		return
+	}
+
+	if err := app.canvas.ReleaseLock(app.getLockName(args[0])); err != nil {
+		fmt.Println(" ReleaseLock: " + err.Error())
+		return
+	}
+
+	fmt.Println(" ReleaseLock: OK!")
+}
+
+func (app *App) GetLocks(args []string) {
+	locks, err := app.canvas.GetLocks()
+	if err != nil {
+		fmt.Println(" GetLocks: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetLocks: OK!")
+	fmt.Println(" GetLocks: " + fmt.Sprint(len(locks)) + " locks held")
+	for _, lock := range locks {
+		holder := lock.TokenHash
+		if lock.Mine {
+			holder = "this session"
+		}
+		fmt.Println(" GetLocks: " + lock.Name + " held by " + holder + " until " + lock.Expires.Format(time.RFC3339))
+	}
+}
+
+func (app *App) SetShapeMetadata(args []string) {
+	if len(args) < 2 {
+		fmt.Println(" SetShapeMetadata: not enough arguments.")
+		return
+	}
+
+	shapeDoubleHash := args[0]
+	shapeHash, exists := app.shapes[shapeDoubleHash]
+	if !exists {
+		fmt.Println(" SetShapeMetadata: could not find shapeHash.")
+		return
+	}
+	// Without a value the key is removed
+	value := ""
+	if len(args) > 2 {
+		value = args[2]
+	}
+
+	if err := app.canvas.SetShapeMetadata(shapeHash, args[1], value); err != nil {
+		fmt.Println(" SetShapeMetadata: " + err.Error())
+		return
+	}
+
+	fmt.Println(" SetShapeMetadata: OK!")
+}
+
+func (app *App) GetShapeMetadata(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetShapeMetadata: not enough arguments.")
+		return
+	}
+
+	shapeDoubleHash := args[0]
+	shapeHash, exists := app.shapes[shapeDoubleHash]
+	if !exists {
+		fmt.Println(" GetShapeMetadata: could not find shapeHash.")
+		return
+	}
+
+	metadata, err := app.canvas.GetShapeMetadata(shapeHash)
+	if err != nil {
+		fmt.Println(" GetShapeMetadata: " + err.Error())
+		return
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Println(" GetShapeMetadata: OK!")
+	for _, key := range keys {
+		fmt.Println(" GetShapeMetadata: " + key + " = " + metadata[key])
+	}
+}
+
+func (app *App) RenderRegionPNG(args []string) {
+	if len(args) < 6 {
+		fmt.Println(" RenderRegionPNG: not enough arguments.")
+		return
+	}
+
+	var bounds [4]int
+	for i := range bounds {
+		bound, err := strconv.Atoi(args[i])
+		if err != nil {
+			fmt.Println(" RenderRegionPNG: could not parse region.")
+			return
+		}
+		bounds[i] = bound
+	}
+	scale, err := strconv.ParseFloat(args[4], 64)
+	if err != nil {
+		fmt.Println(" RenderRegionPNG: could not parse scale.")
+		return
+	}
+
+	png, err := app.canvas.RenderRegionPNG(image.Rect(bounds[0], bounds[1], bounds[2], bounds[3]), scale)
+	if err != nil {
+		fmt.Println(" RenderRegionPNG: " + err.Error())
+		return
+	}
+	if err = ioutil.WriteFile(args[5], png, 0644); err != nil {
+		fmt.Println(" RenderRegionPNG: " + err.Error())
+		return
+	}
+
+	fmt.Println(" RenderRegionPNG: OK!")
+	fmt.Println(" RenderRegionPNG: wrote " + fmt.Sprint(len(png)) + " bytes to " + args[5])
+}
+
+func (app *App) GetValidateNumRecommendation(args []string) {
+	recommendation, err := app.canvas.GetValidateNumRecommendation()
+	if err != nil {
+		fmt.Println(" GetValidateNumRecommendation: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetValidateNumRecommendation: OK!")
+	fmt.Println(" GetValidateNumRecommendation: validateNum   = " + fmt.Sprint(recommendation.ValidateNum))
+	fmt.Println(" GetValidateNumRecommendation: maxReorgDepth = " + fmt.Sprint(recommendation.MaxReorgDepth))
+	fmt.Println(" GetValidateNumRecommendation: reorgs        = " + fmt.Sprint(recommendation.Reorgs) + "/" + fmt.Sprint(recommendation.HeadChanges))
+	fmt.Println(" GetValidateNumRecommendation: staleBlocks   = " + fmt.Sprint(recommendation.StaleBlocks) + "/" + fmt.Sprint(recommendation.KnownBlocks))
+}
+
+func (app *App) GetValidationEstimate(args []string) {
+	if len(args) < 1 {
+		fmt.Println(" GetValidationEstimate: not enough arguments.")
+		return
+	}
+
+	validateNum, err := strconv.ParseInt(args[0], 10, 8)
+	if err != nil {
+		fmt.Println(" GetValidationEstimate: could not parse validateNum.")
+		return
+	}
+
+	estimate, err := app.canvas.GetValidationEstimate(uint8(validateNum))
+	if err != nil {
+		fmt.Println(" GetValidationEstimate: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetValidationEstimate: OK!")
+	if estimate.Samples == 0 {
+		fmt.Println(" GetValidationEstimate: not enough blocks seen to estimate")
+		return
+	}
+	fmt.Println(" GetValidationEstimate: eta     = " + estimate.ETA.Round(time.Second).String())
+	fmt.Println(" GetValidationEstimate: range   = " + estimate.Low.Round(time.Second).String() + " to " + estimate.High.Round(time.Second).String())
+	fmt.Println(" GetValidationEstimate: blocks  = " + fmt.Sprint(estimate.Blocks))
+	fmt.Println(" GetValidationEstimate: samples = " + fmt.Sprint(estimate.Samples))
+}
+
+func (app *App) GetSettings(args []string) {
+	settings, err := app.canvas.GetSettings()
+	if err != nil {
+		fmt.Println(" GetSettings: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetSettings: OK!")
+	fmt.Println(" GetSettings: protocolVersion = " + fmt.Sprint(settings.ProtocolVersion))
+	fmt.Println(" GetSettings: canvas          = " + fmt.Sprint(settings.CanvasSettings.CanvasXMax) + "x" + fmt.Sprint(settings.CanvasSettings.CanvasYMax))
+	fmt.Println(" GetSettings: inkPerBlock     = " + fmt.Sprint(settings.InkPerOpBlock) + " (op) " + fmt.Sprint(settings.InkPerNoOpBlock) + " (no-op)")
+	fmt.Println(" GetSettings: difficulty      = " + fmt.Sprint(settings.PoWDifficultyOpBlock) + " (op) " + fmt.Sprint(settings.PoWDifficultyNoOpBlock) + " (no-op)")
+	fmt.Println(" GetSettings: maxValidateNum  = " + fmt.Sprint(settings.MaxValidateNum))
+	fmt.Println(" GetSettings: refunds         = " + fmt.Sprint(settings.DeleteRefundPercent) + "% (delete) " + fmt.Sprint(settings.ExpiryRefundPercent) + "% (expiry)")
+	fmt.Println(" GetSettings: maxExpiryBlocks = " + fmt.Sprint(settings.MaxExpiryBlocks))
+	fmt.Println(" GetSettings: ownOverlap      = " + fmt.Sprint(settings.SameOwnerOverlap))
+	fmt.Println(" GetSettings: autoClosePaths  = " + fmt.Sprint(settings.AutoCloseOpenPaths))
+	fmt.Println(" GetSettings: maxVertices     = " + fmt.Sprint(settings.MaxShapeVertices))
+	fmt.Println(" GetSettings: maxOpsPerBlock  = " + fmt.Sprint(settings.MaxOpsPerBlock))
+}
+
+func (app *App) GetSupplyStats(args []string) {
+	stats, err := app.canvas.GetSupplyStats()
+	if err != nil {
+		fmt.Println(" GetSupplyStats: " + err.Error())
+		return
+	}
+
+	headDoubleHash := md5Hash([]byte(stats.HeadHash))
+	app.blocks[headDoubleHash] = stats.HeadHash
+
+	fmt.Println(" GetSupplyStats: OK!")
+	fmt.Println(" GetSupplyStats: head        = " + headDoubleHash)
+	fmt.Println(" GetSupplyStats: blocks      = " + fmt.Sprint(stats.OpBlocks) + " (op) " + fmt.Sprint(stats.NoOpBlocks) + " (no-op)")
+	fmt.Println(" GetSupplyStats: minted      = " + fmt.Sprint(stats.Minted))
+	fmt.Println(" GetSupplyStats: spent       = " + fmt.Sprint(stats.Spent))
+	fmt.Println(" GetSupplyStats: refunded    = " + fmt.Sprint(stats.Refunded) + " (delete) " + fmt.Sprint(stats.ExpiryRefunded) + " (expiry)")
+	fmt.Println(" GetSupplyStats: expired     = " + fmt.Sprint(stats.Expired))
+	fmt.Println(" GetSupplyStats: burned      = " + fmt.Sprint(stats.Burned))
+	fmt.Println(" GetSupplyStats: circulating = " + fmt.Sprint(stats.Circulating) + " in " + fmt.Sprint(stats.Holders) + " keys")
+}
+
+func (app *App) GetQuota(args []string) {
+	quota, spent, err := app.canvas.GetQuota()
+	if err != nil {
+		fmt.Println(" GetQuota: " + err.Error())
+		return
+	}
+
+	fmt.Println(" GetQuota: OK!")
+	fmt.Println(" GetQuota: ink = " + fmt.Sprint(spent.Ink) + " of " + fmt.Sprint(quota.Ink))
+	fmt.Println(" GetQuota: ops = " + fmt.Sprint(spent.Ops) + " of " + fmt.Sprint(quota.Ops))
+}
+
+func (app *App) RevokeToken(args []string) {
+	tokenHash := ""
+	if len(args) > 0 {
+		tokenHash = args[0]
+	}
+
+	numRevoked, err := app.canvas.RevokeToken(tokenHash)
+	if err != nil {
+		fmt.Println(" RevokeToken: " + err.Error())
+		return
+	}
+
+	fmt.Println(" RevokeToken: revoked " + fmt.Sprint(numRevoked) + " tokens")
+	fmt.Println(" RevokeToken: OK!")
+}
+
 func (app *App) CloseCanvas(args []string) (err error) {
-	inkRemaining, err := app.canvas.CloseCanvas()
+	inkRemaining, pendingOpSigs, err := app.canvas.CloseCanvasWithPendingOps()
 	if err != nil {
 		fmt.Println(" CloseCanvas: " + err.Error())
 		return
@@ -281,6 +1091,9 @@ func (app *App) CloseCanvas(args []string) (err error) {
 
 	fmt.Println(" CloseCanvas: OK!")
 	fmt.Println(" CloseCanvas: inkRemaining = " + fmt.Sprint(inkRemaining))
+	for _, opSig := range pendingOpSigs {
+		fmt.Println(" CloseCanvas: pending op   = " + md5Hash([]byte(opSig)))
+	}
 
 	return
 }
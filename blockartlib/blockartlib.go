@@ -10,13 +10,24 @@ package blockartlib
 import (
 	"crypto/ecdsa"
 	"crypto/rand"
-	"encoding/gob"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"io/ioutil"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/oplib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
 )
 
 // Represents a type of shape in the BlockArt system.
@@ -28,14 +39,35 @@ const (
 	CIRCLE
 )
 
+// How a shape's stroke is drawn, as the SVG stroke-dasharray (e.g. "5 3"),
+// stroke-linecap (butt, round or square) and stroke-linejoin (miter, round
+// or bevel) attributes; empty attributes are left out. The style is only
+// drawn and doesn't change the shape's ink cost.
+type StrokeStyle struct {
+	Dasharray string
+	Linecap   string
+	Linejoin  string
+}
+
 // Represents the type of operation for a shape on the canvas
-type OpType int
+type OpType = oplib.OpType
 
 const (
-	ADD OpType = iota
-	REMOVE
+	ADD    = oplib.ADD
+	REMOVE = oplib.REMOVE
+	ALLOW  = oplib.ALLOW
+	ROTATE = oplib.ROTATE
 )
 
+// Milliseconds a local canvas waits on the miner for the chain to change
+const CANVAS_WAIT_TIMEOUT uint32 = 10000
+
+// Number of unread diffs a local canvas subscriber can fall behind by
+const CANVAS_SUBSCRIBER_BUFFER int = 16
+
+// A ChildrenQuery Depth that returns every descendant of a block
+const ALL_DESCENDANTS uint32 = 1<<32 - 1
+
 type MinerResponse struct {
 	Error   error
 	Payload []interface{}
@@ -75,11 +107,23 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8
 	PoWDifficultyNoOpBlock uint8
 
+	// Whether filled paths that aren't closed are closed automatically
+	// instead of being rejected
+	AutoCloseOpenPaths bool
+
+	// Most vertices a shape may have, 0 for shapelib.DEFAULT_MAX_VERTICES
+	MaxShapeVertices uint32
+
+	// Most ops a block may have, 0 for the miners' default (1000)
+	MaxOpsPerBlock uint32
+
 	// Canvas settings
 	canvasSettings CanvasSettings
 }
 
-// Represents a canvas in the system.
+// Represents a canvas in the system. Besides the errors listed for each
+// method, any call can return a RateLimitedError if the canvas makes calls
+// faster than the miner's rate limit allows.
 type Canvas interface {
 	// Adds a new shape to the canvas.
 	// Can return the following errors:
@@ -87,16 +131,129 @@ type Canvas interface {
 	// - InsufficientInkError
 	// - InvalidShapeSvgStringError
 	// - ShapeSvgStringTooLongError
+	// - ComplexityExceededError
 	// - ShapeOverlapError
 	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	// - QuotaError
+	// - OpStaleError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Adds a new shape to the canvas, paid for with the payer's ink. The
+	// payer must have allowed this canvas's key to spend that much of its
+	// ink with AllowInk. inkRemaining is this canvas's own ink.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - AllowanceError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ComplexityExceededError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	// - QuotaError
+	// - OpStaleError
+	AddShapeFrom(payer string, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
+	// Adds a new shape to the canvas that is removed again expiryBlocks
+	// blocks after the block it is added in, when half of its ink is
+	// refunded. Every miner removes it at the same block. It can still be
+	// deleted before then, for a full refund.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ComplexityExceededError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	// - ExpiryError
+	// - QuotaError
+	// - OpStaleError
+	AddEphemeralShape(expiryBlocks uint32, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
+	// Adds a new shape to the canvas whose stroke is drawn with the given
+	// style. The style costs no ink.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - InvalidShapeFillStrokeError
+	// - ComplexityExceededError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	// - QuotaError
+	// - OpStaleError
+	AddStyledShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, style StrokeStyle) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
+	// Adds a new shape to the canvas that is only mined in a block after
+	// the one holding the op dependsOn, e.g. the shapeHash of a shape
+	// added before it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ComplexityExceededError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	// - DependencyError
+	// - QuotaError
+	// - OpStaleError
+	AddShapeAfter(dependsOn string, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
+	// Submits an op drafted and signed ahead of time with DraftShape,
+	// possibly by another key than this canvas's, and returns its hash
+	// once the miner has validated and disseminated it. Unlike AddShape it
+	// doesn't wait for the op to be mined; GetOpStatus follows it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidSignatureError
+	// - ValidationError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ComplexityExceededError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - ObserverError
+	// - KeyRotatedError
+	SubmitSignedOp(signedOp SignedOp) (shapeHash string, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InvalidShapeHashError
 	GetSvgString(shapeHash string) (svgString string, err error)
 
+	// Returns the encoding of the shape as an svg string, like GetSvgString,
+	// but also finds the shapes this canvas added that aren't on the longest
+	// chain yet, e.g. while AddShape is waiting for them, which are flagged
+	// as pending.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetSvgStringWithPending(shapeHash string) (svgString string, pending bool, err error)
+
+	// Returns the encodings of several shapes as svg strings in one round
+	// trip, in the order of their hashes. A hash that isn't a shape gets an
+	// empty svg string and an InvalidShapeHashError in errs. At most 1000
+	// shapes can be asked for at once.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - BatchTooLargeError
+	GetSvgStrings(shapeHashes []string) (svgStrings []string, errs []error, err error)
+
 	// Returns the amount of ink currently available.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -106,8 +263,30 @@ type Canvas interface {
 	// Can return the following errors:
 	// - DisconnectedError
 	// - ShapeOwnerError
+	// - ObserverError
+	// - KeyRotatedError
+	// - QuotaError
+	// - OpStaleError
 	DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
 
+	// Allows the spender key to spend up to allowance more of this
+	// canvas's ink, or revokes what is left of its allowance if allowance
+	// is 0. Returns once the allowance has been validated.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InkOverflowError
+	// - ValidationError
+	// - ObserverError
+	// - KeyRotatedError
+	// - QuotaError
+	// - OpStaleError
+	AllowInk(validateNum uint8, spender string, allowance uint32) (inkRemaining uint32, err error)
+
+	// Returns how much of the payer's ink the spender may still spend.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetAllowance(payer string, spender string) (allowance uint32, err error)
+
 	// Retrieves hashes contained by a specific block.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -125,92 +304,576 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
 
+	// Retrieves a page of the descendants of the block identified by
+	// blockHash, level by level so that each block comes after its parent,
+	// optionally along with each block's metadata.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetDescendants(blockHash string, query ChildrenQuery) (page ChildrenPage, err error)
+
+	// Retrieves the blocks mined by the miner with the given public key,
+	// on any branch, with block numbers from fromBlockNo to toBlockNo (0
+	// for no limit), lowest first. Each block's metadata is set; the blocks
+	// on the longest chain are the ones the miner was rewarded for.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetBlocksByOwner(pubKey string, fromBlockNo uint32, toBlockNo uint32) (blocks []BlockInfo, err error)
+
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
+
+	// Closes the canvas/connection to the BlockArt network, and returns the
+	// hashes of the shapes and ops added or deleted through this canvas that
+	// haven't been validated yet. They may still be validated after closing.
+	// Local canvases stop updating and their subscriptions are closed.
+	// - DisconnectedError
+	CloseCanvasWithPendingOps() (inkRemaining uint32, pendingOpSigs []string, err error)
+
+	// Revokes another token issued for this canvas's key, e.g. one that
+	// leaked, identified by its hash as in GetPresence, or with an empty
+	// hash every other token of the key. Returns how many were revoked.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidTokenError
+	RevokeToken(tokenHash string) (numRevoked int, err error)
+
+	// Retrieves the status of an operation, including the reasons it was
+	// rejected by any miners.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetOpStatus(shapeHash string) (status OpStatus, err error)
+
+	// Retrieves which of the miner's peers are known to hold an operation,
+	// to tell whether an operation that is never mined failed to propagate
+	// or was rejected.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetOpPropagation(shapeHash string) (propagation OpPropagation, err error)
+
+	// Retrieves whether a block is final, i.e. on the miner's main chain at
+	// or below the newest block that enough of the recent miners attested to.
+	// The miner never switches to a chain without its final blocks.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetFinality(blockHash string) (finality FinalityStatus, err error)
+
+	// Lists the art node sessions that made a call to the miner in the last
+	// minute, most recently active first, including this one.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - PresenceDisabledError
+	GetPresence() (sessions []SessionPresence, err error)
+
+	// Sets a key of a shape's metadata, e.g. its "title", to value, or
+	// removes the key if value is "". Metadata is signed by the shape's
+	// owner and gossiped between the miners beside the chain, so it costs
+	// no ink but, like an unmined op, may not reach every miner. A shape
+	// has at most 16 keys of at most 64 bytes, with values of at most 1024
+	// bytes.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	// - ShapeOwnerError
+	// - MetadataTooLargeError
+	SetShapeMetadata(shapeHash string, key string, value string) (err error)
+
+	// Retrieves a shape's metadata as known to the miner. Metadata the
+	// miner missed is pulled from its peers in the background, so a later
+	// call may return more.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetShapeMetadata(shapeHash string) (metadata map[string]string, err error)
+
+	// Renders a region of the canvas to a PNG image, as of the head of the
+	// miner's longest chain. The region spans the canvas from
+	// (region.Min.X, region.Min.Y) up to but not including (region.Max.X,
+	// region.Max.Y), and each canvas unit is drawn as scale by scale
+	// pixels (a scale of 0 is 1). Stroke styles aren't drawn.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - OutOfBoundsError
+	// - RenderTooLargeError
+	RenderRegionPNG(region image.Rectangle, scale float64) (png []byte, err error)
+
+	// Pins or unpins an operation added through this canvas's miner. A
+	// pinned operation that fails after a reorg is retried until it is
+	// validated again, and reported as still pending until it has failed
+	// repeatedly, when it is unpinned and fails with a PinExpiredError.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	// - ShapeOwnerError
+	PinOp(shapeHash string, pinned bool) (err error)
+
+	// Recommends a validateNum based on the forks the miner has recently
+	// observed.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetValidateNumRecommendation() (recommendation ValidateNumRecommendation, err error)
+
+	// Estimates how long an op added now with the given validateNum takes
+	// to be validated, from the times between the blocks the miner has
+	// recently seen.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetValidationEstimate(validateNum uint8) (estimate ValidationEstimate, err error)
+
+	// Retrieves the network's settings and the rules the miner validates
+	// shapes by.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetSettings() (settings NetworkSettings, err error)
+
+	// Retrieves the ink supply of the miner's longest chain: how much ink
+	// was minted, burned on shapes and refunded, and how much the keys
+	// hold.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetSupplyStats() (stats SupplyStats, err error)
+
+	// Retrieves the canvas's quota, as set by OpenCanvasWithQuota, and how
+	// much of it has been spent.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetQuota() (quota TokenQuota, spent TokenQuota, err error)
+
+	// Retrieves the miner that owns a shape and the art node that added it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetShapeProvenance(shapeHash string) (provenance ShapeProvenance, err error)
+
+	// Retrieves every shape on the canvas, as of the head of the longest chain.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetCanvas() (snapshot CanvasSnapshot, err error)
+
+	// Retrieves every shape on the canvas, like GetCanvas, as this canvas
+	// would see it once its ops that aren't on the longest chain yet are:
+	// the shapes it added are included, flagged in snapshot.Pending, and
+	// the shapes it deleted are left out.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetCanvasWithPending() (snapshot CanvasSnapshot, err error)
+
+	// Retrieves the changes to the canvas since the block identified by
+	// blockHash, which need not be on the longest chain.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetCanvasDiff(blockHash string) (diff CanvasDiff, err error)
+
+	// Opens a local copy of the canvas that is kept up to date until the
+	// canvas is closed, and cached in cacheDir.
+	// Can return the following errors:
+	// - DisconnectedError
+	OpenLocalCanvas(cacheDir string) (local *LocalCanvas, err error)
+
+	// Acquires the advisory lock on a name, e.g. a shape hash or a region
+	// like "region:0,0,100,100", for the given seconds (30 if 0, at most
+	// 600), or renews it if this session already holds it. Locks are only
+	// seen by the art nodes connected to the same miner and are never
+	// mined: they don't stop anyone from drawing, but let art nodes that
+	// agree to use them coordinate their edits. A lock is released when it
+	// expires or the canvas is closed.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - LockHeldError
+	// - LockLimitError
+	AcquireLock(name string, seconds uint32) (expires time.Time, err error)
+
+	// Releases an advisory lock held by this session. Does nothing if
+	// nobody holds it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - LockHeldError
+	ReleaseLock(name string) (err error)
+
+	// Lists the advisory locks held on the miner, sorted by name.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetLocks() (locks []LockInfo, err error)
+
+	// Returns a channel that receives the advisory locks held on the miner,
+	// first right away and then each time they change. A subscriber that
+	// falls behind only receives the latest locks. The channel is closed
+	// once the canvas is closed or the miner can no longer be reached.
+	// Can return the following errors:
+	// - DisconnectedError
+	SubscribeLocks() (updates <-chan []LockInfo, err error)
 }
 
-type CanvasInstance struct {
-	MinerAddr string
-	Miner     *rpc.Client
-	Token     string
-	Closed    *bool
+// Status of an operation submitted to the BlockArt network.
+type OpStatus struct {
+	// One of "unmined", "unvalidated", "validated", "failed" or "unknown"
+	State string
+
+	// Hash of the block containing the operation, if it has been mined
+	BlockHash string
+
+	// Summary of why the operation was rejected, e.g.
+	// "rejected by 3 peers: ShapeOverlapError(<hash>)"
+	Summary string
+
+	// Each rejection, formatted as "address: reason"
+	Rejections []string
+
+	// Whether the operation is pinned with PinOp
+	Pinned bool
+
+	// Why the operation failed on this canvas's miner, if it did
+	Error string
 }
 
-////////////////////////////////////////////////////////////////////////////////////////////
-// <ERROR DEFINITIONS>
+// Which peers of a miner are known to hold an operation. A peer holds an
+// operation once it accepts it from the miner, sends it to the miner, or
+// lists it when the two exchange their mempool inventories.
+type OpPropagation struct {
+	// Addresses of the peers that acknowledged the operation, sorted
+	Acknowledged []string
 
-// These type definitions allow the application to explicitly check
-// for the kind of error that occurred. Each API call below lists the
-// errors that it is allowed to raise.
-//
-// Also see:
-// https://blog.golang.org/error-handling-and-go
-// https://blog.golang.org/errors-are-values
+	// When each acknowledged peer last acknowledged the operation
+	AcknowledgedAt []time.Time
+
+	// Addresses of the connected peers that neither acknowledged nor
+	// rejected the operation, sorted
+	Unacknowledged []string
+
+	// Each rejection, formatted as "address: reason"
+	Rejections []string
+}
+
+// Whether a block is final, and how close it is to becoming final.
+type FinalityStatus struct {
+	// Whether the block is on the main chain at or below the final block
+	Final bool
+
+	// Number of the block and its recent ancestors (its finality window)
+	// mined by the miners that attested to the block. Attestations of
+	// blocks below the final block are no longer counted.
+	Attestations int
+
+	// Number of blocks of the finality window the attesting miners must
+	// have mined for the block to be final
+	Quorum int
+
+	// Hash of the newest final block, "" if no block is final yet
+	FinalBlockHash string
+}
+
+// An art node session online on a miner.
+type SessionPresence struct {
+	// Hash of the session's token, which identifies it without revealing
+	// the token
+	TokenHash string
+
+	// Public key the art node authenticated with
+	PubKeyString string
+
+	// "miner" or "delegate", followed by the session's quotas if it has
+	// any, e.g. "delegate ink<=100 ops<=5"
+	Scope string
+
+	// When the session last made a call
+	LastActive time.Time
+
+	// Number of ops submitted with the session
+	NumOps uint32
+}
+
+// An advisory lock held on a miner.
+type LockInfo struct {
+	// Name the lock is on
+	Name string
+
+	// Hash of the token of the session holding the lock (see
+	// SessionPresence)
+	TokenHash string
+
+	// Public key the holding art node authenticated with
+	PubKeyString string
+
+	// When the lock expires unless it is renewed
+	Expires time.Time
+
+	// Whether this session holds the lock
+	Mine bool
+}
+
+// A validateNum recommendation, along with the fork statistics it was
+// computed from.
+type ValidateNumRecommendation struct {
+	// Smallest validateNum that would have survived every recent reorg (>= 1)
+	ValidateNum uint8
+
+	// Number of blocks abandoned by the deepest recent reorg
+	MaxReorgDepth uint32
+
+	// Number of recent blockchain head changes, and how many were reorgs
+	Reorgs      uint32
+	HeadChanges uint32
+
+	// Number of blocks known to the miner, and how many are not on the
+	// longest chain
+	StaleBlocks uint32
+	KnownBlocks uint32
+}
+
+// An estimate of how long an op takes to be validated.
+type ValidationEstimate struct {
+	// Expected time until the op is validated, and a range that it is
+	// validated within about 90% of the time. All are 0 if the miner
+	// hasn't seen enough blocks to estimate.
+	ETA  time.Duration
+	Low  time.Duration
+	High time.Duration
+
+	// Number of blocks to be mined before the op is validated: the op's
+	// own block and validateNum more
+	Blocks uint32
+
+	// Number of recent block intervals the estimate is based on
+	Samples uint32
+}
+
+// The ink supply of a chain, as of its head.
+type SupplyStats struct {
+	HeadHash string
+
+	// Number of blocks with and without ops on the chain
+	OpBlocks   uint32
+	NoOpBlocks uint32
+
+	// Ink rewarded to the miners of the blocks
+	Minted uint64
+
+	// Ink costs of the shapes added, and of those deleted since, which are
+	// refunded in full
+	Spent    uint64
+	Refunded uint64
+
+	// Ink costs of the shapes that expired, and the part of them refunded
+	Expired        uint64
+	ExpiryRefunded uint64
+
+	// Ink held by the shapes still on the canvas
+	Burned uint64
+
+	// Ink held by keys, and the number of keys holding any
+	Circulating uint64
+	Holders     uint32
+}
 
-// Contains address IP:port that art node cannot connect to.
-type DisconnectedError string
+// The settings of a BlockArt network, and the rules a miner validates
+// shapes by.
+type NetworkSettings struct {
+	// Version of the miner's RPCs
+	ProtocolVersion uint32
 
-func (e DisconnectedError) Error() string {
-	return fmt.Sprintf("BlockArt: cannot connect to [%s]", string(e))
+	CanvasSettings CanvasSettings
+
+	// Mining ink reward per op and no-op blocks
+	InkPerOpBlock   uint32
+	InkPerNoOpBlock uint32
+
+	// Proof of work difficulty: number of zeroes in prefix
+	PoWDifficultyOpBlock   uint8
+	PoWDifficultyNoOpBlock uint8
+
+	// Largest validateNum an operation may wait for
+	MaxValidateNum uint8
+
+	// A filled shape costs the number of pixels it covers and a transparent
+	// one the length of its outline. Deleting a shape refunds
+	// DeleteRefundPercent of its cost, and an ephemeral shape that expires
+	// ExpiryRefundPercent of it; it can expire after at most MaxExpiryBlocks.
+	DeleteRefundPercent uint32
+	ExpiryRefundPercent uint32
+	MaxExpiryBlocks     uint32
+
+	// Whether shapes of the same owner may overlap. Shapes of different
+	// owners never may.
+	SameOwnerOverlap bool
+
+	// Whether a filled path with a sub-path that isn't closed is closed with
+	// a straight line back to where the sub-path started, and costs and
+	// overlaps as the closed path, instead of being rejected
+	AutoCloseOpenPaths bool
+
+	// Most vertices a shape may have, counting one for each point a path
+	// moves or draws to. Shapes with more fail with a
+	// ComplexityExceededError.
+	MaxShapeVertices uint32
+
+	// Most ops a block may have. Ops beyond it wait for a later block.
+	MaxOpsPerBlock uint32
 }
 
-// Contains amount of ink remaining.
-type InsufficientInkError uint32
+// Limits on what a canvas may spend, for canvases whose token is handed to
+// front-ends that aren't trusted with all of the miner's ink. AddShape,
+// AddShapeFrom and AddEphemeralShape spend their shape's ink cost, AllowInk
+// spends the allowance, and each of them and DeleteShape spends one op.
+type TokenQuota struct {
+	// Most ink the canvas may spend, 0 for no limit
+	Ink uint32
 
-func (e InsufficientInkError) Error() string {
-	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
+	// Most ops the canvas may submit, 0 for no limit
+	Ops uint32
 }
 
-// Contains the offending svg string.
-type InvalidShapeSvgStringError string
+// Which descendants of a block GetDescendants retrieves.
+type ChildrenQuery struct {
+	// Number of levels of descendants, e.g. 1 for only the children (the
+	// same as 0) or ALL_DESCENDANTS for the whole subtree
+	Depth uint32
+
+	// Whether to retrieve each block's metadata along with its hash
+	IncludeMetadata bool
 
-func (e InvalidShapeSvgStringError) Error() string {
-	return fmt.Sprintf("BlockArt: Bad shape svg string [%s]", string(e))
+	// Number of descendants to skip, and the most to retrieve (0 for as
+	// many as the miner allows)
+	Offset uint32
+	Limit  uint32
 }
 
-// Contains the offending svg string.
-type ShapeSvgStringTooLongError string
+// A page of the descendants of a block.
+type ChildrenPage struct {
+	Blocks []BlockInfo
 
-func (e ShapeSvgStringTooLongError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape svg string too long [%s]", string(e))
+	// Number of descendants within the query's depth, over every page
+	Total uint32
 }
 
-// Contains the bad shape hash string.
-type InvalidShapeHashError string
+// A block in the block tree. Only Hash is set unless metadata was
+// requested.
+type BlockInfo struct {
+	Hash     string
+	PrevHash string
+	BlockNo  uint32
 
-func (e InvalidShapeHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid shape hash [%s]", string(e))
+	// Public key of the miner that mined the block
+	Miner string
+
+	OpCount        uint32
+	OnLongestChain bool
 }
 
-// Contains the bad shape hash string.
-type ShapeOwnerError string
+// Attribution of a shape on the canvas.
+type ShapeProvenance struct {
+	// Public key of the miner whose ink paid for the shape
+	Owner string
+
+	// Public key of the art node that added the shape (the owner's, unless
+	// the art node opened its canvas with OpenDelegatedCanvas)
+	Artnode string
 
-func (e ShapeOwnerError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape owned by someone else [%s]", string(e))
+	// Hash of the block containing the shape
+	BlockHash string
 }
 
-// Empty
-type OutOfBoundsError struct{}
+// The shapes on the canvas as of a given block.
+type CanvasSnapshot struct {
+	// Hash of the block the snapshot was taken at
+	HeadHash string
 
-func (e OutOfBoundsError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape is outside the bounds of the canvas")
+	// Svg string of each shape on the canvas, keyed by shape hash
+	Shapes map[string]string
+
+	// Hashes of the shapes in Shapes that this canvas added with ops that
+	// aren't on the longest chain yet (only set by GetCanvasWithPending)
+	Pending map[string]bool
 }
 
-// Contains the hash of the shape that this shape overlaps with.
-type ShapeOverlapError string
+// The changes to the canvas between two blocks.
+type CanvasDiff struct {
+	FromHash string
+	HeadHash string
+
+	// Svg strings of the added shapes, keyed by shape hash
+	Added map[string]string
 
-func (e ShapeOverlapError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape overlaps with a previously added shape [%s]", string(e))
+	// Hashes of the removed shapes, whether deleted or lost to a fork
+	Removed []string
 }
 
-// Contains the invalid block hash.
-type InvalidBlockHashError string
+// An op signed by an art node's own key, which can be kept (e.g. as JSON)
+// and submitted later through any miner with SubmitSignedOp. EncodedOp is
+// the op exactly as it was signed.
+type SignedOp struct {
+	EncodedOp    string
+	OpSig        string
+	PubKeyString string
+}
+
+// A local copy of the canvas. It is bootstrapped from an on-disk cache
+// keyed by head block hash (or from GetCanvas if there is no cache), and
+// then kept up to date in the background by waiting for the head of the
+// longest chain to change and applying GetCanvasDiff.
+type LocalCanvas struct {
+	canvas      CanvasInstance
+	cacheDir    string
+	lock        *sync.Mutex
+	snapshot    CanvasSnapshot
+	subscribers []chan CanvasDiff
+	closed      bool
+}
 
-func (e InvalidBlockHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
+type CanvasInstance struct {
+	MinerAddr string
+	Miner     *rpc.Client
+	Token     string
+	Closed    *bool
 }
 
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ERROR DEFINITIONS>
+
+// These constructors allow the application to explicitly check for the
+// kind of error that occurred, e.g.
+// errors.Is(err, blockartlib.ShapeOverlapError("")). Each API call below
+// lists the errors that it is allowed to raise. They are the errorlib
+// constructors, so errors returned by the miner match too.
+//
+// Also see:
+// https://blog.golang.org/error-handling-and-go
+// https://blog.golang.org/errors-are-values
+var (
+	DisconnectedError           = errorLib.DisconnectedError
+	InsufficientInkError        = errorLib.InsufficientInkError
+	InvalidShapeSvgStringError  = errorLib.InvalidShapeSvgStringError
+	ShapeSvgStringTooLongError  = errorLib.ShapeSvgStringTooLongError
+	InvalidShapeFillStrokeError = errorLib.InvalidShapeFillStrokeError
+	InvalidShapeHashError       = errorLib.InvalidShapeHashError
+	ShapeOwnerError             = errorLib.ShapeOwnerError
+	OutOfBoundsError            = errorLib.OutOfBoundsError
+	ShapeOverlapError           = errorLib.ShapeOverlapError
+	InvalidBlockHashError       = errorLib.InvalidBlockHashError
+	ObserverError               = errorLib.ObserverError
+	AllowanceError              = errorLib.AllowanceError
+	InkOverflowError            = errorLib.InkOverflowError
+	ValidationError             = errorLib.ValidationError
+	InvalidSignatureError       = errorLib.InvalidSignatureError
+	PinExpiredError             = errorLib.PinExpiredError
+	ExpiryError                 = errorLib.ExpiryError
+	QuotaError                  = errorLib.QuotaError
+	ComplexityExceededError     = errorLib.ComplexityExceededError
+	KeyRotatedError             = errorLib.KeyRotatedError
+	DependencyError             = errorLib.DependencyError
+	RenderTooLargeError         = errorLib.RenderTooLargeError
+	PresenceDisabledError       = errorLib.PresenceDisabledError
+	MetadataTooLargeError       = errorLib.MetadataTooLargeError
+	BatchTooLargeError          = errorLib.BatchTooLargeError
+	OpStaleError                = errorLib.OpStaleError
+	LockHeldError               = errorLib.LockHeldError
+	LockLimitError              = errorLib.LockLimitError
+	InvalidTokenError           = errorLib.InvalidTokenError
+	RateLimitedError            = errorLib.RateLimitedError
+)
+
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -239,24 +902,59 @@ func (e InvalidBlockHashError) Error() string {
 // Can return the following errors:
 // - DisconnectedError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	return openCanvas(minerAddr, privKey, "", TokenQuota{}, nil)
+}
+
+// The constructor for a new Canvas object instance, for an art node with
+// its own keypair. The delegation is the miner's signature of the art
+// node's public key and an expiry, as printed by "ink-miner delegate", and
+// is refused once it has expired. Shapes added through the canvas still
+// use the miner's ink, but are attributed to the art node's public key
+// (see GetShapeProvenance).
+//
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+func OpenDelegatedCanvas(minerAddr string, privKey ecdsa.PrivateKey, delegation string) (canvas Canvas, setting CanvasSettings, err error) {
+	return openCanvas(minerAddr, privKey, delegation, TokenQuota{}, nil)
+}
+
+// The constructor for a new Canvas object instance that can spend at most
+// the given quota, e.g. so that its token can be handed to a front-end over
+// JSON-RPC. The delegation is as for OpenDelegatedCanvas, or "" for the
+// miner's own key. Ops that would exceed the quota fail with a QuotaError.
+//
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+func OpenCanvasWithQuota(minerAddr string, privKey ecdsa.PrivateKey, delegation string, quota TokenQuota) (canvas Canvas, setting CanvasSettings, err error) {
+	return openCanvas(minerAddr, privKey, delegation, quota, nil)
+}
+
+// The constructor for a new Canvas object instance connected over TLS to
+// the address a miner serves with -artnode-tls. The miner's certificate
+// must be for minerKey, which for an art node using the miner's own key
+// is privKey's public key, so that the token and the ops sent with it
+// can't be read or replayed on the way. The delegation is as for
+// OpenDelegatedCanvas, or "" for the miner's own key.
+//
+// Can return the following errors:
+// - DisconnectedError, also if the certificate isn't for minerKey
+// - InvalidSignatureError
+func OpenSecureCanvas(minerAddr string, privKey ecdsa.PrivateKey, delegation string, minerKey ecdsa.PublicKey) (canvas Canvas, setting CanvasSettings, err error) {
+	return openCanvas(minerAddr, privKey, delegation, TokenQuota{}, &minerKey)
+}
+
+func openCanvas(minerAddr string, privKey ecdsa.PrivateKey, delegation string, quota TokenQuota, minerKey *ecdsa.PublicKey) (canvas Canvas, setting CanvasSettings, err error) {
 	// Greet the miner and retrieve a nonce
-	gob.Register(errorLib.InvalidBlockHashError(""))
-	gob.Register(errorLib.DisconnectedError(""))
-	gob.Register(errorLib.InvalidShapeSvgStringError(""))
-	gob.Register(errorLib.ShapeSvgStringTooLongError(""))
-	gob.Register(errorLib.InvalidShapeHashError(""))
-	gob.Register(errorLib.ShapeOwnerError(""))
-	gob.Register(errorLib.OutOfBoundsError{})
-	gob.Register(errorLib.ShapeOverlapError(""))
-	gob.Register(errorLib.InvalidShapeFillStrokeError(""))
-	gob.Register(errorLib.InvalidSignatureError{})
-	gob.Register(errorLib.InvalidTokenError(""))
-	gob.Register(errorLib.ValidationError(""))
-	gob.Register(errorLib.InsufficientInkError(0))
-
-	miner, err := rpc.Dial("tcp", minerAddr)
+	var miner *rpc.Client
+	if minerKey == nil {
+		miner, err = rpc.Dial("tcp", minerAddr)
+	} else {
+		miner, err = dialSecure(minerAddr, minerKey)
+	}
 	if checkError(err) != nil {
-		return CanvasInstance{}, CanvasSettings{}, DisconnectedError(minerAddr)
+		return CanvasInstance{}, CanvasSettings{}, DisconnectedError(minerAddr).Wrap(err)
 	}
 	var nonce string
 	err = miner.Call("Miner.Hello", "", &nonce)
@@ -272,6 +970,19 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 	request.Payload[0] = nonce
 	request.Payload[1] = r.String()
 	request.Payload[2] = s.String()
+	if delegation != "" {
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+		if checkError(err) != nil {
+			return CanvasInstance{}, CanvasSettings{}, err
+		}
+		request.Payload = append(request.Payload, hex.EncodeToString(publicKeyBytes), delegation)
+	}
+	if quota != (TokenQuota{}) {
+		if delegation == "" {
+			request.Payload = append(request.Payload, "", "")
+		}
+		request.Payload = append(request.Payload, quota.Ink, quota.Ops)
+	}
 
 	// Request token and canvas settings from the miner
 	response := new(MinerResponse)
@@ -294,23 +1005,207 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 	return canvas, setting, nil
 }
 
-// Adds a new shape to the canvas.
+// Connects to a miner over TLS, accepting its certificate only if it is
+// for minerKey. Certificates are self-signed, so minerKey stands in for
+// a certificate authority.
+func dialSecure(minerAddr string, minerKey *ecdsa.PublicKey) (*rpc.Client, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("miner presented no certificate")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if pubKey, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pubKey.Equal(minerKey) {
+				return errors.New("miner certificate isn't for the miner's key")
+			}
+			return nil
+		},
+	}
+	conn, err := tls.Dial("tcp", minerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Drafts an op adding a shape owned and paid for by privKey's key, and
+// signs it, without contacting a miner. The shape is checked and its ink
+// cost computed offline against the canvas settings, with filled paths
+// required to be closed; a network with other settings may still reject
+// it when it is submitted.
 // Can return the following errors:
-// - DisconnectedError
-// - InsufficientInkError
 // - InvalidShapeSvgStringError
 // - ShapeSvgStringTooLongError
-// - ShapeOverlapError
+// - ComplexityExceededError
 // - OutOfBoundsError
-func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
-	request := new(ArtnodeRequest)
-	request.Token = c.Token
-	request.Payload = make([]interface{}, 5)
+func DraftShape(privKey ecdsa.PrivateKey, settings CanvasSettings, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (signedOp SignedOp, err error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if checkError(err) != nil {
+		return
+	}
+	pubKeyString := hex.EncodeToString(publicKeyBytes)
+
+	shape := shapelib.Shape{
+		ShapeType:      shapelib.ShapeType(shapeType),
+		ShapeSvgString: shapeSvgString,
+		Fill:           strings.Trim(fill, " "),
+		Stroke:         strings.Trim(stroke, " "),
+		Owner:          pubKeyString}
+	rules := shapelib.ShapeRules{XMax: settings.CanvasXMax, YMax: settings.CanvasYMax, Policy: shapelib.REJECT_OPEN_PATHS}
+	geometry, err := shapelib.DefaultEngine.Validate(shape, rules)
+	if err != nil {
+		return
+	}
+
+	op := oplib.Operation{
+		Type:         ADD,
+		Shape:        shape,
+		InkCost:      uint32(shapelib.DefaultEngine.Cost(geometry)),
+		ValidateNum:  validateNum,
+		NumRemaining: validateNum,
+		TimeStamp:    time.Now().UnixNano(),
+		Artnode:      pubKeyString}
+	encodedOp, opSig, err := oplib.Sign(&privKey, &op)
+	if checkError(err) != nil {
+		return
+	}
+
+	return SignedOp{string(encodedOp), opSig, pubKeyString}, nil
+}
+
+// Parses a path's svg string into its geometry offline, for art apps that
+// animate along the paths they draw: its TotalLength and PointAtLength
+// trace the outline as it is drawn. The path is taken as transparent, so
+// its sub-paths may be open, and the canvas bounds aren't checked.
+// Can return the following errors:
+// - InvalidShapeSvgStringError
+// - ComplexityExceededError
+func GetPathGeometry(shapeSvgString string) (geometry shapelib.PathGeometry, err error) {
+	shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: shapeSvgString, Fill: "transparent"}
+	parsed, err := shapelib.ReferenceEngine{}.Parse(shape, shapelib.ShapeRules{})
+	if err != nil {
+		return
+	}
+
+	return parsed.(shapelib.PathGeometry), nil
+}
+
+// Adds a new shape to the canvas.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+// - QuotaError
+func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.addShape("", 0, StrokeStyle{}, "", validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Adds a new shape to the canvas, paid for with the payer's ink. The
+// payer must have allowed this canvas's key to spend that much of its
+// ink with AllowInk. inkRemaining is this canvas's own ink.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - AllowanceError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+// - QuotaError
+func (c CanvasInstance) AddShapeFrom(payer string, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.addShape(payer, 0, StrokeStyle{}, "", validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Adds a new shape to the canvas that is removed again expiryBlocks
+// blocks after the block it is added in, when half of its ink is
+// refunded. Every miner removes it at the same block. It can still be
+// deleted before then, for a full refund.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+// - ExpiryError
+// - QuotaError
+func (c CanvasInstance) AddEphemeralShape(expiryBlocks uint32, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.addShape("", expiryBlocks, StrokeStyle{}, "", validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Adds a new shape to the canvas whose stroke is drawn with the given
+// style. The style costs no ink.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - InvalidShapeFillStrokeError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+// - QuotaError
+func (c CanvasInstance) AddStyledShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, style StrokeStyle) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.addShape("", 0, style, "", validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Adds a new shape to the canvas that is only mined in a block after
+// the one holding the op dependsOn, e.g. the shapeHash of a shape
+// added before it.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+// - DependencyError
+// - QuotaError
+func (c CanvasInstance) AddShapeAfter(dependsOn string, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.addShape("", 0, StrokeStyle{}, dependsOn, validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Adds a shape paid for by payer, or by this canvas's key if payer is
+// empty, which expires after expiryBlocks blocks unless that is 0, whose
+// stroke is drawn with style, and which is mined after the op dependsOn
+// unless that is empty
+func (c CanvasInstance) addShape(payer string, expiryBlocks uint32, style StrokeStyle, dependsOn string, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 11)
 	request.Payload[0] = validateNum
 	request.Payload[1] = int(shapeType)
 	request.Payload[2] = shapeSvgString
 	request.Payload[3] = fill
 	request.Payload[4] = stroke
+	request.Payload[5] = payer
+	request.Payload[6] = expiryBlocks
+	request.Payload[7] = style.Dasharray
+	request.Payload[8] = style.Linecap
+	request.Payload[9] = style.Linejoin
+	request.Payload[10] = dependsOn
 	response := new(MinerResponse)
 
 	err = c.Miner.Call("Miner.AddShape", request, response)
@@ -352,6 +1247,40 @@ func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSv
 	return
 }
 
+// Submits an op drafted with DraftShape and returns its hash.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+// - ValidationError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ComplexityExceededError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - ObserverError
+// - KeyRotatedError
+func (c CanvasInstance) SubmitSignedOp(signedOp SignedOp) (shapeHash string, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = signedOp.EncodedOp
+	request.Payload[1] = signedOp.OpSig
+	request.Payload[2] = signedOp.PubKeyString
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.SubmitSignedOp", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return response.Payload[0].(string), nil
+}
+
 // Returns the encoding of the shape as an svg string.
 // Can return the following errors:
 // - DisconnectedError
@@ -360,10 +1289,25 @@ func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSv
 // TODO: Testing
 //
 func (c CanvasInstance) GetSvgString(shapeHash string) (svgString string, err error) {
+	svgString, _, err = c.getSvgString(shapeHash, false)
+	return
+}
+
+// Returns the encoding of the shape as an svg string, and whether it was
+// added by this canvas with an op that isn't on the longest chain yet.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (c CanvasInstance) GetSvgStringWithPending(shapeHash string) (svgString string, pending bool, err error) {
+	return c.getSvgString(shapeHash, true)
+}
+
+func (c CanvasInstance) getSvgString(shapeHash string, includePending bool) (svgString string, pending bool, err error) {
 	request := new(ArtnodeRequest)
 	request.Token = c.Token
-	request.Payload = make([]interface{}, 1)
+	request.Payload = make([]interface{}, 2)
 	request.Payload[0] = shapeHash
+	request.Payload[1] = includePending
 	response := new(MinerResponse)
 	err = c.Miner.Call("Miner.GetSvgString", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
@@ -375,8 +1319,44 @@ func (c CanvasInstance) GetSvgString(shapeHash string) (svgString string, err er
 	}
 
 	svgString = response.Payload[0].(string)
+	if len(response.Payload) > 1 {
+		pending = response.Payload[1].(bool)
+	}
+
+	return svgString, pending, nil
+}
+
+// Returns the encodings of several shapes as svg strings in one round
+// trip, in the order of their hashes. A hash that isn't a shape gets an
+// empty svg string and an InvalidShapeHashError in errs.
+// Can return the following errors:
+// - DisconnectedError
+// - BatchTooLargeError
+func (c CanvasInstance) GetSvgStrings(shapeHashes []string) (svgStrings []string, errs []error, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = shapeHashes
+	response := new(MinerResponse)
+	err = c.Miner.Call("Miner.GetSvgStrings", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	svgStrings = response.Payload[0].([]string)
+	errs = make([]error, len(shapeHashes))
+	for i, errType := range response.Payload[1].([]string) {
+		if errType != "" {
+			code, _ := errorLib.GetCode(errType)
+			errs[i] = errorLib.New(code, shapeHashes[i])
+		}
+	}
 
-	return svgString, nil
+	return svgStrings, errs, nil
 }
 
 // Returns the amount of ink currently available.
@@ -408,6 +1388,9 @@ func (c CanvasInstance) GetInk() (inkRemaining uint32, err error) {
 // Can return the following errors:
 // - DisconnectedError
 // - ShapeOwnerError
+// - ObserverError
+// - KeyRotatedError
+// - QuotaError
 func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
 	request := new(ArtnodeRequest)
 	response := new(MinerResponse)
@@ -422,6 +1405,9 @@ func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRem
 	} else if errorLib.IsType(response.Error, "ShapeOwnerError") {
 		err = ShapeOwnerError(shapeHash)
 		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
 	}
 
 	opSig := response.Payload[0].(string)
@@ -453,6 +1439,84 @@ func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRem
 	return
 }
 
+// Allows the spender key to spend up to allowance more of this canvas's
+// ink. Returns once the allowance has been validated.
+// Can return the following errors:
+// - DisconnectedError
+// - InkOverflowError
+// - ValidationError
+// - ObserverError
+// - KeyRotatedError
+// - QuotaError
+func (c CanvasInstance) AllowInk(validateNum uint8, spender string, allowance uint32) (inkRemaining uint32, err error) {
+	request := new(ArtnodeRequest)
+	response := new(MinerResponse)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = validateNum
+	request.Payload[1] = spender
+	request.Payload[2] = allowance
+	err = c.Miner.Call("Miner.AllowInk", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	opSig := response.Payload[0].(string)
+
+	request = new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = opSig
+	response = new(MinerResponse)
+	for {
+		err = c.Miner.Call("Miner.OpValidated", request, response)
+
+		validated := response.Payload[0].(bool)
+		inkRemaining = response.Payload[2].(uint32)
+
+		if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+			err = DisconnectedError(c.MinerAddr)
+			return
+		} else if response.Error != nil {
+			err = response.Error
+			return
+		} else if validated == true {
+			return
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Returns how much of the payer's ink the spender may still spend.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetAllowance(payer string, spender string) (allowance uint32, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = payer
+	request.Payload[1] = spender
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetAllowance", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	allowance = response.Payload[0].(uint32)
+
+	return allowance, nil
+}
+
 // Retrieves hashes contained by a specific block.
 // Can return the following errors:
 // - DisconnectedError
@@ -534,9 +1598,92 @@ func (c CanvasInstance) GetChildren(blockHash string) (blockHashes []string, err
 	return blockHashes, nil
 }
 
+// Retrieves a page of the descendants of the block identified by
+// blockHash, level by level so that each block comes after its parent,
+// optionally along with each block's metadata.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (c CanvasInstance) GetDescendants(blockHash string, query ChildrenQuery) (page ChildrenPage, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = []interface{}{blockHash, query.Depth, query.IncludeMetadata, query.Offset, query.Limit}
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetChildren", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	blockHashes := response.Payload[0].([]string)
+	page.Total = response.Payload[1].(uint32)
+	page.Blocks = make([]BlockInfo, len(blockHashes))
+	for i, hash := range blockHashes {
+		page.Blocks[i].Hash = hash
+		if query.IncludeMetadata {
+			page.Blocks[i].PrevHash = response.Payload[2].([]string)[i]
+			page.Blocks[i].BlockNo = response.Payload[3].([]uint32)[i]
+			page.Blocks[i].Miner = response.Payload[4].([]string)[i]
+			page.Blocks[i].OpCount = response.Payload[5].([]uint32)[i]
+			page.Blocks[i].OnLongestChain = response.Payload[6].([]bool)[i]
+		}
+	}
+
+	return page, nil
+}
+
+// Retrieves the blocks mined by the miner with the given public key,
+// on any branch, with block numbers from fromBlockNo to toBlockNo (0
+// for no limit), lowest first. Each block's metadata is set; the blocks
+// on the longest chain are the ones the miner was rewarded for.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetBlocksByOwner(pubKey string, fromBlockNo uint32, toBlockNo uint32) (blocks []BlockInfo, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = []interface{}{pubKey, fromBlockNo, toBlockNo}
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetBlocksByOwner", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	blockHashes := response.Payload[0].([]string)
+	blocks = make([]BlockInfo, len(blockHashes))
+	for i, hash := range blockHashes {
+		blocks[i].Hash = hash
+		blocks[i].PrevHash = response.Payload[1].([]string)[i]
+		blocks[i].BlockNo = response.Payload[2].([]uint32)[i]
+		blocks[i].Miner = pubKey
+		blocks[i].OpCount = response.Payload[3].([]uint32)[i]
+		blocks[i].OnLongestChain = response.Payload[4].([]bool)[i]
+	}
+
+	return blocks, nil
+}
+
 // Closes the canvas/connection to the BlockArt network.
 // - DisconnectedError
 func (c CanvasInstance) CloseCanvas() (inkRemaining uint32, err error) {
+	inkRemaining, _, err = c.CloseCanvasWithPendingOps()
+	return
+}
+
+// Closes the canvas/connection to the BlockArt network, and returns the
+// hashes of the shapes and ops added or deleted through this canvas that
+// haven't been validated yet. They may still be validated after closing.
+// Local canvases stop updating and their subscriptions are closed.
+// - DisconnectedError
+func (c CanvasInstance) CloseCanvasWithPendingOps() (inkRemaining uint32, pendingOpSigs []string, err error) {
 	request := new(ArtnodeRequest)
 	request.Token = c.Token
 	response := new(MinerResponse)
@@ -548,22 +1695,901 @@ func (c CanvasInstance) CloseCanvas() (inkRemaining uint32, err error) {
 	}
 
 	inkRemaining = response.Payload[0].(uint32)
+	pendingOpSigs = response.Payload[1].([]string)
 	*c.Closed = true
 
-	return inkRemaining, nil
+	return inkRemaining, pendingOpSigs, nil
 }
 
-// </EXPORTED METHODS>
-////////////////////////////////////////////////////////////////////////////////////////////
-
-////////////////////////////////////////////////////////////////////////////////////////////
-// <PRIVATE METHODS>
+// Revokes another token issued for this canvas's key, or every other one.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidTokenError
+func (c CanvasInstance) RevokeToken(tokenHash string) (numRevoked int, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = tokenHash
+	response := new(MinerResponse)
 
-func checkError(err error) error {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		return err
+	// Only this canvas's own token being invalid means it is disconnected
+	err = c.Miner.Call("Miner.RevokeToken", request, response)
+	if checkError(err) != nil || errors.Is(response.Error, InvalidTokenError(c.Token)) || *c.Closed {
+		return 0, DisconnectedError(c.MinerAddr)
+	} else if response.Error != nil {
+		return 0, response.Error
 	}
+
+	return response.Payload[0].(int), nil
+}
+
+// Retrieves the status of an operation, including the reasons it was
+// rejected by any miners.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetOpStatus(shapeHash string) (status OpStatus, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = shapeHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetOpStatus", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	status.State = response.Payload[0].(string)
+	status.BlockHash = response.Payload[1].(string)
+	status.Summary = response.Payload[2].(string)
+	status.Rejections = response.Payload[3].([]string)
+	status.Pinned = response.Payload[4].(bool)
+	status.Error = response.Payload[5].(string)
+
+	return status, nil
+}
+
+// Retrieves which of the miner's peers are known to hold an operation.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetOpPropagation(shapeHash string) (propagation OpPropagation, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = shapeHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetOpPropagation", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	propagation.Acknowledged = response.Payload[0].([]string)
+	for _, at := range response.Payload[1].([]int64) {
+		propagation.AcknowledgedAt = append(propagation.AcknowledgedAt, time.Unix(0, at))
+	}
+	propagation.Unacknowledged = response.Payload[2].([]string)
+	propagation.Rejections = response.Payload[3].([]string)
+
+	return propagation, nil
+}
+
+// Retrieves whether a block is final.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (c CanvasInstance) GetFinality(blockHash string) (finality FinalityStatus, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = blockHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetFinality", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	finality.Final = response.Payload[0].(bool)
+	finality.Attestations = response.Payload[1].(int)
+	finality.Quorum = response.Payload[2].(int)
+	finality.FinalBlockHash = response.Payload[3].(string)
+
+	return finality, nil
+}
+
+// Lists the art node sessions online on the miner.
+// Can return the following errors:
+// - DisconnectedError
+// - PresenceDisabledError
+func (c CanvasInstance) GetPresence() (sessions []SessionPresence, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetPresence", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	tokenHashes := response.Payload[0].([]string)
+	pubKeys := response.Payload[1].([]string)
+	scopes := response.Payload[2].([]string)
+	lastActive := response.Payload[3].([]int64)
+	numOps := response.Payload[4].([]uint32)
+	sessions = make([]SessionPresence, len(tokenHashes))
+	for i := range tokenHashes {
+		sessions[i] = SessionPresence{tokenHashes[i], pubKeys[i], scopes[i], time.Unix(0, lastActive[i]), numOps[i]}
+	}
+
+	return sessions, nil
+}
+
+// Sets or removes a key of a shape's metadata.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+// - ShapeOwnerError
+// - MetadataTooLargeError
+func (c CanvasInstance) SetShapeMetadata(shapeHash string, key string, value string) (err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = shapeHash
+	request.Payload[1] = key
+	request.Payload[2] = value
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.SetShapeMetadata", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		return DisconnectedError(c.MinerAddr)
+	} else if response.Error != nil {
+		return response.Error
+	}
+
+	return nil
+}
+
+// Retrieves a shape's metadata.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (c CanvasInstance) GetShapeMetadata(shapeHash string) (metadata map[string]string, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = shapeHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetShapeMetadata", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	keys := response.Payload[0].([]string)
+	values := response.Payload[1].([]string)
+	metadata = make(map[string]string)
+	for i := range keys {
+		metadata[keys[i]] = values[i]
+	}
+
+	return metadata, nil
+}
+
+// Renders a region of the canvas to a PNG image.
+// Can return the following errors:
+// - DisconnectedError
+// - OutOfBoundsError
+// - RenderTooLargeError
+func (c CanvasInstance) RenderRegionPNG(region image.Rectangle, scale float64) (png []byte, err error) {
+	if region.Min.X < 0 || region.Min.Y < 0 || region.Max.X < 0 || region.Max.Y < 0 {
+		return nil, OutOfBoundsError("region starts below 0")
+	}
+
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 5)
+	request.Payload[0] = uint32(region.Min.X)
+	request.Payload[1] = uint32(region.Min.Y)
+	request.Payload[2] = uint32(region.Max.X)
+	request.Payload[3] = uint32(region.Max.Y)
+	request.Payload[4] = scale
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.RenderRegionPNG", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return response.Payload[1].([]byte), nil
+}
+
+// Pins or unpins an operation added through this canvas's miner. A
+// pinned operation that fails after a reorg is retried until it is
+// validated again, and reported as still pending until it has failed
+// repeatedly, when it is unpinned and fails with a PinExpiredError.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+// - ShapeOwnerError
+func (c CanvasInstance) PinOp(shapeHash string, pinned bool) (err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = shapeHash
+	request.Payload[1] = pinned
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.PinOp", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return nil
+}
+
+// Recommends a validateNum based on the forks the miner has recently
+// observed.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetValidateNumRecommendation() (recommendation ValidateNumRecommendation, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetValidateNumRecommendation", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	recommendation.ValidateNum = response.Payload[0].(uint8)
+	recommendation.MaxReorgDepth = response.Payload[1].(uint32)
+	recommendation.Reorgs = response.Payload[2].(uint32)
+	recommendation.HeadChanges = response.Payload[3].(uint32)
+	recommendation.StaleBlocks = response.Payload[4].(uint32)
+	recommendation.KnownBlocks = response.Payload[5].(uint32)
+
+	return recommendation, nil
+}
+
+// Estimates how long an op added now with the given validateNum takes
+// to be validated, from the times between the blocks the miner has
+// recently seen.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetValidationEstimate(validateNum uint8) (estimate ValidationEstimate, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = validateNum
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetValidationEstimate", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	estimate.ETA = time.Duration(response.Payload[0].(int64))
+	estimate.Low = time.Duration(response.Payload[1].(int64))
+	estimate.High = time.Duration(response.Payload[2].(int64))
+	estimate.Blocks = response.Payload[3].(uint32)
+	estimate.Samples = response.Payload[4].(uint32)
+
+	return estimate, nil
+}
+
+// Retrieves the network's settings and the rules the miner validates
+// shapes by.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetSettings() (settings NetworkSettings, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetSettings", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	settings.ProtocolVersion = response.Payload[0].(uint32)
+	settings.CanvasSettings.CanvasXMax = response.Payload[1].(uint32)
+	settings.CanvasSettings.CanvasYMax = response.Payload[2].(uint32)
+	settings.InkPerOpBlock = response.Payload[3].(uint32)
+	settings.InkPerNoOpBlock = response.Payload[4].(uint32)
+	settings.PoWDifficultyOpBlock = response.Payload[5].(uint8)
+	settings.PoWDifficultyNoOpBlock = response.Payload[6].(uint8)
+	settings.MaxValidateNum = response.Payload[7].(uint8)
+	settings.DeleteRefundPercent = response.Payload[8].(uint32)
+	settings.ExpiryRefundPercent = response.Payload[9].(uint32)
+	settings.MaxExpiryBlocks = response.Payload[10].(uint32)
+	settings.SameOwnerOverlap = response.Payload[11].(bool)
+	if len(response.Payload) > 12 {
+		settings.AutoCloseOpenPaths = response.Payload[12].(bool)
+	}
+	if len(response.Payload) > 13 {
+		settings.MaxShapeVertices = response.Payload[13].(uint32)
+	}
+	if len(response.Payload) > 14 {
+		settings.MaxOpsPerBlock = response.Payload[14].(uint32)
+	}
+
+	return settings, nil
+}
+
+// Retrieves the ink supply of the miner's longest chain.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetSupplyStats() (stats SupplyStats, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetSupplyStats", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	stats.HeadHash = response.Payload[0].(string)
+	stats.OpBlocks = response.Payload[1].(uint32)
+	stats.NoOpBlocks = response.Payload[2].(uint32)
+	stats.Minted = response.Payload[3].(uint64)
+	stats.Spent = response.Payload[4].(uint64)
+	stats.Refunded = response.Payload[5].(uint64)
+	stats.Expired = response.Payload[6].(uint64)
+	stats.ExpiryRefunded = response.Payload[7].(uint64)
+	stats.Burned = response.Payload[8].(uint64)
+	stats.Circulating = response.Payload[9].(uint64)
+	stats.Holders = response.Payload[10].(uint32)
+
+	return stats, nil
+}
+
+// Retrieves the canvas's quota, as set by OpenCanvasWithQuota, and how
+// much of it has been spent.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetQuota() (quota TokenQuota, spent TokenQuota, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetQuota", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	quota.Ink = response.Payload[0].(uint32)
+	quota.Ops = response.Payload[1].(uint32)
+	spent.Ink = response.Payload[2].(uint32)
+	spent.Ops = response.Payload[3].(uint32)
+
+	return quota, spent, nil
+}
+
+// Retrieves the miner that owns a shape and the art node that added it.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (c CanvasInstance) GetShapeProvenance(shapeHash string) (provenance ShapeProvenance, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = shapeHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetShapeProvenance", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	provenance.Owner = response.Payload[0].(string)
+	provenance.Artnode = response.Payload[1].(string)
+	provenance.BlockHash = response.Payload[2].(string)
+
+	return provenance, nil
+}
+
+// Retrieves every shape on the canvas, as of the head of the longest chain.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetCanvas() (snapshot CanvasSnapshot, err error) {
+	return c.getCanvas(false)
+}
+
+// Retrieves every shape on the canvas, as this canvas would see it once its
+// ops that aren't on the longest chain yet are.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetCanvasWithPending() (snapshot CanvasSnapshot, err error) {
+	return c.getCanvas(true)
+}
+
+func (c CanvasInstance) getCanvas(includePending bool) (snapshot CanvasSnapshot, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = []interface{}{includePending}
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetCanvas", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	snapshot.HeadHash = response.Payload[0].(string)
+	snapshot.Shapes = make(map[string]string)
+	shapeHashes := response.Payload[1].([]string)
+	svgStrings := response.Payload[2].([]string)
+	for i, shapeHash := range shapeHashes {
+		snapshot.Shapes[shapeHash] = svgStrings[i]
+	}
+	if includePending && len(response.Payload) > 3 {
+		snapshot.Pending = make(map[string]bool)
+		for i, pending := range response.Payload[3].([]bool) {
+			if pending {
+				snapshot.Pending[shapeHashes[i]] = true
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Retrieves the changes to the canvas since the block identified by
+// blockHash, which need not be on the longest chain.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (c CanvasInstance) GetCanvasDiff(blockHash string) (diff CanvasDiff, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = blockHash
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetCanvasDiff", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	diff.FromHash = blockHash
+	diff.HeadHash = response.Payload[0].(string)
+	diff.Added = make(map[string]string)
+	added := response.Payload[1].([]string)
+	svgStrings := response.Payload[2].([]string)
+	for i, shapeHash := range added {
+		diff.Added[shapeHash] = svgStrings[i]
+	}
+	diff.Removed = response.Payload[3].([]string)
+
+	return diff, nil
+}
+
+// Acquires or renews an advisory lock.
+// Can return the following errors:
+// - DisconnectedError
+// - LockHeldError
+// - LockLimitError
+func (c CanvasInstance) AcquireLock(name string, seconds uint32) (expires time.Time, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = name
+	request.Payload[1] = seconds
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.AcquireLock", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return time.Unix(0, response.Payload[0].(int64)), nil
+}
+
+// Releases an advisory lock held by this session.
+// Can return the following errors:
+// - DisconnectedError
+// - LockHeldError
+func (c CanvasInstance) ReleaseLock(name string) (err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = name
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.ReleaseLock", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		return DisconnectedError(c.MinerAddr)
+	}
+	return response.Error
+}
+
+// Lists the advisory locks held on the miner.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) GetLocks() (locks []LockInfo, err error) {
+	locks, _, err = c.getLocks()
+	return locks, err
+}
+
+// Subscribes to the advisory locks held on the miner.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) SubscribeLocks() (updates <-chan []LockInfo, err error) {
+	locks, version, err := c.getLocks()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriber := make(chan []LockInfo, 1)
+	subscriber <- locks
+	go c.syncLocks(subscriber, version)
+
+	return subscriber, nil
+}
+
+// Opens a local copy of the canvas that is kept up to date until the
+// canvas is closed, and cached in cacheDir. If cacheDir holds a snapshot
+// from an earlier session, it is returned right away and brought up to
+// date in the background; otherwise the whole canvas is retrieved first.
+// Can return the following errors:
+// - DisconnectedError
+func (c CanvasInstance) OpenLocalCanvas(cacheDir string) (local *LocalCanvas, err error) {
+	local = &LocalCanvas{canvas: c, cacheDir: cacheDir, lock: &sync.Mutex{}}
+	if snapshot, cacheErr := loadCanvasCache(cacheDir); cacheErr == nil {
+		local.snapshot = snapshot
+	} else if local.snapshot, err = c.GetCanvas(); err != nil {
+		return nil, err
+	} else {
+		checkError(saveCanvasCache(cacheDir, local.snapshot))
+	}
+
+	go local.sync()
+
+	return local, nil
+}
+
+// Returns a copy of the local canvas
+func (l *LocalCanvas) Snapshot() (snapshot CanvasSnapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	snapshot.HeadHash = l.snapshot.HeadHash
+	snapshot.Shapes = make(map[string]string)
+	for shapeHash, svgString := range l.snapshot.Shapes {
+		snapshot.Shapes[shapeHash] = svgString
+	}
+
+	return snapshot
+}
+
+// Returns a channel that receives each change applied to the local
+// canvas. A subscriber that falls too far behind misses changes, and
+// should catch up with Snapshot. The channel is closed once the local
+// canvas stops updating.
+func (l *LocalCanvas) Subscribe() <-chan CanvasDiff {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	subscriber := make(chan CanvasDiff, CANVAS_SUBSCRIBER_BUFFER)
+	if l.closed {
+		close(subscriber)
+	} else {
+		l.subscribers = append(l.subscribers, subscriber)
+	}
+	return subscriber
+}
+
+// </EXPORTED METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+func checkError(err error) error {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Blocks until the head of the longest chain is no longer blockHash, or
+// until timeout milliseconds pass, and returns the head's hash.
+func (c CanvasInstance) waitForCanvasChange(blockHash string, timeout uint32) (headHash string, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = blockHash
+	request.Payload[1] = timeout
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.WaitForCanvasChange", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return response.Payload[0].(string), nil
+}
+
+// Lists the advisory locks held on the miner, along with the version they
+// are as of.
+func (c CanvasInstance) getLocks() (locks []LockInfo, version uint64, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.GetLocks", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	names := response.Payload[0].([]string)
+	tokenHashes := response.Payload[1].([]string)
+	pubKeys := response.Payload[2].([]string)
+	expires := response.Payload[3].([]int64)
+	mine := response.Payload[4].([]bool)
+	locks = make([]LockInfo, len(names))
+	for i := range names {
+		locks[i] = LockInfo{names[i], tokenHashes[i], pubKeys[i], time.Unix(0, expires[i]), mine[i]}
+	}
+
+	return locks, response.Payload[5].(uint64), nil
+}
+
+// Blocks until the version of the miner's advisory locks is no longer
+// version, or until timeout milliseconds pass, and returns the version.
+func (c CanvasInstance) waitForLockChange(version uint64, timeout uint32) (newVersion uint64, err error) {
+	request := new(ArtnodeRequest)
+	request.Token = c.Token
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = version
+	request.Payload[1] = timeout
+	response := new(MinerResponse)
+
+	err = c.Miner.Call("Miner.WaitForLockChange", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
+		err = DisconnectedError(c.MinerAddr)
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	return response.Payload[0].(uint64), nil
+}
+
+// Sends the advisory locks to a subscriber each time they change, until
+// the canvas is closed or the miner can no longer be reached, then closes
+// the subscription. A subscriber that hasn't read the previous locks has
+// them replaced by the latest.
+func (c CanvasInstance) syncLocks(subscriber chan []LockInfo, version uint64) {
+	defer close(subscriber)
+
+	for !*c.Closed {
+		newVersion, err := c.waitForLockChange(version, CANVAS_WAIT_TIMEOUT)
+		if err != nil {
+			return
+		} else if newVersion == version {
+			continue
+		}
+
+		locks, lockVersion, err := c.getLocks()
+		if err != nil {
+			return
+		}
+		version = lockVersion
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- locks
+	}
+}
+
+// Keeps the local canvas up to date until the canvas is closed or the
+// miner can no longer be reached, then closes the subscriptions.
+func (l *LocalCanvas) sync() {
+	defer l.closeSubscribers()
+
+	for !*l.canvas.Closed {
+		l.lock.Lock()
+		headHash := l.snapshot.HeadHash
+		l.lock.Unlock()
+
+		diff, err := l.canvas.GetCanvasDiff(headHash)
+		if errorLib.IsType(err, "InvalidBlockHashError") {
+			// The cached snapshot is from a block this miner doesn't know
+			var snapshot CanvasSnapshot
+			if snapshot, err = l.canvas.GetCanvas(); err == nil {
+				diff = l.diffFrom(snapshot)
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		if diff.HeadHash != headHash || len(diff.Added) > 0 || len(diff.Removed) > 0 {
+			l.apply(diff)
+		}
+
+		if _, err = l.canvas.waitForCanvasChange(diff.HeadHash, CANVAS_WAIT_TIMEOUT); err != nil {
+			return
+		}
+	}
+}
+
+func (l *LocalCanvas) closeSubscribers() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, subscriber := range l.subscribers {
+		close(subscriber)
+	}
+	l.subscribers = nil
+	l.closed = true
+}
+
+// Computes the changes from the local canvas to the given snapshot
+func (l *LocalCanvas) diffFrom(snapshot CanvasSnapshot) (diff CanvasDiff) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	diff.FromHash = l.snapshot.HeadHash
+	diff.HeadHash = snapshot.HeadHash
+	diff.Added = make(map[string]string)
+	for shapeHash, svgString := range snapshot.Shapes {
+		if _, exists := l.snapshot.Shapes[shapeHash]; !exists {
+			diff.Added[shapeHash] = svgString
+		}
+	}
+	for shapeHash := range l.snapshot.Shapes {
+		if _, exists := snapshot.Shapes[shapeHash]; !exists {
+			diff.Removed = append(diff.Removed, shapeHash)
+		}
+	}
+
+	return diff
+}
+
+// Applies a diff to the local canvas, caches the result and notifies
+// subscribers
+func (l *LocalCanvas) apply(diff CanvasDiff) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, shapeHash := range diff.Removed {
+		delete(l.snapshot.Shapes, shapeHash)
+	}
+	for shapeHash, svgString := range diff.Added {
+		l.snapshot.Shapes[shapeHash] = svgString
+	}
+	l.snapshot.HeadHash = diff.HeadHash
+	checkError(saveCanvasCache(l.cacheDir, l.snapshot))
+
+	for _, subscriber := range l.subscribers {
+		select {
+		case subscriber <- diff:
+		default:
+		}
+	}
+}
+
+// Loads the most recently cached snapshot. The cache holds a single
+// snapshot, stored in a file named after its head block hash, along with
+// a HEAD file naming that hash.
+func loadCanvasCache(cacheDir string) (snapshot CanvasSnapshot, err error) {
+	headHash, err := ioutil.ReadFile(filepath.Join(cacheDir, "HEAD"))
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cacheDir, string(headHash)+".json"))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return
+	}
+	if snapshot.Shapes == nil {
+		snapshot.Shapes = make(map[string]string)
+	}
+
+	return snapshot, nil
+}
+
+// Replaces the cached snapshot
+func saveCanvasCache(cacheDir string, snapshot CanvasSnapshot) error {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(cacheDir, snapshot.HeadHash+".json"), data, 0644); err != nil {
+		return err
+	}
+
+	oldHeadHash, _ := ioutil.ReadFile(filepath.Join(cacheDir, "HEAD"))
+	if err = ioutil.WriteFile(filepath.Join(cacheDir, "HEAD"), []byte(snapshot.HeadHash), 0644); err != nil {
+		return err
+	}
+	if len(oldHeadHash) > 0 && string(oldHeadHash) != snapshot.HeadHash {
+		os.Remove(filepath.Join(cacheDir, string(oldHeadHash)+".json"))
+	}
+
 	return nil
 }
 
@@ -1,102 +1,373 @@
 package errorLib
 
 import (
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
+////////////////////////////////////////////////////////////////////////////////
+// <ERROR TYPE>
+
+// Identifies the kind of a BlockArt error. Codes are sent across RPC, so
+// an existing code must never be renumbered or reused.
+type ErrorCode uint16
+
+// A BlockArt error. Every error the miners and blockartlib return to each
+// other is an *Error, so adding a new kind of error only means registering
+// a new code: the type itself is already registered with gob.
+//
+// Errors are matched with errors.Is against a constructed error; an empty
+// Details in the target matches any details, e.g.
+// errors.Is(err, ShapeOverlapError("")) matches every ShapeOverlapError.
+type Error struct {
+	Code ErrorCode
+
+	// The context of the error, e.g. the offending shape hash
+	Details string
+
+	// The error that caused this one, if any
+	Cause *Error
+}
+
+func (e *Error) Error() string {
+	message := "BlockArt: " + getMessage(e.Code)
+	if strings.Contains(message, "%s") {
+		message = fmt.Sprintf(message, e.Details)
+	}
+	if e.Cause != nil {
+		message += ": " + e.Cause.Error()
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	if e.Cause == nil {
+		return nil
+	}
+	return e.Cause
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && (t.Details == "" || t.Details == e.Details)
+}
+
+// Returns a copy of the error caused by cause. Errors that aren't an
+// *Error are kept as an UnknownError holding their message, so that the
+// chain can still be sent across RPC.
+func (e *Error) Wrap(cause error) *Error {
+	wrapped := *e
+	if cause != nil {
+		var causeErr *Error
+		if !errors.As(cause, &causeErr) || causeErr != cause {
+			causeErr = New(UnknownCode, cause.Error())
+		}
+		wrapped.Cause = causeErr
+	}
+	return &wrapped
+}
+
+// Creates an error with the given code and details
+func New(code ErrorCode, details string) *Error {
+	return &Error{Code: code, Details: details}
+}
+
+// </ERROR TYPE>
+////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////
+// <ERROR CODES>
+
+const (
+	UnknownCode                ErrorCode = 0
+	DisconnectedCode           ErrorCode = 1
+	InsufficientInkCode        ErrorCode = 2
+	InvalidShapeSvgStringCode  ErrorCode = 3
+	ShapeSvgStringTooLongCode  ErrorCode = 4
+	InvalidShapeHashCode       ErrorCode = 5
+	ShapeOwnerCode             ErrorCode = 6
+	OutOfBoundsCode            ErrorCode = 7
+	ShapeOverlapCode           ErrorCode = 8
+	InvalidBlockHashCode       ErrorCode = 9
+	InvalidShapeFillStrokeCode ErrorCode = 10
+	InvalidSignatureCode       ErrorCode = 11
+	InvalidTokenCode           ErrorCode = 12
+	ValidationCode             ErrorCode = 13
+	InkOverflowCode            ErrorCode = 14
+	ObserverCode               ErrorCode = 15
+	AllowanceCode              ErrorCode = 16
+	PinExpiredCode             ErrorCode = 17
+	ExpiryCode                 ErrorCode = 18
+	PrunedCode                 ErrorCode = 19
+	QuotaCode                  ErrorCode = 20
+	ComplexityExceededCode     ErrorCode = 21
+	KeyRotatedCode             ErrorCode = 22
+	DependencyCode             ErrorCode = 23
+	RenderTooLargeCode         ErrorCode = 24
+	PresenceDisabledCode       ErrorCode = 25
+	MetadataTooLargeCode       ErrorCode = 26
+	BatchTooLargeCode          ErrorCode = 27
+	OpStaleCode                ErrorCode = 28
+	LockHeldCode               ErrorCode = 29
+	LockLimitCode              ErrorCode = 30
+	PeerBannedCode             ErrorCode = 31
+	RateLimitedCode            ErrorCode = 32
+)
+
+// Name and message of a registered error code. A "%s" in the message is
+// replaced by the error's details.
+type codeInfo struct {
+	name    string
+	message string
+}
+
+var registry = map[ErrorCode]codeInfo{}
+
+// Registers an error code. Panics if the code or name is already taken,
+// since two kinds of errors sharing either could not be told apart.
+func Register(code ErrorCode, name string, message string) {
+	for c, info := range registry {
+		if c == code || info.name == name {
+			panic(fmt.Sprintf("errorLib: error code %d (%s) registered twice", code, name))
+		}
+	}
+	registry[code] = codeInfo{name, message}
+}
+
+func init() {
+	gob.Register(&Error{})
+
+	Register(UnknownCode, "UnknownError", "%s")
+	Register(DisconnectedCode, "DisconnectedError", "cannot connect to [%s]")
+	Register(InsufficientInkCode, "InsufficientInkError", "Not enough ink to addShape [%s]")
+	Register(InvalidShapeSvgStringCode, "InvalidShapeSvgStringError", "Bad shape svg string [%s]")
+	Register(ShapeSvgStringTooLongCode, "ShapeSvgStringTooLongError", "Shape svg string too long [%s]")
+	Register(InvalidShapeHashCode, "InvalidShapeHashError", "Invalid shape hash [%s]")
+	Register(ShapeOwnerCode, "ShapeOwnerError", "Shape owned by someone else [%s]")
+	Register(OutOfBoundsCode, "OutOfBoundsError", "Shape is outside the bounds of the canvas [%s]")
+	Register(ShapeOverlapCode, "ShapeOverlapError", "Shape overlaps with a previously added shape [%s]")
+	Register(InvalidBlockHashCode, "InvalidBlockHashError", "Invalid block hash [%s]")
+	Register(InvalidShapeFillStrokeCode, "InvalidShapeFillStrokeError", "%s")
+	Register(InvalidSignatureCode, "InvalidSignatureError", "Invalid signature")
+	Register(InvalidTokenCode, "InvalidTokenError", "Invalid token [%s]")
+	Register(ValidationCode, "ValidationError", "Problem occurred with validation on [%s]")
+	Register(InkOverflowCode, "InkOverflowError", "Ink account would overflow [%s]")
+	Register(ObserverCode, "ObserverError", "Miner is an observer and does not accept shapes [%s]")
+	Register(AllowanceCode, "AllowanceError", "Not allowed to spend that much of the payer's ink [%s]")
+	Register(PinExpiredCode, "PinExpiredError", "Pinned op kept failing and was unpinned [%s]")
+	Register(ExpiryCode, "ExpiryError", "Shapes can expire after at most [%s] blocks")
+	Register(PrunedCode, "PrunedError", "Block body was pruned from the store [%s]")
+	Register(QuotaCode, "QuotaError", "Op would exceed the token's quota [%s]")
+	Register(ComplexityExceededCode, "ComplexityExceededError", "Shape has more than the [%s] vertices allowed")
+	Register(KeyRotatedCode, "KeyRotatedError", "Key was rotated to [%s]")
+	Register(DependencyCode, "DependencyError", "Op depends on an op that isn't on the chain [%s]")
+	Register(RenderTooLargeCode, "RenderTooLargeError", "Rendered image would have more than the [%s] pixels allowed")
+	Register(PresenceDisabledCode, "PresenceDisabledError", "Miner doesn't share its art node sessions [%s]")
+	Register(MetadataTooLargeCode, "MetadataTooLargeError", "Shape metadata is over the size limits [%s]")
+	Register(BatchTooLargeCode, "BatchTooLargeError", "Request has more than the [%s] items allowed")
+	Register(OpStaleCode, "OpStaleError", "Op wasn't mined before it expired from the mempool [%s]")
+	Register(LockHeldCode, "LockHeldError", "Lock is held by another session [%s]")
+	Register(LockLimitCode, "LockLimitError", "Lock is over the limits [%s]")
+	Register(PeerBannedCode, "PeerBannedError", "Peer is banned [%s]")
+	Register(RateLimitedCode, "RateLimitedError", "Too many calls with the token, retry after [%s]")
+}
+
+// Returns the registered name of a code, e.g. "ShapeOverlapError"
+func GetName(code ErrorCode) string {
+	if info, exists := registry[code]; exists {
+		return info.name
+	}
+	return fmt.Sprintf("Error%d", code)
+}
+
+// Returns the code registered under a name, and whether there is one
+func GetCode(name string) (code ErrorCode, exists bool) {
+	for c, info := range registry {
+		if info.name == name {
+			return c, true
+		}
+	}
+	return UnknownCode, false
+}
+
+func getMessage(code ErrorCode) string {
+	if info, exists := registry[code]; exists {
+		return info.message
+	}
+	// Sent by a newer node that knows codes this one doesn't
+	return fmt.Sprintf("error %d [%%s]", code)
+}
+
+// </ERROR CODES>
+////////////////////////////////////////////////////////////////////////////////
+
 ////////////////////////////////////////////////////////////////////////////////
 // <ERROR DEFS>
 
 // Contains address IP:port that art node cannot connect to.
-type DisconnectedError string
-
-func (e DisconnectedError) Error() string {
-	return fmt.Sprintf("BlockArt: cannot connect to [%s]", string(e))
+func DisconnectedError(addr string) *Error {
+	return New(DisconnectedCode, addr)
 }
 
 // Contains amount of ink remaining.
-type InsufficientInkError uint32
+func InsufficientInkError(inkRemaining uint32) *Error {
+	return New(InsufficientInkCode, fmt.Sprint(inkRemaining))
+}
 
-func (e InsufficientInkError) Error() string {
-	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
+// Contains amount of ink held.
+func InkOverflowError(inkHeld uint32) *Error {
+	return New(InkOverflowCode, fmt.Sprint(inkHeld))
 }
 
 // Contains the offending svg string.
-type InvalidShapeSvgStringError string
-
-func (e InvalidShapeSvgStringError) Error() string {
-	return fmt.Sprintf("BlockArt: Bad shape svg string [%s]", string(e))
+func InvalidShapeSvgStringError(svgString string) *Error {
+	return New(InvalidShapeSvgStringCode, svgString)
 }
 
 // Contains the offending svg string.
-type ShapeSvgStringTooLongError string
+func ShapeSvgStringTooLongError(svgString string) *Error {
+	return New(ShapeSvgStringTooLongCode, svgString)
+}
 
-func (e ShapeSvgStringTooLongError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape svg string too long [%s]", string(e))
+// Contains the bad shape hash string.
+func InvalidShapeHashError(shapeHash string) *Error {
+	return New(InvalidShapeHashCode, shapeHash)
 }
 
 // Contains the bad shape hash string.
-type InvalidShapeHashError string
+func ShapeOwnerError(shapeHash string) *Error {
+	return New(ShapeOwnerCode, shapeHash)
+}
 
-func (e InvalidShapeHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid shape hash [%s]", string(e))
+// Contains by how much and in which directions the shape is out of
+// bounds, e.g. "exceeds xMax by 14 at command 3".
+func OutOfBoundsError(overrun string) *Error {
+	return New(OutOfBoundsCode, overrun)
 }
 
-// Contains the bad shape hash string.
-type ShapeOwnerError string
+// Contains the hash of the shape that this shape overlaps with.
+func ShapeOverlapError(shapeHash string) *Error {
+	return New(ShapeOverlapCode, shapeHash)
+}
+
+// Contains the invalid block hash.
+func InvalidBlockHashError(blockHash string) *Error {
+	return New(InvalidBlockHashCode, blockHash)
+}
 
-func (e ShapeOwnerError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape owned by someone else [%s]", string(e))
+// Contains details
+func InvalidShapeFillStrokeError(details string) *Error {
+	return New(InvalidShapeFillStrokeCode, details)
 }
 
 // Empty
-type OutOfBoundsError struct{}
+func InvalidSignatureError() *Error {
+	return New(InvalidSignatureCode, "")
+}
 
-func (e OutOfBoundsError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape is outside the bounds of the canvas")
+// Contains the token
+func InvalidTokenError(token string) *Error {
+	return New(InvalidTokenCode, token)
 }
 
-// Contains the hash of the shape that this shape overlaps with.
-type ShapeOverlapError string
+// Contains the hash of the block or op that failed validation
+func ValidationError(hash string) *Error {
+	return New(ValidationCode, hash)
+}
 
-func (e ShapeOverlapError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape overlaps with a previously added shape [%s]", string(e))
+// Contains the address of the observer miner.
+func ObserverError(addr string) *Error {
+	return New(ObserverCode, addr)
 }
 
-// Contains the invalid block hash.
-type InvalidBlockHashError string
+// Contains the amount of the payer's ink the spender is allowed to spend.
+func AllowanceError(allowance uint32) *Error {
+	return New(AllowanceCode, fmt.Sprint(allowance))
+}
 
-func (e InvalidBlockHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
+// Contains the signature of the op that was unpinned.
+func PinExpiredError(opSig string) *Error {
+	return New(PinExpiredCode, opSig)
 }
 
-// Contains details
-type InvalidShapeFillStrokeError string
+// Contains the most blocks after which a shape can expire.
+func ExpiryError(maxExpiryBlocks uint32) *Error {
+	return New(ExpiryCode, fmt.Sprint(maxExpiryBlocks))
+}
 
-func (e InvalidShapeFillStrokeError) Error() string {
-	return fmt.Sprintf("BlockArt: ", string(e))
+// Contains the hash of the block whose body was pruned.
+func PrunedError(blockHash string) *Error {
+	return New(PrunedCode, blockHash)
 }
 
-// Empty
-type InvalidSignatureError struct{}
+// Contains the quota that would be exceeded and how much of it is left,
+// e.g. "ink 20/100".
+func QuotaError(quotaLeft string) *Error {
+	return New(QuotaCode, quotaLeft)
+}
 
-func (e InvalidSignatureError) Error() string {
-	return fmt.Sprintf("Invalid signature.", nil)
+// Contains the most vertices a shape may have.
+func ComplexityExceededError(maxVertices uint32) *Error {
+	return New(ComplexityExceededCode, fmt.Sprint(maxVertices))
 }
 
-// Contains the token
-type InvalidTokenError string
+// Contains the key that the retired key was rotated to.
+func KeyRotatedError(newKey string) *Error {
+	return New(KeyRotatedCode, newKey)
+}
+
+// Contains the signature of the op that the op depends on.
+func DependencyError(opSig string) *Error {
+	return New(DependencyCode, opSig)
+}
+
+// Contains the most pixels a rendered image may have.
+func RenderTooLargeError(maxPixels uint32) *Error {
+	return New(RenderTooLargeCode, fmt.Sprint(maxPixels))
+}
+
+// Contains the address of the miner.
+func PresenceDisabledError(addr string) *Error {
+	return New(PresenceDisabledCode, addr)
+}
+
+// Contains the limit that was exceeded, e.g. "value of 2048 bytes".
+func MetadataTooLargeError(limit string) *Error {
+	return New(MetadataTooLargeCode, limit)
+}
 
-func (e InvalidTokenError) Error() string {
-	return fmt.Sprintf("Invalid token: ", string(e))
+// Contains the most items a batched request may have.
+func BatchTooLargeError(maxItems uint32) *Error {
+	return New(BatchTooLargeCode, fmt.Sprint(maxItems))
 }
 
-type ValidationError string
+// Contains the signature of the op that expired.
+func OpStaleError(opSig string) *Error {
+	return New(OpStaleCode, opSig)
+}
+
+// Contains the name of the lock.
+func LockHeldError(name string) *Error {
+	return New(LockHeldCode, name)
+}
 
-func (e ValidationError) Error() string {
-	return fmt.Sprintf("Problem occured with validation on", string(e))
+// Contains the limit that was exceeded, e.g. "name of 300 bytes".
+func LockLimitError(limit string) *Error {
+	return New(LockLimitCode, limit)
+}
+
+// Contains the address of the banned peer.
+func PeerBannedError(minerAddr string) *Error {
+	return New(PeerBannedCode, minerAddr)
+}
+
+// Contains how long to wait before the token may make another call.
+func RateLimitedError(retryAfter time.Duration) *Error {
+	return New(RateLimitedCode, fmt.Sprint(retryAfter))
 }
 
 // </ERROR DEFS>
@@ -105,9 +376,33 @@ func (e ValidationError) Error() string {
 ////////////////////////////////////////////////////////////////////////////////
 // <FUNCTIONS>
 
+// Reports whether err, or any error it wraps, is of the named kind, e.g.
+// IsType(err, "InvalidTokenError")
 func IsType(err error, errType string) bool {
 	if err == nil {
 		return false
 	}
+	if code, exists := GetCode(errType); exists {
+		return errors.Is(err, New(code, ""))
+	}
 	return strings.HasSuffix(reflect.TypeOf(err).String(), errType)
 }
+
+// Returns the code of err, UnknownCode if it isn't a BlockArt error
+func GetErrorCode(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return UnknownCode
+}
+
+// Formats an error as its name followed by its details, e.g.
+// "ShapeOverlapError(<hash>)"
+func Describe(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return GetName(e.Code) + "(" + e.Details + ")"
+	}
+	return reflect.Indirect(reflect.ValueOf(err)).Type().Name() + "(" + err.Error() + ")"
+}
@@ -0,0 +1,90 @@
+package errorLib
+
+/*
+Usage:
+cd [errorlib]; go test
+*/
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+)
+
+// Test matching errors by code and details
+func TestIs(t *testing.T) {
+	err := ShapeOverlapError("abc")
+
+	if !errors.Is(err, ShapeOverlapError("")) {
+		t.Error("Expected ShapeOverlapError to match any ShapeOverlapError")
+	}
+	if !errors.Is(err, ShapeOverlapError("abc")) {
+		t.Error("Expected ShapeOverlapError to match the same details")
+	}
+	if errors.Is(err, ShapeOverlapError("def")) {
+		t.Error("Expected ShapeOverlapError not to match other details")
+	}
+	if errors.Is(err, ShapeOwnerError("")) {
+		t.Error("Expected ShapeOverlapError not to match ShapeOwnerError")
+	}
+	if !IsType(err, "ShapeOverlapError") || IsType(err, "ShapeOwnerError") {
+		t.Error("Expected IsType to match by name")
+	}
+}
+
+// Test wrapping, including errors that aren't BlockArt errors
+func TestWrap(t *testing.T) {
+	err := ValidationError("block").Wrap(InsufficientInkError(5))
+
+	if !errors.Is(err, ValidationError("")) || !errors.Is(err, New(InsufficientInkCode, "")) {
+		t.Error("Expected wrapped error to match both codes")
+	}
+	if err.Error() != "BlockArt: Problem occurred with validation on [block]: BlockArt: Not enough ink to addShape [5]" {
+		t.Error("Unexpected message", err.Error())
+	}
+
+	var cause *Error
+	if !errors.As(errors.Unwrap(err), &cause) || cause.Code != InsufficientInkCode {
+		t.Error("Expected Unwrap to return the cause")
+	}
+
+	err = DisconnectedError("addr").Wrap(errors.New("refused"))
+	if err.Cause.Code != UnknownCode || err.Error() != "BlockArt: cannot connect to [addr]: BlockArt: refused" {
+		t.Error("Unexpected message", err.Error())
+	}
+}
+
+// Test that errors keep their code, details and cause across gob
+func TestGob(t *testing.T) {
+	var sent error = ValidationError("block").Wrap(OutOfBoundsError(""))
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&sent); err != nil {
+		t.Fatal("Expected error to encode, got", err)
+	}
+
+	var received error
+	if err := gob.NewDecoder(&buffer).Decode(&received); err != nil {
+		t.Fatal("Expected error to decode, got", err)
+	}
+	if received.Error() != sent.Error() || !errors.Is(received, OutOfBoundsError("")) {
+		t.Error("Expected "+sent.Error()+", got", received)
+	}
+}
+
+// Test that codes and names can't be registered twice
+func TestRegister(t *testing.T) {
+	if GetName(ShapeOverlapCode) != "ShapeOverlapError" {
+		t.Error("Expected ShapeOverlapError, got", GetName(ShapeOverlapCode))
+	}
+	if code, exists := GetCode("InvalidTokenError"); !exists || code != InvalidTokenCode {
+		t.Error("Expected InvalidTokenCode, got", code)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a taken code to panic")
+		}
+	}()
+	Register(ShapeOverlapCode, "OtherError", "Other")
+}
@@ -2,34 +2,73 @@
 An ink miner that can be used in BlockArt
 
 Usage:
-go run ink-miner.go [server ip:port] [pubKey] [privKey]
+go run ink-miner.go run [-config file] [-server ip:port] [-listen ip:port] [-admin ip:port] [-data dir] [-json ip:port] [-keys file] [-observer] [-gateway file] [-noop-interval ms] [-quota MB] [-memory MB] [-geometry-engine name] [-presence] [-max-inbound n] [-max-outbound n] [-quarantine n] [-workers n] [-validation-workers n] [-mempool-ttl s] [-token-ttl s] [-rate-limit n] [-rate-burst n] [-op-batch-window ms] [-tls] [-tls-cert file -tls-key file] [-artnode-tls ip:port] [-priority name] [-bootstrap url|file] [-bootstrap-key pubKey] [-log-file file] [-log-timestamps] [server ip:port] [pubKey] [privKey]
+go run ink-miner.go keygen [-o file]
+go run ink-miner.go status [-admin ip:port]
+go run ink-miner.go restart [-admin ip:port]
+go run ink-miner.go peers [-admin ip:port] [-stats | -bans | -add ip:port | -remove ip:port | -ban ip:port [-for s] | -unban ip:port]
+go run ink-miner.go quarantine [-admin ip:port] [-o file]
+go run ink-miner.go snapshot [-admin ip:port] [-o file]
+go run ink-miner.go verify [-data dir]
+go run ink-miner.go export [-admin ip:port | -data dir] [-o file]
+go run ink-miner.go canvas [-admin ip:port] [-block hash] [-o name] | canvas -verify [-key pubKey] [-o name]
+go run ink-miner.go delegate [privKey] [artnode pubKey]
+go run ink-miner.go profile [-admin ip:port] [-kind name] [-seconds n] [-o file]
+go run ink-miner.go bench [-o file] [-baseline file] [-tolerance percent]
+go run ink-miner.go help [command]
 
 */
 
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/big"
 	"net"
+	"net/http"
+	httppprof "net/http/pprof"
 	"net/rpc"
+	"net/rpc/jsonrpc"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/internal/shapebench"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/oplib"
 	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
 )
 
@@ -38,26 +77,46 @@ import (
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <TYPE DECLARATIONS>
 
-// Represents the type of operation for a shape on the canvas
-type OpType int
+// Represents the type of operation for a shape on the canvas (see oplib)
+type OpType = oplib.OpType
 
 const (
-	ADD OpType = iota
-	REMOVE
+	ADD    = oplib.ADD
+	REMOVE = oplib.REMOVE
+	ALLOW  = oplib.ALLOW
+	ROTATE = oplib.ROTATE
 )
 
+// The TraceID of a request or response identifies the journey of the op or
+// block it carries: it is chosen when the op is submitted or the block
+// mined, passed on with every request that gossips them, and prefixed to
+// every log line about them, so that one op can be followed across
+// miners' logs. Requests without one get a new one where they arrive.
 type MinerResponse struct {
 	Error   error
 	Payload []interface{}
+	TraceID string
 }
 
 type MinerRequest struct {
 	Payload []interface{}
+	TraceID string
+
+	// The gossip envelope of SendBlock, SendOp and SendOps: when the
+	// sending miner started (in Unix nanoseconds), the number of the
+	// message among those it has sent since, starting at 1, and the
+	// sending miner's key and its signature of the envelope. See
+	// sealGossip and GossipReplayGuard.
+	Epoch        int64
+	Seq          uint64
+	PubKeyString string
+	EnvelopeSig  string
 }
 
 type ArtnodeRequest struct {
 	Token   string
 	Payload []interface{}
+	TraceID string
 }
 
 // Settings for a canvas in BlockArt.
@@ -89,6 +148,24 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8
 	PoWDifficultyNoOpBlock uint8
 
+	// Whether filled paths that aren't closed are closed automatically
+	// instead of being rejected
+	AutoCloseOpenPaths bool
+
+	// Most vertices a shape may have, 0 for shapelib.DEFAULT_MAX_VERTICES
+	MaxShapeVertices uint32
+
+	// Depth below the head at which miners attest to the blocks of their
+	// main chain, 0 if miners don't attest and blocks are never final
+	FinalityDepth uint32
+
+	// Percentage of the blocks of a block's finality window whose miners
+	// must attest to it to make it final, 0 for DEFAULT_FINALITY_QUORUM
+	FinalityQuorum uint8
+
+	// Most ops a block may have, 0 for DEFAULT_MAX_OPS_PER_BLOCK
+	MaxOpsPerBlock uint32
+
 	// Canvas settings
 	CanvasSettings CanvasSettings
 }
@@ -96,11 +173,285 @@ type MinerNetSettings struct {
 // Used to send heartbeat to the server just shy of 1 second each beat
 const TIME_BUFFER uint32 = 500
 
+// Error the server returns for a key it has no registration for
+const SERVER_UNKNOWN_KEY_ERROR string = "BlockArt server: unknown key"
+
+// Maximum number of ops for which rejection reasons are retained
+const MAX_REJECTION_LOG_OPS int = 1000
+
+// Maximum number of ops for which the peers known to hold them are retained
+const MAX_RECEIPT_LOG_OPS int = 1000
+
+// Maximum number of ops and blocks whose trace IDs are retained, and the
+// longest trace ID accepted from an art node or another miner
+const MAX_TRACE_LOG_ENTRIES int = 10000
+const MAX_TRACE_ID_LENGTH int = 64
+
+// How far behind the newest message received from a peer a SendBlock or
+// SendOp may arrive out of order without being dropped as a replay
+const GOSSIP_REPLAY_WINDOW uint64 = 64
+
+// Number of recent blockchain head changes used to recommend a validateNum
+const MAX_FORK_STATS_HEAD_CHANGES int = 100
+
+// Number of recent main chain block intervals used to estimate how long
+// ops take to be validated
+const MAX_BLOCK_INTERVALS int = 100
+
+// Default number of recent invalid blocks kept in the quarantine
+const DEFAULT_QUARANTINE_BLOCKS int = 100
+
+// Number of received ops and blocks that can be queued for the event
+// applier before the RPCs delivering them block
+const EVENT_INBOX_SIZE int = 100
+
+// Number of events buffered for each event bus subscriber. A subscriber
+// that falls further behind misses events.
+const EVENT_SUBSCRIBER_BUFFER int = 100
+
+// Longest that WaitForCanvasChange may block for, in milliseconds, and
+// how often it checks for a new blockchain head
+const MAX_CANVAS_WAIT uint32 = 30000
+const CANVAS_WAIT_POLL uint32 = 50
+
+// Seconds an advisory lock is held for if no duration is given, and most
+// seconds it may be held for before it has to be renewed
+const DEFAULT_LOCK_SECONDS uint32 = 30
+const MAX_LOCK_SECONDS uint32 = 600
+
+// Most bytes in the name of an advisory lock, and most locks one art node
+// session may hold
+const MAX_LOCK_NAME_LENGTH int = 256
+const MAX_SESSION_LOCKS int = 100
+
+// Most blocks GetChildren returns in one call
+const MAX_CHILDREN_PAGE uint32 = 1000
+
+// Most blocks GetBlocksByOwner returns in one call. The rest can be fetched
+// from the block number after the last one returned.
+const MAX_OWNER_BLOCKS_PAGE uint32 = 1000
+
+// Most shapes GetSvgStrings returns the svg strings of in one call
+const MAX_SVG_STRINGS_BATCH uint32 = 1000
+
+// Most unmined ops a miner lists in its reply to a ping, oldest first
+const MAX_MEMPOOL_SUMMARY_OPS int = 100
+
+// Most unmined ops miners exchange when they connect, oldest first. Bounds
+// the bandwidth of a mempool sync.
+const MAX_MEMPOOL_SYNC_OPS int = 1000
+
+// Milliseconds between re-announcements of this miner's own unmined ops,
+// and after which an op is no longer re-announced
+const OP_REGOSSIP_INTERVAL uint32 = 5000
+const OP_REGOSSIP_EXPIRY uint32 = 300000
+
+// Default milliseconds an op disseminated by this miner waits for others to
+// be sent along with it in one SendOps message, and most ops in a message
+const DEFAULT_OP_BATCH_WINDOW uint = 20
+const MAX_OP_BATCH uint32 = 100
+
+// Default seconds after an op is created that it expires from the mempool
+// if it still hasn't been mined, and milliseconds between the miner's
+// checks for expired ops
+const DEFAULT_MEMPOOL_TTL uint = 3600
+const MEMPOOL_EXPIRY_INTERVAL uint32 = 5000
+
+// Default seconds after an artnode token is issued that it expires, seconds
+// after a nonce is handed out that it can no longer be exchanged for a
+// token, and milliseconds between the miner's sweeps of expired tokens and
+// nonces
+const DEFAULT_TOKEN_TTL uint = 86400
+const NONCE_TTL uint32 = 300
+const TOKEN_EXPIRY_INTERVAL uint32 = 10000
+
+// Default seconds a delegation printed by "ink-miner delegate" is valid for
+const DEFAULT_DELEGATION_TTL uint = 30 * 86400
+
+// Default calls per second each artnode token may make on average, and
+// most calls it may make at once, before its calls fail with a
+// RateLimitedError (see TokenRateLimiter)
+const DEFAULT_RATE_LIMIT uint = 50
+const DEFAULT_RATE_BURST uint = 100
+
+// Milliseconds a TLS handshake with a peer may take, and the least
+// milliseconds between fetches of the registered miner keys when a peer
+// presents a key that doesn't match them (see MinerRegistry)
+const TLS_HANDSHAKE_TIMEOUT uint32 = 5000
+const PEER_KEYS_REFRESH uint32 = 5000
+
+// Default address of the admin RPC socket. The admin socket only ever
+// listens on the loopback interface.
+const DEFAULT_ADMIN_ADDR string = "127.0.0.1:7070"
+
+// Number of the newest main chain blocks, oldest unmined ops and largest ink
+// accounts shown on the admin dashboard, and the seconds between reloads
+const DASHBOARD_BLOCKS int = 20
+const DASHBOARD_OPS int = 50
+const DASHBOARD_ACCOUNTS int = 20
+const DASHBOARD_REFRESH int = 5
+
+// Percentage by which a benchmark may be slower than its baseline before
+// the bench command fails
+const DEFAULT_BENCH_TOLERANCE float64 = 25
+
+// Milliseconds the bench command times each geometry op for, at least
+const BENCH_TIME uint32 = 1000
+
+// Weight of the newest round-trip time in a peer's smoothed latency
+const PEER_LATENCY_SMOOTHING float64 = 0.25
+
+// Milliseconds between checks for ops while a no-op block is held back
+const NOOP_BACKOFF_POLL uint32 = 50
+
+// Nonces each mining worker hashes before the mining loop checks for a new
+// longest chain and new ops again
+const MINING_BATCH_NONCES uint32 = 1000
+
+// Number of head changes in a row on which a pinned op may fail
+// revalidation before it is unpinned
+const MAX_PIN_RETRIES uint32 = 10
+
+// Milliseconds a gateway waits for a backend miner to answer a call
+const GATEWAY_TIMEOUT uint32 = 10000
+
+// Most blocks after which a shape can expire, which bounds how far back
+// applying a block looks for expiring shapes
+const MAX_EXPIRY_BLOCKS uint32 = 1000
+
+// Percentage of an expired shape's ink cost refunded to its payer
+const EXPIRY_REFUND_PERCENT uint32 = 50
+
+// Version of the miner and artnode RPCs, returned by GetSettings. Raised
+// whenever they change in a way older art nodes or miners can't handle.
+const PROTOCOL_VERSION uint32 = 1
+
+// Default number of peers that may connect to this miner, and that it
+// connects to itself
+const DEFAULT_MAX_INBOUND_PEERS int = 16
+const DEFAULT_MAX_OUTBOUND_PEERS int = 8
+
+// Number of the longest connected peers that are never evicted to make
+// room for a new one
+const NUM_ANCHOR_PEERS int = 2
+
+// Number of times a soft restart tries to register with the server, a
+// heartbeat apart, while the server still holds the miner's registration
+const RESTART_REGISTER_ATTEMPTS int = 5
+
+// Most milliseconds a shutting down miner waits for its blocks and ops to
+// finish sending to its peers, and for the server to deregister it
+const SHUTDOWN_TIMEOUT uint32 = 5000
+
+// Number of the most recent main chain blocks whose bodies are never
+// pruned from a store, so that forks and peers catching up can still be
+// served from it
+const MIN_UNPRUNED_BLOCKS int = 100
+
+// Prefix of a stored op's svg string that refers to the svg string stored
+// under the hash that follows in a store's svgs directory (see
+// BlockStore.storeSvgs)
+const SVG_REF_PREFIX = "@svg:"
+
+var svgRefPattern = regexp.MustCompile(SVG_REF_PREFIX + "[0-9a-f]{64}")
+
+// Number of the most recent main chain blocks a bootstrap snapshot has the
+// bodies of, the most bytes a miner reads of one, and the most milliseconds
+// it waits for one to download
+const BOOTSTRAP_RECENT_BLOCKS int = 100
+const MAX_BOOTSTRAP_BYTES int64 = 1 << 30
+const BOOTSTRAP_TIMEOUT uint32 = 300000
+
+// Number of blocks of a chain being applied that may be prechecked ahead
+// of the block being applied
+const MAX_PRECHECKED_BLOCKS int = 256
+
+// Number of blocks whose bodies a syncing miner downloads from a peer in
+// one request, and the most such requests it has in flight at once
+const SYNC_CHUNK_BLOCKS int = 100
+const MAX_PARALLEL_BODY_DOWNLOADS int = 8
+
+// Percentage of the blocks of a block's finality window whose miners must
+// attest to it to make it final, unless the network settings set another
+const DEFAULT_FINALITY_QUORUM uint8 = 67
+
+// Number of main chain blocks, ending at a block, whose miners may attest
+// to it: each miner's attestation counts for as many of those blocks as it
+// mined. A say in finality has to be earned with work, so a miner gains
+// nothing by registering more keys with the server.
+const FINALITY_WINDOW uint32 = 100
+
+// Most ops a block may have, unless the network settings set another. Bounds
+// the time it takes to hash, send and validate a block.
+const DEFAULT_MAX_OPS_PER_BLOCK uint32 = 1000
+
+// Most pixels an image rendered by RenderRegionPNG may have
+const MAX_RENDER_PIXELS uint32 = 1 << 20
+
+// Seconds Admin.Profile records a CPU profile for by default, and at most
+const DEFAULT_PROFILE_SECONDS uint32 = 30
+const MAX_PROFILE_SECONDS uint32 = 600
+
+// Milliseconds between a miner's checks for new blocks to attest to, and
+// the most blocks it attests to in one check
+const ATTESTATION_INTERVAL uint32 = 1000
+const MAX_ATTESTATIONS_PER_INTERVAL int = 100
+
+// Milliseconds between checks of the miner's memory use against its budget
+const RESOURCE_CHECK_INTERVAL uint32 = 1000
+
+// A peer releases a secret chain when it announces at least
+// WITHHOLDING_MIN_RELEASE blocks back to back, at most
+// WITHHOLDING_BURST_INTERVAL milliseconds apart, starting with a block at
+// least WITHHOLDING_MIN_AGE blocks old, and the last of them reorgs the
+// main chain (see recordAnnouncedBlock). Each released block costs the peer
+// WITHHOLDING_PENALTY points of its score, and a peer that releases
+// WITHHOLDING_ALERT_RELEASES chains is reported as withholding blocks.
+const WITHHOLDING_MIN_RELEASE uint32 = 3
+const WITHHOLDING_BURST_INTERVAL uint32 = 1000
+const WITHHOLDING_MIN_AGE uint32 = 2
+const WITHHOLDING_PENALTY uint64 = 10
+const WITHHOLDING_ALERT_RELEASES uint64 = 3
+
+// Milliseconds since an art node session last made a call within which it
+// counts as online
+const PRESENCE_WINDOW uint32 = 60000
+
+// Most keys a shape's metadata may have, and most bytes in a key and in a
+// value
+const MAX_METADATA_KEYS int = 16
+const MAX_METADATA_KEY_LENGTH int = 64
+const MAX_METADATA_VALUE_LENGTH int = 1024
+
+// Least milliseconds between two pulls of a shape's metadata from the peers
+const METADATA_PULL_INTERVAL uint32 = 60000
+
+// Approximate bytes taken by an op record, a block, a shape geometry and a
+// map entry besides the strings they hold, used to estimate memory use
+const OP_RECORD_OVERHEAD int64 = 512
+const BLOCK_OVERHEAD int64 = 256
+const GEOMETRY_OVERHEAD int64 = 1024
+const ENTRY_OVERHEAD int64 = 64
+
+// The miner's state is guarded by lock. Every RPC handler, the mining loop
+// and the background loops (op regossip, attestations, the resource
+// budget) hold it while they read or change the state, and everything
+// they call expects it to be held. Ops and blocks received from peers are
+// applied one at a time by applyEvents (see EventBus), so SendOp and
+// SendBlock never interleave their validation, reorgs or dissemination,
+// and the mining loop takes the lock between batches of nonces, which its
+// workers hash without it, so it notices a new head (newLongestChain)
+// within a batch.
+// Goroutines that wait on a peer are handed what they need first, and
+// only take the lock again to record the outcome. Art node reads are
+// answered from the read replica (replicaLock) and pings from the mempool
+// summary (mempoolLock), so that neither waits for lock.
 type Miner struct {
 	lock            *sync.RWMutex
 	logger          *log.Logger
 	localAddr       net.Addr
 	serverAddr      string
+	keyFile         string
 	serverConn      *rpc.Client
 	miners          map[string]*rpc.Client
 	blockchain      map[string]*Block
@@ -110,35 +461,109 @@ type Miner struct {
 	privKey         ecdsa.PrivateKey
 	pubKeyString    string
 	inkAccounts     map[string]uint32
+	allowances      map[string]map[string]uint32
+	rotatedKeys     map[string]KeyRotation
+	revocations     map[string]uint32
 	settings        *MinerNetSettings
-	nonces          map[string]bool
-	tokens          map[string]bool
+	nonces          map[string]time.Time
+	tokens          map[string]*ArtnodeSession
 	newLongestChain bool
 	unminedOps      map[string]*OperationRecord
 	unvalidatedOps  map[string]*OperationRecord
 	validatedOps    map[string]*OperationRecord
 	failedOps       map[string]*OperationRecord
 	tempOps         map[string]*OperationRecord
+	rpcAddr         string
+	adminAddr       string
+	jsonAddr        string
+	artnodeTLSAddr  string
+	store           *BlockStore
+	rejections      *OpRejectionLog
+	receipts        *OpReceiptLog
+	opSources       map[string]string
+	forkStats       *ForkStats
+	blockIntervals  *BlockIntervalStats
+	quarantine      *BlockQuarantine
+	observer        bool
+	peerLatencies   map[string]time.Duration
+	noOpInterval    time.Duration
+	mempoolTTL      time.Duration
+	tokenTTL        time.Duration
+	opBatch         []*OperationRecord
+	opBatchWindow   time.Duration
+	miningWorkers   []*MiningWorker
+	numValidators   int
+	lastNoOpBlock   time.Time
+	pinnedOps       map[string]uint32
+	events          *EventBus
+	peerMempools    map[string]MempoolSummary
+	pulledOps       map[string]bool
+	mempoolLock     sync.Mutex
+	mempool         MempoolSummary
+	replicaLock     sync.Mutex
+	replica         *ReadReplica
+	minedBlocks     map[string][]string
+	expiredOps      map[string]bool
+	prunedOps       map[string]bool
+	backends        []*GatewayBackend
+	nextBackend     int
+	gatewayLock     sync.Mutex
+	quiet           bool
+	peerSlots       map[string]*PeerSlot
+	peerStats       map[string]*peerCounters
+	maxInbound      int
+	maxOutbound     int
+	positions       map[string]ChainPosition
+	ledgers         map[string]InkLedger
+	geometries      map[string]shapelib.ShapeGeometry
+	occupancy       *shapelib.CanvasOccupancy
+	attestations    map[string]map[string]Attestation
+	finalBlock      string
+	budget          *ResourceBudget
+	engine          shapelib.GeometryEngine
+	priority        PriorityPolicy
+	presence        bool
+	activityLock    sync.Mutex
+	tokenActivity   map[string]time.Time
+	withholding     map[string]*WithholdingStats
+	traces          *TraceLog
+	gossipEpoch     int64
+	gossipSeq       uint64
+	replayGuard     *GossipReplayGuard
+	registry        *MinerRegistry
+	arrivals        *BlockArrivals
+	locks           *AdvisoryLocks
+	bans            *PeerBans
+	peerTLS         *PeerTLS
+	artnodeTLS      *PeerTLS
+	limiter         *TokenRateLimiter
+	stopping        chan struct{}
+	stopOnce        sync.Once
+	sends           int64
+	metadata        map[string]map[string]ShapeMetadata
+	metadataPulls   map[string]time.Time
 }
 
 type Block struct {
-	BlockNo      uint32
-	PrevHash     string
-	Records      []OperationRecord
+	BlockNo  uint32
+	PrevHash string
+	Records  []OperationRecord
+
+	// Summary of Records, checked during validation so that it can be
+	// relied on without iterating Records. InkDebited is the ink spent by
+	// ADD ops and InkCredited the ink refunded by REMOVE ops; neither
+	// includes the mining reward.
+	OpCount     uint64
+	InkDebited  uint64
+	InkCredited uint64
+
 	PubKeyString string
 	Nonce        uint32
 }
 
-type Operation struct {
-	Type         OpType
-	Shape        shapelib.Shape
-	Ref          string
-	InkCost      uint32
-	ValidateNum  uint8
-	NumRemaining uint8
-	TimeStamp    int64
-	Deleted      bool
-}
+// An op as it is signed. Its encoding is shared with blockartlib, which
+// drafts ops for art nodes to sign themselves.
+type Operation = oplib.Operation
 
 type OperationRecord struct {
 	Op           Operation
@@ -147,16 +572,94 @@ type OperationRecord struct {
 	Error        error
 }
 
+// Returns the public key whose ink pays for the op
+func (r *OperationRecord) getPayer() string {
+	if r.Op.Payer != "" {
+		return r.Op.Payer
+	}
+	return r.PubKeyString
+}
+
 type Signature struct {
 	R *big.Int
 	S *big.Int
 }
 
+// A miner's permission for an art node key to open canvases on it until
+// Expiry (in Unix seconds). R and S sign getDelegationDigest.
+type Delegation struct {
+	Expiry int64
+	R      *big.Int
+	S      *big.Int
+}
+
 type MinerInfo struct {
 	Address net.Addr
 	Key     ecdsa.PublicKey
 }
 
+// A request to the server to deregister the miner, signed with the
+// miner's key, see newDeregisterRequest
+type DeregisterRequest struct {
+	Key       ecdsa.PublicKey
+	Timestamp int64
+	R         *big.Int
+	S         *big.Int
+}
+
+// The outcome of a soft restart, returned by Admin.Restart
+type RestartResult struct {
+	PubKeyString   string
+	KeyChanged     bool
+	NumPeers       int
+	BlocksReceived int
+}
+
+// A profile for Admin.Profile to capture: "cpu", recorded for Seconds (0
+// for DEFAULT_PROFILE_SECONDS), or a runtime profile such as "heap" or
+// "goroutine". It is written to File on the miner's host, or to a new file
+// in its temp directory if File is empty.
+type ProfileRequest struct {
+	Kind    string
+	Seconds uint32
+	File    string
+}
+
+// Height of a block and the proof of work of the chain ending in it,
+// recorded from its parent's when it is inserted so that chains can be
+// compared without walking them
+type ChainPosition struct {
+	Height uint32
+
+	// Expected number of hashes to mine every block up to this one
+	Work uint64
+}
+
+// Ink minted, spent and refunded by the chain ending in a block, recorded
+// from its parent's when the block is applied so that the ledger of any
+// head is known without replaying its chain
+type InkLedger struct {
+	OpBlocks   uint32
+	NoOpBlocks uint32
+
+	// Ink rewarded to the miners of the blocks
+	Minted uint64
+
+	// Ink costs of the shapes added, and of those deleted since, which are
+	// refunded in full
+	Spent    uint64
+	Refunded uint64
+
+	// Ink costs of the shapes that expired, and the part of them refunded
+	Expired        uint64
+	ExpiryRefunded uint64
+}
+
+// Returns the ink held by the shapes still on the canvas
+func (l InkLedger) getBurned() uint64 {
+	return l.Spent - l.Refunded - l.Expired
+}
+
 type BlockchainMap struct {
 	Blockchain map[string]*Block
 	Lock       sync.RWMutex
@@ -169,1073 +672,11149 @@ type Pair struct {
 
 type PairList []Pair
 
-// </TYPE DECLARATIONS>
-////////////////////////////////////////////////////////////////////////////////////////////
+// Bounded log of the reasons each op was rejected, keyed by OpSig and then
+// by the address of the rejecting miner. Once full, the ops that were
+// first rejected the longest ago are evicted.
+type OpRejectionLog struct {
+	capacity int
+	order    []string
+	reasons  map[string]map[string]string
+}
 
-//
+// Bounded log of when each peer was last known to hold an op, keyed by
+// OpSig and then by the peer's address. A peer holds an op once it accepts
+// it from this miner, sends it to this miner, or lists it in an inventory
+// exchange (a ping, a mempool sync or a HasOps reply). Once full, the ops
+// that were first acknowledged the longest ago are evicted.
+type OpReceiptLog struct {
+	capacity int
+	order    []string
+	receipts map[string]map[string]time.Time
+}
 
-var (
-	logger   *log.Logger
-	alphabet = []rune("0123456789abcdef")
-)
+// Trace IDs of the ops and blocks this miner has seen, keyed by op
+// signature or block hash. Only the most recent entries are kept, and the
+// first trace ID seen for an op or block is the one kept. A nil log
+// records nothing. It has its own lock, since ops are served from the
+// mempool without the miner's lock.
+type TraceLog struct {
+	lock     sync.Mutex
+	capacity int
+	ids      map[string]string
+	order    []string
+}
 
-func main() {
-	logger = log.New(os.Stdout, "[Initializing]\n", log.Lshortfile)
-	gob.Register(&elliptic.CurveParams{})
-	gob.Register(&net.TCPAddr{})
-	gob.Register([]Block{})
-	gob.Register(Block{})
-	gob.Register(Operation{})
-	gob.Register(OperationRecord{})
-	gob.Register(errorLib.InvalidBlockHashError(""))
-	gob.Register(errorLib.DisconnectedError(""))
-	gob.Register(errorLib.InvalidShapeSvgStringError(""))
-	gob.Register(errorLib.ShapeSvgStringTooLongError(""))
-	gob.Register(errorLib.InvalidShapeHashError(""))
-	gob.Register(errorLib.ShapeOwnerError(""))
-	gob.Register(errorLib.OutOfBoundsError{})
-	gob.Register(errorLib.ShapeOverlapError(""))
-	gob.Register(errorLib.InvalidShapeFillStrokeError(""))
-	gob.Register(errorLib.InvalidSignatureError{})
-	gob.Register(errorLib.InvalidTokenError(""))
-	gob.Register(errorLib.ValidationError(""))
-	gob.Register(errorLib.InsufficientInkError(0))
-	miner := new(Miner)
-	miner.init()
-	miner.listenRPC()
-	miner.registerWithServer()
-	miner.getMiners()
-	miner.initBlockchain()
-	logger.SetPrefix("[Mining]\n")
-	for {
-		miner.mineBlock()
-	}
+// The SendBlock and SendOp messages received from each peer, keyed by the
+// address the peer sends them from, so that a captured stream of them
+// can't be replayed to waste validation or resurrect expired ops. A peer
+// numbers its messages in increasing order from when it started (see
+// MinerRequest), so a message is dropped if it comes from an earlier start
+// of the peer, was already received, or is more than GOSSIP_REPLAY_WINDOW
+// messages older than the newest one received. A message must also be
+// sealed by the miner registered with the server for the address it says
+// it comes from, so that its number can't be stripped or changed and a
+// peer can't send messages as another; messages that aren't are dropped
+// without being counted as replays. A nil guard lets every message
+// through. It has its own lock, since messages are checked before they
+// are queued for the miner's lock.
+type GossipReplayGuard struct {
+	registry *MinerRegistry
+	lock     sync.Mutex
+	windows  map[string]*gossipWindow
+	replayed map[string]uint64
 }
 
-//
+// The messages received from a peer since it last started: the newest
+// one, and which of the GOSSIP_REPLAY_WINDOW before it (bit i for the
+// message i older) were received
+type gossipWindow struct {
+	epoch   int64
+	highest uint64
+	seen    uint64
+}
 
-////////////////////////////////////////////////////////////////////////////////////////////
-// <PRIVATE METHODS : MINER>
+// Blocks that peers send while the same block is already known or being
+// applied, dropped before they reach the validation pipeline. A block
+// whose hash is in the blocktree is dropped, and one that arrives while the
+// same block from another peer is queued or being validated waits for that
+// block's outcome instead of being queued again. Duplicates are counted by
+// the address they came from. A nil set lets every block through. It has
+// its own lock, since blocks are checked before they are queued for the
+// miner's lock.
+type BlockArrivals struct {
+	lock       sync.Mutex
+	inFlight   map[string]*blockArrival
+	duplicates map[string]uint64
+}
 
-func (m *Miner) init() {
-	args := os.Args[1:]
-	m.serverAddr = args[0]
-	m.blockChildren = make(map[string][]string)
-	m.nonces = make(map[string]bool)
-	m.tokens = make(map[string]bool)
-	m.miners = make(map[string]*rpc.Client)
-	m.lock = &sync.RWMutex{}
-	if len(args) <= 1 {
-		logger.Fatalln("Missing keys, please generate with: go run generateKeys.go")
-	}
+// A block that is queued or being validated; err is its outcome once done
+// is closed
+type blockArrival struct {
+	done chan struct{}
+	err  error
+}
 
-	privBytes, _ := hex.DecodeString(args[2])
-	privKey, err := x509.ParseECPrivateKey(privBytes)
-	if checkError(err) != nil {
-		log.Fatalln("Error with Private Key")
-	}
+// Advisory locks that art node sessions hold on names, e.g. a shape hash or
+// a region of the canvas, so that art nodes sharing a miner can coordinate
+// their edits. Locks are kept by the miner alone, off the chain: they cost
+// no ink, aren't gossiped and aren't enforced on ops. A lock is held until
+// it is released, it expires or its session ends. Version is bumped on
+// every change, so that art nodes can long-poll for changes. It has its own
+// lock, so that it can be polled without the miner's lock.
+type AdvisoryLocks struct {
+	lock    sync.Mutex
+	locks   map[string]*AdvisoryLock
+	version uint64
+}
 
-	pubKey := decodeStringPubKey(args[1])
+// An advisory lock on a name, held by the session of a token until Expires
+type AdvisoryLock struct {
+	Name         string
+	Token        string
+	PubKeyString string
+	Expires      time.Time
+}
 
-	// Verify if keys are correct
-	data := []byte("Hello World")
-	r, s, _ := ecdsa.Sign(rand.Reader, privKey, data)
-	if !ecdsa.Verify(pubKey, data, r, s) {
-		logger.Fatalln("Keys don't match, try again")
-	} else {
-		logger.Println("Keys are correct and verified")
-	}
+// The peers an operator has banned with Admin.BanPeer, by address, with
+// when each ban ends (the zero time for a ban that doesn't). A banned peer
+// isn't connected to, its connections are refused and the blocks and ops
+// it sends are dropped. Bans are kept in the block store, if the miner has
+// one, so that they outlast a restart. A nil list bans no one. It has its
+// own lock, since messages are checked before they are queued for the
+// miner's lock.
+type PeerBans struct {
+	lock sync.Mutex
+	bans map[string]time.Time
+}
 
-	m.privKey = *privKey
-	m.pubKey = *pubKey
-	m.pubKeyString = args[1]
+// A token bucket for each artnode token, which fills up at rate calls per
+// second to burst calls, and which each call the token makes takes one
+// from. Calls made while the bucket is empty fail with a RateLimitedError,
+// so that an art app calling in a tight loop can't hog the miner. A nil
+// limiter limits no one. It has its own lock, since reads answered from the
+// read replica don't take the miner's lock.
+type TokenRateLimiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
 
-	m.newLongestChain = false
+// Calls a token could make at once when its bucket was last updated
+type tokenBucket struct {
+	calls   float64
+	updated time.Time
 }
 
-func (m *Miner) listenRPC() {
-	addrs, _ := net.InterfaceAddrs()
-	var externalIP string
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				externalIP = ipnet.IP.String()
-			}
-		}
-	}
-	externalIP = externalIP + ":0"
-	tcpAddr, err := net.ResolveTCPAddr("tcp", externalIP)
-	checkError(err)
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	checkError(err)
-	rpc.Register(m)
-	m.localAddr = listener.Addr()
-	logger.Println("Listening on: ", listener.Addr().String())
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			checkError(err)
-			logger.Println("New connection!")
-			go rpc.ServeConn(conn)
-		}
-	}()
+// A banned peer, as listed by Admin.Bans and stored in the block store
+type PeerBan struct {
+	Address string
+	Until   time.Time
 }
 
-// Ink miner registers their address and public key to the server and starts sending heartbeats
-func (m *Miner) registerWithServer() {
-	serverConn, err := rpc.Dial("tcp", m.serverAddr)
-	if checkError(err) != nil {
-		log.Fatal("Server is not reachable")
-	}
-	settings := new(MinerNetSettings)
-	err = serverConn.Call("RServer.Register", &MinerInfo{m.localAddr, m.pubKey}, settings)
-	if checkError(err) != nil {
-		//TODO: Crashing for now, will need to revisit if there is any softer way to handle the error
-		log.Fatal("Couldn't Register to Server")
-	}
-	m.serverConn = serverConn
-	m.settings = settings
-	go m.startHeartBeats()
+// Arguments of Admin.BanPeer: the peer's address and how many seconds to
+// ban it for (0 bans it for good)
+type BanRequest struct {
+	Address string
+	Seconds uint32
 }
 
-// Sends heartbeats every half second to the server to maintain connection
-func (m *Miner) startHeartBeats() {
-	var ignored bool
-	m.serverConn.Call("RServer.HeartBeat", m.pubKey, &ignored)
-	for {
-		time.Sleep(time.Duration(m.settings.HeartBeat-TIME_BUFFER) * time.Millisecond)
-		m.serverConn.Call("RServer.HeartBeat", m.pubKey, &ignored)
+// Depths of the most recent blockchain head changes, where the depth is
+// the number of blocks abandoned from the old head (0 for a fast-forward).
+// Once full, the oldest head changes are evicted.
+type ForkStats struct {
+	capacity int
+	depths   []uint32
+}
+
+// The times between the most recent blocks to extend the main chain, as
+// this miner saw them. A head change that extends the chain by several
+// blocks at once is spread evenly over them. Once full, the oldest
+// intervals are evicted.
+type BlockIntervalStats struct {
+	capacity   int
+	intervals  []time.Duration
+	lastHeight uint32
+	lastTime   time.Time
+}
+
+// The most recent received blocks that failed validation, kept so that
+// attacks and bugs can be looked into after the fact. Once full, the
+// oldest blocks are evicted. A capacity of 0 keeps none.
+type BlockQuarantine struct {
+	capacity int
+	blocks   []QuarantinedBlock
+}
+
+// One kind of the miner's state whose memory is budgeted. usage estimates
+// the bytes it holds, and evict frees at least the given bytes if it can,
+// lowest priority entries first, returning the bytes freed and the number
+// of entries evicted. A pool without evict is only measured.
+type ResourcePool struct {
+	name  string
+	usage func(m *Miner) int64
+	evict func(m *Miner, bytes int64) (freed int64, evicted int)
+}
+
+// The memory a miner may use for its pools, and what it last measured. A
+// limit of 0 measures without ever evicting.
+type ResourceBudget struct {
+	limit     int64
+	usage     map[string]int64
+	evictions map[string]uint64
+}
+
+// Represents the type of an event on a miner's event bus
+type EventType int
+
+const (
+	OP_RECEIVED EventType = iota
+	BLOCK_RECEIVED
+	HEAD_CHANGED
+)
+
+// Something that happened to a miner. OP_RECEIVED carries the op and the
+// address of the miner it came from (if known), BLOCK_RECEIVED the block,
+// and HEAD_CHANGED the old and new head hashes. Err is the outcome of
+// applying a received op or block.
+type MinerEvent struct {
+	Type    EventType
+	Op      *OperationRecord
+	Source  string
+	Block   *Block
+	OldHead string
+	NewHead string
+	Err     error
+
+	// Trace ID of the op or block, for HEAD_CHANGED that of the new head
+	TraceID string
+
+	done chan error
+}
+
+// Decouples the RPCs that receive ops and blocks from the changes they make
+// to the miner's state: received ops and blocks are queued on the inbox and
+// applied one at a time by a single goroutine, and every event is then
+// published to subscribers and counted.
+type EventBus struct {
+	lock        sync.Mutex
+	inbox       chan *MinerEvent
+	subscribers []chan MinerEvent
+	counts      map[EventType]uint64
+}
+
+// An art node connected to this miner, identified by its token
+type ArtnodeSession struct {
+	// Public key the art node authenticated with: either the miner's own
+	// key or a key the miner has delegated to
+	PubKeyString string
+
+	// Signatures of the ops submitted with this token
+	OpSigs []string
+
+	// Most ink the token may spend, on shapes and on allowances (which
+	// others can spend), and most ops it may submit; 0 for no limit. Set
+	// when the token is issued.
+	InkQuota uint32
+	OpQuota  uint32
+
+	InkSpent uint32
+	NumOps   uint32
+
+	// When the token was issued, and when it expires (never if zero)
+	Created time.Time
+	Expires time.Time
+}
+
+// Counts an op costing inkCost against the session's quota. Returns a
+// QuotaError, without counting it, if it would exceed the quota.
+func (s *ArtnodeSession) spendQuota(inkCost uint32) error {
+	if s.OpQuota != 0 && s.NumOps >= s.OpQuota {
+		return errorLib.QuotaError(fmt.Sprintf("ops %d/%d", s.OpQuota-s.NumOps, s.OpQuota))
+	} else if s.InkQuota != 0 && uint64(s.InkSpent)+uint64(inkCost) > uint64(s.InkQuota) {
+		return errorLib.QuotaError(fmt.Sprintf("ink %d/%d", s.InkQuota-s.InkSpent, s.InkQuota))
 	}
+
+	s.InkSpent += inkCost
+	s.NumOps++
+	return nil
 }
 
-// Gets miners from server if below MinNumMinerConnections
-func (m *Miner) getMiners() {
-	var addrSet []net.Addr
-	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if !isConnected {
-			delete(m.miners, minerAddr)
-		}
+// Undoes spendQuota for an op that wasn't submitted after all
+func (s *ArtnodeSession) refundQuota(inkCost uint32) {
+	s.InkSpent -= inkCost
+	s.NumOps--
+}
+
+// Returns how much ink and how many ops the session has left,
+// math.MaxUint32 for no limit
+func (s *ArtnodeSession) getQuotaLeft() (inkLeft uint32, opsLeft uint32) {
+	inkLeft, opsLeft = math.MaxUint32, math.MaxUint32
+	if s.InkQuota != 0 {
+		inkLeft = s.InkQuota - s.InkSpent
 	}
-	if len(m.miners) < int(m.settings.MinNumMinerConnections) {
-		m.serverConn.Call("RServer.GetNodes", m.pubKey, &addrSet)
-		m.connectToMiners(addrSet)
+	if s.OpQuota != 0 {
+		opsLeft = s.OpQuota - s.NumOps
 	}
+	return
 }
 
-// Establishes RPC connections with miners in addrs array
-func (m *Miner) connectToMiners(addrs []net.Addr) {
-	for _, minerAddr := range addrs {
-		if m.miners[minerAddr.String()] == nil {
-			minerConn, err := rpc.Dial("tcp", minerAddr.String())
-			if err != nil {
-				log.Println(err)
-				delete(m.miners, minerAddr.String())
-			} else {
-				m.miners[minerAddr.String()] = minerConn
-				response := new(MinerResponse)
-				request := new(MinerRequest)
-				request.Payload = make([]interface{}, 1)
-				request.Payload[0] = m.localAddr.String()
-				minerConn.Call("Miner.BidirectionalSetup", request, response)
-			}
-		}
-	}
+// Receiver for the artnode RPCs served over JSON-RPC. It is registered
+// under the name "Miner" so that method names match the gob protocol.
+type ArtnodeJSON struct {
+	miner *Miner
 }
 
-// When a new miner joins the network, it'll ask all the neighbouring miners for their longest chain
-// After retrieving the chain, it'll use one of them as it's starting chain
-// This method will do the following:
-//	After returning with a chain
-// 	- Validate the shape with existing miner states (ink, exisiting shapes)
-//	- Apply the Block's state to the miner to validate future blocks
-// 	- Revert the blocks to earse the memory
+// Arguments of an artnode RPC made over JSON-RPC. JSON can't carry the
+// concrete Go types that ArtnodeRequest payloads rely on, so each
+// argument is named explicitly; methods only read the fields they need.
+type ArtnodeJSONRequest struct {
+	Token string
+
+	// AddShape, DeleteShape, AllowInk, SubmitSignedOp (optional)
+	TraceID string
+
+	// RevokeToken
+	TokenHash string
+
+	// GetSvgString, GetCanvas
+	IncludePending bool
+
+	// GetToken
+	Nonce      string
+	R          string
+	S          string
+	PubKey     string
+	Delegation string
+	InkQuota   uint32
+	OpQuota    uint32
+
+	// GetSvgString, DeleteShape, OpValidated, GetOpStatus, GetOpPropagation, GetShapeProvenance, PinOp,
+	// SetShapeMetadata, GetShapeMetadata
+	ShapeHash string
+
+	// GetSvgStrings
+	ShapeHashes []string
+
+	// SetShapeMetadata
+	MetadataKey   string
+	MetadataValue string
+
+	// PinOp
+	Pinned bool
+
+	// GetShapes, GetChildren, GetCanvasDiff, WaitForCanvasChange, GetFinality
+	BlockHash string
+
+	// WaitForCanvasChange, WaitForLockChange, in milliseconds
+	Timeout uint32
+
+	// AcquireLock, ReleaseLock
+	LockName    string
+	LockSeconds uint32
+
+	// WaitForLockChange
+	LockVersion uint64
+
+	// GetChildren
+	Depth           uint32
+	IncludeMetadata bool
+	Offset          uint32
+	Limit           uint32
+
+	// GetBlocksByOwner
+	Owner       string
+	FromBlockNo uint32
+	ToBlockNo   uint32
+
+	// AddShape, DeleteShape, AllowInk, GetValidationEstimate
+	ValidateNum    uint8
+	ShapeType      int
+	ShapeSvgString string
+	Fill           string
+	Stroke         string
+
+	// AddShape, GetAllowance
+	Payer string
+
+	// AddShape
+	ExpiryBlocks    uint32
+	StrokeDasharray string
+	StrokeLinecap   string
+	StrokeLinejoin  string
+	DependsOn       string
+
+	// AllowInk, GetAllowance
+	Spender   string
+	Allowance uint32
+
+	// SubmitSignedOp
+	EncodedOp string
+	OpSig     string
+	Signer    string
+
+	// RenderRegionPNG, in canvas units
+	MinX  uint32
+	MinY  uint32
+	MaxX  uint32
+	MaxY  uint32
+	Scale float64
+}
 
-// After the checks, it'll keep the current longest valid chain
-// The new miner will then apply the blocks again and start mining from the end of that chain
+// Reply to an artnode RPC made over JSON-RPC. ErrorCode holds the stable
+// errorlib code, ErrorType its name (e.g. "ShapeOverlapError") and Error
+// its message.
+type ArtnodeJSONResponse struct {
+	ErrorCode errorLib.ErrorCode
+	ErrorType string
+	Error     string
+	Payload   []interface{}
+	TraceID   string
+}
 
-func (m *Miner) initBlockchain() {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Receiver for RPCs served on the admin socket. These are never exposed
+// to art nodes or other miners.
+type MinerAdmin struct {
+	miner *Miner
+}
 
-	request := new(MinerRequest)
+// Summary of a running miner, returned by Admin.Status
+type MinerStatus struct {
+	Address        string
+	PubKeyString   string
+	BlockchainHead string
+	ChainLength    uint32
+	ChainWork      uint64
+	NumBlocks      int
+	NumPeers       int
+	InkRemaining   uint32
+	NumUnminedOps  int
+	NumUnvalidOps  int
+	NumValidOps    int
+	NumFailedOps   int
+	NumChainOps    uint64
+	ChainInkSpent  uint64
+	Observer       bool
+	NoOpInterval   time.Duration
+
+	// Hashes per second of each mining worker, over the time it has spent
+	// hashing
+	HashRates []float64
+
+	// Events published on the miner's event bus since it started
+	OpsReceived    uint64
+	BlocksReceived uint64
+	HeadChanges    uint64
+}
 
-	m.initBlockchainCache()
+// A connected peer and its smoothed RPC round-trip time, returned by
+// Admin.Peers. Latency is zero until the peer has answered an RPC.
+// UnminedOps is the number of unmined ops in its last reply to a ping.
+// Inbound, Anchor and Score are those of its PeerSlot.
+type PeerStatus struct {
+	Address    string
+	Latency    time.Duration
+	UnminedOps int
+	Inbound    bool
+	Anchor     bool
+	Manual     bool
+	Score      uint64
+}
 
-	// For each connected Miner, get the length of their longest chain first
-	mapMinerAndLength := make(map[string]int)
-	for minerAddr, minerCon := range m.miners {
-		singleResponse := new(MinerResponse)
-		minerCon.Call("Miner.GetBlockChainLength", request, singleResponse)
-		if len(singleResponse.Payload) > 0 {
-			lengthMinerChain := singleResponse.Payload[0].(int)
-			mapMinerAndLength[minerAddr] = lengthMinerChain
-		}
-	}
+// The protocol statistics of a peer, returned by Admin.PeerStats. Blocks
+// and ops received are those the peer sent or this miner pulled from it,
+// and the invalid ones those of them that this miner rejected. Bytes are
+// those written to and read from the connection this miner opened to the
+// peer, i.e. its own requests (such as the blocks and ops it sends) and the
+// peer's replies. The peer was last seen when it last sent or replied.
+type PeerStats struct {
+	Address        string
+	Connected      bool
+	BlocksSent     uint64
+	BlocksReceived uint64
+	OpsSent        uint64
+	OpsReceived    uint64
+	BytesSent      uint64
+	BytesReceived  uint64
+	InvalidBlocks  uint64
+	InvalidOps     uint64
+	Replayed       uint64
+	Duplicates     uint64
+	LastSeen       time.Time
+
+	// How the peer announces blocks, see WithholdingStats
+	BlocksAnnounced uint64
+	BlocksReleased  uint64
+	BlockAges       [4]uint64
+	Releases        uint64
+	LongestRelease  uint32
+	ReorgedBlocks   uint64
+	Withholding     bool
+}
 
-	sortedMap := sortMap(mapMinerAndLength)
-	// Then get go through from highest to lowest
-	for _, pair := range sortedMap {
-		singleResponse := new(MinerResponse)
-		m.miners[pair.Key].Call("Miner.GetBlockChain", request, singleResponse)
-		if len(singleResponse.Payload) > 0 {
-			currentChain := singleResponse.Payload[0].([]Block)
-			isChainValid := true
+// How a peer announces blocks, to spot one that mines in private and
+// releases long chains at once to reorg the network. Blocks announced are
+// the valid new blocks first received from the peer, and BlockAges counts
+// them by how many blocks old they were when they arrived: how far the
+// main chain had already reached at or past their height (0, 1, 2 to 5,
+// and more than 5). A peer that relays blocks as they are mined announces
+// blocks of age 0 or 1. Blocks released are those announced as part of a
+// secret chain; ReorgedBlocks are the main chain blocks its releases
+// abandoned.
+type WithholdingStats struct {
+	BlocksAnnounced uint64
+	BlocksReleased  uint64
+	BlockAges       [4]uint64
+	Releases        uint64
+	LongestRelease  uint32
+	ReorgedBlocks   uint64
+	LastRelease     time.Time
+
+	// The run of blocks the peer is announcing back to back: its newest
+	// block, its length, the age of its first block and when its newest
+	// block arrived
+	runTip    string
+	runLength uint32
+	runAge    uint32
+	runLast   time.Time
+}
 
-			// The order of currentChain from low to high indices is newest to oldest, so
-			// we have to traverse backwards
-			for i := len(currentChain) - 1; i >= 0; i-- {
-				block := &currentChain[i]
+// A block received from a peer that failed validation, returned by
+// Admin.Quarantine. Reason is the validation error, and Source the address
+// of the peer the block came from (empty if unknown).
+type QuarantinedBlock struct {
+	Hash     string
+	Block    Block
+	Reason   string
+	Source   string
+	Received time.Time
+}
 
-				// If the block is invalid, the chain is also invalid, so move on to the next chain
-				if m.validateBlock(block) != nil {
-					isChainValid = false
-					break
-				}
-				// Else, the block is valid, so apply the block to simulate
-				m.addBlock(block)
-				m.applyBlock(block)
-			}
+// A nonce handed out by Hello that hasn't been exchanged for a token yet
+type NonceStatus struct {
+	Nonce   string
+	Created time.Time
+}
 
-			// If the chain is valid and longer than any other valid chain we've received,
-			// then set it as the new longest chain
-			if isChainValid {
-				logger.Println("Got an existing chain, start mining at blockNo: ", m.blockchain[m.blockchainHead].BlockNo+1)
-				break
-			}
+// An art node session as others may see it: identified by a hash of its
+// token rather than the token itself. Scope is "miner" for a session of
+// the miner's own key and "delegate" for one of a delegated key, followed
+// by its quotas, if any, e.g. "delegate ink<=100 ops<=5".
+type SessionPresence struct {
+	TokenHash    string
+	PubKeyString string
+	Scope        string
+	NumOps       uint32
+	Created      time.Time
+	LastActive   time.Time
+	Online       bool
+}
 
-			// Reset the miner state
-			m.initBlockchainCache()
-			// otherwise go to the next one
-		}
-	}
+// An artnode token and what has been spent with it
+type TokenStatus struct {
+	Token        string
+	PubKeyString string
+	Created      time.Time
+	Expires      time.Time
+	NumOps       uint32
+	InkSpent     uint32
 }
 
-func (m *Miner) initBlockchainCache() {
-	m.unminedOps = make(map[string]*OperationRecord)
-	m.unvalidatedOps = make(map[string]*OperationRecord)
-	m.validatedOps = make(map[string]*OperationRecord)
-	m.failedOps = make(map[string]*OperationRecord)
-	m.tempOps = make(map[string]*OperationRecord)
-	m.blockchain = make(map[string]*Block)
-	m.inkAccounts = make(map[string]uint32)
-	m.inkAccounts[m.pubKeyString] = 0
+// The outstanding nonces and tokens of a miner, oldest first, returned by
+// Admin.Sessions
+type SessionList struct {
+	Nonces []NonceStatus
+	Tokens []TokenStatus
+}
 
-	genesisBlock := &Block{0, "", []OperationRecord{}, "", 0}
-	m.blockchain[m.settings.GenesisBlockHash] = genesisBlock
-	m.blockchainHead = m.settings.GenesisBlockHash
+// Everything shown on the admin dashboard. Blocks are the newest of the
+// main chain, newest first, and UnminedOps the oldest unmined ops.
+type Dashboard struct {
+	Status      MinerStatus
+	Peers       []PeerStatus
+	Blocks      []ExportedBlock
+	UnminedOps  []OperationRecord
+	InkAccounts PairList
+	Canvas      CanvasSettings
+	Shapes      []DashboardShape
+	Refresh     int
 }
 
-// Creates a block and block hash that has a suffix of nHashZeroes
-// If successful, block is appended to the longestChainLastBlockHashin the blockchain map
-func (m *Miner) mineBlock() {
-	m.lock.Lock()
-	var nonce uint32 = 0
-	prevHash := m.blockchainHead
-	blockNo := m.blockchain[prevHash].BlockNo + 1
-	m.lock.Unlock()
+// A shape on the canvas preview of the admin dashboard. D and FillRule are
+// the path data and fill-rule of a path; Cx, Cy and R are set for a circle.
+type DashboardShape struct {
+	Circle   bool
+	D        string
+	FillRule string
+	Cx       int64
+	Cy       int64
+	R        int64
+	Stroke   string
+	Fill     string
+	Style    shapelib.StrokeStyle
+}
 
-	for {
-		m.lock.Lock()
-		if m.newLongestChain {
-			m.newLongestChain = false
-			m.lock.Unlock()
-			return
-		} else {
-			var block Block
-			// Will create a opBlock or noOpBlock depending upon whether unminedOps are waiting to be mined
-			if len(m.unminedOps) > 0 {
-				opRecordArray := make([]OperationRecord, len(m.unminedOps))
-				i := 0
-				for _, opRecord := range m.unminedOps {
-					opRecordArray[i] = *opRecord
-					i++
-				}
-				block = Block{blockNo, prevHash, opRecordArray, m.pubKeyString, nonce}
-			} else {
-				block = Block{blockNo, prevHash, nil, m.pubKeyString, nonce}
-			}
-			if m.blockSuccessfullyMined(&block) {
-				m.lock.Unlock()
-				return
-			} else {
-				nonce++
-			}
-		}
-		m.lock.Unlock()
-	}
+// The slot a connected peer takes up: inbound if the peer connected to this
+// miner, outbound if this miner connected to it. A peer's score counts the
+// new blocks and ops it was the first to send; the least useful peer is
+// evicted when a new peer needs its slot, except for the NUM_ANCHOR_PEERS
+// longest connected peers (the anchors) and the peers an operator added
+// with Admin.AddPeer.
+type PeerSlot struct {
+	inbound   bool
+	connected time.Time
+	score     uint64
+	manual    bool
 }
 
-// Manages miner state updates during a change of the blockchain head.
-//
-// Notes:
-// - When we are only doing a fast-forward, there is no 'oldBranch'. Also, 'newBranch'
-//   will only contain one block. Otherwise (if we are switching branches), this will
-//   not be the case.
-// - The first for-loop constructs part of the (and possibly the entire) newBranch.
-// - The second for-loop continues to construct newBranch while at the same time constructing
-//   oldBranch, so long as each pair of successive child blocks have the same BlockNo but are
-//   different blocks. This continues until the most recent common ancestor is reached, at
-//   which point the construction of newBranch and oldBranch will be complete.
+// Counts of the protocol messages exchanged with a peer. They are kept for
+// as long as the miner runs, even after the peer is dropped, and updated
+// atomically, since the peer's connection counts bytes as it is used.
+type peerCounters struct {
+	blocksSent     uint64
+	blocksReceived uint64
+	opsSent        uint64
+	opsReceived    uint64
+	bytesSent      uint64
+	bytesReceived  uint64
+	invalidBlocks  uint64
+	invalidOps     uint64
+	lastSeen       int64
+}
+
+// The key each miner registered with the server (as encoded by the
+// server), by the address it registered, so that a peer can be checked to
+// be the miner registered for its address. The keys are fetched from the
+// server again when a peer's key doesn't match them, at most every
+// PEER_KEYS_REFRESH milliseconds. The server is called without holding
+// lock, so that checking other peers isn't held up by it, and under
+// fetchLock, so that only one fetch runs at a time.
+type MinerRegistry struct {
+	fetchLock sync.Mutex
+
+	lock    sync.Mutex
+	keys    map[string]string
+	fetched time.Time
+	server  *rpc.Client
+	pubKey  ecdsa.PublicKey
+}
+
+// TLS for the connections between miners (see run -tls). Each miner
+// presents a certificate for its own miner key. A miner only connects to a
+// peer whose certificate is for the key registered with the server for the
+// peer's address, and only accepts a peer whose certificate is for a
+// registered key, so that the blocks and ops miners send each other can't
+// be read or tampered with in transit. Art nodes keep connecting without
+// TLS on the same socket; the miner RPCs are refused on their connections.
+type PeerTLS struct {
+	config   *tls.Config
+	registry *MinerRegistry
+
+	// The certificate this miner presents
+	lock sync.Mutex
+	cert *tls.Certificate
+}
+
+// A connection whose first bytes were peeked at through r
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// A connection to a peer that counts the bytes read from and written to it
+type countingConn struct {
+	net.Conn
+	counters *peerCounters
+}
+
+// The unmined ops a miner holds, as sent in reply to a ping: how many there
+// are and the OpSigs of up to MAX_MEMPOOL_SUMMARY_OPS of them. A miner's own
+// summary also holds the OpSigs of up to MAX_MEMPOOL_SYNC_OPS of them for
+// mempool syncs, and those ops, so that peers can pull them without waiting
+// on its lock.
+type MempoolSummary struct {
+	NumOps int
+	OpSigs []string
+
+	inventory []string
+	ops       map[string]OperationRecord
+}
+
+// Copy of the state that art node reads are answered from, so that they
+// never wait on the miner's lock while blocks are being validated. A
+// replica is never modified: when the head or the tokens change it is
+// replaced (see updateReadReplica), sharing whatever didn't change with
+// the replica it replaces.
+type ReadReplica struct {
+	GenesisBlockHash string
+	HeadHash         string
+	InkRemaining     uint32
+
+	// Shapes on the canvas as of the head, keyed by shape hash, and the
+	// hashes of those that expire, keyed by the block number at which
+	// they do
+	shapes   map[string]shapelib.Shape
+	expiries map[uint32][]string
+
+	// Shapes each token has added, and shapes it has deleted, with ops that
+	// aren't on the longest chain yet, keyed by token and then by shape
+	// hash, so that its reads can include its own writes (see GetCanvas)
+	pendingShapes  map[string]map[string]shapelib.Shape
+	pendingDeletes map[string]map[string]bool
+
+	tokens map[string]time.Time
+}
+
+// A block along with its hash, as written by the export command
+type ExportedBlock struct {
+	Hash  string
+	Block Block
+}
+
+// Main chain from the genesis block (exclusive) to the head, oldest first
+type ChainExport struct {
+	GenesisBlockHash string
+	Blocks           []ExportedBlock
+}
+
+// A signed snapshot of a miner's main chain, as written by the snapshot
+// command, that a new miner can start from instead of downloading and
+// validating the whole chain from its peers (see run -bootstrap).
+// Snapshot is the state of the chain at its head. The blocks of the chain
+// are split into Headers, the older blocks without their ops, and Blocks,
+// the newest BOOTSTRAP_RECENT_BLOCKS in full, both oldest first. Sig is
+// the signature of the rest by PubKeyString, encoded like an OpSig.
+type BootstrapSnapshot struct {
+	GenesisBlockHash string
+	Snapshot         StoreSnapshot
+	Headers          []ExportedBlock
+	Blocks           []ExportedBlock
+	PubKeyString     string
+	Sig              string
+}
+
+// A signed manifest of the canvas as of a block, as written by the canvas
+// command next to the canvas's svg, so that a published artwork can be
+// checked against the chain it was drawn on. Shapes are listed in the
+// order they are drawn, SvgHash is the hex encoded sha256 of the svg, and
+// Sig is the signature of the rest by PubKeyString, encoded like an OpSig.
+type CanvasManifest struct {
+	GenesisBlockHash string
+	BlockHash        string
+	BlockNo          uint32
+	Final            bool
+	Shapes           []ManifestShape
+	SvgHash          string
+	PubKeyString     string
+	Sig              string
+}
+
+// A shape on the canvas of a manifest, by the hash of the op that added it
+type ManifestShape struct {
+	ShapeHash string
+	Owner     string
+}
+
+// The canvas as of a block, as an svg and its signed manifest
+type CanvasExport struct {
+	Svg      string
+	Manifest CanvasManifest
+}
+
+// Settings of a miner read from the JSON file given to run -config, in
+// place of the flags of the same names. Flags given on the command line
+// take precedence, and the server address, like -server, stands in for
+// the [server ip:port] argument. Relative paths are relative to the
+// directory of the config file. Fields left out keep their defaults.
+type MinerConfig struct {
+	Server            string `json:"server"`
+	Keys              string `json:"keys"`
+	Listen            string `json:"listen"`
+	Admin             string `json:"admin"`
+	JSON              string `json:"json"`
+	Data              string `json:"data"`
+	Workers           *int   `json:"workers"`
+	ValidationWorkers *int   `json:"validation-workers"`
+	LogFile           string `json:"log-file"`
+	LogTimestamps     bool   `json:"log-timestamps"`
+	TLS               bool   `json:"tls"`
+	TLSCert           string `json:"tls-cert"`
+	TLSKey            string `json:"tls-key"`
+	ArtnodeTLS        string `json:"artnode-tls"`
+}
+
+// A subcommand of the miner binary, run as ink-miner <Name> [arguments] or
+// by one of its Aliases. Usage lists its flags and arguments, and Summary
+// says what it does in a line.
+type MinerCommand struct {
+	Name    string
+	Aliases []string
+	Usage   string
+	Summary string
+	Run     func(args []string)
+}
+
+// Timing of one geometry op on one reference shape, as written by the
+// bench command
+type BenchmarkResult struct {
+	Name        string
+	NsPerOp     int64
+	AllocsPerOp int64
+}
+
+// Persists blocks, network settings and the miner's own pending ops to a
+// local directory so that a miner's chain can be verified and exported
+// without the network, and its ops survive a restart.
 //
-// In the case of a branch switch, we perform the following procedure (this can also be
-// generalized to the simple case of a fast-forward):
-// - Traverse the blocks in the old branch one at a time, up to the most
-//   recent common ancestor
-//     - Update (reverse) ink accounts for each block
-//     - In each block, for each operation:
-//         - Reverse the ink associated with that operation
-//         - Add the operation to the unmined group
-//         - Remove the operation from all other groups
-// - Traverse the blocks in the new branch one at a time
-//     - Apply each block in order, starting at the child of the most recent common ancestor
-//     - Note: this MUST be done in order from oldest to newest, because of the way we decrement
-//       our validateNum counter. This is why we do a backwards traversal.
+// The svg strings of stored ops are stored once each, under the hash of
+// their contents, so that a canvas of many identical shapes (e.g. drawn by
+// stamp tools) takes up the space of one shape in every block and op that
+// holds it, on disk and once loaded. Ops are sent and signed with their svg
+// strings as they were.
 //
-// Assumption: oldBlockHash and newBlockHash must both be valid block hashes
-// for blocks which exist in the miner's current block map, and are both
-// connected to the genesis block.
+// Every file is replaced atomically, and the head is only committed once
+// the blocks and ops it depends on are on disk, so after a crash (even in
+// the middle of a reorg) the store holds the last committed head along
+// with the state it was committed with.
+type BlockStore struct {
+	dir string
+
+	// Bytes the store may use before the bodies of old blocks are pruned
+	// (0 never prunes), and held while pruning
+	quota     int64
+	pruneLock sync.Mutex
+}
+
+// An op along with the hash of the block it was in (empty if it was
+// unmined), as stored for this miner's pending ops and in snapshots
+type StoredOp struct {
+	Record    OperationRecord
+	BlockHash string
+}
+
+// The state of the chain at the newest block whose body was pruned from a
+// store. Only the ops that can still affect later blocks are kept: the
+// shapes on the canvas and the ops that aren't validated yet. Of the
+// other ops on the chain, only the signatures are kept, since later ops
+// can still depend on them.
+type StoreSnapshot struct {
+	BlockHash      string
+	BlockNo        uint32
+	InkAccounts    map[string]uint32
+	Allowances     map[string]map[string]uint32
+	RotatedKeys    map[string]KeyRotation
+	ValidatedOps   []StoredOp
+	UnvalidatedOps []StoredOp
+	PrunedOps      []string
+}
+
+// A key that was retired by a ROTATE op: the key that took over its ink and
+// shapes, and how much ink was moved, so that the op can be reversed
+type KeyRotation struct {
+	NewKey string
+	Ink    uint32
+}
+
+// A miner that a gateway forwards artnode writes to. The delegation is the
+// backend's signature of the gateway's public key, as printed by
+// "ink-miner delegate", which lets the gateway open a session on it.
+type GatewayBackend struct {
+	Addr       string
+	Delegation string
+
+	lock  sync.Mutex
+	conn  *rpc.Client
+	token string
+}
+
+// A miner's signed statement that a block is on its main chain,
+// FinalityDepth blocks below its head. Sig is the signature of the block's
+// attestation digest (see getAttestationDigest) by PubKeyString, encoded
+// like an OpSig.
+type Attestation struct {
+	BlockHash    string
+	PubKeyString string
+	Sig          string
+}
+
+// A report, relayed back along the path an op was disseminated on, that
+// the miner at MinerAddr rejected the op for Reason. Reporter is the
+// address of the miner that sent the report and Sig the signature of the
+// report's other fields (see getRejectionDigest) by PubKeyString, which
+// must be the key registered with the server for Reporter, encoded like an
+// OpSig.
+type OpRejectionReport struct {
+	OpSig        string
+	MinerAddr    string
+	Reason       string
+	Reporter     string
+	PubKeyString string
+	Sig          string
+}
+
+// A key and value annotating a shape, e.g. its title, kept by the miners
+// beside the chain rather than in it. Sig is the signature of the entry's
+// other fields (see getMetadataDigest) by PubKeyString, the shape's owner,
+// encoded like an OpSig. An entry with a higher Version replaces the one
+// for the same key, and an empty Value removes the key.
+type ShapeMetadata struct {
+	ShapeHash    string
+	Key          string
+	Value        string
+	Version      int64
+	PubKeyString string
+	Sig          string
+}
+
+// </TYPE DECLARATIONS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
 //
-func (m *Miner) changeBlockchainHead(oldBlockHash, newBlockHash string) {
-	// newBlock and oldBlock are "current" block pointers
-	newBlock := m.blockchain[newBlockHash]
-	oldBlock := m.blockchain[oldBlockHash]
-	// newBranch and oldBranch are chains of blocks in the new and old branches
-	// up to the most recent common ancestor.
-	newBranch := []*Block{}
-	oldBranch := []*Block{}
 
-	// Construct the part of the new branch up to the block with the same BlockNo
-	// as the old branch head
-	for newBlock.BlockNo > oldBlock.BlockNo {
-		newBranch = append(newBranch, newBlock)
-		newBlock = m.blockchain[newBlock.PrevHash]
+var (
+	logger   *log.Logger
+	alphabet = []rune("0123456789abcdef")
+)
+
+func main() {
+	logger = log.New(os.Stdout, "[Initializing]\n", log.Lshortfile)
+	registerGobTypes()
+
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "help", "-h", "-help", "--help":
+		if len(os.Args) > 2 {
+			if command, exists := getMinerCommand(os.Args[2]); exists {
+				command.Run([]string{"-h"})
+			}
+		}
+		printUsage()
+		return
+	}
+	command, exists := getMinerCommand(os.Args[1])
+	if !exists {
+		fmt.Fprintln(os.Stderr, "Unknown command", os.Args[1])
+		printUsage()
+		os.Exit(1)
+	}
+	command.Run(os.Args[2:])
+}
+
+func registerGobTypes() {
+	gob.Register(&elliptic.CurveParams{})
+	gob.Register(&net.TCPAddr{})
+	gob.Register([]Block{})
+	gob.Register(Block{})
+	gob.Register(Operation{})
+	gob.Register(OperationRecord{})
+	gob.Register([]OperationRecord{})
+	gob.Register([][]OperationRecord{})
+	gob.Register(Attestation{})
+	gob.Register(OpRejectionReport{})
+	gob.Register(ShapeMetadata{})
+	gob.Register([]ShapeMetadata{})
+}
+
+// Returns the miner's subcommands, in the order they are listed in
+func getMinerCommands() []MinerCommand {
+	return []MinerCommand{
+		{Name: "run", Aliases: []string{"mine"}, Run: runCommand,
+			Usage:   "run [-config file] [-server ip:port] [-listen ip:port] [-admin ip:port] [-data dir] [-json ip:port] [-keys file] [-observer] [-gateway file] [-noop-interval ms] [-quota MB] [-memory MB] [-geometry-engine name] [-presence] [-max-inbound n] [-max-outbound n] [-quarantine n] [-workers n] [-validation-workers n] [-mempool-ttl s] [-token-ttl s] [-rate-limit n] [-rate-burst n] [-op-batch-window ms] [-tls] [-tls-cert file -tls-key file] [-artnode-tls ip:port] [-priority name] [-bootstrap url|file] [-bootstrap-key pubKey] [-log-file file] [-log-timestamps] [server ip:port] [pubKey] [privKey]",
+			Summary: "Registers with the server, joins the network and mines (or, as an observer, validates and relays)"},
+		{Name: "keygen", Run: keygenCommand,
+			Usage:   "keygen [-o file]",
+			Summary: "Generates a keypair and writes the hex encoded keys to a file"},
+		{Name: "status", Run: statusCommand,
+			Usage:   "status [-admin ip:port]",
+			Summary: "Prints the status of a running miner"},
+		{Name: "restart", Run: restartCommand,
+			Usage:   "restart [-admin ip:port]",
+			Summary: "Soft restarts a running miner's networking"},
+		{Name: "peers", Run: peersCommand,
+			Usage:   "peers [-admin ip:port] [-stats | -bans | -add ip:port | -remove ip:port | -ban ip:port [-for s] | -unban ip:port]",
+			Summary: "Lists, adds, removes and bans a running miner's peers"},
+		{Name: "quarantine", Run: quarantineCommand,
+			Usage:   "quarantine [-admin ip:port] [-o file]",
+			Summary: "Lists the invalid blocks a running miner received"},
+		{Name: "verify", Run: verifyCommand,
+			Usage:   "verify [-data dir]",
+			Summary: "Replays and validates the chain persisted in a data directory"},
+		{Name: "export", Aliases: []string{"export-chain"}, Run: exportCommand,
+			Usage:   "export [-admin ip:port | -data dir] [-o file]",
+			Summary: "Writes the main chain as JSON, from a running miner or a data directory"},
+		{Name: "snapshot", Run: snapshotCommand,
+			Usage:   "snapshot [-admin ip:port] [-o file]",
+			Summary: "Writes a signed snapshot of a running miner's chain for -bootstrap"},
+		{Name: "canvas", Run: canvasCommand,
+			Usage:   "canvas [-admin ip:port] [-block hash] [-o name] | canvas -verify [-key pubKey] [-o name]",
+			Summary: "Exports a running miner's canvas as an svg with a signed manifest, or checks an export"},
+		{Name: "delegate", Run: delegateCommand,
+			Usage:   "delegate [-ttl seconds] [privKey] [artnode pubKey]",
+			Summary: "Prints a delegation letting an art node use the miner with its own keypair"},
+		{Name: "rotate", Run: rotateCommand,
+			Usage:   "rotate [-admin ip:port] [new pubKey]",
+			Summary: "Hands a running miner's ink and shapes over to a new key"},
+		{Name: "sessions", Run: sessionsCommand,
+			Usage:   "sessions [-admin ip:port] [-revoke token | -purge | -presence]",
+			Summary: "Lists, revokes and purges a running miner's artnode sessions"},
+		{Name: "profile", Run: profileCommand,
+			Usage:   "profile [-admin ip:port] [-kind name] [-seconds n] [-o file]",
+			Summary: "Captures a CPU or runtime profile of a running miner"},
+		{Name: "bench", Run: benchCommand,
+			Usage:   "bench [-o file] [-baseline file] [-tolerance percent]",
+			Summary: "Benchmarks the geometry ops on the reference shapes"},
+	}
+}
+
+// Looks up a subcommand by its name or one of its aliases
+func getMinerCommand(name string) (command MinerCommand, exists bool) {
+	for _, command := range getMinerCommands() {
+		if command.Name == name {
+			return command, true
+		}
+		for _, alias := range command.Aliases {
+			if alias == name {
+				return command, true
+			}
+		}
+	}
+	return MinerCommand{}, false
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: ink-miner <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, command := range getMinerCommands() {
+		name := command.Name
+		if len(command.Aliases) > 0 {
+			name += " (" + strings.Join(command.Aliases, ", ") + ")"
+		}
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", name, command.Summary)
+	}
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Run ink-miner help <command> for its arguments and flags.")
+}
+
+// Returns the flag set of a subcommand, whose -h prints the subcommand's
+// usage and flags
+func newCommandFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		command, _ := getMinerCommand(name)
+		fmt.Fprintln(os.Stderr, "Usage: ink-miner "+command.Usage)
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, command.Summary)
+		fmt.Fprintln(os.Stderr, "")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <COMMANDS>
+
+// Registers with the server, joins the network and mines forever. An
+// observer only syncs, validates and relays; it never mines. A gateway is
+// an observer that forwards artnode writes to its backend miners.
+func runCommand(args []string) {
+	fs := newCommandFlagSet("run")
+	configFile := fs.String("config", "", "JSON file of settings to run with, overridden by the flags given (disabled if empty)")
+	serverAddr := fs.String("server", "", "Address of the server, in place of the [server ip:port] argument")
+	rpcAddr := fs.String("listen", "", "Address on which to serve other miners and art nodes (defaults to a free port on an external IP)")
+	logFile := fs.String("log-file", "", "File to append the log to instead of writing it to stdout (disabled if empty)")
+	logTimestamps := fs.Bool("log-timestamps", false, "Prefix every log line with the date and time")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	dataDir := fs.String("data", "", "Directory in which to persist the blockchain (disabled if empty)")
+	keyFile := fs.String("keys", "", "File written by keygen to read the keypair from instead of the arguments, again on every restart")
+	jsonAddr := fs.String("json", "", "Address on which to also serve the artnode RPCs over JSON-RPC (disabled if empty)")
+	artnodeTLSAddr := fs.String("artnode-tls", "", "Address on which to also serve the artnode RPCs over TLS with a certificate for the miner's key (disabled if empty)")
+	observer := fs.Bool("observer", false, "Validate and serve the blockchain without mining or accepting shapes")
+	gatewayFile := fs.String("gateway", "", "JSON file of backend miners to forward artnode writes to, as an observer (disabled if empty)")
+	noOpInterval := fs.Uint("noop-interval", 0, "Minimum milliseconds between this miner's own no-op blocks (0 mines them back to back)")
+	quota := fs.Uint("quota", 0, "Megabytes the -data directory may use before the bodies of old blocks are pruned (0 never prunes)")
+	maxInbound := fs.Int("max-inbound", DEFAULT_MAX_INBOUND_PEERS, "Most peers that may connect to this miner")
+	maxOutbound := fs.Int("max-outbound", DEFAULT_MAX_OUTBOUND_PEERS, "Most peers this miner connects to itself")
+	quarantineSize := fs.Int("quarantine", DEFAULT_QUARANTINE_BLOCKS, "Number of recent invalid blocks to keep for inspection (0 keeps none)")
+	priorityName := fs.String("priority", FIFOPriority{}.Name(), "Order in which unmined ops are taken into this miner's blocks, one of "+strings.Join(getPriorityPolicyNames(), ", "))
+	engineName := fs.String("geometry-engine", shapelib.DefaultEngine.Name(), "Geometry engine to validate shapes with, one of "+strings.Join(shapelib.GetEngineNames(), ", "))
+	presence := fs.Bool("presence", false, "Let art nodes list the sessions that are online on this miner")
+	memory := fs.Uint("memory", 0, "Megabytes the mempool, logs, quarantine and caches may use before their lowest priority entries are evicted (0 never evicts)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of goroutines that hash nonces while mining")
+	mempoolTTL := fs.Uint("mempool-ttl", DEFAULT_MEMPOOL_TTL, "Seconds after an op is created that it expires from the mempool if it hasn't been mined (0 never expires ops)")
+	tokenTTL := fs.Uint("token-ttl", DEFAULT_TOKEN_TTL, "Seconds after an artnode token is issued that it expires (0 never expires tokens)")
+	rateLimit := fs.Uint("rate-limit", DEFAULT_RATE_LIMIT, "Calls per second each artnode token may make on average (0 doesn't limit them)")
+	rateBurst := fs.Uint("rate-burst", DEFAULT_RATE_BURST, "Most calls an artnode token may make at once")
+	opBatchWindow := fs.Uint("op-batch-window", DEFAULT_OP_BATCH_WINDOW, "Milliseconds an op waits for others to be sent to peers with it in one message (0 sends each op right away)")
+	validationWorkers := fs.Int("validation-workers", 0, "Number of goroutines that validate the ops of blocks and the mempool (0 uses one per core)")
+	bootstrap := fs.String("bootstrap", "", "URL or file of a snapshot written by the snapshot command to start from instead of syncing the whole chain (disabled if empty)")
+	bootstrapKey := fs.String("bootstrap-key", "", "Public key of the miner trusted to sign the -bootstrap snapshot")
+	useTLS := fs.Bool("tls", false, "Encrypt the connections with other miners, which must all use -tls too, and only accept registered miners as peers")
+	tlsCert := fs.String("tls-cert", "", "PEM file of the certificate of the miner's key to present to peers, implying -tls (defaults to a self-signed one)")
+	tlsKey := fs.String("tls-key", "", "PEM file of the private key of -tls-cert, which must be the miner's key")
+	fs.Parse(args)
+	positional := fs.Args()
+	if *configFile != "" {
+		config, err := loadMinerConfig(*configFile)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		applyMinerConfig(fs, config)
+	}
+	// All three arguments, as before -server, override it
+	if *serverAddr != "" && len(positional) < 3 {
+		positional = append([]string{*serverAddr}, positional...)
+	}
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		logger.SetOutput(file)
+	}
+	if *logTimestamps {
+		logger.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	}
+	if *bootstrap != "" && *bootstrapKey == "" {
+		logger.Fatalln("A -bootstrap snapshot needs the -bootstrap-key it is signed with")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Fatalln("-tls-cert and -tls-key must be given together")
+	}
+
+	miner := new(Miner)
+	miner.rpcAddr = *rpcAddr
+	miner.adminAddr = *adminAddr
+	miner.jsonAddr = *jsonAddr
+	miner.artnodeTLSAddr = *artnodeTLSAddr
+	miner.keyFile = *keyFile
+	miner.observer = *observer
+	if *gatewayFile != "" {
+		miner.backends = loadGatewayBackends(*gatewayFile)
+		miner.observer = true
+	}
+	miner.noOpInterval = time.Duration(*noOpInterval) * time.Millisecond
+	miner.miningWorkers = newMiningWorkers(*workers)
+	miner.numValidators = *validationWorkers
+	miner.mempoolTTL = time.Duration(*mempoolTTL) * time.Second
+	miner.tokenTTL = time.Duration(*tokenTTL) * time.Second
+	miner.opBatchWindow = time.Duration(*opBatchWindow) * time.Millisecond
+	if *rateLimit > 0 {
+		miner.limiter = newTokenRateLimiter(float64(*rateLimit), *rateBurst)
+	}
+	miner.maxInbound = *maxInbound
+	miner.maxOutbound = *maxOutbound
+	miner.quarantine = newBlockQuarantine(*quarantineSize)
+	miner.budget = newResourceBudget(int64(*memory) << 20)
+	miner.presence = *presence
+	priority, exists := getPriorityPolicy(*priorityName)
+	if !exists {
+		logger.Fatalln("Unknown priority policy", *priorityName)
+	}
+	miner.priority = priority
+	engine, exists := shapelib.GetEngine(*engineName)
+	if !exists {
+		logger.Fatalln("Unknown geometry engine", *engineName)
+	}
+	miner.engine = engine
+	var storedOps []StoredOp
+	if *dataDir != "" {
+		miner.store = openBlockStore(*dataDir)
+		miner.store.quota = int64(*quota) << 20
+		// Read before syncing, which overwrites the stored ops
+		ops, err := miner.store.loadOps()
+		if checkError(err) == nil {
+			storedOps = ops
+		}
+	}
+	miner.init(positional)
+	if *useTLS || *tlsCert != "" || *artnodeTLSAddr != "" {
+		cert, err := loadPeerCertificate(*tlsCert, *tlsKey, &miner.privKey)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		miner.artnodeTLS = newPeerTLS(cert, miner.registry)
+		if *useTLS || *tlsCert != "" {
+			miner.peerTLS = miner.artnodeTLS
+		}
+	}
+	if miner.store != nil {
+		bans, err := miner.store.loadBans()
+		if checkError(err) == nil {
+			miner.bans.restore(bans)
+		}
+	}
+	go withRole(ROLE_VALIDATION, miner.applyEvents)
+	miner.listenRPC()
+	miner.listenJSONRPC()
+	miner.listenArtnodeTLS()
+	miner.listenAdminRPC()
+	miner.registerWithServer()
+	bootstrapped := false
+	if *bootstrap != "" {
+		// Falls back to syncing the whole chain from the peers
+		bootstrapped = checkError(miner.bootstrapFrom(*bootstrap, *bootstrapKey)) == nil
+	}
+	miner.lock.Lock()
+	miner.getMiners()
+	miner.lock.Unlock()
+	if bootstrapped {
+		withRole(ROLE_VALIDATION, miner.catchUpAfterBootstrap)
+	} else {
+		withRole(ROLE_VALIDATION, miner.initBlockchain)
+	}
+	miner.reconcileStoredOps(storedOps)
+	go withRole(ROLE_GOSSIP, miner.startOpRegossip)
+	go withRole(ROLE_VALIDATION, miner.startMempoolExpiry)
+	go withRole(ROLE_ARTNODE, miner.startTokenExpiry)
+	go miner.startResourceBudget()
+	if miner.settings.FinalityDepth > 0 {
+		go withRole(ROLE_GOSSIP, miner.startAttestations)
+	}
+	go miner.handleSignals()
+	if miner.observer {
+		logger.SetPrefix("[Observing]\n")
+		<-miner.stopping
+	} else {
+		logger.SetPrefix("[Mining]\n")
+		withRole(ROLE_MINING, func() {
+			for !miner.isStopping() {
+				miner.mineBlock()
+			}
+		})
+	}
+	miner.shutdown()
+}
+
+// Reads and validates a run -config file. Every problem with its settings
+// is reported, each on its own line.
+func loadMinerConfig(file string) (*MinerConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(MinerConfig)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+			return nil, fmt.Errorf("config file %s: line %d: %v", file, line, err)
+		}
+		return nil, fmt.Errorf("config file %s: %v", file, err)
+	}
+
+	// Relative to the config file rather than to the working directory
+	dir := filepath.Dir(file)
+	for _, path := range []*string{&config.Keys, &config.Data, &config.LogFile, &config.TLSCert, &config.TLSKey} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+
+	var problems []string
+	addrs := []struct{ name, addr string }{
+		{"server", config.Server}, {"listen", config.Listen}, {"admin", config.Admin}, {"json", config.JSON},
+		{"artnode-tls", config.ArtnodeTLS},
+	}
+	for _, addr := range addrs {
+		if addr.addr == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr.addr); err != nil || port == "" {
+			problems = append(problems, fmt.Sprintf("%s: %q isn't an ip:port address", addr.name, addr.addr))
+		}
+	}
+	if config.Keys != "" {
+		if _, err := os.Stat(config.Keys); err != nil {
+			problems = append(problems, fmt.Sprintf("keys: %v (write one with: go run ink-miner.go keygen -o %s)", err, config.Keys))
+		}
+	}
+	if config.Data != "" {
+		if info, err := os.Stat(config.Data); err == nil && !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("data: %s isn't a directory", config.Data))
+		}
+	}
+	if config.LogFile != "" {
+		if info, err := os.Stat(filepath.Dir(config.LogFile)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("log-file: directory of %s doesn't exist", config.LogFile))
+		}
+	}
+	for _, file := range []struct{ name, path string }{{"tls-cert", config.TLSCert}, {"tls-key", config.TLSKey}} {
+		if file.path == "" {
+			continue
+		} else if _, err := os.Stat(file.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.name, err))
+		}
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		problems = append(problems, "tls-cert and tls-key must be given together")
+	}
+	if config.Workers != nil && *config.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("workers: %d, must be at least 1", *config.Workers))
+	}
+	if config.ValidationWorkers != nil && *config.ValidationWorkers < 0 {
+		problems = append(problems, fmt.Sprintf("validation-workers: %d, must be at least 0 (0 uses one per core)", *config.ValidationWorkers))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("config file %s:\n  %s", file, strings.Join(problems, "\n  "))
+	}
+	return config, nil
+}
+
+// Sets the flags of fs to the settings of a config file, except for those
+// given on the command line
+func applyMinerConfig(fs *flag.FlagSet, config *MinerConfig) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	values := map[string]string{
+		"server":   config.Server,
+		"keys":     config.Keys,
+		"listen":   config.Listen,
+		"admin":    config.Admin,
+		"json":     config.JSON,
+		"data":     config.Data,
+		"log-file": config.LogFile,
+		"tls-cert": config.TLSCert,
+		"tls-key":  config.TLSKey,
+	}
+	if config.ArtnodeTLS != "" {
+		values["artnode-tls"] = config.ArtnodeTLS
+	}
+	if config.Workers != nil {
+		values["workers"] = strconv.Itoa(*config.Workers)
+	}
+	if config.ValidationWorkers != nil {
+		values["validation-workers"] = strconv.Itoa(*config.ValidationWorkers)
+	}
+	if config.LogTimestamps {
+		values["log-timestamps"] = "true"
+	}
+	if config.TLS {
+		values["tls"] = "true"
+	}
+	for name, value := range values {
+		if value != "" && !given[name] && fs.Lookup(name) != nil {
+			fs.Set(name, value)
+		}
+	}
+}
+
+// Generates a new keypair and writes the hex encoded keys to a file
+func keygenCommand(args []string) {
+	fs := newCommandFlagSet("keygen")
+	out := fs.String("o", "", "File to write keys to (defaults to a new encodedKeys file)")
+	fs.Parse(args)
+
+	privKey := generateNewKeys()
+	privateKeyBytes, err := x509.MarshalECPrivateKey(&privKey)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+
+	encodedPrivateBytes := hex.EncodeToString(privateKeyBytes)
+	encodedPublicBytes := hex.EncodeToString(publicKeyBytes)
+
+	fmt.Println("Encoded Public key: ", encodedPublicBytes)
+	fmt.Println("Encoded Private key: ", encodedPrivateBytes)
+
+	var file *os.File
+	if *out == "" {
+		file, err = ioutil.TempFile(".", "encodedKeys")
+	} else {
+		file, err = os.Create(*out)
+	}
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer file.Close()
+	file.WriteString(encodedPublicBytes + "\r\n" + encodedPrivateBytes)
+}
+
+// Signs an art node's public key with the miner's private key, allowing
+// the art node to open a canvas on the miner with its own keypair until
+// the delegation expires
+func delegateCommand(args []string) {
+	fs := newCommandFlagSet("delegate")
+	ttl := fs.Uint("ttl", DEFAULT_DELEGATION_TTL, "Seconds the delegation is valid for")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	privBytes, err := hex.DecodeString(args[0])
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	privKey, err := x509.ParseECPrivateKey(privBytes)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	if parseStringPubKey(args[1]) == nil {
+		fmt.Fprintln(os.Stderr, "Invalid artnode public key")
+		os.Exit(1)
+	}
+
+	delegation, err := signDelegation(privKey, args[1], time.Now().Add(time.Duration(*ttl)*time.Second))
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	fmt.Println(delegation)
+}
+
+// Hands a running miner's ink and shapes over to a new key over the admin
+// socket
+func rotateCommand(args []string) {
+	fs := newCommandFlagSet("rotate")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	var opSig string
+	if checkError(admin.Call("Admin.RotateKey", fs.Arg(0), &opSig)) != nil {
+		os.Exit(1)
+	}
+	fmt.Println("Rotation op:", opSig)
+	fmt.Println("Restart the miner with the new keypair once the op is validated")
+}
+
+// Queries a running miner for its status over the admin socket
+func statusCommand(args []string) {
+	fs := newCommandFlagSet("status")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	status := new(MinerStatus)
+	if checkError(admin.Call("Admin.Status", "", status)) != nil {
+		os.Exit(1)
+	}
+
+	fmt.Println("Address:          ", status.Address)
+	fmt.Println("Public key:       ", status.PubKeyString)
+	fmt.Println("Blockchain head:  ", status.BlockchainHead)
+	fmt.Println("Chain length:     ", status.ChainLength)
+	fmt.Println("Chain work:       ", status.ChainWork)
+	fmt.Println("Known blocks:     ", status.NumBlocks)
+	fmt.Println("Connected peers:  ", status.NumPeers)
+	fmt.Println("Ink remaining:    ", status.InkRemaining)
+	fmt.Println("Unmined ops:      ", status.NumUnminedOps)
+	fmt.Println("Unvalidated ops:  ", status.NumUnvalidOps)
+	fmt.Println("Validated ops:    ", status.NumValidOps)
+	fmt.Println("Failed ops:       ", status.NumFailedOps)
+	fmt.Println("Ops on chain:     ", status.NumChainOps)
+	fmt.Println("Chain ink spent:  ", status.ChainInkSpent)
+	fmt.Println("Observer:         ", status.Observer)
+	fmt.Println("No-op interval:   ", status.NoOpInterval)
+	fmt.Println("Ops received:     ", status.OpsReceived)
+	fmt.Println("Blocks received:  ", status.BlocksReceived)
+	fmt.Println("Head changes:     ", status.HeadChanges)
+	for i, hashRate := range status.HashRates {
+		fmt.Printf("Worker %-11s %.0f hashes/s\n", fmt.Sprint(i)+":", hashRate)
+	}
+}
+
+// Soft restarts a running miner over the admin socket
+func restartCommand(args []string) {
+	fs := newCommandFlagSet("restart")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	result := new(RestartResult)
+	if checkError(admin.Call("Admin.Restart", "", result)) != nil {
+		os.Exit(1)
+	}
+
+	fmt.Println("Public key:       ", result.PubKeyString)
+	fmt.Println("Key changed:      ", result.KeyChanged)
+	fmt.Println("Connected peers:  ", result.NumPeers)
+	fmt.Println("Blocks received:  ", result.BlocksReceived)
+}
+
+// Lists a running miner's peers and their latencies over the admin socket
+func peersCommand(args []string) {
+	fs := newCommandFlagSet("peers")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	showStats := fs.Bool("stats", false, "List the messages exchanged with every peer instead")
+	addAddr := fs.String("add", "", "Address of a miner to connect to right away")
+	removeAddr := fs.String("remove", "", "Address of a peer to disconnect from")
+	banAddr := fs.String("ban", "", "Address of a miner to disconnect from and refuse")
+	banSeconds := fs.Uint("for", 0, "Seconds to -ban the miner for (0 bans it for good)")
+	unbanAddr := fs.String("unban", "", "Address of a banned miner to lift the ban on")
+	showBans := fs.Bool("bans", false, "List the banned miners instead")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	switch {
+	case *addAddr != "":
+		if checkError(admin.Call("Admin.AddPeer", *addAddr, new(bool))) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Added peer", *addAddr)
+		return
+	case *removeAddr != "":
+		if checkError(admin.Call("Admin.RemovePeer", *removeAddr, new(bool))) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Removed peer", *removeAddr)
+		return
+	case *banAddr != "":
+		var until time.Time
+		if checkError(admin.Call("Admin.BanPeer", BanRequest{*banAddr, uint32(*banSeconds)}, &until)) != nil {
+			os.Exit(1)
+		}
+		if until.IsZero() {
+			fmt.Println("Banned", *banAddr, "for good")
+		} else {
+			fmt.Println("Banned", *banAddr, "until", until.Format(time.RFC3339))
+		}
+		return
+	case *unbanAddr != "":
+		if checkError(admin.Call("Admin.UnbanPeer", *unbanAddr, new(bool))) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Lifted the ban on", *unbanAddr)
+		return
+	case *showBans:
+		var bans []PeerBan
+		if checkError(admin.Call("Admin.Bans", "", &bans)) != nil {
+			os.Exit(1)
+		}
+		for _, ban := range bans {
+			until := "for good"
+			if !ban.Until.IsZero() {
+				until = "until " + ban.Until.Format(time.RFC3339)
+			}
+			fmt.Printf("%-22s %s\n", ban.Address, until)
+		}
+		return
+	}
+
+	if *showStats {
+		var stats []PeerStats
+		if checkError(admin.Call("Admin.PeerStats", "", &stats)) != nil {
+			os.Exit(1)
+		}
+		for _, peer := range stats {
+			lastSeen := "never"
+			if !peer.LastSeen.IsZero() {
+				lastSeen = time.Since(peer.LastSeen).Round(time.Second).String() + " ago"
+			}
+			if !peer.Connected {
+				lastSeen += " (dropped)"
+			}
+			fmt.Printf("%-22s sent %d blocks %d ops %d B, received %d blocks %d ops %d B, invalid %d blocks %d ops, replayed %d, duplicate %d blocks, last seen %s\n",
+				peer.Address, peer.BlocksSent, peer.OpsSent, peer.BytesSent, peer.BlocksReceived, peer.OpsReceived, peer.BytesReceived,
+				peer.InvalidBlocks, peer.InvalidOps, peer.Replayed, peer.Duplicates, lastSeen)
+			if peer.Releases > 0 {
+				withholding := ""
+				if peer.Withholding {
+					withholding = ", WITHHOLDING"
+				}
+				fmt.Printf("%-22s released %d of %d announced blocks in %d secret chains (longest %d), abandoning %d blocks%s\n",
+					"", peer.BlocksReleased, peer.BlocksAnnounced, peer.Releases, peer.LongestRelease, peer.ReorgedBlocks, withholding)
+			}
+		}
+		return
+	}
+
+	var peers []PeerStatus
+	if checkError(admin.Call("Admin.Peers", "", &peers)) != nil {
+		os.Exit(1)
+	}
+
+	for _, peer := range peers {
+		latency := "unmeasured"
+		if peer.Latency > 0 {
+			latency = peer.Latency.String()
+		}
+		slot := "outbound"
+		if peer.Inbound {
+			slot = "inbound"
+		}
+		if peer.Anchor {
+			slot += " anchor"
+		}
+		if peer.Manual {
+			slot += " manual"
+		}
+		fmt.Printf("%-22s %-14s %-15s score %-6d %d unmined ops\n", peer.Address, latency, slot, peer.Score, peer.UnminedOps)
+	}
+}
+
+// Lists the invalid blocks a running miner has quarantined over the admin
+// socket, newest first, or writes them as JSON
+func quarantineCommand(args []string) {
+	fs := newCommandFlagSet("quarantine")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	out := fs.String("o", "", "File to write the quarantined blocks to as JSON")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	var blocks []QuarantinedBlock
+	if checkError(admin.Call("Admin.Quarantine", "", &blocks)) != nil {
+		os.Exit(1)
+	}
+
+	if *out != "" {
+		encoded, err := json.MarshalIndent(blocks, "", "  ")
+		if checkError(err) != nil || checkError(ioutil.WriteFile(*out, encoded, 0644)) != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, quarantined := range blocks {
+		source := quarantined.Source
+		if source == "" {
+			source = "unknown"
+		}
+		fmt.Printf("%s block %d from %s, %s ago: %s\n", quarantined.Hash, quarantined.Block.BlockNo, source,
+			time.Since(quarantined.Received).Round(time.Second), quarantined.Reason)
+	}
+}
+
+// Captures a profile of a running miner over the admin socket, see
+// Admin.Profile
+func profileCommand(args []string) {
+	fs := newCommandFlagSet("profile")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	kind := fs.String("kind", "cpu", "Profile to capture: cpu, or a runtime profile such as heap or goroutine")
+	seconds := fs.Uint("seconds", uint(DEFAULT_PROFILE_SECONDS), "Seconds to record a CPU profile for")
+	out := fs.String("o", "", "File on the miner's host to write the profile to (defaults to a new file in its temp directory)")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	var path string
+	if checkError(admin.Call("Admin.Profile", ProfileRequest{*kind, uint32(*seconds), *out}, &path)) != nil {
+		os.Exit(1)
+	}
+	fmt.Println("Wrote the", *kind, "profile to", path)
+}
+
+// Lists a running miner's outstanding nonces and tokens over the admin
+// socket, or revokes one token or all of them
+func sessionsCommand(args []string) {
+	fs := newCommandFlagSet("sessions")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	revoke := fs.String("revoke", "", "Token to revoke")
+	purge := fs.Bool("purge", false, "Revoke every token and forget every nonce")
+	presence := fs.Bool("presence", false, "List the sessions by token hash with their scope and last activity instead")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+
+	if *revoke != "" {
+		if checkError(admin.Call("Admin.RevokeToken", *revoke, new(bool))) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Revoked token", *revoke)
+		return
+	} else if *purge {
+		var numRevoked int
+		if checkError(admin.Call("Admin.PurgeSessions", "", &numRevoked)) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Revoked", numRevoked, "tokens and forgot every nonce")
+		return
+	} else if *presence {
+		var sessions []SessionPresence
+		if checkError(admin.Call("Admin.Presence", "", &sessions)) != nil {
+			os.Exit(1)
+		}
+		numOnline := 0
+		for _, session := range sessions {
+			status := "idle"
+			if session.Online {
+				status = "online"
+				numOnline++
+			}
+			lastActive := "never"
+			if !session.LastActive.IsZero() {
+				lastActive = session.LastActive.Format(time.RFC3339)
+			}
+			fmt.Printf("session %s  %s  last active %s  key ...%s  %s  %d ops\n", session.TokenHash, status, lastActive, shortenKey(session.PubKeyString), session.Scope, session.NumOps)
+		}
+		fmt.Println(numOnline, "of", len(sessions), "sessions online")
+		return
+	}
+
+	sessions := new(SessionList)
+	if checkError(admin.Call("Admin.Sessions", "", sessions)) != nil {
+		os.Exit(1)
+	}
+	for _, nonce := range sessions.Nonces {
+		fmt.Printf("nonce %s  created %s\n", nonce.Nonce, nonce.Created.Format(time.RFC3339))
+	}
+	for _, token := range sessions.Tokens {
+		expires := "never"
+		if !token.Expires.IsZero() {
+			expires = token.Expires.Format(time.RFC3339)
+		}
+		fmt.Printf("token %s  created %s  expires %s  key ...%s  %d ops  %d ink\n", token.Token, token.Created.Format(time.RFC3339), expires, shortenKey(token.PubKeyString), token.NumOps, token.InkSpent)
+	}
+}
+
+// Replays the blocks in the local store from the genesis block, checking
+// every block along the longest chain exactly as if it had been received
+// from a peer.
+func verifyCommand(args []string) {
+	fs := newCommandFlagSet("verify")
+	dataDir := fs.String("data", "", "Directory of the blockchain to verify")
+	fs.Parse(args)
+
+	if *dataDir == "" {
+		logger.Fatalln("Missing -data directory")
+	}
+
+	m, chain, err := loadStoredChain(openBlockStore(*dataDir))
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+
+	logger.SetPrefix("[Verifying]\n")
+	if m.blockchainHead != m.settings.GenesisBlockHash {
+		fmt.Println("Blocks up to", m.blockchain[m.blockchainHead].BlockNo, "were pruned; verifying from the store's snapshot")
+	}
+	if numApplied, err := m.applyChain(getChainBlocks(chain), false); err != nil {
+		exported := chain[numApplied]
+		logger.Fatalln("Store is invalid at block [" + fmt.Sprint(exported.Block.BlockNo) + "] [" + exported.Hash + "]")
+	}
+
+	fmt.Println("Store is valid. Chain length: ", m.blockchain[m.blockchainHead].BlockNo, " head: ", m.blockchainHead)
+}
+
+// Writes the main chain as JSON, either from a running miner or from a
+// local store.
+func exportCommand(args []string) {
+	fs := newCommandFlagSet("export")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	dataDir := fs.String("data", "", "Export from this local store instead of a running miner")
+	out := fs.String("o", "", "File to write the chain to (defaults to stdout)")
+	fs.Parse(args)
+
+	export := new(ChainExport)
+	if *dataDir != "" {
+		m, chain, err := loadStoredChain(openBlockStore(*dataDir))
+		if checkError(err) != nil {
+			os.Exit(1)
+		}
+		// Only the headers of the blocks up to the snapshot are left
+		if m.blockchainHead != m.settings.GenesisBlockHash {
+			checkError(errorLib.PrunedError(m.blockchainHead))
+			os.Exit(1)
+		}
+		export.GenesisBlockHash = m.settings.GenesisBlockHash
+		export.Blocks = chain
+	} else {
+		admin, err := rpc.DialHTTP("tcp", *adminAddr)
+		if checkError(err) != nil {
+			os.Exit(1)
+		}
+		defer admin.Close()
+		if checkError(admin.Call("Admin.ExportChain", "", export)) != nil {
+			os.Exit(1)
+		}
+	}
+
+	encoded, err := json.MarshalIndent(export, "", "  ")
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		fmt.Println(string(encoded))
+	} else if checkError(ioutil.WriteFile(*out, encoded, 0644)) != nil {
+		os.Exit(1)
+	}
+}
+
+// Writes a signed snapshot of a running miner's main chain, which new
+// miners can be bootstrapped from
+func snapshotCommand(args []string) {
+	fs := newCommandFlagSet("snapshot")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	out := fs.String("o", "", "File to write the snapshot to (defaults to stdout)")
+	fs.Parse(args)
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+	snapshot := new(BootstrapSnapshot)
+	if checkError(admin.Call("Admin.Snapshot", "", snapshot)) != nil {
+		os.Exit(1)
+	}
+
+	encoded, err := json.Marshal(snapshot)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		fmt.Println(string(encoded))
+	} else if checkError(ioutil.WriteFile(*out, encoded, 0644)) != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Snapshot of block", snapshot.Snapshot.BlockNo, "signed by", snapshot.PubKeyString)
+}
+
+// Writes the canvas as of a block (by default the final block) to
+// <name>.svg, with its manifest signed by the miner's key to <name>.json.
+// With -verify, checks instead that an export's manifest is signed (by
+// -key, if given) and matches its svg.
+func canvasCommand(args []string) {
+	fs := newCommandFlagSet("canvas")
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "Address of the admin RPC socket")
+	blockHash := fs.String("block", "", "Hash of the block to export the canvas as of (defaults to the final block)")
+	name := fs.String("o", "canvas", "Name of the files to write the svg and manifest to, or to verify")
+	verify := fs.Bool("verify", false, "Check an export instead of writing one")
+	trustedKey := fs.String("key", "", "Public key the manifest checked with -verify must be signed by")
+	fs.Parse(args)
+
+	if *verify {
+		svg, err := ioutil.ReadFile(*name + ".svg")
+		if checkError(err) != nil {
+			os.Exit(1)
+		}
+		encoded, err := ioutil.ReadFile(*name + ".json")
+		if checkError(err) != nil {
+			os.Exit(1)
+		}
+		manifest := new(CanvasManifest)
+		if checkError(json.Unmarshal(encoded, manifest)) != nil || checkError(verifyCanvasExport(manifest, svg, *trustedKey)) != nil {
+			os.Exit(1)
+		}
+		fmt.Println("Canvas of block", manifest.BlockNo, "["+manifest.BlockHash+"] with", len(manifest.Shapes), "shapes signed by", manifest.PubKeyString)
+		return
+	}
+
+	admin, err := rpc.DialHTTP("tcp", *adminAddr)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	defer admin.Close()
+	export := new(CanvasExport)
+	if checkError(admin.Call("Admin.ExportCanvas", *blockHash, export)) != nil {
+		os.Exit(1)
+	}
+
+	encoded, err := json.MarshalIndent(export.Manifest, "", "  ")
+	if checkError(err) != nil ||
+		checkError(ioutil.WriteFile(*name+".svg", []byte(export.Svg), 0644)) != nil ||
+		checkError(ioutil.WriteFile(*name+".json", encoded, 0644)) != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Canvas of block", export.Manifest.BlockNo, "with", len(export.Manifest.Shapes), "shapes signed by", export.Manifest.PubKeyString)
+}
+
+// Benchmarks the geometry ops on the reference shapes. If a
+// baseline written by an earlier run is given, exits with an error when
+// any benchmark is slower than its baseline by more than the tolerance.
+func benchCommand(args []string) {
+	fs := newCommandFlagSet("bench")
+	out := fs.String("o", "", "File to write the results to as JSON")
+	baselineFile := fs.String("baseline", "", "Results of an earlier run to compare against")
+	tolerance := fs.Float64("tolerance", DEFAULT_BENCH_TOLERANCE, "Percentage slowdown allowed relative to the baseline")
+	fs.Parse(args)
+
+	results := runShapeBenchmarks()
+	for _, result := range results {
+		fmt.Printf("%-24s %12d ns/op %8d allocs/op\n", result.Name, result.NsPerOp, result.AllocsPerOp)
+	}
+
+	if *out != "" {
+		encoded, err := json.MarshalIndent(results, "", "  ")
+		if checkError(err) != nil || checkError(ioutil.WriteFile(*out, encoded, 0644)) != nil {
+			os.Exit(1)
+		}
+	}
+
+	if *baselineFile != "" {
+		data, err := ioutil.ReadFile(*baselineFile)
+		if checkError(err) != nil {
+			os.Exit(1)
+		}
+		var baseline []BenchmarkResult
+		if checkError(json.Unmarshal(data, &baseline)) != nil {
+			os.Exit(1)
+		}
+
+		regressions := getBenchmarkRegressions(baseline, results, *tolerance)
+		for _, regression := range regressions {
+			fmt.Println("Regression: " + regression)
+		}
+		if len(regressions) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("No regressions against " + *baselineFile)
+	}
+}
+
+// </COMMANDS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS : MINER>
+
+func (m *Miner) init(args []string) {
+	if len(args) < 1 {
+		logger.Fatalln("Missing server address, give it as an argument or in a -config file")
+	}
+	m.serverAddr = args[0]
+	m.initState()
+	if m.keyFile == "" && len(args) < 3 {
+		logger.Fatalln("Missing keys, please generate with: go run ink-miner.go keygen")
+	}
+
+	pubKeyString, privKey, err := m.loadKeys(args[1:])
+	if checkError(err) != nil {
+		logger.Fatalln(err)
+	}
+	logger.Println("Keys are correct and verified")
+
+	m.privKey = *privKey
+	m.pubKey = privKey.PublicKey
+	m.pubKeyString = pubKeyString
+
+	m.newLongestChain = false
+}
+
+// Creates the miner's lock and its peer, session and gossip bookkeeping,
+// all empty. The chain is set up separately by initBlockchainCache, once
+// the network settings are known.
+func (m *Miner) initState() {
+	m.lock = &sync.RWMutex{}
+	m.blockChildren = make(map[string][]string)
+	m.nonces = make(map[string]time.Time)
+	m.tokens = make(map[string]*ArtnodeSession)
+	m.miners = make(map[string]*rpc.Client)
+	m.peerLatencies = make(map[string]time.Duration)
+	m.peerMempools = make(map[string]MempoolSummary)
+	m.peerSlots = make(map[string]*PeerSlot)
+	m.peerStats = make(map[string]*peerCounters)
+	m.pulledOps = make(map[string]bool)
+	m.pinnedOps = make(map[string]uint32)
+	m.rejections = newOpRejectionLog(MAX_REJECTION_LOG_OPS)
+	m.receipts = newOpReceiptLog(MAX_RECEIPT_LOG_OPS)
+	m.traces = newTraceLog(MAX_TRACE_LOG_ENTRIES)
+	m.gossipEpoch = time.Now().UnixNano()
+	m.registry = newMinerRegistry()
+	m.replayGuard = newGossipReplayGuard(m.registry)
+	m.arrivals = newBlockArrivals()
+	m.locks = newAdvisoryLocks()
+	m.bans = newPeerBans()
+	m.stopping = make(chan struct{})
+	m.opSources = make(map[string]string)
+	m.forkStats = newForkStats(MAX_FORK_STATS_HEAD_CHANGES)
+	m.blockIntervals = newBlockIntervalStats(MAX_BLOCK_INTERVALS)
+	m.events = newEventBus(EVENT_INBOX_SIZE)
+}
+
+// Reads the miner's keypair from its key file if it has one, or else takes
+// the given hex encoded public and private keys, and checks that the keys
+// match
+func (m *Miner) loadKeys(args []string) (pubKeyString string, privKey *ecdsa.PrivateKey, err error) {
+	if m.keyFile != "" {
+		encoded, err := ioutil.ReadFile(m.keyFile)
+		if err != nil {
+			return "", nil, err
+		}
+		// As written by keygen: the public key, then the private key
+		args = strings.Fields(string(encoded))
+		if len(args) < 2 {
+			return "", nil, fmt.Errorf("key file %s doesn't hold a public and a private key", m.keyFile)
+		}
+	}
+
+	privBytes, _ := hex.DecodeString(args[1])
+	privKey, err = x509.ParseECPrivateKey(privBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error with Private Key: %v", err)
+	}
+
+	pubKey := parseStringPubKey(args[0])
+	data := []byte("Hello World")
+	r, s, _ := ecdsa.Sign(rand.Reader, privKey, data)
+	if pubKey == nil || !ecdsa.Verify(pubKey, data, r, s) {
+		return "", nil, fmt.Errorf("Keys don't match, try again")
+	}
+	return args[0], privKey, nil
+}
+
+func (m *Miner) listenRPC() {
+	listenAddr := m.rpcAddr
+	if listenAddr == "" {
+		addrs, _ := net.InterfaceAddrs()
+		var externalIP string
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				if ipnet.IP.To4() != nil {
+					externalIP = ipnet.IP.String()
+				}
+			}
+		}
+		listenAddr = externalIP + ":0"
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	checkError(err)
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	checkError(err)
+	rpc.Register(m)
+	roles := getRPCRoles()
+	m.localAddr = listener.Addr()
+	logger.Println("Listening on: ", listener.Addr().String())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			checkError(err)
+			logger.Println("New connection!")
+			go m.serveRPCConn(rpc.DefaultServer, conn, roles)
+		}
+	}()
+}
+
+// Serves the RPCs of a connection to the main listener. With peer TLS, a
+// connection that starts with a TLS handshake is a peer's, and any other
+// is an art node's, on which the miner RPCs are refused.
+func (m *Miner) serveRPCConn(server *rpc.Server, conn net.Conn, roles map[string]string) {
+	if m.peerTLS == nil {
+		server.ServeCodec(newLabelledGobCodec(conn, roles))
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if first[0] != TLS_HANDSHAKE_RECORD {
+		codec := newLabelledGobCodec(peekedConn{conn, reader}, roles)
+		codec.refuseGossip = true
+		server.ServeCodec(codec)
+		return
+	}
+
+	tlsConn := tls.Server(peekedConn{conn, reader}, m.peerTLS.config)
+	tlsConn.SetDeadline(time.Now().Add(time.Duration(TLS_HANDSHAKE_TIMEOUT) * time.Millisecond))
+	if err = tlsConn.Handshake(); err != nil {
+		logger.Println("Refused peer [" + conn.RemoteAddr().String() + "]: " + err.Error())
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	server.ServeCodec(newLabelledGobCodec(tlsConn, roles))
+}
+
+// Serves the artnode RPCs over JSON-RPC, for art apps that don't use the
+// Go blockartlib. Miners keep talking to each other over gob on the main
+// listener.
+func (m *Miner) listenJSONRPC() {
+	if m.jsonAddr == "" {
+		return
+	}
+	server := rpc.NewServer()
+	server.RegisterName("Miner", &ArtnodeJSON{m})
+	listener, err := net.Listen("tcp", m.jsonAddr)
+	if checkError(err) != nil {
+		logger.Fatalln("Couldn't open JSON-RPC listener on", m.jsonAddr)
+	}
+	logger.Println("JSON-RPC listening on: ", listener.Addr().String())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if checkError(err) != nil {
+				continue
+			}
+			go withRole(ROLE_ARTNODE, func() {
+				server.ServeCodec(jsonrpc.NewServerCodec(conn))
+			})
+		}
+	}()
+}
+
+// Serves the artnode RPCs over TLS, with a certificate for the miner's key
+// that art nodes can check (see blockartlib.OpenSecureCanvas), so that the
+// GetToken handshake and the calls made with its token can't be read or
+// replayed by anyone on the path between them. The miner RPCs are refused,
+// since other miners connect to -listen.
+func (m *Miner) listenArtnodeTLS() {
+	if m.artnodeTLSAddr == "" {
+		return
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: m.artnodeTLS.config.GetCertificate}
+	listener, err := tls.Listen("tcp", m.artnodeTLSAddr, config)
+	if checkError(err) != nil {
+		logger.Fatalln("Couldn't open artnode TLS listener on", m.artnodeTLSAddr)
+	}
+	logger.Println("Artnode TLS listening on: ", listener.Addr().String())
+	go m.serveArtnodeTLS(rpc.DefaultServer, listener)
+}
+
+// Serves the artnode RPCs of the connections to the artnode TLS listener
+// until it is closed
+func (m *Miner) serveArtnodeTLS(server *rpc.Server, listener net.Listener) {
+	roles := getRPCRoles()
+	for {
+		conn, err := listener.Accept()
+		if checkError(err) != nil {
+			return
+		}
+		codec := newLabelledGobCodec(conn, roles)
+		codec.refuseGossip = true
+		go server.ServeCodec(codec)
+	}
+}
+
+// Serves the admin RPCs over HTTP on a loopback-only socket, separately
+// from the RPCs exposed to art nodes and other miners. /metrics serves
+// the peer statistics, /debug/pprof/ the runtime profiles (see
+// net/http/pprof), and any other path on the socket the dashboard.
+func (m *Miner) listenAdminRPC() {
+	server := rpc.NewServer()
+	server.RegisterName("Admin", &MinerAdmin{m})
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.HandleFunc("/metrics", m.serveMetrics)
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	mux.HandleFunc("/", m.serveDashboard)
+	listener, err := net.Listen("tcp", m.adminAddr)
+	if checkError(err) != nil {
+		logger.Fatalln("Couldn't open admin socket on", m.adminAddr)
+	}
+	logger.Println("Admin socket listening on: ", listener.Addr().String())
+	go withRole(ROLE_ADMIN, func() {
+		http.Serve(listener, mux)
+	})
+}
+
+// Ink miner registers their address and public key to the server and starts sending heartbeats
+func (m *Miner) registerWithServer() {
+	serverConn, err := rpc.Dial("tcp", m.serverAddr)
+	if checkError(err) != nil {
+		log.Fatal("Server is not reachable")
+	}
+	settings := new(MinerNetSettings)
+	err = serverConn.Call("RServer.Register", &MinerInfo{m.localAddr, m.pubKey}, settings)
+	if checkError(err) != nil {
+		//TODO: Crashing for now, will need to revisit if there is any softer way to handle the error
+		log.Fatal("Couldn't Register to Server")
+	}
+	m.lock.Lock()
+	m.serverConn = serverConn
+	m.settings = settings
+	m.lock.Unlock()
+	m.registry.setServer(serverConn, m.pubKey)
+	if m.store != nil {
+		checkError(m.store.saveSettings(settings))
+	}
+	go m.startHeartBeats(serverConn, m.pubKey, settings.HeartBeat)
+}
+
+// Sends heartbeats to the server, a little more often than the given
+// heartbeat interval, to maintain connection, until the connection is
+// closed. If the server no longer knows the key, e.g. because a late
+// heartbeat let the registration time out, the miner registers again.
+func (m *Miner) startHeartBeats(serverConn *rpc.Client, pubKey ecdsa.PublicKey, heartBeat uint32) {
+	var ignored bool
+	err := serverConn.Call("RServer.HeartBeat", pubKey, &ignored)
+	for {
+		if err == rpc.ErrShutdown {
+			return
+		} else if err == rpc.ServerError(SERVER_UNKNOWN_KEY_ERROR) {
+			logger.Println("Server lost the registration, registering again")
+			if err = serverConn.Call("RServer.Register", &MinerInfo{m.localAddr, pubKey}, new(MinerNetSettings)); err != nil {
+				logger.Println("Couldn't register again:", err)
+			}
+		}
+		time.Sleep(time.Duration(heartBeat-TIME_BUFFER) * time.Millisecond)
+		err = serverConn.Call("RServer.HeartBeat", pubKey, &ignored)
+	}
+}
+
+// Restarts the miner's networking without dropping its chain state, to
+// recover from a network flap: the keys are read again (from the key file,
+// if there is one), the connections to the server and to every peer are
+// torn down, and the miner registers with the server again, taking the
+// network settings it now returns. It then connects to new peers, receives
+// the blocks it missed from the longest of their chains, and goes back to
+// mining on its in-memory chain.
+//
+// The server only lets the miner register again once its old registration
+// has timed out, so the miner retries a heartbeat apart. The settings must
+// be for the same canvas, i.e. have the same genesis block. A miner that
+// fails to register stays disconnected until it is restarted again.
+func (m *Miner) softRestart() (result RestartResult, err error) {
+	pubKeyString, privKey := m.pubKeyString, &m.privKey
+	if m.keyFile != "" {
+		if pubKeyString, privKey, err = m.loadKeys(nil); err != nil {
+			return
+		}
+	}
+
+	for minerAddr, minerConn := range m.miners {
+		minerConn.Close()
+		m.dropPeer(minerAddr)
+	}
+	if m.serverConn != nil {
+		m.serverConn.Close()
+	}
+	result.KeyChanged = pubKeyString != m.pubKeyString
+	m.privKey, m.pubKey, m.pubKeyString = *privKey, privKey.PublicKey, pubKeyString
+	if result.KeyChanged && m.artnodeTLS != nil {
+		// A certificate given with -tls-cert is for the old key
+		cert, err := newMinerCertificate(privKey)
+		if err != nil {
+			return result, err
+		}
+		m.artnodeTLS.setCertificate(cert)
+	}
+	result.PubKeyString = pubKeyString
+
+	serverConn, err := rpc.Dial("tcp", m.serverAddr)
+	if err != nil {
+		return result, errorLib.DisconnectedError(m.serverAddr)
+	}
+	settings := new(MinerNetSettings)
+	for attempt := 1; ; attempt++ {
+		err = serverConn.Call("RServer.Register", &MinerInfo{m.localAddr, m.pubKey}, settings)
+		if err == nil || attempt == RESTART_REGISTER_ATTEMPTS {
+			break
+		}
+		time.Sleep(time.Duration(m.settings.HeartBeat) * time.Millisecond)
+	}
+	if err != nil {
+		serverConn.Close()
+		return
+	} else if settings.GenesisBlockHash != m.settings.GenesisBlockHash {
+		serverConn.Close()
+		return result, errorLib.InvalidBlockHashError(settings.GenesisBlockHash)
+	}
+
+	m.serverConn = serverConn
+	m.settings = settings
+	m.registry.setServer(serverConn, m.pubKey)
+	if m.store != nil {
+		checkError(m.store.saveSettings(settings))
+	}
+	go m.startHeartBeats(serverConn, m.pubKey, settings.HeartBeat)
+	logger.Println("Registered with the server again")
+
+	m.getMiners()
+	result.NumPeers = len(m.miners)
+	result.BlocksReceived = m.catchUpWithPeers()
+	m.newLongestChain = true
+	m.updateReadReplica()
+	return
+}
+
+// Stops the miner on the first SIGINT or SIGTERM, see shutdown, and exits
+// right away on the second, in case shutting down hangs
+func (m *Miner) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Println("Received", sig, "- shutting down")
+	m.stop()
+	<-signals
+	logger.Println("Received a second signal, exiting without shutting down")
+	os.Exit(1)
+}
+
+// Asks the miner to stop: it mines no new block, and the mining loop
+// returns once the nonces being hashed are done
+func (m *Miner) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopping)
+	})
+}
+
+// Determines whether the miner was asked to stop
+func (m *Miner) isStopping() bool {
+	select {
+	case <-m.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shuts a stopped miner down cleanly, so that it doesn't die in the middle
+// of sending a block: waits up to SHUTDOWN_TIMEOUT milliseconds for the
+// blocks and ops being sent to its peers, commits its pending ops and head
+// to the store (waiting for any pruning to finish), deregisters from the
+// server so that it stops handing out the miner's address, and closes its
+// connections to the server and its peers. The miner's lock is held from
+// then on, so that nothing changes its state before the process exits.
+func (m *Miner) shutdown() {
+	m.lock.Lock()
+	m.sendOpBatch()
+	m.lock.Unlock()
+
+	deadline := time.Now().Add(time.Duration(SHUTDOWN_TIMEOUT) * time.Millisecond)
+	for atomic.LoadInt64(&m.sends) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(CANVAS_WAIT_POLL) * time.Millisecond)
+	}
+	if sends := atomic.LoadInt64(&m.sends); sends > 0 {
+		logger.Println("Gave up waiting for", sends, "sends to peers")
+	}
+
+	m.lock.Lock()
+	if m.store != nil {
+		m.store.pruneLock.Lock()
+		m.storePendingOps()
+		m.store.pruneLock.Unlock()
+	}
+
+	if m.serverConn != nil {
+		if request, err := m.newDeregisterRequest(); checkError(err) == nil {
+			call := m.serverConn.Go("RServer.Deregister", request, new(bool), nil)
+			select {
+			case <-call.Done:
+				checkError(call.Error)
+			case <-time.After(time.Until(deadline)):
+				logger.Println("Server didn't answer the deregistration")
+			}
+		}
+		m.serverConn.Close()
+	}
+	for minerAddr, minerConn := range m.miners {
+		minerConn.Close()
+		m.dropPeer(minerAddr)
+	}
+	logger.Println("Shut down")
+}
+
+// Returns a request to deregister the miner, timestamped now and signed
+// with its key, so that the server knows it comes from the miner
+func (m *Miner) newDeregisterRequest() (request DeregisterRequest, err error) {
+	request.Key = m.pubKey
+	request.Timestamp = time.Now().UnixNano()
+	request.R, request.S, err = ecdsa.Sign(rand.Reader, &m.privKey, getDeregisterDigest(request.Timestamp))
+	return
+}
+
+// Returns the digest a miner signs to deregister, which must match the
+// server's: the SHA-256 hash of the JSON array
+// ["RServer.Deregister", timestamp]
+func getDeregisterDigest(timestamp int64) []byte {
+	encoded, _ := json.Marshal([]interface{}{"RServer.Deregister", timestamp})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
+
+// Runs a send to a peer in the background, counted as in flight until it
+// returns so that shutdown can wait for it
+func (m *Miner) goSend(send func()) {
+	atomic.AddInt64(&m.sends, 1)
+	go func() {
+		defer atomic.AddInt64(&m.sends, -1)
+		send()
+	}()
+}
+
+// Receives the blocks of the longest chain among the connected miners that
+// are missing from the blocktree, oldest first, as if they had been sent,
+// so that a miner that was cut off for a while catches up without a resync.
+// Only the blocks after its own chain are downloaded (see
+// downloadBlocksSince), or from peers that can't send them that way, the
+// bodies of the blocks missing from the blocktree (see downloadChain).
+// Returns the number of blocks received.
+func (m *Miner) catchUpWithPeers() (numReceived int) {
+	request := new(MinerRequest)
+	lengths := make(map[string]int)
+	for minerAddr, minerCon := range m.miners {
+		response := new(MinerResponse)
+		if m.timedCall(minerAddr, minerCon, "Miner.GetBlockChainLength", request, response) == nil && len(response.Payload) > 0 {
+			lengths[minerAddr] = response.Payload[0].(int)
+		}
+	}
+
+	headNo := int(m.blockchain[m.blockchainHead].BlockNo)
+	peers := m.sortPeersForSync(lengths)
+	for _, pair := range peers {
+		if pair.Value <= headNo {
+			break
+		}
+		chain, err := m.downloadBlocksSince(pair.Key)
+		if err != nil && len(chain) == 0 {
+			chain, err = m.downloadChain(pair.Key, peers)
+		}
+		if len(chain) == 0 {
+			continue
+		}
+
+		for _, block := range chain {
+			if _, exists := m.blockchain[hashBlock(block)]; exists {
+				continue
+			} else if m.applyEvent(&MinerEvent{Type: BLOCK_RECEIVED, Block: block, Source: pair.Key}) != nil {
+				break
+			}
+			numReceived++
+		}
+		break
+	}
+	return
+}
+
+// Gets miners from server if below MinNumMinerConnections
+func (m *Miner) getMiners() {
+	var addrSet []net.Addr
+	for minerAddr, minerCon := range m.miners {
+		if !m.pingMiner(minerAddr, minerCon) {
+			m.dropPeer(minerAddr)
+		}
+	}
+	if len(m.miners) < int(m.settings.MinNumMinerConnections) {
+		m.serverConn.Call("RServer.GetNodes", m.pubKey, &addrSet)
+		m.connectToMiners(addrSet)
+	}
+}
+
+// Pings a connected miner, updating its latency and the summary of its
+// unmined ops. Returns whether it is still connected.
+func (m *Miner) pingMiner(minerAddr string, minerCon *rpc.Client) bool {
+	response := new(MinerResponse)
+	if m.timedCall(minerAddr, minerCon, "Miner.Ping", new(MinerRequest), response) != nil {
+		delete(m.peerLatencies, minerAddr)
+		delete(m.peerMempools, minerAddr)
+		return false
+	}
+	if len(response.Payload) > 1 {
+		m.peerMempools[minerAddr] = MempoolSummary{NumOps: response.Payload[0].(int), OpSigs: response.Payload[1].([]string)}
+		m.receipts.add(minerAddr, m.peerMempools[minerAddr].OpSigs, time.Now())
+	}
+	return true
+}
+
+// Refreshes the summary of unmined ops that this miner replies to pings
+// with. Called whenever a received op or block, or mining, may have changed
+// the unmined ops.
+func (m *Miner) updateMempoolSummary() {
+	ops := make([]*OperationRecord, 0, len(m.unminedOps))
+	for _, opRecord := range m.unminedOps {
+		ops = append(ops, opRecord)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Op.TimeStamp < ops[j].Op.TimeStamp
+	})
+	if len(ops) > MAX_MEMPOOL_SYNC_OPS {
+		ops = ops[:MAX_MEMPOOL_SYNC_OPS]
+	}
+
+	summary := MempoolSummary{NumOps: len(m.unminedOps), OpSigs: []string{}, inventory: []string{}, ops: make(map[string]OperationRecord)}
+	for i, opRecord := range ops {
+		if i < MAX_MEMPOOL_SUMMARY_OPS {
+			summary.OpSigs = append(summary.OpSigs, opRecord.OpSig)
+		}
+		summary.inventory = append(summary.inventory, opRecord.OpSig)
+		summary.ops[opRecord.OpSig] = *opRecord
+	}
+
+	m.mempoolLock.Lock()
+	m.mempool = summary
+	m.mempoolLock.Unlock()
+}
+
+// Replaces the read replica with one of the current head and tokens. When
+// the head only moved on by a block, the canvas is the old replica's with
+// that block applied; otherwise it is rebuilt from the chain.
+func (m *Miner) updateReadReplica() {
+	old := m.getReadReplica()
+	replica := &ReadReplica{
+		GenesisBlockHash: m.settings.GenesisBlockHash,
+		HeadHash:         m.blockchainHead,
+		InkRemaining:     m.inkAccounts[m.pubKeyString],
+		shapes:           old.shapes,
+		expiries:         old.expiries,
+		pendingShapes:    make(map[string]map[string]shapelib.Shape),
+		pendingDeletes:   make(map[string]map[string]bool),
+		tokens:           make(map[string]time.Time)}
+
+	if head := m.blockchain[m.blockchainHead]; head != nil && (m.blockchainHead != old.HeadHash || old.shapes == nil) {
+		if old.shapes != nil && head.PrevHash == old.HeadHash {
+			replica.shapes = make(map[string]shapelib.Shape)
+			for shapeHash, shape := range old.shapes {
+				replica.shapes[shapeHash] = shape
+			}
+			replica.expiries = make(map[uint32][]string)
+			for blockNo, shapeHashes := range old.expiries {
+				replica.expiries[blockNo] = append([]string{}, shapeHashes...)
+			}
+			applyBlockToCanvas(replica.shapes, replica.expiries, head)
+		} else {
+			replica.shapes, replica.expiries = m.getShapesAt(m.blockchainHead)
+		}
+	}
+	for token, session := range m.tokens {
+		replica.tokens[token] = session.Expires
+		for _, opSig := range session.OpSigs {
+			opRecord := m.unminedOps[opSig]
+			if opRecord == nil {
+				continue
+			} else if opRecord.Op.Type == ADD {
+				if replica.pendingShapes[token] == nil {
+					replica.pendingShapes[token] = make(map[string]shapelib.Shape)
+				}
+				replica.pendingShapes[token][opSig] = opRecord.Op.Shape
+			} else if opRecord.Op.Type == REMOVE {
+				if replica.pendingDeletes[token] == nil {
+					replica.pendingDeletes[token] = make(map[string]bool)
+				}
+				replica.pendingDeletes[token][opRecord.Op.Ref] = true
+			}
+		}
+	}
+
+	m.replicaLock.Lock()
+	m.replica = replica
+	m.replicaLock.Unlock()
+}
+
+// Returns the current read replica, which may be read without any lock
+func (m *Miner) getReadReplica() *ReadReplica {
+	m.replicaLock.Lock()
+	defer m.replicaLock.Unlock()
+
+	if m.replica == nil {
+		return &ReadReplica{}
+	}
+	return m.replica
+}
+
+// Pulls the unmined ops that connected miners listed in their last reply
+// to a ping but that this miner has never seen, if it has no ops of its
+// own to mine, so that it doesn't mine a no-op block while ops are waiting
+// elsewhere in the network. Each op is only pulled once, however it turns
+// out. Must be called without holding the lock.
+func (m *Miner) pullMissingOps() {
+	m.lock.Lock()
+	if len(m.unminedOps) > 0 {
+		m.lock.Unlock()
+		return
+	}
+
+	missing := make(map[string][]string)
+	miners := make(map[string]*rpc.Client)
+	listed := make(map[string]bool)
+	for minerAddr, summary := range m.peerMempools {
+		minerCon, connected := m.miners[minerAddr]
+		if !connected {
+			continue
+		}
+		for _, opSig := range summary.OpSigs {
+			listed[opSig] = true
+			if m.pulledOps[opSig] || m.hasOp(opSig) {
+				continue
+			}
+			m.pulledOps[opSig] = true
+			missing[minerAddr] = append(missing[minerAddr], opSig)
+			miners[minerAddr] = minerCon
+		}
+	}
+	// Ops that no peer lists any more won't be pulled again anyway
+	for opSig := range m.pulledOps {
+		if !listed[opSig] {
+			delete(m.pulledOps, opSig)
+		}
+	}
+	m.lock.Unlock()
+
+	for minerAddr, opSigs := range missing {
+		request := new(MinerRequest)
+		request.Payload = []interface{}{opSigs}
+		response := new(MinerResponse)
+		if err := miners[minerAddr].Call("Miner.GetOps", request, response); err != nil || len(response.Payload) == 0 {
+			continue
+		}
+
+		traceIDs := getOpsTraceIDs(response)
+		ops := response.Payload[0].([]OperationRecord)
+		for i := range ops {
+			logTrace(traceIDs[i], "Pulled op from ["+minerAddr+"]: "+ops[i].OpSig)
+			m.events.submit(&MinerEvent{Type: OP_RECEIVED, Op: &ops[i], Source: minerAddr, TraceID: traceIDs[i]})
+		}
+	}
+}
+
+// Exchanges mempools with a newly connected miner: pulls the unmined ops
+// in its inventory that this miner has never seen, so that it doesn't mine
+// blocks missing ops the rest of the network is waiting on. The miner does
+// the same on its side of the connection. At most MAX_MEMPOOL_SYNC_OPS ops
+// are exchanged. Must be called without holding the lock.
+func (m *Miner) syncMempool(minerAddr string, minerCon *rpc.Client) {
+	inventory := new(MinerResponse)
+	if err := minerCon.Call("Miner.GetMempoolInventory", new(MinerRequest), inventory); err != nil || len(inventory.Payload) < 2 {
+		return
+	}
+
+	m.lock.Lock()
+	m.receipts.add(minerAddr, inventory.Payload[1].([]string), time.Now())
+	missing := []string{}
+	for _, opSig := range inventory.Payload[1].([]string) {
+		if !m.hasOp(opSig) && len(missing) < MAX_MEMPOOL_SYNC_OPS {
+			missing = append(missing, opSig)
+		}
+	}
+	m.lock.Unlock()
+	if len(missing) == 0 {
+		return
+	}
+
+	request := new(MinerRequest)
+	request.Payload = []interface{}{missing}
+	response := new(MinerResponse)
+	if err := minerCon.Call("Miner.GetOps", request, response); err != nil || len(response.Payload) == 0 {
+		return
+	}
+
+	ops := response.Payload[0].([]OperationRecord)
+	logger.Println(fmt.Sprintf("Synced %d of the %d unmined ops held by [%s]", len(ops), inventory.Payload[0], minerAddr))
+	traceIDs := getOpsTraceIDs(response)
+	for i := range ops {
+		m.events.submit(&MinerEvent{Type: OP_RECEIVED, Op: &ops[i], Source: minerAddr, TraceID: traceIDs[i]})
+	}
+}
+
+// Calls an RPC on a connected miner and, if it succeeds, folds its
+// round-trip time into the miner's smoothed latency
+func (m *Miner) timedCall(minerAddr string, minerCon *rpc.Client, method string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	err := minerCon.Call(method, args, reply)
+	if err != nil {
+		return err
+	}
+
+	rtt := time.Since(start)
+	if latency, measured := m.peerLatencies[minerAddr]; measured {
+		rtt = time.Duration(PEER_LATENCY_SMOOTHING*float64(rtt) + (1-PEER_LATENCY_SMOOTHING)*float64(latency))
+	}
+	m.peerLatencies[minerAddr] = rtt
+	return nil
+}
+
+// Orders peers for fetching the chain from: longest chain first, and the
+// lowest latency first among peers with chains of the same length. Peers
+// whose latency hasn't been measured come after those whose has.
+func (m *Miner) sortPeersForSync(minerAndLength map[string]int) PairList {
+	pl := make(PairList, 0, len(minerAndLength))
+	for k, v := range minerAndLength {
+		pl = append(pl, Pair{k, v})
+	}
+	sort.Slice(pl, func(i, j int) bool {
+		if pl[i].Value != pl[j].Value {
+			return pl[i].Value > pl[j].Value
+		}
+		latencyI, measuredI := m.peerLatencies[pl[i].Key]
+		latencyJ, measuredJ := m.peerLatencies[pl[j].Key]
+		if measuredI != measuredJ {
+			return measuredI
+		}
+		return latencyI < latencyJ
+	})
+	return pl
+}
+
+// Establishes RPC connections with miners in addrs array, as long as there
+// are free outbound slots. Banned miners are skipped.
+func (m *Miner) connectToMiners(addrs []net.Addr) {
+	for _, minerAddr := range addrs {
+		if m.miners[minerAddr.String()] == nil && !m.bans.isBanned(minerAddr.String(), time.Now()) {
+			if m.countPeers(false) >= m.maxOutbound {
+				return
+			}
+			if err := m.connectToPeer(minerAddr.String()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// Connects to a miner in an outbound slot, whether or not one is free,
+// asks it to connect back and syncs mempools with it
+func (m *Miner) connectToPeer(minerAddr string) error {
+	minerConn, err := m.dialPeer(minerAddr)
+	if err != nil {
+		m.dropPeer(minerAddr)
+		return err
+	}
+	m.addPeer(minerAddr, minerConn, false)
+	response := new(MinerResponse)
+	request := new(MinerRequest)
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = m.localAddr.String()
+	minerConn.Call("Miner.BidirectionalSetup", request, response)
+	go m.syncMempool(minerAddr, minerConn)
+	return nil
+}
+
+// When a new miner joins the network, it'll ask all the neighbouring miners for their longest chain
+// After retrieving the chain, it'll use one of them as it's starting chain
+// This method will do the following:
+//	After returning with a chain
+// 	- Validate the shape with existing miner states (ink, exisiting shapes)
+//	- Apply the Block's state to the miner to validate future blocks
+// 	- Revert the blocks to earse the memory
+
+// After the checks, it'll keep the current longest valid chain
+// The new miner will then apply the blocks again and start mining from the end of that chain
+
+func (m *Miner) initBlockchain() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	request := new(MinerRequest)
+
+	m.initBlockchainCache()
+
+	// For each connected Miner, get the length of their longest chain first
+	mapMinerAndLength := make(map[string]int)
+	for minerAddr, minerCon := range m.miners {
+		singleResponse := new(MinerResponse)
+		m.timedCall(minerAddr, minerCon, "Miner.GetBlockChainLength", request, singleResponse)
+		if len(singleResponse.Payload) > 0 {
+			lengthMinerChain := singleResponse.Payload[0].(int)
+			mapMinerAndLength[minerAddr] = lengthMinerChain
+		}
+	}
+
+	sortedMap := m.sortPeersForSync(mapMinerAndLength)
+	// Then get go through from highest to lowest, nearest first
+	for _, pair := range sortedMap {
+		if chain, err := m.downloadChain(pair.Key, sortedMap); err == nil && len(chain) > 0 {
+			// If a block is invalid, the chain is also invalid, so move on to the next chain.
+			// Else, each block is applied to simulate the chain up to it
+			_, err = m.applyChain(chain, true)
+
+			// If the chain is valid and longer than any other valid chain we've received,
+			// then set it as the new longest chain
+			if err == nil {
+				logger.Println("Got an existing chain, start mining at blockNo: ", m.blockchain[m.blockchainHead].BlockNo+1)
+				break
+			}
+
+			// Reset the miner state
+			m.initBlockchainCache()
+			// otherwise go to the next one
+		}
+	}
+	m.storePendingOps()
+	m.updateReadReplica()
+}
+
+func (m *Miner) initBlockchainCache() {
+	m.unminedOps = make(map[string]*OperationRecord)
+	m.unvalidatedOps = make(map[string]*OperationRecord)
+	m.validatedOps = make(map[string]*OperationRecord)
+	m.failedOps = make(map[string]*OperationRecord)
+	m.tempOps = make(map[string]*OperationRecord)
+	m.blockchain = make(map[string]*Block)
+	m.inkAccounts = make(map[string]uint32)
+	m.inkAccounts[m.pubKeyString] = 0
+	m.allowances = make(map[string]map[string]uint32)
+	m.rotatedKeys = make(map[string]KeyRotation)
+	m.revocations = make(map[string]uint32)
+	m.expiredOps = make(map[string]bool)
+	m.prunedOps = make(map[string]bool)
+	m.occupancy = shapelib.NewCanvasOccupancyWithEngine(shapelib.DEFAULT_OCCUPANCY_CELL_SIZE, m.getEngine())
+	m.attestations = make(map[string]map[string]Attestation)
+	m.finalBlock = ""
+
+	genesisBlock := &Block{0, "", []OperationRecord{}, 0, 0, 0, "", 0}
+	m.blockchain[m.settings.GenesisBlockHash] = genesisBlock
+	m.blockchainHead = m.settings.GenesisBlockHash
+	m.positions = map[string]ChainPosition{m.settings.GenesisBlockHash: ChainPosition{}}
+	m.ledgers = map[string]InkLedger{m.settings.GenesisBlockHash: InkLedger{}}
+	m.minedBlocks = make(map[string][]string)
+}
+
+// Reconciles the ops that were pending when the miner last stopped with the
+// chain it has just synced. Missing blocks that stored ops were in are
+// fetched, and ops that are no longer on the main chain are re-queued so
+// that they get mined again.
+func (m *Miner) reconcileStoredOps(storedOps []StoredOp) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(storedOps) == 0 {
+		return
+	}
+
+	fetched := 0
+	for _, storedOp := range storedOps {
+		if _, exists := m.blockchain[storedOp.BlockHash]; storedOp.BlockHash == "" || exists {
+			continue
+		}
+		if m.fetchBlock(storedOp.BlockHash) {
+			fetched++
+		} else {
+			logger.Println("Couldn't fetch block [" + storedOp.BlockHash + "] of a stored op")
+		}
+	}
+
+	requeued := []*OperationRecord{}
+	for i := range storedOps {
+		opRecord := storedOps[i].Record
+		_, unminedExists := m.unminedOps[opRecord.OpSig]
+		_, unvalidExists := m.unvalidatedOps[opRecord.OpSig]
+		_, validExists := m.validatedOps[opRecord.OpSig]
+		if unminedExists || unvalidExists || validExists {
+			continue
+		}
+		if opRecord.PubKeyString != m.pubKeyString || !m.validateSignature(opRecord) {
+			continue
+		}
+		m.unminedOps[opRecord.OpSig] = &opRecord
+		requeued = append(requeued, &opRecord)
+	}
+
+	if len(requeued) > 0 {
+		m.validateUnminedOps()
+		for _, opRecord := range requeued {
+			if _, exists := m.unminedOps[opRecord.OpSig]; exists {
+				m.disseminateOpToConnectedMiners(opRecord)
+			}
+		}
+	}
+	m.storePendingOps()
+
+	logger.Println("Reconciled", len(storedOps), "stored ops:", fetched, "blocks fetched,", len(requeued), "ops re-queued")
+}
+
+// Fetches a missing block, along with any of its ancestors that are missing
+// too, from the local store or else from connected miners, and receives
+// them as if they had been sent. Returns whether the block is now in the
+// blocktree.
+func (m *Miner) fetchBlock(blockHash string) bool {
+	missing := []*Block{}
+	for currHash := blockHash; ; {
+		if _, exists := m.blockchain[currHash]; exists {
+			break
+		}
+		block := m.findMissingBlock(currHash)
+		// Each ancestor must be one block closer to the genesis block, so
+		// that a bad peer can't keep this going
+		if block == nil || block.BlockNo == 0 || (len(missing) > 0 && block.BlockNo+1 != missing[len(missing)-1].BlockNo) {
+			return false
+		}
+		missing = append(missing, block)
+		currHash = block.PrevHash
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if m.applyEvent(&MinerEvent{Type: BLOCK_RECEIVED, Block: missing[i]}) != nil {
+			return false
+		}
+	}
+	_, exists := m.blockchain[blockHash]
+	return exists
+}
+
+// Looks for a block that isn't in the blocktree, first in the local store
+// and then on each connected miner. Returns nil if it can't be found.
+func (m *Miner) findMissingBlock(blockHash string) *Block {
+	if m.store != nil {
+		if block, err := m.store.loadBlock(blockHash); err == nil {
+			return block
+		}
+	}
+
+	request := new(MinerRequest)
+	request.Payload = []interface{}{blockHash}
+	for minerAddr, minerCon := range m.miners {
+		response := new(MinerResponse)
+		err := m.timedCall(minerAddr, minerCon, "Miner.GetBlock", request, response)
+		if err != nil || response.Error != nil || len(response.Payload) == 0 {
+			continue
+		}
+		block := response.Payload[0].(Block)
+		if hashBlock(&block) == blockHash {
+			return &block
+		}
+	}
+	return nil
+}
+
+// Stores this miner's own unmined and unvalidated ops, if it has a store,
+// so that they can be reconciled with the chain after a restart, and then
+// commits the head they were stored at
+func (m *Miner) storePendingOps() {
+	if m.store == nil {
+		return
+	}
+
+	storedOps := []StoredOp{}
+	for _, opRecord := range m.unminedOps {
+		if opRecord.PubKeyString == m.pubKeyString {
+			storedOps = append(storedOps, StoredOp{storedOpRecord(opRecord), ""})
+		}
+	}
+	for opSig, opRecord := range m.unvalidatedOps {
+		if opRecord.PubKeyString == m.pubKeyString {
+			blockHash, _ := m.getOpBlockHash(opSig)
+			storedOps = append(storedOps, StoredOp{storedOpRecord(opRecord), blockHash})
+		}
+	}
+	if checkError(m.store.saveOps(storedOps)) == nil {
+		checkError(m.store.saveHead(m.blockchainHead))
+	}
+}
+
+// Returns a copy of an op record as it was signed, i.e. with none of its
+// validations counted and no error
+func storedOpRecord(opRecord *OperationRecord) OperationRecord {
+	stored := *opRecord
+	stored.Op.NumRemaining = stored.Op.ValidateNum
+	stored.Error = nil
+	return stored
+}
+
+// Creates a block and block hash that has a suffix of nHashZeroes
+// If successful, block is appended to the longestChainLastBlockHashin the blockchain map
+//
+// With a no-op interval set, a no-op block isn't worked on until the
+// interval has passed since this miner's last no-op block. Ops are always
+// mined right away.
+//
+// The nonces are hashed by the mining workers in batches, without the
+// lock; between batches the ops are selected again if they changed, and
+// mining stops if there is a new longest chain.
+func (m *Miner) mineBlock() {
+	m.pullMissingOps()
+
+	m.lock.Lock()
+	m.updateMempoolSummary()
+	var nonce uint32 = 0
+	prevHash := m.blockchainHead
+	blockNo := m.blockchain[prevHash].BlockNo + 1
+	if len(m.miningWorkers) == 0 {
+		m.miningWorkers = newMiningWorkers(1)
+	}
+	workers := m.miningWorkers
+	m.lock.Unlock()
+
+	var records []OperationRecord
+	numUnminedOps := -1
+	for {
+		m.lock.Lock()
+		if m.newLongestChain || m.isStopping() {
+			m.newLongestChain = false
+			m.lock.Unlock()
+			return
+		} else {
+			// Ops are only selected again once the unmined ops change
+			if len(m.unminedOps) != numUnminedOps || !m.allUnmined(records) {
+				records = m.selectOpsForBlock()
+				numUnminedOps = len(m.unminedOps)
+			}
+
+			var block Block
+			// Will create a opBlock or noOpBlock depending upon whether there are unmined ops that can be mined
+			if len(records) > 0 {
+				block = newBlock(blockNo, prevHash, records, m.pubKeyString, nonce)
+			} else if time.Since(m.lastNoOpBlock) < m.noOpInterval {
+				m.lock.Unlock()
+				time.Sleep(time.Duration(NOOP_BACKOFF_POLL) * time.Millisecond)
+				continue
+			} else {
+				block = newBlock(blockNo, prevHash, nil, m.pubKeyString, nonce)
+			}
+			difficulty := m.getPoWDifficulty(len(block.Records))
+			m.lock.Unlock()
+
+			solved, found := searchNonces(block, difficulty, workers)
+			nonce += uint32(len(workers)) * MINING_BATCH_NONCES
+			if !found {
+				continue
+			}
+
+			// The head and the ops may have changed while the nonces were
+			// being hashed
+			m.lock.Lock()
+			if !m.newLongestChain && m.blockchainHead == prevHash && m.allUnmined(solved.Records) && m.blockSuccessfullyMined(&solved) {
+				if len(solved.Records) == 0 {
+					m.lastNoOpBlock = time.Now()
+				}
+				m.lock.Unlock()
+				return
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// Hashes and times the nonces tried by one of the goroutines that mine
+// blocks. Its counters are updated atomically after every batch, so that
+// they can be read while it mines.
+type MiningWorker struct {
+	hashes  uint64
+	hashing int64
+}
+
+func newMiningWorkers(numWorkers int) []*MiningWorker {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	workers := make([]*MiningWorker, numWorkers)
+	for i := range workers {
+		workers[i] = new(MiningWorker)
+	}
+	return workers
+}
+
+// Returns the hashes per second the worker has tried over the time it has
+// spent hashing, 0 if it hasn't hashed yet
+func (w *MiningWorker) getHashRate() float64 {
+	hashing := time.Duration(atomic.LoadInt64(&w.hashing))
+	if hashing == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&w.hashes)) / hashing.Seconds()
+}
+
+// Hashes a batch of MINING_BATCH_NONCES nonces per worker, starting at the
+// block's nonce. The nonce space is partitioned between the workers: of
+// n workers, worker i tries the block's nonce plus i, i+n, i+2n and so on.
+// All of them stop as soon as one finds a nonce for which the block's hash
+// ends in difficulty zeroes, and that block is returned.
+func searchNonces(block Block, difficulty uint8, workers []*MiningWorker) (solved Block, found bool) {
+	suffix := strings.Repeat("0", int(difficulty))
+	base, step := block.Nonce, uint32(len(workers))
+	solutions := make(chan Block, len(workers))
+	var stopped int32
+	var wg sync.WaitGroup
+	for i, worker := range workers {
+		wg.Add(1)
+		go func(i uint32, worker *MiningWorker, candidate Block) {
+			defer wg.Done()
+			start := time.Now()
+			var hashes uint64
+			for j := uint32(0); j < MINING_BATCH_NONCES && atomic.LoadInt32(&stopped) == 0; j++ {
+				candidate.Nonce = base + i + j*step
+				hashes++
+				if strings.HasSuffix(hashBlock(&candidate), suffix) {
+					atomic.StoreInt32(&stopped, 1)
+					solutions <- candidate
+					break
+				}
+			}
+			atomic.AddUint64(&worker.hashes, hashes)
+			atomic.AddInt64(&worker.hashing, int64(time.Since(start)))
+		}(uint32(i), worker, block)
+	}
+	wg.Wait()
+
+	select {
+	case solved = <-solutions:
+		return solved, true
+	default:
+		return Block{}, false
+	}
+}
+
+// Determines whether all the given ops are still unmined
+func (m *Miner) allUnmined(records []OperationRecord) bool {
+	for _, opRecord := range records {
+		if _, unmined := m.unminedOps[opRecord.OpSig]; !unmined {
+			return false
+		}
+	}
+	return true
+}
+
+// Creates a block with its summary fields filled in from records
+func newBlock(blockNo uint32, prevHash string, records []OperationRecord, pubKeyString string, nonce uint32) Block {
+	opCount, inkDebited, inkCredited := summarizeRecords(records)
+	return Block{blockNo, prevHash, records, opCount, inkDebited, inkCredited, pubKeyString, nonce}
+}
+
+// Returns the number of records and the total ink debited by ADD ops and
+// credited by REMOVE ops. Totals are as wide as a block's summary fields,
+// so that they can't wrap.
+func summarizeRecords(records []OperationRecord) (opCount, inkDebited, inkCredited uint64) {
+	for _, record := range records {
+		if record.Op.Type == ADD {
+			inkDebited += uint64(record.Op.InkCost)
+		} else if record.Op.Type == REMOVE {
+			inkCredited += uint64(record.Op.InkCost)
+		}
+	}
+	return uint64(len(records)), inkDebited, inkCredited
+}
+
+// Asserts that a block's summary fields match its records
+func blockSummaryMatches(block *Block) bool {
+	opCount, inkDebited, inkCredited := summarizeRecords(block.Records)
+	return block.OpCount == opCount && block.InkDebited == inkDebited && block.InkCredited == inkCredited
+}
+
+// Manages miner state updates during a change of the blockchain head.
+//
+// Notes:
+// - When we are only doing a fast-forward, there is no 'oldBranch'. Also, 'newBranch'
+//   will only contain one block. Otherwise (if we are switching branches), this will
+//   not be the case.
+// - The first for-loop constructs part of the (and possibly the entire) newBranch.
+// - The second for-loop continues to construct newBranch while at the same time constructing
+//   oldBranch, so long as each pair of successive child blocks have the same BlockNo but are
+//   different blocks. This continues until the most recent common ancestor is reached, at
+//   which point the construction of newBranch and oldBranch will be complete.
+//
+// In the case of a branch switch, we perform the following procedure (this can also be
+// generalized to the simple case of a fast-forward):
+// - Traverse the blocks in the old branch one at a time, up to the most
+//   recent common ancestor
+//     - Update (reverse) ink accounts and shape expiries for each block
+//     - In each block, for each operation:
+//         - Reverse the ink associated with that operation
+//         - Add the operation to the unmined group
+//         - Remove the operation from all other groups
+// - Traverse the blocks in the new branch one at a time
+//     - Apply each block in order, starting at the child of the most recent common ancestor
+//     - Note: this MUST be done in order from oldest to newest, because of the way we decrement
+//       our validateNum counter. This is why we do a backwards traversal.
+//
+// Assumption: oldBlockHash and newBlockHash must both be valid block hashes
+// for blocks which exist in the miner's current block map, and are both
+// connected to the genesis block.
+//
+func (m *Miner) changeBlockchainHead(oldBlockHash, newBlockHash string) {
+	// newBlock and oldBlock are "current" block pointers
+	newBlock := m.blockchain[newBlockHash]
+	oldBlock := m.blockchain[oldBlockHash]
+	// newBranch and oldBranch are chains of blocks in the new and old branches
+	// up to the most recent common ancestor.
+	newBranch := []*Block{}
+	oldBranch := []*Block{}
+
+	// Construct the part of the new branch up to the block with the same BlockNo
+	// as the old branch head
+	for newBlock.BlockNo > oldBlock.BlockNo {
+		newBranch = append(newBranch, newBlock)
+		newBlock = m.blockchain[newBlock.PrevHash]
+	}
+
+	// Construct the part of the old branch up to the block with the same BlockNo
+	// as the new branch head
+	for newBlock.BlockNo < oldBlock.BlockNo {
+		oldBranch = append(oldBranch, oldBlock)
+		oldBlock = m.blockchain[oldBlock.PrevHash]
+	}
+
+	// Construct the rest of the new and old branches at the same time, until
+	// their pointers are equal.
+	for newBlock != oldBlock {
+		newBranch = append(newBranch, newBlock)
+		oldBranch = append(oldBranch, oldBlock)
+		newBlock = m.blockchain[newBlock.PrevHash]
+		oldBlock = m.blockchain[oldBlock.PrevHash]
+	}
+
+	// Move each operation in the old branch back to the unmined group and reverse
+	// ink accounts.
+	for _, block := range oldBranch {
+		m.reverseExpiries(block)
+		records := sortRecordsForInk(block.Records)
+		for i := len(records) - 1; i >= 0; i-- {
+			opRecord := records[i]
+			opRecord.Op.NumRemaining = opRecord.Op.ValidateNum
+			m.unminedOps[opRecord.OpSig] = &opRecord
+			delete(m.unvalidatedOps, opRecord.OpSig)
+			delete(m.validatedOps, opRecord.OpSig)
+			m.reverseOpInk(&opRecord)
+		}
+		m.reverseBlockInk(block)
+		m.vacateCanvas(block.Records)
+	}
+
+	// Apply the blocks in the new branch. NOTE THE ORDER IN WHICH THIS IS DONE.
+	// Must be oldest -> newest, in order to correctly validate unvalidated ops.
+	for i := len(newBranch) - 1; i >= 0; i-- {
+		m.applyBlock(newBranch[i])
+	}
+
+	// The new branch is empty when moving back to an ancestor, so the head
+	// has to be set explicitly.
+	m.blockchainHead = newBlockHash
+}
+
+// Returns the number of blocks in the branch of oldBlockHash that are not
+// ancestors of newBlockHash, i.e. how many blocks switching the head from
+// oldBlockHash to newBlockHash abandons.
+func (m *Miner) getForkDepth(oldBlockHash, newBlockHash string) (depth uint32) {
+	newBlock := m.blockchain[newBlockHash]
+	oldBlock := m.blockchain[oldBlockHash]
+
+	for newBlock.BlockNo > oldBlock.BlockNo {
+		newBlock = m.blockchain[newBlock.PrevHash]
+	}
+	for newBlock.BlockNo < oldBlock.BlockNo {
+		oldBlock = m.blockchain[oldBlock.PrevHash]
+		depth++
+	}
+	for newBlock != oldBlock {
+		newBlock = m.blockchain[newBlock.PrevHash]
+		oldBlock = m.blockchain[oldBlock.PrevHash]
+		depth++
+	}
+
+	return depth
+}
+
+// Sends block to all connected miners
+// Makes sure that enough miners are connected; if under minimum, it calls for more
+func (m *Miner) disseminateToConnectedMiners(block *Block) error {
+	m.getMiners() // checks all miners, connects to more if needed
+	request := new(MinerRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = *block
+	request.Payload[1] = m.localAddr.String()
+	request.TraceID = m.traces.get(hashBlock(block))
+	m.sealGossip(request)
+	for minerAddr, minerCon := range m.miners {
+		if m.pingMiner(minerAddr, minerCon) {
+			atomic.AddUint64(&m.getPeerCounters(minerAddr).blocksSent, 1)
+			minerCon := minerCon
+			m.goSend(func() {
+				minerCon.Call("Miner.SendBlock", request, new(MinerResponse))
+			})
+		} else {
+			m.dropPeer(minerAddr)
+		}
+	}
+	return nil
+}
+
+// Validates a shape that is about to be added, against every op this miner
+// knows of, including unmined ones
+func (m *Miner) validateNewShape(s shapelib.Shape, payer string) (inkCost uint32, err error) {
+	return m.validateShape(s, payer, m.unminedOps, m.tempOps)
+}
+
+// Validates a shape and returns its ink cost. The shape must not overlap
+// the shapes of another owner on the chain or in the given op collections.
+func (m *Miner) validateShape(s shapelib.Shape, payer string, opCollections ...map[string]*OperationRecord) (inkCost uint32, err error) {
+	geo, err := m.getEngine().Validate(s, m.getShapeRules())
+	if err != nil {
+		return
+	}
+	return m.validateShapeGeometry(s, geo, payer, opCollections...)
+}
+
+// Validates a valid shape of the given geometry against the payer's ink
+// and the shapes of another owner on the chain or in the given op
+// collections, and returns its ink cost
+func (m *Miner) validateShapeGeometry(s shapelib.Shape, geo shapelib.ShapeGeometry, payer string, opCollections ...map[string]*OperationRecord) (inkCost uint32, err error) {
+	spendable := m.getSpendableInk(payer, s.Owner)
+	if cost := m.getEngine().Cost(geo); cost > uint64(spendable) {
+		err = errorLib.InsufficientInkError(spendable)
+		return
+	} else {
+		inkCost = uint32(cost)
+		if overlaps, hash := m.hasOverlappingShape(s, geo, opCollections...); overlaps {
+			err = errorLib.ShapeOverlapError(hash)
+			return
+		}
+	}
+	return
+}
+
+// Returns the network's policy for filled paths that aren't closed
+func (m *Miner) getPathPolicy() shapelib.OpenPathPolicy {
+	if m.settings.AutoCloseOpenPaths {
+		return shapelib.AUTO_CLOSE_OPEN_PATHS
+	}
+	return shapelib.REJECT_OPEN_PATHS
+}
+
+// Returns the most ops the network allows a block to have
+func (m *Miner) getMaxOpsPerBlock() uint32 {
+	if m.settings.MaxOpsPerBlock == 0 {
+		return DEFAULT_MAX_OPS_PER_BLOCK
+	}
+	return m.settings.MaxOpsPerBlock
+}
+
+// Returns the most vertices the network allows a shape to have
+func (m *Miner) getMaxShapeVertices() uint32 {
+	if m.settings.MaxShapeVertices == 0 {
+		return shapelib.DEFAULT_MAX_VERTICES
+	}
+	return m.settings.MaxShapeVertices
+}
+
+// Returns the network's rules for shapes
+func (m *Miner) getShapeRules() shapelib.ShapeRules {
+	return shapelib.ShapeRules{
+		XMax:        m.settings.CanvasSettings.CanvasXMax,
+		YMax:        m.settings.CanvasSettings.CanvasYMax,
+		MaxVertices: m.getMaxShapeVertices(),
+		Policy:      m.getPathPolicy()}
+}
+
+// Returns the geometry engine shapes are validated with, the default one
+// unless the miner was run with another
+func (m *Miner) getEngine() shapelib.GeometryEngine {
+	if m.engine == nil {
+		return shapelib.DefaultEngine
+	}
+	return m.engine
+}
+
+// Determines if a shape overlaps the shape of another owner on the chain,
+// which is looked up in the canvas occupancy, or in one of the given op
+// collections, and returns the signature of the op of the shape it overlaps
+func (m *Miner) hasOverlappingShape(s shapelib.Shape, geo shapelib.ShapeGeometry, opCollections ...map[string]*OperationRecord) (overlaps bool, hash string) {
+	for _, hash := range m.occupancy.Overlaps(geo) {
+		opRecord, exists := m.validatedOps[hash]
+		if !exists {
+			opRecord, exists = m.unvalidatedOps[hash]
+		}
+		if exists && !m.canOverlap(s, hash, opRecord) {
+			return true, hash
+		}
+	}
+
+	for _, opCollection := range opCollections {
+		for _, hash := range getSortedOpSigs(opCollection) {
+			opRecord := opCollection[hash]
+			if m.canOverlap(s, hash, opRecord) {
+				continue
+			} else if _geo := m.getOpGeometry(hash, opRecord.Op.Shape); m.getEngine().Overlap(_geo, geo) {
+				return true, hash
+			}
+		}
+	}
+
+	return false, hash
+}
+
+// Returns the signatures of a collection of ops, sorted, so that the same
+// overlapping shape is reported however the collection was filled
+func getSortedOpSigs(opCollection map[string]*OperationRecord) []string {
+	opSigs := make([]string, 0, len(opCollection))
+	for opSig := range opCollection {
+		opSigs = append(opSigs, opSig)
+	}
+	sort.Strings(opSigs)
+	return opSigs
+}
+
+// Determines if a shape may overlap the shape of an op: one of the same
+// owner, or one that has expired. ALLOW and ROTATE ops have no shape.
+func (m *Miner) canOverlap(s shapelib.Shape, opSig string, opRecord *OperationRecord) bool {
+	return m.getCurrentKey(opRecord.Op.Shape.Owner) == m.getCurrentKey(s.Owner) || opRecord.Op.Type == ALLOW || opRecord.Op.Type == ROTATE || m.expiredOps[opSig]
+}
+
+// Returns the geometry of an op's shape, taken from the geometries
+// prechecked for the chain being applied if it is there
+func (m *Miner) getOpGeometry(opSig string, s shapelib.Shape) shapelib.ShapeGeometry {
+	if geo, prechecked := m.geometries[opSig]; prechecked {
+		return geo
+	}
+	geo, _ := m.getEngine().Parse(s, m.getShapeRules())
+	return geo
+}
+
+// Adds a block to the current blocktree, without changing any other
+// miner state, and disseminates the block to connected miners.
+func (m *Miner) addBlock(block *Block) {
+	m.insertBlock(block)
+	m.disseminateToConnectedMiners(block)
+}
+
+// Adds a block to the current blocktree and the local store (if any),
+// without changing any other miner state.
+func (m *Miner) insertBlock(block *Block) {
+	blockHash := hashBlock(block)
+	if _, exists := m.blockchain[blockHash]; !exists {
+		m.minedBlocks[block.PubKeyString] = append(m.minedBlocks[block.PubKeyString], blockHash)
+	}
+	m.blockchain[blockHash] = block
+	m.recordPosition(blockHash, block)
+	m.addBlockChild(block)
+	if m.store != nil {
+		checkError(m.store.saveBlock(blockHash, block))
+		if m.store.quota > 0 {
+			go m.store.pruneIfOverQuota()
+		}
+	}
+}
+
+// This method applies a block's operations to the miner.
+// This means that only in THIS function will we change any miner state
+// related to unmined, unvalidated, validated, or failed ops, and ink
+// accounts for all miners.
+//
+// Important: This methods sets the blockchainHead! There should be no
+// need to set the blockchainHead other than in this method, EXCEPT
+// for the genesis block in initBlockchain().
+func (m *Miner) applyBlock(block *Block) {
+	blockHash := hashBlock(block)
+	m.applyBlockAndOpInk(block)
+	expired := m.applyExpiries(block)
+	m.recordLedger(blockHash, block, expired)
+	m.moveUnminedToUnvalidated(block)
+	m.moveUnvalidatedToValidated()
+	m.occupyCanvas(block.Records)
+	m.blockchainHead = blockHash
+}
+
+// Adds the shapes of ops that are now on the chain to the canvas
+// occupancy, which new shapes are checked against
+func (m *Miner) occupyCanvas(records []OperationRecord) {
+	geometries := make(map[string]shapelib.ShapeGeometry)
+	for _, opRecord := range records {
+		if opRecord.Op.Type != ADD && opRecord.Op.Type != REMOVE {
+			continue
+		} else if geo := m.getOpGeometry(opRecord.OpSig, opRecord.Op.Shape); geo != nil {
+			geometries[opRecord.OpSig] = geo
+		}
+	}
+	m.occupancy.AddAll(geometries)
+}
+
+// Removes the shapes of ops that are no longer on the chain from the
+// canvas occupancy
+func (m *Miner) vacateCanvas(records []OperationRecord) {
+	opSigs := make([]string, 0, len(records))
+	for _, opRecord := range records {
+		opSigs = append(opSigs, opRecord.OpSig)
+	}
+	m.occupancy.RemoveAll(opSigs)
+}
+
+// Records the position of a block from its parent's, which must have been
+// inserted before it
+func (m *Miner) recordPosition(blockHash string, block *Block) {
+	parent := m.positions[block.PrevHash]
+	work := parent.Work + m.blockWork(block)
+	if work < parent.Work {
+		work = math.MaxUint64
+	}
+	m.positions[blockHash] = ChainPosition{Height: parent.Height + 1, Work: work}
+}
+
+// Records the ledger of the chain ending in a block from its parent's,
+// given the ops whose shapes expired at the block
+func (m *Miner) recordLedger(blockHash string, block *Block, expired []OperationRecord) {
+	ledger := m.ledgers[block.PrevHash]
+	if len(block.Records) == 0 {
+		ledger.NoOpBlocks++
+	} else {
+		ledger.OpBlocks++
+	}
+	ledger.Minted += uint64(m.blockInkReward(block))
+	ledger.Spent += block.InkDebited
+	ledger.Refunded += block.InkCredited
+	for _, opRecord := range expired {
+		ledger.Expired += uint64(opRecord.Op.InkCost)
+		ledger.ExpiryRefunded += uint64(expiryRefund(&opRecord.Op))
+	}
+	m.ledgers[blockHash] = ledger
+}
+
+// Returns the expected number of hashes to mine a block: 16 for each zero
+// its hash must end in. Uses the block's summary, since a pruned block has
+// no records.
+func (m *Miner) blockWork(block *Block) uint64 {
+	difficulty := m.getPoWDifficulty(int(block.OpCount))
+	if difficulty >= 16 {
+		return math.MaxUint64
+	}
+	return 1 << (4 * uint(difficulty))
+}
+
+// Determines if the chain ending in blockHash is longer than the one ending
+// in the head, breaking ties by the larger hash so that every miner picks
+// the same head
+func (m *Miner) isLongerChain(blockHash string) bool {
+	position, head := m.positions[blockHash], m.positions[m.blockchainHead]
+	if !m.extendsFinalBlock(blockHash) {
+		return false
+	}
+	return position.Height > head.Height || (position.Height == head.Height && blockHash > m.blockchainHead)
+}
+
+// Adds a block's hash to its parent's list of child hashes.
+func (m *Miner) addBlockChild(block *Block) {
+	hash := hashBlock(block)
+	if _, exists := m.blockChildren[block.PrevHash]; !exists {
+		m.blockChildren[block.PrevHash] = []string{hash}
+	} else {
+		children := m.blockChildren[block.PrevHash]
+		m.blockChildren[block.PrevHash] = append(children, hash)
+	}
+}
+
+// Subtracts or credits ink to the ink accounts of each operation owner
+// within a specified block, as well as ink for the mined block itself.
+//
+// TODO: Use a mutex
+//
+func (m *Miner) applyBlockAndOpInk(block *Block) {
+	// update ink per operation
+	for _, record := range sortRecordsForInk(block.Records) {
+		_, err := m.applyOpInk(&record)
+		checkError(err)
+	}
+
+	// add ink for the newly mined block
+	checkError(m.creditInk(block.PubKeyString, m.blockInkReward(block)))
+}
+
+// Debits (ADD) or credits (REMOVE) the op's ink cost to its payer, raises
+// or revokes the spender's allowance (ALLOW), or moves all of the signer's
+// ink to the new key and retires the signer's key (ROTATE). An ADD paid for by
+// another key also uses up the signer's allowance. Nothing changes if the
+// op would take an account or allowance below zero.
+func (m *Miner) applyOpInk(opRecord *OperationRecord) (inkRemaining uint32, err error) {
+	op := opRecord.Op
+	payer := opRecord.getPayer()
+	switch op.Type {
+	case ADD:
+		if payer != opRecord.PubKeyString && m.getAllowance(payer, opRecord.PubKeyString) < op.InkCost {
+			err = errorLib.AllowanceError(m.getAllowance(payer, opRecord.PubKeyString))
+		} else if err = m.debitInk(payer, op.InkCost); err == nil && payer != opRecord.PubKeyString {
+			checkError(m.lowerAllowance(payer, opRecord.PubKeyString, op.InkCost))
+		}
+	case REMOVE:
+		err = m.creditInk(payer, op.InkCost)
+	case ALLOW:
+		if op.Allowance == 0 {
+			// What is revoked is kept to give back if the op is reversed
+			revoked := m.getAllowance(opRecord.PubKeyString, op.Spender)
+			checkError(m.lowerAllowance(opRecord.PubKeyString, op.Spender, revoked))
+			m.revocations[opRecord.OpSig] = revoked
+		} else {
+			err = m.raiseAllowance(opRecord.PubKeyString, op.Spender, op.Allowance)
+		}
+	case ROTATE:
+		ink := m.inkAccounts[opRecord.PubKeyString]
+		if err = m.creditInk(op.NewKey, ink); err == nil {
+			checkError(m.debitInk(opRecord.PubKeyString, ink))
+			m.rotatedKeys[opRecord.PubKeyString] = KeyRotation{op.NewKey, ink}
+		}
+	}
+
+	return m.inkAccounts[opRecord.PubKeyString], err
+}
+
+func (m *Miner) reverseOpInk(opRecord *OperationRecord) {
+	op := opRecord.Op
+	payer := opRecord.getPayer()
+	switch op.Type {
+	case ADD:
+		checkError(m.creditInk(payer, op.InkCost))
+		if payer != opRecord.PubKeyString {
+			checkError(m.raiseAllowance(payer, opRecord.PubKeyString, op.InkCost))
+		}
+	case REMOVE:
+		checkError(m.debitInk(payer, op.InkCost))
+	case ALLOW:
+		if op.Allowance == 0 {
+			checkError(m.raiseAllowance(opRecord.PubKeyString, op.Spender, m.revocations[opRecord.OpSig]))
+			delete(m.revocations, opRecord.OpSig)
+		} else {
+			checkError(m.lowerAllowance(opRecord.PubKeyString, op.Spender, op.Allowance))
+		}
+	case ROTATE:
+		rotation := m.rotatedKeys[opRecord.PubKeyString]
+		delete(m.rotatedKeys, opRecord.PubKeyString)
+		checkError(m.debitInk(rotation.NewKey, rotation.Ink))
+		checkError(m.creditInk(opRecord.PubKeyString, rotation.Ink))
+	}
+}
+
+// Sorts records into the canonical order of a block's records: oldest
+// first, with ties broken by OpSig. Every miner assembles blocks in this
+// order and rejects blocks that aren't in it, so that the same ops always
+// make the same block.
+func sortRecordsCanonically(records []OperationRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return isCanonicallyBefore(&records[i], &records[j])
+	})
+}
+
+// Determines whether records are in canonical order, with no op twice
+func areRecordsCanonical(records []OperationRecord) bool {
+	for i := 1; i < len(records); i++ {
+		if !isCanonicallyBefore(&records[i-1], &records[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCanonicallyBefore(a *OperationRecord, b *OperationRecord) bool {
+	if a.Op.TimeStamp != b.Op.TimeStamp {
+		return a.Op.TimeStamp < b.Op.TimeStamp
+	}
+	return a.OpSig < b.OpSig
+}
+
+// Returns records in the order their ink is applied: ALLOW ops first so
+// that allowances can be spent in the same block, then REMOVE ops so that
+// refunds can be, then ADD ops, then ROTATE ops so that the other ops of a
+// key are applied before it is retired, each in the order given (for a
+// block's records, the canonical order). Ink is reversed in the opposite
+// order.
+func sortRecordsForInk(records []OperationRecord) (sorted []OperationRecord) {
+	for _, opType := range []OpType{ALLOW, REMOVE, ADD, ROTATE} {
+		for _, record := range records {
+			if record.Op.Type == opType {
+				sorted = append(sorted, record)
+			}
+		}
+	}
+	return
+}
+
+// Returns how much of payer's ink spender may spend
+func (m *Miner) getAllowance(payer, spender string) uint32 {
+	return m.allowances[payer][spender]
+}
+
+// Returns how much of payer's ink spender can currently spend, i.e. all
+// of it for the payer itself
+func (m *Miner) getSpendableInk(payer, spender string) uint32 {
+	ink := m.inkAccounts[payer]
+	if allowance := m.getAllowance(payer, spender); payer != spender && allowance < ink {
+		return allowance
+	}
+	return ink
+}
+
+// Allows spender to spend amount more of payer's ink. Returns an
+// InkOverflowError, leaving the allowance unchanged, if it would no
+// longer fit in a uint32.
+func (m *Miner) raiseAllowance(payer, spender string, amount uint32) error {
+	allowance := m.getAllowance(payer, spender)
+	if amount > math.MaxUint32-allowance {
+		return errorLib.InkOverflowError(allowance)
+	}
+	if m.allowances[payer] == nil {
+		m.allowances[payer] = make(map[string]uint32)
+	}
+	m.allowances[payer][spender] = allowance + amount
+	return nil
+}
+
+// Lowers spender's allowance of payer's ink. Returns an AllowanceError,
+// leaving the allowance unchanged, if it is less than amount.
+func (m *Miner) lowerAllowance(payer, spender string, amount uint32) error {
+	allowance := m.getAllowance(payer, spender)
+	if amount > allowance {
+		return errorLib.AllowanceError(allowance)
+	}
+	if allowance == amount {
+		delete(m.allowances[payer], spender)
+	} else {
+		m.allowances[payer][spender] = allowance - amount
+	}
+	return nil
+}
+
+// Removes the shapes that expire at a block from the canvas and refunds
+// part of their ink to their payers, and returns their ops. This happens
+// after the block's own ops are applied, so a shape can still be deleted
+// in the block at which it expires, in which case it doesn't expire.
+func (m *Miner) applyExpiries(block *Block) (expired []OperationRecord) {
+	expired = m.getExpiringOps(block)
+	for _, opRecord := range expired {
+		m.expiredOps[opRecord.OpSig] = true
+		checkError(m.creditInk(opRecord.getPayer(), expiryRefund(&opRecord.Op)))
+		m.logState("Shape has expired. [" + opRecord.Op.Shape.ShapeSvgString + "]")
+	}
+	return
+}
+
+// Restores the shapes that expired at a block and takes back their
+// refunds
+func (m *Miner) reverseExpiries(block *Block) {
+	for _, opRecord := range m.getExpiringOps(block) {
+		delete(m.expiredOps, opRecord.OpSig)
+		checkError(m.debitInk(opRecord.getPayer(), expiryRefund(&opRecord.Op)))
+	}
+}
+
+// Returns the ADD ops on a block's branch whose shapes expire at that
+// block, i.e. those ExpiryBlocks blocks before it that haven't been deleted
+// since. Only the ancestors in the block tree are read, so every miner
+// finds the same ops for the same block.
+func (m *Miner) getExpiringOps(block *Block) (expiring []OperationRecord) {
+	deleted := make(map[string]bool)
+	for ancestor := block; ancestor != nil && block.BlockNo-ancestor.BlockNo <= MAX_EXPIRY_BLOCKS; ancestor = m.blockchain[ancestor.PrevHash] {
+		age := block.BlockNo - ancestor.BlockNo
+		for _, opRecord := range ancestor.Records {
+			if opRecord.Op.Type == REMOVE {
+				deleted[opRecord.Op.Ref] = true
+			} else if opRecord.Op.Type == ADD && age > 0 && opRecord.Op.ExpiryBlocks == age && !deleted[opRecord.OpSig] {
+				expiring = append(expiring, opRecord)
+			}
+		}
+	}
+	return
+}
+
+// Returns the ink refunded to the payer when an op's shape expires
+func expiryRefund(op *Operation) uint32 {
+	return uint32(uint64(op.InkCost) * uint64(EXPIRY_REFUND_PERCENT) / 100)
+}
+
+func (m *Miner) reverseBlockInk(block *Block) {
+	checkError(m.debitInk(block.PubKeyString, m.blockInkReward(block)))
+}
+
+// Returns the ink rewarded to the miner of a block
+func (m *Miner) blockInkReward(block *Block) uint32 {
+	if len(block.Records) == 0 {
+		return m.settings.InkPerNoOpBlock
+	}
+	return m.settings.InkPerOpBlock
+}
+
+// Removes ink from an account, or from the account of the key it was
+// rotated to. Returns an InsufficientInkError, leaving the account
+// unchanged, if the account holds less than amount.
+func (m *Miner) debitInk(pubKeyString string, amount uint32) error {
+	pubKeyString = m.getCurrentKey(pubKeyString)
+	balance := m.inkAccounts[pubKeyString]
+	if amount > balance {
+		return errorLib.InsufficientInkError(balance)
+	}
+	m.inkAccounts[pubKeyString] = balance - amount
+	return nil
+}
+
+// Adds ink to an account, or to the account of the key it was rotated to,
+// so that block rewards and refunds for a retired key aren't lost. Returns
+// an InkOverflowError, leaving the account unchanged, if the balance would
+// no longer fit in a uint32.
+func (m *Miner) creditInk(pubKeyString string, amount uint32) error {
+	pubKeyString = m.getCurrentKey(pubKeyString)
+	balance := m.inkAccounts[pubKeyString]
+	if amount > math.MaxUint32-balance {
+		return errorLib.InkOverflowError(balance)
+	}
+	m.inkAccounts[pubKeyString] = balance + amount
+	return nil
+}
+
+// Returns the key that now holds a key's ink and shapes: the last key in
+// its chain of rotations, or the key itself if it was never rotated
+func (m *Miner) getCurrentKey(pubKeyString string) string {
+	for rotation, rotated := m.rotatedKeys[pubKeyString]; rotated; rotation, rotated = m.rotatedKeys[pubKeyString] {
+		pubKeyString = rotation.NewKey
+	}
+	return pubKeyString
+}
+
+// Returns a KeyRotatedError if an op is signed by a retired key, or is an
+// ADD paid for by one, since only the key it was rotated to may use its
+// ink and shapes
+func (m *Miner) checkKeysNotRotated(opRecord *OperationRecord) error {
+	pubKeyStrings := []string{opRecord.PubKeyString}
+	if opRecord.Op.Type == ADD {
+		pubKeyStrings = append(pubKeyStrings, opRecord.getPayer())
+	}
+	for _, pubKeyString := range pubKeyStrings {
+		if rotation, rotated := m.rotatedKeys[pubKeyString]; rotated {
+			return errorLib.KeyRotatedError(rotation.NewKey)
+		}
+	}
+	return nil
+}
+
+// Checks that a ROTATE op names a valid new key other than the signer's,
+// that hasn't been retired itself, so that keys never rotate in a cycle
+func (m *Miner) checkRotation(opRecord *OperationRecord) error {
+	newKey := opRecord.Op.NewKey
+	if parseStringPubKey(newKey) == nil || newKey == opRecord.PubKeyString {
+		return errorLib.ValidationError(opRecord.OpSig)
+	} else if rotation, rotated := m.rotatedKeys[newKey]; rotated {
+		return errorLib.KeyRotatedError(rotation.NewKey)
+	}
+	return nil
+}
+
+func (m *Miner) blockSuccessfullyMined(block *Block) bool {
+	blockHash := hashBlock(block)
+	if m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) {
+		traceID := newTraceID()
+		m.traces.add(blockHash, traceID)
+		err := m.validateBlock(block)
+		if err != nil {
+			return false
+		}
+		logTrace(traceID, "Found a new Block. ["+fmt.Sprint(block.BlockNo)+"] ["+blockHash+"]")
+		oldHead := m.blockchainHead
+		m.addBlock(block)
+		m.applyBlock(block)
+		m.storePendingOps()
+		m.updateReadReplica()
+		m.forkStats.add(0)
+		m.blockIntervals.add(block.BlockNo, time.Now())
+		m.events.publish(MinerEvent{Type: HEAD_CHANGED, OldHead: oldHead, NewHead: blockHash, TraceID: traceID})
+		time.Sleep(50 * time.Millisecond)
+		// logger.Println("Current BlockChainMap: ", m.blockchain)
+		return true
+	} else {
+		return false
+	}
+}
+
+// Asserts that block hash matches the intended POW difficulty
+func (m *Miner) hashMatchesPOWDifficulty(blockHash string, numRecords int) bool {
+	return strings.HasSuffix(blockHash, strings.Repeat("0", int(m.getPoWDifficulty(numRecords))))
+}
+
+// Returns the number of zeroes the hash of a block with the given number of
+// records must end in
+func (m *Miner) getPoWDifficulty(numRecords int) uint8 {
+	if numRecords == 0 {
+		return m.settings.PoWDifficultyNoOpBlock
+	}
+	return m.settings.PoWDifficultyOpBlock
+}
+
+// Moves all operations in a newly mined block from the unmined op collection
+// to the unvalidated op collection.
+func (m *Miner) moveUnminedToUnvalidated(block *Block) {
+	for _, opRecord := range block.Records {
+		// previously using &opRecord would not work properly when adding multiple
+		// records into unvalidated. Deep copy ensures the values exist in that map
+		newOpRecord := &OperationRecord{
+			Op:           opRecord.Op,
+			OpSig:        opRecord.OpSig,
+			PubKeyString: opRecord.PubKeyString}
+		m.unvalidatedOps[opRecord.OpSig] = newOpRecord
+		delete(m.unminedOps, opRecord.OpSig)
+		m.logState("OperationRecord has been placed into a block. [" + opRecord.Op.Shape.ShapeSvgString + "]")
+	}
+}
+
+// Decrements the validation num counter for each op in the unvalidated op collection
+// and moves those which have become valid to the validated op collection
+func (m *Miner) moveUnvalidatedToValidated() {
+	for _, opRecord := range m.unvalidatedOps {
+		if opRecord.Op.NumRemaining <= 0 {
+			if opRecord.Op.Type == REMOVE {
+				m.validatedOps[opRecord.Op.Ref].Op.Deleted = true
+			}
+			m.validatedOps[opRecord.OpSig] = opRecord
+			delete(m.unvalidatedOps, opRecord.OpSig)
+			delete(m.opSources, opRecord.OpSig)
+			m.logState("OperationRecord has been validated. [" + opRecord.Op.Shape.ShapeSvgString + "]")
+		} else {
+			opRecord.Op.NumRemaining -= 1
+			m.logState("OperationRecord validateNum decreased. [" + fmt.Sprint(opRecord.Op.NumRemaining) + "] [" + opRecord.Op.Shape.ShapeSvgString + "]")
+		}
+	}
+}
+
+// Logs a change to the state of the chain or its ops, unless the miner is
+// quiet, i.e. it is replaying a store in the background
+func (m *Miner) logState(message string) {
+	if !m.quiet {
+		logger.Println(message)
+	}
+}
+
+// Sends block to all connected miners
+// Makes sure that enough miners are connected; if under minimum, it calls for more
+//
+// Any miner that rejects the op replies with the reason, which is recorded
+// in the rejection log. With an op batch window, the op is queued to be
+// sent with the ops disseminated after it instead (see queueOpForPeers).
+func (m *Miner) disseminateOpToConnectedMiners(opRec *OperationRecord) {
+	if m.opBatchWindow > 0 {
+		m.queueOpForPeers(opRec)
+		return
+	}
+
+	m.getMiners() // checks all miners, connects to more if needed
+	request := new(MinerRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = *opRec
+	request.Payload[1] = m.localAddr.String()
+	request.TraceID = m.traces.get(opRec.OpSig)
+	m.sealGossip(request)
+	for minerAddr, minerCon := range m.miners {
+		if m.pingMiner(minerAddr, minerCon) {
+			atomic.AddUint64(&m.getPeerCounters(minerAddr).opsSent, 1)
+			minerAddr, minerCon := minerAddr, minerCon
+			m.goSend(func() {
+				m.sendOpToMiner(minerAddr, minerCon, request)
+			})
+		} else {
+			m.dropPeer(minerAddr)
+		}
+	}
+}
+
+// Sends an op to a single miner, recording the reason if it rejects it.
+// Must be called without holding the lock.
+func (m *Miner) sendOpToMiner(minerAddr string, minerCon *rpc.Client, request *MinerRequest) {
+	opRec := request.Payload[0].(OperationRecord)
+	response := new(MinerResponse)
+	err := minerCon.Call("Miner.SendOp", request, response)
+	if err == nil && response.Error != nil {
+		m.lock.Lock()
+		m.recordOpRejection(opRec.OpSig, minerAddr, errorLib.Describe(response.Error))
+		m.lock.Unlock()
+	} else if err == nil {
+		m.lock.Lock()
+		m.receipts.add(minerAddr, []string{opRec.OpSig}, time.Now())
+		m.lock.Unlock()
+	}
+}
+
+// Queues an op to be disseminated in one SendOps message with the other
+// ops disseminated within the op batch window of the first, so that a
+// burst of small ops costs each peer one round trip (and one ping) rather
+// than one per op. A full batch is sent right away. The lock must be held.
+func (m *Miner) queueOpForPeers(opRec *OperationRecord) {
+	m.opBatch = append(m.opBatch, opRec)
+	if len(m.opBatch) >= int(MAX_OP_BATCH) {
+		m.sendOpBatch()
+	} else if len(m.opBatch) == 1 {
+		time.AfterFunc(m.opBatchWindow, func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			m.sendOpBatch()
+		})
+	}
+}
+
+// Disseminates the queued ops to every connected miner in one SendOps
+// message, recording the ops each miner rejects. Miners that don't know
+// SendOps are sent the ops one by one. The lock must be held.
+func (m *Miner) sendOpBatch() {
+	if len(m.opBatch) == 0 {
+		return
+	}
+	opRecords := make([]OperationRecord, len(m.opBatch))
+	traceIDs := make([]string, len(m.opBatch))
+	for i, opRec := range m.opBatch {
+		opRecords[i] = *opRec
+		traceIDs[i] = m.traces.get(opRec.OpSig)
+	}
+	m.opBatch = nil
+
+	m.getMiners()
+	request := new(MinerRequest)
+	request.Payload = []interface{}{opRecords, m.localAddr.String(), traceIDs}
+	m.sealGossip(request)
+	for minerAddr, minerCon := range m.miners {
+		if m.pingMiner(minerAddr, minerCon) {
+			atomic.AddUint64(&m.getPeerCounters(minerAddr).opsSent, uint64(len(opRecords)))
+			minerAddr, minerCon := minerAddr, minerCon
+			m.goSend(func() {
+				m.sendOpsToMiner(minerAddr, minerCon, request)
+			})
+		} else {
+			m.dropPeer(minerAddr)
+		}
+	}
+}
+
+// Sends a batch of ops to a single miner, recording the reasons it rejects
+// any of them. Must be called without holding the lock.
+func (m *Miner) sendOpsToMiner(minerAddr string, minerCon *rpc.Client, request *MinerRequest) {
+	opRecords := request.Payload[0].([]OperationRecord)
+	traceIDs := request.Payload[2].([]string)
+	response := new(MinerResponse)
+	err := minerCon.Call("Miner.SendOps", request, response)
+	if err != nil && strings.Contains(err.Error(), "can't find method") {
+		for i, opRec := range opRecords {
+			single := new(MinerRequest)
+			single.Payload = []interface{}{opRec, request.Payload[1]}
+			single.TraceID = traceIDs[i]
+			m.sealGossip(single)
+			m.sendOpToMiner(minerAddr, minerCon, single)
+		}
+		return
+	} else if err != nil || response.Error != nil || len(response.Payload) == 0 {
+		return
+	}
+
+	rejections := response.Payload[0].([]string)
+	var accepted []string
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, opRec := range opRecords {
+		if i < len(rejections) && rejections[i] != "" {
+			m.recordOpRejection(opRec.OpSig, minerAddr, rejections[i])
+		} else {
+			accepted = append(accepted, opRec.OpSig)
+		}
+	}
+	m.receipts.add(minerAddr, accepted, time.Now())
+}
+
+// Periodically re-announces this miner's own unmined ops, in case they
+// were first disseminated during a network partition and never reached
+// the miners that go on to mine blocks. Each connected miner is first
+// asked which of the ops it is missing (see HasOps), and only those are
+// sent again. An op is re-announced until it is mined, or until
+// OP_REGOSSIP_EXPIRY has passed since it was created. Pinned ops are
+// re-announced however old they are, even to miners that rejected them.
+func (m *Miner) startOpRegossip() {
+	for {
+		time.Sleep(time.Duration(OP_REGOSSIP_INTERVAL) * time.Millisecond)
+
+		m.lock.Lock()
+		ops := make(map[string]OperationRecord)
+		var opSigs []string
+		expiry := time.Now().Add(-time.Duration(OP_REGOSSIP_EXPIRY) * time.Millisecond).UnixNano()
+		for opSig, opRecord := range m.unminedOps {
+			_, pinned := m.pinnedOps[opSig]
+			if opRecord.PubKeyString == m.pubKeyString && (opRecord.Op.TimeStamp > expiry || pinned) {
+				ops[opSig] = *opRecord
+				opSigs = append(opSigs, opSig)
+			}
+		}
+		m.getMiners()
+		miners := make(map[string]*rpc.Client)
+		for minerAddr, minerCon := range m.miners {
+			miners[minerAddr] = minerCon
+		}
+		m.lock.Unlock()
+
+		if len(opSigs) == 0 {
+			continue
+		}
+
+		request := new(MinerRequest)
+		request.Payload = make([]interface{}, 1)
+		request.Payload[0] = opSigs
+		for minerAddr, minerCon := range miners {
+			response := new(MinerResponse)
+			if err := minerCon.Call("Miner.HasOps", request, response); err != nil || response.Error != nil {
+				continue
+			}
+
+			missing := make(map[string]bool)
+			for _, opSig := range response.Payload[0].([]string) {
+				missing[opSig] = true
+			}
+			held := []string{}
+			for _, opSig := range opSigs {
+				if !missing[opSig] {
+					held = append(held, opSig)
+				}
+			}
+			m.lock.Lock()
+			m.receipts.add(minerAddr, held, time.Now())
+			m.lock.Unlock()
+
+			for _, opSig := range response.Payload[0].([]string) {
+				m.lock.Lock()
+				_, rejected := m.rejections.get(opSig)[minerAddr]
+				_, pinned := m.pinnedOps[opSig]
+				m.lock.Unlock()
+				rejected = rejected && !pinned
+				if opRecord, exists := ops[opSig]; exists && !rejected {
+					traceID := m.traces.get(opSig)
+					logTrace(traceID, "Re-announcing op to ["+minerAddr+"]: "+opSig)
+					opRequest := new(MinerRequest)
+					opRequest.Payload = make([]interface{}, 2)
+					opRequest.Payload[0] = opRecord
+					opRequest.Payload[1] = m.localAddr.String()
+					opRequest.TraceID = traceID
+					m.sealGossip(opRequest)
+					go m.sendOpToMiner(minerAddr, minerCon, opRequest)
+				}
+			}
+		}
+	}
+}
+
+// Records that a miner rejected an op. If the op was received from another
+// miner, the rejection is reported back to it, signed by this miner, so
+// that it eventually reaches the miner the op originated from.
+func (m *Miner) recordOpRejection(opSig, minerAddr, reason string) {
+	if !m.rejections.add(opSig, minerAddr, reason) {
+		return
+	}
+	traceID := m.traces.get(opSig)
+	logTrace(traceID, "Op rejected by ["+minerAddr+"]: "+reason)
+
+	source, exists := m.opSources[opSig]
+	if !exists {
+		return
+	}
+	if sourceCon := m.miners[source]; sourceCon != nil {
+		report := OpRejectionReport{
+			OpSig:        opSig,
+			MinerAddr:    minerAddr,
+			Reason:       reason,
+			Reporter:     m.localAddr.String(),
+			PubKeyString: m.pubKeyString}
+		r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, getRejectionDigest(report))
+		if checkError(err) != nil {
+			return
+		}
+		encodedSig, _ := json.Marshal(Signature{r, s})
+		report.Sig = string(encodedSig)
+
+		request := new(MinerRequest)
+		request.Payload = make([]interface{}, 1)
+		request.Payload[0] = report
+		request.TraceID = traceID
+		go sourceCon.Call("Miner.ReportOpRejection", request, new(MinerResponse))
+	}
+}
+
+// Returns the digest of a rejection report that is signed. It is prefixed
+// with "rejection:" so that it can't be taken for anything else the
+// reporting miner's key signs.
+func getRejectionDigest(report OpRejectionReport) []byte {
+	encoded, _ := json.Marshal([]interface{}{report.OpSig, report.MinerAddr, report.Reason, report.Reporter, report.PubKeyString})
+	digest := sha256.Sum256(append([]byte("rejection:"), encoded...))
+	return digest[:]
+}
+
+// Determines whether a rejection report is signed by the key registered
+// with the server for the miner that sent it. Must be called without
+// holding the lock, since the registered keys may have to be fetched.
+func (m *Miner) verifyRejectionReport(report OpRejectionReport) bool {
+	pubKey := parseStringPubKey(report.PubKeyString)
+	sig := new(Signature)
+	if report.Reporter == "" || pubKey == nil || json.Unmarshal([]byte(report.Sig), sig) != nil || sig.R == nil || sig.S == nil ||
+		!ecdsa.Verify(pubKey, getRejectionDigest(report), sig.R, sig.S) {
+		return false
+	}
+	return m.registry.verify(report.Reporter, getRegisteredKey(report.PubKeyString))
+}
+
+// </PRIVATE METHODS : MINER>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RPC METHODS>
+
+func (m *Miner) Hello(_ string, nonce *string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*nonce = getRand256()
+	m.nonces[*nonce] = time.Now()
+	return nil
+}
+
+// Once a token is successfully retrieved, that nonce can no longer be used
+//
+// Payload: [nonce, r, s] to authenticate with the miner's key, or
+// [nonce, r, s, artnode pubKey, delegation] to authenticate with an art
+// node key that the miner has delegated to (see delegateCommand), followed
+// by an optional [ink quota, op quota] limiting what the token may spend
+// (see ArtnodeSession). The pubKey and delegation are "" for the miner's
+// key when a quota is given.
+func (m *Miner) GetToken(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	nonce := request.Payload[0].(string)
+	r := new(big.Int)
+	s := new(big.Int)
+	r, r_ok := r.SetString(request.Payload[1].(string), 0)
+	s, s_ok := s.SetString(request.Payload[2].(string), 0)
+
+	if !r_ok || !s_ok {
+		response.Error = errorLib.InvalidSignatureError()
+		return
+	}
+
+	pubKeyString, pubKey := m.pubKeyString, &m.pubKey
+	if len(request.Payload) > 4 && request.Payload[3].(string) != "" {
+		pubKeyString = request.Payload[3].(string)
+		pubKey = m.verifyDelegation(pubKeyString, request.Payload[4].(string))
+		if pubKey == nil {
+			response.Error = errorLib.InvalidSignatureError()
+			return
+		}
+	}
+
+	created, validNonce := m.nonces[nonce]
+	validNonce = validNonce && time.Since(created) < time.Duration(NONCE_TTL)*time.Second
+	validSignature := ecdsa.Verify(pubKey, []byte(nonce), r, s)
+
+	if validNonce && validSignature {
+		delete(m.nonces, nonce)
+		response.Error = nil
+		response.Payload = make([]interface{}, 3)
+		token := getRand256()
+		m.tokens[token] = &ArtnodeSession{PubKeyString: pubKeyString, Created: time.Now()}
+		if m.tokenTTL > 0 {
+			m.tokens[token].Expires = m.tokens[token].Created.Add(m.tokenTTL)
+		}
+		m.touchToken(token)
+		if len(request.Payload) > 6 {
+			m.tokens[token].InkQuota = request.Payload[5].(uint32)
+			m.tokens[token].OpQuota = request.Payload[6].(uint32)
+		}
+
+		m.updateReadReplica()
+
+		response.Payload[0] = token
+		response.Payload[1] = m.settings.CanvasSettings.CanvasXMax
+		response.Payload[2] = m.settings.CanvasSettings.CanvasYMax
+	} else {
+		response.Error = errorLib.InvalidSignatureError()
+	}
+
+	return nil
+}
+
+// Gets the svg string for the shape identified by a given shape hash (operation
+// signature), if it exists.
+//
+// This only checks for ops in the validated group (because there's no way an art
+// app could get the hash of an unvalidated operation), unless asked to include
+// the shapes added with the same token that aren't on the longest chain yet.
+//
+// Payload: [shape hash, include pending (optional)] -> [svg string, pending]
+func (m *Miner) GetSvgString(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	hash := request.Payload[0].(string)
+	includePending := len(request.Payload) > 1 && request.Payload[1].(bool)
+	opRecord := m.validatedOps[hash]
+	if opRecord == nil && includePending {
+		if shape, pending := m.getReadReplica().pendingShapes[token][hash]; pending {
+			response.Payload = []interface{}{getSvgElement(shape), true}
+			return nil
+		}
+	}
+	if opRecord == nil || opRecord.Op.Type == ALLOW || opRecord.Op.Type == ROTATE {
+		response.Error = errorLib.InvalidShapeHashError(hash)
+		return nil
+	}
+
+	response.Error = nil
+	response.Payload = make([]interface{}, 2)
+
+	response.Payload[0] = getSvgElement(opRecord.Op.Shape)
+	response.Payload[1] = false
+
+	return nil
+}
+
+// Gets the svg strings of several shapes at once, e.g. those returned by
+// GetShapes, in the order of their hashes. A hash that isn't a validated
+// shape gets an empty svg string and the name of its error.
+//
+// Payload: [shape hashes] -> [svg strings, error type of each ("" if none)]
+func (m *Miner) GetSvgStrings(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	hashes := request.Payload[0].([]string)
+	if len(hashes) > int(MAX_SVG_STRINGS_BATCH) {
+		response.Error = errorLib.BatchTooLargeError(MAX_SVG_STRINGS_BATCH)
+		return nil
+	}
+
+	svgStrings := make([]string, len(hashes))
+	errTypes := make([]string, len(hashes))
+	for i, hash := range hashes {
+		opRecord := m.validatedOps[hash]
+		if opRecord == nil || opRecord.Op.Type == ALLOW || opRecord.Op.Type == ROTATE {
+			errTypes[i] = errorLib.GetName(errorLib.InvalidShapeHashCode)
+			continue
+		}
+		svgStrings[i] = getSvgElement(opRecord.Op.Shape)
+	}
+
+	response.Payload = []interface{}{svgStrings, errTypes}
+	return nil
+}
+
+// Payload: [block, address of the miner the block came from]
+//
+// Replayed or unsealed blocks are dropped, see GossipReplayGuard, and so
+// are blocks that are already known or being applied, see BlockArrivals.
+func (m *Miner) SendBlock(request *MinerRequest, response *MinerResponse) (err error) {
+	block := request.Payload[0].(Block)
+	event := &MinerEvent{Type: BLOCK_RECEIVED, Block: &block, TraceID: getTraceID(request.TraceID)}
+	if len(request.Payload) > 1 {
+		event.Source = request.Payload[1].(string)
+	}
+	blockHash := hashBlock(&block)
+	if m.bans.isBanned(event.Source, time.Now()) {
+		logTrace(event.TraceID, "Dropped block from banned peer ["+event.Source+"]: "+blockHash)
+		return nil
+	}
+	if !m.replayGuard.accept(event.Source, request, blockHash) {
+		logTrace(event.TraceID, "Dropped replayed or unsealed block from ["+event.Source+"]: "+blockHash)
+		return nil
+	}
+
+	arrival, first := m.arrivals.claim(blockHash, event.Source)
+	if !first {
+		logTrace(event.TraceID, "Waiting on the same block from another peer, for duplicate from ["+event.Source+"]: "+blockHash)
+		<-arrival.done
+		return arrival.err
+	} else if m.isBlockKnown(blockHash) {
+		m.arrivals.release(blockHash, nil)
+		m.arrivals.countDuplicate(event.Source)
+		logTrace(event.TraceID, "Dropped known block from ["+event.Source+"]: "+blockHash)
+		return nil
+	}
+	err = m.events.submit(event)
+	m.arrivals.release(blockHash, err)
+	return err
+}
+
+// Determines whether a block is in the blocktree. Waits for the miner's
+// lock, but not for the block itself to be validated.
+func (m *Miner) isBlockKnown(blockHash string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, exists := m.blockchain[blockHash]
+	return exists
+}
+
+// Validates a block sent by (or fetched from) another miner and adds it to
+// the blocktree, switching to its chain if it is now the longest. Blocks
+// that are already known or whose parent isn't are ignored.
+func (m *Miner) receiveBlock(block *Block, source string) (err error) {
+	blockHash := hashBlock(block)
+
+	_, blockExists := m.blockchain[blockHash]
+	_, parentExists := m.blockchain[block.PrevHash]
+
+	if blockExists || !parentExists {
+		return
+	}
+
+	oldBlockchainHead := m.blockchainHead
+	m.changeBlockchainHead(oldBlockchainHead, block.PrevHash)
+	err = m.validateBlock(block)
+	m.changeBlockchainHead(m.blockchainHead, oldBlockchainHead)
+
+	traceID := m.traces.get(blockHash)
+	if err != nil {
+		if m.quarantine.add(block, err.Error(), source, time.Now()) {
+			logTrace(traceID, "Quarantined invalid block. ["+blockHash+"]")
+		}
+	} else {
+		logTrace(traceID, "Received new block. ["+fmt.Sprint(block.BlockNo)+"] ["+blockHash+"]")
+
+		m.creditPeer(source)
+		m.recordAnnouncedBlock(source, blockHash, block, time.Now())
+		m.addBlock(block)
+
+		if m.isLongerChain(blockHash) {
+			forkDepth := m.getForkDepth(m.blockchainHead, blockHash)
+			logTrace(traceID, "Blockchain head changed, abandoning "+fmt.Sprint(forkDepth)+" blocks. Now mining after block ["+fmt.Sprint(m.positions[blockHash].Height)+"]")
+			m.forkStats.add(forkDepth)
+			m.checkRelease(source, forkDepth)
+			// The block may be on another branch than the head, whose blocks
+			// have to be reversed and the fork's own applied, not just this one
+			m.changeBlockchainHead(m.blockchainHead, blockHash)
+			m.blockIntervals.add(m.positions[blockHash].Height, time.Now())
+			m.validateUnminedOps()
+			m.newLongestChain = true
+		}
+		m.storePendingOps()
+	}
+
+	return
+}
+
+// Payload: [op record, address of the miner the op came from]
+//
+// Replayed or unsealed ops are dropped, see GossipReplayGuard.
+func (m *Miner) SendOp(request *MinerRequest, response *MinerResponse) error {
+	opRec := request.Payload[0].(OperationRecord)
+	event := &MinerEvent{Type: OP_RECEIVED, Op: &opRec, TraceID: getTraceID(request.TraceID)}
+	if len(request.Payload) > 1 {
+		event.Source = request.Payload[1].(string)
+	}
+	if m.bans.isBanned(event.Source, time.Now()) {
+		logTrace(event.TraceID, "Dropped op from banned peer ["+event.Source+"]: "+opRec.OpSig)
+		return nil
+	}
+	if !m.replayGuard.accept(event.Source, request, getGossipContent(opRec)) {
+		logTrace(event.TraceID, "Dropped replayed or unsealed op from ["+event.Source+"]: "+opRec.OpSig)
+		return nil
+	}
+
+	// The reason for rejecting the op is returned to the sender
+	response.Error = m.events.submit(event)
+	return nil
+}
+
+// Payload: [op records, address of the miner the ops came from, trace ID of
+// each op]
+// Response payload: [reason each op was rejected, or "" if it wasn't]
+//
+// Each op is validated and deduplicated as if it had been sent by SendOp,
+// in order. The message as a whole is dropped if it is replayed or
+// unsealed (see GossipReplayGuard), and refused with a BatchTooLargeError if it holds
+// more than MAX_OP_BATCH ops.
+func (m *Miner) SendOps(request *MinerRequest, response *MinerResponse) error {
+	opRecs := request.Payload[0].([]OperationRecord)
+	source := request.Payload[1].(string)
+	traceIDs := request.Payload[2].([]string)
+	if len(opRecs) > int(MAX_OP_BATCH) {
+		response.Error = errorLib.BatchTooLargeError(MAX_OP_BATCH)
+		return nil
+	}
+	if m.bans.isBanned(source, time.Now()) {
+		logger.Println("Dropped " + fmt.Sprint(len(opRecs)) + " ops from banned peer [" + source + "]")
+		return nil
+	}
+	if !m.replayGuard.accept(source, request, getGossipContent(opRecs)) {
+		logger.Println("Dropped " + fmt.Sprint(len(opRecs)) + " replayed or unsealed ops from [" + source + "]")
+		return nil
+	}
+
+	rejections := make([]string, len(opRecs))
+	for i := range opRecs {
+		traceID := ""
+		if i < len(traceIDs) {
+			traceID = traceIDs[i]
+		}
+		event := &MinerEvent{Type: OP_RECEIVED, Op: &opRecs[i], Source: source, TraceID: getTraceID(traceID)}
+		if err := m.events.submit(event); err != nil {
+			rejections[i] = errorLib.Describe(err)
+		}
+	}
+	response.Payload = []interface{}{rejections}
+	return nil
+}
+
+// Validates an op sent by another miner and, if it is new, adds it to the
+// unmined ops and disseminates it. Returns the reason the op was rejected.
+func (m *Miner) receiveOp(opRec *OperationRecord, source string) error {
+	logTrace(m.traces.get(opRec.OpSig), "Received Op: ", opRec.OpSig)
+	if source != "" {
+		m.receipts.add(source, []string{opRec.OpSig}, time.Now())
+	}
+
+	if err := m.checkKeysNotRotated(opRec); err != nil {
+		return err
+	}
+	if opRec.Op.Type == ADD {
+		if _, shapeError := m.validateNewShape(opRec.Op.Shape, opRec.getPayer()); shapeError != nil {
+			// The shape being added isn't valid
+			return shapeError
+		} else if opRec.Op.ExpiryBlocks > MAX_EXPIRY_BLOCKS {
+			return errorLib.ExpiryError(MAX_EXPIRY_BLOCKS)
+		}
+	} else if opRec.Op.Type == REMOVE {
+		opRecord := m.validatedOps[opRec.Op.Ref]
+		if opRecord == nil || opRecord.Op.Type != ADD || m.getCurrentKey(opRecord.PubKeyString) != opRec.PubKeyString || opRecord.Op.Deleted || m.expiredOps[opRec.Op.Ref] || opRecord.Op.Payer != opRec.Op.Payer {
+			return errorLib.ShapeOwnerError(opRec.Op.Ref)
+		}
+	} else if opRec.Op.Type == ROTATE {
+		if err := m.checkRotation(opRec); err != nil {
+			return err
+		}
+	} else if parseStringPubKey(opRec.Op.Spender) == nil {
+		return errorLib.ValidationError(opRec.OpSig)
+	}
+
+	// If new op, disseminate
+	_, unminedExists := m.unminedOps[opRec.OpSig]
+	_, unvalidExists := m.unvalidatedOps[opRec.OpSig]
+	_, validExists := m.validatedOps[opRec.OpSig]
+	isSigValid := m.validateSignature(*opRec)
+
+	if !isSigValid {
+		return errorLib.InvalidSignatureError()
+	} else if !unminedExists && !unvalidExists && !validExists {
+		if m.isOpStale(opRec, time.Now()) {
+			return errorLib.OpStaleError(opRec.OpSig)
+		}
+		if source != "" {
+			m.opSources[opRec.OpSig] = source
+			m.creditPeer(source)
+		}
+		m.unminedOps[opRec.OpSig] = opRec
+		m.disseminateOpToConnectedMiners(opRec)
+	}
+
+	return nil
+}
+
+// Receives the reason a miner rejected an op that this miner disseminated.
+// Reports that aren't signed by the key registered for the miner that sent
+// them are refused with an InvalidSignatureError.
+//
+// Payload: [OpRejectionReport]
+func (m *Miner) ReportOpRejection(request *MinerRequest, response *MinerResponse) error {
+	report, ok := request.Payload[0].(OpRejectionReport)
+	if !ok || !m.verifyRejectionReport(report) {
+		response.Error = errorLib.InvalidSignatureError()
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.recordOpRejection(report.OpSig, report.MinerAddr, report.Reason)
+
+	return nil
+}
+
+// Receives a miner's attestation of a block, and passes it on to the other
+// connected miners if it hasn't been seen before
+//
+// Payload: [attestation, address of the miner it came from (optional)]
+func (m *Miner) SendAttestation(request *MinerRequest, response *MinerResponse) error {
+	attestation := request.Payload[0].(Attestation)
+	source := ""
+	if len(request.Payload) > 1 {
+		source = request.Payload[1].(string)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	isNew, err := m.addAttestation(attestation)
+	if err != nil {
+		response.Error = err
+	} else if isNew {
+		m.disseminateAttestation(attestation, source)
+	}
+
+	return nil
+}
+
+// Gossip of a shape's metadata entry, passed on to the other peers if it is
+// new
+//
+// Payload: [entry, address of the miner the entry came from (optional)]
+func (m *Miner) SendShapeMetadata(request *MinerRequest, response *MinerResponse) error {
+	entry := request.Payload[0].(ShapeMetadata)
+	source := ""
+	if len(request.Payload) > 1 {
+		source = request.Payload[1].(string)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	isNew, err := m.addShapeMetadata(entry)
+	if err != nil {
+		response.Error = err
+	} else if isNew {
+		m.disseminateShapeMetadata(entry, source)
+	}
+
+	return nil
+}
+
+// Payload: [shape hash]
+// Response payload: [the shape's metadata entries, including removed keys]
+func (m *Miner) GetShapeMetadataEntries(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	shapeHash := request.Payload[0].(string)
+	entries := []ShapeMetadata{}
+	for _, entry := range m.metadata[shapeHash] {
+		entries = append(entries, entry)
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = entries
+
+	return nil
+}
+
+// Inventory check used to avoid resending ops a miner already has
+//
+// Payload: [OpSigs]
+// Response payload: [OpSigs of the ops this miner has never seen]
+func (m *Miner) HasOps(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	missing := []string{}
+	for _, opSig := range request.Payload[0].([]string) {
+		if !m.hasOp(opSig) {
+			missing = append(missing, opSig)
+		}
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = missing
+
+	return nil
+}
+
+// Replies to a ping with a summary of this miner's unmined ops (see
+// MempoolSummary). Like PingMiner, this doesn't take the miner's lock,
+// since miners ping each other while holding their own.
+//
+// Response payload: [number of unmined ops, OpSigs of the oldest ones]
+func (m *Miner) Ping(request *MinerRequest, response *MinerResponse) error {
+	m.mempoolLock.Lock()
+	defer m.mempoolLock.Unlock()
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = m.mempool.NumOps
+	response.Payload[1] = m.mempool.OpSigs
+	return nil
+}
+
+// Lists this miner's unmined ops for a newly connected miner to sync its
+// mempool with (see syncMempool). Doesn't take the miner's lock, for the
+// same reason as Ping.
+//
+// Response payload: [number of unmined ops, OpSigs of up to
+// MAX_MEMPOOL_SYNC_OPS of them, oldest first]
+func (m *Miner) GetMempoolInventory(request *MinerRequest, response *MinerResponse) error {
+	m.mempoolLock.Lock()
+	defer m.mempoolLock.Unlock()
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = m.mempool.NumOps
+	response.Payload[1] = m.mempool.inventory
+	return nil
+}
+
+// Returns the unmined ops with the given OpSigs that were listed in this
+// miner's last reply to a ping or mempool inventory. Doesn't take the
+// miner's lock, for the same reason as Ping.
+//
+// Payload: [OpSigs]
+// Response payload: [op records, their trace IDs]
+// where the trace ID of each op is at the same index as it, "" if unknown.
+func (m *Miner) GetOps(request *MinerRequest, response *MinerResponse) error {
+	m.mempoolLock.Lock()
+	defer m.mempoolLock.Unlock()
+
+	ops := []OperationRecord{}
+	traceIDs := []string{}
+	for _, opSig := range request.Payload[0].([]string) {
+		if opRecord, exists := m.mempool.ops[opSig]; exists {
+			ops = append(ops, opRecord)
+			traceIDs = append(traceIDs, m.traces.get(opSig))
+		}
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = ops
+	response.Payload[1] = traceIDs
+	return nil
+}
+
+// Pings all miners currently listed in the miner map
+// If a connected miner fails to reply, that miner should be removed from the map
+func (m *Miner) PingMiner(payload string, reply *bool) error {
+	*reply = true
+	return nil
+}
+
+func (m *Miner) GetBlockChainLength(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = int(m.blockchain[m.blockchainHead].BlockNo)
+	return nil
+}
+
+func (m *Miner) BidirectionalSetup(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	minerAddr := request.Payload[0].(string)
+	if m.bans.isBanned(minerAddr, time.Now()) {
+		logger.Println("Refused banned peer [" + minerAddr + "]")
+		return nil
+	}
+	if _, connected := m.miners[minerAddr]; !connected && !m.makePeerSlot(true) {
+		logger.Println("Refused peer [" + minerAddr + "]: no free inbound slots")
+		return nil
+	}
+	minerConn, err := m.dialPeer(minerAddr)
+	if err != nil {
+		m.dropPeer(minerAddr)
+	} else {
+		m.addPeer(minerAddr, minerConn, true)
+		logger.Println("birectional setup complete")
+		go m.syncMempool(minerAddr, minerConn)
+	}
+	return nil
+}
+
+// Adds a connected peer in an inbound or outbound slot. A peer that was
+// already connected keeps its slot.
+func (m *Miner) addPeer(minerAddr string, minerConn *rpc.Client, inbound bool) {
+	m.miners[minerAddr] = minerConn
+	if _, exists := m.peerSlots[minerAddr]; !exists {
+		m.peerSlots[minerAddr] = &PeerSlot{inbound: inbound, connected: time.Now()}
+	}
+}
+
+// Opens an RPC connection to a peer, whose traffic is counted in the
+// peer's stats
+func (m *Miner) dialPeer(minerAddr string) (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", minerAddr)
+	if err != nil {
+		return nil, err
+	}
+	var peerConn net.Conn = countingConn{conn, m.getPeerCounters(minerAddr)}
+	if m.peerTLS != nil {
+		tlsConn := tls.Client(peerConn, m.peerTLS.dialConfig(minerAddr))
+		tlsConn.SetDeadline(time.Now().Add(time.Duration(TLS_HANDSHAKE_TIMEOUT) * time.Millisecond))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		peerConn = tlsConn
+	}
+	return rpc.NewClient(peerConn), nil
+}
+
+// Returns the message counters of a peer, creating them on first use
+func (m *Miner) getPeerCounters(minerAddr string) *peerCounters {
+	counters, exists := m.peerStats[minerAddr]
+	if !exists {
+		counters = new(peerCounters)
+		m.peerStats[minerAddr] = counters
+	}
+	return counters
+}
+
+func (c countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.counters.bytesReceived, uint64(n))
+		atomic.StoreInt64(&c.counters.lastSeen, time.Now().UnixNano())
+	}
+	return
+}
+
+func (c countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddUint64(&c.counters.bytesSent, uint64(n))
+	return
+}
+
+// Counts a block or op received from a peer, as invalid if it was rejected
+func (m *Miner) countReceived(event *MinerEvent) {
+	if event.Source == "" {
+		return
+	}
+	counters := m.getPeerCounters(event.Source)
+	atomic.StoreInt64(&counters.lastSeen, time.Now().UnixNano())
+	if event.Type == BLOCK_RECEIVED {
+		atomic.AddUint64(&counters.blocksReceived, 1)
+		if event.Err != nil {
+			atomic.AddUint64(&counters.invalidBlocks, 1)
+		}
+	} else if event.Type == OP_RECEIVED {
+		atomic.AddUint64(&counters.opsReceived, 1)
+		if event.Err != nil {
+			atomic.AddUint64(&counters.invalidOps, 1)
+		}
+	}
+}
+
+// Returns the protocol statistics of a peer
+func (m *Miner) getPeerStats(minerAddr string) PeerStats {
+	counters := m.getPeerCounters(minerAddr)
+	_, connected := m.miners[minerAddr]
+	stats := PeerStats{
+		Address:        minerAddr,
+		Connected:      connected,
+		BlocksSent:     atomic.LoadUint64(&counters.blocksSent),
+		BlocksReceived: atomic.LoadUint64(&counters.blocksReceived),
+		OpsSent:        atomic.LoadUint64(&counters.opsSent),
+		OpsReceived:    atomic.LoadUint64(&counters.opsReceived),
+		BytesSent:      atomic.LoadUint64(&counters.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&counters.bytesReceived),
+		InvalidBlocks:  atomic.LoadUint64(&counters.invalidBlocks),
+		InvalidOps:     atomic.LoadUint64(&counters.invalidOps),
+		Replayed:       m.replayGuard.getReplayed(minerAddr),
+		Duplicates:     m.arrivals.getDuplicates(minerAddr)}
+	if lastSeen := atomic.LoadInt64(&counters.lastSeen); lastSeen != 0 {
+		stats.LastSeen = time.Unix(0, lastSeen)
+	}
+	if withholding := m.withholding[minerAddr]; withholding != nil {
+		stats.BlocksAnnounced = withholding.BlocksAnnounced
+		stats.BlocksReleased = withholding.BlocksReleased
+		stats.BlockAges = withholding.BlockAges
+		stats.Releases = withholding.Releases
+		stats.LongestRelease = withholding.LongestRelease
+		stats.ReorgedBlocks = withholding.ReorgedBlocks
+		stats.Withholding = withholding.Releases >= WITHHOLDING_ALERT_RELEASES
+	}
+	return stats
+}
+
+// Forgets a peer, e.g. one that no longer answers
+func (m *Miner) dropPeer(minerAddr string) {
+	delete(m.miners, minerAddr)
+	delete(m.peerLatencies, minerAddr)
+	delete(m.peerMempools, minerAddr)
+	delete(m.peerSlots, minerAddr)
+}
+
+// Returns the number of peers in inbound or outbound slots
+func (m *Miner) countPeers(inbound bool) (count int) {
+	for _, slot := range m.peerSlots {
+		if slot.inbound == inbound {
+			count++
+		}
+	}
+	return
+}
+
+// Returns the NUM_ANCHOR_PEERS longest connected peers
+func (m *Miner) getAnchorPeers() map[string]bool {
+	minerAddrs := make([]string, 0, len(m.peerSlots))
+	for minerAddr := range m.peerSlots {
+		minerAddrs = append(minerAddrs, minerAddr)
+	}
+	sort.Slice(minerAddrs, func(i, j int) bool {
+		return m.peerSlots[minerAddrs[i]].connected.Before(m.peerSlots[minerAddrs[j]].connected)
+	})
+
+	anchors := make(map[string]bool)
+	for i := 0; i < len(minerAddrs) && i < NUM_ANCHOR_PEERS; i++ {
+		anchors[minerAddrs[i]] = true
+	}
+	return anchors
+}
+
+// Makes room for a new peer in the inbound or outbound slots if they are
+// full, by evicting the peer in them with the lowest score (the most
+// recently connected one among equals) that isn't an anchor or added by
+// an operator. Returns whether there is room.
+func (m *Miner) makePeerSlot(inbound bool) bool {
+	limit := m.maxOutbound
+	if inbound {
+		limit = m.maxInbound
+	}
+	if m.countPeers(inbound) < limit {
+		return true
+	}
+
+	anchors := m.getAnchorPeers()
+	evicted := ""
+	for minerAddr, slot := range m.peerSlots {
+		if slot.inbound != inbound || anchors[minerAddr] || slot.manual {
+			continue
+		}
+		if evicted == "" || slot.score < m.peerSlots[evicted].score ||
+			(slot.score == m.peerSlots[evicted].score && slot.connected.After(m.peerSlots[evicted].connected)) {
+			evicted = minerAddr
+		}
+	}
+	if evicted == "" {
+		return false
+	}
+
+	logger.Println("Evicting peer [" + evicted + "] with score [" + fmt.Sprint(m.peerSlots[evicted].score) + "]")
+	m.miners[evicted].Close()
+	m.dropPeer(evicted)
+	return true
+}
+
+// Credits a peer with being the first to send a new block or op
+func (m *Miner) creditPeer(minerAddr string) {
+	if slot := m.peerSlots[minerAddr]; slot != nil {
+		slot.score++
+	}
+}
+
+func (m *Miner) GetBlockChain(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	logger.Println("GetBlockChain")
+
+	longestChainLength := m.blockchain[m.blockchainHead].BlockNo
+	if longestChainLength == 0 {
+		return nil
+	}
+	longestChain := make([]Block, longestChainLength)
+
+	var currhash = m.blockchainHead
+	for i := 0; i < int(longestChainLength); i++ {
+		longestChain[i] = *m.blockchain[currhash]
+		currhash = m.blockchain[currhash].PrevHash
+	}
+	response.Error = nil
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = longestChain
+
+	return nil
+}
+
+// Returns the hashes and headers (the blocks without their records) of the
+// blocks of the longest chain, oldest first, so that a syncing miner can
+// download the bodies from several miners at once
+//
+// Payload: [hashes, headers]
+func (m *Miner) GetBlockHeaders(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	headNo := int(m.blockchain[m.blockchainHead].BlockNo)
+	hashes := make([]string, headNo)
+	headers := make([]Block, headNo)
+	blockHash := m.blockchainHead
+	for i := headNo - 1; i >= 0; i-- {
+		hashes[i] = blockHash
+		headers[i] = *m.blockchain[blockHash]
+		headers[i].Records = nil
+		blockHash = headers[i].PrevHash
+	}
+
+	response.Payload = []interface{}{hashes, headers}
+	return nil
+}
+
+// Returns the records of blocks in the blocktree, in the order of the
+// given hashes, for at most SYNC_CHUNK_BLOCKS blocks
+//
+// Payload: [hashes] -> [bodies]
+func (m *Miner) GetBlockBodies(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hashes := request.Payload[0].([]string)
+	if len(hashes) > SYNC_CHUNK_BLOCKS {
+		hashes = hashes[:SYNC_CHUNK_BLOCKS]
+	}
+	bodies := make([][]OperationRecord, len(hashes))
+	for i, blockHash := range hashes {
+		block, exists := m.blockchain[blockHash]
+		if !exists {
+			response.Error = errorLib.InvalidBlockHashError(blockHash)
+			return nil
+		}
+		bodies[i] = block.Records
+	}
+
+	response.Payload = []interface{}{bodies}
+	return nil
+}
+
+// Returns up to maxCount (at most SYNC_CHUNK_BLOCKS, 0 for that many)
+// blocks of the longest chain after the given block, oldest first, and
+// whether the chain goes on past them, so that a miner can fetch only the
+// blocks it is missing. The block must be on the longest chain.
+//
+// Payload: [block hash, maxCount] -> [blocks, more]
+func (m *Miner) GetBlocksSince(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	since := request.Payload[0].(string)
+	maxCount := request.Payload[1].(uint32)
+	if maxCount == 0 || maxCount > uint32(SYNC_CHUNK_BLOCKS) {
+		maxCount = uint32(SYNC_CHUNK_BLOCKS)
+	}
+	if !m.isOnMainChain(since) {
+		response.Error = errorLib.InvalidBlockHashError(since)
+		return nil
+	}
+
+	sinceNo, headNo := m.blockchain[since].BlockNo, m.blockchain[m.blockchainHead].BlockNo
+	lastNo := sinceNo + maxCount
+	if lastNo > headNo {
+		lastNo = headNo
+	}
+	blocks := make([]Block, lastNo-sinceNo)
+	blockHash := m.getAncestorAt(m.blockchainHead, lastNo)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		blocks[i] = *m.blockchain[blockHash]
+		blockHash = blocks[i].PrevHash
+	}
+
+	response.Payload = []interface{}{blocks, lastNo < headNo}
+	return nil
+}
+
+// Returns a block in the blocktree, whether or not it is on the longest
+// chain, so that a miner can fetch blocks it is missing
+//
+// Payload: [block]
+func (m *Miner) GetBlock(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	blockHash := request.Payload[0].(string)
+	block, exists := m.blockchain[blockHash]
+	if !exists {
+		response.Error = errorLib.InvalidBlockHashError(blockHash)
+		return nil
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = *block
+	return nil
+}
+
+// Get the amount of ink remaining associated with the miners pub/priv key pair
+func (m *Miner) GetInk(request *ArtnodeRequest, response *MinerResponse) error {
+	replica := m.getReadReplica()
+
+	token := request.Token
+	if !m.isReplicaToken(replica, token) {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	response.Error = nil
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = replica.InkRemaining
+
+	return nil
+}
+
+// Get the hash of the genesis block
+func (m *Miner) GetGenesisBlock(request *ArtnodeRequest, response *MinerResponse) error {
+	replica := m.getReadReplica()
+
+	token := request.Token
+	if !m.isReplicaToken(replica, token) {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	response.Error = nil
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = replica.GenesisBlockHash
+
+	return nil
+}
+
+// Gets a list of shape hashes (operation signatures) in a given block.
+//
+func (m *Miner) GetShapes(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	hash := request.Payload[0].(string)
+	block := m.blockchain[hash]
+	if block == nil {
+		response.Error = errorLib.InvalidBlockHashError(hash)
+		return nil
+	}
+
+	response.Error = nil
+	response.Payload = make([]interface{}, 1)
+	shapeHashes := []string{}
+	for _, record := range block.Records {
+		if record.Op.Type != ALLOW && record.Op.Type != ROTATE {
+			shapeHashes = append(shapeHashes, record.OpSig)
+		}
+	}
+	response.Payload[0] = shapeHashes
+
+	return nil
+}
+
+// Get a list of block hashes which are descendants of a given block, level
+// by level, so that each block comes after its parent. Only the children
+// are returned unless a depth greater than 1 is given. With metadata, each
+// block's parent, number, miner, op count and whether it is on the longest
+// chain are returned too, in the same order. At most MAX_CHILDREN_PAGE
+// blocks are returned, starting at the offset.
+//
+// Request payload: [block hash, depth (optional), include metadata
+// (optional), offset (optional), limit (optional, 0 for the most allowed)]
+// Response payload: [block hashes, total number of descendants] followed,
+// with metadata, by [prev hashes, block numbers, miner public keys,
+// op counts, on longest chain]
+func (m *Miner) GetChildren(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	hash := request.Payload[0].(string)
+	if _, exists := m.blockchain[hash]; !exists {
+		response.Error = errorLib.InvalidBlockHashError(hash)
+		return nil
+	}
+
+	var depth, offset, limit uint32 = 1, 0, MAX_CHILDREN_PAGE
+	includeMetadata := false
+	if len(request.Payload) > 4 {
+		if requested := request.Payload[1].(uint32); requested > 1 {
+			depth = requested
+		}
+		includeMetadata = request.Payload[2].(bool)
+		offset = request.Payload[3].(uint32)
+		if requested := request.Payload[4].(uint32); requested > 0 && requested < MAX_CHILDREN_PAGE {
+			limit = requested
+		}
+	}
+
+	descendants := []string{}
+	level := []string{hash}
+	for i := uint32(0); i < depth && len(level) > 0; i++ {
+		var nextLevel []string
+		for _, parentHash := range level {
+			nextLevel = append(nextLevel, m.blockChildren[parentHash]...)
+		}
+		descendants = append(descendants, nextLevel...)
+		level = nextLevel
+	}
+
+	total := uint32(len(descendants))
+	page := []string{}
+	if offset < total {
+		page = descendants[offset:]
+		if uint32(len(page)) > limit {
+			page = page[:limit]
+		}
+	}
+
+	response.Error = nil
+	response.Payload = []interface{}{page, total}
+	if includeMetadata {
+		onLongestChain := make(map[string]bool)
+		for currHash := m.blockchainHead; m.blockchain[currHash] != nil; currHash = m.blockchain[currHash].PrevHash {
+			onLongestChain[currHash] = true
+		}
+
+		prevHashes, blockNos, miners, opCounts, onChain := []string{}, []uint32{}, []string{}, []uint32{}, []bool{}
+		for _, blockHash := range page {
+			block := m.blockchain[blockHash]
+			prevHashes = append(prevHashes, block.PrevHash)
+			blockNos = append(blockNos, block.BlockNo)
+			miners = append(miners, block.PubKeyString)
+			opCounts = append(opCounts, uint32(block.OpCount))
+			onChain = append(onChain, onLongestChain[blockHash])
+		}
+		response.Payload = append(response.Payload, prevHashes, blockNos, miners, opCounts, onChain)
+	}
+
+	return nil
+}
+
+// Lists the blocks mined by a public key with block numbers from fromBlockNo
+// to toBlockNo (0 for no limit), on any branch, lowest first and then by
+// hash. At most MAX_OWNER_BLOCKS_PAGE blocks are returned. Blocks on the
+// longest chain are the ones the key was rewarded for.
+//
+// Request payload: [public key, from block number, to block number]
+// Response payload: [block hashes, prev hashes, block numbers, op counts,
+// on longest chain]
+func (m *Miner) GetBlocksByOwner(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	owner := request.Payload[0].(string)
+	fromBlockNo := request.Payload[1].(uint32)
+	toBlockNo := request.Payload[2].(uint32)
+	if toBlockNo == 0 {
+		toBlockNo = math.MaxUint32
+	}
+
+	blockHashes := []string{}
+	for _, blockHash := range m.minedBlocks[owner] {
+		if blockNo := m.blockchain[blockHash].BlockNo; blockNo >= fromBlockNo && blockNo <= toBlockNo {
+			blockHashes = append(blockHashes, blockHash)
+		}
+	}
+	sort.Slice(blockHashes, func(i, j int) bool {
+		blockNoI, blockNoJ := m.blockchain[blockHashes[i]].BlockNo, m.blockchain[blockHashes[j]].BlockNo
+		return blockNoI < blockNoJ || (blockNoI == blockNoJ && blockHashes[i] < blockHashes[j])
+	})
+	if uint32(len(blockHashes)) > MAX_OWNER_BLOCKS_PAGE {
+		blockHashes = blockHashes[:MAX_OWNER_BLOCKS_PAGE]
+	}
+
+	onLongestChain := make(map[string]bool)
+	for currHash := m.blockchainHead; m.blockchain[currHash] != nil && m.blockchain[currHash].BlockNo >= fromBlockNo; currHash = m.blockchain[currHash].PrevHash {
+		onLongestChain[currHash] = true
+	}
+
+	prevHashes, blockNos, opCounts, onChain := []string{}, []uint32{}, []uint32{}, []bool{}
+	for _, blockHash := range blockHashes {
+		block := m.blockchain[blockHash]
+		prevHashes = append(prevHashes, block.PrevHash)
+		blockNos = append(blockNos, block.BlockNo)
+		opCounts = append(opCounts, uint32(block.OpCount))
+		onChain = append(onChain, onLongestChain[blockHash])
+	}
+
+	response.Error = nil
+	response.Payload = []interface{}{blockHashes, prevHashes, blockNos, opCounts, onChain}
+
+	return nil
+}
+
+// Response payload: [OpSig, ink quota left, op quota left], where the
+// quota left is math.MaxUint32 for a token without a quota
+func (m *Miner) AddShape(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	if m.backends != nil {
+		// Another backend may have the ink to pay for the shape
+		return m.forwardWrite("AddShape", m.getRequestInkCost(request), request, response, "InsufficientInkError")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	validateNum := request.Payload[0].(uint8)
+	shapeType := shapelib.ShapeType(request.Payload[1].(int))
+	shapeSvgString := request.Payload[2].(string)
+	fill := strings.Trim(request.Payload[3].(string), " ")
+	stroke := strings.Trim(request.Payload[4].(string), " ")
+	// The optional payer spends another key's ink under its allowance
+	payer := ""
+	if len(request.Payload) > 5 && request.Payload[5].(string) != m.pubKeyString {
+		payer = request.Payload[5].(string)
+	}
+	// The optional expiry makes the shape ephemeral
+	var expiryBlocks uint32 = 0
+	if len(request.Payload) > 6 {
+		expiryBlocks = request.Payload[6].(uint32)
+	}
+
+	shape := shapelib.Shape{
+		ShapeType:      shapeType,
+		ShapeSvgString: shapeSvgString,
+		Fill:           fill,
+		Stroke:         stroke,
+		Owner:          m.pubKeyString}
+	// The optional stroke style is only drawn, so it costs no ink
+	if len(request.Payload) > 9 {
+		shape.Style = shapelib.StrokeStyle{
+			Dasharray: request.Payload[7].(string),
+			Linecap:   request.Payload[8].(string),
+			Linejoin:  request.Payload[9].(string)}
+		if shape.Style != (shapelib.StrokeStyle{}) {
+			shape.Version = shapelib.STROKE_STYLE_VERSION
+		}
+	}
+	// The optional dependency is an op the shape is only mined after
+	dependsOn := ""
+	if len(request.Payload) > 10 {
+		dependsOn = request.Payload[10].(string)
+	}
+	artnode := m.tokens[token].PubKeyString
+	if m.observer {
+		response.Error = errorLib.ObserverError(m.localAddr.String())
+		return
+	} else if expiryBlocks > MAX_EXPIRY_BLOCKS {
+		response.Error = errorLib.ExpiryError(MAX_EXPIRY_BLOCKS)
+		return
+	} else if dependsOn != "" && (m.failedOps[dependsOn] != nil || (m.unminedOps[dependsOn] == nil && !m.isOpOnChain(dependsOn))) {
+		response.Error = errorLib.DependencyError(dependsOn)
+		return
+	}
+
+	opRecord := OperationRecord{Op: Operation{Payer: payer}, PubKeyString: m.pubKeyString}
+	inkCost, shapeError := m.validateNewShape(shape, opRecord.getPayer())
+	if shapeError != nil {
+		response.Error = shapeError
+		return
+	} else if quotaError := m.tokens[token].spendQuota(inkCost); quotaError != nil {
+		response.Error = quotaError
+		return
+	}
+
+	op := Operation{
+		Type:         ADD,
+		Shape:        shape,
+		InkCost:      inkCost,
+		ValidateNum:  validateNum,
+		NumRemaining: validateNum,
+		TimeStamp:    time.Now().UnixNano(),
+		Deleted:      false,
+		Artnode:      artnode,
+		Payer:        payer,
+		ExpiryBlocks: expiryBlocks,
+		DependsOn:    dependsOn}
+
+	response.TraceID = getTraceID(request.TraceID)
+	opSig := m.addOperationRecord(&op, response.TraceID)
+	m.addSessionOp(m.tokens[token], opSig)
+
+	inkLeft, opsLeft := m.tokens[token].getQuotaLeft()
+	response.Error = nil
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = opSig
+	response.Payload[1] = inkLeft
+	response.Payload[2] = opsLeft
+
+	return
+}
+
+// Response payload: [OpSig, ink quota left, op quota left], as for AddShape
+func (m *Miner) DeleteShape(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	if m.backends != nil {
+		// Only the backend that added the shape can delete it
+		return m.forwardWrite("DeleteShape", 0, request, response, "ShapeOwnerError")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	shapeHash := request.Payload[0].(string)
+	validateNum := request.Payload[1].(uint8)
+	if m.observer {
+		response.Error = errorLib.ObserverError(m.localAddr.String())
+		return nil
+	}
+
+	opRecord := m.validatedOps[shapeHash]
+	if opRecord == nil || opRecord.Op.Type != ADD || m.getCurrentKey(opRecord.PubKeyString) != m.pubKeyString || opRecord.Op.Deleted || m.expiredOps[shapeHash] {
+		response.Error = errorLib.ShapeOwnerError(shapeHash)
+		return
+	} else if quotaError := m.tokens[token].spendQuota(0); quotaError != nil {
+		response.Error = quotaError
+		return
+	}
+
+	delShape := opRecord.Op.Shape
+	inkCost := opRecord.Op.InkCost
+	delShape.Fill, delShape.Stroke = "white", "white"
+
+	op := Operation{
+		Type:         REMOVE,
+		Shape:        delShape,
+		Ref:          opRecord.OpSig,
+		InkCost:      inkCost,
+		ValidateNum:  validateNum,
+		NumRemaining: validateNum,
+		TimeStamp:    time.Now().UnixNano(),
+		Artnode:      m.tokens[token].PubKeyString,
+		Payer:        opRecord.Op.Payer}
+
+	response.TraceID = getTraceID(request.TraceID)
+	opSig := m.addOperationRecord(&op, response.TraceID)
+	m.addSessionOp(m.tokens[token], opSig)
+
+	inkLeft, opsLeft := m.tokens[token].getQuotaLeft()
+	response.Error = nil
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = opSig
+	response.Payload[1] = inkLeft
+	response.Payload[2] = opsLeft
+
+	return
+}
+
+// Allows another key to spend up to the given amount more of the miner's
+// ink, through ADD ops naming the miner's key as payer, or revokes what is
+// left of its allowance if the amount is 0. Returns the ALLOW
+// op's signature and the token's quota left, as AddShape does; the
+// allowance counts against the token's ink quota.
+func (m *Miner) AllowInk(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	if m.backends != nil {
+		return m.forwardWrite("AllowInk", request.Payload[2].(uint32), request, response)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	validateNum := request.Payload[0].(uint8)
+	spender := request.Payload[1].(string)
+	allowance := request.Payload[2].(uint32)
+	if m.observer {
+		response.Error = errorLib.ObserverError(m.localAddr.String())
+		return nil
+	}
+
+	if parseStringPubKey(spender) == nil || spender == m.pubKeyString {
+		response.Error = errorLib.ValidationError(spender)
+		return nil
+	} else if quotaError := m.tokens[token].spendQuota(allowance); quotaError != nil {
+		response.Error = quotaError
+		return nil
+	}
+
+	op := Operation{
+		Type:         ALLOW,
+		ValidateNum:  validateNum,
+		NumRemaining: validateNum,
+		TimeStamp:    time.Now().UnixNano(),
+		Artnode:      m.tokens[token].PubKeyString,
+		Spender:      spender,
+		Allowance:    allowance}
+
+	response.TraceID = getTraceID(request.TraceID)
+	opSig := m.addOperationRecord(&op, response.TraceID)
+	m.addSessionOp(m.tokens[token], opSig)
+
+	inkLeft, opsLeft := m.tokens[token].getQuotaLeft()
+	response.Error = nil
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = opSig
+	response.Payload[1] = inkLeft
+	response.Payload[2] = opsLeft
+
+	return
+}
+
+// Submits an op that the art node drafted and signed itself, e.g. offline
+// or with a hardware key, instead of having the miner sign it. The op is
+// validated as fully as one sent by another miner, and then disseminated,
+// so the signer's key doesn't have to be this miner's. The op must be
+// encoded exactly as the miners encode it, since that is what is signed.
+//
+// Payload: [encoded op, OpSig, public key of the signer]
+// Response payload: [OpSig]
+func (m *Miner) SubmitSignedOp(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	encodedOp := request.Payload[0].(string)
+	opSig := request.Payload[1].(string)
+	signer := request.Payload[2].(string)
+
+	m.lock.Lock()
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		m.lock.Unlock()
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		m.lock.Unlock()
+		return
+	} else if m.observer {
+		m.lock.Unlock()
+		response.Error = errorLib.ObserverError(m.localAddr.String())
+		return
+	}
+	opRecord := OperationRecord{OpSig: opSig, PubKeyString: signer}
+	response.Error = m.checkSignedOp(encodedOp, &opRecord)
+	m.lock.Unlock()
+	if response.Error != nil {
+		return
+	}
+
+	// The op is applied like one received from a peer, without holding
+	// the lock the event bus takes
+	response.TraceID = getTraceID(request.TraceID)
+	response.Error = m.events.submit(&MinerEvent{Type: OP_RECEIVED, Op: &opRecord, TraceID: response.TraceID})
+	if response.Error != nil {
+		return
+	}
+
+	m.lock.Lock()
+	if session, validToken := m.getSession(token); validToken {
+		m.addSessionOp(session, opSig)
+	}
+	m.lock.Unlock()
+
+	response.Payload = []interface{}{opSig}
+	return
+}
+
+// Decodes an op submitted with its signature into the given record, and
+// checks what receiveOp doesn't: that the op was encoded canonically, that
+// the signer's key parses, that an added shape is owned by the signer and
+// that its ink cost is the shape's
+func (m *Miner) checkSignedOp(encodedOp string, opRecord *OperationRecord) error {
+	if err := json.Unmarshal([]byte(encodedOp), &opRecord.Op); err != nil {
+		return errorLib.ValidationError(opRecord.OpSig)
+	} else if reencoded, err := oplib.Encode(&opRecord.Op); err != nil || string(reencoded) != encodedOp {
+		return errorLib.ValidationError(opRecord.OpSig)
+	} else if parseStringPubKey(opRecord.PubKeyString) == nil {
+		return errorLib.ValidationError(opRecord.PubKeyString)
+	}
+
+	if opRecord.Op.Type == ADD {
+		if opRecord.Op.Shape.Owner != opRecord.PubKeyString {
+			return errorLib.ValidationError(opRecord.OpSig)
+		}
+		geo, err := m.getEngine().Validate(opRecord.Op.Shape, m.getShapeRules())
+		if err != nil {
+			return err
+		} else if m.getEngine().Cost(geo) != uint64(opRecord.Op.InkCost) {
+			return errorLib.ValidationError(opRecord.OpSig)
+		}
+	}
+	return nil
+}
+
+// Returns how much of the payer's ink the spender may still spend, as of
+// the longest chain
+func (m *Miner) GetAllowance(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	payer := request.Payload[0].(string)
+	spender := request.Payload[1].(string)
+
+	response.Error = nil
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = m.getAllowance(payer, spender)
+
+	return nil
+}
+
+// Pins or unpins an op signed by this miner. While an op is pinned, it is
+// retried on every head change if it fails revalidation after a reorg, and
+// re-announced to peers however old it is. OpValidated treats it as
+// pending rather than failed until it has failed MAX_PIN_RETRIES head
+// changes in a row, when it is unpinned and fails with a PinExpiredError.
+//
+// Payload: [opSig, pinned]
+func (m *Miner) PinOp(request *ArtnodeRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return nil
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return nil
+	}
+
+	opSig := request.Payload[0].(string)
+	pinned := request.Payload[1].(bool)
+
+	opRecord := m.unminedOps[opSig]
+	for _, ops := range []map[string]*OperationRecord{m.unvalidatedOps, m.validatedOps, m.failedOps} {
+		if opRecord == nil {
+			opRecord = ops[opSig]
+		}
+	}
+	if opRecord == nil {
+		response.Error = errorLib.InvalidShapeHashError(opSig)
+		return nil
+	} else if opRecord.PubKeyString != m.pubKeyString {
+		response.Error = errorLib.ShapeOwnerError(opSig)
+		return nil
+	}
+
+	if _, alreadyPinned := m.pinnedOps[opSig]; pinned && !alreadyPinned {
+		m.pinnedOps[opSig] = 0
+	} else if !pinned {
+		delete(m.pinnedOps, opSig)
+	}
+
+	return nil
+}
+
+func (m *Miner) OpValidated(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	opSig := request.Payload[0].(string)
+	validOp := m.validatedOps[opSig]
+	failedOp := m.failedOps[opSig]
+
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = false
+	response.Payload[1] = ""
+	response.Payload[2] = uint32(0)
+
+	if validOp != nil {
+		blockHash, err := m.getOpBlockHash(opSig)
+		if err != nil {
+			response.Error = err
+		} else {
+			response.Payload[0] = true
+			response.Payload[1] = blockHash
+			response.Payload[2] = m.inkAccounts[validOp.PubKeyString]
+		}
+	} else if _, pinned := m.pinnedOps[opSig]; failedOp != nil && !pinned {
+		// A pinned op is still pending until it is unpinned
+		response.Error = failedOp.Error
+		delete(m.failedOps, opSig)
+	} else {
+		response.Payload[0] = false
+	}
+
+	return
+}
+
+// Reports where an op is in its lifecycle, along with the reasons it was
+// rejected by any miner (including this one) that reported back.
+//
+// Payload: [state, block hash, rejection summary, rejections]
+// where state is one of "unmined", "unvalidated", "validated", "failed"
+// or "unknown", and each rejection is formatted as "address: reason".
+func (m *Miner) GetOpStatus(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	opSig := request.Payload[0].(string)
+	state, blockHash := "unknown", ""
+	if _, exists := m.unminedOps[opSig]; exists {
+		state = "unmined"
+	} else if _, exists := m.unvalidatedOps[opSig]; exists {
+		state = "unvalidated"
+		blockHash, _ = m.getOpBlockHash(opSig)
+	} else if _, exists := m.validatedOps[opSig]; exists {
+		state = "validated"
+		blockHash, _ = m.getOpBlockHash(opSig)
+	} else if _, exists := m.failedOps[opSig]; exists {
+		state = "failed"
+	}
+	_, pinned := m.pinnedOps[opSig]
+	opError := ""
+	if failedOp := m.failedOps[opSig]; failedOp != nil && failedOp.Error != nil {
+		opError = failedOp.Error.Error()
+	}
+
+	reasons := m.rejections.get(opSig)
+	rejections := make([]string, 0, len(reasons))
+	for minerAddr, reason := range reasons {
+		rejections = append(rejections, minerAddr+": "+reason)
+	}
+	sort.Strings(rejections)
+
+	response.Payload = make([]interface{}, 6)
+	response.Payload[0] = state
+	response.Payload[1] = blockHash
+	response.Payload[2] = summarizeRejections(reasons)
+	response.Payload[3] = rejections
+	response.Payload[4] = pinned
+	response.Payload[5] = opError
+
+	return
+}
+
+// Reports which peers are known to hold an op, to tell an op that never
+// reached the miners from one they rejected. Acknowledged peers (including
+// ones since dropped) accepted the op from this miner, sent it here, or
+// listed it in an inventory exchange; the connected peers that did none of
+// these and didn't reject it are unacknowledged.
+//
+// Payload: [opSig]
+// Response payload: [acknowledged addresses, when each last acknowledged
+// the op (unix nanoseconds), unacknowledged addresses, rejections]
+// where each rejection is formatted as "address: reason".
+func (m *Miner) GetOpPropagation(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	opSig := request.Payload[0].(string)
+	receipts := m.receipts.get(opSig)
+	acknowledged := make([]string, 0, len(receipts))
+	for minerAddr := range receipts {
+		acknowledged = append(acknowledged, minerAddr)
+	}
+	sort.Strings(acknowledged)
+	acknowledgedAt := make([]int64, len(acknowledged))
+	for i, minerAddr := range acknowledged {
+		acknowledgedAt[i] = receipts[minerAddr].UnixNano()
+	}
+
+	reasons := m.rejections.get(opSig)
+	unacknowledged := []string{}
+	for minerAddr := range m.miners {
+		_, acked := receipts[minerAddr]
+		_, rejected := reasons[minerAddr]
+		if !acked && !rejected {
+			unacknowledged = append(unacknowledged, minerAddr)
+		}
+	}
+	sort.Strings(unacknowledged)
+	rejections := make([]string, 0, len(reasons))
+	for minerAddr, reason := range reasons {
+		rejections = append(rejections, minerAddr+": "+reason)
+	}
+	sort.Strings(rejections)
+
+	response.Payload = make([]interface{}, 4)
+	response.Payload[0] = acknowledged
+	response.Payload[1] = acknowledgedAt
+	response.Payload[2] = unacknowledged
+	response.Payload[3] = rejections
+
+	return
+}
+
+// Reports whether a block is final: whether it is on the main chain at or
+// below the newest block that the miners of a quorum of its finality
+// window attested to. Reorgs past a final block are refused.
+//
+// Payload: [blockHash]
+// Response payload: [final, number of blocks of the block's finality window
+// mined by miners that attested to it, number of such blocks needed, hash
+// of the newest final block ("" if there is none)]
+func (m *Miner) GetFinality(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	blockHash := request.Payload[0].(string)
+	if _, exists := m.blockchain[blockHash]; !exists {
+		response.Error = errorLib.InvalidBlockHashError(blockHash)
+		return
+	}
+
+	response.Payload = make([]interface{}, 4)
+	response.Payload[0] = m.isFinal(blockHash)
+	response.Payload[1] = m.countAttestations(blockHash)
+	response.Payload[2] = m.getFinalityQuorum(blockHash)
+	response.Payload[3] = m.finalBlock
+
+	return
+}
+
+// Lists the art node sessions that are online on this miner, i.e. that
+// made a call in the last PRESENCE_WINDOW milliseconds, most recently
+// active first. Sessions are identified by a hash of their token. Returns
+// a PresenceDisabledError unless the miner was run with -presence.
+//
+// Payload: []
+// Response payload: [token hashes, public keys, scopes, when each was last
+// active (unix nanoseconds), ops submitted by each]
+func (m *Miner) GetPresence(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	} else if !m.presence {
+		response.Error = errorLib.PresenceDisabledError(m.localAddr.String())
+		return
+	}
+
+	presence := m.getPresence(true, time.Now())
+	tokenHashes := make([]string, len(presence))
+	pubKeys := make([]string, len(presence))
+	scopes := make([]string, len(presence))
+	lastActive := make([]int64, len(presence))
+	numOps := make([]uint32, len(presence))
+	for i, session := range presence {
+		tokenHashes[i] = session.TokenHash
+		pubKeys[i] = session.PubKeyString
+		scopes[i] = session.Scope
+		lastActive[i] = session.LastActive.UnixNano()
+		numOps[i] = session.NumOps
+	}
+
+	response.Payload = make([]interface{}, 5)
+	response.Payload[0] = tokenHashes
+	response.Payload[1] = pubKeys
+	response.Payload[2] = scopes
+	response.Payload[3] = lastActive
+	response.Payload[4] = numOps
+
+	return
+}
+
+// Sets a key of the metadata of a shape owned by this miner, signing it
+// with the miner's key and gossiping it to the peers. The metadata is kept
+// beside the chain, so it costs no ink and is never mined. An empty value
+// removes the key.
+//
+// Payload: [shape hash, key, value]
+// Response payload: [version of the entry]
+func (m *Miner) SetShapeMetadata(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	shapeHash := request.Payload[0].(string)
+	key := request.Payload[1].(string)
+	value := request.Payload[2].(string)
+
+	entry, err := m.signShapeMetadata(shapeHash, key, value)
+	if err != nil {
+		response.Error = err
+		return nil
+	}
+	if _, err = m.addShapeMetadata(entry); err != nil {
+		response.Error = err
+		return nil
+	}
+	m.disseminateShapeMetadata(entry, "")
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = entry.Version
+
+	return
+}
+
+// Returns the metadata of a shape that this miner knows of, sorted by key.
+// Metadata gossiped while the miner wasn't connected is pulled from its
+// peers in the background the first time it is asked for (and again at
+// most every METADATA_PULL_INTERVAL milliseconds), so a later call may
+// return more.
+//
+// Payload: [shape hash]
+// Response payload: [keys, values, versions]
+// where the value and version of each key are at the same index as it.
+func (m *Miner) GetShapeMetadata(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	shapeHash := request.Payload[0].(string)
+	if _, exists := m.getShapeOwner(shapeHash); !exists {
+		response.Error = errorLib.InvalidShapeHashError(shapeHash)
+		return
+	}
+	if m.needsMetadataPull(shapeHash, time.Now()) {
+		go m.pullShapeMetadata(shapeHash)
+	}
+
+	entries := m.getLiveShapeMetadata(shapeHash)
+	keys := make([]string, len(entries))
+	values := make([]string, len(entries))
+	versions := make([]int64, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+		values[i] = entry.Value
+		versions[i] = entry.Version
+	}
+
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = keys
+	response.Payload[1] = values
+	response.Payload[2] = versions
+
+	return
+}
+
+// Recommends a validateNum from the depths of recent forks: an op whose
+// block is followed by validateNum blocks survives any reorg abandoning
+// at most validateNum blocks. The recommendation is the deepest recent
+// reorg, and at least 1.
+//
+// Payload: [recommended validateNum, deepest recent reorg, recent reorgs,
+// recent head changes, stale blocks, known blocks]
+// where stale blocks are known blocks (excluding the genesis block) that
+// are not on the longest chain.
+func (m *Miner) GetValidateNumRecommendation(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	maxDepth, reorgs := m.forkStats.summarize()
+	recommended := uint8(1)
+	if maxDepth > math.MaxUint8 {
+		recommended = math.MaxUint8
+	} else if maxDepth > 1 {
+		recommended = uint8(maxDepth)
+	}
+
+	knownBlocks := uint32(len(m.blockchain) - 1)
+	staleBlocks := knownBlocks - m.blockchain[m.blockchainHead].BlockNo
+
+	response.Payload = make([]interface{}, 6)
+	response.Payload[0] = recommended
+	response.Payload[1] = maxDepth
+	response.Payload[2] = reorgs
+	response.Payload[3] = uint32(len(m.forkStats.depths))
+	response.Payload[4] = staleBlocks
+	response.Payload[5] = knownBlocks
+
+	return
+}
+
+// Estimates how long an op submitted now with the given validateNum takes
+// to be validated, from the intervals between recent main chain blocks. The
+// op is validated once it is mined and validateNum blocks follow its block.
+// The range is roughly a 90% one, treating block intervals as independent;
+// without any recent intervals there is no estimate, and all three are 0.
+//
+// Payload: [validateNum]
+// Response payload: [estimated nanoseconds, low, high, blocks needed,
+// intervals sampled]
+func (m *Miner) GetValidationEstimate(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	numBlocks := uint32(request.Payload[0].(uint8)) + 1
+	eta, low, high := m.blockIntervals.estimate(numBlocks)
+
+	response.Payload = make([]interface{}, 5)
+	response.Payload[0] = int64(eta)
+	response.Payload[1] = int64(low)
+	response.Payload[2] = int64(high)
+	response.Payload[3] = numBlocks
+	response.Payload[4] = uint32(len(m.blockIntervals.intervals))
+
+	return
+}
+
+// Returns the network's settings and the rules this miner validates shapes
+// by. Deleting a shape refunds all of its ink, and shapes of the same owner
+// may overlap.
+//
+// Payload: [protocol version, canvas x max, canvas y max, ink per op block,
+// ink per no-op block, op block difficulty, no-op block difficulty, max
+// validateNum, delete refund percent, expiry refund percent, max expiry
+// blocks, same owner overlap, auto-close open paths, max shape vertices,
+// max ops per block]
+func (m *Miner) GetSettings(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	settings := m.settings
+	response.Payload = []interface{}{
+		PROTOCOL_VERSION,
+		settings.CanvasSettings.CanvasXMax,
+		settings.CanvasSettings.CanvasYMax,
+		settings.InkPerOpBlock,
+		settings.InkPerNoOpBlock,
+		settings.PoWDifficultyOpBlock,
+		settings.PoWDifficultyNoOpBlock,
+		uint8(math.MaxUint8),
+		uint32(100),
+		EXPIRY_REFUND_PERCENT,
+		MAX_EXPIRY_BLOCKS,
+		true,
+		settings.AutoCloseOpenPaths,
+		m.getMaxShapeVertices(),
+		m.getMaxOpsPerBlock()}
+
+	return
+}
+
+// Reports the ink supply of the chain ending in the head: the ink minted
+// for its blocks, what shapes burned and what was refunded, and the ink
+// the keys hold, to tune InkPerOpBlock and InkPerNoOpBlock by.
+//
+// Response payload: [head hash, op blocks, no-op blocks, ink minted, ink
+// spent on shapes, ink refunded for deleted shapes, ink spent on expired
+// shapes, ink refunded for expired shapes, ink burned on the shapes on the
+// canvas, ink held by keys, number of keys holding ink]
+func (m *Miner) GetSupplyStats(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	var circulating uint64
+	var holders uint32
+	for _, ink := range m.inkAccounts {
+		if ink > 0 {
+			circulating += uint64(ink)
+			holders++
+		}
+	}
+
+	ledger := m.ledgers[m.blockchainHead]
+	response.Payload = []interface{}{
+		m.blockchainHead,
+		ledger.OpBlocks,
+		ledger.NoOpBlocks,
+		ledger.Minted,
+		ledger.Spent,
+		ledger.Refunded,
+		ledger.Expired,
+		ledger.ExpiryRefunded,
+		ledger.getBurned(),
+		circulating,
+		holders}
+
+	return
+}
+
+// Retrieves the token's quota (see ArtnodeSession)
+//
+// Payload: [ink quota, op quota, ink spent, ops submitted]
+func (m *Miner) GetQuota(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	session, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	response.Payload = make([]interface{}, 4)
+	response.Payload[0] = session.InkQuota
+	response.Payload[1] = session.OpQuota
+	response.Payload[2] = session.InkSpent
+	response.Payload[3] = session.NumOps
+
+	return
+}
+
+// Attributes a validated shape to the miner that owns it and the art node
+// that submitted it.
+//
+// Payload: [owner pubKey, artnode pubKey, block hash]
+func (m *Miner) GetShapeProvenance(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	hash := request.Payload[0].(string)
+	opRecord := m.validatedOps[hash]
+	if opRecord == nil {
+		response.Error = errorLib.InvalidShapeHashError(hash)
+		return
+	}
+	blockHash, err := m.getOpBlockHash(hash)
+	if err != nil {
+		response.Error = err
+		return nil
+	}
+
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = opRecord.PubKeyString
+	response.Payload[1] = opRecord.Op.Artnode
+	response.Payload[2] = blockHash
+
+	return
+}
+
+// Returns every shape on the canvas, as of the head of the longest chain.
+// Deleted and expired shapes are left out. Answered from the read replica,
+// so it doesn't wait for blocks being validated. When asked to include
+// pending shapes, the canvas is as the token would see it once its ops
+// that aren't on the longest chain yet are: the shapes it added are
+// included, flagged as pending, and the shapes it deleted are left out.
+//
+// Request payload: [include pending (optional)]
+// Response payload: [head block hash, shape hashes, svg strings, pending]
+// where the svg string of each shape, and whether it is pending, are at the
+// same index as its hash.
+func (m *Miner) GetCanvas(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	replica := m.getReadReplica()
+
+	token := request.Token
+	if !m.isReplicaToken(replica, token) {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	includePending := len(request.Payload) > 0 && request.Payload[0].(bool)
+	deleted := map[string]bool{}
+	if includePending {
+		deleted = replica.pendingDeletes[token]
+	}
+	shapeHashes, svgStrings, pending := []string{}, []string{}, []bool{}
+	for shapeHash, shape := range replica.shapes {
+		if !deleted[shapeHash] {
+			shapeHashes = append(shapeHashes, shapeHash)
+			svgStrings = append(svgStrings, getSvgElement(shape))
+			pending = append(pending, false)
+		}
+	}
+	if includePending {
+		for shapeHash, shape := range replica.pendingShapes[token] {
+			if _, onCanvas := replica.shapes[shapeHash]; !onCanvas && !deleted[shapeHash] {
+				shapeHashes = append(shapeHashes, shapeHash)
+				svgStrings = append(svgStrings, getSvgElement(shape))
+				pending = append(pending, true)
+			}
+		}
+	}
+
+	response.Payload = make([]interface{}, 4)
+	response.Payload[0] = replica.HeadHash
+	response.Payload[1] = shapeHashes
+	response.Payload[2] = svgStrings
+	response.Payload[3] = pending
+
+	return
+}
+
+// Renders a region of the canvas, as of the head of the longest chain, to a
+// PNG image (see shapelib.RenderShapes), so that clients don't need an SVG
+// renderer. The region spans the canvas from (minX, minY) up to but not
+// including (maxX, maxY), and each canvas unit is drawn as scale by scale
+// pixels; a scale of 0 or less is 1. Answered from the read replica.
+//
+// Payload: [minX, minY, maxX, maxY, scale]
+// Response payload: [head block hash, PNG bytes]
+func (m *Miner) RenderRegionPNG(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	replica := m.getReadReplica()
+
+	token := request.Token
+	if !m.isReplicaToken(replica, token) {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	minX, minY := request.Payload[0].(uint32), request.Payload[1].(uint32)
+	maxX, maxY := request.Payload[2].(uint32), request.Payload[3].(uint32)
+	scale := request.Payload[4].(float64)
+	if scale <= 0 {
+		scale = 1
+	}
+
+	canvas := m.settings.CanvasSettings
+	if maxX > canvas.CanvasXMax || maxY > canvas.CanvasYMax {
+		response.Error = errorLib.OutOfBoundsError(fmt.Sprintf("region ends at (%d, %d) on a %dx%d canvas", maxX, maxY, canvas.CanvasXMax, canvas.CanvasYMax))
+		return
+	} else if minX >= maxX || minY >= maxY {
+		response.Error = errorLib.OutOfBoundsError(fmt.Sprintf("region from (%d, %d) to (%d, %d) is empty", minX, minY, maxX, maxY))
+		return
+	} else if math.Ceil(float64(maxX-minX)*scale)*math.Ceil(float64(maxY-minY)*scale) > float64(MAX_RENDER_PIXELS) {
+		response.Error = errorLib.RenderTooLargeError(MAX_RENDER_PIXELS)
+		return
+	}
+
+	shapeHashes := make([]string, 0, len(replica.shapes))
+	for shapeHash := range replica.shapes {
+		shapeHashes = append(shapeHashes, shapeHash)
+	}
+	sort.Strings(shapeHashes)
+	shapes := make([]shapelib.Shape, len(shapeHashes))
+	for i, shapeHash := range shapeHashes {
+		shapes[i] = replica.shapes[shapeHash]
+	}
+
+	region := image.Rect(int(minX), int(minY), int(maxX), int(maxY))
+	var encoded bytes.Buffer
+	if err = png.Encode(&encoded, shapelib.RenderShapes(shapes, region, scale, m.getPathPolicy())); err != nil {
+		return
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = replica.HeadHash
+	response.Payload[1] = encoded.Bytes()
+
+	return
+}
+
+// Returns the changes to the canvas between a given block and the head of
+// the longest chain, which need not be on the same branch.
+//
+// Payload: [head block hash, added shape hashes, added svg strings,
+// removed shape hashes]
+func (m *Miner) GetCanvasDiff(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	fromHash := request.Payload[0].(string)
+	if _, exists := m.blockchain[fromHash]; !exists {
+		response.Error = errorLib.InvalidBlockHashError(fromHash)
+		return
+	}
+
+	from, to := m.getCanvasAt(fromHash), m.getCanvasAt(m.blockchainHead)
+	added, svgStrings, removed := []string{}, []string{}, []string{}
+	for shapeHash, svgString := range to {
+		if _, exists := from[shapeHash]; !exists {
+			added = append(added, shapeHash)
+			svgStrings = append(svgStrings, svgString)
+		}
+	}
+	for shapeHash := range from {
+		if _, exists := to[shapeHash]; !exists {
+			removed = append(removed, shapeHash)
+		}
+	}
+
+	response.Payload = make([]interface{}, 4)
+	response.Payload[0] = m.blockchainHead
+	response.Payload[1] = added
+	response.Payload[2] = svgStrings
+	response.Payload[3] = removed
+
+	return
+}
+
+// Blocks until the head of the longest chain is no longer the given block
+// hash, or until the timeout (in milliseconds, at most MAX_CANVAS_WAIT)
+// passes. This lets art nodes subscribe to canvas changes by long-polling.
+//
+// Request payload: [known head block hash, timeout]
+// Response payload: [head block hash]
+func (m *Miner) WaitForCanvasChange(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	knownHash := request.Payload[0].(string)
+	timeout := request.Payload[1].(uint32)
+	if timeout > MAX_CANVAS_WAIT {
+		timeout = MAX_CANVAS_WAIT
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+
+	// Only the call counts towards the token's rate limit, not each wait
+	for first := true; ; first = false {
+		replica := m.getReadReplica()
+		token := request.Token
+		if !m.isReplicaToken(replica, token) {
+			response.Error = errorLib.InvalidTokenError(token)
+			return
+		} else if first {
+			if response.Error = m.limitToken(token); response.Error != nil {
+				return
+			}
+		}
+		headHash := replica.HeadHash
+
+		if headHash != knownHash || !time.Now().Before(deadline) {
+			response.Payload = make([]interface{}, 1)
+			response.Payload[0] = headHash
+			return
+		}
+		time.Sleep(time.Duration(CANVAS_WAIT_POLL) * time.Millisecond)
+	}
+}
+
+// Acquires the advisory lock on a name, e.g. a shape hash or a region of
+// the canvas, for the given seconds (DEFAULT_LOCK_SECONDS if 0, at most
+// MAX_LOCK_SECONDS), or renews it if the token's session already holds it.
+// Locks are only seen by the art nodes of this miner and don't stop
+// anyone from adding or deleting shapes; they let art nodes that agree to
+// use them coordinate their edits.
+//
+// Payload: [name, seconds]
+// Response payload: [when the lock expires (unix nanoseconds)]
+func (m *Miner) AcquireLock(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	session, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	name := request.Payload[0].(string)
+	seconds := request.Payload[1].(uint32)
+	lock, err := m.locks.acquire(name, token, session.PubKeyString, seconds, time.Now())
+	if err != nil {
+		response.Error = err
+		return nil
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = lock.Expires.UnixNano()
+
+	return
+}
+
+// Releases the advisory lock on a name held by the token's session. Does
+// nothing if nobody holds it.
+//
+// Payload: [name]
+func (m *Miner) ReleaseLock(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	name := request.Payload[0].(string)
+	response.Error = m.locks.release(name, token, time.Now())
+
+	return
+}
+
+// Lists the advisory locks held on this miner, sorted by name. Holders are
+// identified by a hash of their token.
+//
+// Payload: []
+// Response payload: [names, token hashes, public keys, when each expires
+// (unix nanoseconds), whether each is held by the token's session, version
+// of the locks]
+func (m *Miner) GetLocks(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	_, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	locks, version := m.locks.getLocks(time.Now())
+	names := make([]string, len(locks))
+	tokenHashes := make([]string, len(locks))
+	pubKeys := make([]string, len(locks))
+	expires := make([]int64, len(locks))
+	mine := make([]bool, len(locks))
+	for i, lock := range locks {
+		names[i] = lock.Name
+		tokenHashes[i] = hashToken(lock.Token)
+		pubKeys[i] = lock.PubKeyString
+		expires[i] = lock.Expires.UnixNano()
+		mine[i] = lock.Token == token
+	}
+
+	response.Payload = make([]interface{}, 6)
+	response.Payload[0] = names
+	response.Payload[1] = tokenHashes
+	response.Payload[2] = pubKeys
+	response.Payload[3] = expires
+	response.Payload[4] = mine
+	response.Payload[5] = version
+
+	return
+}
+
+// Blocks until the version of the advisory locks is no longer the given
+// one, i.e. a lock was acquired, renewed, released or expired, or until
+// the timeout (in milliseconds, at most MAX_CANVAS_WAIT) passes. This lets
+// art nodes subscribe to lock changes by long-polling.
+//
+// Request payload: [known version, timeout]
+// Response payload: [version]
+func (m *Miner) WaitForLockChange(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	knownVersion := request.Payload[0].(uint64)
+	timeout := request.Payload[1].(uint32)
+	if timeout > MAX_CANVAS_WAIT {
+		timeout = MAX_CANVAS_WAIT
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+
+	// Only the call counts towards the token's rate limit, not each wait
+	for first := true; ; first = false {
+		replica := m.getReadReplica()
+		token := request.Token
+		if !m.isReplicaToken(replica, token) {
+			response.Error = errorLib.InvalidTokenError(token)
+			return
+		} else if first {
+			if response.Error = m.limitToken(token); response.Error != nil {
+				return
+			}
+		}
+		now := time.Now()
+		version := m.locks.getVersion(now)
+
+		if version != knownVersion || !now.Before(deadline) {
+			response.Payload = make([]interface{}, 1)
+			response.Payload[0] = version
+			return
+		}
+		time.Sleep(time.Duration(CANVAS_WAIT_POLL) * time.Millisecond)
+	}
+}
+
+// Revokes the token, which also ends any WaitForCanvasChange calls made
+// with it and releases its advisory locks. Returns the miner's ink and the ops submitted with the token
+// that are neither validated nor failed yet; they stay in the network.
+//
+// Payload: [ink remaining, pending op sigs]
+func (m *Miner) CloseCanvas(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Not rate limited, so that an art app can always give up its token
+	token := request.Token
+	session, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	}
+
+	pendingOpSigs := []string{}
+	for _, opSig := range session.OpSigs {
+		_, unmined := m.unminedOps[opSig]
+		_, unvalidated := m.unvalidatedOps[opSig]
+		if unmined || unvalidated {
+			pendingOpSigs = append(pendingOpSigs, opSig)
+		}
+	}
+
+	m.revokeToken(token)
+	m.updateReadReplica()
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = m.inkAccounts[m.pubKeyString]
+	response.Payload[1] = pendingOpSigs
+
+	return
+}
+
+// Revokes a token issued for the same key as the token's session, e.g. one
+// that leaked, identified by its hash as in GetPresence and GetLocks, or
+// with an empty hash every other token issued for the key. Ops already
+// submitted with the revoked tokens are still mined. Returns an
+// InvalidTokenError if no token of the key has the hash.
+//
+// Payload: [token hash]
+// Response payload: [number of tokens revoked]
+func (m *Miner) RevokeToken(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token := request.Token
+	session, validToken := m.getSession(token)
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(token)
+		return
+	} else if response.Error = m.limitToken(token); response.Error != nil {
+		return
+	}
+
+	tokenHash := request.Payload[0].(string)
+	numRevoked := 0
+	for other, otherSession := range m.tokens {
+		if otherSession.PubKeyString != session.PubKeyString {
+			continue
+		}
+		if (tokenHash == "" && other != token) || (tokenHash != "" && hashToken(other) == tokenHash) {
+			m.revokeToken(other)
+			numRevoked++
+		}
+	}
+	if tokenHash != "" && numRevoked == 0 {
+		response.Error = errorLib.InvalidTokenError(tokenHash)
+		return
+	}
+
+	m.updateReadReplica()
+	response.Payload = []interface{}{numRevoked}
+	return
+}
+
+// </RPC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ADMIN RPC METHODS>
+
+// Reports a summary of the miner's chain, peers and op collections
+func (a *MinerAdmin) Status(_ string, status *MinerStatus) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status.Address = m.localAddr.String()
+	status.PubKeyString = m.pubKeyString
+	status.BlockchainHead = m.blockchainHead
+	status.NumBlocks = len(m.blockchain)
+	status.NumPeers = len(m.miners)
+	status.InkRemaining = m.inkAccounts[m.pubKeyString]
+	status.NumUnminedOps = len(m.unminedOps)
+	status.NumUnvalidOps = len(m.unvalidatedOps)
+	status.NumValidOps = len(m.validatedOps)
+	status.NumFailedOps = len(m.failedOps)
+	status.Observer = m.observer
+	status.NoOpInterval = m.noOpInterval
+	status.OpsReceived, status.BlocksReceived, status.HeadChanges = m.events.getCounts()
+	status.ChainLength = m.positions[m.blockchainHead].Height
+	status.ChainWork = m.positions[m.blockchainHead].Work
+	for _, worker := range m.miningWorkers {
+		status.HashRates = append(status.HashRates, worker.getHashRate())
+	}
+	for currHash := m.blockchainHead; m.blockchain[currHash] != nil; currHash = m.blockchain[currHash].PrevHash {
+		status.NumChainOps += m.blockchain[currHash].OpCount
+		status.ChainInkSpent += m.blockchain[currHash].InkDebited - m.blockchain[currHash].InkCredited
+	}
+
+	return nil
+}
+
+// Lists the connected peers, nearest first and unmeasured peers last
+func (a *MinerAdmin) Peers(_ string, peers *[]PeerStatus) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*peers = []PeerStatus{}
+	anchors := m.getAnchorPeers()
+	for minerAddr := range m.miners {
+		peer := PeerStatus{Address: minerAddr, Latency: m.peerLatencies[minerAddr], UnminedOps: m.peerMempools[minerAddr].NumOps, Anchor: anchors[minerAddr]}
+		if slot := m.peerSlots[minerAddr]; slot != nil {
+			peer.Inbound, peer.Score, peer.Manual = slot.inbound, slot.score, slot.manual
+		}
+		*peers = append(*peers, peer)
+	}
+	sort.Slice(*peers, func(i, j int) bool {
+		latencyI, latencyJ := (*peers)[i].Latency, (*peers)[j].Latency
+		return latencyI != 0 && (latencyJ == 0 || latencyI < latencyJ)
+	})
+	return nil
+}
+
+// Connects to a miner right away, even if the outbound slots are full, in
+// a slot that isn't given up for other peers. Returns a PeerBannedError if
+// the miner is banned, or a DisconnectedError if it can't be reached.
+func (a *MinerAdmin) AddPeer(minerAddr string, _ *bool) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.bans.isBanned(minerAddr, time.Now()) {
+		return errorLib.PeerBannedError(minerAddr)
+	}
+	if _, connected := m.miners[minerAddr]; !connected {
+		if err := m.connectToPeer(minerAddr); err != nil {
+			return errorLib.DisconnectedError(minerAddr)
+		}
+	}
+	m.peerSlots[minerAddr].manual = true
+	logger.Println("Added peer [" + minerAddr + "]")
+	return nil
+}
+
+// Disconnects from a peer. It may be connected to again later, e.g. when
+// the server hands out its address; ban it to keep it away.
+func (a *MinerAdmin) RemovePeer(minerAddr string, _ *bool) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	minerConn, connected := m.miners[minerAddr]
+	if !connected {
+		return fmt.Errorf("[%s] isn't a peer", minerAddr)
+	}
+	minerConn.Close()
+	m.dropPeer(minerAddr)
+	logger.Println("Removed peer [" + minerAddr + "]")
+	return nil
+}
+
+// Bans a miner for the given number of seconds, or for good, disconnecting
+// from it if it is a peer. Banning a banned miner again replaces its ban.
+// Returns when the ban ends (the zero time if it doesn't).
+func (a *MinerAdmin) BanPeer(request BanRequest, until *time.Time) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if request.Address == "" {
+		return fmt.Errorf("no address to ban")
+	}
+	*until = time.Time{}
+	if request.Seconds > 0 {
+		*until = time.Now().Add(time.Duration(request.Seconds) * time.Second)
+	}
+	m.bans.ban(request.Address, *until)
+	if minerConn, connected := m.miners[request.Address]; connected {
+		minerConn.Close()
+		m.dropPeer(request.Address)
+	}
+	logger.Println("Banned peer [" + request.Address + "]")
+	return m.storeBans()
+}
+
+// Lifts the ban on a miner. Returns an error if it isn't banned.
+func (a *MinerAdmin) UnbanPeer(minerAddr string, _ *bool) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.bans.unban(minerAddr) {
+		return fmt.Errorf("[%s] isn't banned", minerAddr)
+	}
+	logger.Println("Unbanned peer [" + minerAddr + "]")
+	return m.storeBans()
+}
+
+// Lists the banned miners, by address
+func (a *MinerAdmin) Bans(_ string, bans *[]PeerBan) error {
+	*bans = a.miner.bans.getBans(time.Now())
+	return nil
+}
+
+// Returns the protocol statistics of every peer the miner has exchanged
+// messages with since it started, by address
+func (a *MinerAdmin) PeerStats(_ string, stats *[]PeerStats) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*stats = []PeerStats{}
+	for minerAddr := range m.peerStats {
+		*stats = append(*stats, m.getPeerStats(minerAddr))
+	}
+	sort.Slice(*stats, func(i, j int) bool {
+		return (*stats)[i].Address < (*stats)[j].Address
+	})
+	return nil
+}
+
+// Returns the received blocks that failed validation, newest first
+func (a *MinerAdmin) Quarantine(_ string, blocks *[]QuarantinedBlock) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*blocks = m.quarantine.list()
+	return nil
+}
+
+// Soft restarts the miner, see softRestart
+func (a *MinerAdmin) Restart(_ string, result *RestartResult) (err error) {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*result, err = m.softRestart()
+	return
+}
+
+// Returns the miner's current main chain, oldest block first
+func (a *MinerAdmin) ExportChain(_ string, export *ChainExport) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	export.GenesisBlockHash = m.settings.GenesisBlockHash
+	export.Blocks = m.getMainChain()
+
+	return nil
+}
+
+// Takes a signed snapshot of the miner's main chain, see BootstrapSnapshot
+func (a *MinerAdmin) Snapshot(_ string, snapshot *BootstrapSnapshot) (err error) {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bootstrap, err := m.takeBootstrapSnapshot()
+	if err != nil {
+		return err
+	}
+	*snapshot = *bootstrap
+	return nil
+}
+
+// Exports the canvas as of a block, or as of the final block if blockHash
+// is "", as an svg with a manifest signed by the miner's key
+func (a *MinerAdmin) ExportCanvas(blockHash string, export *CanvasExport) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	canvas, err := m.exportCanvas(blockHash)
+	if err != nil {
+		return err
+	}
+	*export = *canvas
+	return nil
+}
+
+// Signs a ROTATE op handing the miner's ink and shapes over to a new key,
+// e.g. because the miner's private key has leaked, and returns the op's
+// signature. The miner keeps mining under its old key, whose rewards go to
+// the new key, but must be restarted with the new keypair to add shapes.
+func (a *MinerAdmin) RotateKey(newKey string, opSig *string) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.observer {
+		return errorLib.ObserverError(m.localAddr.String())
+	} else if rotation, rotated := m.rotatedKeys[m.pubKeyString]; rotated {
+		return errorLib.KeyRotatedError(rotation.NewKey)
+	} else if parseStringPubKey(newKey) == nil || newKey == m.pubKeyString {
+		return errorLib.ValidationError(newKey)
+	}
+
+	op := Operation{
+		Type:      ROTATE,
+		TimeStamp: time.Now().UnixNano(),
+		Artnode:   m.pubKeyString,
+		NewKey:    newKey}
+	*opSig = m.addOperationRecord(&op, newTraceID())
+
+	return nil
+}
+
+// Lists the outstanding nonces and tokens, oldest first, so that an
+// operator can spot stale or leaked ones
+func (a *MinerAdmin) Sessions(_ string, sessions *SessionList) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sessions.Nonces = []NonceStatus{}
+	for nonce, created := range m.nonces {
+		sessions.Nonces = append(sessions.Nonces, NonceStatus{nonce, created})
+	}
+	sort.Slice(sessions.Nonces, func(i, j int) bool {
+		return sessions.Nonces[i].Created.Before(sessions.Nonces[j].Created)
+	})
+
+	sessions.Tokens = []TokenStatus{}
+	for token, session := range m.tokens {
+		sessions.Tokens = append(sessions.Tokens, TokenStatus{token, session.PubKeyString, session.Created, session.Expires, session.NumOps, session.InkSpent})
+	}
+	sort.Slice(sessions.Tokens, func(i, j int) bool {
+		return sessions.Tokens[i].Created.Before(sessions.Tokens[j].Created)
+	})
+	return nil
+}
+
+// Lists every session of the miner's tokens, whether or not it is online,
+// most recently active first, so that an operator can audit access
+func (a *MinerAdmin) Presence(_ string, presence *[]SessionPresence) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*presence = m.getPresence(false, time.Now())
+	return nil
+}
+
+// Revokes a token, as if its canvas had been closed. Ops already submitted
+// with it are still mined, but its advisory locks are released. Returns an
+// InvalidTokenError if there is no such token.
+func (a *MinerAdmin) RevokeToken(token string, _ *bool) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, validToken := m.getSession(token); !validToken {
+		return errorLib.InvalidTokenError(token)
+	}
+	m.revokeToken(token)
+	m.updateReadReplica()
+	return nil
+}
+
+// Revokes every token and forgets every nonce, so that every art node has
+// to authenticate again. Returns how many tokens were revoked.
+func (a *MinerAdmin) PurgeSessions(_ string, numRevoked *int) error {
+	m := a.miner
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	*numRevoked = len(m.tokens)
+	for token := range m.tokens {
+		m.locks.releaseSession(token)
+	}
+	m.tokens = make(map[string]*ArtnodeSession)
+	m.nonces = make(map[string]time.Time)
+	m.updateReadReplica()
+	return nil
+}
+
+// Captures a profile of the miner to a file on its host, see
+// ProfileRequest, and returns the file's path. It doesn't take the lock,
+// so that the miner is profiled as it runs.
+func (a *MinerAdmin) Profile(request ProfileRequest, path *string) error {
+	seconds := request.Seconds
+	if seconds == 0 {
+		seconds = DEFAULT_PROFILE_SECONDS
+	}
+	if request.Kind != "cpu" && pprof.Lookup(request.Kind) == nil {
+		return fmt.Errorf("unknown profile %q", request.Kind)
+	} else if seconds > MAX_PROFILE_SECONDS {
+		return fmt.Errorf("can't record a CPU profile for more than %d seconds", MAX_PROFILE_SECONDS)
+	}
+
+	var file *os.File
+	var err error
+	if request.File == "" {
+		file, err = ioutil.TempFile("", "blockart-"+request.Kind+"-*.pprof")
+	} else {
+		file, err = os.Create(request.File)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	*path = file.Name()
+
+	if request.Kind != "cpu" {
+		return pprof.Lookup(request.Kind).WriteTo(file, 0)
+	} else if err = pprof.StartCPUProfile(file); err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(seconds) * time.Second)
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// </ADMIN RPC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PROFILING>
+
+// Roles that goroutines are labelled with (the pprof label "role"), so
+// that profiles can be broken down by what the miner was doing, e.g. with
+// go tool pprof -tagfocus role=mining. Validation covers applying received
+// blocks and ops and replaying synced chains, gossip the RPCs other miners
+// make and the loops that gossip with them, and artnode the RPCs art nodes
+// make. Goroutines inherit the role of the goroutine that started them.
+const (
+	ROLE_MINING     = "mining"
+	ROLE_VALIDATION = "validation"
+	ROLE_GOSSIP     = "gossip"
+	ROLE_ARTNODE    = "artnode"
+	ROLE_ADMIN      = "admin"
+)
+
+// Runs f with the goroutine labelled with a role
+func withRole(role string, f func()) {
+	pprof.Do(context.Background(), pprof.Labels("role", role), func(context.Context) {
+		f()
+	})
+}
+
+// Returns the role of each RPC method of the miner that other miners call
+// (those taking a *MinerRequest), keyed by service method, e.g.
+// "Miner.SendBlock". Every other method is called by art nodes.
+func getRPCRoles() map[string]string {
+	roles := make(map[string]string)
+	minerType := reflect.TypeOf(new(Miner))
+	for i := 0; i < minerType.NumMethod(); i++ {
+		method := minerType.Method(i)
+		if method.Type.NumIn() == 3 && method.Type.In(1) == reflect.TypeOf(new(MinerRequest)) {
+			roles["Miner."+method.Name] = ROLE_GOSSIP
+		}
+	}
+	return roles
+}
+
+// Serves RPCs over gob like rpc.ServeConn, labelling each call with the
+// role of its method (see getRPCRoles), since art nodes and other miners
+// call the miner on the same socket. net/rpc reads a call's header on the
+// connection's goroutine, then starts the call on a goroutine of its own,
+// which inherits the label set when the header was read.
+type labelledGobCodec struct {
+	conn  io.ReadWriteCloser
+	buf   *bufio.Writer
+	dec   *gob.Decoder
+	enc   *gob.Encoder
+	roles map[string]string
+
+	// Whether calls of the miner RPCs are refused, as on art nodes'
+	// connections with peer TLS
+	refuseGossip bool
+}
+
+func newLabelledGobCodec(conn io.ReadWriteCloser, roles map[string]string) *labelledGobCodec {
+	buf := bufio.NewWriter(conn)
+	return &labelledGobCodec{conn, buf, gob.NewDecoder(conn), gob.NewEncoder(buf), roles, false}
+}
+
+func (c *labelledGobCodec) ReadRequestHeader(request *rpc.Request) error {
+	err := c.dec.Decode(request)
+	role, exists := c.roles[request.ServiceMethod]
+	if !exists {
+		role = ROLE_ARTNODE
+	} else if c.refuseGossip {
+		// net/rpc replies that there is no such method
+		request.ServiceMethod = "Miner.PeerTLSRequired"
+	}
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("role", role)))
+	return err
+}
+
+func (c *labelledGobCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+// Writes a reply, closing the connection if the reply can't be encoded,
+// since the stream is then out of sync
+func (c *labelledGobCodec) WriteResponse(response *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(response); err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err != nil {
+		if c.buf.Flush() == nil {
+			c.Close()
+		}
+		return
+	}
+	return c.buf.Flush()
+}
+
+func (c *labelledGobCodec) Close() error {
+	return c.conn.Close()
+}
+
+// </PROFILING>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <DASHBOARD>
+
+var opTypeNames = map[OpType]string{ADD: "ADD", REMOVE: "REMOVE", ALLOW: "ALLOW", ROTATE: "ROTATE"}
+
+// Page served at the root of the admin socket. html/template escapes every
+// value, including the fill and stroke of the shapes on the canvas.
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"hash":   shortenHash,
+	"key":    shortenKey,
+	"opHash": func(opSig string) string { return shortenHash(md5Hash([]byte(opSig))) },
+	"opType": func(opType OpType) string { return opTypeNames[opType] },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>BlockArt miner {{.Status.Address}}</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+svg { border: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>Miner {{.Status.Address}}</h1>
+<p>Key {{key .Status.PubKeyString}}, head {{hash .Status.BlockchainHead}} at height {{.Status.ChainLength}}, {{.Status.NumPeers}} peers, {{.Status.InkRemaining}} ink{{if .Status.Observer}}, observing{{end}}</p>
+
+<h2>Chain</h2>
+<table>
+<tr><th>Height</th><th>Hash</th><th>Miner</th><th>Ops</th><th>Ink debited</th><th>Ink credited</th></tr>
+{{range .Blocks}}<tr><td>{{.Block.BlockNo}}</td><td>{{hash .Hash}}</td><td>{{key .Block.PubKeyString}}</td><td>{{.Block.OpCount}}</td><td>{{.Block.InkDebited}}</td><td>{{.Block.InkCredited}}</td></tr>
+{{end}}</table>
+
+<h2>Peers</h2>
+<table>
+<tr><th>Address</th><th>Latency</th><th>Unmined ops</th><th>Slot</th><th>Score</th></tr>
+{{range .Peers}}<tr><td>{{.Address}}</td><td>{{if .Latency}}{{.Latency}}{{else}}unmeasured{{end}}</td><td>{{.UnminedOps}}</td><td>{{if .Inbound}}inbound{{else}}outbound{{end}}{{if .Anchor}}, anchor{{end}}</td><td>{{.Score}}</td></tr>
+{{end}}</table>
+
+<h2>Mempool ({{.Status.NumUnminedOps}} unmined ops)</h2>
+<table>
+<tr><th>Op</th><th>Type</th><th>Signer</th><th>Ink cost</th><th>Validate num</th></tr>
+{{range .UnminedOps}}<tr><td>{{opHash .OpSig}}</td><td>{{opType .Op.Type}}</td><td>{{key .PubKeyString}}</td><td>{{.Op.InkCost}}</td><td>{{.Op.ValidateNum}}</td></tr>
+{{end}}</table>
+
+<h2>Canvas ({{len .Shapes}} shapes)</h2>
+<svg width="{{.Canvas.CanvasXMax}}" height="{{.Canvas.CanvasYMax}}">
+{{define "style"}}{{with .Dasharray}} stroke-dasharray="{{.}}"{{end}}{{with .Linecap}} stroke-linecap="{{.}}"{{end}}{{with .Linejoin}} stroke-linejoin="{{.}}"{{end}}{{end}}
+{{range .Shapes}}{{if .Circle}}<circle cx="{{.Cx}}" cy="{{.Cy}}" r="{{.R}}" stroke="{{.Stroke}}" fill="{{.Fill}}"{{template "style" .Style}}/>{{else}}<path d="{{.D}}" stroke="{{.Stroke}}" fill="{{.Fill}}"{{with .FillRule}} fill-rule="{{.}}"{{end}}{{template "style" .Style}}/>{{end}}
+{{end}}</svg>
+
+<h2>Ink ledger</h2>
+<table>
+<tr><th>Key</th><th>Ink</th></tr>
+{{range .InkAccounts}}<tr><td>{{key .Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// A per-peer metric served on /metrics
+type peerMetric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(PeerStats) uint64
+}
+
+var peerMetrics = []peerMetric{
+	{"blockart_peer_blocks_sent_total", "counter", "Blocks sent to the peer", func(s PeerStats) uint64 { return s.BlocksSent }},
+	{"blockart_peer_blocks_received_total", "counter", "Blocks received from the peer", func(s PeerStats) uint64 { return s.BlocksReceived }},
+	{"blockart_peer_ops_sent_total", "counter", "Ops sent to the peer", func(s PeerStats) uint64 { return s.OpsSent }},
+	{"blockart_peer_ops_received_total", "counter", "Ops received from the peer", func(s PeerStats) uint64 { return s.OpsReceived }},
+	{"blockart_peer_bytes_sent_total", "counter", "Bytes written to the connection to the peer", func(s PeerStats) uint64 { return s.BytesSent }},
+	{"blockart_peer_bytes_received_total", "counter", "Bytes read from the connection to the peer", func(s PeerStats) uint64 { return s.BytesReceived }},
+	{"blockart_peer_invalid_blocks_total", "counter", "Blocks from the peer that were rejected", func(s PeerStats) uint64 { return s.InvalidBlocks }},
+	{"blockart_peer_invalid_ops_total", "counter", "Ops from the peer that were rejected", func(s PeerStats) uint64 { return s.InvalidOps }},
+	{"blockart_peer_replayed_total", "counter", "Blocks and ops from the peer that were dropped as replays", func(s PeerStats) uint64 { return s.Replayed }},
+	{"blockart_peer_duplicate_blocks_total", "counter", "Blocks from the peer that were dropped as already known or being applied", func(s PeerStats) uint64 { return s.Duplicates }},
+	{"blockart_peer_blocks_announced_total", "counter", "Valid new blocks first received from the peer", func(s PeerStats) uint64 { return s.BlocksAnnounced }},
+	{"blockart_peer_blocks_released_total", "counter", "Blocks the peer announced as part of a released secret chain", func(s PeerStats) uint64 { return s.BlocksReleased }},
+	{"blockart_peer_releases_total", "counter", "Secret chains the peer released", func(s PeerStats) uint64 { return s.Releases }},
+	{"blockart_peer_reorged_blocks_total", "counter", "Main chain blocks abandoned by the peer's secret chains", func(s PeerStats) uint64 { return s.ReorgedBlocks }},
+	{"blockart_peer_withholding", "gauge", "1 if the peer keeps releasing secret chains", func(s PeerStats) uint64 {
+		if s.Withholding {
+			return 1
+		}
+		return 0
+	}},
+	{"blockart_peer_last_seen_seconds", "gauge", "Unix time the peer last sent or replied", func(s PeerStats) uint64 {
+		if s.LastSeen.IsZero() {
+			return 0
+		}
+		return uint64(s.LastSeen.Unix())
+	}}}
+
+// Serves the peer statistics and the memory use of the resource budget's
+// pools in the Prometheus text format
+func (m *Miner) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var stats []PeerStats
+	(&MinerAdmin{m}).PeerStats("", &stats)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range peerMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.metricType)
+		for _, peer := range stats {
+			fmt.Fprintf(w, "%s{peer=%q} %d\n", metric.name, peer.Address, metric.value(peer))
+		}
+	}
+	fmt.Fprintf(w, "# HELP blockart_peer_block_ages_total Blocks announced by the peer by how many blocks old they were\n# TYPE blockart_peer_block_ages_total counter\n")
+	for _, peer := range stats {
+		for i, age := range []string{"0", "1", "2-5", "6+"} {
+			fmt.Fprintf(w, "blockart_peer_block_ages_total{peer=%q,age=%q} %d\n", peer.Address, age, peer.BlockAges[i])
+		}
+	}
+
+	m.lock.RLock()
+	usage, total := m.getResourceUsage()
+	evictions := make(map[string]uint64)
+	for name, count := range m.budget.evictions {
+		evictions[name] = count
+	}
+	limit := m.budget.limit
+	m.lock.RUnlock()
+
+	fmt.Fprintf(w, "# HELP blockart_memory_budget_bytes Bytes the budgeted pools may use (0 for no limit)\n# TYPE blockart_memory_budget_bytes gauge\n")
+	fmt.Fprintf(w, "blockart_memory_budget_bytes %d\n", limit)
+	fmt.Fprintf(w, "# HELP blockart_memory_usage_bytes Approximate bytes used by the budgeted pools as of the last check\n# TYPE blockart_memory_usage_bytes gauge\n")
+	fmt.Fprintf(w, "blockart_memory_usage_bytes %d\n", total)
+	fmt.Fprintf(w, "# HELP blockart_memory_pool_bytes Approximate bytes used by the pool as of the last check\n# TYPE blockart_memory_pool_bytes gauge\n")
+	for _, pool := range resourcePools {
+		fmt.Fprintf(w, "blockart_memory_pool_bytes{pool=%q} %d\n", pool.name, usage[pool.name])
+	}
+	fmt.Fprintf(w, "# HELP blockart_memory_evictions_total Entries evicted from the pool to stay within the budget\n# TYPE blockart_memory_evictions_total counter\n")
+	for _, pool := range resourcePools {
+		if pool.evict != nil {
+			fmt.Fprintf(w, "blockart_memory_evictions_total{pool=%q} %d\n", pool.name, evictions[pool.name])
+		}
+	}
+}
+
+func (m *Miner) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	checkError(dashboardTemplate.Execute(w, m.getDashboard()))
+}
+
+// Gathers what the dashboard shows. The status and peers are those the
+// admin RPCs return; the rest is read under a single lock so that the
+// chain, mempool, canvas and ink ledger agree with each other.
+func (m *Miner) getDashboard() *Dashboard {
+	admin := &MinerAdmin{m}
+	dashboard := &Dashboard{Refresh: DASHBOARD_REFRESH}
+	admin.Status("", &dashboard.Status)
+	admin.Peers("", &dashboard.Peers)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	dashboard.Canvas = m.settings.CanvasSettings
+	for currHash := m.blockchainHead; m.blockchain[currHash] != nil && currHash != m.settings.GenesisBlockHash; currHash = m.blockchain[currHash].PrevHash {
+		if len(dashboard.Blocks) == DASHBOARD_BLOCKS {
+			break
+		}
+		dashboard.Blocks = append(dashboard.Blocks, ExportedBlock{currHash, *m.blockchain[currHash]})
+	}
+
+	for _, opRecord := range m.unminedOps {
+		dashboard.UnminedOps = append(dashboard.UnminedOps, *opRecord)
+	}
+	sort.Slice(dashboard.UnminedOps, func(i, j int) bool {
+		return dashboard.UnminedOps[i].Op.TimeStamp < dashboard.UnminedOps[j].Op.TimeStamp
+	})
+	if len(dashboard.UnminedOps) > DASHBOARD_OPS {
+		dashboard.UnminedOps = dashboard.UnminedOps[:DASHBOARD_OPS]
+	}
+
+	for pubKeyString, ink := range m.inkAccounts {
+		dashboard.InkAccounts = append(dashboard.InkAccounts, Pair{pubKeyString, int(ink)})
+	}
+	sort.Slice(dashboard.InkAccounts, func(i, j int) bool {
+		accountI, accountJ := dashboard.InkAccounts[i], dashboard.InkAccounts[j]
+		return accountI.Value > accountJ.Value || (accountI.Value == accountJ.Value && accountI.Key < accountJ.Key)
+	})
+	if len(dashboard.InkAccounts) > DASHBOARD_ACCOUNTS {
+		dashboard.InkAccounts = dashboard.InkAccounts[:DASHBOARD_ACCOUNTS]
+	}
+
+	// Sorted so that the preview doesn't change between reloads
+	shapes, _ := m.getShapesAt(m.blockchainHead)
+	shapeHashes := make([]string, 0, len(shapes))
+	for shapeHash := range shapes {
+		shapeHashes = append(shapeHashes, shapeHash)
+	}
+	sort.Strings(shapeHashes)
+	for _, shapeHash := range shapeHashes {
+		dashboard.Shapes = append(dashboard.Shapes, getDashboardShape(shapes[shapeHash]))
+	}
+
+	return dashboard
+}
+
+func getDashboardShape(shape shapelib.Shape) DashboardShape {
+	dashboardShape := DashboardShape{D: shape.ShapeSvgString, FillRule: shape.GetFillRule(), Stroke: shape.Stroke, Fill: shape.Fill, Style: shape.Style}
+	if shape.ShapeType == shapelib.CIRCLE {
+		_geo, _ := shape.GetGeometry()
+		geo, _ := _geo.(shapelib.CircleGeometry)
+		dashboardShape.Circle = true
+		dashboardShape.Cx, dashboardShape.Cy, dashboardShape.R = geo.Center.X, geo.Center.Y, geo.Radius
+	}
+	return dashboardShape
+}
+
+// Returns the first 8 characters of a hash. Block hashes end in the zeros
+// of their proof of work, so their prefixes tell them apart.
+func shortenHash(hash string) string {
+	if len(hash) <= 8 {
+		return hash
+	}
+	return hash[:8]
+}
+
+// Returns the last 8 characters of a public key. Encoded keys all start
+// with the same curve parameters, so their suffixes tell them apart.
+func shortenKey(pubKeyString string) string {
+	if len(pubKeyString) <= 8 {
+		return pubKeyString
+	}
+	return pubKeyString[len(pubKeyString)-8:]
+}
+
+// </DASHBOARD>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <JSON-RPC METHODS>
+
+// Each method converts its arguments into an ArtnodeRequest payload with
+// the types the gob protocol expects, and calls the matching Miner method.
+
+func (a *ArtnodeJSON) Hello(_ ArtnodeJSONRequest, nonce *string) error {
+	return a.miner.Hello("", nonce)
+}
+
+func (a *ArtnodeJSON) GetToken(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	if request.InkQuota != 0 || request.OpQuota != 0 {
+		return a.call(a.miner.GetToken, request.Token, response, request.Nonce, request.R, request.S, request.PubKey, request.Delegation, request.InkQuota, request.OpQuota)
+	} else if request.PubKey != "" {
+		return a.call(a.miner.GetToken, request.Token, response, request.Nonce, request.R, request.S, request.PubKey, request.Delegation)
+	}
+	return a.call(a.miner.GetToken, request.Token, response, request.Nonce, request.R, request.S)
+}
+
+func (a *ArtnodeJSON) GetSvgString(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetSvgString, request.Token, response, request.ShapeHash, request.IncludePending)
+}
+
+func (a *ArtnodeJSON) GetSvgStrings(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetSvgStrings, request.Token, response, request.ShapeHashes)
+}
+
+func (a *ArtnodeJSON) GetInk(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetInk, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetGenesisBlock(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetGenesisBlock, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetShapes(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetShapes, request.Token, response, request.BlockHash)
+}
+
+func (a *ArtnodeJSON) GetChildren(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetChildren, request.Token, response, request.BlockHash, request.Depth, request.IncludeMetadata, request.Offset, request.Limit)
+}
+
+func (a *ArtnodeJSON) GetBlocksByOwner(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetBlocksByOwner, request.Token, response, request.Owner, request.FromBlockNo, request.ToBlockNo)
+}
+
+func (a *ArtnodeJSON) AddShape(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.callTraced(a.miner.AddShape, request.Token, request.TraceID, response, request.ValidateNum, request.ShapeType,
+		request.ShapeSvgString, request.Fill, request.Stroke, request.Payer, request.ExpiryBlocks,
+		request.StrokeDasharray, request.StrokeLinecap, request.StrokeLinejoin, request.DependsOn)
+}
+
+func (a *ArtnodeJSON) DeleteShape(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.callTraced(a.miner.DeleteShape, request.Token, request.TraceID, response, request.ShapeHash, request.ValidateNum)
+}
+
+func (a *ArtnodeJSON) AllowInk(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.callTraced(a.miner.AllowInk, request.Token, request.TraceID, response, request.ValidateNum, request.Spender, request.Allowance)
+}
+
+func (a *ArtnodeJSON) SubmitSignedOp(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.callTraced(a.miner.SubmitSignedOp, request.Token, request.TraceID, response, request.EncodedOp, request.OpSig, request.Signer)
+}
+
+func (a *ArtnodeJSON) GetAllowance(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetAllowance, request.Token, response, request.Payer, request.Spender)
+}
+
+func (a *ArtnodeJSON) PinOp(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.PinOp, request.Token, response, request.ShapeHash, request.Pinned)
+}
+
+func (a *ArtnodeJSON) OpValidated(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.OpValidated, request.Token, response, request.ShapeHash)
+}
+
+func (a *ArtnodeJSON) GetOpStatus(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetOpStatus, request.Token, response, request.ShapeHash)
+}
+
+func (a *ArtnodeJSON) GetOpPropagation(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetOpPropagation, request.Token, response, request.ShapeHash)
+}
+
+func (a *ArtnodeJSON) GetFinality(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetFinality, request.Token, response, request.BlockHash)
+}
+
+func (a *ArtnodeJSON) GetPresence(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetPresence, request.Token, response)
+}
+
+func (a *ArtnodeJSON) SetShapeMetadata(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.SetShapeMetadata, request.Token, response, request.ShapeHash, request.MetadataKey, request.MetadataValue)
+}
+
+func (a *ArtnodeJSON) GetShapeMetadata(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetShapeMetadata, request.Token, response, request.ShapeHash)
+}
+
+func (a *ArtnodeJSON) RenderRegionPNG(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.RenderRegionPNG, request.Token, response, request.MinX, request.MinY, request.MaxX, request.MaxY, request.Scale)
+}
+
+func (a *ArtnodeJSON) GetValidateNumRecommendation(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetValidateNumRecommendation, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetValidationEstimate(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetValidationEstimate, request.Token, response, request.ValidateNum)
+}
+
+func (a *ArtnodeJSON) GetSettings(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetSettings, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetSupplyStats(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetSupplyStats, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetQuota(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetQuota, request.Token, response)
+}
+
+func (a *ArtnodeJSON) GetShapeProvenance(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetShapeProvenance, request.Token, response, request.ShapeHash)
+}
+
+func (a *ArtnodeJSON) GetCanvas(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetCanvas, request.Token, response, request.IncludePending)
+}
+
+func (a *ArtnodeJSON) GetCanvasDiff(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetCanvasDiff, request.Token, response, request.BlockHash)
+}
+
+func (a *ArtnodeJSON) WaitForCanvasChange(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.WaitForCanvasChange, request.Token, response, request.BlockHash, request.Timeout)
+}
+
+func (a *ArtnodeJSON) AcquireLock(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.AcquireLock, request.Token, response, request.LockName, request.LockSeconds)
+}
+
+func (a *ArtnodeJSON) ReleaseLock(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.ReleaseLock, request.Token, response, request.LockName)
+}
+
+func (a *ArtnodeJSON) GetLocks(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.GetLocks, request.Token, response)
+}
+
+func (a *ArtnodeJSON) WaitForLockChange(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.WaitForLockChange, request.Token, response, request.LockVersion, request.Timeout)
+}
+
+func (a *ArtnodeJSON) CloseCanvas(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.CloseCanvas, request.Token, response)
+}
+
+func (a *ArtnodeJSON) RevokeToken(request ArtnodeJSONRequest, response *ArtnodeJSONResponse) error {
+	return a.call(a.miner.RevokeToken, request.Token, response, request.TokenHash)
+}
+
+// Calls an artnode RPC method with the given token and payload, and
+// flattens its error into the JSON response.
+func (a *ArtnodeJSON) call(method func(*ArtnodeRequest, *MinerResponse) error, token string, response *ArtnodeJSONResponse, payload ...interface{}) error {
+	return a.callTraced(method, token, "", response, payload...)
+}
+
+// Calls an artnode RPC like call, with the trace ID the client chose for
+// it (if any), and returns the trace ID it was given
+func (a *ArtnodeJSON) callTraced(method func(*ArtnodeRequest, *MinerResponse) error, token string, traceID string, response *ArtnodeJSONResponse, payload ...interface{}) error {
+	minerResponse := new(MinerResponse)
+	if err := method(&ArtnodeRequest{Token: token, Payload: payload, TraceID: traceID}, minerResponse); err != nil {
+		return err
+	}
+
+	response.Payload = minerResponse.Payload
+	response.TraceID = minerResponse.TraceID
+	if minerResponse.Error != nil {
+		response.ErrorCode = errorLib.GetErrorCode(minerResponse.Error)
+		response.ErrorType = errorLib.GetName(response.ErrorCode)
+		response.Error = minerResponse.Error.Error()
+	}
+
+	return nil
+}
+
+// </JSON-RPC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BLOCK STORE>
+
+// Opens (creating if necessary) a block store rooted at dir
+func openBlockStore(dir string) *BlockStore {
+	for _, subdir := range []string{"blocks", "headers", "svgs"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); checkError(err) != nil {
+			logger.Fatalln("Couldn't create data directory", dir)
+		}
+	}
+
+	// Files that were being written when the miner crashed
+	for _, pattern := range []string{"*.tmp", "blocks/*.tmp", "headers/*.tmp", "svgs/*.tmp"} {
+		tmpFiles, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, tmpFile := range tmpFiles {
+			checkError(os.Remove(tmpFile))
+		}
+	}
+	return &BlockStore{dir: dir}
+}
+
+// Writes a file so that a crash leaves either the old file or the new one
+// in its place, never part of one: the data is synced to a temporary file,
+// which then replaces the file, and the directory is synced so that the
+// replacement itself is durable.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Commits the head of the miner's chain. Its block and the miner's pending
+// ops must already be stored.
+func (bs *BlockStore) saveHead(blockHash string) error {
+	encoded, err := json.Marshal(blockHash)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "head.json"), encoded)
+}
+
+// Loads the committed head. A store without one (e.g. one written before
+// heads were committed) has an empty head.
+func (bs *BlockStore) loadHead() (blockHash string, err error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "head.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(encoded, &blockHash)
+	return
+}
+
+func (bs *BlockStore) saveSettings(settings *MinerNetSettings) error {
+	encoded, err := json.Marshal(*settings)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "settings.json"), encoded)
+}
+
+func (bs *BlockStore) loadSettings() (settings *MinerNetSettings, err error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "settings.json"))
+	if err != nil {
+		return
+	}
+	settings = new(MinerNetSettings)
+	err = json.Unmarshal(encoded, settings)
+	return
+}
+
+// Stores a block, unless its body has already been pruned
+func (bs *BlockStore) saveBlock(blockHash string, block *Block) error {
+	if _, err := os.Stat(filepath.Join(bs.dir, "headers", blockHash+".json")); err == nil {
+		return nil
+	}
+	stored := *block
+	records, err := bs.storeSvgs(block.Records)
+	if err != nil {
+		return err
+	}
+	stored.Records = records
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "blocks", blockHash+".json"), encoded)
+}
+
+// Loads a single stored block, checking that it still hashes to the name it
+// was stored under. Returns a PrunedError if only its header is left.
+func (bs *BlockStore) loadBlock(blockHash string) (*Block, error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "blocks", blockHash+".json"))
+	if os.IsNotExist(err) {
+		if _, headerErr := os.Stat(filepath.Join(bs.dir, "headers", blockHash+".json")); headerErr == nil {
+			return nil, errorLib.PrunedError(blockHash)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	block := new(Block)
+	if err = json.Unmarshal(encoded, block); err != nil {
+		return nil, err
+	}
+	if err = bs.loadSvgs(block.Records, make(map[string]string)); err != nil {
+		return nil, err
+	}
+	if hashBlock(block) != blockHash {
+		return nil, errorLib.InvalidBlockHashError(blockHash)
+	}
+	return block, nil
+}
+
+func (bs *BlockStore) saveBans(bans []PeerBan) error {
+	encoded, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "bans.json"), encoded)
+}
+
+// Loads the stored peer bans. A store without any has none.
+func (bs *BlockStore) loadBans() (bans []PeerBan, err error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "bans.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(encoded, &bans)
+	return
+}
+
+func (bs *BlockStore) saveOps(ops []StoredOp) error {
+	ops, err := bs.storeOpSvgs(ops)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "ops.json"), encoded)
+}
+
+// Loads the stored ops. A store without any (e.g. one written before ops
+// were stored) has none.
+func (bs *BlockStore) loadOps() (ops []StoredOp, err error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "ops.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(encoded, &ops); err != nil {
+		return
+	}
+	err = bs.loadOpSvgs(ops, make(map[string]string))
+	return
+}
+
+// Loads every stored block, checking that each one still hashes to the
+// name it was stored under.
+func (bs *BlockStore) loadBlocks() (blocks map[string]*Block, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(bs.dir, "blocks"))
+	if err != nil {
+		return
+	}
+
+	blocks = make(map[string]*Block)
+	svgs := make(map[string]string)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		blockHash := strings.TrimSuffix(file.Name(), ".json")
+		encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "blocks", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		block := new(Block)
+		if err = json.Unmarshal(encoded, block); err != nil {
+			return nil, err
+		}
+		if err = bs.loadSvgs(block.Records, svgs); err != nil {
+			return nil, err
+		}
+		if hashBlock(block) != blockHash {
+			return nil, errorLib.InvalidBlockHashError(blockHash)
+		}
+		blocks[blockHash] = block
+	}
+
+	return
+}
+
+// Stores the header of a block whose body is being pruned, i.e. the block
+// without its records
+func (bs *BlockStore) saveHeader(blockHash string, block *Block) error {
+	header := *block
+	header.Records = nil
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "headers", blockHash+".json"), encoded)
+}
+
+// Loads the headers of every pruned block. Headers can't be checked
+// against their hashes, as those cover the pruned records.
+func (bs *BlockStore) loadHeaders() (headers map[string]*Block, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(bs.dir, "headers"))
+	if os.IsNotExist(err) {
+		return make(map[string]*Block), nil
+	} else if err != nil {
+		return
+	}
+
+	headers = make(map[string]*Block)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "headers", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		header := new(Block)
+		if err = json.Unmarshal(encoded, header); err != nil {
+			return nil, err
+		}
+		headers[strings.TrimSuffix(file.Name(), ".json")] = header
+	}
+
+	return
+}
+
+func (bs *BlockStore) saveSnapshot(snapshot *StoreSnapshot) error {
+	stored := *snapshot
+	var err error
+	if stored.ValidatedOps, err = bs.storeOpSvgs(snapshot.ValidatedOps); err != nil {
+		return err
+	}
+	if stored.UnvalidatedOps, err = bs.storeOpSvgs(snapshot.UnvalidatedOps); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bs.dir, "snapshot.json"), encoded)
+}
+
+// Loads the store's snapshot, nil if it has never been pruned
+func (bs *BlockStore) loadSnapshot() (*StoreSnapshot, error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "snapshot.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshot := new(StoreSnapshot)
+	if err = json.Unmarshal(encoded, snapshot); err != nil {
+		return nil, err
+	}
+	svgs := make(map[string]string)
+	if err = bs.loadOpSvgs(snapshot.ValidatedOps, svgs); err != nil {
+		return nil, err
+	}
+	if err = bs.loadOpSvgs(snapshot.UnvalidatedOps, svgs); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Returns a copy of records in which each svg string longer than a
+// reference to it is replaced by one, storing the svg strings that aren't
+// stored yet. The svg strings that already are have their modification
+// time updated, so that sweepSvgs doesn't delete them before the file that
+// refers to them is written.
+func (bs *BlockStore) storeSvgs(records []OperationRecord) ([]OperationRecord, error) {
+	if records == nil {
+		return nil, nil
+	}
+	stored := make([]OperationRecord, len(records))
+	for i, record := range records {
+		stored[i] = record
+		svg := record.Op.Shape.ShapeSvgString
+		hash := sha256.Sum256([]byte(svg))
+		svgHash := hex.EncodeToString(hash[:])
+		if len(svg) <= len(SVG_REF_PREFIX)+len(svgHash) {
+			continue
+		}
+
+		path := filepath.Join(bs.dir, "svgs", svgHash+".svg")
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); os.IsNotExist(err) {
+			err = writeFileAtomic(path, []byte(svg))
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		stored[i].Op.Shape.ShapeSvgString = SVG_REF_PREFIX + svgHash
+	}
+	return stored, nil
+}
+
+// Restores, in place, the svg strings of records that refer to stored
+// ones, checking that each still hashes to its name. svgs holds the svg
+// strings already read by hash, so that records with the same svg string
+// share it.
+func (bs *BlockStore) loadSvgs(records []OperationRecord, svgs map[string]string) error {
+	for i := range records {
+		if err := bs.loadSvg(&records[i].Op.Shape, svgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restores the svg string of a shape, if it refers to a stored one
+func (bs *BlockStore) loadSvg(shape *shapelib.Shape, svgs map[string]string) error {
+	if !strings.HasPrefix(shape.ShapeSvgString, SVG_REF_PREFIX) {
+		return nil
+	}
+	svgHash := strings.TrimPrefix(shape.ShapeSvgString, SVG_REF_PREFIX)
+	svg, read := svgs[svgHash]
+	if !read {
+		encoded, err := ioutil.ReadFile(filepath.Join(bs.dir, "svgs", svgHash+".svg"))
+		if err != nil {
+			return err
+		}
+		if hash := sha256.Sum256(encoded); hex.EncodeToString(hash[:]) != svgHash {
+			return fmt.Errorf("stored svg string %s doesn't match its hash", svgHash)
+		}
+		svg = string(encoded)
+		svgs[svgHash] = svg
+	}
+	shape.ShapeSvgString = svg
+	return nil
+}
+
+// Like storeSvgs, for the records of stored ops
+func (bs *BlockStore) storeOpSvgs(ops []StoredOp) ([]StoredOp, error) {
+	records := make([]OperationRecord, len(ops))
+	for i, op := range ops {
+		records[i] = op.Record
+	}
+	records, err := bs.storeSvgs(records)
+	if err != nil || ops == nil {
+		return nil, err
+	}
+	stored := make([]StoredOp, len(ops))
+	for i, op := range ops {
+		stored[i] = StoredOp{records[i], op.BlockHash}
+	}
+	return stored, nil
+}
+
+// Like loadSvgs, for the records of stored ops
+func (bs *BlockStore) loadOpSvgs(ops []StoredOp, svgs map[string]string) error {
+	for i := range ops {
+		if err := bs.loadSvg(&ops[i].Record.Op.Shape, svgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the stored svg strings that no stored block, op or snapshot
+// refers to anymore and that weren't stored or referred to again since the
+// given time. Returns how many were deleted.
+func (bs *BlockStore) sweepSvgs(since time.Time) (deleted int, err error) {
+	files, _ := filepath.Glob(filepath.Join(bs.dir, "blocks", "*.json"))
+	files = append(files, filepath.Join(bs.dir, "ops.json"), filepath.Join(bs.dir, "snapshot.json"))
+	refs := make(map[string]bool)
+	for _, file := range files {
+		encoded, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		for _, ref := range svgRefPattern.FindAll(encoded, -1) {
+			refs[strings.TrimPrefix(string(ref), SVG_REF_PREFIX)] = true
+		}
+	}
+
+	svgFiles, err := ioutil.ReadDir(filepath.Join(bs.dir, "svgs"))
+	if err != nil {
+		return
+	}
+	for _, file := range svgFiles {
+		svgHash := strings.TrimSuffix(file.Name(), ".svg")
+		if strings.HasSuffix(file.Name(), ".svg") && !refs[svgHash] && file.ModTime().Before(since) {
+			if err = os.Remove(filepath.Join(bs.dir, "svgs", file.Name())); err != nil && !os.IsNotExist(err) {
+				return
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Returns the number of bytes the store's files take up
+func (bs *BlockStore) size() (size int64, err error) {
+	err = filepath.Walk(bs.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// Prunes the store if it takes up more than its quota. Does nothing if it
+// is already being pruned.
+func (bs *BlockStore) pruneIfOverQuota() {
+	if !bs.pruneLock.TryLock() {
+		return
+	}
+	defer bs.pruneLock.Unlock()
+
+	size, err := bs.size()
+	if checkError(err) != nil || size <= bs.quota {
+		return
+	}
+	checkError(bs.prune())
+}
+
+// Prunes the bodies of the stored main chain's blocks, except the newest
+// MIN_UNPRUNED_BLOCKS. The chain is replayed and validated up to the
+// newest block being pruned and the state there saved as the store's
+// snapshot; the pruned blocks are then kept as headers only. Blocks off
+// the main chain that are no newer than the snapshot are deleted.
+func (bs *BlockStore) prune() error {
+	started := time.Now()
+	m, chain, err := loadStoredChain(bs)
+	if err != nil {
+		return err
+	}
+	if len(chain) <= MIN_UNPRUNED_BLOCKS {
+		return nil
+	}
+
+	m.quiet = true
+	pruned := chain[:len(chain)-MIN_UNPRUNED_BLOCKS]
+	if numApplied, err := m.applyChain(getChainBlocks(pruned), false); err != nil {
+		return errorLib.ValidationError(pruned[numApplied].Hash).Wrap(err)
+	}
+
+	snapshot := m.takeSnapshot()
+	if err = bs.saveSnapshot(snapshot); err != nil {
+		return err
+	}
+	for _, exported := range pruned {
+		if err = bs.saveHeader(exported.Hash, &exported.Block); err != nil {
+			return err
+		}
+		if err = os.Remove(filepath.Join(bs.dir, "blocks", exported.Hash+".json")); err != nil {
+			return err
+		}
+	}
+
+	onChain := make(map[string]bool)
+	for _, exported := range chain {
+		onChain[exported.Hash] = true
+	}
+	blocks, err := bs.loadBlocks()
+	if err != nil {
+		return err
+	}
+	for blockHash, block := range blocks {
+		if block.BlockNo <= snapshot.BlockNo && !onChain[blockHash] {
+			if err = os.Remove(filepath.Join(bs.dir, "blocks", blockHash+".json")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = bs.sweepSvgs(started); err != nil {
+		return err
+	}
+	logger.Println("Pruned the bodies of the stored blocks up to block [" + fmt.Sprint(snapshot.BlockNo) + "]")
+	return nil
+}
+
+// Builds an offline miner from a block store, and returns the stored
+// main chain (oldest block first) without validating it: the chain of the
+// committed head, or the longest stored chain if no head was committed.
+// Blocks stored after the head was last committed are ignored. The miner's
+// blockchain only contains the genesis block, or, if the store has been
+// pruned, the pruned blocks with the miner's state restored from the
+// store's snapshot. The chain then starts after the snapshot.
+func loadStoredChain(bs *BlockStore) (m *Miner, chain []ExportedBlock, err error) {
+	settings, err := bs.loadSettings()
+	if err != nil {
+		return
+	}
+	blocks, err := bs.loadBlocks()
+	if err != nil {
+		return
+	}
+	headers, err := bs.loadHeaders()
+	if err != nil {
+		return
+	}
+	snapshot, err := bs.loadSnapshot()
+	if err != nil {
+		return
+	}
+	committedHead, err := bs.loadHead()
+	if err != nil {
+		return
+	}
+
+	m = new(Miner)
+	m.settings = settings
+	m.lock = &sync.RWMutex{}
+	m.blockChildren = make(map[string][]string)
+	m.miners = make(map[string]*rpc.Client)
+	m.peerLatencies = make(map[string]time.Duration)
+	m.initBlockchainCache()
+	if snapshot != nil {
+		if err = m.restoreSnapshot(snapshot, headers, blocks); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Pick the longest chain, breaking ties the same way SendBlock does
+	headHash := m.blockchainHead
+	headNo := m.blockchain[headHash].BlockNo
+	if _, stored := blocks[committedHead]; stored {
+		headHash = committedHead
+	} else if committedHead == "" {
+		for blockHash, block := range blocks {
+			if block.BlockNo > headNo || (block.BlockNo == headNo && blockHash > headHash) {
+				headHash, headNo = blockHash, block.BlockNo
+			}
+		}
+	}
+
+	for currHash := headHash; currHash != m.blockchainHead; {
+		block, exists := blocks[currHash]
+		if _, pruned := headers[currHash]; !exists && pruned {
+			return nil, nil, errorLib.PrunedError(currHash)
+		} else if !exists {
+			return nil, nil, errorLib.InvalidBlockHashError(currHash)
+		}
+		chain = append([]ExportedBlock{ExportedBlock{currHash, *block}}, chain...)
+		currHash = block.PrevHash
+	}
+
+	return
+}
+
+// Restores the state of the chain at a store's snapshot, and inserts the
+// blocks from the snapshot's block back to the genesis block, using their
+// headers where their bodies were pruned. The snapshot's ops are put back
+// into the pruned blocks they were in, so that shapes added before the
+// snapshot can still expire after it.
+func (m *Miner) restoreSnapshot(snapshot *StoreSnapshot, headers map[string]*Block, blocks map[string]*Block) error {
+	records := make(map[string][]OperationRecord)
+	for _, storedOp := range append(snapshot.ValidatedOps, snapshot.UnvalidatedOps...) {
+		records[storedOp.BlockHash] = append(records[storedOp.BlockHash], storedOp.Record)
+	}
+
+	restored := []string{}
+	for currHash := snapshot.BlockHash; currHash != m.settings.GenesisBlockHash; {
+		// A body is only left if pruning stopped before removing it
+		block, exists := blocks[currHash]
+		if header, pruned := headers[currHash]; pruned {
+			block = header
+			block.Records = records[currHash]
+		} else if !exists {
+			return errorLib.InvalidBlockHashError(currHash)
+		}
+		m.blockchain[currHash] = block
+		m.blockChildren[block.PrevHash] = append(m.blockChildren[block.PrevHash], currHash)
+		m.minedBlocks[block.PubKeyString] = append(m.minedBlocks[block.PubKeyString], currHash)
+		restored = append(restored, currHash)
+		currHash = block.PrevHash
+	}
+	for i := len(restored) - 1; i >= 0; i-- {
+		m.recordPosition(restored[i], m.blockchain[restored[i]])
+	}
+	m.blockchainHead = snapshot.BlockHash
+
+	for pubKeyString, ink := range snapshot.InkAccounts {
+		m.inkAccounts[pubKeyString] = ink
+	}
+	for payer, allowances := range snapshot.Allowances {
+		m.allowances[payer] = allowances
+	}
+	for pubKeyString, rotation := range snapshot.RotatedKeys {
+		m.rotatedKeys[pubKeyString] = rotation
+	}
+	var chainOps []OperationRecord
+	for _, storedOp := range snapshot.ValidatedOps {
+		opRecord := storedOp.Record
+		m.validatedOps[opRecord.OpSig] = &opRecord
+		chainOps = append(chainOps, opRecord)
+	}
+	for _, storedOp := range snapshot.UnvalidatedOps {
+		opRecord := storedOp.Record
+		m.unvalidatedOps[opRecord.OpSig] = &opRecord
+		chainOps = append(chainOps, opRecord)
+	}
+	m.occupyCanvas(chainOps)
+	for _, opSig := range snapshot.PrunedOps {
+		m.prunedOps[opSig] = true
+	}
+	m.ledgers[snapshot.BlockHash] = m.getRestoredLedger(restored, chainOps)
+	return nil
+}
+
+// Returns the ledger of a chain restored from a snapshot, given its blocks
+// (newest first) and the ops the snapshot kept. The blocks' summaries give
+// what was minted, spent and refunded for deleted shapes, even where their
+// bodies were pruned. What expired is what was spent on shapes that are
+// neither deleted nor on the canvas, and what it refunded is whatever ink
+// the accounts hold beyond the rest.
+func (m *Miner) getRestoredLedger(restored []string, chainOps []OperationRecord) (ledger InkLedger) {
+	for _, blockHash := range restored {
+		block := m.blockchain[blockHash]
+		if block.OpCount == 0 {
+			ledger.NoOpBlocks++
+			ledger.Minted += uint64(m.settings.InkPerNoOpBlock)
+		} else {
+			ledger.OpBlocks++
+			ledger.Minted += uint64(m.settings.InkPerOpBlock)
+		}
+		ledger.Spent += block.InkDebited
+		ledger.Refunded += block.InkCredited
+	}
+
+	var burned, circulating uint64
+	for _, opRecord := range chainOps {
+		if opRecord.Op.Type == ADD && !opRecord.Op.Deleted && !m.expiredOps[opRecord.OpSig] {
+			burned += uint64(opRecord.Op.InkCost)
+		}
+	}
+	for _, ink := range m.inkAccounts {
+		circulating += uint64(ink)
+	}
+	if unaccounted := ledger.Spent - ledger.Refunded; burned <= unaccounted {
+		ledger.Expired = unaccounted - burned
+	}
+	if issued := ledger.Minted + ledger.Refunded; circulating+ledger.Spent >= issued {
+		ledger.ExpiryRefunded = circulating + ledger.Spent - issued
+	}
+	return
+}
+
+// Returns the state of the chain at the head of the miner's blockchain.
+// Validated ops are only kept if they are shapes still on the canvas, and
+// expired ops not at all, since no later op can refer to them.
+func (m *Miner) takeSnapshot() *StoreSnapshot {
+	snapshot := &StoreSnapshot{
+		BlockHash:   m.blockchainHead,
+		BlockNo:     m.blockchain[m.blockchainHead].BlockNo,
+		InkAccounts: m.inkAccounts,
+		Allowances:  m.allowances,
+		RotatedKeys: m.rotatedKeys}
+
+	opBlockHashes := make(map[string]string)
+	for currHash := m.blockchainHead; currHash != m.settings.GenesisBlockHash; currHash = m.blockchain[currHash].PrevHash {
+		for _, opRecord := range m.blockchain[currHash].Records {
+			opBlockHashes[opRecord.OpSig] = currHash
+		}
+	}
+
+	for opSig, opRecord := range m.validatedOps {
+		if opRecord.Op.Type == ADD && !opRecord.Op.Deleted && !m.expiredOps[opSig] {
+			snapshot.ValidatedOps = append(snapshot.ValidatedOps, StoredOp{*opRecord, opBlockHashes[opSig]})
+		} else {
+			snapshot.PrunedOps = append(snapshot.PrunedOps, opSig)
+		}
+	}
+	for opSig, opRecord := range m.unvalidatedOps {
+		if !m.expiredOps[opSig] {
+			snapshot.UnvalidatedOps = append(snapshot.UnvalidatedOps, StoredOp{*opRecord, opBlockHashes[opSig]})
+		} else {
+			snapshot.PrunedOps = append(snapshot.PrunedOps, opSig)
+		}
+	}
+	for opSig := range m.prunedOps {
+		snapshot.PrunedOps = append(snapshot.PrunedOps, opSig)
+	}
+	return snapshot
+}
+
+// </BLOCK STORE>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BOOTSTRAP>
+
+// Takes a snapshot of the miner's main chain and signs it with the miner's
+// key. Blocks among the newest BOOTSTRAP_RECENT_BLOCKS that the miner only
+// has the header of, because it was itself bootstrapped, are left as
+// headers along with the blocks before them. The miner's lock must be
+// held.
+func (m *Miner) takeBootstrapSnapshot() (bootstrap *BootstrapSnapshot, err error) {
+	snapshot := m.takeSnapshot()
+	// The snapshot shares the miner's maps, which change once the lock is
+	// released
+	inkAccounts := make(map[string]uint32)
+	for pubKeyString, ink := range snapshot.InkAccounts {
+		inkAccounts[pubKeyString] = ink
+	}
+	allowances := make(map[string]map[string]uint32)
+	for payer, spenders := range snapshot.Allowances {
+		allowances[payer] = make(map[string]uint32)
+		for spender, allowance := range spenders {
+			allowances[payer][spender] = allowance
+		}
+	}
+	rotatedKeys := make(map[string]KeyRotation)
+	for pubKeyString, rotation := range snapshot.RotatedKeys {
+		rotatedKeys[pubKeyString] = rotation
+	}
+	snapshot.InkAccounts, snapshot.Allowances, snapshot.RotatedKeys = inkAccounts, allowances, rotatedKeys
+
+	bootstrap = &BootstrapSnapshot{
+		GenesisBlockHash: m.settings.GenesisBlockHash,
+		Snapshot:         *snapshot,
+		Headers:          []ExportedBlock{},
+		Blocks:           []ExportedBlock{},
+		PubKeyString:     m.pubKeyString}
+	chain := m.getMainChain()
+	numHeaders := len(chain) - BOOTSTRAP_RECENT_BLOCKS
+	if numHeaders < 0 {
+		numHeaders = 0
+	}
+	for i := numHeaders; i < len(chain); i++ {
+		if hashBlock(&chain[i].Block) != chain[i].Hash {
+			numHeaders = i + 1
+		}
+	}
+	for i, exported := range chain {
+		if i < numHeaders {
+			exported.Block.Records = nil
+			bootstrap.Headers = append(bootstrap.Headers, exported)
+		} else {
+			bootstrap.Blocks = append(bootstrap.Blocks, exported)
+		}
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, getBootstrapDigest(bootstrap))
+	if err != nil {
+		return nil, err
+	}
+	encodedSig, _ := json.Marshal(Signature{r, s})
+	bootstrap.Sig = string(encodedSig)
+	return bootstrap, nil
+}
+
+// Returns the digest of a bootstrap snapshot that is signed
+func getBootstrapDigest(bootstrap *BootstrapSnapshot) []byte {
+	encoded, _ := json.Marshal([]interface{}{bootstrap.GenesisBlockHash, bootstrap.Snapshot, bootstrap.Headers, bootstrap.Blocks})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
+
+// Reads a bootstrap snapshot from an http(s) URL or a file
+func loadBootstrapSnapshot(location string) (*BootstrapSnapshot, error) {
+	var reader io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: time.Duration(BOOTSTRAP_TIMEOUT) * time.Millisecond}
+		response, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", location, response.Status)
+		}
+		reader = response.Body
+	} else {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	bootstrap := new(BootstrapSnapshot)
+	if err := json.NewDecoder(io.LimitReader(reader, MAX_BOOTSTRAP_BYTES)).Decode(bootstrap); err != nil {
+		return nil, err
+	}
+	return bootstrap, nil
+}
+
+// Checks that a bootstrap snapshot is signed by the trusted key and is of
+// this network's chain: its blocks must link up from the genesis block to
+// the snapshot's block, and the blocks in full must match their hashes
+// and meet the proof of work difficulty. The state itself can't be checked
+// without the ops of the headers, so it is taken on trust. Returns an
+// InvalidSignatureError, an InvalidBlockHashError if the snapshot is of
+// another canvas, or a ValidationError.
+func (m *Miner) verifyBootstrapSnapshot(bootstrap *BootstrapSnapshot, trustedKey string) error {
+	pubKey := parseStringPubKey(trustedKey)
+	sig := new(Signature)
+	if bootstrap.PubKeyString != trustedKey || pubKey == nil ||
+		json.Unmarshal([]byte(bootstrap.Sig), sig) != nil || sig.R == nil || sig.S == nil ||
+		!ecdsa.Verify(pubKey, getBootstrapDigest(bootstrap), sig.R, sig.S) {
+		return errorLib.InvalidSignatureError()
+	} else if bootstrap.GenesisBlockHash != m.settings.GenesisBlockHash {
+		return errorLib.InvalidBlockHashError(bootstrap.GenesisBlockHash)
+	}
+
+	prevHash := m.settings.GenesisBlockHash
+	for i, exported := range append(append([]ExportedBlock{}, bootstrap.Headers...), bootstrap.Blocks...) {
+		block := exported.Block
+		if block.PrevHash != prevHash || block.BlockNo != uint32(i+1) {
+			return errorLib.ValidationError(exported.Hash).Wrap(fmt.Errorf("block doesn't extend the one before it"))
+		} else if i >= len(bootstrap.Headers) &&
+			(hashBlock(&block) != exported.Hash || !m.hashMatchesPOWDifficulty(exported.Hash, len(block.Records))) {
+			return errorLib.ValidationError(exported.Hash).Wrap(fmt.Errorf("block doesn't match its hash"))
+		}
+		prevHash = exported.Hash
+	}
+	if prevHash != bootstrap.Snapshot.BlockHash {
+		return errorLib.ValidationError(bootstrap.Snapshot.BlockHash).Wrap(fmt.Errorf("snapshot isn't of the chain's head"))
+	}
+	return nil
+}
+
+// Starts the miner's chain from a bootstrap snapshot signed by the trusted
+// key, read from an http(s) URL or a file, instead of syncing the whole
+// chain from its peers. The snapshot is saved to the store, if there is
+// one, as if the store had been pruned up to it.
+func (m *Miner) bootstrapFrom(location, trustedKey string) error {
+	bootstrap, err := loadBootstrapSnapshot(location)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err = m.verifyBootstrapSnapshot(bootstrap, trustedKey); err != nil {
+		return err
+	}
+	headers := make(map[string]*Block)
+	for i := range bootstrap.Headers {
+		headers[bootstrap.Headers[i].Hash] = &bootstrap.Headers[i].Block
+	}
+	blocks := make(map[string]*Block)
+	for i := range bootstrap.Blocks {
+		blocks[bootstrap.Blocks[i].Hash] = &bootstrap.Blocks[i].Block
+	}
+
+	m.initBlockchainCache()
+	if err = m.restoreSnapshot(&bootstrap.Snapshot, headers, blocks); err != nil {
+		m.initBlockchainCache()
+		return err
+	}
+
+	if m.store != nil {
+		for blockHash, header := range headers {
+			checkError(m.store.saveHeader(blockHash, header))
+		}
+		for blockHash, block := range blocks {
+			checkError(m.store.saveBlock(blockHash, block))
+		}
+		if checkError(m.store.saveSnapshot(&bootstrap.Snapshot)) == nil {
+			checkError(m.store.saveHead(m.blockchainHead))
+		}
+	}
+	m.updateReadReplica()
+	logger.Println("Bootstrapped from a snapshot of block [" + fmt.Sprint(bootstrap.Snapshot.BlockNo) + "] signed by " + bootstrap.PubKeyString)
+	return nil
+}
+
+// Receives the blocks mined since the bootstrap snapshot from the peers
+func (m *Miner) catchUpAfterBootstrap() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	numReceived := m.catchUpWithPeers()
+	logger.Println("Received", numReceived, "blocks mined since the snapshot")
+	m.storePendingOps()
+	m.updateReadReplica()
+}
+
+// </BOOTSTRAP>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <CANVAS EXPORT>
+
+// Renders the canvas as of a block, or as of the final block if blockHash
+// is "", and signs its manifest (see CanvasManifest). Shapes are drawn in
+// the order they were mined, as art nodes draw them. Returns an
+// InvalidBlockHashError if the block isn't known or no block is final yet.
+func (m *Miner) exportCanvas(blockHash string) (*CanvasExport, error) {
+	if blockHash == "" {
+		blockHash = m.finalBlock
+	}
+	block, exists := m.blockchain[blockHash]
+	if !exists {
+		return nil, errorLib.InvalidBlockHashError(blockHash)
+	}
+
+	manifest := CanvasManifest{
+		GenesisBlockHash: m.settings.GenesisBlockHash,
+		BlockHash:        blockHash,
+		BlockNo:          block.BlockNo,
+		Final:            m.isFinal(blockHash),
+		Shapes:           []ManifestShape{},
+		PubKeyString:     m.pubKeyString}
+	shapes, _ := m.getShapesAt(blockHash)
+	var svg bytes.Buffer
+	svg.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="` + fmt.Sprint(m.settings.CanvasSettings.CanvasXMax) +
+		`" height="` + fmt.Sprint(m.settings.CanvasSettings.CanvasYMax) + `">` + "\n")
+	for _, exported := range m.getChainTo(blockHash) {
+		for _, opRecord := range exported.Block.Records {
+			if shape, onCanvas := shapes[opRecord.OpSig]; onCanvas && opRecord.Op.Type == ADD {
+				manifest.Shapes = append(manifest.Shapes, ManifestShape{opRecord.OpSig, shape.Owner})
+				svg.WriteString(getSvgElement(shape) + "\n")
+			}
+		}
+	}
+	svg.WriteString("</svg>\n")
+	svgHash := sha256.Sum256(svg.Bytes())
+	manifest.SvgHash = hex.EncodeToString(svgHash[:])
+
+	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, getCanvasManifestDigest(&manifest))
+	if err != nil {
+		return nil, err
+	}
+	encodedSig, _ := json.Marshal(Signature{r, s})
+	manifest.Sig = string(encodedSig)
+	return &CanvasExport{svg.String(), manifest}, nil
+}
+
+// Returns the digest of a canvas manifest that is signed
+func getCanvasManifestDigest(manifest *CanvasManifest) []byte {
+	encoded, _ := json.Marshal([]interface{}{manifest.GenesisBlockHash, manifest.BlockHash, manifest.BlockNo, manifest.Final, manifest.Shapes, manifest.SvgHash})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
+
+// Checks that a canvas manifest is signed by its PubKeyString, which must
+// be trustedKey unless that is "", and that the svg is the one it was
+// signed with. Returns an InvalidSignatureError or a ValidationError.
+func verifyCanvasExport(manifest *CanvasManifest, svg []byte, trustedKey string) error {
+	pubKey := parseStringPubKey(manifest.PubKeyString)
+	sig := new(Signature)
+	if (trustedKey != "" && manifest.PubKeyString != trustedKey) || pubKey == nil ||
+		json.Unmarshal([]byte(manifest.Sig), sig) != nil || sig.R == nil || sig.S == nil ||
+		!ecdsa.Verify(pubKey, getCanvasManifestDigest(manifest), sig.R, sig.S) {
+		return errorLib.InvalidSignatureError()
+	}
+	if svgHash := sha256.Sum256(svg); hex.EncodeToString(svgHash[:]) != manifest.SvgHash {
+		return errorLib.ValidationError(manifest.BlockHash).Wrap(fmt.Errorf("svg doesn't match the manifest"))
+	}
+	return nil
+}
+
+// </CANVAS EXPORT>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <GATEWAY>
+
+// Reads the backend miners of a gateway from a JSON file, e.g.
+// [{"Addr": "127.0.0.1:8001", "Delegation": "..."}]
+func loadGatewayBackends(file string) (backends []*GatewayBackend) {
+	data, err := ioutil.ReadFile(file)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+	if checkError(json.Unmarshal(data, &backends)) != nil {
+		os.Exit(1)
+	}
+	if len(backends) == 0 {
+		logger.Fatalln("No backend miners in " + file)
+	}
+	return
+}
+
+// Forwards an artnode write to the backend miners, starting with the next
+// one in turn and moving on to the others while they can't be reached, are
+// observers or fail with one of the given errors. The op is recorded in
+// the art node's session, and inkCost counted against its quota, as if it
+// had been added here. The lock must not
+// be held, since backends send the op back to the gateway before replying.
+func (m *Miner) forwardWrite(method string, inkCost uint32, request *ArtnodeRequest, response *MinerResponse, retryOn ...string) error {
+	m.lock.Lock()
+	session, validToken := m.getSession(request.Token)
+	var callError error
+	if validToken {
+		if callError = m.limitToken(request.Token); callError == nil {
+			callError = session.spendQuota(inkCost)
+		}
+	}
+	m.lock.Unlock()
+	if !validToken {
+		response.Error = errorLib.InvalidTokenError(request.Token)
+		return nil
+	} else if callError != nil {
+		response.Error = callError
+		return nil
+	}
+
+	m.gatewayLock.Lock()
+	first := m.nextBackend
+	m.nextBackend = (m.nextBackend + 1) % len(m.backends)
+	m.gatewayLock.Unlock()
+
+	traceID := getTraceID(request.TraceID)
+	retryOn = append(retryOn, "DisconnectedError", "ObserverError")
+	for i := range m.backends {
+		backend := m.backends[(first+i)%len(m.backends)]
+		*response = *m.callBackend(backend, method, request.Payload, traceID)
+		response.TraceID = traceID
+
+		retry := false
+		for _, errType := range retryOn {
+			retry = retry || errorLib.IsType(response.Error, errType)
+		}
+		if !retry {
+			break
+		}
+		logTrace(traceID, "Backend could not "+method+": "+errorLib.Describe(response.Error))
+	}
+
+	m.lock.Lock()
+	if response.Error != nil {
+		session.refundQuota(inkCost)
+	} else {
+		session.OpSigs = append(session.OpSigs, response.Payload[0].(string))
+		inkLeft, opsLeft := session.getQuotaLeft()
+		response.Payload = []interface{}{response.Payload[0], inkLeft, opsLeft}
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// Returns the ink the shape in an AddShape request costs, as the backend
+// will charge it, or 0 if the shape is invalid (the backend rejects it)
+func (m *Miner) getRequestInkCost(request *ArtnodeRequest) uint32 {
+	shape := shapelib.Shape{
+		ShapeType:      shapelib.ShapeType(request.Payload[1].(int)),
+		ShapeSvgString: request.Payload[2].(string),
+		Fill:           strings.Trim(request.Payload[3].(string), " ")}
+	geo, err := m.getEngine().Parse(shape, m.getShapeRules())
+	if err != nil {
+		return 0
+	}
+	return uint32(m.getEngine().Cost(geo))
+}
+
+// Calls an artnode RPC on a backend miner, opening a new session and
+// trying again once if the connection or session has gone stale. Returns a
+// DisconnectedError if the backend can't be reached. Writes aren't
+// idempotent, so a call is only tried again, here or by forwardWrite on
+// another backend, if the backend can't have acted on it: a call that was
+// sent but got no reply fails with an UnknownError instead.
+func (m *Miner) callBackend(backend *GatewayBackend, method string, payload []interface{}, traceID string) (response *MinerResponse) {
+	for attempt := 0; attempt < 2; attempt++ {
+		response = new(MinerResponse)
+		conn, token, err := m.connectBackend(backend, attempt > 0)
+		if err != nil {
+			response.Error = errorLib.DisconnectedError(backend.Addr).Wrap(err)
+			continue
+		}
+
+		err = callWithTimeout(conn, "Miner."+method, &ArtnodeRequest{Token: token, Payload: payload, TraceID: traceID}, response)
+		if err == rpc.ErrShutdown {
+			// The connection was closed before the call was sent
+			response.Error = errorLib.DisconnectedError(backend.Addr).Wrap(err)
+		} else if err != nil {
+			response.Error = errorLib.New(errorLib.UnknownCode, "no reply from ["+backend.Addr+"] to "+method+", which may still have been applied").Wrap(err)
+			return
+		} else if !errorLib.IsType(response.Error, "InvalidTokenError") {
+			return
+		}
+	}
+
+	if errorLib.IsType(response.Error, "InvalidTokenError") {
+		response.Error = errorLib.DisconnectedError(backend.Addr)
+	}
+	return
+}
+
+// Returns a connection to a backend miner and a session token on it,
+// authenticating with the gateway's key and the backend's delegation if
+// there isn't one yet. With reconnect, any existing connection is dropped.
+func (m *Miner) connectBackend(backend *GatewayBackend, reconnect bool) (conn *rpc.Client, token string, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if reconnect && backend.conn != nil {
+		backend.conn.Close()
+		backend.conn, backend.token = nil, ""
+	}
+	if backend.conn == nil {
+		if backend.conn, err = rpc.Dial("tcp", backend.Addr); err != nil {
+			return
+		}
+	}
+
+	if backend.token == "" {
+		var nonce string
+		if err = callWithTimeout(backend.conn, "Miner.Hello", "", &nonce); err != nil {
+			return
+		}
+		r, s, signErr := ecdsa.Sign(rand.Reader, &m.privKey, []byte(nonce))
+		if err = signErr; err != nil {
+			return
+		}
+
+		request := &ArtnodeRequest{Payload: []interface{}{nonce, r.String(), s.String(), m.pubKeyString, backend.Delegation}}
+		response := new(MinerResponse)
+		if err = callWithTimeout(backend.conn, "Miner.GetToken", request, response); err != nil {
+			return
+		} else if err = response.Error; err != nil {
+			return
+		}
+		backend.token = response.Payload[0].(string)
+	}
+
+	return backend.conn, backend.token, nil
+}
+
+// Calls an RPC, giving up after GATEWAY_TIMEOUT milliseconds
+func callWithTimeout(conn *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := conn.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(time.Duration(GATEWAY_TIMEOUT) * time.Millisecond):
+		return errorLib.New(errorLib.UnknownCode, "no reply to "+method)
+	}
+}
+
+// </GATEWAY>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <OP REJECTION LOG>
+
+func newOpRejectionLog(capacity int) *OpRejectionLog {
+	return &OpRejectionLog{
+		capacity: capacity,
+		reasons:  make(map[string]map[string]string)}
+}
+
+// Adds a rejection reason for an op. Returns false if this miner's
+// rejection of the op was already known.
+func (l *OpRejectionLog) add(opSig, minerAddr, reason string) bool {
+	reasons, exists := l.reasons[opSig]
+	if !exists {
+		if len(l.order) >= l.capacity {
+			delete(l.reasons, l.order[0])
+			l.order = l.order[1:]
+		}
+		reasons = make(map[string]string)
+		l.reasons[opSig] = reasons
+		l.order = append(l.order, opSig)
+	} else if _, known := reasons[minerAddr]; known {
+		return false
+	}
+
+	reasons[minerAddr] = reason
+	return true
+}
+
+// Returns the rejection reasons for an op, keyed by miner address
+func (l *OpRejectionLog) get(opSig string) map[string]string {
+	return l.reasons[opSig]
+}
+
+// Groups rejection reasons into a single human readable line, e.g.
+// "rejected by 3 peers: ShapeOverlapError(<hash>)"
+func summarizeRejections(reasons map[string]string) string {
+	if len(reasons) == 0 {
+		return ""
+	}
+
+	counts := make(map[string]int)
+	for _, reason := range reasons {
+		counts[reason]++
+	}
+	var distinct []string
+	for reason := range counts {
+		distinct = append(distinct, reason)
+	}
+	sort.Strings(distinct)
+
+	var summaries []string
+	for _, reason := range distinct {
+		peers := "peers"
+		if counts[reason] == 1 {
+			peers = "peer"
+		}
+		summaries = append(summaries, fmt.Sprintf("rejected by %d %s: %s", counts[reason], peers, reason))
+	}
+
+	return strings.Join(summaries, "; ")
+}
+
+// </OP REJECTION LOG>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <OP RECEIPT LOG>
+
+func newOpReceiptLog(capacity int) *OpReceiptLog {
+	return &OpReceiptLog{
+		capacity: capacity,
+		receipts: make(map[string]map[string]time.Time)}
+}
+
+// Records that a peer holds each of the ops at the given time
+func (l *OpReceiptLog) add(minerAddr string, opSigs []string, at time.Time) {
+	for _, opSig := range opSigs {
+		receipts, exists := l.receipts[opSig]
+		if !exists {
+			if len(l.order) >= l.capacity {
+				delete(l.receipts, l.order[0])
+				l.order = l.order[1:]
+			}
+			receipts = make(map[string]time.Time)
+			l.receipts[opSig] = receipts
+			l.order = append(l.order, opSig)
+		}
+		receipts[minerAddr] = at
+	}
+}
+
+// Returns when each peer known to hold an op last acknowledged it, keyed
+// by address
+func (l *OpReceiptLog) get(opSig string) map[string]time.Time {
+	return l.receipts[opSig]
+}
+
+// </OP RECEIPT LOG>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <TRACE LOG>
+
+func newTraceLog(capacity int) *TraceLog {
+	return &TraceLog{
+		capacity: capacity,
+		ids:      make(map[string]string)}
+}
+
+// Records the trace ID of an op or block, unless it already has one or the
+// trace ID is empty, evicting the oldest entry when the log is full
+func (l *TraceLog) add(key, traceID string) {
+	if l == nil || traceID == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, known := l.ids[key]; known {
+		return
+	}
+	if len(l.order) >= l.capacity {
+		delete(l.ids, l.order[0])
+		l.order = l.order[1:]
+	}
+	l.ids[key] = traceID
+	l.order = append(l.order, key)
+}
+
+// Returns the trace ID of an op or block, "" if it isn't known
+func (l *TraceLog) get(key string) string {
+	if l == nil {
+		return ""
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.ids[key]
+}
+
+// Returns a new random trace ID
+func newTraceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Returns the trace ID a request came with, or a new one if it came
+// without one or with one that isn't at most MAX_TRACE_ID_LENGTH letters,
+// digits, '-' and '_'
+func getTraceID(traceID string) string {
+	if traceID == "" || len(traceID) > MAX_TRACE_ID_LENGTH {
+		return newTraceID()
+	}
+	for _, c := range traceID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return newTraceID()
+		}
+	}
+	return traceID
+}
+
+// Returns the trace IDs of the ops in a reply to GetOps, one per op. They
+// are "" if the replying miner didn't send them.
+func getOpsTraceIDs(response *MinerResponse) []string {
+	ops := response.Payload[0].([]OperationRecord)
+	if len(response.Payload) > 1 {
+		if traceIDs := response.Payload[1].([]string); len(traceIDs) == len(ops) {
+			return traceIDs
+		}
+	}
+	return make([]string, len(ops))
+}
+
+// Logs a line about an op or block, prefixed with its trace ID if it has one
+func logTrace(traceID string, v ...interface{}) {
+	if traceID != "" {
+		v = append([]interface{}{"[trace " + traceID + "]"}, v...)
+	}
+	logger.Println(v...)
+}
+
+// </TRACE LOG>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <GOSSIP REPLAY GUARD>
+
+func newGossipReplayGuard(registry *MinerRegistry) *GossipReplayGuard {
+	return &GossipReplayGuard{
+		registry: registry,
+		windows:  make(map[string]*gossipWindow),
+		replayed: make(map[string]uint64)}
+}
+
+// Stamps a SendBlock, SendOp or SendOps request, whose payload must be
+// set, with this miner's epoch, the next message number and this miner's
+// key, and signs them (see getGossipDigest). Each request is sealed once,
+// however many peers it is sent to.
+func (m *Miner) sealGossip(request *MinerRequest) {
+	request.Epoch = m.gossipEpoch
+	request.Seq = atomic.AddUint64(&m.gossipSeq, 1)
+	request.PubKeyString = m.pubKeyString
+	source, _ := request.Payload[1].(string)
+	digest := getGossipDigest(source, request.Epoch, request.Seq, getGossipContent(request.Payload[0]))
+	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, digest)
+	if checkError(err) == nil {
+		encodedSig, _ := json.Marshal(Signature{r, s})
+		request.EnvelopeSig = string(encodedSig)
+	}
+}
+
+// Returns the digest a gossip envelope is signed over: the SHA-256 hash of
+// the JSON array [source, epoch, seq, content]
+func getGossipDigest(source string, epoch int64, seq uint64, content string) []byte {
+	encoded, _ := json.Marshal([]interface{}{source, epoch, seq, content})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
+
+// Returns what of a gossip message's payload its envelope is signed over:
+// the hash of a block, the signature of an op, or the JSON array of the
+// signatures of a batch of ops
+func getGossipContent(payload interface{}) string {
+	switch content := payload.(type) {
+	case Block:
+		return hashBlock(&content)
+	case OperationRecord:
+		return content.OpSig
+	case []OperationRecord:
+		opSigs := make([]string, len(content))
+		for i, opRec := range content {
+			opSigs[i] = opRec.OpSig
+		}
+		encoded, _ := json.Marshal(opSigs)
+		return string(encoded)
+	}
+	return ""
+}
+
+// Records a message from a peer, whose payload's content is given (see
+// getGossipContent), returning false if it is a replay or isn't sealed by
+// the miner registered for the source address, and should be dropped
+func (g *GossipReplayGuard) accept(source string, request *MinerRequest, content string) bool {
+	if g == nil {
+		return true
+	} else if !g.isSealed(source, request, content) {
+		return false
+	}
+	epoch, seq := request.Epoch, request.Seq
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	window, exists := g.windows[source]
+	if !exists || epoch > window.epoch {
+		// The peer's first message, or its first since it restarted
+		g.windows[source] = &gossipWindow{epoch: epoch, highest: seq, seen: 1}
+		return true
+	}
+
+	age := window.highest - seq
+	if epoch < window.epoch || (seq <= window.highest && (age >= GOSSIP_REPLAY_WINDOW || window.seen&(1<<age) != 0)) {
+		g.replayed[source]++
+		return false
+	}
+
+	if seq > window.highest {
+		if shift := seq - window.highest; shift < GOSSIP_REPLAY_WINDOW {
+			window.seen <<= shift
+		} else {
+			window.seen = 0
+		}
+		window.highest, age = seq, 0
+	}
+	window.seen |= 1 << age
+	return true
+}
+
+// Determines whether a message is numbered, and signed along with its
+// source and content by the key registered with the server for the source
+func (g *GossipReplayGuard) isSealed(source string, request *MinerRequest, content string) bool {
+	if source == "" || request.Seq == 0 {
+		return false
+	}
+	pubKey := parseStringPubKey(request.PubKeyString)
+	sig := new(Signature)
+	if pubKey == nil || json.Unmarshal([]byte(request.EnvelopeSig), sig) != nil || sig.R == nil || sig.S == nil {
+		return false
+	}
+	digest := getGossipDigest(source, request.Epoch, request.Seq, content)
+	return ecdsa.Verify(pubKey, digest, sig.R, sig.S) && g.registry.verify(source, getRegisteredKey(request.PubKeyString))
+}
+
+// Returns how many messages from a peer were dropped as replays
+func (g *GossipReplayGuard) getReplayed(source string) uint64 {
+	if g == nil {
+		return 0
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.replayed[source]
+}
+
+// </GOSSIP REPLAY GUARD>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BLOCK ARRIVALS>
+
+func newBlockArrivals() *BlockArrivals {
+	return &BlockArrivals{
+		inFlight:   make(map[string]*blockArrival),
+		duplicates: make(map[string]uint64)}
+}
+
+// Claims a block that arrived from source for validation. Returns true if
+// no other arrival of the block is queued or being validated, in which
+// case the caller must release it once it has been applied. Otherwise
+// counts a duplicate and returns the arrival to wait on.
+func (a *BlockArrivals) claim(blockHash, source string) (arrival *blockArrival, first bool) {
+	if a == nil {
+		return nil, true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if arrival, exists := a.inFlight[blockHash]; exists {
+		a.duplicates[source]++
+		return arrival, false
+	}
+	a.inFlight[blockHash] = &blockArrival{done: make(chan struct{})}
+	return nil, true
+}
+
+// Releases a claimed block, handing its outcome to the duplicates waiting
+// on it
+func (a *BlockArrivals) release(blockHash string, err error) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if arrival, exists := a.inFlight[blockHash]; exists {
+		arrival.err = err
+		close(arrival.done)
+		delete(a.inFlight, blockHash)
+	}
+}
+
+// Counts a block from source that was dropped as already known
+func (a *BlockArrivals) countDuplicate(source string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.duplicates[source]++
+}
+
+// Returns how many blocks from a peer were dropped as duplicates
+func (a *BlockArrivals) getDuplicates(source string) uint64 {
+	if a == nil {
+		return 0
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.duplicates[source]
+}
+
+// </BLOCK ARRIVALS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ADVISORY LOCKS>
+
+func newAdvisoryLocks() *AdvisoryLocks {
+	return &AdvisoryLocks{locks: make(map[string]*AdvisoryLock)}
+}
+
+// Acquires the lock on a name for the session of a token, or renews it if
+// the session already holds it, until seconds from now. Returns a
+// LockHeldError if another session holds it, or a LockLimitError if the
+// name is empty or too long, or the session holds too many locks.
+func (l *AdvisoryLocks) acquire(name, token, pubKeyString string, seconds uint32, now time.Time) (lock AdvisoryLock, err error) {
+	if len(name) == 0 || len(name) > MAX_LOCK_NAME_LENGTH {
+		return lock, errorLib.LockLimitError(fmt.Sprintf("name of %d bytes", len(name)))
+	}
+	if seconds == 0 {
+		seconds = DEFAULT_LOCK_SECONDS
+	} else if seconds > MAX_LOCK_SECONDS {
+		seconds = MAX_LOCK_SECONDS
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.prune(now)
+	if held, exists := l.locks[name]; exists && held.Token != token {
+		return lock, errorLib.LockHeldError(name)
+	} else if !exists && len(l.getSessionLocks(token)) >= MAX_SESSION_LOCKS {
+		return lock, errorLib.LockLimitError(fmt.Sprintf("%d locks", MAX_SESSION_LOCKS))
+	}
+
+	l.locks[name] = &AdvisoryLock{
+		Name:         name,
+		Token:        token,
+		PubKeyString: pubKeyString,
+		Expires:      now.Add(time.Duration(seconds) * time.Second)}
+	l.version++
+	return *l.locks[name], nil
+}
+
+// Releases the lock on a name held by the session of a token. Releasing a
+// lock nobody holds does nothing; returns a LockHeldError if another
+// session holds it.
+func (l *AdvisoryLocks) release(name, token string, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.prune(now)
+	held, exists := l.locks[name]
+	if !exists {
+		return nil
+	} else if held.Token != token {
+		return errorLib.LockHeldError(name)
+	}
+	delete(l.locks, name)
+	l.version++
+	return nil
+}
+
+// Releases every lock held by the session of a token, once it ends
+func (l *AdvisoryLocks) releaseSession(token string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, name := range l.getSessionLocks(token) {
+		delete(l.locks, name)
+		l.version++
+	}
+}
+
+// Returns the locks that are held, sorted by name, and the version they
+// are as of
+func (l *AdvisoryLocks) getLocks(now time.Time) (locks []AdvisoryLock, version uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.prune(now)
+	locks = make([]AdvisoryLock, 0, len(l.locks))
+	for _, lock := range l.locks {
+		locks = append(locks, *lock)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Name < locks[j].Name
+	})
+	return locks, l.version
+}
+
+// Returns the version of the locks, first dropping those that expired
+func (l *AdvisoryLocks) getVersion(now time.Time) uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.prune(now)
+	return l.version
+}
+
+// Drops the locks that expired. The locks' lock must be held.
+func (l *AdvisoryLocks) prune(now time.Time) {
+	for name, lock := range l.locks {
+		if !now.Before(lock.Expires) {
+			delete(l.locks, name)
+			l.version++
+		}
+	}
+}
+
+// Returns the names of the locks held by the session of a token. The
+// locks' lock must be held.
+func (l *AdvisoryLocks) getSessionLocks(token string) (names []string) {
+	for name, lock := range l.locks {
+		if lock.Token == token {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// </ADVISORY LOCKS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PEER BANS>
+
+func newPeerBans() *PeerBans {
+	return &PeerBans{bans: make(map[string]time.Time)}
+}
+
+// Bans a peer until the given time, or for good if it is zero
+func (b *PeerBans) ban(minerAddr string, until time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.bans[minerAddr] = until
+}
+
+// Lifts the ban on a peer. Returns whether it was banned.
+func (b *PeerBans) unban(minerAddr string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, banned := b.bans[minerAddr]
+	delete(b.bans, minerAddr)
+	return banned
+}
+
+// Returns whether a peer is banned at the given time, forgetting its ban
+// if it has ended
+func (b *PeerBans) isBanned(minerAddr string, now time.Time) bool {
+	if b == nil || minerAddr == "" {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	until, banned := b.bans[minerAddr]
+	if banned && !until.IsZero() && !now.Before(until) {
+		delete(b.bans, minerAddr)
+		return false
+	}
+	return banned
+}
+
+// Returns the bans that haven't ended at the given time, by address
+func (b *PeerBans) getBans(now time.Time) (bans []PeerBan) {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bans = []PeerBan{}
+	for minerAddr, until := range b.bans {
+		if !until.IsZero() && !now.Before(until) {
+			delete(b.bans, minerAddr)
+			continue
+		}
+		bans = append(bans, PeerBan{minerAddr, until})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Address < bans[j].Address
+	})
+	return
+}
+
+// Restores bans loaded from the block store
+func (b *PeerBans) restore(bans []PeerBan) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, ban := range bans {
+		b.bans[ban.Address] = ban.Until
+	}
+}
+
+// Writes the bans that haven't ended to the block store, if the miner has
+// one
+func (m *Miner) storeBans() error {
+	if m.store == nil {
+		return nil
+	}
+	return m.store.saveBans(m.bans.getBans(time.Now()))
+}
+
+// </PEER BANS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RATE LIMITS>
+
+func newTokenRateLimiter(rate float64, burst uint) *TokenRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenRateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// Takes a call from a token's bucket at the given time. Returns how long
+// the token has to wait for its next call if the bucket is empty, and 0
+// otherwise. A token's bucket starts full.
+func (l *TokenRateLimiter) take(token string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket := l.buckets[token]
+	if bucket == nil {
+		bucket = &tokenBucket{calls: l.burst, updated: now}
+		l.buckets[token] = bucket
+	}
+	if now.After(bucket.updated) {
+		bucket.calls = math.Min(l.burst, bucket.calls+now.Sub(bucket.updated).Seconds()*l.rate)
+		bucket.updated = now
+	}
+	if bucket.calls < 1 {
+		return time.Duration(math.Ceil((1-bucket.calls)/l.rate*1000)) * time.Millisecond
+	}
+	bucket.calls--
+	return 0
+}
+
+// Forgets the bucket of a token that was closed, revoked or expired
+func (l *TokenRateLimiter) forget(token string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.buckets, token)
+}
+
+// Counts a call made with a valid token towards its rate limit. Returns a
+// RateLimitedError, with how long to wait, if the token is over it.
+func (m *Miner) limitToken(token string) error {
+	if wait := m.limiter.take(token, time.Now()); wait > 0 {
+		return errorLib.RateLimitedError(wait)
+	}
+	return nil
+}
+
+// </RATE LIMITS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PEER TLS>
+
+// First byte of a TLS handshake record, which no gob stream starts with
+const TLS_HANDSHAKE_RECORD byte = 0x16
+
+func newPeerTLS(cert tls.Certificate, registry *MinerRegistry) *PeerTLS {
+	p := &PeerTLS{cert: &cert, registry: registry}
+	p.config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.getCertificate(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return p.getCertificate(), nil
+		},
+		// Peers are known by their registered keys rather than by a
+		// certificate authority
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.verifyPeer(""),
+	}
+	return p
+}
+
+// Returns the config to dial the miner at minerAddr with, which only
+// accepts the key registered for minerAddr
+func (p *PeerTLS) dialConfig(minerAddr string) *tls.Config {
+	config := p.config.Clone()
+	config.VerifyPeerCertificate = p.verifyPeer(minerAddr)
+	return config
+}
+
+// Returns a self-signed certificate for a miner's key
+func newMinerCertificate(privKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "BlockArt miner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privKey}, nil
+}
+
+// Loads the certificate given with -tls-cert and -tls-key, which must be
+// for the miner's key, or makes a self-signed one if none was given
+func loadPeerCertificate(certFile string, keyFile string, privKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	if certFile == "" {
+		return newMinerCertificate(privKey)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+	if pubKey, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pubKey.Equal(&privKey.PublicKey) {
+		return cert, fmt.Errorf("certificate %s isn't for the miner's key", certFile)
+	}
+	return cert, nil
+}
+
+func (p *PeerTLS) getCertificate() *tls.Certificate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.cert
+}
+
+// Replaces the certificate presented to peers, e.g. after a key rotation
+func (p *PeerTLS) setCertificate(cert tls.Certificate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.cert = &cert
+}
+
+// Returns a check of a peer's certificate that accepts it if it is for the
+// key registered with the server for minerAddr or, for an empty minerAddr
+// (an inbound peer, whose address isn't known), for any registered key
+func (p *PeerTLS) verifyPeer(minerAddr string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		pubKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("peer certificate isn't for a miner key")
+		}
+		key := string(elliptic.Marshal(pubKey.Curve, pubKey.X, pubKey.Y))
+
+		if p.registry.verify(minerAddr, key) {
+			return nil
+		} else if minerAddr == "" {
+			return fmt.Errorf("peer certificate key isn't registered with the server")
+		}
+		return fmt.Errorf("peer certificate key isn't the one registered for %s", minerAddr)
+	}
+}
+
+func (c peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// </PEER TLS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <MINER REGISTRY>
+
+func newMinerRegistry() *MinerRegistry {
+	return &MinerRegistry{keys: make(map[string]string)}
+}
+
+// Sets the server the registered keys are fetched from, and the key this
+// miner is registered with, which it calls the server with
+func (r *MinerRegistry) setServer(server *rpc.Client, pubKey ecdsa.PublicKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// gob only encodes the curve by its parameters
+	pubKey.Curve = pubKey.Curve.Params()
+	r.server, r.pubKey = server, pubKey
+}
+
+// Determines whether the key (as encoded by the server) is registered for
+// minerAddr or, for an empty minerAddr, for any address, fetching the keys
+// from the server again if it doesn't match them
+func (r *MinerRegistry) verify(minerAddr string, key string) bool {
+	if r.isRegistered(minerAddr, key) {
+		return true
+	}
+	r.fetchKeys()
+	return r.isRegistered(minerAddr, key)
+}
+
+func (r *MinerRegistry) isRegistered(minerAddr string, key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if minerAddr != "" {
+		return key != "" && r.keys[minerAddr] == key
+	}
+	for _, registered := range r.keys {
+		if registered == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetches the key registered for each miner address from the server,
+// unless they were fetched less than PEER_KEYS_REFRESH milliseconds ago
+func (r *MinerRegistry) fetchKeys() {
+	r.fetchLock.Lock()
+	defer r.fetchLock.Unlock()
+
+	r.lock.Lock()
+	server, pubKey, fetched := r.server, r.pubKey, r.fetched
+	r.lock.Unlock()
+	if server == nil || time.Since(fetched) < time.Duration(PEER_KEYS_REFRESH)*time.Millisecond {
+		return
+	}
+
+	var keys map[string]string
+	if err := server.Call("RServer.GetMinerKeysByAddress", pubKey, &keys); checkError(err) != nil {
+		return
+	}
+	r.lock.Lock()
+	r.keys, r.fetched = keys, time.Now()
+	r.lock.Unlock()
+}
+
+// </MINER REGISTRY>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIORITY POLICIES>
+
+// Decides which unmined ops a miner takes into its next block first, when
+// they conflict with each other (by overlapping, or by spending the same
+// ink). Only the blocks the miner assembles depend on it: their ops are
+// still put in canonical order, and every miner validates a block the same
+// way whatever its own policy. Policies register themselves with
+// registerPriorityPolicy, e.g. from a file behind a build tag, and are
+// picked with -priority.
+type PriorityPolicy interface {
+	Name() string
+
+	// Determines whether op a is taken before op b. Must be a strict
+	// order, with no two ops equal, so that blocks don't depend on the
+	// order of the mempool.
+	Before(a *OperationRecord, b *OperationRecord) bool
+}
+
+// Takes ops oldest first, in canonical order
+type FIFOPriority struct{}
+
+// Takes the ops that spend the most ink first, oldest first among ops of
+// the same cost, so that when shapes compete for the canvas the miner
+// mines the larger ones. Cheap ops may wait behind a stream of costlier
+// ones until they expire from the mempool.
+type InkCostPriority struct{}
+
+// Priority policies by name
+var priorityPolicies = map[string]PriorityPolicy{"fifo": FIFOPriority{}, "ink-cost": InkCostPriority{}}
+
+func registerPriorityPolicy(policy PriorityPolicy) {
+	priorityPolicies[policy.Name()] = policy
+}
+
+// Returns the priority policy of the given name, and whether there is one
+func getPriorityPolicy(name string) (policy PriorityPolicy, exists bool) {
+	policy, exists = priorityPolicies[name]
+	return
+}
+
+// Returns the names of the priority policies, sorted
+func getPriorityPolicyNames() (names []string) {
+	for name := range priorityPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Returns the policy the miner takes unmined ops into its blocks by, FIFO
+// unless the miner was run with another
+func (m *Miner) getPriorityPolicy() PriorityPolicy {
+	if m.priority == nil {
+		return FIFOPriority{}
+	}
+	return m.priority
+}
+
+func (FIFOPriority) Name() string {
+	return "fifo"
+}
+
+func (FIFOPriority) Before(a *OperationRecord, b *OperationRecord) bool {
+	return isCanonicallyBefore(a, b)
+}
+
+func (InkCostPriority) Name() string {
+	return "ink-cost"
+}
+
+func (InkCostPriority) Before(a *OperationRecord, b *OperationRecord) bool {
+	if a.Op.InkCost != b.Op.InkCost {
+		return a.Op.InkCost > b.Op.InkCost
+	}
+	return isCanonicallyBefore(a, b)
+}
+
+// </PRIORITY POLICIES>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <FORK STATS>
+
+func newForkStats(capacity int) *ForkStats {
+	return &ForkStats{capacity: capacity}
+}
+
+// Records the depth of a blockchain head change
+func (f *ForkStats) add(depth uint32) {
+	if len(f.depths) >= f.capacity {
+		f.depths = f.depths[1:]
+	}
+	f.depths = append(f.depths, depth)
+}
+
+// Returns the deepest recent reorg and the number of recent head changes
+// that were reorgs rather than fast-forwards
+func (f *ForkStats) summarize() (maxDepth uint32, reorgs uint32) {
+	for _, depth := range f.depths {
+		if depth > 0 {
+			reorgs++
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	return
+}
+
+// </FORK STATS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BLOCK INTERVAL STATS>
+
+func newBlockIntervalStats(capacity int) *BlockIntervalStats {
+	return &BlockIntervalStats{capacity: capacity}
+}
+
+// Records that the main chain reached the given height. The first height
+// recorded is only a starting point, since the blocks before it may have
+// been synced all at once.
+func (b *BlockIntervalStats) add(height uint32, now time.Time) {
+	if b.lastTime.IsZero() {
+		b.lastHeight, b.lastTime = height, now
+		return
+	} else if height <= b.lastHeight {
+		return
 	}
 
-	// Construct the part of the old branch up to the block with the same BlockNo
-	// as the new branch head
-	for newBlock.BlockNo < oldBlock.BlockNo {
-		oldBranch = append(oldBranch, oldBlock)
-		oldBlock = m.blockchain[oldBlock.PrevHash]
+	numBlocks := height - b.lastHeight
+	interval := now.Sub(b.lastTime) / time.Duration(numBlocks)
+	if numBlocks > uint32(b.capacity) {
+		numBlocks = uint32(b.capacity)
+	}
+	for i := uint32(0); i < numBlocks; i++ {
+		if len(b.intervals) >= b.capacity {
+			b.intervals = b.intervals[1:]
+		}
+		b.intervals = append(b.intervals, interval)
 	}
+	b.lastHeight, b.lastTime = height, now
+}
 
-	// Construct the rest of the new and old branches at the same time, until
-	// their pointers are equal.
-	for newBlock != oldBlock {
-		newBranch = append(newBranch, newBlock)
-		oldBranch = append(oldBranch, oldBlock)
-		newBlock = m.blockchain[newBlock.PrevHash]
-		oldBlock = m.blockchain[oldBlock.PrevHash]
+// Estimates how long the main chain takes to grow by numBlocks blocks: the
+// mean recent interval times numBlocks, and 1.645 standard deviations of a
+// sum of numBlocks intervals either side of that
+func (b *BlockIntervalStats) estimate(numBlocks uint32) (eta time.Duration, low time.Duration, high time.Duration) {
+	if len(b.intervals) == 0 {
+		return
 	}
 
-	// Move each operation in the old branch back to the unmined group and reverse
-	// ink accounts.
-	for _, block := range oldBranch {
-		for _, opRecord := range block.Records {
-			opRecord.Op.NumRemaining = opRecord.Op.ValidateNum
-			m.unminedOps[opRecord.OpSig] = &opRecord
-			delete(m.unvalidatedOps, opRecord.OpSig)
-			delete(m.validatedOps, opRecord.OpSig)
-			m.reverseOpInk(&opRecord)
+	var mean, variance float64
+	for _, interval := range b.intervals {
+		mean += float64(interval)
+	}
+	mean /= float64(len(b.intervals))
+	for _, interval := range b.intervals {
+		variance += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+	variance /= float64(len(b.intervals))
+
+	spread := 1.645 * math.Sqrt(variance*float64(numBlocks))
+	eta = time.Duration(mean * float64(numBlocks))
+	low = time.Duration(math.Max(0, float64(eta)-spread))
+	high = time.Duration(float64(eta) + spread)
+	return
+}
+
+// </BLOCK INTERVAL STATS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BLOCK QUARANTINE>
+
+func newBlockQuarantine(capacity int) *BlockQuarantine {
+	return &BlockQuarantine{capacity: capacity}
+}
+
+// Quarantines an invalid block with why it failed validation and the peer
+// it came from. Returns false if the block was already quarantined, or the
+// quarantine keeps no blocks.
+func (q *BlockQuarantine) add(block *Block, reason string, source string, received time.Time) bool {
+	if q.capacity <= 0 {
+		return false
+	}
+	blockHash := hashBlock(block)
+	for _, quarantined := range q.blocks {
+		if quarantined.Hash == blockHash {
+			return false
 		}
-		m.reverseBlockInk(block)
 	}
 
-	// Apply the blocks in the new branch. NOTE THE ORDER IN WHICH THIS IS DONE.
-	// Must be oldest -> newest, in order to correctly validate unvalidated ops.
-	// If this is done in the correct order, it will also update the blockchainHead.
-	for i := len(newBranch) - 1; i >= 0; i-- {
-		m.applyBlock(newBranch[i])
+	if len(q.blocks) >= q.capacity {
+		q.blocks = q.blocks[1:]
 	}
+	q.blocks = append(q.blocks, QuarantinedBlock{
+		Hash:     blockHash,
+		Block:    *block,
+		Reason:   reason,
+		Source:   source,
+		Received: received})
+	return true
 }
 
-// Sends block to all connected miners
-// Makes sure that enough miners are connected; if under minimum, it calls for more
-func (m *Miner) disseminateToConnectedMiners(block *Block) error {
-	m.getMiners() // checks all miners, connects to more if needed
+// Returns the quarantined blocks, newest first
+func (q *BlockQuarantine) list() []QuarantinedBlock {
+	blocks := make([]QuarantinedBlock, 0, len(q.blocks))
+	for i := len(q.blocks) - 1; i >= 0; i-- {
+		blocks = append(blocks, q.blocks[i])
+	}
+	return blocks
+}
+
+// </BLOCK QUARANTINE>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <FINALITY>
+
+// Periodically attests to the blocks at least FinalityDepth blocks below the
+// head of this miner's main chain, and sends the attestations to the
+// connected miners, who pass them on. Once the miners of the finality
+// quorum of a block's finality window have attested to a block on the main
+// chain, it is final: the miner refuses to switch to a chain that doesn't
+// contain it.
+func (m *Miner) startAttestations() {
+	for {
+		time.Sleep(time.Duration(ATTESTATION_INTERVAL) * time.Millisecond)
+
+		m.lock.Lock()
+		for _, attestation := range m.attestMainChain() {
+			m.disseminateAttestation(attestation, "")
+		}
+		// Attestations may have arrived before the blocks they attest to
+		for blockHash := range m.attestations {
+			m.updateFinality(blockHash)
+		}
+		m.lock.Unlock()
+	}
+}
+
+// Returns the key a miner is registered with the server under, "" if the
+// public key string isn't a valid key
+func getRegisteredKey(pubKeyString string) string {
+	pubKey := parseStringPubKey(pubKeyString)
+	if pubKey == nil {
+		return ""
+	}
+	return string(elliptic.Marshal(pubKey.Curve, pubKey.X, pubKey.Y))
+}
+
+// Signs attestations of the blocks at least FinalityDepth blocks below the
+// head that this miner hasn't attested to yet, newest first. Stops at the
+// first block it already attested to (after a reorg, the fork point), at
+// the final block, or after MAX_ATTESTATIONS_PER_INTERVAL blocks.
+func (m *Miner) attestMainChain() (attestations []Attestation) {
+	block := m.blockchain[m.blockchainHead]
+	if block.BlockNo <= m.settings.FinalityDepth {
+		return
+	}
+	blockHash := m.getAncestorAt(m.blockchainHead, block.BlockNo-m.settings.FinalityDepth)
+
+	for len(attestations) < MAX_ATTESTATIONS_PER_INTERVAL && blockHash != m.settings.GenesisBlockHash && blockHash != m.finalBlock {
+		if _, attested := m.attestations[blockHash][m.pubKeyString]; attested {
+			break
+		}
+
+		r, sigS, err := ecdsa.Sign(rand.Reader, &m.privKey, getAttestationDigest(blockHash))
+		if checkError(err) != nil {
+			break
+		}
+		encodedSig, _ := json.Marshal(Signature{r, sigS})
+		attestation := Attestation{
+			BlockHash:    blockHash,
+			PubKeyString: m.pubKeyString,
+			Sig:          string(encodedSig)}
+		// Blocks below a block that just became final need no attestation
+		if isNew, err := m.addAttestation(attestation); !isNew || err != nil {
+			break
+		}
+		attestations = append(attestations, attestation)
+
+		blockHash = m.blockchain[blockHash].PrevHash
+	}
+
+	return
+}
+
+// Records an attestation and checks whether it makes its block final.
+// Returns whether it hasn't been seen before, or an InvalidSignatureError
+// if it isn't signed by the key it names.
+func (m *Miner) addAttestation(attestation Attestation) (isNew bool, err error) {
+	if _, exists := m.attestations[attestation.BlockHash][attestation.PubKeyString]; exists {
+		return false, nil
+	}
+
+	pubKey := parseStringPubKey(attestation.PubKeyString)
+	sig := new(Signature)
+	if pubKey == nil || json.Unmarshal([]byte(attestation.Sig), sig) != nil || sig.R == nil || sig.S == nil ||
+		!ecdsa.Verify(pubKey, getAttestationDigest(attestation.BlockHash), sig.R, sig.S) {
+		return false, errorLib.InvalidSignatureError()
+	}
+
+	// Blocks at or below the final block can't become final again
+	if final, exists := m.blockchain[m.finalBlock]; exists {
+		if block, exists := m.blockchain[attestation.BlockHash]; exists && block.BlockNo <= final.BlockNo {
+			return false, nil
+		}
+	}
+
+	if _, exists := m.attestations[attestation.BlockHash]; !exists {
+		m.attestations[attestation.BlockHash] = make(map[string]Attestation)
+	}
+	m.attestations[attestation.BlockHash][attestation.PubKeyString] = attestation
+	m.updateFinality(attestation.BlockHash)
+
+	return true, nil
+}
+
+// Returns the digest of an attestation of a block that is signed. It is
+// prefixed with "attest:" so that it can't be taken for anything else the
+// miner's key signs.
+func getAttestationDigest(blockHash string) []byte {
+	digest := sha256.Sum256([]byte("attest:" + blockHash))
+	return digest[:]
+}
+
+// Sends an attestation to every connected miner but the one it came from
+func (m *Miner) disseminateAttestation(attestation Attestation, source string) {
 	request := new(MinerRequest)
-	request.Payload = make([]interface{}, 1)
-	request.Payload[0] = *block
-	response := new(MinerResponse)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = attestation
+	request.Payload[1] = m.localAddr.String()
 	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if isConnected {
-			go minerCon.Call("Miner.SendBlock", request, response)
-		} else {
-			delete(m.miners, minerAddr)
+		if minerAddr != source && minerCon != nil {
+			go minerCon.Call("Miner.SendAttestation", request, new(MinerResponse))
 		}
 	}
-	return nil
 }
 
-func (m *Miner) validateNewShape(s shapelib.Shape) (inkCost uint32, err error) {
-	canvasSettings := m.settings.CanvasSettings
-	_, geo, err := s.IsValid(canvasSettings.CanvasXMax, canvasSettings.CanvasYMax)
-	if err != nil {
+// Returns how many of the blocks of a block's finality window, i.e. the
+// block and up to FINALITY_WINDOW-1 of its ancestors, each key mined, and
+// the number of blocks in the window
+func (m *Miner) getFinalityWindow(blockHash string) (blocksMined map[string]int, numBlocks int) {
+	blocksMined = make(map[string]int)
+	for block := m.blockchain[blockHash]; block != nil && block.BlockNo > 0 && numBlocks < int(FINALITY_WINDOW); block = m.blockchain[block.PrevHash] {
+		blocksMined[block.PubKeyString]++
+		numBlocks++
+	}
+	return
+}
+
+// Returns the weight of attestations that makes a block final: the quorum
+// share of the blocks of its finality window, rounded up
+func (m *Miner) getFinalityQuorum(blockHash string) int {
+	quorum := m.settings.FinalityQuorum
+	if quorum == 0 {
+		quorum = DEFAULT_FINALITY_QUORUM
+	}
+	_, numBlocks := m.getFinalityWindow(blockHash)
+	return (numBlocks*int(quorum) + 99) / 100
+}
+
+// Returns the weight of the attestations of a block: the number of blocks
+// of its finality window mined by the miners that attested to it
+func (m *Miner) countAttestations(blockHash string) (count int) {
+	blocksMined, _ := m.getFinalityWindow(blockHash)
+	for pubKeyString := range m.attestations[blockHash] {
+		count += blocksMined[pubKeyString]
+	}
+	return
+}
+
+// Makes a block final if it is on the main chain above the final block and
+// the miners of enough of its finality window attested to it. Attestations
+// of the blocks below it are then no longer needed.
+func (m *Miner) updateFinality(blockHash string) {
+	block, exists := m.blockchain[blockHash]
+	if !exists {
 		return
-	} else if inkCost = uint32(geo.GetInkCost()); inkCost > m.inkAccounts[m.pubKeyString] {
-		err = errorLib.InsufficientInkError(m.inkAccounts[m.pubKeyString])
+	} else if quorum := m.getFinalityQuorum(blockHash); quorum == 0 || m.countAttestations(blockHash) < quorum {
 		return
-	} else {
-		// Check against all unmined, unvalidated, and validated operations
-		if overlaps, hash := m.hasOverlappingShape(s, geo); overlaps {
-			err = errorLib.ShapeOverlapError(hash)
-			return
+	}
+	if final, exists := m.blockchain[m.finalBlock]; exists && block.BlockNo <= final.BlockNo {
+		return
+	} else if !m.isOnMainChain(blockHash) {
+		return
+	}
+
+	logTrace(m.traces.get(blockHash), "Block is final. ["+fmt.Sprint(block.BlockNo)+"] ["+blockHash+"]")
+	m.finalBlock = blockHash
+	for attestedHash := range m.attestations {
+		if attested, exists := m.blockchain[attestedHash]; exists && attested.BlockNo < block.BlockNo {
+			delete(m.attestations, attestedHash)
+		}
+	}
+}
+
+// Determines whether a block is an ancestor of the head, or the head
+func (m *Miner) isOnMainChain(blockHash string) bool {
+	block, exists := m.blockchain[blockHash]
+	if !exists {
+		return false
+	}
+	return m.getAncestorAt(m.blockchainHead, block.BlockNo) == blockHash
+}
+
+// Returns the hash of the ancestor of a block (or the block itself) with
+// the given block number, "" if the block is below it
+func (m *Miner) getAncestorAt(blockHash string, blockNo uint32) string {
+	block, exists := m.blockchain[blockHash]
+	for exists && block.BlockNo > blockNo {
+		blockHash = block.PrevHash
+		block, exists = m.blockchain[blockHash]
+	}
+	if !exists || block.BlockNo != blockNo {
+		return ""
+	}
+	return blockHash
+}
+
+// Determines whether a block's chain contains the final block, i.e.
+// whether switching to it wouldn't reorg past the final block
+func (m *Miner) extendsFinalBlock(blockHash string) bool {
+	final, exists := m.blockchain[m.finalBlock]
+	if !exists {
+		return true
+	}
+	return m.getAncestorAt(blockHash, final.BlockNo) == m.finalBlock
+}
+
+// Determines whether a block is final: on the main chain at or below the
+// final block
+func (m *Miner) isFinal(blockHash string) bool {
+	block, exists := m.blockchain[blockHash]
+	if !exists || m.finalBlock == "" {
+		return false
+	}
+	return m.getAncestorAt(m.finalBlock, block.BlockNo) == blockHash
+}
+
+// </FINALITY>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RESOURCE BUDGET>
+
+// The budgeted pools, in the order they are evicted from: state that peers
+// resend or that is only kept for inspection goes first, and other miners'
+// unmined ops last. The chain itself, the canvas geometries and this
+// miner's own ops are needed for consensus, so they are only measured.
+var resourcePools = []ResourcePool{
+	{"peer_queues", (*Miner).getPeerQueuesUsage, (*Miner).evictPeerMempools},
+	{"receipts", (*Miner).getReceiptsUsage, (*Miner).evictReceipts},
+	{"rejections", (*Miner).getRejectionsUsage, (*Miner).evictRejections},
+	{"quarantine", (*Miner).getQuarantineUsage, (*Miner).evictQuarantine},
+	{"metadata", (*Miner).getMetadataUsage, (*Miner).evictMetadata},
+	{"attestations", (*Miner).getAttestationsUsage, (*Miner).evictAttestations},
+	{"failed_ops", (*Miner).getFailedOpsUsage, (*Miner).evictFailedOps},
+	{"unmined_ops", (*Miner).getPeerOpsUsage, (*Miner).evictPeerOps},
+	{"own_ops", (*Miner).getOwnOpsUsage, nil},
+	{"geometries", (*Miner).getGeometriesUsage, nil},
+	{"chain", (*Miner).getChainUsage, nil}}
+
+func newResourceBudget(limit int64) *ResourceBudget {
+	return &ResourceBudget{
+		limit:     limit,
+		usage:     make(map[string]int64),
+		evictions: make(map[string]uint64)}
+}
+
+// Periodically measures the miner's memory use and evicts from its pools
+// while it is over budget
+func (m *Miner) startResourceBudget() {
+	for {
+		time.Sleep(time.Duration(RESOURCE_CHECK_INTERVAL) * time.Millisecond)
+
+		m.lock.Lock()
+		m.enforceResourceBudget()
+		m.lock.Unlock()
+	}
+}
+
+// Measures every pool and, if their total is over the budget, evicts from
+// the pools in order until it isn't or nothing more can be evicted.
+// Returns the bytes freed. The miner's lock must be held.
+func (m *Miner) enforceResourceBudget() (freed int64) {
+	var total int64
+	for _, pool := range resourcePools {
+		m.budget.usage[pool.name] = pool.usage(m)
+		total += m.budget.usage[pool.name]
+	}
+
+	for _, pool := range resourcePools {
+		if m.budget.limit <= 0 || total <= m.budget.limit {
+			break
+		} else if pool.evict == nil {
+			continue
 		}
+		poolFreed, evicted := pool.evict(m, total-m.budget.limit)
+		if evicted > 0 {
+			logger.Println("Over memory budget, evicted " + fmt.Sprint(evicted) + " entries from " + pool.name)
+		}
+		m.budget.usage[pool.name] -= poolFreed
+		m.budget.evictions[pool.name] += uint64(evicted)
+		total -= poolFreed
+		freed += poolFreed
+	}
+	return
+}
+
+// Returns the bytes last measured in each pool, and the total
+func (m *Miner) getResourceUsage() (usage map[string]int64, total int64) {
+	usage = make(map[string]int64)
+	for name, bytes := range m.budget.usage {
+		usage[name] = bytes
+		total += bytes
 	}
 	return
 }
 
-func (m *Miner) hasOverlappingShape(s shapelib.Shape, geo shapelib.ShapeGeometry) (overlaps bool, hash string) {
-	opCollections := []map[string]*OperationRecord{m.unminedOps, m.unvalidatedOps, m.validatedOps, m.tempOps}
+func getOpRecordSize(opRecord *OperationRecord) int64 {
+	op := &opRecord.Op
+	return OP_RECORD_OVERHEAD + int64(len(opRecord.OpSig)+len(opRecord.PubKeyString)+
+		len(op.Shape.ShapeSvgString)+len(op.Shape.Fill)+len(op.Shape.Stroke)+len(op.Ref)+
+		len(op.Artnode)+len(op.Payer)+len(op.Spender)+len(op.NewKey))
+}
 
-	for _, opCollection := range opCollections {
-		for hash, opRecord := range opCollection {
-			_s := opRecord.Op.Shape
-			if _s.Owner == s.Owner {
-				continue
-			} else if _geo, _ := _s.GetGeometry(); _geo.HasOverlap(geo) {
-				return true, hash
-			}
+func getBlockSize(block *Block) int64 {
+	size := BLOCK_OVERHEAD + int64(len(block.PrevHash)+len(block.PubKeyString))
+	for i := range block.Records {
+		size += getOpRecordSize(&block.Records[i])
+	}
+	return size
+}
+
+func getOpsSize(ops map[string]*OperationRecord, pubKeyString string, own bool) (size int64) {
+	for _, opRecord := range ops {
+		if (opRecord.PubKeyString == pubKeyString) == own {
+			size += ENTRY_OVERHEAD + getOpRecordSize(opRecord)
 		}
 	}
+	return
+}
 
-	return false, hash
+func getOpLogEntrySize(opSig string, peers int) int64 {
+	return ENTRY_OVERHEAD + int64(len(opSig)) + int64(peers)*ENTRY_OVERHEAD*2
 }
 
-// Adds a block to the current blocktree, without changing any other
-// miner state, and disseminates the block to connected miners.
-func (m *Miner) addBlock(block *Block) {
-	blockHash := hashBlock(block)
-	m.blockchain[blockHash] = block
-	m.addBlockChild(block)
-	m.disseminateToConnectedMiners(block)
+func getMempoolSummarySize(minerAddr string, summary MempoolSummary) int64 {
+	size := ENTRY_OVERHEAD + int64(len(minerAddr))
+	for _, opSig := range summary.OpSigs {
+		size += int64(len(opSig))
+	}
+	return size
 }
 
-// This method applies a block's operations to the miner.
-// This means that only in THIS function will we change any miner state
-// related to unmined, unvalidated, validated, or failed ops, and ink
-// accounts for all miners.
-//
-// Important: This methods sets the blockchainHead! There should be no
-// need to set the blockchainHead other than in this method, EXCEPT
-// for the genesis block in initBlockchain().
-func (m *Miner) applyBlock(block *Block) {
-	m.applyBlockAndOpInk(block)
-	m.moveUnminedToUnvalidated(block)
-	m.moveUnvalidatedToValidated()
-	m.blockchainHead = hashBlock(block)
+func getShapeMetadataSize(entry *ShapeMetadata) int64 {
+	return ENTRY_OVERHEAD + int64(len(entry.ShapeHash)+len(entry.Key)+len(entry.Value)+len(entry.PubKeyString)+len(entry.Sig))
 }
 
-// Adds a block's hash to its parent's list of child hashes.
-func (m *Miner) addBlockChild(block *Block) {
-	hash := hashBlock(block)
-	if _, exists := m.blockChildren[block.PrevHash]; !exists {
-		m.blockChildren[block.PrevHash] = []string{hash}
-	} else {
-		children := m.blockChildren[block.PrevHash]
-		m.blockChildren[block.PrevHash] = append(children, hash)
+func getQuarantinedBlockSize(quarantined *QuarantinedBlock) int64 {
+	return getBlockSize(&quarantined.Block) + int64(len(quarantined.Hash)+len(quarantined.Reason)+len(quarantined.Source))
+}
+
+func getAttestationsSize(blockHash string, attestations map[string]Attestation) int64 {
+	size := ENTRY_OVERHEAD + int64(len(blockHash))
+	for _, attestation := range attestations {
+		size += ENTRY_OVERHEAD + int64(len(attestation.BlockHash)+len(attestation.PubKeyString)*2+len(attestation.Sig))
 	}
+	return size
 }
 
-// Subtracts or credits ink to the ink accounts of each operation owner
-// within a specified block, as well as ink for the mined block itself.
-//
-// TODO: Use a mutex
-//
-func (m *Miner) applyBlockAndOpInk(block *Block) {
-	// update ink per operation
-	for _, record := range block.Records {
-		m.applyOpInk(&record)
+// Peers' mempool summaries, the ops being pulled from them and the events
+// waiting to be applied
+func (m *Miner) getPeerQueuesUsage() (size int64) {
+	for minerAddr, summary := range m.peerMempools {
+		size += getMempoolSummarySize(minerAddr, summary)
+	}
+	for opSig := range m.pulledOps {
+		size += ENTRY_OVERHEAD + int64(len(opSig))
+	}
+	if m.events != nil {
+		size += int64(len(m.events.inbox)) * (OP_RECORD_OVERHEAD + BLOCK_OVERHEAD)
+	}
+	return
+}
+
+func (m *Miner) getReceiptsUsage() (size int64) {
+	for opSig, receipts := range m.receipts.receipts {
+		size += getOpLogEntrySize(opSig, len(receipts))
 	}
+	return
+}
 
-	// add ink for the newly mined block
-	if _, exists := m.inkAccounts[block.PubKeyString]; !exists {
-		m.inkAccounts[block.PubKeyString] = 0
+func (m *Miner) getRejectionsUsage() (size int64) {
+	for opSig, reasons := range m.rejections.reasons {
+		size += getOpLogEntrySize(opSig, len(reasons))
+		for _, reason := range reasons {
+			size += int64(len(reason))
+		}
 	}
-	if len(block.Records) == 0 {
-		m.inkAccounts[block.PubKeyString] += m.settings.InkPerNoOpBlock
-	} else {
-		m.inkAccounts[block.PubKeyString] += m.settings.InkPerOpBlock
+	return
+}
+
+func (m *Miner) getQuarantineUsage() (size int64) {
+	for i := range m.quarantine.blocks {
+		size += getQuarantinedBlockSize(&m.quarantine.blocks[i])
 	}
+	return
 }
 
-func (m *Miner) applyOpInk(opRecord *OperationRecord) (inkRemaining uint32) {
-	op := opRecord.Op
-	if _, exists := m.inkAccounts[opRecord.PubKeyString]; !exists {
-		m.inkAccounts[opRecord.PubKeyString] = 0
+func (m *Miner) getMetadataUsage() (size int64) {
+	for _, entries := range m.metadata {
+		for _, entry := range entries {
+			size += getShapeMetadataSize(&entry)
+		}
 	}
-	if op.Type == ADD {
-		m.inkAccounts[opRecord.PubKeyString] -= op.InkCost
-	} else {
-		m.inkAccounts[opRecord.PubKeyString] += op.InkCost
+	return
+}
+
+func (m *Miner) getAttestationsUsage() (size int64) {
+	for blockHash, attestations := range m.attestations {
+		size += getAttestationsSize(blockHash, attestations)
 	}
+	return
+}
+
+func (m *Miner) getFailedOpsUsage() int64 {
+	return getOpsSize(m.failedOps, "", false)
+}
+
+// Unmined ops signed by other miners
+func (m *Miner) getPeerOpsUsage() int64 {
+	return getOpsSize(m.unminedOps, m.pubKeyString, false)
+}
 
-	return m.inkAccounts[opRecord.PubKeyString]
+// Unmined ops signed by this miner
+func (m *Miner) getOwnOpsUsage() int64 {
+	return getOpsSize(m.unminedOps, m.pubKeyString, true)
 }
 
-func (m *Miner) reverseOpInk(opRecord *OperationRecord) {
-	op := opRecord.Op
-	if op.Type == ADD {
-		m.inkAccounts[opRecord.PubKeyString] += op.InkCost
-	} else {
-		m.inkAccounts[opRecord.PubKeyString] -= op.InkCost
+// Geometries of the shapes on the canvas, used for overlap checks
+func (m *Miner) getGeometriesUsage() int64 {
+	if m.occupancy == nil {
+		return 0
 	}
+	return int64(m.occupancy.Len()) * GEOMETRY_OVERHEAD
 }
 
-func (m *Miner) reverseBlockInk(block *Block) {
-	if len(block.Records) == 0 {
-		m.inkAccounts[block.PubKeyString] -= m.settings.InkPerNoOpBlock
-	} else {
-		m.inkAccounts[block.PubKeyString] -= m.settings.InkPerOpBlock
+// Blocks, including those off the main chain, and the ops applied from them
+func (m *Miner) getChainUsage() (size int64) {
+	for blockHash, block := range m.blockchain {
+		size += ENTRY_OVERHEAD + int64(len(blockHash)) + getBlockSize(block)
 	}
+	size += getOpsSize(m.unvalidatedOps, "", false) + getOpsSize(m.validatedOps, "", false)
+	return
 }
 
-func (m *Miner) blockSuccessfullyMined(block *Block) bool {
-	blockHash := hashBlock(block)
-	if m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) {
-		err := m.validateBlock(block)
-		if err != nil {
-			return false
+// Drops peers' mempool summaries, which the next ping refreshes
+func (m *Miner) evictPeerMempools(bytes int64) (freed int64, evicted int) {
+	var minerAddrs []string
+	for minerAddr := range m.peerMempools {
+		minerAddrs = append(minerAddrs, minerAddr)
+	}
+	sort.Strings(minerAddrs)
+	for _, minerAddr := range minerAddrs {
+		if freed >= bytes {
+			break
 		}
-		logger.Println("Found a new Block. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
-		m.addBlock(block)
-		m.applyBlock(block)
-		time.Sleep(50 * time.Millisecond)
-		// logger.Println("Current BlockChainMap: ", m.blockchain)
-		return true
-	} else {
-		return false
+		freed += getMempoolSummarySize(minerAddr, m.peerMempools[minerAddr])
+		delete(m.peerMempools, minerAddr)
+		evicted++
 	}
+	return
 }
 
-// Asserts that block hash matches the intended POW difficulty
-func (m *Miner) hashMatchesPOWDifficulty(blockHash string, numRecords int) bool {
-	if numRecords == 0 {
-		return strings.HasSuffix(blockHash, strings.Repeat("0", int(m.settings.PoWDifficultyNoOpBlock)))
-	} else {
-		return strings.HasSuffix(blockHash, strings.Repeat("0", int(m.settings.PoWDifficultyOpBlock)))
+// Drops the receipts of the ops first acknowledged the longest ago
+func (m *Miner) evictReceipts(bytes int64) (freed int64, evicted int) {
+	for freed < bytes && len(m.receipts.order) > 0 {
+		opSig := m.receipts.order[0]
+		freed += getOpLogEntrySize(opSig, len(m.receipts.receipts[opSig]))
+		delete(m.receipts.receipts, opSig)
+		m.receipts.order = m.receipts.order[1:]
+		evicted++
 	}
+	return
 }
 
-// Moves all operations in a newly mined block from the unmined op collection
-// to the unvalidated op collection.
-func (m *Miner) moveUnminedToUnvalidated(block *Block) {
-	for _, opRecord := range block.Records {
-		// previously using &opRecord would not work properly when adding multiple
-		// records into unvalidated. Deep copy ensures the values exist in that map
-		newOpRecord := &OperationRecord{
-			Op:           opRecord.Op,
-			OpSig:        opRecord.OpSig,
-			PubKeyString: opRecord.PubKeyString}
-		m.unvalidatedOps[opRecord.OpSig] = newOpRecord
-		delete(m.unminedOps, opRecord.OpSig)
-		logger.Println("OperationRecord has been placed into a block. [" + opRecord.Op.Shape.ShapeSvgString + "]")
+// Drops the rejections of the ops first rejected the longest ago
+func (m *Miner) evictRejections(bytes int64) (freed int64, evicted int) {
+	for freed < bytes && len(m.rejections.order) > 0 {
+		opSig := m.rejections.order[0]
+		reasons := m.rejections.reasons[opSig]
+		freed += getOpLogEntrySize(opSig, len(reasons))
+		for _, reason := range reasons {
+			freed += int64(len(reason))
+		}
+		delete(m.rejections.reasons, opSig)
+		m.rejections.order = m.rejections.order[1:]
+		evicted++
 	}
+	return
 }
 
-// Decrements the validation num counter for each op in the unvalidated op collection
-// and moves those which have become valid to the validated op collection
-func (m *Miner) moveUnvalidatedToValidated() {
-	for _, opRecord := range m.unvalidatedOps {
-		if opRecord.Op.NumRemaining <= 0 {
-			if opRecord.Op.Type == REMOVE {
-				m.validatedOps[opRecord.Op.Ref].Op.Deleted = true
+// Drops the oldest quarantined blocks
+func (m *Miner) evictQuarantine(bytes int64) (freed int64, evicted int) {
+	for freed < bytes && len(m.quarantine.blocks) > 0 {
+		freed += getQuarantinedBlockSize(&m.quarantine.blocks[0])
+		m.quarantine.blocks = m.quarantine.blocks[1:]
+		evicted++
+	}
+	return
+}
+
+// Drops the metadata of shapes owned by other miners, which is pulled from
+// the peers again when it is next asked for. The metadata of this miner's
+// own shapes is kept, since it may be the only copy.
+func (m *Miner) evictMetadata(bytes int64) (freed int64, evicted int) {
+	var shapeHashes []string
+	for shapeHash, entries := range m.metadata {
+		for _, entry := range entries {
+			if entry.PubKeyString != m.pubKeyString {
+				shapeHashes = append(shapeHashes, shapeHash)
 			}
-			m.validatedOps[opRecord.OpSig] = opRecord
-			delete(m.unvalidatedOps, opRecord.OpSig)
-			logger.Println("OperationRecord has been validated. [" + opRecord.Op.Shape.ShapeSvgString + "]")
-		} else {
-			opRecord.Op.NumRemaining -= 1
-			logger.Println("OperationRecord validateNum decreased. [" + fmt.Sprint(opRecord.Op.NumRemaining) + "] [" + opRecord.Op.Shape.ShapeSvgString + "]")
+			break
 		}
 	}
+	sort.Strings(shapeHashes)
+	for _, shapeHash := range shapeHashes {
+		if freed >= bytes {
+			break
+		}
+		for _, entry := range m.metadata[shapeHash] {
+			freed += getShapeMetadataSize(&entry)
+			evicted++
+		}
+		delete(m.metadata, shapeHash)
+		delete(m.metadataPulls, shapeHash)
+	}
+	return
 }
 
-// Sends block to all connected miners
-// Makes sure that enough miners are connected; if under minimum, it calls for more
-func (m *Miner) disseminateOpToConnectedMiners(opRec *OperationRecord) {
-	m.getMiners() // checks all miners, connects to more if needed
-	request := new(MinerRequest)
-	request.Payload = make([]interface{}, 1)
-	request.Payload[0] = *opRec
-	response := new(MinerResponse)
-	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if isConnected {
-			go minerCon.Call("Miner.SendOp", request, response)
-		} else {
-			delete(m.miners, minerAddr)
+// Drops the attestations of blocks below the final block, lowest first.
+// They can no longer make a block final, since those blocks already are.
+// The final block's own attestations are kept so that GetFinality can
+// still report them.
+func (m *Miner) evictAttestations(bytes int64) (freed int64, evicted int) {
+	var blockHashes []string
+	for blockHash := range m.attestations {
+		if blockHash != m.finalBlock && m.isFinal(blockHash) {
+			blockHashes = append(blockHashes, blockHash)
+		}
+	}
+	sort.Slice(blockHashes, func(i, j int) bool {
+		return m.blockchain[blockHashes[i]].BlockNo < m.blockchain[blockHashes[j]].BlockNo
+	})
+	for _, blockHash := range blockHashes {
+		if freed >= bytes {
+			break
 		}
+		freed += getAttestationsSize(blockHash, m.attestations[blockHash])
+		delete(m.attestations, blockHash)
+		evicted++
 	}
+	return
 }
 
-// </PRIVATE METHODS : MINER>
-////////////////////////////////////////////////////////////////////////////////////////////
-
-//
-
-////////////////////////////////////////////////////////////////////////////////////////////
-// <RPC METHODS>
+// Returns the signatures of the ops, oldest first, leaving out pinned ops
+// and, if pubKeyString isn't empty, the ops it signed
+func (m *Miner) getEvictableOps(ops map[string]*OperationRecord, pubKeyString string) []string {
+	var opSigs []string
+	for opSig, opRecord := range ops {
+		if _, pinned := m.pinnedOps[opSig]; !pinned && (pubKeyString == "" || opRecord.PubKeyString != pubKeyString) {
+			opSigs = append(opSigs, opSig)
+		}
+	}
+	sort.Slice(opSigs, func(i, j int) bool {
+		if ops[opSigs[i]].Op.TimeStamp != ops[opSigs[j]].Op.TimeStamp {
+			return ops[opSigs[i]].Op.TimeStamp < ops[opSigs[j]].Op.TimeStamp
+		}
+		return opSigs[i] < opSigs[j]
+	})
+	return opSigs
+}
 
-func (m *Miner) Hello(_ string, nonce *string) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Periodically expires the unmined ops that have outlived the mempool TTL
+func (m *Miner) startMempoolExpiry() {
+	for {
+		time.Sleep(time.Duration(MEMPOOL_EXPIRY_INTERVAL) * time.Millisecond)
 
-	*nonce = getRand256()
-	m.nonces[*nonce] = true
-	return nil
+		m.lock.Lock()
+		if m.expireStaleOps(time.Now()) > 0 {
+			m.updateReadReplica()
+		}
+		m.lock.Unlock()
+	}
 }
 
-// Once a token is successfully retrieved, that nonce can no longer be used
-//
-func (m *Miner) GetToken(request *ArtnodeRequest, response *MinerResponse) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Determines whether an op was created longer than the mempool TTL ago
+func (m *Miner) isOpStale(opRecord *OperationRecord, now time.Time) bool {
+	return m.mempoolTTL > 0 && opRecord.Op.TimeStamp < now.Add(-m.mempoolTTL).UnixNano()
+}
 
-	nonce := request.Payload[0].(string)
-	r := new(big.Int)
-	s := new(big.Int)
-	r, r_ok := r.SetString(request.Payload[1].(string), 0)
-	s, s_ok := s.SetString(request.Payload[2].(string), 0)
+// Expires the unmined ops that were created longer than the mempool TTL
+// ago and still haven't been mined, except pinned ones, which are retried.
+// An expired op fails with an OpStaleError, which the art node that added
+// it gets when it next asks whether the op was validated (and the miner
+// that sent it, as a rejection), and its shape no longer keeps new shapes
+// from overlapping it. Returns the number of ops expired.
+func (m *Miner) expireStaleOps(now time.Time) (expired int) {
+	for _, opSig := range m.getEvictableOps(m.unminedOps, "") {
+		opRecord := m.unminedOps[opSig]
+		if !m.isOpStale(opRecord, now) {
+			break
+		}
 
-	if !r_ok || !s_ok {
-		response.Error = new(errorLib.InvalidSignatureError)
-		return
+		opRecord.Error = errorLib.OpStaleError(opSig)
+		m.failedOps[opSig] = opRecord
+		m.recordOpRejection(opSig, m.localAddr.String(), errorLib.Describe(opRecord.Error))
+		delete(m.unminedOps, opSig)
+		delete(m.opSources, opSig)
+		expired++
 	}
+	if expired > 0 {
+		m.storePendingOps()
+		m.updateMempoolSummary()
+	}
+	return
+}
 
-	_, validNonce := m.nonces[nonce]
-	validSignature := ecdsa.Verify(&m.pubKey, []byte(nonce), r, s)
-
-	if validNonce && validSignature {
-		delete(m.nonces, nonce)
-		response.Error = nil
-		response.Payload = make([]interface{}, 3)
-		token := getRand256()
-		m.tokens[token] = true
-
-		response.Payload[0] = token
-		response.Payload[1] = m.settings.CanvasSettings.CanvasXMax
-		response.Payload[2] = m.settings.CanvasSettings.CanvasYMax
-	} else {
-		response.Error = new(errorLib.InvalidSignatureError)
+// Drops the oldest failed ops, except pinned ones, which are retried
+func (m *Miner) evictFailedOps(bytes int64) (freed int64, evicted int) {
+	for _, opSig := range m.getEvictableOps(m.failedOps, "") {
+		if freed >= bytes {
+			break
+		}
+		freed += ENTRY_OVERHEAD + getOpRecordSize(m.failedOps[opSig])
+		delete(m.failedOps, opSig)
+		evicted++
 	}
+	return
+}
 
-	return nil
+// Drops the oldest unmined ops signed by other miners. Their signers keep
+// regossiping them, so they come back once there is room again.
+func (m *Miner) evictPeerOps(bytes int64) (freed int64, evicted int) {
+	for _, opSig := range m.getEvictableOps(m.unminedOps, m.pubKeyString) {
+		if freed >= bytes {
+			break
+		}
+		freed += ENTRY_OVERHEAD + getOpRecordSize(m.unminedOps[opSig])
+		delete(m.unminedOps, opSig)
+		delete(m.opSources, opSig)
+		evicted++
+	}
+	if evicted > 0 {
+		m.updateMempoolSummary()
+	}
+	return
 }
 
-// Gets the svg string for the shape identified by a given shape hash (operation
-// signature), if it exists.
-//
-// This only checks for ops in the validated group (because there's no way an art
-// app could get the hash of an unvalidated operation).
-//
-func (m *Miner) GetSvgString(request *ArtnodeRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// </RESOURCE BUDGET>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRESENCE>
+
+// Returns the session of a token, and whether there is one, recording the
+// call as the session's latest activity. The miner's lock must be held.
+func (m *Miner) getSession(token string) (session *ArtnodeSession, exists bool) {
+	session, exists = m.tokens[token]
+	if exists && isExpired(session.Expires, time.Now()) {
+		// Swept by startTokenExpiry
+		return nil, false
 	}
-
-	hash := request.Payload[0].(string)
-	opRecord := m.validatedOps[hash]
-	if opRecord == nil {
-		response.Error = errorLib.InvalidShapeHashError(hash)
-		return nil
+	if exists {
+		m.touchToken(token)
 	}
+	return
+}
 
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
+// Forgets a token and releases its session's advisory locks. The read
+// replica must be updated afterwards.
+func (m *Miner) revokeToken(token string) {
+	delete(m.tokens, token)
+	m.locks.releaseSession(token)
+	m.limiter.forget(token)
+}
 
-	shape := opRecord.Op.Shape
-	if shape.ShapeType == shapelib.CIRCLE {
-		_geo, _ := shape.GetGeometry()
-		geo, _ := _geo.(shapelib.CircleGeometry)
+// Determines whether something that expires at the given time (never if it
+// is zero) has expired at now
+func isExpired(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
 
-		cx := strconv.FormatInt(geo.Center.X, 10)
-		cy := strconv.FormatInt(geo.Center.Y, 10)
-		r := strconv.FormatInt(geo.Radius, 10)
+// Periodically forgets the tokens that have expired and the nonces that
+// were never exchanged for a token in time
+func (m *Miner) startTokenExpiry() {
+	for {
+		time.Sleep(time.Duration(TOKEN_EXPIRY_INTERVAL) * time.Millisecond)
 
-		response.Payload[0] = `<circle cx="` + cx + `" cy="` + cy + `" r="` + r + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"/>`
-	} else {
-		response.Payload[0] = `<path d="` + shape.ShapeSvgString + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"/>`
+		m.lock.Lock()
+		if m.expireTokens(time.Now()) > 0 {
+			m.updateReadReplica()
+		}
+		m.lock.Unlock()
 	}
-
-	return nil
 }
 
-func (m *Miner) SendBlock(request *MinerRequest, response *MinerResponse) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	block := request.Payload[0].(Block)
-	blockHash := hashBlock(&block)
-
-	_, blockExists := m.blockchain[blockHash]
-	_, parentExists := m.blockchain[block.PrevHash]
+// Revokes the tokens that have expired at now and forgets the nonces handed
+// out more than NONCE_TTL seconds before it. Returns the number of tokens
+// revoked.
+func (m *Miner) expireTokens(now time.Time) (expired int) {
+	for token, session := range m.tokens {
+		if isExpired(session.Expires, now) {
+			logger.Println("Token of key ..." + shortenKey(session.PubKeyString) + " expired")
+			m.revokeToken(token)
+			expired++
+		}
+	}
+	for nonce, created := range m.nonces {
+		if now.Sub(created) >= time.Duration(NONCE_TTL)*time.Second {
+			delete(m.nonces, nonce)
+		}
+	}
+	return
+}
 
-	if blockExists || !parentExists {
-		return
+// Determines whether a token is valid as of a read replica, recording the
+// call as the session's latest activity
+func (m *Miner) isReplicaToken(replica *ReadReplica, token string) bool {
+	if expires, exists := replica.tokens[token]; !exists || isExpired(expires, time.Now()) {
+		return false
 	}
+	m.touchToken(token)
+	return true
+}
 
-	oldBlockchainHead := m.blockchainHead
-	m.changeBlockchainHead(oldBlockchainHead, block.PrevHash)
-	err = m.validateBlock(&block)
-	m.changeBlockchainHead(m.blockchainHead, oldBlockchainHead)
+// Records an op submitted with a session's token, and refreshes the read
+// replica so that the token's reads can include it right away. The lock
+// must be held.
+func (m *Miner) addSessionOp(session *ArtnodeSession, opSig string) {
+	session.OpSigs = append(session.OpSigs, opSig)
+	m.updateReadReplica()
+}
 
-	if err == nil {
-		logger.Println("Received new block. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
+// Records that a session made a call now. Reads answered from the replica
+// don't hold the miner's lock, so activity has a lock of its own.
+func (m *Miner) touchToken(token string) {
+	m.activityLock.Lock()
+	if m.tokenActivity == nil {
+		m.tokenActivity = make(map[string]time.Time)
+	}
+	m.tokenActivity[token] = time.Now()
+	m.activityLock.Unlock()
+}
 
-		m.addBlock(&block)
+// Returns a hash that identifies a token without revealing it
+func hashToken(token string) string {
+	hash := md5.Sum([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
 
-		newChainLength := block.BlockNo
-		oldChainLength := m.blockchain[m.blockchainHead].BlockNo
+// Describes what a session may do (see SessionPresence)
+func (m *Miner) getSessionScope(session *ArtnodeSession) string {
+	scope := "delegate"
+	if session.PubKeyString == m.pubKeyString {
+		scope = "miner"
+	}
+	if session.InkQuota != 0 {
+		scope += fmt.Sprintf(" ink<=%d", session.InkQuota)
+	}
+	if session.OpQuota != 0 {
+		scope += fmt.Sprintf(" ops<=%d", session.OpQuota)
+	}
+	return scope
+}
 
-		if newChainLength > oldChainLength || (newChainLength == oldChainLength && blockHash > m.blockchainHead) {
-			logger.Println("Blockchain head changed. Now mining after block [" + fmt.Sprint(newChainLength) + "]")
-			m.applyBlock(&block)
-			m.validateUnminedOps()
-			m.newLongestChain = true
+// Returns the sessions of the miner's tokens, most recently active first,
+// leaving out those that aren't online if onlineOnly is set. Forgets the
+// activity of tokens that were closed or revoked. The miner's lock must be
+// held.
+func (m *Miner) getPresence(onlineOnly bool, now time.Time) []SessionPresence {
+	m.activityLock.Lock()
+	defer m.activityLock.Unlock()
+
+	for token := range m.tokenActivity {
+		if _, exists := m.tokens[token]; !exists {
+			delete(m.tokenActivity, token)
 		}
 	}
 
-	return
+	window := time.Duration(PRESENCE_WINDOW) * time.Millisecond
+	presence := []SessionPresence{}
+	for token, session := range m.tokens {
+		lastActive := m.tokenActivity[token]
+		online := !lastActive.IsZero() && now.Sub(lastActive) <= window
+		if onlineOnly && !online {
+			continue
+		}
+		presence = append(presence, SessionPresence{
+			TokenHash:    hashToken(token),
+			PubKeyString: session.PubKeyString,
+			Scope:        m.getSessionScope(session),
+			NumOps:       session.NumOps,
+			Created:      session.Created,
+			LastActive:   lastActive,
+			Online:       online})
+	}
+	sort.Slice(presence, func(i, j int) bool {
+		if !presence[i].LastActive.Equal(presence[j].LastActive) {
+			return presence[i].LastActive.After(presence[j].LastActive)
+		}
+		return presence[i].TokenHash < presence[j].TokenHash
+	})
+	return presence
 }
 
-func (m *Miner) SendOp(request *MinerRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// </PRESENCE>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	opRec := request.Payload[0].(OperationRecord)
-	logger.Println("Received Op: ", opRec.OpSig)
+////////////////////////////////////////////////////////////////////////////////////////////
+// <WITHHOLDING DETECTION>
 
-	if opRec.Op.Type == ADD {
-		if _, shapeError := m.validateNewShape(opRec.Op.Shape); shapeError != nil {
-			// The shape being added isn't valid
-			return nil
-		}
-	} else {
-		opRecord := m.validatedOps[opRec.Op.Ref]
-		if opRecord == nil || opRecord.PubKeyString != opRec.PubKeyString || opRecord.Op.Deleted {
-			return nil
-		}
+// Returns the withholding statistics of a peer, creating them if needed
+func (m *Miner) getWithholdingStats(minerAddr string) *WithholdingStats {
+	if m.withholding == nil {
+		m.withholding = make(map[string]*WithholdingStats)
 	}
-
-	// If new op, disseminate
-	_, unminedExists := m.unminedOps[opRec.OpSig]
-	_, unvalidExists := m.unvalidatedOps[opRec.OpSig]
-	_, validExists := m.validatedOps[opRec.OpSig]
-	isSigValid := m.validateSignature(opRec)
-
-	if !unminedExists && !unvalidExists && !validExists && isSigValid {
-		m.unminedOps[opRec.OpSig] = &opRec
-		m.disseminateOpToConnectedMiners(&opRec)
+	stats, exists := m.withholding[minerAddr]
+	if !exists {
+		stats = new(WithholdingStats)
+		m.withholding[minerAddr] = stats
 	}
-
-	return nil
+	return stats
 }
 
-// Pings all miners currently listed in the miner map
-// If a connected miner fails to reply, that miner should be removed from the map
-func (m *Miner) PingMiner(payload string, reply *bool) error {
-	*reply = true
-	return nil
+// Returns how many blocks old a block that just arrived is: how far the
+// main chain already reaches at or past its height
+func (m *Miner) getBlockAge(block *Block) uint32 {
+	headHeight := m.positions[m.blockchainHead].Height
+	if headHeight < block.BlockNo {
+		return 0
+	}
+	return headHeight - block.BlockNo + 1
 }
 
-func (m *Miner) GetBlockChainLength(request *MinerRequest, response *MinerResponse) error {
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = int(m.blockchain[m.blockchainHead].BlockNo)
-	return nil
+// Returns the BlockAges bucket of an age
+func getBlockAgeBucket(age uint32) int {
+	switch {
+	case age <= 1:
+		return int(age)
+	case age <= 5:
+		return 2
+	default:
+		return 3
+	}
 }
 
-func (m *Miner) BidirectionalSetup(request *MinerRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	minerAddr := request.Payload[0].(string)
-	minerConn, err := rpc.Dial("tcp", minerAddr)
-	if err != nil {
-		delete(m.miners, minerAddr)
+// Records a valid new block first received from a peer, before it is added
+// to the blocktree. A block that extends the last one the peer announced,
+// soon after it, continues the peer's run of blocks; any other block
+// starts a new run.
+func (m *Miner) recordAnnouncedBlock(source string, blockHash string, block *Block, now time.Time) {
+	if source == "" {
+		return
+	}
+	stats := m.getWithholdingStats(source)
+	age := m.getBlockAge(block)
+	stats.BlocksAnnounced++
+	stats.BlockAges[getBlockAgeBucket(age)]++
+
+	burstInterval := time.Duration(WITHHOLDING_BURST_INTERVAL) * time.Millisecond
+	if stats.runLength > 0 && block.PrevHash == stats.runTip && now.Sub(stats.runLast) <= burstInterval {
+		stats.runLength++
 	} else {
-		m.miners[minerAddr] = minerConn
-		logger.Println("birectional setup complete")
+		stats.runLength, stats.runAge = 1, age
 	}
-	return nil
+	stats.runTip, stats.runLast = blockHash, now
 }
 
-func (m *Miner) GetBlockChain(request *MinerRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	logger.Println("GetBlockChain")
+// Checks, after the last block a peer announced reorged the main chain by
+// forkDepth blocks, whether the peer's run of blocks was a secret chain
+// being released. If so the peer is penalized, and reported as
+// withholding blocks once it has released WITHHOLDING_ALERT_RELEASES
+// chains.
+func (m *Miner) checkRelease(source string, forkDepth uint32) {
+	if source == "" || forkDepth == 0 {
+		return
+	}
+	stats := m.getWithholdingStats(source)
+	if stats.runLength < WITHHOLDING_MIN_RELEASE || stats.runAge < WITHHOLDING_MIN_AGE {
+		return
+	}
 
-	longestChainLength := m.blockchain[m.blockchainHead].BlockNo
-	if longestChainLength == 0 {
-		return nil
+	stats.Releases++
+	stats.BlocksReleased += uint64(stats.runLength)
+	stats.ReorgedBlocks += uint64(forkDepth)
+	if stats.runLength > stats.LongestRelease {
+		stats.LongestRelease = stats.runLength
+	}
+	stats.LastRelease = stats.runLast
+	logger.Println("Peer released a secret chain of " + fmt.Sprint(stats.runLength) + " blocks, abandoning " + fmt.Sprint(forkDepth) + ". [" + source + "]")
+	if stats.Releases == WITHHOLDING_ALERT_RELEASES {
+		logger.Println("ALERT: peer keeps releasing secret chains and may be withholding blocks. [" + source + "]")
 	}
-	longestChain := make([]Block, longestChainLength)
 
-	var currhash = m.blockchainHead
-	for i := 0; i < int(longestChainLength); i++ {
-		longestChain[i] = *m.blockchain[currhash]
-		currhash = m.blockchain[currhash].PrevHash
+	if slot := m.peerSlots[source]; slot != nil {
+		penalty := WITHHOLDING_PENALTY * uint64(stats.runLength)
+		if penalty > slot.score {
+			penalty = slot.score
+		}
+		slot.score -= penalty
 	}
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = longestChain
 
-	return nil
+	// Blocks the peer announces next start a new run
+	stats.runLength = 0
 }
 
-// Get the amount of ink remaining associated with the miners pub/priv key pair
-func (m *Miner) GetInk(request *ArtnodeRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// </WITHHOLDING DETECTION>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+////////////////////////////////////////////////////////////////////////////////////////////
+// <SHAPE METADATA>
+
+// Returns the owner of the shape added by an op this miner knows of,
+// whether or not it is mined yet, and whether there is one
+func (m *Miner) getShapeOwner(shapeHash string) (owner string, exists bool) {
+	for _, ops := range []map[string]*OperationRecord{m.validatedOps, m.unvalidatedOps, m.unminedOps} {
+		if opRecord := ops[shapeHash]; opRecord != nil && opRecord.Op.Type == ADD {
+			return opRecord.Op.Shape.Owner, true
+		}
 	}
-
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = m.inkAccounts[m.pubKeyString]
-
-	return nil
+	return "", false
 }
 
-// Get the hash of the genesis block
-func (m *Miner) GetGenesisBlock(request *ArtnodeRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Returns the digest of a metadata entry that its signature covers. ECDSA
+// only signs as many leading bytes as the curve's order has, so the fields
+// are hashed rather than signed directly.
+func getMetadataDigest(entry *ShapeMetadata) []byte {
+	encoded, _ := json.Marshal([]interface{}{entry.ShapeHash, entry.Key, entry.Value, entry.Version})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+// Signs a metadata entry of a shape owned by this miner, with a version
+// above that of the entry it replaces. Returns an InvalidShapeHashError if
+// the shape isn't known, or a ShapeOwnerError if it isn't this miner's.
+func (m *Miner) signShapeMetadata(shapeHash, key, value string) (entry ShapeMetadata, err error) {
+	if owner, exists := m.getShapeOwner(shapeHash); !exists {
+		return entry, errorLib.InvalidShapeHashError(shapeHash)
+	} else if owner != m.pubKeyString {
+		return entry, errorLib.ShapeOwnerError(shapeHash)
 	}
 
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = m.settings.GenesisBlockHash
+	entry = ShapeMetadata{
+		ShapeHash:    shapeHash,
+		Key:          key,
+		Value:        value,
+		Version:      time.Now().UnixNano(),
+		PubKeyString: m.pubKeyString}
+	if previous, exists := m.metadata[shapeHash][key]; exists && previous.Version >= entry.Version {
+		entry.Version = previous.Version + 1
+	}
 
-	return nil
+	r, sigS, err := ecdsa.Sign(rand.Reader, &m.privKey, getMetadataDigest(&entry))
+	if err != nil {
+		return entry, err
+	}
+	encodedSig, _ := json.Marshal(Signature{r, sigS})
+	entry.Sig = string(encodedSig)
+	return entry, nil
 }
 
-// Gets a list of shape hashes (operation signatures) in a given block.
-//
-func (m *Miner) GetShapes(request *ArtnodeRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Records a metadata entry unless this miner already has the same or a
+// newer version of its key. Returns whether it was recorded, or an error
+// if it is over the size limits, isn't signed by the key it names, or
+// annotates a shape that isn't known or isn't owned by that key.
+func (m *Miner) addShapeMetadata(entry ShapeMetadata) (isNew bool, err error) {
+	if len(entry.Key) == 0 || len(entry.Key) > MAX_METADATA_KEY_LENGTH {
+		return false, errorLib.MetadataTooLargeError(fmt.Sprintf("key of %d bytes", len(entry.Key)))
+	} else if len(entry.Value) > MAX_METADATA_VALUE_LENGTH {
+		return false, errorLib.MetadataTooLargeError(fmt.Sprintf("value of %d bytes", len(entry.Value)))
+	}
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+	if previous, exists := m.metadata[entry.ShapeHash][entry.Key]; exists &&
+		(previous.Version > entry.Version || (previous.Version == entry.Version && previous.Sig >= entry.Sig)) {
+		return false, nil
 	}
 
-	hash := request.Payload[0].(string)
-	block := m.blockchain[hash]
-	if block == nil {
-		response.Error = errorLib.InvalidBlockHashError(hash)
-		return nil
+	pubKey := parseStringPubKey(entry.PubKeyString)
+	sig := new(Signature)
+	if pubKey == nil || json.Unmarshal([]byte(entry.Sig), sig) != nil || sig.R == nil || sig.S == nil ||
+		!ecdsa.Verify(pubKey, getMetadataDigest(&entry), sig.R, sig.S) {
+		return false, errorLib.InvalidSignatureError()
+	}
+	if owner, exists := m.getShapeOwner(entry.ShapeHash); !exists {
+		return false, errorLib.InvalidShapeHashError(entry.ShapeHash)
+	} else if owner != entry.PubKeyString {
+		return false, errorLib.ShapeOwnerError(entry.ShapeHash)
 	}
 
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	shapeHashes := make([]string, len(block.Records))
-	for i, record := range block.Records {
-		shapeHashes[i] = record.OpSig
+	entries := m.metadata[entry.ShapeHash]
+	if entry.Value != "" && entries[entry.Key].Value == "" && len(m.getLiveShapeMetadata(entry.ShapeHash)) >= MAX_METADATA_KEYS {
+		return false, errorLib.MetadataTooLargeError(fmt.Sprintf("%d keys", MAX_METADATA_KEYS))
 	}
-	response.Payload[0] = shapeHashes
 
-	return nil
+	if m.metadata == nil {
+		m.metadata = make(map[string]map[string]ShapeMetadata)
+	}
+	if entries == nil {
+		entries = make(map[string]ShapeMetadata)
+		m.metadata[entry.ShapeHash] = entries
+	}
+	entries[entry.Key] = entry
+	return true, nil
 }
 
-// Get a list of block hashes which are children of a given block
-func (m *Miner) GetChildren(request *ArtnodeRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+// Returns the entries of a shape's metadata that aren't removed, sorted by
+// key
+func (m *Miner) getLiveShapeMetadata(shapeHash string) (entries []ShapeMetadata) {
+	for _, entry := range m.metadata[shapeHash] {
+		if entry.Value != "" {
+			entries = append(entries, entry)
+		}
 	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return
+}
 
-	hash := request.Payload[0].(string)
-	children, exists := m.blockChildren[hash]
-	if !exists {
-		response.Error = errorLib.InvalidBlockHashError(hash)
-		return nil
+// Sends a metadata entry to every connected miner but the one it came from
+func (m *Miner) disseminateShapeMetadata(entry ShapeMetadata, source string) {
+	request := new(MinerRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = entry
+	request.Payload[1] = m.localAddr.String()
+	for minerAddr, minerCon := range m.miners {
+		if minerAddr != source && minerCon != nil {
+			go minerCon.Call("Miner.SendShapeMetadata", request, new(MinerResponse))
+		}
 	}
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = children
+}
 
-	return nil
+// Determines whether a shape's metadata should be pulled from the peers,
+// i.e. whether it wasn't in the last METADATA_PULL_INTERVAL milliseconds,
+// and if so records that it is being pulled now
+func (m *Miner) needsMetadataPull(shapeHash string, now time.Time) bool {
+	if m.metadataPulls == nil {
+		m.metadataPulls = make(map[string]time.Time)
+	}
+	if pulled, exists := m.metadataPulls[shapeHash]; exists && now.Sub(pulled) < time.Duration(METADATA_PULL_INTERVAL)*time.Millisecond {
+		return false
+	}
+	m.metadataPulls[shapeHash] = now
+	return true
 }
 
-func (m *Miner) AddShape(request *ArtnodeRequest, response *MinerResponse) (err error) {
+// Asks every connected miner for a shape's metadata and records the
+// entries that are newer than this miner's. Peers that can't be reached
+// or send invalid entries are skipped: metadata is only kept on a best
+// effort basis. Must be called without the miner's lock.
+func (m *Miner) pullShapeMetadata(shapeHash string) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return
+	peers := make(map[string]*rpc.Client)
+	for minerAddr, minerCon := range m.miners {
+		if minerCon != nil {
+			peers[minerAddr] = minerCon
+		}
 	}
+	m.lock.Unlock()
 
-	validateNum := request.Payload[0].(uint8)
-	shapeType := shapelib.ShapeType(request.Payload[1].(int))
-	shapeSvgString := request.Payload[2].(string)
-	fill := strings.Trim(request.Payload[3].(string), " ")
-	stroke := strings.Trim(request.Payload[4].(string), " ")
-
-	shape := shapelib.Shape{
-		ShapeType:      shapeType,
-		ShapeSvgString: shapeSvgString,
-		Fill:           fill,
-		Stroke:         stroke,
-		Owner:          m.pubKeyString}
+	request := &MinerRequest{Payload: []interface{}{shapeHash}}
+	for _, minerCon := range peers {
+		response := new(MinerResponse)
+		if callWithTimeout(minerCon, "Miner.GetShapeMetadataEntries", request, response) != nil || response.Error != nil {
+			continue
+		}
 
-	inkCost, shapeError := m.validateNewShape(shape)
-	if shapeError != nil {
-		response.Error = shapeError
-		return
+		m.lock.Lock()
+		for _, entry := range response.Payload[0].([]ShapeMetadata) {
+			if entry.ShapeHash == shapeHash {
+				m.addShapeMetadata(entry)
+			}
+		}
+		m.lock.Unlock()
 	}
+}
 
-	op := Operation{
-		Type:         ADD,
-		Shape:        shape,
-		InkCost:      inkCost,
-		ValidateNum:  validateNum,
-		NumRemaining: validateNum,
-		TimeStamp:    time.Now().UnixNano(),
-		Deleted:      false}
-
-	opSig := m.addOperationRecord(&op)
+// </SHAPE METADATA>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = opSig
+////////////////////////////////////////////////////////////////////////////////////////////
+// <BLOCK DOWNLOAD>
+
+// Downloads the longest chain of a peer, oldest block first. Only the
+// headers come from that peer: the bodies of the blocks missing from the
+// blocktree are downloaded in chunks of SYNC_CHUNK_BLOCKS heights, striped
+// over all the given peers whose chains reach the chunk, and each body is
+// checked against the hash of its header. A chunk whose bodies don't match
+// is downloaded from the next of those peers, and a chunk that none of
+// them has ends the chain. Peers that can't send headers send their whole
+// chain instead.
+func (m *Miner) downloadChain(minerAddr string, peers PairList) (chain []*Block, err error) {
+	response := new(MinerResponse)
+	if err = m.timedCall(minerAddr, m.miners[minerAddr], "Miner.GetBlockHeaders", new(MinerRequest), response); err != nil || len(response.Payload) < 2 {
+		return m.downloadWholeChain(minerAddr)
+	}
 
-	return
-}
+	// Headers are only used up to the first one that doesn't extend the
+	// one before it
+	hashes := response.Payload[0].([]string)
+	headers := response.Payload[1].([]Block)
+	prevHash := m.settings.GenesisBlockHash
+	for i := range headers {
+		if i == len(hashes) || headers[i].PrevHash != prevHash || headers[i].BlockNo != uint32(i+1) {
+			headers = headers[:i]
+			break
+		}
+		prevHash = hashes[i]
+	}
 
-func (m *Miner) DeleteShape(request *ArtnodeRequest, response *MinerResponse) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	chain = make([]*Block, len(headers))
+	var missing []int
+	for i := range headers {
+		if block, exists := m.blockchain[hashes[i]]; exists {
+			chain[i] = block
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	var chunks [][]int
+	for len(missing) > 0 {
+		size := SYNC_CHUNK_BLOCKS
+		if size > len(missing) {
+			size = len(missing)
+		}
+		chunks = append(chunks, missing[:size])
+		missing = missing[size:]
+	}
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return nil
+	// Each chunk fills in its own blocks of the chain
+	downloaded := make([]bool, len(chunks))
+	slots := make(chan struct{}, MAX_PARALLEL_BODY_DOWNLOADS)
+	var wg sync.WaitGroup
+	for c, chunk := range chunks {
+		sources := m.getChunkSources(peers, chunk[len(chunk)-1]+1, c)
+		wg.Add(1)
+		go func(c int, chunk []int, sources []*rpc.Client) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			for _, source := range sources {
+				if downloadBodies(source, chunk, hashes, headers, chain) {
+					downloaded[c] = true
+					return
+				}
+			}
+		}(c, chunk, sources)
 	}
+	wg.Wait()
 
-	shapeHash := request.Payload[0].(string)
-	validateNum := request.Payload[1].(uint8)
+	for c, chunk := range chunks {
+		if !downloaded[c] {
+			chain = chain[:chunk[0]]
+			break
+		}
+	}
+	logger.Println("Downloaded the bodies of", len(chunks), "chunks of blocks from", len(peers), "peers, chain has", len(chain), "blocks")
+	return chain, nil
+}
 
-	opRecord := m.validatedOps[shapeHash]
-	if opRecord == nil || opRecord.PubKeyString != m.pubKeyString || opRecord.Op.Deleted {
-		response.Error = errorLib.ShapeOwnerError(shapeHash)
+// Downloads the longest chain of a peer in one response, oldest block first
+func (m *Miner) downloadWholeChain(minerAddr string) (chain []*Block, err error) {
+	response := new(MinerResponse)
+	if err = m.timedCall(minerAddr, m.miners[minerAddr], "Miner.GetBlockChain", new(MinerRequest), response); err != nil || len(response.Payload) == 0 {
 		return
 	}
 
-	delShape := opRecord.Op.Shape
-	inkCost := opRecord.Op.InkCost
-	delShape.Fill, delShape.Stroke = "white", "white"
+	// Newest block first
+	blocks := response.Payload[0].([]Block)
+	chain = make([]*Block, len(blocks))
+	for i := range blocks {
+		chain[len(chain)-1-i] = &blocks[i]
+	}
+	return
+}
 
-	op := Operation{
-		Type:         REMOVE,
-		Shape:        delShape,
-		Ref:          opRecord.OpSig,
-		InkCost:      inkCost,
-		ValidateNum:  validateNum,
-		NumRemaining: validateNum,
-		TimeStamp:    time.Now().UnixNano()}
+// Downloads the blocks of a peer's longest chain that are missing from
+// this miner's main chain, oldest first, SYNC_CHUNK_BLOCKS at a time. They
+// follow the newest block of the main chain that is also on the peer's:
+// the head, or if the peer has switched away from it, the block 1, 2, 4,
+// ... blocks below it, down to the genesis block. Returns the blocks
+// downloaded before an error, e.g. a peer that can't send blocks this way.
+func (m *Miner) downloadBlocksSince(minerAddr string) (chain []*Block, err error) {
+	var blocks []Block
+	var more bool
+	since, headNo := m.blockchainHead, m.blockchain[m.blockchainHead].BlockNo
+	for step := uint32(1); ; step *= 2 {
+		blocks, more, err = m.getBlocksSince(minerAddr, since)
+		if !errorLib.IsType(err, "InvalidBlockHashError") || since == m.settings.GenesisBlockHash {
+			break
+		}
+		since = m.settings.GenesisBlockHash
+		if step < headNo {
+			since = m.getAncestorAt(m.blockchainHead, headNo-step)
+		}
+	}
 
-	opSig := m.addOperationRecord(&op)
+	for err == nil {
+		for i := range blocks {
+			chain = append(chain, &blocks[i])
+		}
+		if !more || len(blocks) == 0 {
+			break
+		}
+		blocks, more, err = m.getBlocksSince(minerAddr, hashBlock(chain[len(chain)-1]))
+	}
+	return
+}
 
-	response.Error = nil
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = opSig
+// Asks a peer for the next SYNC_CHUNK_BLOCKS blocks of its longest chain
+// after the given block, see GetBlocksSince
+func (m *Miner) getBlocksSince(minerAddr string, since string) (blocks []Block, more bool, err error) {
+	request := &MinerRequest{Payload: []interface{}{since, uint32(SYNC_CHUNK_BLOCKS)}}
+	response := new(MinerResponse)
+	if err = m.timedCall(minerAddr, m.miners[minerAddr], "Miner.GetBlocksSince", request, response); err != nil {
+		return
+	} else if response.Error != nil {
+		return nil, false, response.Error
+	}
+	return response.Payload[0].([]Block), response.Payload[1].(bool), nil
+}
 
+// Returns the connections to the peers whose chains are at least as long
+// as a chunk's last height, to download chunk c from in turn. Each chunk
+// starts at a different peer, so that the chunks are spread over them.
+func (m *Miner) getChunkSources(peers PairList, height int, c int) (sources []*rpc.Client) {
+	var eligible []*rpc.Client
+	for _, pair := range peers {
+		if minerCon := m.miners[pair.Key]; minerCon != nil && pair.Value >= height {
+			eligible = append(eligible, minerCon)
+		}
+	}
+	for i := range eligible {
+		sources = append(sources, eligible[(c+i)%len(eligible)])
+	}
 	return
 }
 
-func (m *Miner) OpValidated(request *ArtnodeRequest, response *MinerResponse) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Downloads the bodies of the blocks at the given positions of a chain from
+// a peer, and fills in those blocks of the chain if every body hashes to
+// its block's hash along with its header. Returns whether they matched.
+func downloadBodies(minerCon *rpc.Client, positions []int, hashes []string, headers []Block, chain []*Block) bool {
+	chunkHashes := make([]string, len(positions))
+	for j, i := range positions {
+		chunkHashes[j] = hashes[i]
+	}
+	request := &MinerRequest{Payload: []interface{}{chunkHashes}}
+	response := new(MinerResponse)
+	if callWithTimeout(minerCon, "Miner.GetBlockBodies", request, response) != nil || response.Error != nil || len(response.Payload) == 0 {
+		return false
+	}
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return
+	bodies := response.Payload[0].([][]OperationRecord)
+	if len(bodies) != len(positions) {
+		return false
+	}
+	blocks := make([]*Block, len(positions))
+	for j, i := range positions {
+		block := headers[i]
+		block.Records = bodies[j]
+		if hashBlock(&block) != hashes[i] {
+			return false
+		}
+		blocks[j] = &block
 	}
+	for j, i := range positions {
+		chain[i] = blocks[j]
+	}
+	return true
+}
 
-	opSig := request.Payload[0].(string)
-	validOp := m.validatedOps[opSig]
-	failedOp := m.failedOps[opSig]
+// </BLOCK DOWNLOAD>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	response.Payload = make([]interface{}, 3)
-	response.Payload[0] = false
-	response.Payload[1] = ""
-	response.Payload[2] = uint32(0)
+////////////////////////////////////////////////////////////////////////////////////////////
+// <EVENT BUS>
 
-	if validOp != nil {
-		blockHash, err := m.getOpBlockHash(opSig)
-		if err != nil {
-			response.Error = err
-		} else {
-			response.Payload[0] = true
-			response.Payload[1] = blockHash
-			response.Payload[2] = m.inkAccounts[validOp.PubKeyString]
+func newEventBus(inboxSize int) *EventBus {
+	return &EventBus{
+		inbox:  make(chan *MinerEvent, inboxSize),
+		counts: make(map[EventType]uint64)}
+}
+
+// Queues a received op or block to be applied and waits until it has been.
+// Returns the outcome of applying it. Must not be called while holding the
+// miner's lock, since the applier needs it.
+func (b *EventBus) submit(event *MinerEvent) error {
+	event.done = make(chan error, 1)
+	b.inbox <- event
+	return <-event.done
+}
+
+// Counts an event and sends it to every subscriber, without waiting on
+// subscribers whose buffers are full
+func (b *EventBus) publish(event MinerEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	event.done = nil
+	b.counts[event.Type]++
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
 		}
-	} else if failedOp != nil {
-		response.Error = failedOp.Error
-		delete(m.failedOps, opSig)
-	} else {
-		response.Payload[0] = false
 	}
+}
 
-	return
+// Returns a channel that receives every event published from now on, as
+// long as the subscriber keeps up. The ops and blocks events point to are
+// shared with the miner and must not be modified.
+func (b *EventBus) subscribe() <-chan MinerEvent {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subscriber := make(chan MinerEvent, EVENT_SUBSCRIBER_BUFFER)
+	b.subscribers = append(b.subscribers, subscriber)
+	return subscriber
 }
 
-func (m *Miner) CloseCanvas(request *ArtnodeRequest, response *MinerResponse) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Returns the number of events of each type published so far
+func (b *EventBus) getCounts() (opsReceived, blocksReceived, headChanges uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
-		response.Error = errorLib.InvalidTokenError(token)
-		return
+	return b.counts[OP_RECEIVED], b.counts[BLOCK_RECEIVED], b.counts[HEAD_CHANGED]
+}
+
+// Applies the ops and blocks received by RPC in the order they were
+// submitted. This is the only goroutine that applies them, so the handlers
+// never interleave validation, reorgs and dissemination.
+func (m *Miner) applyEvents() {
+	for event := range m.events.inbox {
+		m.lock.Lock()
+		err := m.applyEvent(event)
+		m.lock.Unlock()
+		event.done <- err
 	}
+}
 
-	delete(m.tokens, token)
-	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = m.inkAccounts[m.pubKeyString]
+// Applies a received op or block to the miner's state, then publishes it,
+// followed by a HEAD_CHANGED event if it changed the head. Returns the
+// outcome of applying it.
+func (m *Miner) applyEvent(event *MinerEvent) error {
+	oldHead := m.blockchainHead
+	switch event.Type {
+	case OP_RECEIVED:
+		m.traces.add(event.Op.OpSig, event.TraceID)
+		event.Err = m.receiveOp(event.Op, event.Source)
+	case BLOCK_RECEIVED:
+		m.traces.add(hashBlock(event.Block), event.TraceID)
+		event.Err = m.receiveBlock(event.Block, event.Source)
+	}
+	m.countReceived(event)
 
-	return
+	m.updateMempoolSummary()
+	m.updateReadReplica()
+	m.events.publish(*event)
+	if m.blockchainHead != oldHead {
+		m.events.publish(MinerEvent{Type: HEAD_CHANGED, OldHead: oldHead, NewHead: m.blockchainHead, TraceID: m.traces.get(m.blockchainHead)})
+	}
+	return event.Err
 }
 
-// </RPC METHODS>
+// </EVENT BUS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 //
@@ -1243,15 +11822,9 @@ func (m *Miner) CloseCanvas(request *ArtnodeRequest, response *MinerResponse) (e
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <HELPER METHODS>
 
-func (m *Miner) addOperationRecord(op *Operation) (opSig string) {
-	encodedOp, err := json.Marshal(*op)
-	checkError(err)
-	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, encodedOp)
+func (m *Miner) addOperationRecord(op *Operation, traceID string) (opSig string) {
+	_, opSig, err := oplib.Sign(&m.privKey, op)
 	checkError(err)
-	sig := Signature{r, s}
-	encodedSig, err := json.Marshal(sig)
-	checkError(err)
-	opSig = string(encodedSig)
 
 	opRecord := OperationRecord{
 		Op:           *op,
@@ -1259,6 +11832,10 @@ func (m *Miner) addOperationRecord(op *Operation) (opSig string) {
 		PubKeyString: m.pubKeyString}
 
 	m.unminedOps[opSig] = &opRecord
+	m.traces.add(opSig, traceID)
+	logTrace(traceID, "Submitted op: ", opSig)
+	m.storePendingOps()
+	m.updateMempoolSummary()
 	m.disseminateOpToConnectedMiners(&opRecord)
 
 	return
@@ -1266,71 +11843,380 @@ func (m *Miner) addOperationRecord(op *Operation) (opSig string) {
 
 // Asserts the following about a given block and blockHash:
 // - blockhash matches POW difficulty and nonce is correct
+// - the block's summary fields match its records
 // - the given block points to a valid hash in the blockchain
 func (m *Miner) validateBlock(block *Block) error {
+	precheck := m.precheckBlock(block)
+	if precheck.Err != nil {
+		logTrace(m.traces.get(hashBlock(block)), "Block could not be validated. ", hashBlock(block))
+		return precheck.Err
+	}
+	return m.validatePrecheckedBlock(block, precheck.Geometries)
+}
+
+// The result of the checks of a block that don't depend on the chain
+type BlockPrecheck struct {
+	Err error
+
+	// Geometries of the block's valid ADD shapes, keyed by op signature
+	Geometries map[string]shapelib.ShapeGeometry
+}
+
+// Checks everything about a block that doesn't depend on the chain it
+// extends: its proof of work, number of ops, summary fields and record
+// order, each op's signature, and that each added shape is valid on the
+// canvas. Reads only the network settings, so blocks can be prechecked
+// concurrently.
+//
+// The ops are checked on the validation workers, but the error returned is
+// always that of the first invalid op in the block, so that every miner
+// rejects a block for the same reason whatever its number of workers.
+func (m *Miner) precheckBlock(block *Block) (precheck BlockPrecheck) {
+	blockHash := hashBlock(block)
+	if !m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) {
+		precheck.Err = errorLib.ValidationError(blockHash).Wrap(fmt.Errorf("hash doesn't meet the proof of work difficulty"))
+		return
+	} else if maxOps := m.getMaxOpsPerBlock(); uint32(len(block.Records)) > maxOps {
+		precheck.Err = errorLib.ValidationError(blockHash).Wrap(fmt.Errorf("block has more than the %d ops allowed", maxOps))
+		return
+	} else if !blockSummaryMatches(block) {
+		precheck.Err = errorLib.ValidationError(blockHash).Wrap(fmt.Errorf("summary doesn't match the block's ops"))
+		return
+	} else if !areRecordsCanonical(block.Records) {
+		precheck.Err = errorLib.ValidationError(blockHash).Wrap(fmt.Errorf("ops aren't in canonical order"))
+		return
+	}
+
+	rules := m.getShapeRules()
+	records := block.Records
+	geometries := make([]shapelib.ShapeGeometry, len(records))
+	errs := make([]error, len(records))
+	m.forEachInParallel(len(records), func(i int) {
+		if !m.validateSignature(records[i]) {
+			errs[i] = errorLib.InvalidSignatureError()
+		} else if records[i].Op.Type == ADD {
+			geometries[i], errs[i] = m.getEngine().Validate(records[i].Op.Shape, rules)
+		}
+	})
+
+	precheck.Geometries = make(map[string]shapelib.ShapeGeometry)
+	for i, opRecord := range records {
+		if errs[i] != nil {
+			precheck.Err = errorLib.ValidationError(blockHash).Wrap(errs[i])
+			return
+		} else if opRecord.Op.Type == ADD {
+			precheck.Geometries[opRecord.OpSig] = geometries[i]
+		}
+	}
+	return
+}
+
+// Validates a block that passed precheckBlock against the chain: it must
+// extend a block in the blocktree, and its ops must be valid together on
+// its parent, which must be the head. The block's prechecked geometries
+// are kept with those of the chain being applied, if any.
+func (m *Miner) validatePrecheckedBlock(block *Block, geometries map[string]shapelib.ShapeGeometry) error {
+	if m.geometries == nil {
+		m.geometries = geometries
+		defer func() { m.geometries = nil }()
+	} else {
+		for opSig, geo := range geometries {
+			m.geometries[opSig] = geo
+		}
+	}
+
 	blockHash := hashBlock(block)
-	if m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) && m.validateOpIntegrity(block) && m.blockchain[block.PrevHash] != nil {
-		logger.Println("Block has been validated. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
+	parent, parentExists := m.positions[block.PrevHash]
+	var err error
+	if !parentExists {
+		err = fmt.Errorf("parent [%s] isn't in the blocktree", block.PrevHash)
+	} else if block.BlockNo != parent.Height+1 {
+		err = fmt.Errorf("block number %d doesn't follow its parent's %d", block.BlockNo, parent.Height)
+	} else {
+		err = m.validateOpState(block)
+	}
+	if err == nil {
+		m.logState("Block has been validated. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
 		return nil
 	}
-	logger.Println("Block could not be validated. ", blockHash)
-	return errorLib.ValidationError(blockHash)
+	logTrace(m.traces.get(blockHash), "Block could not be validated. ", blockHash)
+	return errorLib.ValidationError(blockHash).Wrap(err)
+}
+
+// Validates a chain of blocks, oldest first, and applies each block to the
+// miner as it is validated, adding it to the blocktree (and disseminating
+// it, if asked to). Stops at the first invalid block, and returns how many
+// blocks were applied.
+//
+// Only checking ops against the state a block extends has to be done in
+// chain order; the rest of each block's validation (signatures and shape
+// geometry, which dominate the cost of syncing a long chain) is done ahead
+// of time on every core.
+func (m *Miner) applyChain(chain []*Block, disseminate bool) (numApplied int, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	slots := make(chan struct{}, MAX_PRECHECKED_BLOCKS)
+	prechecks := m.precheckBlocks(chain, slots, done)
+
+	m.geometries = make(map[string]shapelib.ShapeGeometry)
+	defer func() { m.geometries = nil }()
+	for i, block := range chain {
+		precheck := <-prechecks[i]
+		<-slots
+		if precheck.Err != nil {
+			logTrace(m.traces.get(hashBlock(block)), "Block could not be validated. ", hashBlock(block))
+			return i, precheck.Err
+		} else if err = m.validatePrecheckedBlock(block, precheck.Geometries); err != nil {
+			return i, err
+		}
+
+		if disseminate {
+			m.addBlock(block)
+		} else {
+			m.insertBlock(block)
+		}
+		m.applyBlock(block)
+	}
+	return len(chain), nil
+}
+
+// Prechecks the blocks of a chain on the validation workers, and returns a
+// channel per block that its precheck is sent on. A block is only
+// prechecked once it takes one of the given slots, which the caller frees
+// as it consumes the prechecks; closing done stops the workers.
+func (m *Miner) precheckBlocks(chain []*Block, slots chan struct{}, done chan struct{}) []chan BlockPrecheck {
+	prechecks := make([]chan BlockPrecheck, len(chain))
+	for i := range prechecks {
+		prechecks[i] = make(chan BlockPrecheck, 1)
+	}
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range chain {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < m.getValidationWorkers(); w++ {
+		go func() {
+			for i := range jobs {
+				prechecks[i] <- m.precheckBlock(chain[i])
+			}
+		}()
+	}
+	return prechecks
+}
+
+// Returns the number of goroutines that validate ops, one per core unless
+// the miner was run with -validation-workers
+func (m *Miner) getValidationWorkers() int {
+	if m.numValidators < 1 {
+		return runtime.NumCPU()
+	}
+	return m.numValidators
+}
+
+// Calls f with each index below n on the validation workers, and returns
+// once every call has. Each call may only write results at its own index,
+// and the caller decides on the results in index order, so that nothing
+// depends on which worker finished first.
+func (m *Miner) forEachInParallel(n int, f func(i int)) {
+	workers := m.getValidationWorkers()
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Returns the blocks of an exported chain, in the same order
+func getChainBlocks(chain []ExportedBlock) []*Block {
+	blocks := make([]*Block, len(chain))
+	for i := range chain {
+		blocks[i] = &chain[i].Block
+	}
+	return blocks
 }
 
 // Helper function to assert that each op in a block is signed properly,
-// shape is valid, and the public key has enough ink.
+// shape is valid, and the public key has enough ink. The ops are checked
+// the same way block assembly picks them, so a block this miner assembles
+// is always valid.
 func (m *Miner) validateOpIntegrity(block *Block) bool {
-	addOps := map[string]*OperationRecord{}
-	removeOps := map[string]*OperationRecord{}
 	blockValid := true
-
-	// Check for valid signatures and credit ink for REMOVE operations first
 	for _, opRecord := range block.Records {
 		if !m.validateSignature(opRecord) {
 			blockValid = false
 		}
-		if opRecord.Op.Type == REMOVE {
-			removeOps[opRecord.OpSig] = &opRecord
-		} else {
-			addOps[opRecord.OpSig] = &opRecord
-		}
 	}
 
-	// Validate each REMOVE operation
-	for opSig, opRecord := range removeOps {
-		originalOp := m.validatedOps[opRecord.Op.Ref]
-		if originalOp == nil || originalOp.Op.Deleted {
-			delete(removeOps, opSig)
-			blockValid = false
-		} else {
-			m.applyOpInk(opRecord)
+	return m.validateOpState(block) == nil && blockValid
+}
+
+// Asserts that a block's ops are valid together on the head: the shapes
+// fit in with the chain's and their payers have enough ink. Returns why
+// the first invalid op in the block is invalid.
+func (m *Miner) validateOpState(block *Block) error {
+	applied, skipped := m.applyTentativeOps(block.Records)
+	m.undoTentativeOps(applied)
+	for _, err := range skipped {
+		logger.Println(err)
+	}
+	for _, opRecord := range block.Records {
+		if err, exists := skipped[opRecord.OpSig]; exists {
+			return err
 		}
 	}
+	return nil
+}
+
+// Returns the unmined ops to mine in the next block: the largest set of
+// them that is valid together on the head. Ops are taken in the order of
+// the miner's priority policy (oldest first by default), in the order
+// their ink is applied, and each op that conflicts with the chain or with
+// the ops taken before it (by overlapping their shapes, or spending ink
+// they already spent) is left out. At most the network's MaxOpsPerBlock ops
+// are taken, those first in priority order; if that leaves out an op that
+// others relied on, e.g. the REMOVE refunding their ink, the others are left
+// out too. Ops left out stay unmined. The ops taken are returned in
+// canonical order.
+func (m *Miner) selectOpsForBlock() (records []OperationRecord) {
+	candidates := make([]OperationRecord, 0, len(m.unminedOps))
+	for _, opRecord := range m.unminedOps {
+		candidates = append(candidates, *opRecord)
+	}
+	policy := m.getPriorityPolicy()
+	sortByPolicy := func(records []OperationRecord) {
+		sort.Slice(records, func(i, j int) bool {
+			return policy.Before(&records[i], &records[j])
+		})
+	}
+	sortByPolicy(candidates)
+
+	records, _ = m.applyTentativeOps(candidates)
+	m.undoTentativeOps(records)
+	if maxOps := int(m.getMaxOpsPerBlock()); len(records) > maxOps {
+		sortByPolicy(records)
+		records, _ = m.applyTentativeOps(records[:maxOps])
+		m.undoTentativeOps(records)
+	}
+	sortRecordsCanonically(records)
+	return
+}
 
-	// Validate each ADD operation
-	for opSig, opRecord := range addOps {
-		_, err := m.validateNewShape(opRecord.Op.Shape)
+// Tentatively applies the ink of ops, in the order blocks apply it, on top
+// of the head. Ops that conflict with the chain or with the ops applied
+// before them are skipped. The shapes of applied ADD ops are kept in
+// tempOps so that later shapes are checked against them. Returns the
+// applied ops, which must be undone with undoTentativeOps, and why each
+// skipped op was skipped.
+func (m *Miner) applyTentativeOps(records []OperationRecord) (applied []OperationRecord, skipped map[string]error) {
+	skipped = make(map[string]error)
+	for _, record := range sortRecordsForInk(records) {
+		opRecord := record
+		err := m.checkBlockOp(&opRecord)
+		if err == nil {
+			_, err = m.applyOpInk(&opRecord)
+		}
 		if err != nil {
-			logger.Println(err)
-			delete(addOps, opSig)
-			blockValid = false
-		} else {
-			m.applyOpInk(opRecord)
-			m.tempOps[opSig] = opRecord
+			skipped[opRecord.OpSig] = err
+			continue
+		}
+
+		if opRecord.Op.Type == ADD {
+			m.tempOps[opRecord.OpSig] = &opRecord
 		}
+		applied = append(applied, opRecord)
 	}
+	return
+}
 
-	// Clean up tempOps
+// Reverses the ink of tentatively applied ops and clears tempOps
+func (m *Miner) undoTentativeOps(applied []OperationRecord) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		m.reverseOpInk(&applied[i])
+	}
 	m.tempOps = map[string]*OperationRecord{}
-	// Reverse temporary inkAccount changes
-	for _, opRecord := range removeOps {
-		m.reverseOpInk(opRecord)
+}
+
+// Checks everything but the ink of an op that is to be mined on the head,
+// after the ops in tempOps. No op may be signed by a retired key. A REMOVE
+// op must delete a validated shape, and refund whoever paid for it. An ADD
+// op's ink cost must match its shape's, and the shape must not overlap the
+// chain's shapes or those in tempOps; unmined ops don't count, since other
+// miners may not have them. An ALLOW op must name a valid spender key. A
+// ROTATE op must name a key that isn't retired. An op that depends on
+// another must come after it on the chain.
+func (m *Miner) checkBlockOp(opRecord *OperationRecord) error {
+	if err := m.checkKeysNotRotated(opRecord); err != nil {
+		return err
+	} else if dependsOn := opRecord.Op.DependsOn; dependsOn != "" && !m.isOpOnChain(dependsOn) {
+		return errorLib.DependencyError(dependsOn)
 	}
-	for _, opRecord := range addOps {
-		m.reverseOpInk(opRecord)
+	switch opRecord.Op.Type {
+	case REMOVE:
+		originalOp := m.validatedOps[opRecord.Op.Ref]
+		if originalOp == nil || originalOp.Op.Type != ADD || originalOp.Op.Deleted || m.expiredOps[opRecord.Op.Ref] || originalOp.Op.Payer != opRecord.Op.Payer {
+			return errorLib.ShapeOwnerError(opRecord.Op.Ref)
+		}
+	case ADD:
+		var inkCost uint32
+		var err error
+		opCollections := []map[string]*OperationRecord{m.tempOps}
+		if geo, prechecked := m.geometries[opRecord.OpSig]; prechecked {
+			inkCost, err = m.validateShapeGeometry(opRecord.Op.Shape, geo, opRecord.getPayer(), opCollections...)
+		} else {
+			inkCost, err = m.validateShape(opRecord.Op.Shape, opRecord.getPayer(), opCollections...)
+		}
+		if err != nil {
+			return err
+		} else if inkCost != opRecord.Op.InkCost || opRecord.Op.ExpiryBlocks > MAX_EXPIRY_BLOCKS {
+			return errorLib.ValidationError(opRecord.OpSig)
+		}
+	case ALLOW:
+		if parseStringPubKey(opRecord.Op.Spender) == nil {
+			return errorLib.ValidationError(opRecord.OpSig)
+		}
+	case ROTATE:
+		return m.checkRotation(opRecord)
 	}
+	return nil
+}
 
-	return blockValid
+// Determines if an op is in a block of the chain ending in the head,
+// including the blocks pruned from the store
+func (m *Miner) isOpOnChain(opSig string) bool {
+	return m.validatedOps[opSig] != nil || m.unvalidatedOps[opSig] != nil || m.prunedOps[opSig]
 }
 
 // Validates a the miner's current collection of unmined ops. The shapes
@@ -1344,56 +12230,275 @@ func (m *Miner) validateOpIntegrity(block *Block) bool {
 // This assumes that signatures have already been validated (otherwise
 // they wouldn't have been added to the unminedOps collection).
 //
-// ADD operations which conflict with some other unmined operation will be
-// successively removed until conflicts no longer occur. The order is
-// unspecified.
+// The ops are validated oldest first, in the canonical order of a block's
+// records. Of ADD operations which conflict with each other, the oldest is
+// kept and the rest are removed, the same way on every miner whatever its
+// number of validation workers, which only check the shapes' geometry.
+//
+// Ops that depend on an op that isn't on the chain yet are left to wait
+// for it, unless it has failed.
 func (m *Miner) validateUnminedOps() {
-	addOps := map[string]*OperationRecord{}
-	removeOps := map[string]*OperationRecord{}
+	addOps := []*OperationRecord{}
+	removeOps := []*OperationRecord{}
+	allowOps := []*OperationRecord{}
+	rotateOps := []*OperationRecord{}
+
+	// Pinned ops that failed get another chance on the new head
+	for opSig := range m.pinnedOps {
+		if opRecord := m.failedOps[opSig]; opRecord != nil {
+			opRecord.Error = nil
+			m.unminedOps[opSig] = opRecord
+			delete(m.failedOps, opSig)
+		}
+	}
 
-	for opSig, opRecord := range m.unminedOps {
-		if opRecord.Op.Type == REMOVE {
-			removeOps[opSig] = opRecord
+	unminedOps := make([]*OperationRecord, 0, len(m.unminedOps))
+	for _, opRecord := range m.unminedOps {
+		unminedOps = append(unminedOps, opRecord)
+	}
+	sort.Slice(unminedOps, func(i, j int) bool {
+		return isCanonicallyBefore(unminedOps[i], unminedOps[j])
+	})
+
+	for _, opRecord := range unminedOps {
+		opSig := opRecord.OpSig
+		err := m.checkKeysNotRotated(opRecord)
+		if dependsOn := opRecord.Op.DependsOn; err == nil && dependsOn != "" && !m.isOpOnChain(dependsOn) {
+			if m.failedOps[dependsOn] == nil {
+				continue
+			}
+			err = errorLib.DependencyError(dependsOn)
+		}
+
+		if err != nil {
+			opRecord.Error = err
+			m.failedOps[opSig] = opRecord
+			m.recordOpRejection(opSig, m.localAddr.String(), errorLib.Describe(err))
+			delete(m.unminedOps, opSig)
+		} else if opRecord.Op.Type == REMOVE {
+			removeOps = append(removeOps, opRecord)
+		} else if opRecord.Op.Type == ALLOW {
+			allowOps = append(allowOps, opRecord)
+		} else if opRecord.Op.Type == ROTATE {
+			rotateOps = append(rotateOps, opRecord)
 		} else {
-			addOps[opSig] = opRecord
+			addOps = append(addOps, opRecord)
+		}
+	}
+
+	// Validate each ALLOW operation and remove if invalid
+	for _, opRecord := range allowOps {
+		if _, err := m.applyOpInk(opRecord); err != nil {
+			opRecord.Error = err
+			m.failedOps[opRecord.OpSig] = opRecord
+			m.recordOpRejection(opRecord.OpSig, m.localAddr.String(), errorLib.Describe(err))
+			delete(m.unminedOps, opRecord.OpSig)
 		}
 	}
 
 	// Validate each REMOVE operation and remove if invalid
-	for opSig, opRecord := range removeOps {
+	for _, opRecord := range removeOps {
+		opSig := opRecord.OpSig
 		originalOp := m.validatedOps[opRecord.Op.Ref]
-		if originalOp == nil || originalOp.Op.Deleted {
-			opRecord.Error = errorLib.ShapeOwnerError(originalOp.OpSig)
+		if originalOp == nil || originalOp.Op.Type != ADD || originalOp.Op.Deleted || m.expiredOps[opRecord.Op.Ref] || originalOp.Op.Payer != opRecord.Op.Payer {
+			opRecord.Error = errorLib.ShapeOwnerError(opRecord.Op.Ref)
 			m.failedOps[opSig] = opRecord
+			m.recordOpRejection(opSig, m.localAddr.String(), errorLib.Describe(opRecord.Error))
+			delete(m.unminedOps, opSig)
+		} else if _, err := m.applyOpInk(opRecord); err != nil {
+			opRecord.Error = err
+			m.failedOps[opSig] = opRecord
+			m.recordOpRejection(opSig, m.localAddr.String(), errorLib.Describe(err))
 			delete(m.unminedOps, opSig)
-		} else {
-			m.applyOpInk(opRecord)
 		}
 	}
 
-	// Validate each ADD operation and remove if invalid
-	for opSig, opRecord := range addOps {
-		_, err := m.validateNewShape(opRecord.Op.Shape)
+	// Validate each ADD operation and remove if invalid. The geometry of
+	// each shape doesn't depend on the other ops, so it is checked first
+	rules := m.getShapeRules()
+	geometries := make([]shapelib.ShapeGeometry, len(addOps))
+	geometryErrs := make([]error, len(addOps))
+	m.forEachInParallel(len(addOps), func(i int) {
+		geometries[i], geometryErrs[i] = m.getEngine().Validate(addOps[i].Op.Shape, rules)
+	})
+	checked := make(map[string]*OperationRecord, len(m.unminedOps))
+	for opSig, opRecord := range m.unminedOps {
+		checked[opSig] = opRecord
+	}
+	for _, opRecord := range addOps {
+		delete(checked, opRecord.OpSig)
+	}
+	for i, opRecord := range addOps {
+		opSig := opRecord.OpSig
+		err := geometryErrs[i]
+		if err == nil {
+			_, err = m.validateShapeGeometry(opRecord.Op.Shape, geometries[i], opRecord.getPayer(), checked, m.tempOps)
+		}
+		if err == nil {
+			_, err = m.applyOpInk(opRecord)
+		}
 		if err != nil {
 			opRecord.Error = err
 			m.failedOps[opSig] = opRecord
+			m.recordOpRejection(opSig, m.localAddr.String(), errorLib.Describe(err))
 			delete(m.unminedOps, opSig)
 		} else {
-			m.applyOpInk(opRecord)
+			checked[opSig] = opRecord
 		}
 	}
 
-	// Reverse temporary inkAccount changes
-	for _, opRecord := range m.unminedOps {
-		m.reverseOpInk(opRecord)
+	// Validate each ROTATE operation, oldest first, and remove if invalid.
+	// A key's second rotation fails, and rotations can chain, so they are
+	// reversed right away in the opposite order to which they were applied.
+	rotated := []*OperationRecord{}
+	for _, opRecord := range rotateOps {
+		err := m.checkKeysNotRotated(opRecord)
+		if err == nil {
+			err = m.checkRotation(opRecord)
+		}
+		if err == nil {
+			_, err = m.applyOpInk(opRecord)
+		}
+		if err != nil {
+			opRecord.Error = err
+			m.failedOps[opRecord.OpSig] = opRecord
+			m.recordOpRejection(opRecord.OpSig, m.localAddr.String(), errorLib.Describe(err))
+			delete(m.unminedOps, opRecord.OpSig)
+		} else {
+			rotated = append(rotated, opRecord)
+		}
+	}
+	for i := len(rotated) - 1; i >= 0; i-- {
+		m.reverseOpInk(rotated[i])
+	}
+
+	// Reverse temporary inkAccount changes, in the opposite order to which
+	// they were applied
+	for _, ops := range [][]*OperationRecord{addOps, removeOps, allowOps} {
+		for i := len(ops) - 1; i >= 0; i-- {
+			if _, unmined := m.unminedOps[ops[i].OpSig]; unmined {
+				m.reverseOpInk(ops[i])
+			}
+		}
+	}
+
+	m.updatePinnedOps()
+}
+
+// Counts the head changes in a row on which each pinned op has failed
+// revalidation, and unpins those that have failed MAX_PIN_RETRIES times.
+// Their failure becomes a PinExpiredError wrapping the last reason.
+func (m *Miner) updatePinnedOps() {
+	for opSig, failures := range m.pinnedOps {
+		opRecord := m.failedOps[opSig]
+		if opRecord == nil {
+			m.pinnedOps[opSig] = 0
+			continue
+		}
+
+		m.pinnedOps[opSig] = failures + 1
+		if failures+1 >= MAX_PIN_RETRIES {
+			logTrace(m.traces.get(opSig), "Unpinned op that kept failing: "+errorLib.Describe(opRecord.Error))
+			opRecord.Error = errorLib.PinExpiredError(opSig).Wrap(opRecord.Error)
+			delete(m.pinnedOps, opSig)
+		}
 	}
 }
 
 func (m *Miner) validateSignature(opRecord OperationRecord) bool {
-	data, _ := json.Marshal(opRecord.Op)
-	sig := new(Signature)
-	json.Unmarshal([]byte(opRecord.OpSig), &sig)
-	return ecdsa.Verify(decodeStringPubKey(opRecord.PubKeyString), data, sig.R, sig.S)
+	encodedOp, _ := oplib.Encode(&opRecord.Op)
+	return oplib.Verify(decodeStringPubKey(opRecord.PubKeyString), encodedOp, opRecord.OpSig)
+}
+
+// Returns the blocks from the genesis block (exclusive) to the head,
+// oldest first
+func (m *Miner) getMainChain() (chain []ExportedBlock) {
+	return m.getChainTo(m.blockchainHead)
+}
+
+// Returns the blocks from the genesis block (exclusive) to the given
+// block (inclusive), oldest first
+func (m *Miner) getChainTo(blockHash string) (chain []ExportedBlock) {
+	chain = make([]ExportedBlock, m.blockchain[blockHash].BlockNo)
+	currHash := blockHash
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i] = ExportedBlock{currHash, *m.blockchain[currHash]}
+		currHash = m.blockchain[currHash].PrevHash
+	}
+	return
+}
+
+// Returns the svg strings of the shapes on the canvas as of a given
+// block, keyed by shape hash
+func (m *Miner) getCanvasAt(blockHash string) map[string]string {
+	canvas := make(map[string]string)
+	shapes, _ := m.getShapesAt(blockHash)
+	for shapeHash, shape := range shapes {
+		canvas[shapeHash] = getSvgElement(shape)
+	}
+	return canvas
+}
+
+// Returns the shapes on the canvas as of a given block, keyed by shape
+// hash, and the hashes of those that expire later, keyed by the block
+// number at which they do
+func (m *Miner) getShapesAt(blockHash string) (canvas map[string]shapelib.Shape, expiries map[uint32][]string) {
+	canvas = make(map[string]shapelib.Shape)
+	expiries = make(map[uint32][]string)
+	for _, exported := range m.getChainTo(blockHash) {
+		applyBlockToCanvas(canvas, expiries, &exported.Block)
+	}
+	return
+}
+
+// Draws the shapes a block adds onto a canvas and removes those it deletes
+// or that expire at it
+func applyBlockToCanvas(canvas map[string]shapelib.Shape, expiries map[uint32][]string, block *Block) {
+	for _, opRecord := range block.Records {
+		if opRecord.Op.Type == ADD {
+			canvas[opRecord.OpSig] = opRecord.Op.Shape
+			if opRecord.Op.ExpiryBlocks > 0 {
+				expiresAt := block.BlockNo + opRecord.Op.ExpiryBlocks
+				expiries[expiresAt] = append(expiries[expiresAt], opRecord.OpSig)
+			}
+		} else if opRecord.Op.Type == REMOVE {
+			delete(canvas, opRecord.Op.Ref)
+		}
+	}
+	for _, shapeHash := range expiries[block.BlockNo] {
+		delete(canvas, shapeHash)
+	}
+	delete(expiries, block.BlockNo)
+}
+
+// Renders a shape as an svg element. A filled path of several sub-paths is
+// drawn with the even-odd rule its ink is costed with, so that its holes
+// show.
+func getSvgElement(shape shapelib.Shape) string {
+	if shape.ShapeType == shapelib.CIRCLE {
+		_geo, _ := shape.GetGeometry()
+		geo, _ := _geo.(shapelib.CircleGeometry)
+
+		cx := strconv.FormatInt(geo.Center.X, 10)
+		cy := strconv.FormatInt(geo.Center.Y, 10)
+		r := strconv.FormatInt(geo.Radius, 10)
+
+		return `<circle cx="` + cx + `" cy="` + cy + `" r="` + r + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"` + shape.Style.GetSvgAttributes() + `/>`
+	}
+	fillRule := ""
+	if rule := shape.GetFillRule(); rule != "" {
+		fillRule = ` fill-rule="` + rule + `"`
+	}
+	return `<path d="` + shape.ShapeSvgString + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"` + fillRule + shape.Style.GetSvgAttributes() + `/>`
+}
+
+// Determines if this miner has seen an op, whatever became of it
+func (m *Miner) hasOp(opSig string) bool {
+	_, unminedExists := m.unminedOps[opSig]
+	_, unvalidExists := m.unvalidatedOps[opSig]
+	_, validExists := m.validatedOps[opSig]
+	_, failedExists := m.failedOps[opSig]
+	return unminedExists || unvalidExists || validExists || failedExists
 }
 
 func (m *Miner) getOpBlockHash(opSig string) (string, error) {
@@ -1422,6 +12527,74 @@ func (m *Miner) getOpBlockHash(opSig string) (string, error) {
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <HELPER METHODS>
 
+// Runs GetGeometry, HasOverlap and GetInkCost on each of the reference
+// shapes. These mirror the benchmarks in shapebench's tests.
+func runShapeBenchmarks() (results []BenchmarkResult) {
+	probeGeo, _ := shapebench.ReferenceProbe().GetGeometry()
+	for _, ref := range shapebench.ReferenceShapes() {
+		shape := ref.Shape
+		geo, err := shape.GetGeometry()
+		if checkError(err) != nil {
+			continue
+		}
+
+		benchmarks := []struct {
+			op string
+			fn func()
+		}{
+			{"GetGeometry", func() { shape.GetGeometry() }},
+			{"HasOverlap", func() { geo.HasOverlap(probeGeo) }},
+			{"GetInkCost", func() { geo.GetInkCost() }},
+		}
+		for _, benchmark := range benchmarks {
+			nsPerOp, allocsPerOp := measureOp(benchmark.fn)
+			results = append(results, BenchmarkResult{benchmark.op + "/" + ref.Name, nsPerOp, allocsPerOp})
+		}
+	}
+	return
+}
+
+// Calls fn in batches twice as large as the last until BENCH_TIME
+// milliseconds have passed, and returns the mean time and number of heap
+// allocations a call took
+func measureOp(fn func()) (nsPerOp int64, allocsPerOp int64) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	var numCalls int64
+	for batch := int64(1); time.Since(start) < time.Duration(BENCH_TIME)*time.Millisecond; batch *= 2 {
+		for i := int64(0); i < batch; i++ {
+			fn()
+		}
+		numCalls += batch
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return elapsed.Nanoseconds() / numCalls, int64(after.Mallocs-before.Mallocs) / numCalls
+}
+
+// Describes each result that is slower than the baseline result of the
+// same name by more than tolerance percent
+func getBenchmarkRegressions(baseline, results []BenchmarkResult, tolerance float64) (regressions []string) {
+	baselineNs := make(map[string]int64)
+	for _, result := range baseline {
+		baselineNs[result.Name] = result.NsPerOp
+	}
+
+	for _, result := range results {
+		ns, exists := baselineNs[result.Name]
+		if !exists || ns <= 0 {
+			continue
+		}
+		slowdown := 100 * float64(result.NsPerOp-ns) / float64(ns)
+		if slowdown > tolerance {
+			regressions = append(regressions, fmt.Sprintf("%s %d ns/op, baseline %d ns/op (+%.0f%%)", result.Name, result.NsPerOp, ns, slowdown))
+		}
+	}
+	return
+}
+
 func checkError(err error) error {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -1438,6 +12611,64 @@ func generateNewKeys() ecdsa.PrivateKey {
 	return *privKey
 }
 
+// Parses a hex encoded public key, returning nil if it isn't a valid
+// ECDSA public key
+func parseStringPubKey(pubkey string) *ecdsa.PublicKey {
+	pubBytes, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		return nil
+	}
+	ecdsaPubKey, _ := pubKey.(*ecdsa.PublicKey)
+	return ecdsaPubKey
+}
+
+// A delegation is a JSON encoded Delegation, signed by the miner, that
+// authorizes the art node with the given hex encoded public key until
+// expiry
+func signDelegation(privKey *ecdsa.PrivateKey, artnodePubKey string, expiry time.Time) (delegation string, err error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return
+	}
+	signed := Delegation{Expiry: expiry.Unix()}
+	digest := getDelegationDigest(hex.EncodeToString(publicKeyBytes), artnodePubKey, signed.Expiry)
+	if signed.R, signed.S, err = ecdsa.Sign(rand.Reader, privKey, digest); err != nil {
+		return
+	}
+	encoded, err := json.Marshal(signed)
+	return string(encoded), err
+}
+
+// Returns the digest of a delegation that is signed. It is prefixed with
+// "delegation:" so that it can't be taken for anything else the miner's
+// key signs, and covers the delegating miner's key as well as the art
+// node's so that it only holds for the miner that signed it.
+func getDelegationDigest(delegator, delegate string, expiry int64) []byte {
+	encoded, _ := json.Marshal([]interface{}{delegator, delegate, expiry})
+	digest := sha256.Sum256(append([]byte("delegation:"), encoded...))
+	return digest[:]
+}
+
+// Returns the art node's public key if the delegation was signed by this
+// miner and hasn't expired, and nil otherwise
+func (m *Miner) verifyDelegation(artnodePubKey, delegation string) *ecdsa.PublicKey {
+	signed := new(Delegation)
+	if err := json.Unmarshal([]byte(delegation), signed); err != nil || signed.R == nil || signed.S == nil {
+		return nil
+	}
+	if time.Now().Unix() >= signed.Expiry {
+		return nil
+	}
+	if !ecdsa.Verify(&m.pubKey, getDelegationDigest(m.pubKeyString, artnodePubKey, signed.Expiry), signed.R, signed.S) {
+		return nil
+	}
+	return parseStringPubKey(artnodePubKey)
+}
+
 func decodeStringPubKey(pubkey string) *ecdsa.PublicKey {
 	pubBytes, _ := hex.DecodeString(pubkey)
 	pubKey, err := x509.ParsePKIXPublicKey(pubBytes)
@@ -1467,21 +12698,6 @@ func hashBlock(block *Block) string {
 	return blockHash
 }
 
-func sortMap(minerAndLength map[string]int) PairList {
-	pl := make(PairList, len(minerAndLength))
-	i := 0
-	for k, v := range minerAndLength {
-		pl[i] = Pair{k, v}
-		i++
-	}
-	sort.Sort(sort.Reverse(pl))
-	return pl
-}
-
-func (p PairList) Len() int           { return len(p) }
-func (p PairList) Less(i, j int) bool { return p[i].Value < p[j].Value }
-func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-
 // Computes the md5 hash of a given byte slice
 func md5Hash(data []byte) string {
 	h := md5.New()
@@ -0,0 +1,4295 @@
+package main
+
+/*
+Usage:
+go test ink-miner.go ink-miner_test.go
+*/
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proj1_b0z8_b4n0b_i5n8_m9r8/blockartlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/oplib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
+)
+
+// Discards the miners' logs. The logger is only set once, since the
+// goroutines of a test may log until its servers are shut down.
+func TestMain(tests *testing.M) {
+	logger = log.New(ioutil.Discard, "", 0)
+	os.Exit(tests.Run())
+}
+
+// Serves RPCs over a pipe with serve, e.g. an rpc.Server's ServeConn, and
+// returns a client of it. When the test ends the client is closed and the
+// calls being served are waited for, so that none outlive the test.
+func serveTestPipe(t *testing.T, serve func(conn io.ReadWriteCloser)) *rpc.Client {
+	serverConn, clientConn := net.Pipe()
+	served := make(chan bool)
+	go func() {
+		serve(serverConn)
+		close(served)
+	}()
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() {
+		client.Close()
+		<-served
+	})
+	return client
+}
+
+// Creates a miner with an empty chain and no network
+func newTestMiner() *Miner {
+	m := new(Miner)
+	m.settings = &MinerNetSettings{
+		GenesisBlockHash: "genesis",
+		InkPerOpBlock:    50,
+		InkPerNoOpBlock:  25,
+		CanvasSettings:   CanvasSettings{1024, 1024}}
+	m.lock = &sync.RWMutex{}
+	m.blockChildren = make(map[string][]string)
+	m.initBlockchainCache()
+	// Gossip is signed with the miner's key
+	m.privKey = generateNewKeys()
+	return m
+}
+
+// Generates a key and gives it some ink
+func newTestKey(m *Miner, ink uint32) (privKey ecdsa.PrivateKey, pubKeyString string) {
+	privKey = generateNewKeys()
+	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	pubKeyString = hex.EncodeToString(publicKeyBytes)
+	m.inkAccounts[pubKeyString] = ink
+	return
+}
+
+var testTimeStamp int64 = 0
+
+// Signs an op adding a filled path and adds it to the unmined ops
+func addTestShape(t *testing.T, m *Miner, privKey ecdsa.PrivateKey, pubKeyString string, svg string) OperationRecord {
+	shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: svg, Fill: "red", Stroke: "red", Owner: pubKeyString}
+	geo, err := shape.GetGeometry()
+	if err != nil {
+		t.Fatal(svg, err)
+	}
+
+	// Each op is newer than the one before it
+	testTimeStamp++
+	op := Operation{Type: ADD, Shape: shape, InkCost: uint32(geo.GetInkCost()), TimeStamp: testTimeStamp}
+	opRecord := signTestOp(privKey, op, pubKeyString)
+	m.unminedOps[opRecord.OpSig] = &opRecord
+	return opRecord
+}
+
+// Signs an op as the given key's
+func signTestOp(privKey ecdsa.PrivateKey, op Operation, pubKeyString string) OperationRecord {
+	_, opSig, err := oplib.Sign(&privKey, &op)
+	checkError(err)
+	return OperationRecord{Op: op, OpSig: opSig, PubKeyString: pubKeyString}
+}
+
+// Returns the signatures of the given ops
+func getOpSigs(records []OperationRecord) (opSigs []string) {
+	for _, opRecord := range records {
+		opSigs = append(opSigs, opRecord.OpSig)
+	}
+	return
+}
+
+// Checks that the selected ops are the expected ones, that they make a
+// valid block, and that selecting them left the miner's ink unchanged
+func checkSelection(t *testing.T, m *Miner, selected []OperationRecord, expected []OperationRecord, inkAccounts map[string]uint32) {
+	if len(selected) != len(expected) {
+		t.Fatal("Expected", len(expected), "ops, got", len(selected))
+	}
+	selectedSigs := getOpSigs(selected)
+	for i, opSig := range getOpSigs(expected) {
+		if selectedSigs[i] != opSig {
+			t.Error("Expected op", i, "to be", opSig[:20]+", got", selectedSigs[i][:20])
+		}
+	}
+
+	block := newBlock(1, m.settings.GenesisBlockHash, selected, "", 0)
+	if !m.validateOpIntegrity(&block) {
+		t.Error("Expected a block of the selected ops to be valid")
+	}
+
+	for pubKeyString, ink := range inkAccounts {
+		if m.inkAccounts[pubKeyString] != ink {
+			t.Error("Expected ink", ink, "to be left unchanged, got", m.inkAccounts[pubKeyString])
+		}
+	}
+	if len(m.tempOps) != 0 {
+		t.Error("Expected tempOps to be cleared, got", len(m.tempOps))
+	}
+}
+
+// Test that of two overlapping shapes of different owners only the older
+// one is mined, and that a block of both would be rejected
+func TestSelectOpsForBlockOverlap(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+
+	older := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 20 v 20 h -20 Z")
+	overlapping := addTestShape(t, m, privKey2, pubKey2, "M 20 20 h 20 v 20 h -20 Z")
+	separate := addTestShape(t, m, privKey2, pubKey2, "M 100 100 h 20 v 20 h -20 Z")
+	// The same owner's shapes may overlap
+	ownOverlap := addTestShape(t, m, privKey1, pubKey1, "M 15 15 h 5 v 5 h -5 Z")
+
+	inkAccounts := map[string]uint32{pubKey1: 1000, pubKey2: 1000}
+	selected := m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{older, separate, ownOverlap}, inkAccounts)
+
+	if _, unmined := m.unminedOps[overlapping.OpSig]; !unmined {
+		t.Error("Expected the overlapping op to stay unmined")
+	}
+
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{older, overlapping, separate}, "", 0)
+	if m.validateOpIntegrity(&block) {
+		t.Error("Expected a block of overlapping shapes to be invalid")
+	}
+}
+
+// Test that ops are mined oldest first until their owner runs out of ink,
+// and that ops of owners with ink left are still mined
+func TestSelectOpsForBlockInk(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 0)
+	privKey2, pubKey2 := newTestKey(m, 0)
+
+	first := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 10 v 10 h -10 Z")
+	second := addTestShape(t, m, privKey1, pubKey1, "M 30 10 h 10 v 10 h -10 Z")
+	third := addTestShape(t, m, privKey1, pubKey1, "M 50 10 h 10 v 10 h -10 Z")
+	other := addTestShape(t, m, privKey2, pubKey2, "M 70 10 h 10 v 10 h -10 Z")
+
+	// Enough ink for two of the first key's shapes, but not three
+	inkAccounts := map[string]uint32{pubKey1: first.Op.InkCost*2 + first.Op.InkCost/2, pubKey2: other.Op.InkCost}
+	for pubKeyString, ink := range inkAccounts {
+		m.inkAccounts[pubKeyString] = ink
+	}
+
+	selected := m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{first, second, other}, inkAccounts)
+
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{first, second, third, other}, "", 0)
+	if m.validateOpIntegrity(&block) {
+		t.Error("Expected a block spending more ink than its owner has to be invalid")
+	}
+}
+
+// Test that selected ops are in canonical order, not the order their ink
+// is applied in, and that a block out of canonical order is invalid
+func TestSelectOpsForBlockOrder(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	_, pubKey2 := newTestKey(m, 1000)
+
+	shape := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 20 v 20 h -20 Z")
+	testTimeStamp++
+	op := Operation{Type: ALLOW, Spender: pubKey2, Allowance: 100, TimeStamp: testTimeStamp}
+	allow := signTestOp(privKey1, op, pubKey1)
+	m.unminedOps[allow.OpSig] = &allow
+
+	selected := m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{shape, allow}, map[string]uint32{pubKey1: 1000})
+
+	canonical := newBlock(1, m.settings.GenesisBlockHash, selected, "", 0)
+	if err := m.validateBlock(&canonical); err != nil {
+		t.Error("Expected a block in canonical order to be valid, got", err)
+	}
+	reordered := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{allow, shape}, "", 0)
+	if err := m.validateBlock(&reordered); err == nil {
+		t.Error("Expected a block out of canonical order to be invalid")
+	}
+	repeated := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{shape, shape}, "", 0)
+	if err := m.validateBlock(&repeated); err == nil {
+		t.Error("Expected a block with an op twice to be invalid")
+	}
+}
+
+// Test that an ALLOW op's spender and allowance are signed, that a spender
+// can spend its allowance, and that an allowance of 0 revokes the rest
+func TestAllowances(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 0)
+	_, pubKey3 := newTestKey(m, 0)
+
+	testTimeStamp++
+	allow := signTestOp(privKey1, Operation{Type: ALLOW, Spender: pubKey2, Allowance: 100, TimeStamp: testTimeStamp}, pubKey1)
+	for _, tamper := range []func(op *Operation){
+		func(op *Operation) { op.Spender = pubKey3 },
+		func(op *Operation) { op.Allowance = 1000 },
+	} {
+		tampered := allow
+		tamper(&tampered.Op)
+		if m.validateSignature(tampered) {
+			t.Error("Expected a tampered ALLOW op's signature to be invalid", tampered.Op)
+		} else if err := m.receiveOp(&tampered, ""); !errors.Is(err, errorLib.InvalidSignatureError()) {
+			t.Error("Expected a tampered ALLOW op to be rejected, got", err)
+		}
+	}
+	if !m.validateSignature(allow) {
+		t.Fatal("Expected the ALLOW op's signature to be valid")
+	}
+	_, err := m.applyOpInk(&allow)
+	checkError(err)
+
+	// The spender pays for a shape with the allowance
+	shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 0 0 h 5 v 5 h -5 Z", Fill: "red", Stroke: "red", Owner: pubKey2}
+	geo, _ := shape.GetGeometry()
+	inkCost := uint32(geo.GetInkCost())
+	testTimeStamp++
+	spend := signTestOp(privKey2, Operation{Type: ADD, Shape: shape, InkCost: inkCost, Payer: pubKey1, TimeStamp: testTimeStamp}, pubKey2)
+	if _, err := m.applyOpInk(&spend); err != nil {
+		t.Fatal(err)
+	} else if m.inkAccounts[pubKey1] != 1000-inkCost || m.getAllowance(pubKey1, pubKey2) != 100-inkCost {
+		t.Error("Expected the payer's ink and allowance to be spent, got", m.inkAccounts[pubKey1], m.getAllowance(pubKey1, pubKey2))
+	}
+
+	// Revoking takes what is left, and reversing the revocation gives it back
+	testTimeStamp++
+	revoke := signTestOp(privKey1, Operation{Type: ALLOW, Spender: pubKey2, TimeStamp: testTimeStamp}, pubKey1)
+	if _, err := m.applyOpInk(&revoke); err != nil {
+		t.Fatal(err)
+	} else if allowance := m.getAllowance(pubKey1, pubKey2); allowance != 0 {
+		t.Error("Expected the allowance to be revoked, got", allowance)
+	}
+	testTimeStamp++
+	spend = signTestOp(privKey2, Operation{Type: ADD, Shape: shape, InkCost: inkCost, Payer: pubKey1, TimeStamp: testTimeStamp}, pubKey2)
+	if _, err := m.applyOpInk(&spend); !errors.Is(err, errorLib.AllowanceError(0)) {
+		t.Error("Expected spending a revoked allowance to fail, got", err)
+	}
+	m.reverseOpInk(&revoke)
+	if allowance := m.getAllowance(pubKey1, pubKey2); allowance != 100-inkCost {
+		t.Error("Expected the revoked allowance to be given back, got", allowance)
+	}
+
+	// A block can't allow a spender that isn't a key
+	testTimeStamp++
+	badSpender := signTestOp(privKey1, Operation{Type: ALLOW, Spender: "not a key", Allowance: 100, TimeStamp: testTimeStamp}, pubKey1)
+	if err := m.checkBlockOp(&badSpender); !errors.Is(err, errorLib.ValidationError(badSpender.OpSig)) {
+		t.Error("Expected an ALLOW op with a bad spender to be invalid, got", err)
+	}
+}
+
+// Test that a shape overlapping one on the chain is not selected
+func TestSelectOpsForBlockChain(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+
+	validated := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 20 v 20 h -20 Z")
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{validated}, pubKey1, 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+
+	addTestShape(t, m, privKey2, pubKey2, "M 20 20 h 20 v 20 h -20 Z")
+	if selected := m.selectOpsForBlock(); len(selected) != 0 {
+		t.Error("Expected a shape overlapping the chain not to be selected, got", len(selected), "ops")
+	}
+}
+
+// Test that pruning a store keeps the newest blocks' bodies, refuses to
+// load the pruned ones, and that replaying the rest of the chain from the
+// snapshot ends in the same state
+func TestPruneStore(t *testing.T) {
+	m := newTestMiner()
+	m.store = openBlockStore(t.TempDir())
+	if err := m.store.saveSettings(m.settings); err != nil {
+		t.Fatal(err)
+	}
+	privKey, pubKey := newTestKey(m, 0)
+
+	var prunedShape, unprunedShape OperationRecord
+	blockHashes := []string{m.settings.GenesisBlockHash}
+	numBlocks := MIN_UNPRUNED_BLOCKS + 10
+	for blockNo := 1; blockNo <= numBlocks; blockNo++ {
+		if blockNo == 5 {
+			prunedShape = addTestShape(t, m, privKey, pubKey, "M 10 10 h 5 v 5 h -5 Z")
+		} else if blockNo == numBlocks-5 {
+			unprunedShape = addTestShape(t, m, privKey, pubKey, "M 30 10 h 5 v 5 h -5 Z")
+		}
+		block := newBlock(uint32(blockNo), m.blockchainHead, m.selectOpsForBlock(), pubKey, 0)
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+		blockHashes = append(blockHashes, m.blockchainHead)
+	}
+
+	if err := m.store.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.store.loadBlock(blockHashes[5]); !errors.Is(err, errorLib.PrunedError("")) {
+		t.Error("Expected a PrunedError loading a pruned block, got", err)
+	}
+	if _, err := m.store.loadBlock(blockHashes[numBlocks]); err != nil {
+		t.Error("Expected the head to be loaded, got", err)
+	}
+
+	replayed, chain, err := loadStoredChain(m.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != MIN_UNPRUNED_BLOCKS {
+		t.Fatal("Expected", MIN_UNPRUNED_BLOCKS, "unpruned blocks, got", len(chain))
+	}
+	for _, exported := range chain {
+		block := exported.Block
+		if err := replayed.validateBlock(&block); err != nil {
+			t.Fatal("Block", block.BlockNo, "is invalid after pruning:", err)
+		}
+		replayed.insertBlock(&block)
+		replayed.applyBlock(&block)
+	}
+
+	if replayed.blockchainHead != m.blockchainHead {
+		t.Error("Expected head", m.blockchainHead, "got", replayed.blockchainHead)
+	}
+	if replayed.inkAccounts[pubKey] != m.inkAccounts[pubKey] {
+		t.Error("Expected ink", m.inkAccounts[pubKey], "got", replayed.inkAccounts[pubKey])
+	}
+	for _, opRecord := range []OperationRecord{prunedShape, unprunedShape} {
+		if _, exists := replayed.validatedOps[opRecord.OpSig]; !exists {
+			t.Error("Expected shape", opRecord.Op.Shape.ShapeSvgString, "to be validated after replaying")
+		}
+	}
+}
+
+// Test that a store keeps one copy of each long svg string, however many
+// blocks and ops hold it, that they load with their svg strings as they
+// were, and that svg strings nothing refers to anymore are swept
+func TestStoreSvgs(t *testing.T) {
+	dir := t.TempDir()
+	bs := openBlockStore(dir)
+	stamp := "M 10 10 h 5 v 5 h -5 Z M 20 10 h 5 v 5 h -5 Z M 30 10 h 5 v 5 h -5 Z M 40 10 h 5 v 5 h -5 Z"
+	record := func(svg string, opSig string) OperationRecord {
+		return OperationRecord{Op: Operation{Type: ADD, Shape: shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: svg}}, OpSig: opSig}
+	}
+	var blocks []Block
+	for i := 0; i < 3; i++ {
+		block := newBlock(uint32(i+1), "genesis", []OperationRecord{record(stamp, fmt.Sprint("stamp", i)), record("M 0 0 h 1 v 1 Z", fmt.Sprint("dot", i))}, "", 0)
+		if err := bs.saveBlock(hashBlock(&block), &block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	if err := bs.saveOps([]StoredOp{{record(stamp, "pending"), ""}}); err != nil {
+		t.Fatal(err)
+	}
+
+	svgFiles, _ := filepath.Glob(filepath.Join(dir, "svgs", "*.svg"))
+	if len(svgFiles) != 1 {
+		t.Fatal("Expected the stamp's svg string to be stored once, got", len(svgFiles), "files")
+	}
+	for _, block := range blocks {
+		encoded, _ := ioutil.ReadFile(filepath.Join(dir, "blocks", hashBlock(&block)+".json"))
+		if bytes.Contains(encoded, []byte(stamp)) || !bytes.Contains(encoded, []byte("M 0 0 h 1 v 1 Z")) {
+			t.Error("Expected only the long svg string to be stored by reference")
+		}
+	}
+
+	loaded, err := bs.loadBlocks()
+	if err != nil || len(loaded) != 3 {
+		t.Fatal("Expected the blocks to load, got", len(loaded), err)
+	}
+	for _, block := range blocks {
+		if loaded[hashBlock(&block)].Records[0].Op.Shape.ShapeSvgString != stamp {
+			t.Error("Expected the stamp's svg string to be restored")
+		}
+	}
+	if ops, err := bs.loadOps(); err != nil || ops[0].Record.Op.Shape.ShapeSvgString != stamp {
+		t.Error("Expected the pending op's svg string to be restored, got", err)
+	}
+
+	// Once nothing refers to it, the svg string is swept, unless it was
+	// referred to since the sweep started
+	for _, block := range blocks {
+		os.Remove(filepath.Join(dir, "blocks", hashBlock(&block)+".json"))
+	}
+	if err := bs.saveOps(nil); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := bs.sweepSvgs(time.Now().Add(-time.Hour)); err != nil || deleted != 0 {
+		t.Error("Expected a recently referred to svg string to be kept, got", deleted, err)
+	}
+	if deleted, err := bs.sweepSvgs(time.Now().Add(time.Second)); err != nil || deleted != 1 {
+		t.Error("Expected the unreferenced svg string to be swept, got", deleted, err)
+	}
+
+	// A tampered svg string fails to load
+	block := blocks[0]
+	bs.saveBlock(hashBlock(&block), &block)
+	svgFiles, _ = filepath.Glob(filepath.Join(dir, "svgs", "*.svg"))
+	ioutil.WriteFile(svgFiles[0], []byte("M 0 0 h 100 v 100 Z"), 0644)
+	if _, err := bs.loadBlock(hashBlock(&block)); err == nil {
+		t.Error("Expected a tampered svg string not to load")
+	}
+}
+
+// Test that a full set of inbound slots evicts the least useful inbound
+// peer, never an anchor or an outbound peer, and refuses new peers once
+// only anchors are left
+// Test that a miner with nothing to mine pulls the ops a peer listed, each
+// as its own op, and only once
+func TestPullMissingOps(t *testing.T) {
+	peer := newTestNode()
+	privKey, pubKeyString := newTestKey(peer, 1000)
+	ops := []OperationRecord{
+		addTestShape(t, peer, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, peer, privKey, pubKeyString, "M 20 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, peer, privKey, pubKeyString, "M 40 0 h 10 v 10 h -10 Z")}
+	peer.updateMempoolSummary()
+
+	registerGobTypes()
+	server := rpc.NewServer()
+	server.Register(peer)
+
+	m := newTestNode()
+	m.inkAccounts[pubKeyString] = 1000
+	m.miners["peer"] = serveTestPipe(t, server.ServeConn)
+	m.peerMempools["peer"] = MempoolSummary{NumOps: len(ops), OpSigs: getOpSigs(ops)}
+
+	m.pullMissingOps()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	shapes := make(map[string]bool)
+	for _, opRecord := range ops {
+		if pulled := m.unminedOps[opRecord.OpSig]; pulled == nil || pulled.OpSig != opRecord.OpSig {
+			t.Fatal("Expected", opRecord.OpSig, "to be pulled as itself, got", pulled)
+		} else {
+			shapes[pulled.Op.Shape.ShapeSvgString] = true
+		}
+	}
+	if len(shapes) != len(ops) {
+		t.Error("Expected the pulled ops to have distinct shapes, got", len(shapes))
+	}
+	for _, opRecord := range ops {
+		if !m.pulledOps[opRecord.OpSig] {
+			t.Error("Expected", opRecord.OpSig, "to be marked as pulled")
+		}
+	}
+}
+
+func TestMakePeerSlot(t *testing.T) {
+	m := newTestMiner()
+	m.miners = make(map[string]*rpc.Client)
+	m.peerSlots = make(map[string]*PeerSlot)
+	m.maxInbound = 4
+
+	connected := time.Now()
+	addTestPeer := func(minerAddr string, inbound bool, score uint64) {
+		conn, _ := net.Pipe()
+		m.addPeer(minerAddr, rpc.NewClient(conn), inbound)
+		m.peerSlots[minerAddr].connected = connected
+		m.peerSlots[minerAddr].score = score
+		connected = connected.Add(time.Second)
+	}
+	addTestPeer("anchor1", true, 0)
+	addTestPeer("anchor2", true, 0)
+	addTestPeer("useful", true, 5)
+	addTestPeer("outbound", false, 0)
+	addTestPeer("useless", true, 1)
+
+	if !m.makePeerSlot(true) {
+		t.Fatal("Expected a peer to be evicted")
+	}
+	for _, minerAddr := range []string{"anchor1", "anchor2", "useful", "outbound"} {
+		if _, connected := m.miners[minerAddr]; !connected {
+			t.Error("Expected", minerAddr, "not to be evicted")
+		}
+	}
+	if _, connected := m.miners["useless"]; connected {
+		t.Error("Expected the least useful peer to be evicted")
+	}
+
+	m.maxInbound = 2
+	if !m.makePeerSlot(true) {
+		t.Fatal("Expected the remaining non-anchor peer to be evicted")
+	}
+	if m.makePeerSlot(true) {
+		t.Error("Expected no room once only anchors are left")
+	}
+	if m.countPeers(true) != 2 {
+		t.Error("Expected both anchors to stay connected, got", m.countPeers(true), "inbound peers")
+	}
+}
+
+// Mines no-op blocks on top of prevHash, storing each one, and returns
+// their hashes. They are applied only if apply is set.
+func mineTestBranch(m *Miner, prevHash string, numBlocks int, apply bool) (blockHashes []string) {
+	for i := 0; i < numBlocks; i++ {
+		block := newBlock(m.blockchain[prevHash].BlockNo+1, prevHash, []OperationRecord{}, "", uint32(i))
+		m.insertBlock(&block)
+		if apply {
+			m.applyBlock(&block)
+		}
+		prevHash = hashBlock(&block)
+		blockHashes = append(blockHashes, prevHash)
+	}
+	return
+}
+
+// Test that a miner killed in the middle of a reorg, after storing the new
+// branch but before committing its head, leaves the store at the old head,
+// and that files it was writing are cleaned up when the store is reopened
+func TestStoreHeadCommit(t *testing.T) {
+	m := newTestMiner()
+	dir := t.TempDir()
+	m.store = openBlockStore(dir)
+	if err := m.store.saveSettings(m.settings); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBranch := mineTestBranch(m, m.settings.GenesisBlockHash, 3, true)
+	m.storePendingOps()
+
+	// The longer branch is stored, and a block of it is half written, when
+	// the miner is killed
+	newBranch := mineTestBranch(m, m.settings.GenesisBlockHash, 4, false)
+	tmpFile := filepath.Join(dir, "blocks", "0123456789abcdef.json.tmp")
+	if err := ioutil.WriteFile(tmpFile, []byte("{\"BlockNo\":"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, chain, err := loadStoredChain(openBlockStore(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || chain[2].Hash != oldBranch[2] {
+		t.Error("Expected the chain of the committed head, got", len(chain), "blocks")
+	}
+	if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Error("Expected the half written block to be removed, got", err)
+	}
+
+	// Once the reorg is committed the store is at the new head
+	m.changeBlockchainHead(m.blockchainHead, newBranch[3])
+	m.storePendingOps()
+	_, chain, err = loadStoredChain(openBlockStore(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 4 || chain[3].Hash != newBranch[3] {
+		t.Error("Expected the chain of the new head, got", len(chain), "blocks")
+	}
+}
+
+func TestSyncMempool(t *testing.T) {
+	peer := newTestNode()
+	privKey, pubKeyString := newTestKey(peer, 1000)
+	ops := []OperationRecord{
+		addTestShape(t, peer, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, peer, privKey, pubKeyString, "M 20 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, peer, privKey, pubKeyString, "M 40 0 h 10 v 10 h -10 Z")}
+	peer.updateMempoolSummary()
+
+	registerGobTypes()
+	server := rpc.NewServer()
+	server.Register(peer)
+	client := serveTestPipe(t, server.ServeConn)
+
+	// The miner already has the first op, and pulls the other two through
+	// its event loop
+	m := newTestNode()
+	m.inkAccounts[pubKeyString] = 1000
+	known := ops[0]
+	m.unminedOps[known.OpSig] = &known
+	received := m.events.subscribe()
+
+	m.syncMempool("peer", client)
+	for _, opRec := range ops[1:] {
+		if event := <-received; event.Type != OP_RECEIVED || event.Op.OpSig != opRec.OpSig || event.Err != nil {
+			t.Error("Expected", opRec.OpSig, "to be synced, got", event.Op.OpSig, event.Err)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	shapes := make(map[string]bool)
+	for sig, opRec := range m.unminedOps {
+		if opRec.OpSig != sig {
+			t.Error("Expected the op under", sig, "to be that op, got", opRec.OpSig)
+		}
+		shapes[opRec.Op.Shape.ShapeSvgString] = true
+	}
+	if len(m.unminedOps) != len(ops) || len(shapes) != len(ops) {
+		t.Error("Expected", len(ops), "unmined ops with distinct shapes, got", len(m.unminedOps), "ops and", len(shapes), "shapes")
+	}
+	for _, opRec := range ops {
+		if _, acked := m.receipts.get(opRec.OpSig)["peer"]; !acked {
+			t.Error("Expected the peer to have acknowledged", opRec.OpSig)
+		}
+	}
+}
+
+// Test that an op's trace ID travels with it to the miners that pull it,
+// and prefixes the lines they log about it
+func TestTraceIDs(t *testing.T) {
+	if traceID := getTraceID("client-1_a"); traceID != "client-1_a" {
+		t.Error("Expected a valid trace ID to be kept, got", traceID)
+	}
+	if traceID := getTraceID("bad id"); traceID == "bad id" || len(traceID) != 16 {
+		t.Error("Expected an invalid trace ID to be replaced, got", traceID)
+	}
+
+	peer := newTestMiner()
+	peer.traces = newTraceLog(MAX_TRACE_LOG_ENTRIES)
+	privKey, pubKeyString := newTestKey(peer, 1000)
+	op := addTestShape(t, peer, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	peer.traces.add(op.OpSig, "client-1")
+	peer.updateMempoolSummary()
+
+	registerGobTypes()
+	server := rpc.NewServer()
+	server.Register(peer)
+	client := serveTestPipe(t, server.ServeConn)
+
+	m := newTestMiner()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	m.inkAccounts[pubKeyString] = 1000
+	m.events = newEventBus(EVENT_INBOX_SIZE)
+	m.receipts = newOpReceiptLog(MAX_RECEIPT_LOG_OPS)
+	m.opSources = make(map[string]string)
+	m.peerStats = make(map[string]*peerCounters)
+	m.traces = newTraceLog(MAX_TRACE_LOG_ENTRIES)
+	var logs bytes.Buffer
+	logger = log.New(&logs, "", 0)
+	defer func() { logger = log.New(ioutil.Discard, "", 0) }()
+	go m.applyEvents()
+
+	m.syncMempool("peer", client)
+	if _, exists := m.unminedOps[op.OpSig]; !exists {
+		t.Fatal("Expected the op to be synced")
+	}
+	if traceID := m.traces.get(op.OpSig); traceID != "client-1" {
+		t.Error("Expected the op's trace ID to be pulled with it, got", traceID)
+	}
+	if !strings.Contains(logs.String(), "[trace client-1] Received Op:") {
+		t.Error("Expected the op's log lines to carry its trace ID, got", logs.String())
+	}
+
+	m.traces.add(op.OpSig, "client-2")
+	if traceID := m.traces.get(op.OpSig); traceID != "client-1" {
+		t.Error("Expected the first trace ID to be kept, got", traceID)
+	}
+}
+
+func TestOpPropagation(t *testing.T) {
+	m := newTestMiner()
+	m.receipts = newOpReceiptLog(2)
+	m.rejections = newOpRejectionLog(MAX_REJECTION_LOG_OPS)
+	m.tokens = map[string]*ArtnodeSession{"token": {}}
+	m.miners = map[string]*rpc.Client{"a": nil, "b": nil, "c": nil}
+
+	at := time.Unix(10, 0)
+	m.receipts.add("a", []string{"op1", "op2"}, at)
+	m.recordOpRejection("op1", "b", "ShapeOverlapError(shape)")
+
+	request := &ArtnodeRequest{Token: "token", Payload: []interface{}{"op1"}}
+	response := new(MinerResponse)
+	m.GetOpPropagation(request, response)
+	acknowledged := response.Payload[0].([]string)
+	if len(acknowledged) != 1 || acknowledged[0] != "a" || response.Payload[1].([]int64)[0] != at.UnixNano() {
+		t.Error("Expected op1 to be acknowledged by a, got", acknowledged)
+	}
+	if unacknowledged := response.Payload[2].([]string); len(unacknowledged) != 1 || unacknowledged[0] != "c" {
+		t.Error("Expected op1 to be unacknowledged by c, got", unacknowledged)
+	}
+	if rejections := response.Payload[3].([]string); len(rejections) != 1 || rejections[0] != "b: ShapeOverlapError(shape)" {
+		t.Error("Expected op1 to be rejected by b, got", rejections)
+	}
+
+	// Once full, the log forgets the op first acknowledged the longest ago
+	m.receipts.add("b", []string{"op2", "op3"}, at)
+	if m.receipts.get("op1") != nil || len(m.receipts.get("op2")) != 2 {
+		t.Error("Expected op1 to be evicted and op2 to be held by a and b")
+	}
+}
+
+// Test that a rejection is reported back to the miner an op came from,
+// signed by the reporting miner, and that reports that aren't signed by the
+// key registered for the miner that sent them are refused
+func TestOpRejectionReports(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	reporter := newTestNode()
+	reporterAddr := "127.0.0.1:2"
+	reporter.localAddr, _ = net.ResolveTCPAddr("tcp", reporterAddr)
+	m.registry.keys[reporterAddr] = getRegisteredKey(reporter.pubKeyString)
+	server := rpc.NewServer()
+	server.Register(m)
+	reporter.miners["source"] = serveTestPipe(t, server.ServeConn)
+
+	reporter.lock.Lock()
+	reporter.opSources["op1"] = "source"
+	reporter.recordOpRejection("op1", "far", "ShapeOverlapError(shape)")
+	reporter.lock.Unlock()
+	reason := ""
+	for deadline := time.Now().Add(2 * time.Second); reason == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		m.lock.Lock()
+		reason = m.rejections.get("op1")["far"]
+		m.lock.Unlock()
+	}
+	if reason != "ShapeOverlapError(shape)" {
+		t.Fatal("Expected the rejection to be reported to the op's source, got", reason)
+	}
+
+	signReport := func(privKey ecdsa.PrivateKey, report OpRejectionReport) OpRejectionReport {
+		r, s, _ := ecdsa.Sign(rand.Reader, &privKey, getRejectionDigest(report))
+		encodedSig, _ := json.Marshal(Signature{r, s})
+		report.Sig = string(encodedSig)
+		return report
+	}
+	report := signReport(reporter.privKey, OpRejectionReport{"op2", "far", "ShapeOverlapError(shape)", reporterAddr, reporter.pubKeyString, ""})
+	tampered := report
+	tampered.Reason = "InsufficientInkError(0)"
+	unregisteredKey, unregisteredPubKey := newTestKey(m, 0)
+	for name, forged := range map[string]OpRejectionReport{
+		"tampered":     tampered,
+		"unregistered": signReport(unregisteredKey, OpRejectionReport{"op2", "far", "ShapeOverlapError(shape)", reporterAddr, unregisteredPubKey, ""}),
+		"misaddressed": signReport(reporter.privKey, OpRejectionReport{"op2", "far", "ShapeOverlapError(shape)", "127.0.0.1:3", reporter.pubKeyString, ""}),
+		"unaddressed":  signReport(reporter.privKey, OpRejectionReport{"op2", "far", "ShapeOverlapError(shape)", "", reporter.pubKeyString, ""}),
+		"unsigned":     OpRejectionReport{"op2", "far", "ShapeOverlapError(shape)", reporterAddr, reporter.pubKeyString, ""},
+	} {
+		response := new(MinerResponse)
+		m.ReportOpRejection(&MinerRequest{Payload: []interface{}{forged}}, response)
+		if !errors.Is(response.Error, errorLib.InvalidSignatureError()) || m.rejections.get("op2") != nil {
+			t.Error("Expected the", name, "report to be refused, got", response.Error)
+		}
+	}
+
+	response := new(MinerResponse)
+	m.ReportOpRejection(&MinerRequest{Payload: []interface{}{report}}, response)
+	if response.Error != nil || m.rejections.get("op2")["far"] != "ShapeOverlapError(shape)" {
+		t.Error("Expected the signed report to be recorded, got", response.Error)
+	}
+}
+
+func TestSpendQuota(t *testing.T) {
+	session := &ArtnodeSession{InkQuota: 100, OpQuota: 3}
+	if err := session.spendQuota(60); err != nil {
+		t.Fatal("Expected the first op to fit the quota, got", err)
+	}
+	if err := session.spendQuota(50); !errors.Is(err, errorLib.QuotaError("ink 40/100")) {
+		t.Error("Expected a QuotaError for the ink, got", err)
+	}
+
+	// A forwarded op that fails is refunded
+	session.spendQuota(40)
+	session.refundQuota(40)
+	if inkLeft, opsLeft := session.getQuotaLeft(); inkLeft != 40 || opsLeft != 2 {
+		t.Error("Expected 40 ink and 2 ops left, got", inkLeft, opsLeft)
+	}
+
+	session.spendQuota(0)
+	session.spendQuota(0)
+	if err := session.spendQuota(0); !errors.Is(err, errorLib.QuotaError("ops 0/3")) {
+		t.Error("Expected a QuotaError for the ops, got", err)
+	}
+
+	unlimited := &ArtnodeSession{}
+	for i := 0; i < 10; i++ {
+		if err := unlimited.spendQuota(1000); err != nil {
+			t.Fatal("Expected no quota, got", err)
+		}
+	}
+	if inkLeft, opsLeft := unlimited.getQuotaLeft(); inkLeft != math.MaxUint32 || opsLeft != math.MaxUint32 {
+		t.Error("Expected no limit, got", inkLeft, opsLeft)
+	}
+}
+
+func TestChainPositions(t *testing.T) {
+	m := newTestMiner()
+	m.settings.PoWDifficultyNoOpBlock = 2
+	mainChain := mineTestBranch(m, m.settings.GenesisBlockHash, 5, true)
+	if head := m.positions[m.blockchainHead]; head.Height != 5 || head.Work != 5*256 {
+		t.Fatal("Expected the head at height 5 with work", 5*256, "got", head)
+	}
+
+	// A fork attaching mid-chain that is shorter, or as long but with a
+	// smaller hash than the head, doesn't replace it
+	shortFork := mineTestBranch(m, mainChain[1], 2, false)
+	if position := m.positions[shortFork[1]]; position.Height != 4 || position.Work != 4*256 {
+		t.Error("Expected the short fork at height 4 with work", 4*256, "got", position)
+	}
+	if m.isLongerChain(shortFork[1]) {
+		t.Error("Expected the short fork not to be longer")
+	}
+	evenFork := mineTestBranch(m, shortFork[1], 1, false)
+	if m.positions[evenFork[0]].Height != 5 || m.isLongerChain(evenFork[0]) != (evenFork[0] > m.blockchainHead) {
+		t.Error("Expected a fork as long as the chain to be broken by hash")
+	}
+
+	longFork := mineTestBranch(m, mainChain[2], 4, false)
+	if position := m.positions[longFork[3]]; position.Height != 7 || !m.isLongerChain(longFork[3]) {
+		t.Error("Expected the long fork to be longer at height 7, got", position)
+	}
+
+	// A block claiming a height its parent doesn't have is invalid
+	m.settings.PoWDifficultyNoOpBlock = 0
+	valid := newBlock(6, longFork[1], []OperationRecord{}, "", 0)
+	invalid := newBlock(10, longFork[1], []OperationRecord{}, "", 0)
+	if err := m.validateBlock(&valid); err != nil {
+		t.Error("Expected a block following its parent to be valid, got", err)
+	}
+	if err := m.validateBlock(&invalid); err == nil {
+		t.Error("Expected a block skipping heights to be invalid")
+	}
+}
+
+// Test that the dashboard shows the chain, mempool and canvas, and escapes
+// what art nodes control
+func TestDashboard(t *testing.T) {
+	m := newTestMiner()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+	m.events = newEventBus(EVENT_INBOX_SIZE)
+	privKey, pubKeyString := newTestKey(m, 1000)
+
+	drawn := addTestShape(t, m, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	delete(m.unminedOps, drawn.OpSig)
+	drawn.Op.Shape.Stroke = `"><script>`
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn}, "", 0)
+	m.insertBlock(&block)
+	m.blockchainHead = hashBlock(&block)
+	pending := addTestShape(t, m, privKey, pubKeyString, "M 20 0 h 10 v 10 h -10 Z")
+
+	recorder := httptest.NewRecorder()
+	m.serveDashboard(recorder, httptest.NewRequest("GET", "/", nil))
+	page := recorder.Body.String()
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Expected the dashboard to be served, got", recorder.Code)
+	}
+	if !strings.Contains(page, shortenHash(m.blockchainHead)) || !strings.Contains(page, shortenHash(md5Hash([]byte(pending.OpSig)))) {
+		t.Error("Expected the head block and the unmined op to be shown")
+	}
+	if !strings.Contains(page, `d="M 0 0 h 10 v 10 h -10 Z"`) {
+		t.Error("Expected the shape on the canvas to be drawn")
+	}
+	if strings.Contains(page, "<script>") {
+		t.Error("Expected the shape's stroke to be escaped")
+	}
+
+	recorder = httptest.NewRecorder()
+	m.serveDashboard(recorder, httptest.NewRequest("GET", "/missing", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Expected other paths not to be found, got", recorder.Code)
+	}
+}
+
+// Test that the read replica's canvas follows the head, whether it moves
+// on by a block or to another branch, and that reads don't take the lock
+func TestReadReplica(t *testing.T) {
+	m := newTestMiner()
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{}}
+	privKey, pubKeyString := newTestKey(m, 1000)
+
+	drawn := addTestShape(t, m, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	drawn.Op.ExpiryBlocks = 2
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn}, "", 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	m.updateReadReplica()
+	if replica := m.getReadReplica(); len(replica.shapes) != 1 || replica.HeadHash != hashBlock(&block) {
+		t.Fatal("Expected the shape on the replica's canvas, got", len(replica.shapes), "shapes")
+	}
+
+	// The shape expires two blocks later
+	mainChain := mineTestBranch(m, hashBlock(&block), 1, true)
+	m.updateReadReplica()
+	if len(m.getReadReplica().shapes) != 1 {
+		t.Error("Expected the shape to stay until it expires")
+	}
+	mainChain = append(mainChain, mineTestBranch(m, mainChain[0], 1, true)...)
+	m.updateReadReplica()
+	if len(m.getReadReplica().shapes) != 0 || len(m.getReadReplica().expiries) != 0 {
+		t.Error("Expected the shape to have expired")
+	}
+
+	// On another branch the shape hasn't expired yet
+	fork := mineTestBranch(m, hashBlock(&block), 1, false)
+	m.blockchainHead = fork[0]
+	m.updateReadReplica()
+	if shapes, _ := m.getShapesAt(fork[0]); len(m.getReadReplica().shapes) != len(shapes) || len(shapes) != 1 {
+		t.Error("Expected the canvas to be rebuilt for the fork")
+	}
+
+	m.lock.Lock()
+	response := new(MinerResponse)
+	m.GetCanvas(&ArtnodeRequest{Token: "token"}, response)
+	m.lock.Unlock()
+	if response.Error != nil || response.Payload[0].(string) != fork[0] || len(response.Payload[1].([]string)) != 1 {
+		t.Error("Expected the canvas of the fork from the replica, got", response.Payload, response.Error)
+	}
+}
+
+func TestRenderRegionPNG(t *testing.T) {
+	m := newTestMiner()
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{}}
+	privKey, pubKeyString := newTestKey(m, 1000)
+	drawn := addTestShape(t, m, privKey, pubKeyString, "M 10 10 h 10 v 10 h -10 Z")
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn}, "", 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	m.updateReadReplica()
+
+	render := func(minX, minY, maxX, maxY uint32, scale float64) *MinerResponse {
+		response := new(MinerResponse)
+		m.RenderRegionPNG(&ArtnodeRequest{Token: "token", Payload: []interface{}{minX, minY, maxX, maxY, scale}}, response)
+		return response
+	}
+
+	response := render(0, 0, 20, 30, 2)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	img, err := png.Decode(bytes.NewReader(response.Payload[1].([]byte)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 40 || size.Y != 60 {
+		t.Error("Expected a 40x60 image, got", size)
+	}
+	if r, g, b, _ := img.At(30, 30).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Error("Expected the square to be filled red, got", r, g, b)
+	}
+	if r, g, b, _ := img.At(5, 5).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 {
+		t.Error("Expected a white background, got", r, g, b)
+	}
+
+	if response := render(0, 0, 2048, 10, 1); !errors.Is(response.Error, errorLib.OutOfBoundsError("")) {
+		t.Error("Expected an OutOfBoundsError for a region off the canvas, got", response.Error)
+	}
+	if response := render(0, 0, 1024, 1024, 2); !errors.Is(response.Error, errorLib.RenderTooLargeError(MAX_RENDER_PIXELS)) {
+		t.Error("Expected a RenderTooLargeError, got", response.Error)
+	}
+}
+
+// Test that blocks are listed by the key that mined them, within the range
+// of block numbers, with those off the longest chain marked
+func TestGetBlocksByOwner(t *testing.T) {
+	m := newTestMiner()
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{}}
+
+	mined := []string{}
+	prevHash := m.settings.GenesisBlockHash
+	for i, owner := range []string{"alice", "bob", "alice", "alice"} {
+		block := newBlock(uint32(i+1), prevHash, []OperationRecord{}, owner, 0)
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+		prevHash = hashBlock(&block)
+		mined = append(mined, prevHash)
+	}
+	stale := newBlock(2, mined[0], []OperationRecord{}, "alice", 1)
+	m.insertBlock(&stale)
+	m.insertBlock(&stale)
+
+	response := new(MinerResponse)
+	m.GetBlocksByOwner(&ArtnodeRequest{Token: "token", Payload: []interface{}{"alice", uint32(2), uint32(0)}}, response)
+	blockHashes, blockNos, onChain := response.Payload[0].([]string), response.Payload[2].([]uint32), response.Payload[4].([]bool)
+	if len(blockHashes) != 3 || blockNos[0] != 2 || blockHashes[0] != hashBlock(&stale) || onChain[0] {
+		t.Fatal("Expected the stale block first and off the longest chain, got", blockHashes, blockNos, onChain)
+	}
+	if blockHashes[1] != mined[2] || blockHashes[2] != mined[3] || !onChain[1] || !onChain[2] {
+		t.Error("Expected alice's blocks 3 and 4 on the longest chain, got", blockHashes, onChain)
+	}
+
+	response = new(MinerResponse)
+	m.GetBlocksByOwner(&ArtnodeRequest{Token: "token", Payload: []interface{}{"bob", uint32(0), uint32(1)}}, response)
+	if blockHashes := response.Payload[0].([]string); len(blockHashes) != 0 {
+		t.Error("Expected none of bob's blocks up to block 1, got", blockHashes)
+	}
+}
+
+// Test that a ROTATE op hands the signer's ink, shapes and block rewards
+// over to the new key, and that the retired key can no longer be used
+func TestRotateKey(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 0)
+	privKey3, pubKey3 := newTestKey(m, 1000)
+
+	drawn := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 20 v 20 h -20 Z")
+	testTimeStamp++
+	op := Operation{Type: ROTATE, NewKey: pubKey2, TimeStamp: testTimeStamp}
+	rotate := signTestOp(privKey1, op, pubKey1)
+
+	// The new key is signed, so the ink can't be sent to another key
+	swapped := rotate
+	swapped.Op.NewKey = pubKey3
+	swappedBlock := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn, swapped}, pubKey1, 0)
+	if m.validateSignature(swapped) {
+		t.Error("Expected a ROTATE op with a swapped new key to have an invalid signature")
+	} else if err := m.validateBlock(&swappedBlock); err == nil {
+		t.Error("Expected a block with a swapped new key to be invalid")
+	}
+	m.unminedOps[rotate.OpSig] = &rotate
+
+	selected := m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{drawn, rotate}, map[string]uint32{pubKey1: 1000, pubKey2: 0})
+	if len(m.rotatedKeys) != 0 {
+		t.Error("Expected selecting the rotation to leave the key unrotated")
+	}
+
+	// The block is mined by the old key, so its reward goes to the new one
+	block := newBlock(1, m.settings.GenesisBlockHash, selected, pubKey1, 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	if m.inkAccounts[pubKey1] != 0 || m.inkAccounts[pubKey2] != 1000-drawn.Op.InkCost+m.settings.InkPerOpBlock {
+		t.Fatal("Expected the ink and reward to go to the new key, got", m.inkAccounts[pubKey1], m.inkAccounts[pubKey2])
+	}
+
+	retired := addTestShape(t, m, privKey1, pubKey1, "M 100 100 h 20 v 20 h -20 Z")
+	if err := m.checkBlockOp(&retired); !errors.Is(err, errorLib.KeyRotatedError(pubKey2)) {
+		t.Error("Expected an op of the retired key to fail with a KeyRotatedError, got", err)
+	}
+	delete(m.unminedOps, retired.OpSig)
+
+	// The new key owns the shape, so its shapes may overlap it
+	ownOverlap := addTestShape(t, m, privKey2, pubKey2, "M 20 20 h 20 v 20 h -20 Z")
+	addTestShape(t, m, privKey3, pubKey3, "M 25 25 h 20 v 20 h -20 Z")
+	selected = m.selectOpsForBlock()
+	if len(selected) != 1 || selected[0].OpSig != ownOverlap.OpSig {
+		t.Error("Expected only the new key's overlapping shape to be selected, got", len(selected), "ops")
+	}
+
+	// Rotating back would make a cycle
+	back := OperationRecord{Op: Operation{Type: ROTATE, NewKey: pubKey1}, OpSig: "back", PubKeyString: pubKey2}
+	if err := m.checkBlockOp(&back); !errors.Is(err, errorLib.KeyRotatedError("")) {
+		t.Error("Expected rotating to a retired key to fail, got", err)
+	}
+}
+
+// Test that outstanding nonces and tokens are listed oldest first, and
+// that revoked tokens can no longer be used, even for replica reads
+func TestSessions(t *testing.T) {
+	m := newTestMiner()
+	admin := &MinerAdmin{m}
+	m.nonces = make(map[string]time.Time)
+	m.tokens = map[string]*ArtnodeSession{
+		"newer": &ArtnodeSession{Created: time.Now()},
+		"older": &ArtnodeSession{Created: time.Now().Add(-time.Hour), NumOps: 2}}
+	var nonce string
+	m.Hello("", &nonce)
+	m.updateReadReplica()
+
+	sessions := new(SessionList)
+	admin.Sessions("", sessions)
+	if len(sessions.Nonces) != 1 || sessions.Nonces[0].Nonce != nonce {
+		t.Error("Expected the nonce to be listed, got", sessions.Nonces)
+	}
+	if len(sessions.Tokens) != 2 || sessions.Tokens[0].Token != "older" || sessions.Tokens[0].NumOps != 2 {
+		t.Fatal("Expected the older token first, got", sessions.Tokens)
+	}
+
+	if err := admin.RevokeToken("older", new(bool)); err != nil {
+		t.Error("Expected the token to be revoked, got", err)
+	}
+	if err := admin.RevokeToken("older", new(bool)); !errors.Is(err, errorLib.InvalidTokenError("older")) {
+		t.Error("Expected revoking it again to fail, got", err)
+	}
+	response := new(MinerResponse)
+	m.GetInk(&ArtnodeRequest{Token: "older"}, response)
+	if !errors.Is(response.Error, errorLib.InvalidTokenError("")) {
+		t.Error("Expected the revoked token to be refused, got", response.Error)
+	}
+
+	var numRevoked int
+	admin.PurgeSessions("", &numRevoked)
+	if numRevoked != 1 || len(m.tokens) != 0 || len(m.nonces) != 0 || len(m.getReadReplica().tokens) != 0 {
+		t.Error("Expected every session to be purged, got", numRevoked, "revoked")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	m := newTestMiner()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	_, m.pubKeyString = newTestKey(m, 0)
+	m.tokens = map[string]*ArtnodeSession{
+		"own":      &ArtnodeSession{PubKeyString: m.pubKeyString, NumOps: 2},
+		"delegate": &ArtnodeSession{PubKeyString: "delegate", InkQuota: 100, OpQuota: 5},
+		"idle":     &ArtnodeSession{PubKeyString: "delegate"}}
+	m.updateReadReplica()
+
+	response := new(MinerResponse)
+	m.GetPresence(&ArtnodeRequest{Token: "own"}, response)
+	if !errors.Is(response.Error, errorLib.PresenceDisabledError("")) {
+		t.Fatal("Expected presence to be disabled by default, got", response.Error)
+	}
+
+	// Reads answered from the replica count as activity too
+	m.presence = true
+	m.GetInk(&ArtnodeRequest{Token: "delegate"}, new(MinerResponse))
+	m.tokenActivity["idle"] = time.Now().Add(-2 * time.Duration(PRESENCE_WINDOW) * time.Millisecond)
+	time.Sleep(time.Millisecond)
+	response = new(MinerResponse)
+	m.GetPresence(&ArtnodeRequest{Token: "own"}, response)
+	tokenHashes := response.Payload[0].([]string)
+	if len(tokenHashes) != 2 || tokenHashes[0] != hashToken("own") || tokenHashes[1] != hashToken("delegate") {
+		t.Fatal("Expected the two online sessions, most recently active first, got", tokenHashes)
+	}
+	if scopes := response.Payload[2].([]string); scopes[0] != "miner" || scopes[1] != "delegate ink<=100 ops<=5" {
+		t.Error("Expected the sessions' scopes, got", scopes)
+	}
+	if numOps := response.Payload[4].([]uint32); numOps[0] != 2 || numOps[1] != 0 {
+		t.Error("Expected the ops submitted by each session, got", numOps)
+	}
+
+	// Operators see idle sessions too, and closed ones are forgotten
+	delete(m.tokens, "delegate")
+	var presence []SessionPresence
+	(&MinerAdmin{m}).Presence("", &presence)
+	if len(presence) != 2 || presence[1].TokenHash != hashToken("idle") || presence[1].Online || !presence[0].Online {
+		t.Error("Expected the online and idle sessions, got", presence)
+	}
+	if _, exists := m.tokenActivity["delegate"]; exists {
+		t.Error("Expected the closed session's activity to be forgotten")
+	}
+}
+
+// Test that metadata is only set on the miner's own shapes and within the
+// limits, and that another miner only accepts entries signed by the
+// shape's owner, keeping the newest version of each key
+func TestShapeMetadata(t *testing.T) {
+	m := newTestMiner()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	m.miners = map[string]*rpc.Client{}
+	m.privKey, m.pubKeyString = newTestKey(m, 0)
+	otherKey, otherPubKey := newTestKey(m, 0)
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{PubKeyString: m.pubKeyString}}
+	own := addTestShape(t, m, m.privKey, m.pubKeyString, "M 0 0 L 10 0 L 10 10 Z")
+	other := addTestShape(t, m, otherKey, otherPubKey, "M 20 20 L 30 20 L 30 30 Z")
+
+	set := func(shapeHash, key, value string) *MinerResponse {
+		response := new(MinerResponse)
+		m.SetShapeMetadata(&ArtnodeRequest{Token: "token", Payload: []interface{}{shapeHash, key, value}}, response)
+		return response
+	}
+	if response := set(own.OpSig, "title", "Triangle"); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	set(own.OpSig, "author", "me")
+	set(own.OpSig, "author", "")
+	if response := set(other.OpSig, "title", "Mine now"); !errors.Is(response.Error, errorLib.ShapeOwnerError("")) {
+		t.Error("Expected a ShapeOwnerError, got", response.Error)
+	}
+	if response := set(own.OpSig, "title", strings.Repeat("a", MAX_METADATA_VALUE_LENGTH+1)); !errors.Is(response.Error, errorLib.MetadataTooLargeError("")) {
+		t.Error("Expected a MetadataTooLargeError, got", response.Error)
+	}
+
+	response := new(MinerResponse)
+	m.GetShapeMetadata(&ArtnodeRequest{Token: "token", Payload: []interface{}{own.OpSig}}, response)
+	if keys, values := response.Payload[0].([]string), response.Payload[1].([]string); len(keys) != 1 || keys[0] != "title" || values[0] != "Triangle" {
+		t.Error("Expected only the title, got", keys, values)
+	}
+
+	// Another miner that knows the shapes
+	peer := newTestMiner()
+	peer.unminedOps[own.OpSig] = &own
+	peer.unminedOps[other.OpSig] = &other
+	title := m.metadata[own.OpSig]["title"]
+	if isNew, err := peer.addShapeMetadata(title); !isNew || err != nil {
+		t.Fatal("Expected the entry to be accepted, got", isNew, err)
+	}
+	if isNew, _ := peer.addShapeMetadata(title); isNew {
+		t.Error("Expected a repeated entry not to be passed on")
+	}
+
+	tampered := title
+	tampered.Value = "Square"
+	tampered.Version++
+	if _, err := peer.addShapeMetadata(tampered); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected an InvalidSignatureError, got", err)
+	}
+	m.privKey, m.pubKeyString = otherKey, otherPubKey
+	forged, _ := m.signShapeMetadata(other.OpSig, "title", "Square")
+	forged.ShapeHash = own.OpSig
+	if _, err := peer.addShapeMetadata(forged); err == nil {
+		t.Error("Expected an entry not signed by the shape's owner to be refused")
+	}
+
+	renamed := title
+	renamed.Value, renamed.Version = "Old name", title.Version-1
+	if isNew, _ := peer.addShapeMetadata(renamed); isNew || peer.metadata[own.OpSig]["title"].Value != "Triangle" {
+		t.Error("Expected an older version to be ignored, got", peer.metadata[own.OpSig]["title"])
+	}
+}
+
+// Test that a chain is applied block by block with its geometry
+// prechecked ahead, and that applying stops at the first invalid block,
+// whether it fails its precheck or conflicts with the chain before it
+func TestApplyChain(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+
+	// Builds a chain of a block per shape, each shape drawn by the next key
+	keys := []ecdsa.PrivateKey{privKey1, privKey2}
+	pubKeys := []string{pubKey1, pubKey2}
+	buildChain := func(svgs ...string) (chain []*Block) {
+		prevHash := m.settings.GenesisBlockHash
+		for i, svg := range svgs {
+			opRecord := addTestShape(t, m, keys[i%2], pubKeys[i%2], svg)
+			block := newBlock(uint32(i+1), prevHash, []OperationRecord{opRecord}, pubKey1, 0)
+			chain = append(chain, &block)
+			prevHash = hashBlock(&block)
+		}
+		return
+	}
+
+	svgs := make([]string, 2*MAX_PRECHECKED_BLOCKS/10)
+	for i := range svgs {
+		svgs[i] = "M " + fmt.Sprint(10*i) + " 10 h 5 v 5 h -5 Z"
+	}
+	chain := buildChain(svgs...)
+	m = newTestMiner()
+	m.inkAccounts[pubKey1], m.inkAccounts[pubKey2] = 1000, 1000
+	if numApplied, err := m.applyChain(chain, false); err != nil || numApplied != len(chain) {
+		t.Fatal("Expected the whole chain to be applied, got", numApplied, err)
+	}
+	if m.blockchainHead != hashBlock(chain[len(chain)-1]) || len(m.validatedOps) != len(chain) {
+		t.Error("Expected the head and ops of the chain, got", m.blockchain[m.blockchainHead].BlockNo, len(m.validatedOps))
+	}
+	if m.geometries != nil {
+		t.Error("Expected the prechecked geometries to be cleared")
+	}
+
+	// The second shape overlaps the first
+	chain = buildChain("M 10 10 h 20 v 20 h -20 Z", "M 20 20 h 20 v 20 h -20 Z", "M 100 100 h 5 v 5 h -5 Z")
+	m = newTestMiner()
+	m.inkAccounts[pubKey1], m.inkAccounts[pubKey2] = 1000, 1000
+	if numApplied, err := m.applyChain(chain, false); !errors.Is(err, errorLib.ValidationError(hashBlock(chain[1]))) || numApplied != 1 {
+		t.Error("Expected the chain to stop at the overlapping shape, got", numApplied, err)
+	}
+	if m.blockchainHead != hashBlock(chain[0]) {
+		t.Error("Expected the head to be the block before the overlapping shape")
+	}
+
+	// The second shape is off the canvas
+	chain = buildChain("M 10 10 h 20 v 20 h -20 Z", "M 2000 10 h 20 v 20 h -20 Z", "M 100 100 h 5 v 5 h -5 Z")
+	m = newTestMiner()
+	m.inkAccounts[pubKey1], m.inkAccounts[pubKey2] = 1000, 1000
+	if numApplied, err := m.applyChain(chain, false); !errors.Is(err, errorLib.OutOfBoundsError("")) || numApplied != 1 {
+		t.Error("Expected the chain to stop at the shape off the canvas, got", numApplied, err)
+	}
+}
+
+// A closed axis-aligned rectangle, priced and intersected without shapelib
+// so that the chain consensus test can check the miner against it
+type testRect struct {
+	X0, Y0, X1, Y1 int64
+	Filled         bool
+	Owner          string
+}
+
+func (r testRect) getSvg() string {
+	return fmt.Sprintf("M %d %d h %d v %d h %d Z", r.X0, r.Y0, r.X1-r.X0, r.Y1-r.Y0, r.X0-r.X1)
+}
+
+// A transparent rectangle costs its outline, a filled one a row of its
+// width for each row it covers
+func (r testRect) getCost() uint32 {
+	w, h := uint32(r.X1-r.X0), uint32(r.Y1-r.Y0)
+	if r.Filled {
+		return w * (h + 1)
+	}
+	return 2 * (w + h)
+}
+
+// Rectangles overlap when they share a pixel, unless one lies strictly
+// inside a transparent one
+func (r testRect) overlaps(o testRect) bool {
+	if r.X0 > o.X1 || o.X0 > r.X1 || r.Y0 > o.Y1 || o.Y0 > r.Y1 {
+		return false
+	}
+	inside := func(a testRect, b testRect) bool {
+		return !a.Filled && a.X0 < b.X0 && b.X1 < a.X1 && a.Y0 < b.Y0 && b.Y1 < a.Y1
+	}
+	return !inside(r, o) && !inside(o, r)
+}
+
+// Names why a block failed validation, ignoring the error's details
+func getBlockOutcome(err error) string {
+	if err == nil {
+		return "valid"
+	} else if errors.Is(err, errorLib.OutOfBoundsError("")) {
+		return "out of bounds"
+	} else if errors.Is(err, errorLib.New(errorLib.InsufficientInkCode, "")) {
+		return "insufficient ink"
+	} else if errors.Is(err, errorLib.ShapeOverlapError("")) {
+		return "overlap"
+	}
+	return errorLib.Describe(err)
+}
+
+// Test that random blocks of shapes are validated the same way one at a
+// time and by applyChain's parallel prechecks, and that both agree with a
+// model of the canvas and the ink accounts
+func TestChainConsensus(t *testing.T) {
+	const numCandidates = 150
+	const startingInk = 400
+	r := mathrand.New(mathrand.NewSource(416))
+	m := newTestMiner()
+	var privKeys []ecdsa.PrivateKey
+	var pubKeys []string
+	balances := make(map[string]uint32)
+	for i := 0; i < 3; i++ {
+		privKey, pubKey := newTestKey(m, startingInk)
+		privKeys, pubKeys = append(privKeys, privKey), append(pubKeys, pubKey)
+		balances[pubKey] = startingInk
+	}
+
+	// Each candidate block adds a random rectangle on top of the chain, and
+	// is only kept if it is valid
+	canvas := m.settings.CanvasSettings
+	var rects []testRect
+	var chain, rejected []*Block
+	outcomes := make(map[string]int)
+	outcomesByBlock := make(map[*Block]string)
+	prevHash := m.settings.GenesisBlockHash
+	for i := 0; i < numCandidates; i++ {
+		owner := r.Intn(len(pubKeys))
+		x0, y0 := r.Int63n(150), r.Int63n(150)
+		if r.Intn(10) == 0 {
+			x0 = int64(canvas.CanvasXMax) - 5
+		}
+		rect := testRect{x0, y0, x0 + 1 + r.Int63n(25), y0 + 1 + r.Int63n(25), r.Intn(2) == 0, pubKeys[owner]}
+		fill := "transparent"
+		if rect.Filled {
+			fill = "red"
+		}
+
+		shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: rect.getSvg(), Fill: fill, Stroke: "red", Owner: rect.Owner}
+		testTimeStamp++
+		op := Operation{Type: ADD, Shape: shape, InkCost: rect.getCost(), TimeStamp: testTimeStamp}
+		opRecord := signTestOp(privKeys[owner], op, rect.Owner)
+		minerKey := pubKeys[r.Intn(len(pubKeys))]
+		block := newBlock(uint32(len(chain)+1), prevHash, []OperationRecord{opRecord}, minerKey, 0)
+
+		expected := "valid"
+		if rect.X1 >= int64(canvas.CanvasXMax) || rect.Y1 >= int64(canvas.CanvasYMax) {
+			expected = "out of bounds"
+		} else if rect.getCost() > balances[rect.Owner] {
+			expected = "insufficient ink"
+		} else {
+			for _, other := range rects {
+				if other.Owner != rect.Owner && other.overlaps(rect) {
+					expected = "overlap"
+					break
+				}
+			}
+		}
+		outcomes[expected]++
+
+		// The chain would diverge from the model after a mismatch
+		if got := getBlockOutcome(m.validateBlock(&block)); got != expected {
+			t.Fatal("Expected", rect, "on top of", rects, "to be", expected, "got", got)
+		} else if expected != "valid" {
+			rejected = append(rejected, &block)
+			outcomesByBlock[&block] = expected
+			continue
+		}
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+		rects = append(rects, rect)
+		balances[rect.Owner] -= rect.getCost()
+		balances[minerKey] += m.settings.InkPerOpBlock
+		chain = append(chain, &block)
+		prevHash = hashBlock(&block)
+	}
+	for _, outcome := range []string{"valid", "out of bounds", "insufficient ink", "overlap"} {
+		if outcomes[outcome] == 0 {
+			t.Error("Expected some blocks to be", outcome, "got", outcomes)
+		}
+	}
+	checkBalances := func(m *Miner) {
+		for pubKey, ink := range balances {
+			if m.inkAccounts[pubKey] != ink {
+				t.Error("Expected", pubKey[len(pubKey)-8:], "to have", ink, "ink, got", m.inkAccounts[pubKey])
+			}
+		}
+	}
+	checkBalances(m)
+
+	// The same chain synced in one go
+	newSyncingMiner := func() *Miner {
+		synced := newTestMiner()
+		for _, pubKey := range pubKeys {
+			synced.inkAccounts[pubKey] = startingInk
+		}
+		return synced
+	}
+	synced := newSyncingMiner()
+	if numApplied, err := synced.applyChain(chain, false); err != nil || numApplied != len(chain) {
+		t.Fatal("Expected the whole chain to be applied, got", numApplied, err)
+	}
+	if synced.blockchainHead != m.blockchainHead {
+		t.Error("Expected the synced chain to end at the same head")
+	}
+	checkBalances(synced)
+
+	// A rejected block must stop the sync of the chain it was built on,
+	// for the same reason
+	for _, block := range rejected[:10] {
+		numValid := int(block.BlockNo) - 1
+		branch := append(append([]*Block{}, chain[:numValid]...), block)
+		expected := outcomesByBlock[block]
+		synced = newSyncingMiner()
+		if numApplied, err := synced.applyChain(branch, false); numApplied != numValid || getBlockOutcome(err) != expected {
+			t.Error("Expected the sync to stop after", numValid, "blocks as", expected+", got", numApplied, err)
+		}
+	}
+}
+
+// Test that an op that depends on another is only selected once the
+// other is on the chain, and that a block mining it before then is invalid
+func TestOpDependency(t *testing.T) {
+	m := newTestMiner()
+	privKey, pubKey := newTestKey(m, 1000)
+
+	first := addTestShape(t, m, privKey, pubKey, "M 10 10 h 20 v 20 h -20 Z")
+	shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 100 100 h 20 v 20 h -20 Z", Fill: "red", Stroke: "red", Owner: pubKey}
+	geo, _ := shape.GetGeometry()
+	testTimeStamp++
+	op := Operation{Type: ADD, Shape: shape, InkCost: uint32(geo.GetInkCost()), TimeStamp: testTimeStamp, DependsOn: first.OpSig}
+	second := signTestOp(privKey, op, pubKey)
+	m.unminedOps[second.OpSig] = &second
+
+	selected := m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{first}, map[string]uint32{pubKey: 1000})
+
+	// Both ops in the same block don't satisfy the dependency either
+	records := []OperationRecord{first, second}
+	sortRecordsCanonically(records)
+	block := newBlock(1, m.settings.GenesisBlockHash, records, pubKey, 0)
+	if err := m.validateBlock(&block); err == nil {
+		t.Error("Expected a block with the op and its dependency to be invalid")
+	}
+
+	mined := newBlock(1, m.settings.GenesisBlockHash, selected, pubKey, 0)
+	m.insertBlock(&mined)
+	m.applyBlock(&mined)
+	delete(m.unminedOps, first.OpSig)
+	selected = m.selectOpsForBlock()
+	checkSelection(t, m, selected, []OperationRecord{second}, map[string]uint32{pubKey: 1000 - first.Op.InkCost + m.settings.InkPerOpBlock})
+
+	// Only the signatures of pruned ops are kept, which still satisfy it
+	noOp := newBlock(2, hashBlock(&mined), []OperationRecord{}, pubKey, 0)
+	m.insertBlock(&noOp)
+	m.applyBlock(&noOp)
+	m.validatedOps[first.OpSig].Op.Deleted = true
+	snapshot := m.takeSnapshot()
+	delete(m.validatedOps, first.OpSig)
+	for _, opSig := range snapshot.PrunedOps {
+		m.prunedOps[opSig] = true
+	}
+	if err := m.checkBlockOp(&second); err != nil {
+		t.Error("Expected the dependency to be met by the pruned op, got", err)
+	}
+	m.prunedOps = map[string]bool{}
+	if err := m.checkBlockOp(&second); !errors.Is(err, errorLib.DependencyError(first.OpSig)) {
+		t.Error("Expected a DependencyError without the dependency, got", err)
+	}
+}
+
+// Test that the messages and bytes exchanged with a peer are counted, and
+// served both by the admin RPC and on /metrics
+func TestPeerStats(t *testing.T) {
+	m := newTestMiner()
+	m.miners = map[string]*rpc.Client{}
+	m.peerStats = make(map[string]*peerCounters)
+	m.budget = newResourceBudget(0)
+
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{}, "", 0)
+	m.countReceived(&MinerEvent{Type: BLOCK_RECEIVED, Block: &block, Source: "peer"})
+	m.countReceived(&MinerEvent{Type: OP_RECEIVED, Source: "peer", Err: errorLib.InvalidSignatureError()})
+	m.countReceived(&MinerEvent{Type: OP_RECEIVED})
+
+	local, remote := net.Pipe()
+	conn := countingConn{local, m.getPeerCounters("peer")}
+	go func() {
+		buf := make([]byte, 5)
+		remote.Read(buf)
+		remote.Write([]byte("ok"))
+	}()
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 2))
+	conn.Close()
+
+	stats := []PeerStats{}
+	(&MinerAdmin{m}).PeerStats("", &stats)
+	if len(stats) != 1 {
+		t.Fatal("Expected the stats of one peer, got", len(stats))
+	}
+	peer := stats[0]
+	if peer.BlocksReceived != 1 || peer.OpsReceived != 1 || peer.InvalidOps != 1 || peer.InvalidBlocks != 0 {
+		t.Error("Expected a block and an invalid op received, got", peer)
+	}
+	if peer.BytesSent != 5 || peer.BytesReceived != 2 || peer.LastSeen.IsZero() || peer.Connected {
+		t.Error("Expected the connection's bytes to be counted, got", peer)
+	}
+
+	recorder := httptest.NewRecorder()
+	m.serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `blockart_peer_invalid_ops_total{peer="peer"} 1`) {
+		t.Error("Expected the invalid op on /metrics, got", recorder.Body.String())
+	}
+}
+
+// Test that a peer releasing a chain mined in private is penalized and,
+// after repeated releases, reported as withholding blocks, while a peer
+// that only wins a race for the head, or announces a chain slowly, is not
+func TestWithholding(t *testing.T) {
+	m := newTestMiner()
+	m.peerStats = make(map[string]*peerCounters)
+	m.peerSlots = map[string]*PeerSlot{"secret": &PeerSlot{score: 25}, "honest": &PeerSlot{score: 25}}
+	mainChain := mineTestBranch(m, m.settings.GenesisBlockHash, 3, true)
+
+	// Announces numBlocks blocks on top of prevHash from source, interval
+	// apart, and returns the hash of the last one
+	now := time.Now()
+	announce := func(source string, prevHash string, numBlocks int, interval time.Duration) string {
+		for i := 0; i < numBlocks; i++ {
+			block := newBlock(m.blockchain[prevHash].BlockNo+1, prevHash, []OperationRecord{}, source, uint32(i))
+			now = now.Add(interval)
+			m.recordAnnouncedBlock(source, hashBlock(&block), &block, now)
+			m.insertBlock(&block)
+			prevHash = hashBlock(&block)
+		}
+		return prevHash
+	}
+
+	// A race for the head lost by a block
+	announce("honest", mainChain[1], 2, time.Millisecond)
+	m.checkRelease("honest", 1)
+	// A chain announced a block at a time
+	announce("honest", mainChain[0], 4, 2*time.Second)
+	m.checkRelease("honest", 2)
+	if stats := m.withholding["honest"]; stats.Releases != 0 || stats.BlocksAnnounced != 6 || m.peerSlots["honest"].score != 25 {
+		t.Error("Expected no releases from the honest peer, got", stats)
+	}
+
+	// A secret chain of 4 blocks abandoning the 3 blocks of the main chain
+	announce("secret", m.settings.GenesisBlockHash, 4, time.Millisecond)
+	m.checkRelease("secret", 3)
+	stats := m.withholding["secret"]
+	if stats.Releases != 1 || stats.BlocksReleased != 4 || stats.ReorgedBlocks != 3 || stats.LongestRelease != 4 {
+		t.Error("Expected a release of 4 blocks, got", stats)
+	}
+	if stats.BlockAges != [4]uint64{1, 1, 2, 0} {
+		t.Error("Expected the released blocks to be old, got", stats.BlockAges)
+	}
+	if m.peerSlots["secret"].score != 0 {
+		t.Error("Expected the peer's score to be penalized, got", m.peerSlots["secret"].score)
+	}
+
+	for i := 0; i < 2; i++ {
+		announce("secret", m.settings.GenesisBlockHash, 4, time.Millisecond)
+		m.checkRelease("secret", 3)
+	}
+	if peer := m.getPeerStats("secret"); !peer.Withholding || peer.Releases != 3 || peer.BlocksAnnounced != 12 {
+		t.Error("Expected the peer to be reported as withholding blocks, got", peer)
+	}
+}
+
+// Test that validation is estimated from the recent block intervals, with
+// a head change of several blocks spread evenly over them
+func TestValidationEstimate(t *testing.T) {
+	m := newTestMiner()
+	m.blockIntervals = newBlockIntervalStats(3)
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{}}
+
+	request := &ArtnodeRequest{Token: "token", Payload: []interface{}{uint8(3)}}
+	response := new(MinerResponse)
+	m.GetValidationEstimate(request, response)
+	if response.Payload[0].(int64) != 0 || response.Payload[3].(uint32) != 4 || response.Payload[4].(uint32) != 0 {
+		t.Error("Expected no estimate without intervals, got", response.Payload)
+	}
+
+	start := time.Now()
+	m.blockIntervals.add(5, start)
+	m.blockIntervals.add(6, start.Add(time.Second))
+	m.blockIntervals.add(6, start.Add(2*time.Second))
+	m.blockIntervals.add(9, start.Add(10*time.Second))
+	if len(m.blockIntervals.intervals) != 3 || m.blockIntervals.intervals[2] != 3*time.Second {
+		t.Fatal("Expected the last head change to be spread over its blocks, got", m.blockIntervals.intervals)
+	}
+
+	// Intervals of 3s, 3s and 1s once the oldest are evicted
+	m.blockIntervals.add(10, start.Add(11*time.Second))
+	eta, low, high := m.blockIntervals.estimate(4)
+	expectedEta := 4 * 7 * time.Second / 3
+	if eta != expectedEta || low >= eta || high <= eta {
+		t.Error("Expected an estimate of", expectedEta, "got", eta, low, high)
+	}
+
+	response = new(MinerResponse)
+	m.GetValidationEstimate(request, response)
+	if time.Duration(response.Payload[0].(int64)) != expectedEta || response.Payload[4].(uint32) != 3 {
+		t.Error("Expected the estimate to be returned, got", response.Payload)
+	}
+}
+
+// Test that received blocks that fail validation are quarantined once each,
+// with the reason and the peer they came from, and that the oldest are
+// evicted once the quarantine is full
+// Signs an attestation of a block with the given key
+func newTestAttestation(privKey ecdsa.PrivateKey, pubKeyString string, blockHash string) Attestation {
+	r, s, _ := ecdsa.Sign(rand.Reader, &privKey, getAttestationDigest(blockHash))
+	encodedSig, _ := json.Marshal(Signature{r, s})
+	return Attestation{BlockHash: blockHash, PubKeyString: pubKeyString, Sig: string(encodedSig)}
+}
+
+// Test that miners attest to the blocks deep enough below their head, and
+// that a block becomes final once the miners of enough of its finality
+// window attested to it, however many other keys attest
+func TestFinality(t *testing.T) {
+	m := newTestMiner()
+	m.settings.FinalityDepth = 2
+	m.privKey, m.pubKeyString = newTestKey(m, 0)
+	otherKey, otherPubKey := newTestKey(m, 0)
+	_, lastPubKey := newTestKey(m, 0)
+	prevHash := m.settings.GenesisBlockHash
+	mainBranch := []string{}
+	for _, miner := range []string{otherPubKey, m.pubKeyString, lastPubKey, otherPubKey} {
+		block := newBlock(m.blockchain[prevHash].BlockNo+1, prevHash, []OperationRecord{}, miner, 0)
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+		prevHash = hashBlock(&block)
+		mainBranch = append(mainBranch, prevHash)
+	}
+
+	// The miner attests to the blocks at least two below its head, once
+	attestations := m.attestMainChain()
+	if len(attestations) != 2 || attestations[0].BlockHash != mainBranch[1] || attestations[1].BlockHash != mainBranch[0] {
+		t.Fatal("Expected attestations of blocks 2 and 1, got", len(attestations))
+	}
+	if attestations := m.attestMainChain(); len(attestations) != 0 {
+		t.Error("Expected the blocks to be attested to only once")
+	}
+
+	// Block 2's window is blocks 1 and 2, so the miner's attestation counts
+	// for the one block it mined, and keys that mined nothing count for none
+	for i := 0; i < 5; i++ {
+		sybilKey, sybilPubKey := newTestKey(m, 0)
+		if isNew, err := m.addAttestation(newTestAttestation(sybilKey, sybilPubKey, mainBranch[1])); !isNew || err != nil {
+			t.Fatal("Expected the attestation to be recorded, got", err)
+		}
+	}
+	if _, err := m.addAttestation(newTestAttestation(otherKey, lastPubKey, mainBranch[1])); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected an InvalidSignatureError, got", err)
+	}
+	r, sigS, _ := ecdsa.Sign(rand.Reader, &otherKey, []byte(mainBranch[1]))
+	undigested, _ := json.Marshal(Signature{r, sigS})
+	if _, err := m.addAttestation(Attestation{mainBranch[1], otherPubKey, string(undigested)}); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected a signature of the bare block hash to be invalid, got", err)
+	}
+	if count, quorum := m.countAttestations(mainBranch[1]), m.getFinalityQuorum(mainBranch[1]); count != 1 || quorum != 2 || m.isFinal(mainBranch[1]) || m.isFinal(mainBranch[0]) {
+		t.Error("Expected attestations for 1 of 2 blocks and no final block, got", count, quorum)
+	}
+
+	m.addAttestation(newTestAttestation(otherKey, otherPubKey, mainBranch[1]))
+	if m.finalBlock != mainBranch[1] || !m.isFinal(mainBranch[0]) || m.isFinal(mainBranch[2]) {
+		t.Error("Expected block 2 and its ancestors to be final")
+	}
+
+	// A longer chain that forks below the final block is refused, but one
+	// that forks above it is not
+	belowFinal := mineTestBranch(m, mainBranch[0], 5, false)
+	if m.isLongerChain(belowFinal[4]) {
+		t.Error("Expected a reorg past the final block to be refused")
+	}
+	aboveFinal := mineTestBranch(m, mainBranch[1], 3, false)
+	if !m.isLongerChain(aboveFinal[2]) {
+		t.Error("Expected a reorg above the final block to be allowed")
+	}
+}
+
+// Test that switching to a longer fork sent by a peer replaces the whole
+// branch it abandons: the abandoned blocks' ink is reversed and their ops
+// are unmined again, and every block of the fork is applied, not just the
+// one that made it longer
+func TestReceiveLongerFork(t *testing.T) {
+	m := newTestNode()
+	privKey, pubKey := newTestKey(m, 1000)
+	_, forkKey := newTestKey(m, 0)
+	genesisHash := m.settings.GenesisBlockHash
+
+	shape := addTestShape(t, m, privKey, pubKey, "M 10 10 h 5 v 5 h -5 Z")
+	main1 := newBlock(1, genesisHash, []OperationRecord{shape}, pubKey, 0)
+	main2 := newBlock(2, hashBlock(&main1), []OperationRecord{}, pubKey, 0)
+	for _, block := range []*Block{&main1, &main2} {
+		if err := m.receiveBlock(block, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.blockchainHead != hashBlock(&main2) || m.inkAccounts[pubKey] == 1000 {
+		t.Fatal("Expected the main chain to be applied")
+	}
+
+	// The fork's first blocks arrive while it is no longer than the main chain
+	fork := mineTestBranch(m, genesisHash, 2, false)
+	tip := newBlock(3, fork[1], []OperationRecord{}, forkKey, 0)
+	if err := m.receiveBlock(&tip, ""); err != nil {
+		t.Fatal(err)
+	}
+	if m.blockchainHead != hashBlock(&tip) {
+		t.Fatal("Expected the longer fork to become the head")
+	}
+	if m.inkAccounts[pubKey] != 1000 {
+		t.Error("Expected the abandoned blocks' ink to be reversed, got", m.inkAccounts[pubKey])
+	}
+	if m.inkAccounts[""] != 2*m.settings.InkPerNoOpBlock || m.inkAccounts[forkKey] != m.settings.InkPerNoOpBlock {
+		t.Error("Expected every block of the fork to be applied, got", m.inkAccounts[""], m.inkAccounts[forkKey])
+	}
+	if _, unmined := m.unminedOps[shape.OpSig]; !unmined {
+		t.Error("Expected the abandoned block's op to be unmined again")
+	}
+}
+
+// Test that the recommended validateNum is the deepest recent reorg, at
+// least 1 and at most what fits in a validateNum, and that stale blocks
+// are counted
+func TestValidateNumRecommendation(t *testing.T) {
+	m := newTestNode()
+	m.forkStats = newForkStats(3)
+	_, pubKey := newTestKey(m, 0)
+	_, forkKey := newTestKey(m, 0)
+	recommend := func() []interface{} {
+		response := new(MinerResponse)
+		if m.GetValidateNumRecommendation(&ArtnodeRequest{Token: "token"}, response); response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		return response.Payload
+	}
+
+	if payload := recommend(); payload[0] != uint8(1) || payload[1] != uint32(0) || payload[3] != uint32(0) || payload[5] != uint32(0) {
+		t.Error("Expected a validateNum of 1 without any head changes, got", payload)
+	}
+
+	// Three fast-forwards, then a fork that abandons two of their blocks
+	prevHash := m.settings.GenesisBlockHash
+	for blockNo := uint32(1); blockNo <= 3; blockNo++ {
+		block := newBlock(blockNo, prevHash, []OperationRecord{}, pubKey, 0)
+		if err := m.receiveBlock(&block, ""); err != nil {
+			t.Fatal(err)
+		}
+		prevHash = hashBlock(&block)
+	}
+	fork := m.blockchain[prevHash].PrevHash
+	fork = m.blockchain[fork].PrevHash
+	for blockNo := uint32(2); blockNo <= 4; blockNo++ {
+		block := newBlock(blockNo, fork, []OperationRecord{}, forkKey, 0)
+		if err := m.receiveBlock(&block, ""); err != nil {
+			t.Fatal(err)
+		}
+		fork = hashBlock(&block)
+	}
+	if m.blockchainHead != fork {
+		t.Fatal("Expected the fork to become the head")
+	}
+	payload := recommend()
+	if payload[0] != uint8(2) || payload[1] != uint32(2) || payload[2] != uint32(1) {
+		t.Error("Expected the fork's depth of 2 to be recommended, got", payload)
+	}
+	if payload[3] != uint32(3) {
+		t.Error("Expected only the last 3 head changes to be kept, got", payload[3])
+	}
+	if payload[4] != uint32(2) || payload[5] != uint32(6) {
+		t.Error("Expected 2 of the 6 known blocks to be stale, got", payload[4], payload[5])
+	}
+
+	m.forkStats.add(1000)
+	if payload := recommend(); payload[0] != uint8(math.MaxUint8) || payload[1] != uint32(1000) {
+		t.Error("Expected a deep reorg to be capped at the largest validateNum, got", payload)
+	}
+
+	response := new(MinerResponse)
+	if m.GetValidateNumRecommendation(&ArtnodeRequest{Token: "bad token"}, response); !errors.Is(response.Error, errorLib.InvalidTokenError("")) {
+		t.Error("Expected a bad token to be refused, got", response.Error)
+	}
+}
+
+// Test that a block's summary holds ink totals past what fits in a uint32,
+// and that a summary truncated to one doesn't match the block's records
+func TestBlockSummaryBoundary(t *testing.T) {
+	records := []OperationRecord{
+		{Op: Operation{Type: ADD, InkCost: math.MaxUint32}, OpSig: "a"},
+		{Op: Operation{Type: ADD, InkCost: math.MaxUint32}, OpSig: "b"},
+		{Op: Operation{Type: REMOVE, InkCost: math.MaxUint32}, OpSig: "c"},
+		{Op: Operation{Type: REMOVE, InkCost: 1}, OpSig: "d"}}
+	block := newBlock(1, "genesis", records, "", 0)
+	if block.OpCount != 4 || block.InkDebited != 2*math.MaxUint32 || block.InkCredited != math.MaxUint32+1 {
+		t.Fatal("Expected the summary to hold the untruncated totals, got", block.OpCount, block.InkDebited, block.InkCredited)
+	} else if !blockSummaryMatches(&block) {
+		t.Error("Expected the summary to match the records")
+	}
+
+	truncated := block
+	truncated.InkDebited = uint64(uint32(block.InkDebited))
+	if blockSummaryMatches(&truncated) {
+		t.Error("Expected a debit total truncated to a uint32 not to match")
+	}
+	truncated = block
+	truncated.InkCredited = uint64(uint32(block.InkCredited))
+	if blockSummaryMatches(&truncated) {
+		t.Error("Expected a credit total truncated to a uint32 not to match")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	m := newTestMiner()
+	m.quarantine = newBlockQuarantine(2)
+	privKey, pubKey := newTestKey(m, 0)
+	genesisHash := m.settings.GenesisBlockHash
+
+	poorBlock := newBlock(1, genesisHash, []OperationRecord{addTestShape(t, m, privKey, pubKey, "M 10 10 h 5 v 5 h -5 Z")}, pubKey, 0)
+	if err := m.receiveBlock(&poorBlock, "127.0.0.1:1"); !errors.Is(err, errorLib.InsufficientInkError(0)) {
+		t.Error("Expected an InsufficientInkError, got", err)
+	}
+	m.receiveBlock(&poorBlock, "127.0.0.1:2")
+
+	skippedBlock := newBlock(5, genesisHash, []OperationRecord{}, pubKey, 0)
+	if err := m.receiveBlock(&skippedBlock, "127.0.0.1:2"); !errors.Is(err, errorLib.ValidationError(hashBlock(&skippedBlock))) {
+		t.Error("Expected a ValidationError, got", err)
+	}
+
+	var blocks []QuarantinedBlock
+	(&MinerAdmin{m}).Quarantine("", &blocks)
+	if len(blocks) != 2 || blocks[0].Hash != hashBlock(&skippedBlock) || blocks[1].Hash != hashBlock(&poorBlock) {
+		t.Fatal("Expected both blocks once, newest first, got", blocks)
+	}
+	if blocks[1].Source != "127.0.0.1:1" || !strings.Contains(blocks[1].Reason, "Not enough ink") {
+		t.Error("Expected the first sender and the op's error, got", blocks[1].Source, blocks[1].Reason)
+	}
+	if !strings.Contains(blocks[0].Reason, "doesn't follow its parent") {
+		t.Error("Expected the block number to be blamed, got", blocks[0].Reason)
+	}
+	if _, exists := m.blockchain[hashBlock(&poorBlock)]; exists {
+		t.Error("Expected the invalid block not to be added")
+	}
+
+	unorderedBlock := newBlock(1, genesisHash, []OperationRecord{}, pubKey, 0)
+	unorderedBlock.OpCount = 1
+	m.receiveBlock(&unorderedBlock, "")
+	blocks = m.quarantine.list()
+	if len(blocks) != 2 || blocks[0].Hash != hashBlock(&unorderedBlock) || blocks[1].Hash != hashBlock(&skippedBlock) {
+		t.Error("Expected the oldest block to be evicted, got", blocks)
+	}
+
+	m.quarantine = newBlockQuarantine(0)
+	m.receiveBlock(&poorBlock, "127.0.0.1:1")
+	if len(m.quarantine.list()) != 0 {
+		t.Error("Expected an empty quarantine to keep no blocks")
+	}
+}
+
+func TestResourceBudget(t *testing.T) {
+	m := newTestMiner()
+	m.budget = newResourceBudget(0)
+	m.receipts = newOpReceiptLog(MAX_RECEIPT_LOG_OPS)
+	m.rejections = newOpRejectionLog(MAX_REJECTION_LOG_OPS)
+	m.quarantine = newBlockQuarantine(DEFAULT_QUARANTINE_BLOCKS)
+	m.peerMempools = make(map[string]MempoolSummary)
+	var ownKey ecdsa.PrivateKey
+	ownKey, m.pubKeyString = newTestKey(m, 1000)
+	peerKey, peerPubKey := newTestKey(m, 1000)
+
+	ownOp := addTestShape(t, m, ownKey, m.pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	failedOp := addTestShape(t, m, peerKey, peerPubKey, "M 20 0 h 10 v 10 h -10 Z")
+	delete(m.unminedOps, failedOp.OpSig)
+	m.failedOps[failedOp.OpSig] = &failedOp
+	oldPeerOp := addTestShape(t, m, peerKey, peerPubKey, "M 40 0 h 10 v 10 h -10 Z")
+	newPeerOp := addTestShape(t, m, peerKey, peerPubKey, "M 60 0 h 10 v 10 h -10 Z")
+	m.receipts.add("peer", []string{oldPeerOp.OpSig}, time.Now())
+	m.recordOpRejection(failedOp.OpSig, "peer", "ShapeOverlapError(shape)")
+	m.peerMempools["peer"] = MempoolSummary{NumOps: 1, OpSigs: []string{newPeerOp.OpSig}}
+	m.quarantine.add(&Block{BlockNo: 5, PrevHash: "genesis"}, "invalid", "peer", time.Now())
+
+	// Without a limit the pools are only measured
+	if freed := m.enforceResourceBudget(); freed != 0 || len(m.unminedOps) != 3 {
+		t.Fatal("Expected nothing to be evicted without a limit, freed", freed)
+	}
+	usage, total := m.getResourceUsage()
+	for _, pool := range []string{"peer_queues", "receipts", "rejections", "quarantine", "failed_ops", "unmined_ops", "own_ops"} {
+		if usage[pool] <= 0 {
+			t.Error("Expected the", pool, "pool to be measured, got", usage[pool])
+		}
+	}
+
+	// Room for everything but the logs, the quarantine, the failed op and
+	// the oldest of the other miner's ops
+	kept := usage["own_ops"] + usage["geometries"] + usage["chain"] + ENTRY_OVERHEAD + getOpRecordSize(&newPeerOp)
+	m.budget.limit = kept
+	if freed := m.enforceResourceBudget(); freed != total-kept {
+		t.Error("Expected", total-kept, "bytes to be freed, freed", freed)
+	}
+	if len(m.peerMempools) != 0 || m.receipts.get(oldPeerOp.OpSig) != nil || len(m.rejections.order) != 0 || len(m.quarantine.list()) != 0 || len(m.failedOps) != 0 {
+		t.Error("Expected the peer queues, logs, quarantine and failed ops to be evicted")
+	}
+	if len(m.unminedOps) != 2 || m.unminedOps[ownOp.OpSig] == nil || m.unminedOps[newPeerOp.OpSig] == nil {
+		t.Error("Expected only the oldest of the other miner's ops to be evicted, got", len(m.unminedOps), "ops")
+	}
+	if m.budget.evictions["unmined_ops"] != 1 || m.budget.evictions["failed_ops"] != 1 {
+		t.Error("Expected the evictions to be counted, got", m.budget.evictions)
+	}
+	if usage, total = m.getResourceUsage(); total != kept {
+		t.Error("Expected the usage to be within the budget, got", total, usage)
+	}
+
+	// The miner's own ops are never evicted
+	m.budget.limit = 1
+	m.enforceResourceBudget()
+	if len(m.unminedOps) != 1 || m.unminedOps[ownOp.OpSig] == nil {
+		t.Error("Expected only the miner's own op to be left, got", len(m.unminedOps), "ops")
+	}
+
+	m.miners = map[string]*rpc.Client{}
+	m.peerStats = make(map[string]*peerCounters)
+	recorder := httptest.NewRecorder()
+	m.serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `blockart_memory_evictions_total{pool="unmined_ops"} 2`) {
+		t.Error("Expected the evictions on /metrics, got", recorder.Body.String())
+	}
+}
+
+// Test that the shapes of a block's ops occupy the canvas while the block
+// is on the chain, and are vacated when a reorg abandons it
+func TestCanvasOccupancyReorg(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+
+	first := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 20 v 20 h -20 Z")
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{first}, pubKey1, 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	if _, exists := m.occupancy.Get(first.OpSig); !exists {
+		t.Fatal("Expected the block's shape to occupy the canvas")
+	}
+
+	overlapping := addTestShape(t, m, privKey2, pubKey2, "M 20 20 h 20 v 20 h -20 Z")
+	if err := m.checkBlockOp(&overlapping); !errors.Is(err, errorLib.ShapeOverlapError(first.OpSig)) {
+		t.Error("Expected a ShapeOverlapError, got", err)
+	}
+
+	fork := mineTestBranch(m, m.settings.GenesisBlockHash, 2, false)
+	m.changeBlockchainHead(m.blockchainHead, fork[1])
+	if m.occupancy.Len() != 0 {
+		t.Error("Expected the abandoned block's shape to be vacated, got", m.occupancy.Len(), "shapes")
+	}
+	if err := m.checkBlockOp(&overlapping); err != nil {
+		t.Error("Expected the shape to fit once the block is abandoned, got", err)
+	}
+}
+
+// Test that keys are read from a key file as keygen writes it, and that a
+// file without a matching private key is refused
+func TestLoadKeys(t *testing.T) {
+	m := newTestMiner()
+	privKey, pubKey := newTestKey(m, 0)
+	otherPrivKey, _ := newTestKey(m, 0)
+	privBytes, _ := x509.MarshalECPrivateKey(&privKey)
+	otherPrivBytes, _ := x509.MarshalECPrivateKey(&otherPrivKey)
+
+	m.keyFile = filepath.Join(t.TempDir(), "keys")
+	ioutil.WriteFile(m.keyFile, []byte(pubKey+"\r\n"+hex.EncodeToString(privBytes)), 0644)
+	pubKeyString, loaded, err := m.loadKeys(nil)
+	if err != nil || pubKeyString != pubKey || loaded.D.Cmp(privKey.D) != 0 {
+		t.Fatal("Expected the file's keypair, got", pubKeyString, err)
+	}
+
+	ioutil.WriteFile(m.keyFile, []byte(pubKey+"\r\n"+hex.EncodeToString(otherPrivBytes)), 0644)
+	if _, _, err = m.loadKeys(nil); err == nil {
+		t.Error("Expected keys that don't match to be refused")
+	}
+	ioutil.WriteFile(m.keyFile, []byte(pubKey), 0644)
+	if _, _, err = m.loadKeys(nil); err == nil {
+		t.Error("Expected a file without a private key to be refused")
+	}
+
+	m.keyFile = ""
+	if pubKeyString, _, err = m.loadKeys([]string{pubKey, hex.EncodeToString(privBytes)}); err != nil || pubKeyString != pubKey {
+		t.Error("Expected the given keypair, got", pubKeyString, err)
+	}
+}
+
+// Test that a soft restart reads the key file again and drops its peers
+// before registering with the server again, and keeps its chain when the
+// server can't be reached
+func TestSoftRestart(t *testing.T) {
+	m := newTestMiner()
+	m.privKey, m.pubKeyString = newTestKey(m, 0)
+	m.pubKey = m.privKey.PublicKey
+	mineTestBranch(m, m.settings.GenesisBlockHash, 2, true)
+	head := m.blockchainHead
+
+	local, _ := net.Pipe()
+	m.miners = map[string]*rpc.Client{"peer": rpc.NewClient(local)}
+	m.peerSlots = map[string]*PeerSlot{"peer": &PeerSlot{}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.serverAddr = listener.Addr().String()
+	listener.Close()
+
+	newPrivKey, newPubKey := newTestKey(m, 0)
+	privBytes, _ := x509.MarshalECPrivateKey(&newPrivKey)
+	m.keyFile = filepath.Join(t.TempDir(), "keys")
+	ioutil.WriteFile(m.keyFile, []byte(newPubKey+"\r\n"+hex.EncodeToString(privBytes)), 0644)
+
+	result, err := m.softRestart()
+	if !errors.Is(err, errorLib.DisconnectedError(m.serverAddr)) {
+		t.Error("Expected a DisconnectedError, got", err)
+	}
+	if !result.KeyChanged || m.pubKeyString != newPubKey || m.privKey.D.Cmp(newPrivKey.D) != 0 {
+		t.Error("Expected the new keypair to be read, got", result)
+	}
+	if len(m.miners) != 0 || len(m.peerSlots) != 0 {
+		t.Error("Expected the peers to be dropped, got", len(m.miners))
+	}
+	if m.blockchainHead != head {
+		t.Error("Expected the chain to be kept")
+	}
+
+	ioutil.WriteFile(m.keyFile, []byte(newPubKey), 0644)
+	if _, err = m.softRestart(); err == nil || m.pubKeyString != newPubKey {
+		t.Error("Expected a bad key file to be refused before anything changes, got", err)
+	}
+}
+
+// Test that a miner receives the blocks it is missing from the longest
+// chain among its peers
+func TestCatchUpWithPeers(t *testing.T) {
+	registerGobTypes()
+	peer := newTestMiner()
+	peer.events = newEventBus(EVENT_INBOX_SIZE)
+	peer.peerStats = make(map[string]*peerCounters)
+	go peer.applyEvents()
+	// No-op blocks are mined without records, which is how they are sent
+	var chain []*Block
+	prevHash := peer.settings.GenesisBlockHash
+	for i := 0; i < 4; i++ {
+		block := newBlock(uint32(i+1), prevHash, nil, "", 0)
+		peer.insertBlock(&block)
+		peer.applyBlock(&block)
+		chain = append(chain, &block)
+		prevHash = hashBlock(&block)
+	}
+
+	server := rpc.NewServer()
+	server.Register(peer)
+
+	m := newTestMiner()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	m.miners = map[string]*rpc.Client{"peer": serveTestPipe(t, server.ServeConn)}
+	m.peerLatencies = make(map[string]time.Duration)
+	m.peerMempools = make(map[string]MempoolSummary)
+	m.peerStats = make(map[string]*peerCounters)
+	m.forkStats = newForkStats(MAX_FORK_STATS_HEAD_CHANGES)
+	m.blockIntervals = newBlockIntervalStats(MAX_BLOCK_INTERVALS)
+	m.events = newEventBus(EVENT_INBOX_SIZE)
+	m.insertBlock(chain[0])
+	m.applyBlock(chain[0])
+
+	if numReceived := m.catchUpWithPeers(); numReceived != 3 || m.blockchainHead != prevHash {
+		t.Error("Expected the 3 missing blocks to be received, got", numReceived)
+	}
+	if numReceived := m.catchUpWithPeers(); numReceived != 0 {
+		t.Error("Expected nothing to catch up on, got", numReceived)
+	}
+}
+
+// Creates a test miner with its own key and everything its RPCs and
+// mining loop use, applying received events
+func newTestNode() *Miner {
+	m := newTestMiner()
+	m.initState()
+	m.privKey, m.pubKeyString = newTestKey(m, 0)
+	m.pubKey = m.privKey.PublicKey
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	m.tokens["token"] = &ArtnodeSession{Created: time.Now()}
+	// Tests gossip without sealing their messages, so only
+	// TestGossipReplayGuard guards against replays
+	m.replayGuard = nil
+	m.quarantine = newBlockQuarantine(DEFAULT_QUARANTINE_BLOCKS)
+	m.updateReadReplica()
+	go m.applyEvents()
+	return m
+}
+
+// Test that a miner mining while art nodes add shapes, a peer gossips ops
+// and a competing chain, and peers poll its chain, ends up with the state
+// its own chain implies
+func TestConcurrentTraffic(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	for _, minerAddr := range []string{"peer1", "peer2"} {
+		server := rpc.NewServer()
+		server.Register(newTestNode())
+		m.miners[minerAddr] = serveTestPipe(t, server.ServeConn)
+	}
+
+	privKey, pubKey := newTestKey(m, 100000)
+	replayed := newTestMiner()
+	replayed.inkAccounts[pubKey] = 100000
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				f(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		m.mineBlock()
+	})
+	run(func(i int) {
+		request := &ArtnodeRequest{Token: "token", Payload: []interface{}{uint8(0), int(shapelib.PATH), fmt.Sprintf("M %d 500 h 5 v 5 h -5 Z", 10*i), "transparent", "red"}}
+		m.AddShape(request, new(MinerResponse))
+		m.GetInk(&ArtnodeRequest{Token: "token"}, new(MinerResponse))
+	})
+	run(func(i int) {
+		shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: fmt.Sprintf("M %d 10 h 5 v 5 h -5 Z", 10*i), Fill: "red", Stroke: "red", Owner: pubKey}
+		op := Operation{Type: ADD, Shape: shape, InkCost: 30, TimeStamp: int64(i + 1)}
+		opRecord := signTestOp(privKey, op, pubKey)
+		m.SendOp(&MinerRequest{Payload: []interface{}{opRecord, "peer1"}}, new(MinerResponse))
+	})
+	prevHash := m.settings.GenesisBlockHash
+	run(func(i int) {
+		block := newBlock(uint32(i+1), prevHash, nil, pubKey, uint32(i))
+		m.SendBlock(&MinerRequest{Payload: []interface{}{block, "peer1"}}, new(MinerResponse))
+		prevHash = hashBlock(&block)
+	})
+	run(func(i int) {
+		m.GetBlockChainLength(new(MinerRequest), new(MinerResponse))
+		m.GetBlockChain(new(MinerRequest), new(MinerResponse))
+	})
+	wg.Wait()
+
+	// Replaying the miner's chain must give the same ink
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var chain []*Block
+	for blockHash := m.blockchainHead; blockHash != m.settings.GenesisBlockHash; blockHash = m.blockchain[blockHash].PrevHash {
+		chain = append([]*Block{m.blockchain[blockHash]}, chain...)
+	}
+	if numApplied, err := replayed.applyChain(chain, false); err != nil || numApplied != len(chain) {
+		t.Fatal("Expected the miner's chain to be valid, got", numApplied, err)
+	}
+	for _, key := range []string{m.pubKeyString, pubKey} {
+		if replayed.inkAccounts[key] != m.inkAccounts[key] {
+			t.Error("Expected", replayed.inkAccounts[key], "ink, got", m.inkAccounts[key])
+		}
+	}
+	if len(chain) < 20 {
+		t.Error("Expected at least 20 blocks, got", len(chain))
+	}
+}
+
+// A peer that predates GetBlockHeaders and GetBlockBodies
+type legacyPeer struct {
+	m *Miner
+}
+
+func (p legacyPeer) GetBlockChain(request *MinerRequest, response *MinerResponse) error {
+	return p.m.GetBlockChain(request, response)
+}
+
+// Test that a chain's bodies are downloaded from every peer that has them,
+// that bodies that don't match their headers are downloaded again from
+// another peer or else end the chain, and that a peer that can't send
+// headers sends its whole chain
+func TestDownloadChain(t *testing.T) {
+	registerGobTypes()
+	peer := newTestMiner()
+	var hashes []string
+	prevHash := peer.settings.GenesisBlockHash
+	for i := 0; i < 2*SYNC_CHUNK_BLOCKS+5; i++ {
+		block := newBlock(uint32(i+1), prevHash, nil, "", uint32(i))
+		peer.insertBlock(&block)
+		peer.applyBlock(&block)
+		prevHash = hashBlock(&block)
+		hashes = append(hashes, prevHash)
+	}
+
+	// The liar's block in the middle chunk has a body that isn't its own,
+	// and the short peer only has the first chunk
+	liar := newTestMiner()
+	short := newTestMiner()
+	for i, blockHash := range hashes {
+		block := *peer.blockchain[blockHash]
+		liar.blockchain[blockHash] = &block
+		if i == SYNC_CHUNK_BLOCKS+1 {
+			liar.blockchain[blockHash] = &Block{BlockNo: block.BlockNo, PrevHash: block.PrevHash, Records: []OperationRecord{{OpSig: "forged"}}}
+		}
+		if i < SYNC_CHUNK_BLOCKS {
+			short.insertBlock(&block)
+			short.applyBlock(&block)
+		}
+	}
+
+	servePeer := func(rcvr interface{}) *rpc.Client {
+		server := rpc.NewServer()
+		server.RegisterName("Miner", rcvr)
+		return serveTestPipe(t, server.ServeConn)
+	}
+	m := newTestMiner()
+	m.miners = map[string]*rpc.Client{"peer": servePeer(peer), "liar": servePeer(liar), "short": servePeer(short), "legacy": servePeer(legacyPeer{peer})}
+	m.peerLatencies = make(map[string]time.Duration)
+	checkChain := func(chain []*Block, length int) {
+		if len(chain) != length {
+			t.Fatal("Expected", length, "blocks, got", len(chain))
+		}
+		for i, block := range chain {
+			if hashBlock(block) != hashes[i] {
+				t.Fatal("Expected block", i+1, "of the chain, got", block)
+			}
+		}
+	}
+
+	// The liar is asked for the middle chunk first
+	peers := PairList{{"liar", len(hashes)}, {"peer", len(hashes)}, {"short", SYNC_CHUNK_BLOCKS}}
+	chain, err := m.downloadChain("peer", peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(chain, len(hashes))
+
+	// Without another peer that has it, the middle chunk ends the chain
+	chain, _ = m.downloadChain("peer", PairList{{"liar", len(hashes)}, {"short", SYNC_CHUNK_BLOCKS}})
+	checkChain(chain, SYNC_CHUNK_BLOCKS)
+
+	// Blocks already in the blocktree aren't downloaded again
+	for _, blockHash := range hashes[:SYNC_CHUNK_BLOCKS] {
+		m.insertBlock(peer.blockchain[blockHash])
+	}
+	chain, _ = m.downloadChain("peer", PairList{})
+	checkChain(chain, SYNC_CHUNK_BLOCKS)
+
+	m = newTestMiner()
+	m.miners = map[string]*rpc.Client{"legacy": servePeer(legacyPeer{peer})}
+	m.peerLatencies = make(map[string]time.Duration)
+	chain, err = m.downloadChain("legacy", PairList{{"legacy", len(hashes)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChain(chain, len(hashes))
+}
+
+// Test that ops drafted and signed by blockartlib are accepted and gossiped
+// by a miner whose key didn't sign them, and that ops which don't match
+// their signature or encoding are rejected
+func TestSubmitSignedOp(t *testing.T) {
+	m := newTestNode()
+	privKey, pubKey := newTestKey(m, 1000)
+	settings := blockartlib.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+	submit := func(token string, signedOp blockartlib.SignedOp) *MinerResponse {
+		response := new(MinerResponse)
+		request := &ArtnodeRequest{Token: token, Payload: []interface{}{signedOp.EncodedOp, signedOp.OpSig, signedOp.PubKeyString}}
+		m.SubmitSignedOp(request, response)
+		return response
+	}
+
+	signedOp, err := blockartlib.DraftShape(privKey, settings, 2, blockartlib.PATH, "M 0 0 h 10 v 10 h -10 Z", "red", "red")
+	if err != nil {
+		t.Fatal(err)
+	} else if response := submit("token", signedOp); response.Error != nil || response.Payload[0] != signedOp.OpSig {
+		t.Fatal("signed op wasn't accepted", response.Error)
+	} else if opRecord := m.unminedOps[signedOp.OpSig]; opRecord == nil || opRecord.PubKeyString != pubKey || opRecord.Op.InkCost != 110 {
+		t.Fatal("signed op isn't unmined", opRecord)
+	} else if _, err := blockartlib.DraftShape(privKey, settings, 2, blockartlib.PATH, "M 1020 0 h 10 v 10 h -10 Z", "red", "red"); !errors.Is(err, errorLib.OutOfBoundsError("")) {
+		t.Fatal("shape out of bounds was drafted", err)
+	}
+
+	if response := submit("bad token", signedOp); !errors.Is(response.Error, errorLib.InvalidTokenError("bad token")) {
+		t.Fatal("op submitted with a bad token", response.Error)
+	}
+
+	// An op signed by another key than the one it claims
+	signedOp, _ = blockartlib.DraftShape(privKey, settings, 2, blockartlib.PATH, "M 100 0 h 10 v 10 h -10 Z", "red", "red")
+	otherKey, _ := newTestKey(m, 1000)
+	forged, _ := blockartlib.DraftShape(otherKey, settings, 2, blockartlib.PATH, "M 100 0 h 10 v 10 h -10 Z", "red", "red")
+	forged.EncodedOp, forged.PubKeyString = signedOp.EncodedOp, signedOp.PubKeyString
+	if response := submit("token", forged); !errors.Is(response.Error, errorLib.InvalidSignatureError()) {
+		t.Fatal("forged op was accepted", response.Error)
+	}
+
+	// The same op, signed as encoded, but not as the miners encode it
+	var op map[string]interface{}
+	json.Unmarshal([]byte(signedOp.EncodedOp), &op)
+	encodedOp, _ := json.Marshal(op)
+	r, s, _ := ecdsa.Sign(rand.Reader, &privKey, oplib.Digest(encodedOp))
+	encodedSig, _ := json.Marshal(Signature{r, s})
+	reordered := blockartlib.SignedOp{EncodedOp: string(encodedOp), OpSig: string(encodedSig), PubKeyString: pubKey}
+	if response := submit("token", reordered); !errors.Is(response.Error, errorLib.ValidationError(reordered.OpSig)) {
+		t.Fatal("non-canonical op was accepted", response.Error)
+	}
+
+	// A shape paid for by the signer but owned by someone else
+	var stolen Operation
+	json.Unmarshal([]byte(signedOp.EncodedOp), &stolen)
+	stolen.Shape.Owner = m.pubKeyString
+	encodedOp, _ = json.Marshal(stolen)
+	r, s, _ = ecdsa.Sign(rand.Reader, &privKey, oplib.Digest(encodedOp))
+	encodedSig, _ = json.Marshal(Signature{r, s})
+	if response := submit("token", blockartlib.SignedOp{EncodedOp: string(encodedOp), OpSig: string(encodedSig), PubKeyString: pubKey}); !errors.Is(response.Error, errorLib.ValidationError(string(encodedSig))) {
+		t.Fatal("shape owned by another key was accepted", response.Error)
+	}
+
+	if response := submit("token", signedOp); response.Error != nil {
+		t.Fatal("signed op wasn't accepted", response.Error)
+	} else if len(m.unminedOps) != 2 || len(m.tokens["token"].OpSigs) != 2 {
+		t.Fatal("wrong unmined ops", len(m.unminedOps), len(m.tokens["token"].OpSigs))
+	}
+}
+
+// Test that the supply stats account for every unit of ink the keys hold,
+// follow the head to another branch, and are worked out the same from a
+// snapshot
+func TestSupplyStats(t *testing.T) {
+	m := newTestMiner()
+	m.settings.InkPerNoOpBlock = 1000
+	m.tokens = map[string]*ArtnodeSession{"token": &ArtnodeSession{}}
+	privKey, pubKeyString := newTestKey(m, 0)
+	getStats := func() []interface{} {
+		response := new(MinerResponse)
+		m.GetSupplyStats(&ArtnodeRequest{Token: "token"}, response)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		return response.Payload
+	}
+
+	// All of the key's ink is minted
+	rewardBlock := newBlock(1, m.settings.GenesisBlockHash, nil, pubKeyString, 0)
+	m.insertBlock(&rewardBlock)
+	m.applyBlock(&rewardBlock)
+
+	expiring := addTestShape(t, m, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	expiring.Op.ExpiryBlocks = 2
+	visible := addTestShape(t, m, privKey, pubKeyString, "M 20 0 h 10 v 10 h -10 Z")
+	deleted := addTestShape(t, m, privKey, pubKeyString, "M 40 0 h 10 v 10 h -10 Z")
+	block := newBlock(2, hashBlock(&rewardBlock), []OperationRecord{expiring, visible, deleted}, "", 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	forkPoint := hashBlock(&block)
+
+	removal := deleted
+	removal.Op = Operation{Type: REMOVE, Shape: deleted.Op.Shape, Ref: deleted.OpSig, InkCost: deleted.Op.InkCost, TimeStamp: deleted.Op.TimeStamp + 1}
+	removal.OpSig = "removal"
+	removalBlock := newBlock(3, forkPoint, []OperationRecord{removal}, "", 0)
+	m.insertBlock(&removalBlock)
+	m.applyBlock(&removalBlock)
+	// The expiring shape expires at block 4
+	mainChain := mineTestBranch(m, hashBlock(&removalBlock), 2, true)
+
+	stats := getStats()
+	expected := []interface{}{mainChain[1], uint32(2), uint32(3), uint64(3100), uint64(330), uint64(110), uint64(110), uint64(55), uint64(110), uint64(3100 - 330 + 110 + 55), uint32(2)}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Error("Expected stat", i, "to be", expected[i], "got", stats[i])
+		}
+	}
+
+	// The restored ledger is worked out from the headers and the accounts
+	snapshot := m.takeSnapshot()
+	restored := []string{}
+	for currHash := m.blockchainHead; currHash != m.settings.GenesisBlockHash; currHash = m.blockchain[currHash].PrevHash {
+		restored = append(restored, currHash)
+	}
+	chainOps := []OperationRecord{}
+	for _, storedOp := range append(snapshot.ValidatedOps, snapshot.UnvalidatedOps...) {
+		chainOps = append(chainOps, storedOp.Record)
+	}
+	if ledger := m.getRestoredLedger(restored, chainOps); ledger != m.ledgers[m.blockchainHead] {
+		t.Error("Expected the restored ledger to be", m.ledgers[m.blockchainHead], "got", ledger)
+	}
+
+	// A longer branch without the removal, where the shape still expires
+	fork := mineTestBranch(m, forkPoint, 4, false)
+	m.changeBlockchainHead(m.blockchainHead, fork[3])
+	stats = getStats()
+	expected = []interface{}{fork[3], uint32(1), uint32(5), uint64(5050), uint64(330), uint64(0), uint64(110), uint64(55), uint64(220), uint64(5050 - 330 + 55), uint32(2)}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Error("Expected stat", i, "on the fork to be", expected[i], "got", stats[i])
+		}
+	}
+}
+
+// Test that the mining workers split a batch of nonces between them, stop
+// once one finds a solution, and that a miner with several workers mines a
+// block meeting the difficulty
+func TestSearchNonces(t *testing.T) {
+	workers := newMiningWorkers(4)
+	block := newBlock(1, "genesis", nil, "", 1000)
+
+	// No hash ends in 32 zeroes, so every nonce of the batch is tried once
+	if _, found := searchNonces(block, 32, workers); found {
+		t.Fatal("Expected no solution")
+	}
+	for i, worker := range workers {
+		if worker.hashes != uint64(MINING_BATCH_NONCES) || worker.getHashRate() <= 0 {
+			t.Error("Expected worker", i, "to hash a full batch, got", worker.hashes, worker.getHashRate())
+		}
+	}
+
+	solved, found := searchNonces(block, 2, workers)
+	if !found || !strings.HasSuffix(hashBlock(&solved), "00") {
+		t.Fatal("Expected a solution, got", found, hashBlock(&solved))
+	} else if solved.Nonce < 1000 || solved.Nonce >= 1000+4*MINING_BATCH_NONCES {
+		t.Error("Expected the nonce to be in the batch, got", solved.Nonce)
+	}
+
+	m := newTestNode()
+	m.settings.PoWDifficultyNoOpBlock = 2
+	m.miningWorkers = newMiningWorkers(4)
+	m.mineBlock()
+	if head := m.blockchain[m.blockchainHead]; head.BlockNo != 1 || !strings.HasSuffix(m.blockchainHead, "00") {
+		t.Error("Expected a block to be mined, got", head.BlockNo, m.blockchainHead)
+	}
+}
+
+// Test that op blocks are held to the op block difficulty and no-op blocks
+// to the no-op block difficulty, whether mined or received
+func TestPoWDifficultyByBlockType(t *testing.T) {
+	m := newTestNode()
+	m.settings.PoWDifficultyNoOpBlock = 1
+	m.settings.PoWDifficultyOpBlock = 3
+	privKey, pubKeyString := newTestKey(m, 1000)
+	drawn := addTestShape(t, m, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	delete(m.unminedOps, drawn.OpSig)
+
+	// An op block whose hash only meets the no-op block difficulty is invalid
+	opBlock := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn}, "", 0)
+	for blockHash := hashBlock(&opBlock); !strings.HasSuffix(blockHash, "0") || strings.HasSuffix(blockHash, "000"); blockHash = hashBlock(&opBlock) {
+		opBlock.Nonce++
+	}
+	if err := m.validateBlock(&opBlock); !errors.Is(err, errorLib.ValidationError("")) {
+		t.Error("Expected an op block at the no-op block difficulty to be invalid, got", err)
+	}
+
+	solved, found := searchNonces(opBlock, m.getPoWDifficulty(len(opBlock.Records)), newMiningWorkers(2))
+	for !found {
+		opBlock.Nonce += 2 * MINING_BATCH_NONCES
+		solved, found = searchNonces(opBlock, m.getPoWDifficulty(len(opBlock.Records)), newMiningWorkers(2))
+	}
+	if err := m.validateBlock(&solved); err != nil {
+		t.Error("Expected an op block at the op block difficulty to be valid, got", err)
+	}
+
+	noOpBlock := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{}, "", 0)
+	for blockHash := hashBlock(&noOpBlock); !strings.HasSuffix(blockHash, "0") || strings.HasSuffix(blockHash, "00"); blockHash = hashBlock(&noOpBlock) {
+		noOpBlock.Nonce++
+	}
+	if err := m.validateBlock(&noOpBlock); err != nil {
+		t.Error("Expected a no-op block at the no-op block difficulty to be valid, got", err)
+	}
+	if work := m.blockWork(&solved); work != 16*16*16 {
+		t.Error("Expected the op block's work to be", 16*16*16, "got", work)
+	} else if work := m.blockWork(&noOpBlock); work != 16 {
+		t.Error("Expected the no-op block's work to be", 16, "got", work)
+	}
+
+	if m.blockSuccessfullyMined(&opBlock) {
+		t.Error("Expected the op block at the no-op block difficulty not to count as mined")
+	} else if !m.blockSuccessfullyMined(&solved) || m.blockchainHead != hashBlock(&solved) {
+		t.Error("Expected the op block at the op block difficulty to be mined")
+	}
+}
+
+// Test that blocks and ops a peer already sent, or sent before it last
+// started, are dropped, while ones arriving a little out of order aren't,
+// and that messages not sealed by the miner registered for their source
+// are dropped
+func TestGossipReplayGuard(t *testing.T) {
+	peer, other := newTestNode(), newTestNode()
+	registry := newMinerRegistry()
+	registry.keys["a"] = getRegisteredKey(peer.pubKeyString)
+	registry.keys["b"] = getRegisteredKey(other.pubKeyString)
+	registry.fetched = time.Now()
+	g := newGossipReplayGuard(registry)
+
+	block := newBlock(1, peer.settings.GenesisBlockHash, []OperationRecord{}, "", 0)
+	blockHash := hashBlock(&block)
+	seal := func(sender *Miner, source string, epoch int64, seq uint64) *MinerRequest {
+		request := &MinerRequest{Payload: []interface{}{block, source}}
+		sender.gossipEpoch, sender.gossipSeq = epoch, seq-1
+		sender.sealGossip(request)
+		return request
+	}
+	accepts := []struct {
+		epoch    int64
+		seq      uint64
+		accepted bool
+	}{
+		{1, 5, true},
+		{1, 5, false},
+		{1, 3, true},
+		{1, 3, false},
+		{1, 70, true},
+		{1, 6, false},
+		{1, 7, true},
+		{0, 100, false},
+		{2, 1, true},
+		{2, 2, true},
+	}
+	for _, test := range accepts {
+		if accepted := g.accept("a", seal(peer, "a", test.epoch, test.seq), blockHash); accepted != test.accepted {
+			t.Error("Expected message", test.epoch, test.seq, "accepted", test.accepted, "got", accepted)
+		}
+	}
+	if !g.accept("b", seal(other, "b", 1, 5), blockHash) || g.getReplayed("a") != 4 || g.getReplayed("b") != 0 {
+		t.Error("Expected only a's replays to be counted, got", g.getReplayed("a"), g.getReplayed("b"))
+	}
+
+	stripped := seal(peer, "a", 2, 3)
+	stripped.Epoch, stripped.Seq, stripped.PubKeyString, stripped.EnvelopeSig = 0, 0, "", ""
+	renumbered := seal(peer, "a", 2, 4)
+	renumbered.Seq = 5
+	unsealed := map[string]*MinerRequest{
+		"stripped envelope":           stripped,
+		"renumbered message":          renumbered,
+		"message as another peer":     seal(other, "a", 2, 6),
+		"message from unknown source": seal(peer, "c", 2, 7),
+		"message without source":      seal(peer, "", 2, 8),
+	}
+	for name, request := range unsealed {
+		source, _ := request.Payload[1].(string)
+		if g.accept(source, request, blockHash) {
+			t.Error("Expected a " + name + " to be dropped")
+		}
+	}
+	if g.accept("a", seal(peer, "a", 2, 3), "other content") {
+		t.Error("Expected a message for other content to be dropped")
+	}
+	if g.getReplayed("a") != 4 {
+		t.Error("Expected unsealed messages not to be counted as replays, got", g.getReplayed("a"))
+	}
+	var none *GossipReplayGuard
+	if !none.accept("a", stripped, blockHash) || !none.accept("a", stripped, blockHash) {
+		t.Error("Expected a nil guard to let everything through")
+	}
+
+	// A replayed or unsealed block never reaches validation
+	m := newTestNode()
+	m.replayGuard = g
+	m.settings.PoWDifficultyNoOpBlock = 0
+	registry.keys["peer"] = getRegisteredKey(peer.pubKeyString)
+	request := seal(peer, "peer", 1, 1)
+	for i := 0; i < 2; i++ {
+		if err := m.SendBlock(request, new(MinerResponse)); err != nil {
+			t.Fatal("Expected the block to be accepted, got", err)
+		}
+	}
+	child := newBlock(2, blockHash, []OperationRecord{}, "", 0)
+	m.SendBlock(&MinerRequest{Payload: []interface{}{child, "peer"}}, new(MinerResponse))
+	m.lock.Lock()
+	head, stats := m.blockchainHead, m.getPeerStats("peer")
+	m.lock.Unlock()
+	if _, blocksReceived, _ := m.events.getCounts(); blocksReceived != 1 || head != blockHash {
+		t.Error("Expected the block to be received once, got", blocksReceived)
+	} else if stats.Replayed != 1 {
+		t.Error("Expected the replay to be counted, got", stats.Replayed)
+	}
+}
+
+// Test that GetSvgStrings returns each shape's svg string in order, with
+// an error of its own for each hash that isn't a shape
+func TestGetSvgStrings(t *testing.T) {
+	m := newTestMiner()
+	m.tokens = map[string]*ArtnodeSession{"token": {}}
+	privKey, pubKeyString := newTestKey(m, 1000)
+	drawn := addTestShape(t, m, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z")
+	delete(m.unminedOps, drawn.OpSig)
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{drawn}, "", 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+
+	request := &ArtnodeRequest{Token: "token", Payload: []interface{}{[]string{"unknown", drawn.OpSig}}}
+	response := new(MinerResponse)
+	m.GetSvgStrings(request, response)
+	svgStrings, errTypes := response.Payload[0].([]string), response.Payload[1].([]string)
+	if svgStrings[0] != "" || errTypes[0] != "InvalidShapeHashError" {
+		t.Error("Expected an InvalidShapeHashError for the unknown hash, got", svgStrings[0], errTypes[0])
+	}
+	if svgStrings[1] != getSvgElement(drawn.Op.Shape) || errTypes[1] != "" {
+		t.Error("Expected the shape's svg string, got", svgStrings[1], errTypes[1])
+	}
+
+	request.Payload[0] = make([]string, MAX_SVG_STRINGS_BATCH+1)
+	if m.GetSvgStrings(request, response); !errors.Is(response.Error, errorLib.BatchTooLargeError(MAX_SVG_STRINGS_BATCH)) {
+		t.Error("Expected a BatchTooLargeError, got", response.Error)
+	}
+	request.Token = "bad"
+	if m.GetSvgStrings(request, response); !errors.Is(response.Error, errorLib.InvalidTokenError("")) {
+		t.Error("Expected an InvalidTokenError, got", response.Error)
+	}
+}
+
+// Test that GetBlocksSince pages through the longest chain after a block
+// on it, and that catching up on a fork only downloads the peer's blocks
+// after the fork point
+func TestGetBlocksSince(t *testing.T) {
+	registerGobTypes()
+	// No-op blocks are mined without records, which is how they are sent
+	mineBranch := func(m *Miner, prevHash string, numBlocks int, apply bool) (blockHashes []string) {
+		for i := 0; i < numBlocks; i++ {
+			block := newBlock(m.blockchain[prevHash].BlockNo+1, prevHash, nil, "", uint32(i))
+			m.insertBlock(&block)
+			if apply {
+				m.applyBlock(&block)
+			}
+			prevHash = hashBlock(&block)
+			blockHashes = append(blockHashes, prevHash)
+		}
+		return
+	}
+	peer := newTestNode()
+	mainChain := mineBranch(peer, peer.settings.GenesisBlockHash, 5, true)
+	fork := mineBranch(peer, mainChain[1], 1, false)
+
+	getBlocksSince := func(since string, maxCount uint32) (blocks []Block, more bool, err error) {
+		response := new(MinerResponse)
+		peer.GetBlocksSince(&MinerRequest{Payload: []interface{}{since, maxCount}}, response)
+		if response.Error != nil {
+			return nil, false, response.Error
+		}
+		return response.Payload[0].([]Block), response.Payload[1].(bool), nil
+	}
+	if blocks, more, err := getBlocksSince(peer.settings.GenesisBlockHash, 2); err != nil || len(blocks) != 2 || !more || hashBlock(&blocks[1]) != mainChain[1] {
+		t.Error("Expected the first 2 blocks and more, got", len(blocks), more, err)
+	}
+	if blocks, more, err := getBlocksSince(mainChain[2], 0); err != nil || len(blocks) != 2 || more || hashBlock(&blocks[1]) != mainChain[4] {
+		t.Error("Expected the last 2 blocks, got", len(blocks), more, err)
+	}
+	if blocks, more, err := getBlocksSince(mainChain[4], 0); err != nil || len(blocks) != 0 || more {
+		t.Error("Expected no blocks after the head, got", len(blocks), more, err)
+	}
+	if _, _, err := getBlocksSince(fork[0], 0); !errors.Is(err, errorLib.InvalidBlockHashError(fork[0])) {
+		t.Error("Expected a block off the longest chain to be refused, got", err)
+	}
+
+	// The miner is on a fork of 2 blocks after the peer's second block
+	server := rpc.NewServer()
+	server.Register(peer)
+	m := newTestNode()
+	m.miners["peer"] = serveTestPipe(t, server.ServeConn)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, blockHash := range mainChain[:2] {
+		block := *peer.blockchain[blockHash]
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+	}
+	mineBranch(m, mainChain[1], 2, true)
+
+	chain, err := m.downloadBlocksSince("peer")
+	if err != nil || len(chain) != 3 || hashBlock(chain[0]) != mainChain[2] {
+		t.Fatal("Expected the peer's 3 blocks after the fork point, got", len(chain), err)
+	}
+	if numReceived := m.catchUpWithPeers(); numReceived != 3 || m.blockchainHead != mainChain[4] {
+		t.Error("Expected to switch to the peer's chain, got", numReceived, m.blockchainHead)
+	}
+}
+
+// Test that RPCs from other miners and from art nodes are told apart for
+// labelling, that the labelling codec serves RPCs like rpc.ServeConn, and
+// that profiles are written to disk
+func TestProfiling(t *testing.T) {
+	registerGobTypes()
+	roles := getRPCRoles()
+	if roles["Miner.SendBlock"] != ROLE_GOSSIP || roles["Miner.GetBlocksSince"] != ROLE_GOSSIP {
+		t.Error("Expected the RPCs of other miners to be gossip, got", roles["Miner.SendBlock"], roles["Miner.GetBlocksSince"])
+	}
+	if _, exists := roles["Miner.GetInk"]; exists {
+		t.Error("Expected GetInk to be left to art nodes")
+	}
+
+	peer := newTestNode()
+	server := rpc.NewServer()
+	server.Register(peer)
+	client := serveTestPipe(t, func(conn io.ReadWriteCloser) {
+		server.ServeCodec(newLabelledGobCodec(conn, roles))
+	})
+	response := new(MinerResponse)
+	if err := client.Call("Miner.GetBlockChainLength", new(MinerRequest), response); err != nil || response.Payload[0].(int) != 0 {
+		t.Error("Expected the chain length over the labelling codec, got", response.Payload, err)
+	}
+	var nonce string
+	if err := client.Call("Miner.Hello", "", &nonce); err != nil || nonce == "" {
+		t.Error("Expected a nonce over the labelling codec, got", nonce, err)
+	}
+
+	admin := &MinerAdmin{peer}
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path string
+	if err := admin.Profile(ProfileRequest{Kind: "heap", File: filepath.Join(dir, "heap.pprof")}, &path); err != nil {
+		t.Fatal("Expected a heap profile, got", err)
+	} else if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Error("Expected the heap profile to be written to", path, err)
+	}
+	if err := admin.Profile(ProfileRequest{Kind: "unknown"}, &path); err == nil {
+		t.Error("Expected an unknown profile to be refused")
+	}
+	if err := admin.Profile(ProfileRequest{Kind: "cpu", Seconds: MAX_PROFILE_SECONDS + 1}, &path); err == nil {
+		t.Error("Expected a CPU profile over the longest allowed to be refused")
+	}
+}
+
+// Test that blocks and the mempool are validated the same way whatever the
+// number of validation workers: a block is rejected for its first invalid
+// op, and of conflicting unmined shapes the oldest is kept
+func TestDeterministicValidation(t *testing.T) {
+	m := newTestNode()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+
+	// The third shape is off the canvas, and the sixth op claims to be
+	// signed by the wrong key
+	var records []OperationRecord
+	for i := 0; i < 8; i++ {
+		svg := "M " + fmt.Sprint(10*i) + " 10 h 5 v 5 h -5 Z"
+		if i == 2 {
+			svg = "M 2000 10 h 5 v 5 h -5 Z"
+		}
+		records = append(records, addTestShape(t, m, privKey1, pubKey1, svg))
+	}
+	records[5].PubKeyString = pubKey2
+	block := newBlock(1, m.settings.GenesisBlockHash, records, pubKey1, 0)
+	withoutOffCanvas := append(append([]OperationRecord{}, records[:2]...), records[3:]...)
+	signatureBlock := newBlock(1, m.settings.GenesisBlockHash, withoutOffCanvas, pubKey1, 0)
+	for _, numValidators := range []int{1, 2, 3, 8} {
+		m.numValidators = numValidators
+		for i := 0; i < 10; i++ {
+			if err := m.precheckBlock(&block).Err; !errors.Is(err, errorLib.OutOfBoundsError("")) {
+				t.Fatal("Expected the block to be rejected for its off-canvas shape with", numValidators, "workers, got", err)
+			} else if err := m.precheckBlock(&signatureBlock).Err; !errors.Is(err, errorLib.InvalidSignatureError()) {
+				t.Fatal("Expected the block to be rejected for its signature with", numValidators, "workers, got", err)
+			}
+		}
+	}
+
+	// Each shape overlaps the one before it, and is drawn by the other key
+	for _, numValidators := range []int{1, 2, 3, 8} {
+		m.numValidators = numValidators
+		m.unminedOps = make(map[string]*OperationRecord)
+		m.failedOps = make(map[string]*OperationRecord)
+		keys := []ecdsa.PrivateKey{privKey1, privKey2}
+		pubKeys := []string{pubKey1, pubKey2}
+		var opSigs []string
+		for i := 0; i < 6; i++ {
+			svg := "M " + fmt.Sprint(10+8*i) + " 100 h 10 v 10 h -10 Z"
+			opSigs = append(opSigs, addTestShape(t, m, keys[i%2], pubKeys[i%2], svg).OpSig)
+		}
+		m.validateUnminedOps()
+		for i, opSig := range opSigs {
+			if _, unmined := m.unminedOps[opSig]; unmined != (i%2 == 0) {
+				t.Error("Expected only the shapes of the first key to be kept with", numValidators, "workers, got op", i, "unmined", unmined)
+			}
+		}
+		if m.inkAccounts[pubKey1] != 1000 || m.inkAccounts[pubKey2] != 1000 {
+			t.Error("Expected validating the mempool to leave the ink unchanged, got", m.inkAccounts[pubKey1], m.inkAccounts[pubKey2])
+		}
+	}
+}
+
+// Test that unmined ops expire once they outlive the mempool TTL, fail
+// with an OpStaleError that their art node gets, and free their area of
+// the canvas, and that stale ops aren't accepted
+func TestMempoolExpiry(t *testing.T) {
+	m := newTestNode()
+	privKey, pubKey := newTestKey(m, 1000)
+	otherPrivKey, otherPubKey := newTestKey(m, 1000)
+	m.mempoolTTL = time.Hour
+
+	stale := addTestShape(t, m, privKey, pubKey, "M 10 10 h 20 v 20 h -20 Z")
+	pinned := addTestShape(t, m, privKey, pubKey, "M 100 10 h 20 v 20 h -20 Z")
+	fresh := addTestShape(t, m, privKey, pubKey, "M 200 10 h 20 v 20 h -20 Z")
+	now := time.Unix(0, fresh.Op.TimeStamp).Add(time.Hour)
+	m.pinnedOps[pinned.OpSig] = 0
+
+	if expired := m.expireStaleOps(now); expired != 1 {
+		t.Fatal("Expected only the unpinned stale op to expire, got", expired)
+	}
+	if _, unmined := m.unminedOps[stale.OpSig]; unmined || !errors.Is(m.failedOps[stale.OpSig].Error, errorLib.OpStaleError("")) {
+		t.Error("Expected the stale op to fail with an OpStaleError")
+	}
+	if _, unmined := m.unminedOps[pinned.OpSig]; !unmined {
+		t.Error("Expected the pinned op to stay unmined")
+	}
+	if _, unmined := m.unminedOps[fresh.OpSig]; !unmined {
+		t.Error("Expected the op created an hour ago to stay unmined")
+	}
+
+	response := new(MinerResponse)
+	m.OpValidated(&ArtnodeRequest{Token: "token", Payload: []interface{}{stale.OpSig}}, response)
+	if !errors.Is(response.Error, errorLib.OpStaleError("")) {
+		t.Error("Expected the art node to be told the op expired, got", response.Error)
+	}
+
+	// Another key can draw where the expired shape was, but not where the
+	// op created an hour ago still is
+	freed := stale.Op.Shape
+	freed.Owner = otherPubKey
+	if _, err := m.validateNewShape(freed, otherPubKey); err != nil {
+		t.Error("Expected the expired shape's area to be free, got", err)
+	}
+	overlapping := fresh.Op.Shape
+	overlapping.Owner = otherPubKey
+	if _, err := m.validateNewShape(overlapping, otherPubKey); !errors.Is(err, errorLib.ShapeOverlapError("")) {
+		t.Error("Expected the unmined shape to keep its area, got", err)
+	}
+
+	// A peer's op that is already stale is rejected
+	old := addTestShape(t, m, otherPrivKey, otherPubKey, "M 300 10 h 20 v 20 h -20 Z")
+	delete(m.unminedOps, old.OpSig)
+	m.mempoolTTL = time.Nanosecond
+	if err := m.receiveOp(&old, "peer"); !errors.Is(err, errorLib.OpStaleError("")) {
+		t.Error("Expected a stale op to be rejected, got", err)
+	}
+	m.mempoolTTL = 0
+	if err := m.receiveOp(&old, "peer"); err != nil {
+		t.Error("Expected ops to never expire without a TTL, got", err)
+	}
+}
+
+// Test that a filled path with a hole is rendered with the even-odd rule
+// it is costed with, and other shapes without a fill-rule
+func TestSvgElementFillRule(t *testing.T) {
+	donut := shapelib.Shape{ShapeType: shapelib.PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 15 15 h 10 v 10 h -10 Z"}
+	if element := getSvgElement(donut); element != `<path d="`+donut.ShapeSvgString+`" stroke="red" fill="red" fill-rule="evenodd"/>` {
+		t.Error("Expected the donut to be drawn with the even-odd rule, got", element)
+	}
+	square := shapelib.Shape{ShapeType: shapelib.PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z"}
+	if element := getSvgElement(square); strings.Contains(element, "fill-rule") {
+		t.Error("Expected no fill-rule for a single sub-path, got", element)
+	}
+	if dashboardShape := getDashboardShape(donut); dashboardShape.FillRule != "evenodd" {
+		t.Error("Expected the dashboard to draw the donut with the even-odd rule, got", dashboardShape.FillRule)
+	}
+}
+
+// Test that duplicates of a block that is being applied wait for its
+// outcome, that known blocks are dropped before validation, and that both
+// are counted as duplicates of the peer they came from
+func TestBlockArrivals(t *testing.T) {
+	a := newBlockArrivals()
+	if _, first := a.claim("block", "a"); !first {
+		t.Fatal("Expected the first arrival to be claimed")
+	}
+	arrival, first := a.claim("block", "b")
+	if first {
+		t.Fatal("Expected the second arrival to wait on the first")
+	}
+	go a.release("block", errorLib.ValidationError("block"))
+	<-arrival.done
+	if !errors.Is(arrival.err, errorLib.ValidationError("block")) || a.getDuplicates("b") != 1 || a.getDuplicates("a") != 0 {
+		t.Error("Expected the duplicate to get the first arrival's outcome, got", arrival.err, a.getDuplicates("b"))
+	}
+	if _, first := a.claim("block", "b"); !first {
+		t.Error("Expected a released block to be claimable again")
+	}
+	var none *BlockArrivals
+	if _, first := none.claim("block", "a"); !first {
+		t.Error("Expected a nil set to let every block through")
+	}
+
+	// Of several peers sending the same block at once, and one sending it
+	// again later, only one reaches the event bus
+	m := newTestNode()
+	m.settings.PoWDifficultyNoOpBlock = 0
+	block := newBlock(1, m.settings.GenesisBlockHash, nil, "", 0)
+	peers := []string{"peer1", "peer2", "peer3", "peer4", "peer5"}
+	var wg sync.WaitGroup
+	for _, minerAddr := range peers {
+		wg.Add(1)
+		go func(minerAddr string) {
+			defer wg.Done()
+			if err := m.SendBlock(&MinerRequest{Payload: []interface{}{block, minerAddr}}, new(MinerResponse)); err != nil {
+				t.Error("Expected the block to be accepted, got", err)
+			}
+		}(minerAddr)
+	}
+	wg.Wait()
+	m.SendBlock(&MinerRequest{Payload: []interface{}{block, "peer1"}}, new(MinerResponse))
+
+	m.lock.Lock()
+	var duplicates uint64
+	for _, minerAddr := range peers {
+		duplicates += m.getPeerStats(minerAddr).Duplicates
+	}
+	head := m.blockchainHead
+	m.lock.Unlock()
+	if _, blocksReceived, _ := m.events.getCounts(); blocksReceived != 1 || head != hashBlock(&block) {
+		t.Error("Expected the block to be received once, got", blocksReceived)
+	} else if duplicates != uint64(len(peers)) {
+		t.Error("Expected every other arrival to be counted as a duplicate, got", duplicates)
+	}
+}
+
+// Test that the priority policy decides which of two conflicting ops is
+// taken into the next block, and that the block is in canonical order
+// whichever it is
+func TestPriorityPolicy(t *testing.T) {
+	m := newTestMiner()
+	privKey1, pubKey1 := newTestKey(m, 1000)
+	privKey2, pubKey2 := newTestKey(m, 1000)
+	small := addTestShape(t, m, privKey1, pubKey1, "M 10 10 h 5 v 5 h -5 Z")
+	large := addTestShape(t, m, privKey2, pubKey2, "M 12 12 h 20 v 20 h -20 Z")
+	other := addTestShape(t, m, privKey2, pubKey2, "M 100 100 h 5 v 5 h -5 Z")
+	inkAccounts := map[string]uint32{pubKey1: 1000, pubKey2: 1000}
+
+	if names := getPriorityPolicyNames(); strings.Join(names, ",") != "fifo,ink-cost" {
+		t.Error("Expected the built-in policies, got", names)
+	}
+	checkSelection(t, m, m.selectOpsForBlock(), []OperationRecord{small, other}, inkAccounts)
+
+	m.priority, _ = getPriorityPolicy("ink-cost")
+	checkSelection(t, m, m.selectOpsForBlock(), []OperationRecord{large, other}, inkAccounts)
+}
+
+// Test that an advisory lock is held by one session at a time until it is
+// released, expires or its session ends, and that waiters see each change
+func TestAdvisoryLocks(t *testing.T) {
+	m := newTestMiner()
+	m.locks = newAdvisoryLocks()
+	m.tokens = map[string]*ArtnodeSession{
+		"alice": &ArtnodeSession{PubKeyString: "alice"},
+		"bob":   &ArtnodeSession{PubKeyString: "bob"}}
+	m.updateReadReplica()
+
+	acquire := func(token, name string, seconds uint32) *MinerResponse {
+		response := new(MinerResponse)
+		m.AcquireLock(&ArtnodeRequest{Token: token, Payload: []interface{}{name, seconds}}, response)
+		return response
+	}
+	release := func(token, name string) *MinerResponse {
+		response := new(MinerResponse)
+		m.ReleaseLock(&ArtnodeRequest{Token: token, Payload: []interface{}{name}}, response)
+		return response
+	}
+	getLocks := func(token string) (names []string, version uint64) {
+		response := new(MinerResponse)
+		m.GetLocks(&ArtnodeRequest{Token: token}, response)
+		return response.Payload[0].([]string), response.Payload[5].(uint64)
+	}
+
+	response := acquire("alice", "region", 0)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	expires := time.Unix(0, response.Payload[0].(int64))
+	if wait := time.Until(expires); wait <= 0 || wait > time.Duration(DEFAULT_LOCK_SECONDS)*time.Second {
+		t.Error("Expected the lock to be held for the default seconds, got", wait)
+	}
+	if response := acquire("bob", "region", 10); !errors.Is(response.Error, errorLib.LockHeldError("")) {
+		t.Error("Expected a LockHeldError, got", response.Error)
+	}
+	if response := release("bob", "region"); !errors.Is(response.Error, errorLib.LockHeldError("")) {
+		t.Error("Expected only the holder to release the lock, got", response.Error)
+	}
+	if response := acquire("bob", strings.Repeat("x", MAX_LOCK_NAME_LENGTH+1), 10); !errors.Is(response.Error, errorLib.LockLimitError("")) {
+		t.Error("Expected a LockLimitError, got", response.Error)
+	}
+
+	// Renewing extends the lock, up to the longest duration
+	response = acquire("alice", "region", MAX_LOCK_SECONDS+1)
+	if renewed := time.Unix(0, response.Payload[0].(int64)); !renewed.After(expires) ||
+		time.Until(renewed) > time.Duration(MAX_LOCK_SECONDS)*time.Second {
+		t.Error("Expected the lock to be renewed for at most the longest duration, got", renewed)
+	}
+
+	// Other sessions see the lock, and which of them hold it
+	acquire("bob", "shape", 10)
+	response = new(MinerResponse)
+	m.GetLocks(&ArtnodeRequest{Token: "bob"}, response)
+	names := response.Payload[0].([]string)
+	tokenHashes := response.Payload[1].([]string)
+	mine := response.Payload[4].([]bool)
+	if len(names) != 2 || names[0] != "region" || names[1] != "shape" {
+		t.Fatal("Expected both locks sorted by name, got", names)
+	}
+	if tokenHashes[0] != hashToken("alice") || mine[0] || !mine[1] {
+		t.Error("Expected the holders of the locks, got", tokenHashes, mine)
+	}
+
+	// A waiter returns once a lock is released
+	_, version := getLocks("alice")
+	done := make(chan uint64)
+	go func() {
+		response := new(MinerResponse)
+		m.WaitForLockChange(&ArtnodeRequest{Token: "alice", Payload: []interface{}{version, MAX_CANVAS_WAIT}}, response)
+		done <- response.Payload[0].(uint64)
+	}()
+	release("bob", "shape")
+	select {
+	case newVersion := <-done:
+		if newVersion == version {
+			t.Error("Expected the version to change")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the waiter to see the released lock")
+	}
+
+	// Expired locks are dropped, and closing a canvas releases its locks
+	m.locks.locks["region"].Expires = time.Now()
+	if names, _ := getLocks("bob"); len(names) != 0 {
+		t.Error("Expected the expired lock to be dropped, got", names)
+	}
+	acquire("alice", "region", 10)
+	m.CloseCanvas(&ArtnodeRequest{Token: "alice"}, new(MinerResponse))
+	if response := acquire("bob", "region", 10); response.Error != nil {
+		t.Error("Expected the closed session's lock to be released, got", response.Error)
+	}
+}
+
+// Test that a block is built from at most MaxOpsPerBlock ops, those first
+// in priority order, and that blocks with more are rejected
+func TestMaxOpsPerBlock(t *testing.T) {
+	m := newTestMiner()
+	m.settings.MaxOpsPerBlock = 2
+	privKey, pubKey := newTestKey(m, 1000)
+	first := addTestShape(t, m, privKey, pubKey, "M 10 10 h 5 v 5 h -5 Z")
+	second := addTestShape(t, m, privKey, pubKey, "M 30 30 h 5 v 5 h -5 Z")
+	large := addTestShape(t, m, privKey, pubKey, "M 50 50 h 20 v 20 h -20 Z")
+	inkAccounts := map[string]uint32{pubKey: 1000}
+
+	checkSelection(t, m, m.selectOpsForBlock(), []OperationRecord{first, second}, inkAccounts)
+
+	m.priority, _ = getPriorityPolicy("ink-cost")
+	selected := m.selectOpsForBlock()
+	if len(selected) != 2 || (selected[0].OpSig != large.OpSig && selected[1].OpSig != large.OpSig) {
+		t.Error("Expected the most expensive op to be taken first, got", getOpSigs(selected))
+	}
+
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{first, second, large}, "", 0)
+	sortRecordsCanonically(block.Records)
+	if precheck := m.precheckBlock(&block); !errors.Is(precheck.Err, errorLib.ValidationError("")) ||
+		!strings.Contains(precheck.Err.Error(), "more than the 2 ops") {
+		t.Error("Expected a block with too many ops to be rejected, got", precheck.Err)
+	}
+	m.settings.MaxOpsPerBlock = 0
+	if precheck := m.precheckBlock(&block); precheck.Err != nil {
+		t.Error("Expected the default limit to allow the block, got", precheck.Err)
+	}
+}
+
+// Stands in for the server, recording the miners that register and
+// deregister, answering heartbeats from unregistered keys with the
+// server's unknown key error, and returning the given keys by address
+type testServer struct {
+	lock         sync.Mutex
+	keys         map[string]bool
+	registered   chan MinerInfo
+	deregistered chan DeregisterRequest
+	addresses    map[string]string
+}
+
+func (s *testServer) GetMinerKeysByAddress(_ ecdsa.PublicKey, keys *map[string]string) error {
+	*keys = s.addresses
+	return nil
+}
+
+func (s *testServer) Register(m MinerInfo, _ *MinerNetSettings) error {
+	s.lock.Lock()
+	s.keys[m.Key.X.String()] = true
+	s.lock.Unlock()
+	s.registered <- m
+	return nil
+}
+
+func (s *testServer) HeartBeat(key ecdsa.PublicKey, _ *bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.keys[key.X.String()] {
+		return errors.New(SERVER_UNKNOWN_KEY_ERROR)
+	}
+	return nil
+}
+
+func (s *testServer) Deregister(request DeregisterRequest, _ *bool) error {
+	s.deregistered <- request
+	return nil
+}
+
+// Test that a stopped miner stops mining, waits for its sends to its peers,
+// commits its head to the store, deregisters from the server and closes
+// its connections
+func TestGracefulShutdown(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	m.stopping = make(chan struct{})
+	m.store = openBlockStore(t.TempDir())
+	peer := rpc.NewServer()
+	peer.Register(newTestNode())
+	m.miners["peer"] = serveTestPipe(t, peer.ServeConn)
+
+	server := rpc.NewServer()
+	fake := &testServer{deregistered: make(chan DeregisterRequest, 1)}
+	server.RegisterName("RServer", fake)
+	m.serverConn = serveTestPipe(t, server.ServeConn)
+	// gob only encodes the curve by its parameters
+	m.pubKey.Curve = m.pubKey.Curve.Params()
+
+	mined := make(chan struct{})
+	go func() {
+		for !m.isStopping() {
+			m.mineBlock()
+		}
+		close(mined)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	m.stop()
+	m.stop()
+	select {
+	case <-mined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the mining loop to stop")
+	}
+
+	var sent int32
+	m.goSend(func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&sent, 1)
+	})
+	m.shutdown()
+	defer m.lock.Unlock()
+
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Error("Expected shutdown to wait for the send in flight")
+	}
+	if head, err := m.store.loadHead(); err != nil || head != m.blockchainHead {
+		t.Error("Expected the head to be committed, got", head, err)
+	}
+	select {
+	case request := <-fake.deregistered:
+		if request.Key.X.Cmp(m.pubKey.X) != 0 {
+			t.Error("Expected the miner's key to be deregistered")
+		} else if request.R == nil || request.S == nil ||
+			!ecdsa.Verify(&m.pubKey, getDeregisterDigest(request.Timestamp), request.R, request.S) {
+			t.Error("Expected the deregistration to be signed with the miner's key")
+		} else if age := time.Since(time.Unix(0, request.Timestamp)); age < 0 || age > time.Minute {
+			t.Error("Expected the deregistration to be timestamped now, got", age)
+		}
+	default:
+		t.Error("Expected the miner to deregister from the server")
+	}
+	if len(m.miners) != 0 {
+		t.Error("Expected the peers to be dropped, got", len(m.miners))
+	}
+	if err := m.serverConn.Call("RServer.Deregister", DeregisterRequest{}, new(bool)); err != rpc.ErrShutdown {
+		t.Error("Expected the connection to the server to be closed, got", err)
+	}
+}
+
+// Test that a miner whose heartbeat the server answers with its unknown
+// key error registers again, and then keeps sending heartbeats
+func TestHeartBeatReregisters(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	m.localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+	// gob only encodes the curve by its parameters
+	m.pubKey.Curve = m.pubKey.Curve.Params()
+
+	server := rpc.NewServer()
+	fake := &testServer{keys: make(map[string]bool), registered: make(chan MinerInfo, 1)}
+	server.RegisterName("RServer", fake)
+	serverConn := serveTestPipe(t, server.ServeConn)
+
+	done := make(chan struct{})
+	go func() {
+		m.startHeartBeats(serverConn, m.pubKey, TIME_BUFFER+10)
+		close(done)
+	}()
+	select {
+	case info := <-fake.registered:
+		if info.Key.X.Cmp(m.pubKey.X) != 0 || info.Address.String() != m.localAddr.String() {
+			t.Error("Expected the miner to register its key and address, got", info.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the miner to register again")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-fake.registered:
+		t.Error("Expected the miner to register only once")
+	default:
+	}
+
+	serverConn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the heartbeats to stop once the connection is closed")
+	}
+}
+
+// Test that a miner bootstrapped from a snapshot, over HTTP or from a file,
+// ends up with the state of the snapshot's chain and validates the blocks
+// after it, and that snapshots that aren't signed by the trusted key are
+// refused
+func TestBootstrapSnapshot(t *testing.T) {
+	m := newTestMiner()
+	m.privKey, m.pubKeyString = newTestKey(m, 0)
+	privKey, pubKey := newTestKey(m, 0)
+
+	var oldShape, newShape OperationRecord
+	numBlocks := BOOTSTRAP_RECENT_BLOCKS + 5
+	for blockNo := 1; blockNo <= numBlocks; blockNo++ {
+		if blockNo == 2 {
+			oldShape = addTestShape(t, m, privKey, pubKey, "M 10 10 h 5 v 5 h -5 Z")
+		} else if blockNo == numBlocks-2 {
+			newShape = addTestShape(t, m, privKey, pubKey, "M 30 10 h 5 v 5 h -5 Z")
+		}
+		block := newBlock(uint32(blockNo), m.blockchainHead, m.selectOpsForBlock(), pubKey, 0)
+		m.insertBlock(&block)
+		m.applyBlock(&block)
+	}
+
+	bootstrap, err := m.takeBootstrapSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bootstrap.Headers) != 5 || len(bootstrap.Blocks) != BOOTSTRAP_RECENT_BLOCKS || bootstrap.Headers[0].Block.Records != nil {
+		t.Fatal("Expected the headers of the older blocks and the newest blocks in full, got", len(bootstrap.Headers), len(bootstrap.Blocks))
+	}
+	encoded, _ := json.Marshal(bootstrap)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encoded)
+	}))
+	defer server.Close()
+
+	joined := newTestMiner()
+	joined.store = openBlockStore(t.TempDir())
+	joined.store.saveSettings(joined.settings)
+	if err := joined.bootstrapFrom(server.URL, m.pubKeyString); err != nil {
+		t.Fatal(err)
+	}
+	if joined.blockchainHead != m.blockchainHead || joined.inkAccounts[pubKey] != m.inkAccounts[pubKey] {
+		t.Error("Expected the snapshot's head and ink, got", joined.blockchainHead, joined.inkAccounts[pubKey])
+	}
+	for _, opRecord := range []OperationRecord{oldShape, newShape} {
+		if _, exists := joined.validatedOps[opRecord.OpSig]; !exists {
+			t.Error("Expected shape", opRecord.Op.Shape.ShapeSvgString, "to be on the canvas")
+		}
+	}
+	if _, chain, err := loadStoredChain(joined.store); err != nil || len(chain) != 0 {
+		t.Error("Expected the store to hold the snapshot, got", len(chain), err)
+	}
+
+	addTestShape(t, m, privKey, pubKey, "M 50 10 h 5 v 5 h -5 Z")
+	block := newBlock(uint32(numBlocks+1), m.blockchainHead, m.selectOpsForBlock(), pubKey, 0)
+	if err := joined.validateBlock(&block); err != nil {
+		t.Error("Expected the next block to be valid on the bootstrapped chain, got", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	ioutil.WriteFile(file, encoded, 0644)
+	if err := newTestMiner().bootstrapFrom(file, pubKey); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected a snapshot signed by another key to be refused, got", err)
+	}
+	bootstrap.Snapshot.InkAccounts[pubKey] += 1000
+	tampered, _ := json.Marshal(bootstrap)
+	ioutil.WriteFile(file, tampered, 0644)
+	if err := newTestMiner().bootstrapFrom(file, m.pubKeyString); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected a tampered snapshot to be refused, got", err)
+	}
+}
+
+// Test that a config file's settings are validated, its paths taken as
+// relative to it, and that its settings give way to the flags given on the
+// command line
+func TestMinerConfig(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "miner.keys"), []byte("pub\r\npriv"), 0644)
+	file := filepath.Join(dir, "miner.json")
+	ioutil.WriteFile(file, []byte(`{"server": "127.0.0.1:12345", "keys": "miner.keys", "admin": "127.0.0.1:7171", "workers": 3, "validation-workers": 0}`), 0644)
+
+	config, err := loadMinerConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server != "127.0.0.1:12345" || config.Keys != filepath.Join(dir, "miner.keys") || *config.Workers != 3 || *config.ValidationWorkers != 0 {
+		t.Error("Expected the config file's settings, got", config)
+	}
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	adminAddr := fs.String("admin", DEFAULT_ADMIN_ADDR, "")
+	keyFile := fs.String("keys", "", "")
+	workers := fs.Int("workers", 1, "")
+	validationWorkers := fs.Int("validation-workers", 2, "")
+	jsonAddr := fs.String("json", "127.0.0.1:8080", "")
+	fs.Parse([]string{"-workers", "5"})
+	applyMinerConfig(fs, config)
+	if *adminAddr != "127.0.0.1:7171" || *keyFile != config.Keys || *validationWorkers != 0 {
+		t.Error("Expected the flags to take the config file's settings, got", *adminAddr, *keyFile, *validationWorkers)
+	}
+	if *workers != 5 || *jsonAddr != "127.0.0.1:8080" {
+		t.Error("Expected the flags given and left out of the config to keep their values, got", *workers, *jsonAddr)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"server": "localhost", "keys": "missing.keys", "workers": 0, "listen": ":9000"}`), 0644)
+	_, err = loadMinerConfig(file)
+	for _, problem := range []string{"server:", "keys:", "workers:"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Error("Expected the config to be refused for its", problem, "got", err)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "listen:") {
+		t.Error("Expected a listen address without a host to be valid, got", err)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"server": "127.0.0.1:12345", "wrokers": 3}`), 0644)
+	if _, err = loadMinerConfig(file); err == nil || !strings.Contains(err.Error(), `"wrokers"`) {
+		t.Error("Expected an unknown setting to be named, got", err)
+	}
+	ioutil.WriteFile(file, []byte("{\n  \"server\": \"127.0.0.1:12345\",\n  \"workers\": 3,\n}"), 0644)
+	if _, err = loadMinerConfig(file); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Error("Expected a syntax error to give its line, got", err)
+	}
+}
+
+// Test that an operator can add a peer past the outbound slots, which
+// isn't evicted, remove it and ban it, and that bans refuse the peer's
+// connections and messages, end when they are due and outlast a restart
+func TestPeerBans(t *testing.T) {
+	m := newTestNode()
+	m.bans = newPeerBans()
+	m.store = openBlockStore(t.TempDir())
+	admin := &MinerAdmin{m}
+
+	peer := newTestNode()
+	server := rpc.NewServer()
+	server.Register(peer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	peerAddr := listener.Addr().String()
+
+	// Anchors connected before the added peer, so that it isn't one
+	for i := 0; i < NUM_ANCHOR_PEERS; i++ {
+		conn, _ := net.Pipe()
+		m.addPeer(fmt.Sprint("anchor", i), rpc.NewClient(conn), false)
+		m.peerSlots[fmt.Sprint("anchor", i)].connected = time.Now().Add(-time.Hour)
+	}
+
+	if err := admin.AddPeer(peerAddr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if slot := m.peerSlots[peerAddr]; slot == nil || !slot.manual {
+		t.Fatal("Expected the peer in a manual slot, got", slot)
+	}
+	if m.makePeerSlot(false) {
+		t.Error("Expected the added peer not to be evicted for another")
+	}
+	if err := admin.AddPeer("127.0.0.1:1", nil); !errors.Is(err, errorLib.DisconnectedError("")) {
+		t.Error("Expected an unreachable miner not to be added, got", err)
+	}
+
+	if err := admin.RemovePeer(peerAddr, nil); err != nil {
+		t.Error(err)
+	}
+	if _, connected := m.miners[peerAddr]; connected {
+		t.Error("Expected the peer to be removed")
+	}
+	if err := admin.RemovePeer(peerAddr, nil); err == nil {
+		t.Error("Expected removing a miner that isn't a peer to fail")
+	}
+
+	admin.AddPeer(peerAddr, nil)
+	var until time.Time
+	if err := admin.BanPeer(BanRequest{Address: peerAddr}, &until); err != nil || !until.IsZero() {
+		t.Fatal("Expected a ban for good, got", until, err)
+	}
+	if _, connected := m.miners[peerAddr]; connected {
+		t.Error("Expected the banned peer to be disconnected")
+	}
+	if err := admin.AddPeer(peerAddr, nil); !errors.Is(err, errorLib.PeerBannedError("")) {
+		t.Error("Expected a banned miner not to be added, got", err)
+	}
+	m.BidirectionalSetup(&MinerRequest{Payload: []interface{}{peerAddr}}, new(MinerResponse))
+	m.connectToMiners([]net.Addr{listener.Addr()})
+	if _, connected := m.miners[peerAddr]; connected {
+		t.Error("Expected the banned miner's connection to be refused")
+	}
+	opRecord := OperationRecord{OpSig: "op"}
+	m.SendOp(&MinerRequest{Payload: []interface{}{opRecord, peerAddr}}, new(MinerResponse))
+	if _, exists := m.unminedOps["op"]; exists || atomic.LoadUint64(&m.getPeerCounters(peerAddr).opsReceived) != 0 {
+		t.Error("Expected the banned miner's op to be dropped")
+	}
+
+	admin.BanPeer(BanRequest{Address: "127.0.0.1:2", Seconds: 60}, &until)
+	restarted := newTestNode()
+	restarted.bans = newPeerBans()
+	bans, err := m.store.loadBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.bans.restore(bans)
+	var restored []PeerBan
+	(&MinerAdmin{restarted}).Bans("", &restored)
+	if len(restored) != 2 || restored[0].Address != "127.0.0.1:2" || !restored[0].Until.Equal(until) || restored[1].Address != peerAddr {
+		t.Error("Expected both bans to outlast a restart, got", restored)
+	}
+	if restarted.bans.isBanned("127.0.0.1:2", until) {
+		t.Error("Expected the ban to end when it is due")
+	}
+
+	if err := admin.UnbanPeer(peerAddr, nil); err != nil {
+		t.Error(err)
+	}
+	if err := admin.UnbanPeer(peerAddr, nil); err == nil {
+		t.Error("Expected lifting a ban that was lifted to fail")
+	}
+	if err := admin.AddPeer(peerAddr, nil); err != nil {
+		t.Error("Expected the miner to be added once its ban is lifted, got", err)
+	}
+}
+
+// Test that every subcommand is found by its name and aliases, that no two
+// share a name, and that each one's usage starts with its name
+func TestMinerCommands(t *testing.T) {
+	names := make(map[string]bool)
+	for _, command := range getMinerCommands() {
+		for _, name := range append([]string{command.Name}, command.Aliases...) {
+			if names[name] {
+				t.Error("Expected", name, "to name a single command")
+			}
+			names[name] = true
+			if found, exists := getMinerCommand(name); !exists || found.Name != command.Name {
+				t.Error("Expected", name, "to find", command.Name, "got", found.Name)
+			}
+		}
+		if !strings.HasPrefix(command.Usage, command.Name+" ") || command.Summary == "" || command.Run == nil {
+			t.Error("Expected", command.Name, "to have its usage, a summary and a function")
+		}
+	}
+	for _, alias := range []string{"mine", "export-chain"} {
+		if !names[alias] {
+			t.Error("Expected the", alias, "alias")
+		}
+	}
+	if _, exists := getMinerCommand("mien"); exists {
+		t.Error("Expected no command for a misspelt name")
+	}
+}
+
+// Test that a delegation lets its art node key get a token until it
+// expires, and only for that key and the miner that signed it
+func TestDelegation(t *testing.T) {
+	m := newTestNode()
+	artnodeKey, artnodePubKey := newTestKey(m, 0)
+	_, otherPubKey := newTestKey(m, 0)
+	other := newTestNode()
+
+	getToken := func(delegation string) *MinerResponse {
+		var nonce string
+		m.Hello("", &nonce)
+		r, s, _ := ecdsa.Sign(rand.Reader, &artnodeKey, []byte(nonce))
+		response := new(MinerResponse)
+		m.GetToken(&ArtnodeRequest{Payload: []interface{}{nonce, r.String(), s.String(), artnodePubKey, delegation}}, response)
+		return response
+	}
+
+	delegation, err := signDelegation(&m.privKey, artnodePubKey, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	} else if m.verifyDelegation(artnodePubKey, delegation) == nil {
+		t.Fatal("Expected the delegation to be valid")
+	} else if response := getToken(delegation); response.Error != nil || m.tokens[response.Payload[0].(string)].PubKeyString != artnodePubKey {
+		t.Fatal("Expected the delegated key to get a token, got", response.Error)
+	}
+
+	if m.verifyDelegation(otherPubKey, delegation) != nil {
+		t.Error("Expected the delegation to be invalid for another art node key")
+	}
+	if other.verifyDelegation(artnodePubKey, delegation) != nil {
+		t.Error("Expected the delegation to be invalid on another miner")
+	}
+	var extended Delegation
+	json.Unmarshal([]byte(delegation), &extended)
+	extended.Expiry += 3600
+	encoded, _ := json.Marshal(extended)
+	if m.verifyDelegation(artnodePubKey, string(encoded)) != nil {
+		t.Error("Expected a delegation with a tampered expiry to be invalid")
+	}
+
+	expired, _ := signDelegation(&m.privKey, artnodePubKey, time.Now().Add(-time.Second))
+	if m.verifyDelegation(artnodePubKey, expired) != nil {
+		t.Error("Expected an expired delegation to be invalid")
+	} else if response := getToken(expired); !errors.Is(response.Error, errorLib.InvalidSignatureError()) {
+		t.Error("Expected an expired delegation to be refused, got", response.Error)
+	}
+}
+
+// Test that an observer validates and applies the blocks and ops its peers
+// send it, refuses writes from its art nodes and its admin, and reports
+// itself as an observer in the status command's output
+func TestObserver(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	m.observer = true
+	m.settings.PoWDifficultyNoOpBlock = 0
+	m.settings.PoWDifficultyOpBlock = 0
+	privKey, pubKey := newTestKey(m, 0)
+	observerError := errorLib.ObserverError(m.localAddr.String())
+
+	block := newBlock(1, m.settings.GenesisBlockHash, nil, pubKey, 0)
+	if err := m.SendBlock(&MinerRequest{Payload: []interface{}{block, "peer1"}}, new(MinerResponse)); err != nil {
+		t.Fatal("Expected the observer to accept the peer's block, got", err)
+	}
+	shape := shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 10 10 h 5 v 5 h -5 Z", Fill: "transparent", Stroke: "red", Owner: pubKey}
+	opRecord := signTestOp(privKey, Operation{Type: ADD, Shape: shape, InkCost: 20, TimeStamp: 1}, pubKey)
+	m.SendOp(&MinerRequest{Payload: []interface{}{opRecord, "peer1"}}, new(MinerResponse))
+
+	m.lock.Lock()
+	head, ink, unmined := m.blockchainHead, m.inkAccounts[pubKey], m.unminedOps[opRecord.OpSig]
+	m.lock.Unlock()
+	if head != hashBlock(&block) || ink != m.settings.InkPerNoOpBlock {
+		t.Error("Expected the observer to apply the peer's block, got", head, ink)
+	} else if unmined == nil {
+		t.Error("Expected the observer to hold the peer's op to relay it")
+	} else if opsReceived, blocksReceived, _ := m.events.getCounts(); opsReceived != 1 || blocksReceived != 1 {
+		t.Error("Expected the op and the block to be received once, got", opsReceived, blocksReceived)
+	}
+
+	response := new(MinerResponse)
+	m.AddShape(&ArtnodeRequest{Token: "token", Payload: []interface{}{uint8(0), int(shapelib.PATH), "M 500 500 h 5 v 5 h -5 Z", "transparent", "red"}}, response)
+	if !errors.Is(response.Error, observerError) {
+		t.Error("Expected the observer to refuse to add a shape, got", response.Error)
+	}
+	response = new(MinerResponse)
+	m.DeleteShape(&ArtnodeRequest{Token: "token", Payload: []interface{}{opRecord.OpSig, uint8(0)}}, response)
+	if !errors.Is(response.Error, observerError) {
+		t.Error("Expected the observer to refuse to delete a shape, got", response.Error)
+	}
+	var opSig string
+	if err := (&MinerAdmin{m}).RotateKey(pubKey, &opSig); !errors.Is(err, observerError) {
+		t.Error("Expected the observer to refuse to rotate its key, got", err)
+	}
+	m.lock.Lock()
+	numUnmined := len(m.unminedOps)
+	m.lock.Unlock()
+	if numUnmined != 1 {
+		t.Error("Expected the refused writes not to reach the mempool, got", numUnmined, "ops")
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("Admin", &MinerAdmin{m})
+	adminServer := httptest.NewServer(server)
+	defer adminServer.Close()
+	stdout := os.Stdout
+	reader, writer, _ := os.Pipe()
+	os.Stdout = writer
+	statusCommand([]string{"-admin", adminServer.Listener.Addr().String()})
+	writer.Close()
+	os.Stdout = stdout
+	output, _ := ioutil.ReadAll(reader)
+	for _, line := range []string{"Observer:          true", "Blockchain head:   " + head, "Blocks received:   1"} {
+		if !strings.Contains(string(output), line+"\n") {
+			t.Error("Expected the status to include", line, "got", string(output))
+		}
+	}
+}
+
+// Stands in for a backend miner of a gateway, listening on a local port.
+// It hands out a new token for every handshake, counts the AddShape calls
+// it gets, failing them as told by failNext.
+type testBackend struct {
+	lock      sync.Mutex
+	listener  net.Listener
+	conns     []net.Conn
+	tokens    int
+	addShapes int
+	fail      []error
+	hangUp    bool
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	b := new(testBackend)
+	server := rpc.NewServer()
+	server.RegisterName("Miner", b)
+	b.listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { b.listener.Close() })
+	go func() {
+		for {
+			conn, err := b.listener.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns = append(b.conns, conn)
+			b.lock.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBackend) Hello(_ string, nonce *string) error {
+	*nonce = "nonce"
+	return nil
+}
+
+func (b *testBackend) GetToken(request *ArtnodeRequest, response *MinerResponse) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens++
+	response.Payload = []interface{}{fmt.Sprint(b.tokens)}
+	return nil
+}
+
+func (b *testBackend) AddShape(request *ArtnodeRequest, response *MinerResponse) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.addShapes++
+	if b.hangUp {
+		for _, conn := range b.conns {
+			conn.Close()
+		}
+		return nil
+	}
+	if len(b.fail) > 0 {
+		response.Error, b.fail = b.fail[0], b.fail[1:]
+		return nil
+	}
+	response.Payload = []interface{}{"opSig" + request.Token}
+	return nil
+}
+
+// Fails the next AddShape call with err, or hangs up on it if err is nil
+func (b *testBackend) failNext(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.hangUp = true
+	} else {
+		b.fail = append(b.fail, err)
+	}
+}
+
+func (b *testBackend) getAddShapes() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.addShapes
+}
+
+// Test that a gateway moves a write on to another backend, or tries it
+// again on the same one, only when the backend can't have acted on it:
+// when it can't be reached, its session or connection has gone stale, or it
+// rejects the write. A write that was sent but got no reply isn't sent again.
+func TestGatewayRetries(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	first, second := newTestBackend(t), newTestBackend(t)
+	m.backends = []*GatewayBackend{{Addr: first.listener.Addr().String()}, {Addr: second.listener.Addr().String()}}
+	addShape := func() *MinerResponse {
+		// Backends are tried in turn, starting with the first
+		m.nextBackend = 0
+		response := new(MinerResponse)
+		m.forwardWrite("AddShape", 0, &ArtnodeRequest{Token: "token"}, response, "InsufficientInkError")
+		return response
+	}
+
+	if response := addShape(); response.Error != nil || response.Payload[0] != "opSig1" {
+		t.Fatal("Expected the first backend to add the shape, got", response.Error)
+	}
+
+	// The backend forgot the gateway's session
+	first.failNext(errorLib.InvalidTokenError("1"))
+	if response := addShape(); response.Error != nil || response.Payload[0] != "opSig2" {
+		t.Error("Expected the first backend to add the shape with a new token, got", response.Error)
+	}
+	// The gateway closed its connection to the backend
+	m.backends[0].conn.Close()
+	if response := addShape(); response.Error != nil || response.Payload[0] != "opSig3" {
+		t.Error("Expected the first backend to add the shape over a new connection, got", response.Error)
+	}
+	first.failNext(errorLib.InsufficientInkError(0))
+	if response := addShape(); response.Error != nil || first.getAddShapes() != 5 || second.getAddShapes() != 1 {
+		t.Error("Expected the second backend to add a shape the first can't pay for, got", response.Error)
+	}
+
+	first.failNext(nil)
+	if response := addShape(); response.Error == nil || errorLib.IsType(response.Error, "DisconnectedError") {
+		t.Error("Expected a write that got no reply to fail as unknown, got", response.Error)
+	} else if first.getAddShapes() != 6 || second.getAddShapes() != 1 {
+		t.Error("Expected a write that got no reply not to be sent again, got", first.getAddShapes(), second.getAddShapes())
+	}
+
+	first.listener.Close()
+	if response := addShape(); response.Error != nil || first.getAddShapes() != 6 || second.getAddShapes() != 2 {
+		t.Error("Expected the second backend to add a shape when the first can't be reached, got", response.Error)
+	}
+	if opSigs := m.tokens["token"].OpSigs; len(opSigs) != 5 {
+		t.Error("Expected the session to record the shapes that were added, got", opSigs)
+	}
+}
+
+// Test that tokens expire the token TTL after they are issued, that nonces
+// can't be exchanged once they are stale, that expired tokens and nonces
+// are swept along with the tokens' locks, and that an art node can revoke
+// the other tokens of its key but not those of other keys
+func TestTokenExpiry(t *testing.T) {
+	m := newTestNode()
+	m.locks = newAdvisoryLocks()
+	m.tokenTTL = time.Hour
+
+	getToken := func() *MinerResponse {
+		var nonce string
+		m.Hello("", &nonce)
+		r, s, _ := ecdsa.Sign(rand.Reader, &m.privKey, []byte(nonce))
+		response := new(MinerResponse)
+		m.GetToken(&ArtnodeRequest{Payload: []interface{}{nonce, r.String(), s.String()}}, response)
+		return response
+	}
+	response := getToken()
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	token := response.Payload[0].(string)
+	session := m.tokens[token]
+	if session.Expires.Sub(session.Created) != time.Hour {
+		t.Error("Expected the token to expire after the TTL, got", session.Expires.Sub(session.Created))
+	}
+
+	var staleNonce string
+	m.Hello("", &staleNonce)
+	m.nonces[staleNonce] = time.Now().Add(-time.Duration(NONCE_TTL) * time.Second)
+	r, s, _ := ecdsa.Sign(rand.Reader, &m.privKey, []byte(staleNonce))
+	response = new(MinerResponse)
+	m.GetToken(&ArtnodeRequest{Payload: []interface{}{staleNonce, r.String(), s.String()}}, response)
+	if !errors.Is(response.Error, errorLib.InvalidSignatureError()) {
+		t.Error("Expected a stale nonce to be refused, got", response.Error)
+	}
+
+	m.AcquireLock(&ArtnodeRequest{Token: token, Payload: []interface{}{"region", uint32(0)}}, new(MinerResponse))
+	session.Expires = time.Now().Add(-time.Second)
+	m.updateReadReplica()
+	if _, valid := m.getSession(token); valid {
+		t.Error("Expected an expired token to be invalid")
+	}
+	if m.isReplicaToken(m.getReadReplica(), token) {
+		t.Error("Expected an expired token to be invalid on the read replica")
+	}
+	if expired := m.expireTokens(time.Now()); expired != 1 {
+		t.Error("Expected the expired token to be swept, got", expired)
+	}
+	if locks, _ := m.locks.getLocks(time.Now()); len(locks) != 0 {
+		t.Error("Expected the expired token's lock to be released")
+	}
+	if _, exists := m.tokens[token]; exists {
+		t.Error("Expected the expired token to be forgotten")
+	}
+	if _, exists := m.nonces[staleNonce]; exists {
+		t.Error("Expected the stale nonce to be forgotten")
+	}
+	if _, exists := m.tokens["token"]; !exists {
+		t.Error("Expected a token without an expiry to be kept")
+	}
+
+	m.tokens = map[string]*ArtnodeSession{
+		"alice1": &ArtnodeSession{PubKeyString: "alice"},
+		"alice2": &ArtnodeSession{PubKeyString: "alice"},
+		"alice3": &ArtnodeSession{PubKeyString: "alice"},
+		"bob":    &ArtnodeSession{PubKeyString: "bob"}}
+	revoke := func(tokenHash string) *MinerResponse {
+		response := new(MinerResponse)
+		m.RevokeToken(&ArtnodeRequest{Token: "alice1", Payload: []interface{}{tokenHash}}, response)
+		return response
+	}
+	if response := revoke(hashToken("bob")); !errors.Is(response.Error, errorLib.InvalidTokenError("")) {
+		t.Error("Expected another key's token not to be revoked, got", response.Error)
+	}
+	if response := revoke(hashToken("alice2")); response.Error != nil || response.Payload[0].(int) != 1 {
+		t.Error("Expected the token to be revoked, got", response.Payload, response.Error)
+	}
+	if response := revoke(""); response.Error != nil || response.Payload[0].(int) != 1 {
+		t.Error("Expected the other token of the key to be revoked, got", response.Payload, response.Error)
+	}
+	if len(m.tokens) != 2 || m.tokens["alice1"] == nil || m.tokens["bob"] == nil {
+		t.Error("Expected only the revoking token and the other key's to be left, got", len(m.tokens))
+	}
+}
+
+// A peer that predates SendOps
+type legacyOpPeer struct {
+	m *Miner
+}
+
+func (p legacyOpPeer) Ping(request *MinerRequest, response *MinerResponse) error {
+	return p.m.Ping(request, response)
+}
+
+func (p legacyOpPeer) SendOp(request *MinerRequest, response *MinerResponse) error {
+	return p.m.SendOp(request, response)
+}
+
+// Test that ops disseminated within the op batch window reach peers in
+// one SendOps message, that each op in it is still validated on its own,
+// and that peers without SendOps are sent the ops one by one
+func TestOpBatching(t *testing.T) {
+	registerGobTypes()
+	author := newTestMiner()
+	privKey, pubKeyString := newTestKey(author, 1000)
+	poorKey, poorKeyString := newTestKey(author, 1000)
+	ops := []OperationRecord{
+		addTestShape(t, author, privKey, pubKeyString, "M 0 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, author, poorKey, poorKeyString, "M 20 0 h 10 v 10 h -10 Z"),
+		addTestShape(t, author, privKey, pubKeyString, "M 40 0 h 10 v 10 h -10 Z")}
+
+	m := newTestNode()
+	m.opBatchWindow = 20 * time.Millisecond
+	peers := map[string]*Miner{"peer": newTestNode(), "legacy": newTestNode()}
+	for minerAddr, peer := range peers {
+		peer.inkAccounts[pubKeyString] = 1000
+		server := rpc.NewServer()
+		if minerAddr == "legacy" {
+			server.RegisterName("Miner", legacyOpPeer{peer})
+		} else {
+			server.Register(peer)
+		}
+		m.miners[minerAddr] = serveTestPipe(t, server.ServeConn)
+	}
+
+	m.lock.Lock()
+	for i := range ops {
+		m.disseminateOpToConnectedMiners(&ops[i])
+	}
+	if len(m.opBatch) != 3 {
+		t.Error("Expected the ops to wait for the batch window, got", len(m.opBatch), "queued")
+	}
+	m.lock.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		m.lock.Lock()
+		done := len(m.rejections.get(ops[1].OpSig)) == 2 && len(m.receipts.get(ops[2].OpSig)) == 2
+		m.lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.lock.Lock()
+	for minerAddr, peer := range peers {
+		if _, rejected := m.rejections.get(ops[1].OpSig)[minerAddr]; !rejected {
+			t.Error("Expected", minerAddr, "to reject the op of a key without ink")
+		}
+		for _, i := range []int{0, 2} {
+			if _, acked := m.receipts.get(ops[i].OpSig)[minerAddr]; !acked {
+				t.Error("Expected", minerAddr, "to acknowledge op", i)
+			}
+		}
+		peer.lock.Lock()
+		if len(peer.unminedOps) != 2 {
+			t.Error("Expected", minerAddr, "to have 2 unmined ops, got", len(peer.unminedOps))
+		}
+		peer.lock.Unlock()
+	}
+	if received := atomic.LoadUint64(&m.getPeerCounters("peer").opsSent); received != 3 {
+		t.Error("Expected 3 ops to be counted as sent, got", received)
+	}
+	m.lock.Unlock()
+
+	// Ops the peer already has are accepted without being added again
+	peer := peers["peer"]
+	request := &MinerRequest{Payload: []interface{}{ops, "other", []string{}}}
+	response := new(MinerResponse)
+	peer.SendOps(request, response)
+	rejections := response.Payload[0].([]string)
+	if len(rejections) != 3 || rejections[0] != "" || rejections[1] == "" || rejections[2] != "" {
+		t.Error("Expected only the op of a key without ink to be rejected, got", rejections)
+	}
+	peer.lock.Lock()
+	if len(peer.unminedOps) != 2 {
+		t.Error("Expected the ops not to be added again, got", len(peer.unminedOps), "unmined ops")
+	}
+	peer.lock.Unlock()
+
+	tooMany := make([]OperationRecord, MAX_OP_BATCH+1)
+	response = new(MinerResponse)
+	peer.SendOps(&MinerRequest{Payload: []interface{}{tooMany, "other", []string{}}}, response)
+	if !errors.Is(response.Error, errorLib.BatchTooLargeError(MAX_OP_BATCH)) {
+		t.Error("Expected a BatchTooLargeError, got", response.Error)
+	}
+}
+
+// Test that a token's reads include its own unmined shapes, flagged as
+// pending, and leave out the shapes it deleted, only when asked to, and
+// never include another token's
+func TestReadYourWrites(t *testing.T) {
+	m := newTestNode()
+	m.inkAccounts[m.pubKeyString] = 1000
+	m.tokens["other"] = &ArtnodeSession{Created: time.Now()}
+	m.updateReadReplica()
+
+	addShape := func(svg string) string {
+		response := new(MinerResponse)
+		m.AddShape(&ArtnodeRequest{Token: "token", Payload: []interface{}{uint8(0), int(shapelib.PATH), svg, "red", "red"}}, response)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		return response.Payload[0].(string)
+	}
+	getSvgString := func(token string, shapeHash string, includePending bool) *MinerResponse {
+		response := new(MinerResponse)
+		m.GetSvgString(&ArtnodeRequest{Token: token, Payload: []interface{}{shapeHash, includePending}}, response)
+		return response
+	}
+	getCanvas := func(token string, includePending bool) map[string]bool {
+		response := new(MinerResponse)
+		m.GetCanvas(&ArtnodeRequest{Token: token, Payload: []interface{}{includePending}}, response)
+		shapes := make(map[string]bool)
+		for i, shapeHash := range response.Payload[1].([]string) {
+			shapes[shapeHash] = response.Payload[3].([]bool)[i]
+		}
+		return shapes
+	}
+
+	mined := addShape("M 0 0 h 10 v 10 h -10 Z")
+	if response := getSvgString("token", mined, false); !errors.Is(response.Error, errorLib.InvalidShapeHashError("")) {
+		t.Error("Expected an unmined shape not to be found, got", response.Error)
+	}
+	if response := getSvgString("token", mined, true); response.Error != nil || !response.Payload[1].(bool) {
+		t.Error("Expected the token's unmined shape to be found as pending, got", response.Payload, response.Error)
+	}
+	if response := getSvgString("other", mined, true); response.Error == nil {
+		t.Error("Expected another token's unmined shape not to be found")
+	}
+	if shapes := getCanvas("token", true); len(shapes) != 1 || !shapes[mined] {
+		t.Error("Expected the canvas to include the pending shape, got", shapes)
+	}
+	if len(getCanvas("token", false)) != 0 || len(getCanvas("other", true)) != 0 {
+		t.Error("Expected the pending shape only to be included for its token when asked")
+	}
+
+	m.lock.Lock()
+	block := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{*m.unminedOps[mined]}, "", 0)
+	m.insertBlock(&block)
+	m.applyBlock(&block)
+	m.updateReadReplica()
+	m.lock.Unlock()
+	if response := getSvgString("token", mined, true); response.Error != nil || response.Payload[1].(bool) {
+		t.Error("Expected the mined shape not to be pending, got", response.Payload, response.Error)
+	}
+
+	// A pending delete hides the shape from its token's canvas
+	response := new(MinerResponse)
+	m.DeleteShape(&ArtnodeRequest{Token: "token", Payload: []interface{}{mined, uint8(0)}}, response)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	added := addShape("M 20 0 h 10 v 10 h -10 Z")
+	if shapes := getCanvas("token", true); len(shapes) != 1 || !shapes[added] {
+		t.Error("Expected only the added shape on the token's canvas, got", shapes)
+	}
+	if shapes := getCanvas("other", true); len(shapes) != 1 || shapes[mined] {
+		t.Error("Expected only the mined shape on another token's canvas, got", shapes)
+	}
+}
+
+// Test that each token's calls are limited by its own token bucket, which
+// refills over time, and that a closed token's bucket is forgotten
+func TestTokenRateLimit(t *testing.T) {
+	var unlimited *TokenRateLimiter
+	if wait := unlimited.take("token", time.Now()); wait != 0 {
+		t.Error("Expected a nil limiter not to limit calls, got", wait)
+	}
+
+	limiter := newTokenRateLimiter(10, 2)
+	now := time.Now()
+	if limiter.take("a", now) != 0 || limiter.take("a", now) != 0 || limiter.take("b", now) != 0 {
+		t.Error("Expected the burst to be allowed")
+	}
+	if wait := limiter.take("a", now); wait != 100*time.Millisecond {
+		t.Error("Expected to wait 100ms after the burst, got", wait)
+	}
+	if wait := limiter.take("a", now.Add(50*time.Millisecond)); wait != 50*time.Millisecond {
+		t.Error("Expected to wait another 50ms, got", wait)
+	}
+	if wait := limiter.take("a", now.Add(100*time.Millisecond)); wait != 0 {
+		t.Error("Expected a call once the bucket refilled, got", wait)
+	}
+
+	m := newTestNode()
+	m.limiter = newTokenRateLimiter(1, 2)
+	m.tokens["other"] = &ArtnodeSession{Created: time.Now()}
+	m.updateReadReplica()
+	getInk := func(token string) error {
+		response := new(MinerResponse)
+		m.GetInk(&ArtnodeRequest{Token: token}, response)
+		return response.Error
+	}
+	if getInk("token") != nil || getInk("token") != nil {
+		t.Error("Expected the burst to be allowed")
+	}
+	if err := getInk("token"); !errorLib.IsType(err, "RateLimitedError") {
+		t.Error("Expected a RateLimitedError, got", err)
+	}
+	if err := getInk("other"); err != nil {
+		t.Error("Expected another token not to be limited, got", err)
+	}
+	if err := getInk("unknown"); !errors.Is(err, errorLib.InvalidTokenError("")) || len(m.limiter.buckets) != 2 {
+		t.Error("Expected an invalid token to get no bucket, got", err)
+	}
+
+	m.CloseCanvas(&ArtnodeRequest{Token: "other"}, new(MinerResponse))
+	if _, exists := m.limiter.buckets["other"]; exists {
+		t.Error("Expected the closed token's bucket to be forgotten")
+	}
+}
+
+// Test that with peer TLS, miners only connect to registered miners, and
+// only to the miner registered for the address they dial, and that art
+// nodes can still connect without TLS but can't call the miner RPCs
+func TestPeerTLS(t *testing.T) {
+	registerGobTypes()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerAddr := listener.Addr().String()
+
+	nodes := []*Miner{newTestNode(), newTestNode(), newTestNode()}
+	for _, m := range nodes {
+		cert, err := loadPeerCertificate("", "", &m.privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.peerTLS = newPeerTLS(cert, m.registry)
+		m.registry.fetched = time.Now()
+	}
+	// The third miner isn't registered
+	for _, m := range nodes {
+		m.registry.keys["127.0.0.1:1"] = getRegisteredKey(nodes[0].pubKeyString)
+		m.registry.keys[peerAddr] = getRegisteredKey(nodes[1].pubKeyString)
+	}
+
+	peer := nodes[1]
+	server := rpc.NewServer()
+	server.Register(peer)
+	// Wait for the connections to be served before the next test replaces
+	// the logger they log to
+	var served sync.WaitGroup
+	defer served.Wait()
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				peer.serveRPCConn(server, conn, getRPCRoles())
+			}()
+		}
+	}()
+
+	client, err := nodes[0].dialPeer(peerAddr)
+	if err != nil {
+		t.Fatal("Expected a registered miner to connect, got", err)
+	}
+	if err = client.Call("Miner.Ping", new(MinerRequest), new(MinerResponse)); err != nil {
+		t.Error("Expected a registered miner's ping to succeed, got", err)
+	}
+	client.Close()
+
+	// A registered miner that isn't the one registered for the address
+	nodes[0].registry.keys[peerAddr] = getRegisteredKey(nodes[0].pubKeyString)
+	if _, err = nodes[0].dialPeer(peerAddr); err == nil || !strings.Contains(err.Error(), "isn't the one registered") {
+		t.Error("Expected a miner with another registered key to be refused, got", err)
+	}
+
+	// The keys are fetched again when they don't match
+	keyServer := rpc.NewServer()
+	fake := &testServer{addresses: map[string]string{peerAddr: getRegisteredKey(nodes[1].pubKeyString)}}
+	keyServer.RegisterName("RServer", fake)
+	nodes[0].registry.setServer(serveTestPipe(t, keyServer.ServeConn), nodes[0].pubKey)
+	nodes[0].registry.fetched = time.Time{}
+	if client, err = nodes[0].dialPeer(peerAddr); err != nil {
+		t.Fatal("Expected the fetched keys to let the miner connect, got", err)
+	}
+	client.Close()
+
+	// Under TLS 1.3 the client's certificate is only refused after the
+	// client's side of the handshake is done
+	if client, err = nodes[2].dialPeer(peerAddr); err == nil {
+		err = client.Call("Miner.Ping", new(MinerRequest), new(MinerResponse))
+		client.Close()
+	}
+	if err == nil {
+		t.Error("Expected an unregistered miner to be refused")
+	}
+
+	artnode, err := rpc.Dial("tcp", peerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer artnode.Close()
+	err = artnode.Call("Miner.Ping", new(MinerRequest), new(MinerResponse))
+	if err == nil || !strings.Contains(err.Error(), "PeerTLSRequired") {
+		t.Error("Expected a miner RPC without TLS to be refused, got", err)
+	}
+	response := new(MinerResponse)
+	if err = artnode.Call("Miner.GetGenesisBlock", &ArtnodeRequest{Token: "token"}, response); err != nil || response.Error != nil {
+		t.Error("Expected an art node RPC without TLS to succeed, got", err, response.Error)
+	}
+}
+
+// Test that art nodes can open a canvas over the artnode TLS listener only
+// if the miner's certificate is for the key they expect
+func TestArtnodeTLS(t *testing.T) {
+	registerGobTypes()
+	m := newTestNode()
+	cert, err := loadPeerCertificate("", "", &m.privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.artnodeTLS = newPeerTLS(cert, m.registry)
+	server := rpc.NewServer()
+	server.Register(m)
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: m.artnodeTLS.config.GetCertificate}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go m.serveArtnodeTLS(server, listener)
+	minerAddr := listener.Addr().String()
+
+	canvas, settings, err := blockartlib.OpenSecureCanvas(minerAddr, m.privKey, "", m.pubKey)
+	if err != nil {
+		t.Fatal("Expected the canvas to open over TLS, got", err)
+	}
+	if settings.CanvasXMax != m.settings.CanvasSettings.CanvasXMax {
+		t.Error("Expected the canvas settings over TLS, got", settings)
+	}
+	if _, err = canvas.GetGenesisBlock(); err != nil {
+		t.Error("Expected an artnode call over TLS to succeed, got", err)
+	}
+	canvas.CloseCanvas()
+
+	other, _ := newTestKey(m, 0)
+	_, _, err = blockartlib.OpenSecureCanvas(minerAddr, m.privKey, "", other.PublicKey)
+	if !errors.Is(err, errorLib.DisconnectedError("")) {
+		t.Error("Expected a certificate for another key to be refused, got", err)
+	}
+
+	conn, err := tls.Dial("tcp", minerAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	err = client.Call("Miner.Ping", new(MinerRequest), new(MinerResponse))
+	if err == nil || !strings.Contains(err.Error(), "PeerTLSRequired") {
+		t.Error("Expected a miner RPC to be refused on the artnode listener, got", err)
+	}
+}
+
+// Test that the canvas is exported as of a block or the final block, with
+// its shapes in the order they were mined, and that the export can be
+// checked against its signature
+func TestExportCanvas(t *testing.T) {
+	m := newTestNode()
+	privKey, pubKeyString := newTestKey(m, 1000)
+	first := addTestShape(t, m, privKey, pubKeyString, "M 10 10 h 10 v 10 h -10 Z")
+	second := addTestShape(t, m, privKey, pubKeyString, "M 30 10 h 10 v 10 h -10 Z")
+	third := addTestShape(t, m, privKey, pubKeyString, "M 50 10 h 10 v 10 h -10 Z")
+	block1 := newBlock(1, m.settings.GenesisBlockHash, []OperationRecord{second, first}, "", 0)
+	m.insertBlock(&block1)
+	block2 := newBlock(2, hashBlock(&block1), []OperationRecord{third}, "", 0)
+	m.insertBlock(&block2)
+
+	if _, err := m.exportCanvas(""); !errors.Is(err, errorLib.InvalidBlockHashError("")) {
+		t.Error("Expected no export before a block is final, got", err)
+	}
+	if _, err := m.exportCanvas("unknown"); !errors.Is(err, errorLib.InvalidBlockHashError("")) {
+		t.Error("Expected no export of an unknown block, got", err)
+	}
+
+	export, err := m.exportCanvas(hashBlock(&block1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := export.Manifest
+	if manifest.BlockNo != 1 || manifest.Final || len(manifest.Shapes) != 2 ||
+		manifest.Shapes[0] != (ManifestShape{second.OpSig, pubKeyString}) || manifest.Shapes[1].ShapeHash != first.OpSig {
+		t.Error("Expected the manifest of block 1's two shapes in mined order, got", manifest)
+	}
+	if strings.Index(export.Svg, "M 30 10") > strings.Index(export.Svg, "M 10 10") || strings.Contains(export.Svg, "M 50 10") {
+		t.Error("Expected the svg of block 1's shapes in mined order, got", export.Svg)
+	}
+
+	m.finalBlock = hashBlock(&block2)
+	export, err = m.exportCanvas("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Manifest.BlockHash != m.finalBlock || !export.Manifest.Final || len(export.Manifest.Shapes) != 3 {
+		t.Error("Expected the manifest of the final block's three shapes, got", export.Manifest)
+	}
+	if err = verifyCanvasExport(&export.Manifest, []byte(export.Svg), m.pubKeyString); err != nil {
+		t.Error("Expected the export to verify, got", err)
+	}
+	if err = verifyCanvasExport(&export.Manifest, []byte(export.Svg), pubKeyString); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected the export to be refused for another key, got", err)
+	}
+	if err = verifyCanvasExport(&export.Manifest, []byte(export.Svg+" "), ""); !errors.Is(err, errorLib.ValidationError("")) {
+		t.Error("Expected a changed svg to be refused, got", err)
+	}
+	export.Manifest.Shapes[0].Owner = m.pubKeyString
+	if err = verifyCanvasExport(&export.Manifest, []byte(export.Svg), ""); !errors.Is(err, errorLib.InvalidSignatureError()) {
+		t.Error("Expected a changed manifest to be refused, got", err)
+	}
+}
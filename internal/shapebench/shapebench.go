@@ -0,0 +1,46 @@
+/*
+
+This package holds the shapes that geometry ops are benchmarked on, shared
+by the shapelib benchmarks and the miner's bench command so that both
+measure the same thing. It isn't part of shapelib's API.
+
+*/
+
+package shapebench
+
+import (
+	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
+)
+
+// Number of steps in the freehand reference shape. Each step adds two
+// vertices.
+const FREEHAND_STEPS int = 500
+
+// A named shape used to measure geometry performance
+type ReferenceShape struct {
+	Name  string
+	Shape shapelib.Shape
+}
+
+// Returns the shapes that geometry ops are benchmarked on, from a
+// simple square up to a freehand path with over a thousand vertices.
+// All of them fit on a 1024 by 1024 canvas.
+func ReferenceShapes() []ReferenceShape {
+	freehand := "M 10 10"
+	for i := 0; i < FREEHAND_STEPS; i++ {
+		freehand += " l 1 0 l 0 1"
+	}
+
+	return []ReferenceShape{
+		ReferenceShape{"Square", shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 10 10 h 100 v 100 h -100 Z", Fill: "red", Stroke: "red"}},
+		ReferenceShape{"Circle", shapelib.Shape{ShapeType: shapelib.CIRCLE, ShapeSvgString: "X 300 Y 300 R 100", Fill: "red", Stroke: "red"}},
+		ReferenceShape{"Freehand", shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: freehand, Fill: "transparent", Stroke: "red"}},
+		ReferenceShape{"Subpaths", shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 600 600 h 200 v 200 h -200 Z M 650 650 h 100 v 100 h -100 Z M 675 675 h 50 v 50 h -50 Z", Fill: "red", Stroke: "red"}},
+	}
+}
+
+// Returns a shape that overlaps none of the reference shapes, so that
+// checking a reference shape against it has to examine every segment.
+func ReferenceProbe() shapelib.Shape {
+	return shapelib.Shape{ShapeType: shapelib.PATH, ShapeSvgString: "M 900 100 h 50 v 50 h -50 Z", Fill: "red", Stroke: "red"}
+}
@@ -0,0 +1,63 @@
+package shapebench
+
+/*
+Usage:
+cd [internal/shapebench]; go test -bench .
+*/
+
+import (
+	"testing"
+)
+
+// Test that the benchmarked shapes exercise the valid code paths
+func TestReferenceShapes(t *testing.T) {
+	var xMax uint32 = 1024
+	var yMax uint32 = 1024
+	probeGeo, _ := ReferenceProbe().GetGeometry()
+
+	for _, ref := range ReferenceShapes() {
+		valid, geo, err := ref.Shape.IsValid(xMax, yMax)
+		if !valid {
+			t.Error("Expected "+ref.Name+" to be valid, got", err)
+		} else if geo.HasOverlap(probeGeo) {
+			t.Error("Expected " + ref.Name + " not to overlap the probe")
+		}
+	}
+}
+
+func BenchmarkGetGeometry(b *testing.B) {
+	for _, ref := range ReferenceShapes() {
+		shape := ref.Shape
+		b.Run(ref.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				shape.GetGeometry()
+			}
+		})
+	}
+}
+
+func BenchmarkHasOverlap(b *testing.B) {
+	probeGeo, _ := ReferenceProbe().GetGeometry()
+	for _, ref := range ReferenceShapes() {
+		geo, _ := ref.Shape.GetGeometry()
+		b.Run(ref.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				geo.HasOverlap(probeGeo)
+			}
+		})
+	}
+}
+
+func BenchmarkGetInkCost(b *testing.B) {
+	for _, ref := range ReferenceShapes() {
+		geo, _ := ref.Shape.GetGeometry()
+		b.Run(ref.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				geo.GetInkCost()
+			}
+		})
+	}
+}
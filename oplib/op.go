@@ -0,0 +1,120 @@
+/*
+
+This package holds the BlockArt op as it is signed, shared by the miners
+and blockartlib so that both encode and sign ops the same way.
+
+*/
+
+package oplib
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+
+	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
+)
+
+// Represents the type of operation for a shape on the canvas
+type OpType int
+
+const (
+	ADD OpType = iota
+	REMOVE
+	// Allows another key to spend some of the signer's ink
+	ALLOW
+	// Hands the signer's ink and shapes over to another key, which is used
+	// when the signer's private key has leaked
+	ROTATE
+)
+
+// Prefix of what ops are signed over (see Digest), so that an op's
+// signature can't be taken for a signature of anything else a key signs
+const SIGNATURE_DOMAIN string = "BlockArt op:"
+
+type Operation struct {
+	Type         OpType
+	Shape        shapelib.Shape
+	Ref          string
+	InkCost      uint32
+	ValidateNum  uint8
+	NumRemaining uint8
+	TimeStamp    int64
+	Deleted      bool
+
+	// Public key of the art node that submitted the op. This is the
+	// miner's own key unless the art node was delegated by the miner.
+	Artnode string
+
+	// For ADD and REMOVE ops, the public key whose ink pays for the shape
+	// and is refunded when it is removed, if it isn't the signer's. The
+	// payer must have allowed the signer to spend its ink with ALLOW ops.
+	Payer string
+
+	// For ALLOW ops, the public key allowed to spend Allowance more of the
+	// signer's ink. An Allowance of 0 revokes what is left of the spender's
+	// allowance.
+	Spender   string
+	Allowance uint32
+
+	// For ROTATE ops, the public key that takes over the signer's ink and
+	// shapes
+	NewKey string
+
+	// For ADD ops, the number of blocks after the op's block at which the
+	// shape is removed and EXPIRY_REFUND_PERCENT of its ink cost refunded
+	// to the payer. 0 means the shape never expires.
+	ExpiryBlocks uint32
+
+	// The signature of an op that must be in an earlier block of the chain
+	// for this op to be mined, if any
+	DependsOn string
+}
+
+type Signature struct {
+	R *big.Int
+	S *big.Int
+}
+
+// Returns the canonical encoding of an op, which is what its signature
+// covers. An op submitted in any other encoding isn't the op as signed.
+func Encode(op *Operation) ([]byte, error) {
+	return json.Marshal(*op)
+}
+
+// Returns the digest an op is signed over: the SHA-256 hash of
+// SIGNATURE_DOMAIN followed by the op's encoding. The whole op has to be
+// hashed, since ECDSA only signs as many leading bytes as the curve's
+// order has, which for an ALLOW or ROTATE op are the same for every op of
+// its type.
+func Digest(encodedOp []byte) []byte {
+	digest := sha256.Sum256(append([]byte(SIGNATURE_DOMAIN), encodedOp...))
+	return digest[:]
+}
+
+// Signs an op with privKey, returning its encoding and its JSON-encoded
+// signature
+func Sign(privKey *ecdsa.PrivateKey, op *Operation) (encodedOp []byte, opSig string, err error) {
+	encodedOp, err = Encode(op)
+	if err != nil {
+		return
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, Digest(encodedOp))
+	if err != nil {
+		return
+	}
+	encodedSig, err := json.Marshal(Signature{r, s})
+	return encodedOp, string(encodedSig), err
+}
+
+// Determines whether opSig is pubKey's signature of an op with the given
+// encoding
+func Verify(pubKey *ecdsa.PublicKey, encodedOp []byte, opSig string) bool {
+	sig := new(Signature)
+	if pubKey == nil || json.Unmarshal([]byte(opSig), sig) != nil || sig.R == nil || sig.S == nil {
+		return false
+	}
+	return ecdsa.Verify(pubKey, Digest(encodedOp), sig.R, sig.S)
+}
@@ -0,0 +1,59 @@
+package oplib
+
+/*
+Usage:
+cd [oplib]; go test
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+// Test that a signature covers every field of the op, however far into
+// its encoding the field is
+func TestSignCoversWholeOp(t *testing.T) {
+	privKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	op := Operation{Type: ALLOW, Spender: "spender", Allowance: 100, TimeStamp: 1}
+	encodedOp, opSig, err := Sign(privKey, &op)
+	if err != nil {
+		t.Fatal(err)
+	} else if !Verify(&privKey.PublicKey, encodedOp, opSig) {
+		t.Fatal("Expected the op's signature to be valid")
+	} else if Verify(&otherKey.PublicKey, encodedOp, opSig) {
+		t.Error("Expected the op's signature to be invalid for another key")
+	} else if Verify(&privKey.PublicKey, encodedOp, "not a signature") {
+		t.Error("Expected a malformed signature to be invalid")
+	}
+
+	for _, tamper := range []func(op *Operation){
+		func(op *Operation) { op.Spender = "other spender" },
+		func(op *Operation) { op.Allowance = 1000 },
+		func(op *Operation) { op.NewKey = "new key" },
+		func(op *Operation) { op.DependsOn = "dependency" },
+	} {
+		tampered := op
+		tamper(&tampered)
+		encodedTampered, _ := Encode(&tampered)
+		if Verify(&privKey.PublicKey, encodedTampered, opSig) {
+			t.Error("Expected the signature of a tampered op to be invalid", tampered)
+		}
+	}
+}
+
+// Test that the digest is domain separated: the raw encoding's own hash
+// isn't what is signed
+func TestDigestDomain(t *testing.T) {
+	encodedOp, _ := Encode(&Operation{Type: ADD, TimeStamp: 1})
+	if string(Digest(encodedOp)) == string(Digest(append([]byte(nil), encodedOp[1:]...))) {
+		t.Error("Expected different encodings to have different digests")
+	}
+	privKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	r, s, _ := ecdsa.Sign(rand.Reader, privKey, encodedOp)
+	if ecdsa.Verify(&privKey.PublicKey, Digest(encodedOp), r, s) {
+		t.Error("Expected a signature of the raw encoding not to verify as the op's")
+	}
+}
@@ -20,6 +20,7 @@ package main
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -27,6 +28,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -51,6 +53,16 @@ func (e AddressAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: address already registered [%s]", string(e))
 }
 
+type InvalidDeregistrationError string
+
+func (e InvalidDeregistrationError) Error() string {
+	return fmt.Sprintf("BlockArt server: invalid deregistration [%s]", string(e))
+}
+
+// Most nanoseconds a deregistration's timestamp may be away from the
+// server's clock
+const DEREGISTER_WINDOW int64 = int64(30 * time.Second)
+
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
@@ -98,6 +110,24 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
+	// Whether filled paths that aren't closed are closed automatically
+	// instead of being rejected
+	AutoCloseOpenPaths bool `json:"auto-close-open-paths"`
+
+	// Most vertices a shape may have, 0 for shapelib.DEFAULT_MAX_VERTICES
+	MaxShapeVertices uint32 `json:"max-shape-vertices"`
+
+	// Depth below the head at which miners attest to the blocks of their
+	// main chain, 0 if miners don't attest and blocks are never final
+	FinalityDepth uint32 `json:"finality-depth"`
+
+	// Percentage of the blocks of a block's finality window whose miners
+	// must attest to it to make it final, 0 for the miners' default (67)
+	FinalityQuorum uint8 `json:"finality-quorum"`
+
+	// Most ops a block may have, 0 for the miners' default (1000)
+	MaxOpsPerBlock uint32 `json:"max-ops-per-block"`
+
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
 }
@@ -118,6 +148,10 @@ type Config struct {
 type AllMiners struct {
 	sync.RWMutex
 	all map[string]*Miner
+
+	// Timestamp of each key's latest deregistration within the last
+	// DEREGISTER_WINDOW, so that it can't be replayed
+	deregistered map[string]int64
 }
 
 var (
@@ -126,7 +160,7 @@ var (
 	errLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	outLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	// Miners in the system.
-	allMiners AllMiners = AllMiners{all: make(map[string]*Miner)}
+	allMiners AllMiners = AllMiners{all: make(map[string]*Miner), deregistered: make(map[string]int64)}
 )
 
 func readConfigOrDie(path string) {
@@ -178,10 +212,32 @@ type MinerInfo struct {
 	Key     ecdsa.PublicKey
 }
 
-// Function to delete dead miners (no recent heartbeat)
-func monitor(k string, heartBeatInterval time.Duration) {
+// A miner's request to deregister, signed with its key over the digest
+// from getDeregisterDigest. Timestamp is in Unix nanoseconds.
+type DeregisterRequest struct {
+	Key       ecdsa.PublicKey
+	Timestamp int64
+	R         *big.Int
+	S         *big.Int
+}
+
+// Returns the digest a miner signs to deregister: the SHA-256 hash of the
+// JSON array ["RServer.Deregister", timestamp]
+func getDeregisterDigest(timestamp int64) []byte {
+	encoded, _ := json.Marshal([]interface{}{"RServer.Deregister", timestamp})
+	digest := sha256.Sum256(encoded)
+	return digest[:]
+}
+
+// Function to delete dead miners (no recent heartbeat). Stops once the
+// miner deregisters, or registers again.
+func monitor(k string, miner *Miner, heartBeatInterval time.Duration) {
 	for {
 		allMiners.Lock()
+		if allMiners.all[k] != miner {
+			allMiners.Unlock()
+			return
+		}
 		if time.Now().UnixNano()-allMiners.all[k].RecentHeartbeat > int64(heartBeatInterval) {
 			outLog.Printf("%s timed out\n", allMiners.all[k].Address.String())
 			delete(allMiners.all, k)
@@ -223,12 +279,13 @@ func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
 		}
 	}
 
-	allMiners.all[k] = &Miner{
+	miner := &Miner{
 		m.Address,
 		time.Now().UnixNano(),
 	}
+	allMiners.all[k] = miner
 
-	go monitor(k, time.Duration(config.MinerSettings.HeartBeat)*time.Millisecond)
+	go monitor(k, miner, time.Duration(config.MinerSettings.HeartBeat)*time.Millisecond)
 
 	*r = config.MinerSettings
 
@@ -288,6 +345,30 @@ func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
 	return nil
 }
 
+// Returns the key each registered miner, including the caller, registered
+// with, by the address it registered, so that a miner connecting to a peer
+// can check that the peer holds the key registered for its address. Each
+// key is encoded with elliptic.Marshal.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) GetMinerKeysByAddress(key ecdsa.PublicKey, keys *map[string]string) error {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+
+	if _, ok := allMiners.all[pubKeyToString(key)]; !ok {
+		return unknownKeyError
+	}
+
+	minerKeys := make(map[string]string, len(allMiners.all))
+	for k, miner := range allMiners.all {
+		minerKeys[miner.Address.String()] = k
+	}
+	*keys = minerKeys
+
+	return nil
+}
+
 // The server also listens for heartbeats from known miners. A miner must
 // send a heartbeat to the server every HeartBeat milliseconds
 // (specified in settings from server) after calling Register, otherwise
@@ -310,6 +391,49 @@ func (s *RServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
 	return nil
 }
 
+// Removes a miner that is shutting down, so that the server stops returning
+// its address to other miners right away instead of once its heartbeats
+// time out. The request must be signed with the miner's key, and its
+// timestamp be within DEREGISTER_WINDOW of the server's clock and later
+// than the key's last deregistration, so that nobody else can deregister
+// the miner or replay its request. The miner may register again afterwards.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+// - InvalidDeregistrationError if the timestamp or signature is not valid.
+func (s *RServer) Deregister(request DeregisterRequest, _ignored *bool) error {
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	k := pubKeyToString(request.Key)
+	miner, ok := allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+
+	now := time.Now().UnixNano()
+	if request.Timestamp < now-DEREGISTER_WINDOW || request.Timestamp > now+DEREGISTER_WINDOW {
+		return InvalidDeregistrationError("timestamp is not recent")
+	} else if request.Timestamp <= allMiners.deregistered[k] {
+		return InvalidDeregistrationError("timestamp was already used")
+	} else if request.R == nil || request.S == nil ||
+		!ecdsa.Verify(&request.Key, getDeregisterDigest(request.Timestamp), request.R, request.S) {
+		return InvalidDeregistrationError("signature does not match the key")
+	}
+	delete(allMiners.all, k)
+
+	for key, timestamp := range allMiners.deregistered {
+		if timestamp < now-DEREGISTER_WINDOW {
+			delete(allMiners.deregistered, key)
+		}
+	}
+	allMiners.deregistered[k] = request.Timestamp
+
+	outLog.Printf("Got Deregister from %s\n", miner.Address.String())
+
+	return nil
+}
+
 func handleErrorFatal(msg string, e error) {
 	if e != nil {
 		errLog.Fatalf("%s, err = %s\n", msg, e.Error())
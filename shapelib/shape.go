@@ -1,10 +1,16 @@
 package shapelib
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"image"
+	"image/color"
 	"math"
+	"math/rand"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,6 +36,75 @@ type CircleCommand struct {
 	Val int64
 }
 
+// The syntax and semantics of a path command, keyed by its absolute
+// (uppercase) type. The relative (lowercase) type takes the same
+// coordinates, as offsets from the current point.
+type pathCommandSpec struct {
+	// The axis each of the command's coordinates sets, in order. Commands
+	// without coordinates (Z) don't move the current point by themselves.
+	axes string
+
+	// The command that each further group of coordinates after the first
+	// is an implicit instance of
+	repeat string
+}
+
+var pathCommandSpecs = map[string]pathCommandSpec{
+	"M": {axes: "xy", repeat: "L"},
+	"L": {axes: "xy", repeat: "L"},
+	"H": {axes: "x", repeat: "H"},
+	"V": {axes: "y", repeat: "V"},
+	"Z": {axes: "", repeat: ""},
+}
+
+// Returns the command of the given type for one group of coordinates
+func (spec pathCommandSpec) getCommand(cmdType string, args []int64) (command PathCommand) {
+	command.CmdType = cmdType
+	for i, axis := range spec.axes {
+		if axis == 'x' {
+			command.X = args[i]
+		} else {
+			command.Y = args[i]
+		}
+	}
+	return
+}
+
+// Returns the type of the implicit command following one of the given
+// type, which is relative if the given type is
+func (spec pathCommandSpec) getRepeat(cmdType string) string {
+	if isRelativeCommand(cmdType) {
+		return strings.ToLower(spec.repeat)
+	}
+	return spec.repeat
+}
+
+// Returns the point a command moves to from the current point. Axes the
+// command has no coordinate for keep the current point's value.
+func (spec pathCommandSpec) getTarget(current Point, command PathCommand) (target Point) {
+	target = current
+	for _, axis := range spec.axes {
+		if axis == 'x' {
+			target.X = command.X
+			if isRelativeCommand(command.CmdType) {
+				target.X += current.X
+			}
+		} else {
+			target.Y = command.Y
+			if isRelativeCommand(command.CmdType) {
+				target.Y += current.Y
+			}
+		}
+	}
+	return
+}
+
+// Determines whether a command's coordinates are relative to the current
+// point, i.e. whether its type is lowercase
+func isRelativeCommand(cmdType string) bool {
+	return cmdType != strings.ToUpper(cmdType)
+}
+
 // </COMMAND>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -44,6 +119,26 @@ const (
 	CIRCLE
 )
 
+// How a filled path with a sub-path that doesn't end where it started is
+// treated. Every miner of a network must use the same policy, since it
+// decides which shapes are valid and what they cost.
+type OpenPathPolicy uint8
+
+const (
+	// Filled paths must close every sub-path
+	REJECT_OPEN_PATHS OpenPathPolicy = iota
+
+	// Each open sub-path of a filled path is closed with a straight line back
+	// to where it started, as SVG renders its fill. The closed geometry is
+	// used for ink cost and overlap.
+	AUTO_CLOSE_OPEN_PATHS
+)
+
+// Most vertices a path may have, unless its network sets another limit.
+// Every vertex adds a segment that overlap checks test, so a shape with
+// many tiny segments could otherwise stall validation on every miner.
+const DEFAULT_MAX_VERTICES uint32 = 1000
+
 type Shape struct {
 	Owner string
 
@@ -51,19 +146,126 @@ type Shape struct {
 	ShapeSvgString string
 	Fill           string
 	Stroke         string
+
+	// How the stroke is drawn. Only encoded from STROKE_STYLE_VERSION on,
+	// so a shape with a style must be of that version or newer.
+	Style StrokeStyle
+
+	// Encoding version of the shape. Zero is the same as version 1, the
+	// original encoding.
+	Version uint8
+
+	// Fields from encoding versions newer than SHAPE_ENCODING_VERSION, kept
+	// as a canonical JSON object so the shape re-encodes byte for byte. A
+	// shape carrying any is never valid. It is exported only so that gob
+	// carries it; its fields are encoded inline by MarshalJSON.
+	Extensions string
 }
 
 func (s Shape) isPath() bool {
 	return s.ShapeType == PATH
 }
 
+// How a shape's stroke is drawn, as the SVG stroke-dasharray,
+// stroke-linecap and stroke-linejoin attributes; empty attributes are left
+// out. The style is only drawn: ink cost and overlap are computed from the
+// shape's geometry alone, as if the stroke were solid with the default
+// caps and joins, so that miners never disagree about a shape however
+// their renderers draw it.
+type StrokeStyle struct {
+	Dasharray string
+	Linecap   string
+	Linejoin  string
+}
+
+// Oldest shape encoding version that encodes a stroke style
+const STROKE_STYLE_VERSION uint8 = 2
+
+// Most lengths a stroke dash array may have
+const MAX_DASHARRAY_LENGTHS int = 16
+
+// A dash array is "none" or non-negative lengths separated by commas
+// and/or whitespace
+var dasharrayRegex = regexp.MustCompile(`^\s*(none|(\d+(\.\d+)?|\.\d+)((\s*,\s*|\s+)(\d+(\.\d+)?|\.\d+))*)\s*$`)
+var dashLengthRegex = regexp.MustCompile(`\d*\.?\d+`)
+
+// Checks the syntax of each attribute of the style. Every attribute ends up
+// quoted in SVG output, so nothing but the SVG keywords and numbers is let
+// through.
+func (style StrokeStyle) validate() error {
+	if style.Dasharray != "" {
+		if !dasharrayRegex.MatchString(style.Dasharray) {
+			return InvalidShapeFillStrokeError("Shape stroke-dasharray must be none or lengths separated by commas or spaces")
+		} else if len(dashLengthRegex.FindAllString(style.Dasharray, -1)) > MAX_DASHARRAY_LENGTHS {
+			return InvalidShapeFillStrokeError("Shape stroke-dasharray has more than " + strconv.Itoa(MAX_DASHARRAY_LENGTHS) + " lengths")
+		}
+	}
+	switch style.Linecap {
+	case "", "butt", "round", "square":
+	default:
+		return InvalidShapeFillStrokeError("Shape stroke-linecap must be butt, round or square")
+	}
+	switch style.Linejoin {
+	case "", "miter", "round", "bevel":
+	default:
+		return InvalidShapeFillStrokeError("Shape stroke-linejoin must be miter, round or bevel")
+	}
+	return nil
+}
+
+// Returns the style's SVG attributes, each preceded by a space, e.g.
+// ` stroke-dasharray="5 3" stroke-linecap="round"`, or "" for a style
+// with no attributes set. The style must be valid.
+func (style StrokeStyle) GetSvgAttributes() string {
+	attributes := ""
+	if style.Dasharray != "" {
+		attributes += ` stroke-dasharray="` + strings.TrimSpace(style.Dasharray) + `"`
+	}
+	if style.Linecap != "" {
+		attributes += ` stroke-linecap="` + style.Linecap + `"`
+	}
+	if style.Linejoin != "" {
+		attributes += ` stroke-linejoin="` + style.Linejoin + `"`
+	}
+	return attributes
+}
+
+// Returns the SVG fill-rule a shape must be drawn with to be filled the way
+// its ink is costed: "evenodd" for a filled path of several sub-paths, so
+// that a sub-path inside another is a hole whichever way it runs, and ""
+// for any other shape, which SVG's default rule fills the same way.
+func (s Shape) GetFillRule() string {
+	if !s.isPath() || s.Fill == "transparent" {
+		return ""
+	}
+	geometry, err := s.getPathGeometry(AUTO_CLOSE_OPEN_PATHS)
+	if err != nil || len(geometry.VertexSets) < 2 {
+		return ""
+	}
+	return "evenodd"
+}
+
 func (s Shape) isCircle() bool {
 	return s.ShapeType == CIRCLE
 }
 
-// Determines whether the shape is valid
+// Determines whether the shape is valid, rejecting filled open paths
 func (s Shape) IsValid(xMax uint32, yMax uint32) (valid bool, geometry ShapeGeometry, err error) {
-	if s.Stroke == "" {
+	return s.IsValidWithPolicy(xMax, yMax, REJECT_OPEN_PATHS)
+}
+
+// Determines whether the shape is valid, treating filled open paths as the
+// policy says. Shapes of an encoding version newer than this shapelib
+// understands, or with fields it doesn't know, are rejected: their cost
+// and overlap can't be worked out without knowing what the fields mean.
+func (s Shape) IsValidWithPolicy(xMax uint32, yMax uint32, policy OpenPathPolicy) (valid bool, geometry ShapeGeometry, err error) {
+	if s.Version > SHAPE_ENCODING_VERSION {
+		err = ValidationError("Shape encoding version " + strconv.Itoa(int(s.Version)) + " is newer than " + strconv.Itoa(int(SHAPE_ENCODING_VERSION)))
+		return
+	} else if s.Extensions != "" {
+		err = ValidationError("Shape has unknown fields " + s.Extensions)
+		return
+	} else if s.Stroke == "" {
 		err = InvalidShapeFillStrokeError("Shape stroke must be specified")
 		return
 	} else if s.Fill == "" {
@@ -72,10 +274,15 @@ func (s Shape) IsValid(xMax uint32, yMax uint32) (valid bool, geometry ShapeGeom
 	} else if s.Stroke == "transparent" && s.Fill == "transparent" {
 		err = InvalidShapeFillStrokeError("Both fill and stroke cannot be transparent")
 		return
+	} else if err = s.Style.validate(); err != nil {
+		return
+	} else if s.Style != (StrokeStyle{}) && s.Version < STROKE_STYLE_VERSION {
+		err = InvalidShapeFillStrokeError("Shape stroke style needs encoding version " + strconv.Itoa(int(STROKE_STYLE_VERSION)))
+		return
 	}
 
 	if s.ShapeType == PATH {
-		geometry, err = s.getPathGeometry()
+		geometry, err = s.getPathGeometry(policy)
 	} else {
 		geometry, err = s.getCircleGeometry()
 	}
@@ -86,319 +293,1144 @@ func (s Shape) IsValid(xMax uint32, yMax uint32) (valid bool, geometry ShapeGeom
 		return
 	}
 
+	// Point out the first command that leaves the canvas
+	var boundsErr *Error
+	if errors.As(err, &boundsErr) && boundsErr.Code == OutOfBoundsCode && s.ShapeType == PATH {
+		err = OutOfBoundsError(boundsErr.Details + " at command " + strconv.Itoa(s.getOutOfBoundsCommand(xMax, yMax)))
+	}
+
 	return
 }
 
+// Returns the position (counting from 1) of the first path command that
+// moves or draws to a point outside the canvas, or 0 if there is none. An
+// implicit command, e.g. each further pair of coordinates after an L, is
+// counted as a command of its own.
+func (s Shape) getOutOfBoundsCommand(xMax uint32, yMax uint32) int {
+	commands, err := s.getPathCommands()
+	if err != nil {
+		return 0
+	}
+
+	current, subpathStart := Point{0, 0}, Point{0, 0}
+	for i, command := range commands {
+		cmdType := strings.ToUpper(command.CmdType)
+		if cmdType == "Z" {
+			current = subpathStart
+			continue
+		}
+
+		current = pathCommandSpecs[cmdType].getTarget(current, command)
+		if cmdType == "M" {
+			subpathStart = current
+		}
+		if !current.inBound(xMax, yMax) {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// Checks, before any geometry is built, that the shape has at most
+// maxVertices vertices: one for each point a path moves or draws to,
+// including the start of a sub-path that closing it returns to. Circles
+// have none. Returns a ComplexityExceededError if there are more.
+func (s Shape) CheckComplexity(maxVertices uint32) error {
+	if !s.isPath() {
+		return nil
+	}
+
+	commands, err := s.getPathCommands()
+	if err != nil {
+		return err
+	} else if uint32(len(commands)) > maxVertices {
+		return ComplexityExceededError(maxVertices)
+	}
+	return nil
+}
+
+// Parses a circle's svg string, e.g. "X 10 Y 10 R 5", into its commands.
+// Each of X, Y and R (in either case) must be given exactly one value, in
+// any order, and the radius must be positive.
 func (s Shape) getCircleCommands() (commands []CircleCommand, err error) {
-	normSvg := normalizeSvgString(s.ShapeSvgString)
-	for {
-		command := CircleCommand{}
+	tokens, valid := tokenizePath(s.ShapeSvgString)
+	if !valid || len(tokens) == 0 {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+		return
+	}
 
-		re := regexp.MustCompile("(^.+?)([a-zA-Z])(.*)")
-		cmdString := strings.Trim(re.ReplaceAllString(normSvg, "$1"), " ")
+	given := make(map[string]bool)
+	for i := 0; i < len(tokens); i += 2 {
+		cmdType := tokens[i]
+		axis := strings.ToUpper(cmdType)
+		if !isPathCommand(cmdType) {
+			err = s.circleError("Value " + cmdType + " has no command.")
+			return
+		} else if axis != "X" && axis != "Y" && axis != "R" {
+			err = s.circleError("Circle has a path command " + cmdType + ".")
+			return
+		} else if given[axis] {
+			err = s.circleError("Circle has more than one " + axis + ".")
+			return
+		} else if i+1 == len(tokens) || isPathCommand(tokens[i+1]) {
+			err = s.circleError("Command " + cmdType + " has no value.")
+			return
+		}
 
-		val, _ := strconv.Atoi(string(cmdString[1:]))
-		cmdType := string(cmdString[0])
-		switch cmdType {
-		case "X", "x":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		case "Y", "y":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		case "R", "r":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		default:
+		val, parseErr := strconv.ParseInt(tokens[i+1], 10, 64)
+		if parseErr != nil {
 			err = InvalidShapeSvgStringError(s.ShapeSvgString)
 			return
+		} else if axis == "R" && val <= 0 {
+			err = s.circleError("Circle radius must be positive.")
+			return
 		}
+		given[axis] = true
+		commands = append(commands, CircleCommand{CmdType: cmdType, Val: val})
+	}
 
-		commands = append(commands, command)
-
-		normSvg = strings.Replace(normSvg, cmdString, "", 1)
-		normSvg = strings.Trim(normSvg, " ")
-		if normSvg == "" {
-			break
+	for _, axis := range []string{"X", "Y", "R"} {
+		if !given[axis] {
+			err = s.circleError("Circle has no " + axis + ".")
+			return
 		}
 	}
-
 	return
 }
 
-func (s Shape) getPathCommands() (commands []PathCommand, err error) {
-	normSvg := normalizeSvgString(s.ShapeSvgString)
-	for {
-		command := PathCommand{}
-
-		re := regexp.MustCompile("(^.+?)([a-zA-Z])(.*)")
-		cmdString := strings.Trim(re.ReplaceAllString(normSvg, "$1"), " ")
+// Returns an InvalidShapeSvgStringError for the shape, caused by the
+// given problem with it
+func (s Shape) circleError(problem string) error {
+	return InvalidShapeSvgStringError(s.ShapeSvgString).Wrap(errors.New(problem))
+}
 
-		pos := strings.Split(string(cmdString[1:]), ",")
-		posEmpty := len(pos) <= 1 && pos[0] == ""
+// Parses a path's svg string into its commands, following the SVG path
+// grammar for the commands BlockArt supports. A command followed by more
+// than one group of coordinates is split into one command per group, so
+// "M 0 0 5 5" becomes "M 0 0" and an implicit "L 5 5".
+func (s Shape) getPathCommands() (commands []PathCommand, err error) {
+	tokens, valid := tokenizePath(s.ShapeSvgString)
+	if !valid || len(tokens) == 0 || strings.ToUpper(tokens[0]) != "M" {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+		return
+	}
 
-		cmdType := string(cmdString[0])
-		switch cmdType {
-		case "M", "m":
-			command.CmdType = cmdType
+	for i := 0; i < len(tokens); {
+		cmdType := tokens[i]
+		spec, exists := pathCommandSpecs[strings.ToUpper(cmdType)]
+		if !exists {
+			err = InvalidShapeSvgStringError(s.ShapeSvgString)
+			return
+		}
 
-			if len(pos) < 2 || posEmpty {
+		var args []int64
+		for i++; i < len(tokens) && !isPathCommand(tokens[i]); i++ {
+			arg, parseErr := strconv.ParseInt(tokens[i], 10, 64)
+			if parseErr != nil {
 				err = InvalidShapeSvgStringError(s.ShapeSvgString)
 				return
-			} else if s.Fill != "transparent" {
-				if pathCommandExists(PathCommand{CmdType: "M"}, commands) || pathCommandExists(PathCommand{CmdType: "m"}, commands) {
-					err = InvalidShapeSvgStringError(s.ShapeSvgString)
-					return
-				}
 			}
+			args = append(args, arg)
+		}
 
-			command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-			command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
-		case "H":
-			command.CmdType = "H"
-
-			if posEmpty {
+		numArgs := len(spec.axes)
+		if numArgs == 0 {
+			if len(args) > 0 {
 				err = InvalidShapeSvgStringError(s.ShapeSvgString)
 				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
 			}
-		case "V":
-			command.CmdType = "V"
+			commands = append(commands, PathCommand{CmdType: cmdType})
+			continue
+		} else if len(args) == 0 || len(args)%numArgs != 0 {
+			err = InvalidShapeSvgStringError(s.ShapeSvgString)
+			return
+		}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
+		for j := 0; j < len(args); j += numArgs {
+			commands = append(commands, spec.getCommand(cmdType, args[j:j+numArgs]))
+			cmdType = spec.getRepeat(cmdType)
+		}
+	}
+
+	return
+}
+
+// A part of an SVG path "d" attribute that importing it leniently left out
+// or changed, so that the imported path only approximates the original
+type PathOmission struct {
+	// Byte offset in the attribute of the command or character
+	Offset int
+
+	// The command (or character) as written, e.g. "C" or "."
+	Command string
+
+	Reason string
+}
+
+// The number of coordinates each SVG curve command takes. BlockArt paths
+// have no curves, so a lenient import draws a line to the curve's end
+// point, which is its last two coordinates.
+var svgCurveArgCounts = map[string]int{
+	"C": 6,
+	"S": 4,
+	"Q": 4,
+	"T": 2,
+	"A": 7,
+}
+
+// A token of an SVG path "d" attribute: a command letter, or a number,
+// which may have a fraction or exponent
+type svgPathToken struct {
+	offset int
+	text   string
+	value  float64
+}
+
+var svgNumberPattern = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+
+// Imports an SVG path "d" attribute, e.g. from a real-world SVG file, as a
+// BlockArt path svg string. Unlike parsing a shape, which rejects the whole
+// string, this recovers what it can and reports the rest. Curves (C, S, Q,
+// T, A) are replaced by a line to their end point, and coordinates with
+// fractions are rounded to the nearest integer. Unknown commands, stray
+// characters, coordinates left over after a command's last complete group,
+// and commands before the first move (M) are skipped. Returns an InvalidShapeSvgStringError if nothing could be recovered.
+func ImportPathSvg(d string) (svg string, omissions []PathOmission, err error) {
+	tokens, omissions := tokenizePathLenient(d)
+	omit := func(token svgPathToken, reason string) {
+		omissions = append(omissions, PathOmission{token.offset, token.text, reason})
+	}
+
+	var commands []PathCommand
+	for i := 0; i < len(tokens); {
+		command := tokens[i]
+		if !isPathCommand(command.text) {
+			omit(command, "coordinate without a command")
+			i++
+			continue
+		}
+
+		var args []svgPathToken
+		for i++; i < len(tokens) && !isPathCommand(tokens[i].text); i++ {
+			args = append(args, tokens[i])
+		}
+
+		cmdType := command.text
+		absType := strings.ToUpper(cmdType)
+		spec, supported := pathCommandSpecs[absType]
+		numArgs := len(spec.axes)
+		if !supported {
+			numCurveArgs, isCurve := svgCurveArgCounts[absType]
+			if !isCurve {
+				omit(command, "unsupported command")
+				continue
+			} else if len(args)%numCurveArgs != 0 {
+				omit(args[len(args)/numCurveArgs*numCurveArgs], "incomplete coordinates")
+			}
+
+			var endPoints []svgPathToken
+			for j := numCurveArgs; j <= len(args); j += numCurveArgs {
+				endPoints = append(endPoints, args[j-2:j]...)
+			}
+			if len(endPoints) > 0 {
+				omit(command, "curve replaced by a line to its end point")
+			}
+			args = endPoints
+			cmdType, spec, numArgs = "L", pathCommandSpecs["L"], 2
+			if isRelativeCommand(command.text) {
+				cmdType = "l"
+			}
+		} else if numArgs == 0 && len(args) > 0 {
+			omit(args[0], "coordinates after a close path")
+			args = nil
+		} else if numArgs > 0 && len(args)%numArgs != 0 {
+			omit(args[len(args)/numArgs*numArgs], "incomplete coordinates")
+			args = args[:len(args)/numArgs*numArgs]
+		}
+
+		if numArgs > 0 && len(args) == 0 {
+			omit(command, "command without coordinates")
+			continue
+		} else if len(commands) == 0 && strings.ToUpper(cmdType) != "M" {
+			omit(command, "command before the first move")
+			continue
+		}
+
+		rounded := make([]int64, len(args))
+		for j, arg := range args {
+			rounded[j] = int64(math.Round(arg.value))
+			if float64(rounded[j]) != arg.value {
+				omit(arg, "coordinate rounded to an integer")
+			}
+		}
+
+		if numArgs == 0 {
+			commands = append(commands, PathCommand{CmdType: cmdType})
+			continue
+		}
+		for j := 0; j < len(rounded); j += numArgs {
+			commands = append(commands, spec.getCommand(cmdType, rounded[j:j+numArgs]))
+			cmdType = spec.getRepeat(cmdType)
+		}
+	}
+
+	if len(commands) == 0 {
+		err = InvalidShapeSvgStringError(d)
+		return
+	}
+
+	return formatPathCommands(commands), omissions, nil
+}
+
+// Splits an SVG path "d" attribute into command letters and numbers,
+// skipping (and reporting) any other characters
+func tokenizePathLenient(d string) (tokens []svgPathToken, omissions []PathOmission) {
+	for i := 0; i < len(d); {
+		c := d[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			i++
+		} else if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			tokens = append(tokens, svgPathToken{offset: i, text: string(c)})
+			i++
+		} else if number := svgNumberPattern.FindString(d[i:]); number != "" {
+			value, _ := strconv.ParseFloat(number, 64)
+			tokens = append(tokens, svgPathToken{i, number, value})
+			i += len(number)
+		} else {
+			omissions = append(omissions, PathOmission{i, string(c), "unexpected character"})
+			i++
+		}
+	}
+
+	return
+}
+
+// Builds an svg path string from path commands, giving each command its
+// type and coordinates
+func formatPathCommands(commands []PathCommand) string {
+	var cmds []string
+	for _, command := range commands {
+		cmds = append(cmds, command.CmdType)
+		for _, axis := range pathCommandSpecs[strings.ToUpper(command.CmdType)].axes {
+			if axis == 'x' {
+				cmds = append(cmds, strconv.FormatInt(command.X, 10))
 			} else {
-				command.Y, _ = strconv.ParseInt(pos[0], 10, 64)
+				cmds = append(cmds, strconv.FormatInt(command.Y, 10))
 			}
-		case "L":
-			command.CmdType = "L"
+		}
+	}
 
-			if len(pos) < 2 || posEmpty {
+	return strings.Join(cmds, " ")
+}
+
+// Gets the shape geometry like GetGeometryWithPolicy, but imports a path's
+// svg string leniently (see ImportPathSvg) first. The geometry's svg string
+// is the imported one. Circles are parsed as usual.
+func (s Shape) GetGeometryLenient(policy OpenPathPolicy) (geometry ShapeGeometry, omissions []PathOmission, err error) {
+	if s.isPath() {
+		s.ShapeSvgString, omissions, err = ImportPathSvg(s.ShapeSvgString)
+		if err != nil {
+			return
+		}
+	}
+
+	geometry, err = s.GetGeometryWithPolicy(policy)
+	return
+}
+
+//Gets the shape geometry of a a provided shape
+func (s Shape) GetGeometry() (geometry ShapeGeometry, err error) {
+	return s.GetGeometryWithPolicy(REJECT_OPEN_PATHS)
+}
+
+// Gets the shape geometry, treating filled open paths as the policy says
+func (s Shape) GetGeometryWithPolicy(policy OpenPathPolicy) (geometry ShapeGeometry, err error) {
+	if s.isCircle() {
+		geometry, err = s.getCircleGeometry()
+	} else if s.isPath() {
+		geometry, err = s.getPathGeometry(policy)
+	}
+
+	return
+}
+
+func (s Shape) getCircleGeometry() (geometry CircleGeometry, err error) {
+	commands, err := s.getCircleCommands()
+	if err != nil {
+		return
+	}
+
+	geometry = CircleGeometry{
+		ShapeSvgString: s.ShapeSvgString,
+		Fill:           s.Fill,
+		Min:            Point{},
+		Max:            Point{}}
+
+	for i := range commands {
+		command := commands[i]
+
+		switch command.CmdType {
+		case "X", "x":
+			geometry.Center.X = int64(command.Val)
+		case "Y", "y":
+			geometry.Center.Y = int64(command.Val)
+		case "R", "r":
+			geometry.Radius = command.Val
+		default:
+			err = InvalidShapeSvgStringError(s.ShapeSvgString)
+			return
+		}
+	}
+
+	geometry.Min.X, geometry.Min.Y = geometry.Center.X-geometry.Radius, geometry.Center.Y-geometry.Radius
+	geometry.Max.X, geometry.Max.Y = geometry.Center.X+geometry.Radius, geometry.Center.Y+geometry.Radius
+
+	return
+}
+
+func (s Shape) getPathGeometry(policy OpenPathPolicy) (geometry PathGeometry, err error) {
+	commands, err := s.getPathCommands()
+	if err != nil {
+		return
+	}
+
+	geometry = PathGeometry{
+		ShapeSvgString: s.ShapeSvgString,
+		Fill:           s.Fill,
+		Min:            Point{},
+		Max:            Point{}}
+
+	// The current point, and the start of the current subpath, which
+	// closing the subpath returns to
+	current, subpathStart := Point{0, 0}, Point{0, 0}
+	var currentVertices []Point
+	for _, command := range commands {
+		switch strings.ToUpper(command.CmdType) {
+		case "M":
+			if len(currentVertices) > 0 {
+				geometry.VertexSets = append(geometry.VertexSets, currentVertices)
+			}
+
+			current = pathCommandSpecs["M"].getTarget(current, command)
+			subpathStart = current
+			currentVertices = []Point{current}
+		case "Z":
+			// Closing a subpath that is already closed does nothing
+			if len(currentVertices) == 0 {
+				continue
+			}
+
+			currentVertices = append(currentVertices, currentVertices[0])
+			geometry.VertexSets = append(geometry.VertexSets, currentVertices)
+			currentVertices = nil
+			current = subpathStart
+		default:
+			// Drawing after closing a subpath starts a new one where the
+			// closed one started
+			if len(currentVertices) == 0 {
+				currentVertices = []Point{subpathStart}
+			}
+
+			current = pathCommandSpecs[strings.ToUpper(command.CmdType)].getTarget(current, command)
+			currentVertices = append(currentVertices, current)
+		}
+	}
+
+	if len(currentVertices) > 0 {
+		geometry.VertexSets = append(geometry.VertexSets, currentVertices)
+	}
+
+	// Close each open sub-path of a filled path, including a deleted one
+	// (whose fill is white), so that it has the geometry it was added with
+	if policy == AUTO_CLOSE_OPEN_PATHS && s.Fill != "transparent" {
+		for i, vSet := range geometry.VertexSets {
+			if vSet[0] != vSet[len(vSet)-1] {
+				geometry.VertexSets[i] = append(vSet, vSet[0])
+			}
+		}
+	}
+
+	geometry.Min, geometry.Max = getVertexBounds(geometry.getAllVertices())
+
+	// Make sure each sub-path is closed
+	if s.Fill != "transparent" && s.Fill != "white" && s.Stroke != "white" {
+		for _, vSet := range geometry.VertexSets {
+			firstVertex := vSet[0]
+			lastVertex := vSet[len(vSet)-1]
+
+			if firstVertex != lastVertex {
 				err = InvalidShapeSvgStringError(s.ShapeSvgString)
 				return
+			}
+		}
+	}
+
+	geometry.LineSegmentSets = make([]LineSegmentSet, len(geometry.VertexSets))
+	for i, vSet := range geometry.VertexSets {
+		geometry.LineSegmentSets[i] = getLineSegments(vSet)
+	}
+
+	return
+}
+
+// </SHAPE>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ENCODING>
+
+// Newest shape encoding version this shapelib understands
+const SHAPE_ENCODING_VERSION uint8 = 2
+
+// Fields of the version 1 encoding, in the order they are encoded
+type shapeV1 struct {
+	Owner          string
+	ShapeType      ShapeType
+	ShapeSvgString string
+	Fill           string
+	Stroke         string
+}
+
+// Encodes the shape as JSON. Shapes are hashed and signed in this form, so
+// it must never change for an existing version. Version 1 encodes exactly
+// as shapes did before versioning. Newer versions encode the version 1
+// fields, then "Version", then every other field sorted by key; a node that
+// doesn't understand a version keeps the unknown fields and so still
+// re-encodes the shape identically. Version 2 adds "StrokeDasharray",
+// "StrokeLinecap" and "StrokeLinejoin", each left out if empty.
+//
+// gob still encodes shapes as plain structs, as it did before versioning,
+// so miners from before versioning exchange version 1 shapes with newer
+// miners unchanged; they ignore the fields they don't know.
+func (s Shape) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(shapeV1{s.Owner, s.ShapeType, s.ShapeSvgString, s.Fill, s.Stroke})
+	if err != nil || s.Version <= 1 {
+		return encoded, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if s.Extensions != "" {
+		if err = json.Unmarshal([]byte(s.Extensions), &fields); err != nil {
+			return nil, err
+		}
+	}
+	styleFields := map[string]string{"StrokeDasharray": s.Style.Dasharray, "StrokeLinecap": s.Style.Linecap, "StrokeLinejoin": s.Style.Linejoin}
+	for key, value := range styleFields {
+		if value != "" {
+			fields[key], _ = json.Marshal(value)
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	buffer.Write(encoded[:len(encoded)-1])
+	buffer.WriteString(`,"Version":` + strconv.Itoa(int(s.Version)))
+	for _, key := range keys {
+		name, _ := json.Marshal(key)
+		buffer.WriteString("," + string(name) + ":" + string(fields[key]))
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+// Decodes a shape encoded by any version. Field names must match exactly.
+func (s *Shape) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*s = Shape{}
+	keys := []string{}
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "Owner":
+			err = json.Unmarshal(value, &s.Owner)
+		case "ShapeType":
+			err = json.Unmarshal(value, &s.ShapeType)
+		case "ShapeSvgString":
+			err = json.Unmarshal(value, &s.ShapeSvgString)
+		case "Fill":
+			err = json.Unmarshal(value, &s.Fill)
+		case "Stroke":
+			err = json.Unmarshal(value, &s.Stroke)
+		case "Version":
+			err = json.Unmarshal(value, &s.Version)
+		case "StrokeDasharray":
+			err = json.Unmarshal(value, &s.Style.Dasharray)
+		case "StrokeLinecap":
+			err = json.Unmarshal(value, &s.Style.Linecap)
+		case "StrokeLinejoin":
+			err = json.Unmarshal(value, &s.Style.Linejoin)
+		default:
+			keys = append(keys, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.Strings(keys)
+	extensions := make([]string, len(keys))
+	for i, key := range keys {
+		var value bytes.Buffer
+		if err := json.Compact(&value, fields[key]); err != nil {
+			return err
+		}
+		name, _ := json.Marshal(key)
+		extensions[i] = string(name) + ":" + value.String()
+	}
+	if len(extensions) > 0 {
+		s.Extensions = "{" + strings.Join(extensions, ",") + "}"
+	}
+
+	return nil
+}
+
+// </ENCODING>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <TRANSFORMS>
+
+// Returned when the scanline rounding of a mirrored shape would charge a
+// different amount of ink than the original shape.
+var ErrMirrorInkCostMismatch = errors.New("Mirrored shape would not cost the same ink.")
+
+// Returns a copy of the shape flipped horizontally, across the vertical
+// line through the centre of its bounding box, with a canonical svg
+// string. The mirrored shape occupies the same bounds and costs the
+// same ink as the original.
+func (s Shape) MirrorX() (mirrored Shape, err error) {
+	return s.mirror(true)
+}
+
+// Returns a copy of the shape flipped vertically, across the horizontal
+// line through the centre of its bounding box, with a canonical svg
+// string. The mirrored shape occupies the same bounds and costs the
+// same ink as the original.
+func (s Shape) MirrorY() (mirrored Shape, err error) {
+	return s.mirror(false)
+}
+
+func (s Shape) mirror(flipX bool) (mirrored Shape, err error) {
+	geometry, err := s.GetGeometry()
+	if err != nil {
+		return
+	}
+
+	mirrored = s
+	if s.isCircle() {
+		// A circle is symmetric about its own centre
+		c := geometry.(CircleGeometry)
+		mirrored.ShapeSvgString = canonicalCircleString(c.Center, c.Radius)
+		return
+	}
+
+	p := geometry.(PathGeometry)
+	min, max := getVertexBounds(p.getAllVertices())
+	vertexSets := make([]VertexSet, len(p.VertexSets))
+	for i, vSet := range p.VertexSets {
+		vertexSets[i] = make(VertexSet, len(vSet))
+		for j, v := range vSet {
+			if flipX {
+				v.X = min.X + max.X - v.X
 			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-				command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
+				v.Y = min.Y + max.Y - v.Y
 			}
-		case "h":
-			command.CmdType = "h"
+			vertexSets[i][j] = v
+		}
+	}
+	mirrored.ShapeSvgString = canonicalPathString(vertexSets)
+
+	mirroredGeometry, err := mirrored.GetGeometry()
+	if err != nil {
+		return
+	} else if mirroredGeometry.GetInkCost() != geometry.GetInkCost() {
+		err = ErrMirrorInkCostMismatch
+	}
+
+	return
+}
+
+// Returns a copy of the shape moved by (dx, dy), with a canonical svg
+// string. The moved shape costs the same ink as the original.
+func (s Shape) Translate(dx int64, dy int64) (translated Shape, err error) {
+	return s.mapPoints(func(p Point) Point {
+		return Point{p.X + dx, p.Y + dy}
+	})
+}
+
+// Returns a copy of the shape moved the least it takes to fit inside a
+// canvas of the given size, with a canonical svg string. A shape that is
+// already inside is returned unchanged. Returns an OutOfBoundsError if the
+// shape is wider or taller than the canvas.
+func (s Shape) TranslateInBounds(xMax uint32, yMax uint32) (translated Shape, err error) {
+	geometry, err := s.GetGeometry()
+	if err != nil {
+		return
+	}
+
+	min, max := geometry.getBounds()
+	if max.X-min.X >= int64(xMax) || max.Y-min.Y >= int64(yMax) {
+		err = OutOfBoundsError(getBoundsOverrun(min, max, xMax, yMax))
+		return
+	}
+
+	dx, dy := getBoundsShift(min.X, max.X, xMax), getBoundsShift(min.Y, max.Y, yMax)
+	if dx == 0 && dy == 0 {
+		return s, nil
+	}
+	return s.Translate(dx, dy)
+}
+
+// Returns a copy of the shape cut down to fit inside a canvas of the given
+// size, with a canonical svg string. Each vertex of a path outside the
+// canvas is moved to the nearest point on its edge. A circle's centre is
+// moved inside the canvas and its radius shrunk until it fits. The clamped
+// shape may cost less ink than the original, and a path may no longer be
+// valid, e.g. if clamping made it intersect itself.
+func (s Shape) ClampToBounds(xMax uint32, yMax uint32) (clamped Shape, err error) {
+	if xMax == 0 || yMax == 0 {
+		err = OutOfBoundsError(getBoundsOverrun(Point{}, Point{}, xMax, yMax))
+		return
+	}
+
+	clampPoint := func(p Point) Point {
+		return Point{clampInt(p.X, 0, int64(xMax)-1), clampInt(p.Y, 0, int64(yMax)-1)}
+	}
+	if !s.isCircle() {
+		return s.mapPoints(clampPoint)
+	}
+
+	geometry, err := s.getCircleGeometry()
+	if err != nil {
+		return
+	}
+	center := clampPoint(geometry.Center)
+	radius := geometry.Radius
+	for _, edgeDist := range []int64{center.X, center.Y, int64(xMax) - 1 - center.X, int64(yMax) - 1 - center.Y} {
+		if edgeDist < radius {
+			radius = edgeDist
+		}
+	}
+
+	clamped = s
+	clamped.ShapeSvgString = canonicalCircleString(center, radius)
+	return
+}
+
+// Returns a copy of the shape with each of its points (a circle's centre)
+// mapped, with a canonical svg string
+func (s Shape) mapPoints(mapPoint func(Point) Point) (mapped Shape, err error) {
+	geometry, err := s.GetGeometry()
+	if err != nil {
+		return
+	}
+
+	mapped = s
+	if s.isCircle() {
+		c := geometry.(CircleGeometry)
+		mapped.ShapeSvgString = canonicalCircleString(mapPoint(c.Center), c.Radius)
+		return
+	}
+
+	p := geometry.(PathGeometry)
+	vertexSets := make([]VertexSet, len(p.VertexSets))
+	for i, vSet := range p.VertexSets {
+		vertexSets[i] = make(VertexSet, len(vSet))
+		for j, v := range vSet {
+			vertexSets[i][j] = mapPoint(v)
+		}
+	}
+	mapped.ShapeSvgString = canonicalPathString(vertexSets)
+
+	return
+}
+
+// Returns how far a span from min to max must move along an axis of the
+// given size to fit inside it, assuming it is short enough to fit
+func getBoundsShift(min int64, max int64, size uint32) int64 {
+	if min < 0 {
+		return -min
+	} else if max >= int64(size) {
+		return int64(size) - 1 - max
+	}
+
+	return 0
+}
+
+func clampInt(v int64, min int64, max int64) int64 {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-			}
-		case "v":
-			command.CmdType = "v"
+	return v
+}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.Y, _ = strconv.ParseInt(pos[0], 10, 64)
-			}
-		case "l":
-			command.CmdType = "l"
+// Builds an svg path string using only absolute M and L commands, closing
+// each vertex set with Z if it ends where it started.
+func canonicalPathString(vertexSets []VertexSet) string {
+	var cmds []string
+	for _, vSet := range vertexSets {
+		if len(vSet) == 0 {
+			continue
+		}
 
-			if len(pos) < 2 || posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-				command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
-			}
-		case "Z", "z":
-			command.CmdType = cmdType
-		default:
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-			return
+		closed := len(vSet) > 2 && vSet[0] == vSet[len(vSet)-1]
+		end := len(vSet)
+		if closed {
+			end = end - 1
+		}
+
+		cmds = append(cmds, "M "+formatPoint(vSet[0]))
+		for _, v := range vSet[1:end] {
+			cmds = append(cmds, "L "+formatPoint(v))
 		}
+		if closed {
+			cmds = append(cmds, "Z")
+		}
+	}
+
+	return strings.Join(cmds, " ")
+}
 
-		commands = append(commands, command)
+// Returns a vertex set in canonical form. A closed vertex set (one that
+// ends where it started) is rotated to start at its smallest vertex, by X
+// and then Y, and an open one keeps its end points; either is then
+// reversed if that makes it smaller (see compareVertices). Two vertex sets
+// that trace the same outline have the same canonical form.
+func canonicalVertexSet(vSet VertexSet) (canonical VertexSet) {
+	closed := len(vSet) > 2 && vSet[0] == vSet[len(vSet)-1]
+	if !closed {
+		canonical = append(VertexSet{}, vSet...)
+		reversed := reverseVertices(vSet)
+		if compareVertices(reversed, canonical) < 0 {
+			canonical = reversed
+		}
+		return
+	}
 
-		normSvg = strings.Replace(normSvg, cmdString, "", 1)
-		normSvg = strings.Trim(normSvg, " ")
-		if normSvg == "" {
-			break
+	// Try every rotation starting at the smallest vertex (it may appear
+	// more than once), in both directions
+	ring := vSet[:len(vSet)-1]
+	smallest := ring[0]
+	for _, vertex := range ring {
+		if compareVertices(VertexSet{vertex}, VertexSet{smallest}) < 0 {
+			smallest = vertex
+		}
+	}
+	for i, start := range ring {
+		if start != smallest {
+			continue
+		}
+		rotated := append(append(VertexSet{}, ring[i:]...), ring[:i]...)
+		rotated = append(rotated, start)
+		for _, candidate := range []VertexSet{rotated, reverseVertices(rotated)} {
+			if canonical == nil || compareVertices(candidate, canonical) < 0 {
+				canonical = candidate
+			}
 		}
 	}
 
 	return
 }
 
-//Gets the shape geometry of a a provided shape
-func (s Shape) GetGeometry() (geometry ShapeGeometry, err error) {
-	if s.isCircle() {
-		geometry, err = s.getCircleGeometry()
-	} else if s.isPath() {
-		geometry, err = s.getPathGeometry()
+// Returns the vertices in reverse order
+func reverseVertices(vSet VertexSet) (reversed VertexSet) {
+	for i := len(vSet) - 1; i >= 0; i-- {
+		reversed = append(reversed, vSet[i])
 	}
 
 	return
 }
 
-func (s Shape) getCircleGeometry() (geometry CircleGeometry, err error) {
-	commands, err := s.getCircleCommands()
-	if err != nil {
-		return
+// Compares vertex sets lexicographically, ordering vertices by X and then
+// Y. Returns -1, 0 or 1.
+func compareVertices(a VertexSet, b VertexSet) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].X != b[i].X {
+			return compareInts(a[i].X, b[i].X)
+		} else if a[i].Y != b[i].Y {
+			return compareInts(a[i].Y, b[i].Y)
+		}
 	}
 
-	geometry = CircleGeometry{
-		ShapeSvgString: s.ShapeSvgString,
-		Fill:           s.Fill,
-		Min:            Point{},
-		Max:            Point{}}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
 
-	for i := range commands {
-		command := commands[i]
+func compareInts(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
 
-		switch command.CmdType {
-		case "X", "x":
-			geometry.Center.X = int64(command.Val)
-		case "Y", "y":
-			geometry.Center.Y = int64(command.Val)
-		case "R", "r":
-			geometry.Radius = command.Val
-		default:
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-			return
+	return 0
+}
+
+// Builds a circle svg string in the form "X cx Y cy R r"
+func canonicalCircleString(center Point, radius int64) string {
+	return "X " + strconv.FormatInt(center.X, 10) + " Y " + strconv.FormatInt(center.Y, 10) + " R " + strconv.FormatInt(radius, 10)
+}
+
+func formatPoint(p Point) string {
+	return strconv.FormatInt(p.X, 10) + " " + strconv.FormatInt(p.Y, 10)
+}
+
+// Computes the bounding box of a set of vertices
+func getVertexBounds(vertices []Point) (min Point, max Point) {
+	for i, v := range vertices {
+		if i == 0 {
+			min, max = v, v
+			continue
+		}
+		if v.X < min.X {
+			min.X = v.X
+		}
+		if v.X > max.X {
+			max.X = v.X
+		}
+		if v.Y < min.Y {
+			min.Y = v.Y
+		}
+		if v.Y > max.Y {
+			max.Y = v.Y
 		}
 	}
 
-	geometry.Min.X, geometry.Min.Y = geometry.Center.X-geometry.Radius, geometry.Center.Y-geometry.Radius
-	geometry.Max.X, geometry.Max.Y = geometry.Center.X+geometry.Radius, geometry.Center.Y+geometry.Radius
-
 	return
 }
 
-func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
-	commands, err := s.getPathCommands()
-	if err != nil {
-		return
-	}
+// </TRANSFORMS>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-	geometry = PathGeometry{
-		ShapeSvgString: s.ShapeSvgString,
-		Fill:           s.Fill,
-		Min:            Point{},
-		Max:            Point{}}
+////////////////////////////////////////////////////////////////////////////////////////////
+// <GEOMETRY ENGINE>
+
+// Version of the GeometryEngine interface and ShapeRules. Raised whenever
+// either changes, so that an engine built against an older version can
+// refuse to register.
+const ENGINE_API_VERSION uint32 = 1
+
+// Name of the engine built from this package's own geometry code
+const REFERENCE_ENGINE string = "reference"
+
+// The network rules a shape is checked against
+type ShapeRules struct {
+	XMax        uint32
+	YMax        uint32
+	MaxVertices uint32
+	Policy      OpenPathPolicy
+}
 
-	absPos, relPos := Point{0, 0}, Point{0, 0}
-	var currentVertices []Point
-	for i := range commands {
-		command := commands[i]
+// Decides everything consensus depends on about shapes: whether they are
+// valid, what they cost and which of them overlap. An alternative engine
+// (e.g. a fixed-point one) can be registered from a file behind a build
+// tag and chosen by name, but every miner of a network must agree on all
+// of these for every shape, so it has to be checked against the reference
+// engine with CompareEngines first.
+type GeometryEngine interface {
+	// Name the engine is registered and chosen by
+	Name() string
+
+	// Builds the geometry of a shape of at most rules.MaxVertices vertices
+	// (DEFAULT_MAX_VERTICES if 0), treating filled open paths as
+	// rules.Policy says. Doesn't check the shape's fill, stroke or bounds.
+	Parse(s Shape, rules ShapeRules) (geometry ShapeGeometry, err error)
+
+	// Parses a shape and checks that it is valid under the rules
+	Validate(s Shape, rules ShapeRules) (geometry ShapeGeometry, err error)
+
+	// Returns the ink a shape of the given geometry costs
+	Cost(geometry ShapeGeometry) uint64
+
+	// Determines whether shapes of the two geometries overlap
+	Overlap(a ShapeGeometry, b ShapeGeometry) bool
+}
 
-		switch command.CmdType {
-		case "M":
-			absPos.X, absPos.Y = command.X, command.Y
-			relPos.X, relPos.Y = command.X, command.Y
+// The engine built from this package's own geometry code, which every
+// other engine must agree with
+type ReferenceEngine struct{}
 
-			if len(currentVertices) > 0 {
-				geometry.VertexSets = append(geometry.VertexSets, currentVertices)
-				currentVertices = []Point{}
-			}
+func (ReferenceEngine) Name() string {
+	return REFERENCE_ENGINE
+}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "m":
-			absPos.X, absPos.Y = relPos.X+command.X, relPos.Y+command.Y
-			relPos.X, relPos.Y = absPos.X, absPos.Y
+func (ReferenceEngine) Parse(s Shape, rules ShapeRules) (geometry ShapeGeometry, err error) {
+	if err = s.CheckComplexity(rules.getMaxVertices()); err != nil {
+		return
+	}
+	return s.GetGeometryWithPolicy(rules.Policy)
+}
 
-			if len(currentVertices) > 0 {
-				geometry.VertexSets = append(geometry.VertexSets, currentVertices)
-				currentVertices = []Point{}
-			}
+func (ReferenceEngine) Validate(s Shape, rules ShapeRules) (geometry ShapeGeometry, err error) {
+	if err = s.CheckComplexity(rules.getMaxVertices()); err != nil {
+		return
+	}
+	_, geometry, err = s.IsValidWithPolicy(rules.XMax, rules.YMax, rules.Policy)
+	return
+}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "H":
-			relPos.X = command.X
+func (ReferenceEngine) Cost(geometry ShapeGeometry) uint64 {
+	return geometry.GetInkCost()
+}
 
-			currentVertices = append(currentVertices, Point{relPos.X, absPos.Y})
-		case "V":
-			relPos.Y = command.Y
+func (ReferenceEngine) Overlap(a ShapeGeometry, b ShapeGeometry) bool {
+	return a.HasOverlap(b)
+}
 
-			currentVertices = append(currentVertices, Point{absPos.X, relPos.Y})
-		case "L":
-			relPos.X, relPos.Y = command.X, command.Y
+func (rules ShapeRules) getMaxVertices() uint32 {
+	if rules.MaxVertices == 0 {
+		return DEFAULT_MAX_VERTICES
+	}
+	return rules.MaxVertices
+}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "h":
-			relPos.X = relPos.X + command.X
+// The engine used where none is chosen. A build tag may replace it from
+// an init function of its own file.
+var DefaultEngine GeometryEngine = ReferenceEngine{}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "v":
-			relPos.Y = relPos.Y + command.Y
+var engines = map[string]GeometryEngine{REFERENCE_ENGINE: ReferenceEngine{}}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "l":
-			relPos.X, relPos.Y = relPos.X+command.X, relPos.Y+command.Y
+// Registers an engine so that it can be chosen by name. Panics if the name
+// is taken or the engine was built against another version of the
+// interface.
+func RegisterEngine(engine GeometryEngine, apiVersion uint32) {
+	if apiVersion != ENGINE_API_VERSION {
+		panic("shapelib: engine " + engine.Name() + " needs API version " + strconv.Itoa(int(apiVersion)))
+	} else if _, exists := engines[engine.Name()]; exists {
+		panic("shapelib: engine " + engine.Name() + " registered twice")
+	}
+	engines[engine.Name()] = engine
+}
 
-			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "Z":
-			currentVertices = append(currentVertices, currentVertices[0])
+// Returns the engine registered under a name, and whether there is one
+func GetEngine(name string) (engine GeometryEngine, exists bool) {
+	engine, exists = engines[name]
+	return
+}
 
-			geometry.VertexSets = append(geometry.VertexSets, currentVertices)
-			currentVertices = []Point{}
-		case "z":
-			currentVertices = append(currentVertices, currentVertices[0])
+// Returns the names of the registered engines, sorted
+func GetEngineNames() (names []string) {
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
 
-			geometry.VertexSets = append(geometry.VertexSets, currentVertices)
-			currentVertices = []Point{}
-		default:
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
+// Runs two engines on the same shapes and describes every way in which
+// they disagree: whether each shape is valid (and if not, the kind of
+// error), what each valid shape costs, and which pairs of valid shapes
+// overlap. Engines that return no mismatches on a broad set of shapes are
+// safe to mix on a network.
+func CompareEngines(a GeometryEngine, b GeometryEngine, shapes []Shape, rules ShapeRules) (mismatches []string) {
+	var aGeos, bGeos []ShapeGeometry
+	var valid []int
+	for i, s := range shapes {
+		aGeo, aErr := a.Validate(s, rules)
+		bGeo, bErr := b.Validate(s, rules)
+		if (aErr == nil) != (bErr == nil) || GetErrorCode(aErr) != GetErrorCode(bErr) {
+			mismatches = append(mismatches, "shape "+strconv.Itoa(i)+" validates as "+describeEngineError(aErr)+" by "+a.Name()+" but "+describeEngineError(bErr)+" by "+b.Name())
+			continue
+		} else if aErr != nil {
+			continue
 		}
 
-		if i == 0 {
-			geometry.Min = relPos
-			geometry.Max = relPos
-		} else {
-			if relPos.X < geometry.Min.X {
-				geometry.Min.X = relPos.X
-			} else if relPos.X > geometry.Max.X {
-				geometry.Max.X = relPos.X
-			}
+		if aCost, bCost := a.Cost(aGeo), b.Cost(bGeo); aCost != bCost {
+			mismatches = append(mismatches, "shape "+strconv.Itoa(i)+" costs "+strconv.FormatUint(aCost, 10)+" by "+a.Name()+" but "+strconv.FormatUint(bCost, 10)+" by "+b.Name())
+		}
+		aGeos, bGeos, valid = append(aGeos, aGeo), append(bGeos, bGeo), append(valid, i)
+	}
 
-			if relPos.Y < geometry.Min.Y {
-				geometry.Min.Y = relPos.Y
-			} else if relPos.Y > geometry.Max.Y {
-				geometry.Max.Y = relPos.Y
+	for i := range valid {
+		for j := range valid {
+			if i == j {
+				continue
+			}
+			if aOverlap, bOverlap := a.Overlap(aGeos[i], aGeos[j]), b.Overlap(bGeos[i], bGeos[j]); aOverlap != bOverlap {
+				mismatches = append(mismatches, "shapes "+strconv.Itoa(valid[i])+" and "+strconv.Itoa(valid[j])+" overlap is "+strconv.FormatBool(aOverlap)+" by "+a.Name()+" but "+strconv.FormatBool(bOverlap)+" by "+b.Name())
 			}
 		}
 	}
+	return
+}
 
-	if len(currentVertices) > 0 {
-		geometry.VertexSets = append(geometry.VertexSets, currentVertices)
+func describeEngineError(err error) string {
+	if err == nil {
+		return "valid"
 	}
+	return Describe(err)
+}
 
-	// Make sure its closed
-	if s.Fill != "transparent" && s.Fill != "white" && s.Stroke != "white" {
-		if len(geometry.VertexSets) > 1 {
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-		} else {
-			firstVertex := geometry.VertexSets[0][0]
-			lastVertex := geometry.VertexSets[0][len(geometry.VertexSets[0])-1]
+// </GEOMETRY ENGINE>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-			if firstVertex != lastVertex {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-			}
-		}
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ROUNDING POLICY>
+
+// How ink costs turn continuous lengths into whole pixels. Every miner of a
+// network must use the same policy, since it decides what shapes cost.
+//
+// A segment, a part of one not retraced by an earlier sub-path, and a
+// circle's circumference cost their length rounded with LENGTH_ROUNDING; a
+// segment that starts and ends at the same point costs POINT_PIXELS.
+//
+// A filled shape costs, for every row from its top to its bottom inclusive,
+// the rounded lengths of its spans on that row, or TANGENT_PIXELS for a row
+// touching a circle at a single point. A span's length doesn't count both
+// of its ends, so a 5 by 5 square costs 6 rows of 5 pixels, 30. Where a row
+// crosses a circle is rounded to a pixel with CROSSING_ROUNDING.
+//
+// ROUNDING_POLICY_VERSION is raised whenever any of this changes.
+const ROUNDING_POLICY_VERSION uint32 = 1
+
+// How a value is rounded to a whole number
+type RoundingMode uint8
 
-		if err != nil {
-			return
-		}
-	}
+const (
+	ROUND_UP RoundingMode = iota
+	ROUND_DOWN
+	ROUND_NEAREST
+)
 
-	geometry.LineSegmentSets = make([]LineSegmentSet, len(geometry.VertexSets))
-	for i, vSet := range geometry.VertexSets {
-		geometry.LineSegmentSets[i] = getLineSegments(vSet)
+const LENGTH_ROUNDING RoundingMode = ROUND_UP
+const CROSSING_ROUNDING RoundingMode = ROUND_UP
+const POINT_PIXELS uint64 = 1
+const TANGENT_PIXELS uint64 = 1
+
+// Rounds a value with the given mode. Halves round away from zero.
+func (mode RoundingMode) round(value float64) float64 {
+	switch mode {
+	case ROUND_DOWN:
+		return math.Floor(value)
+	case ROUND_NEAREST:
+		return math.Round(value)
+	default:
+		return math.Ceil(value)
 	}
+}
 
-	return
+// Returns the pixels of ink a length costs
+func roundLength(length float64) uint64 {
+	return uint64(LENGTH_ROUNDING.round(length))
 }
 
-// </SHAPE>
+// Returns the pixel where a row or column crosses a circle
+func roundCrossing(x float64, y float64) Point {
+	return Point{int64(CROSSING_ROUNDING.round(x)), int64(CROSSING_ROUNDING.round(y))}
+}
+
+// </ROUNDING POLICY>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -409,6 +1441,11 @@ type ShapeGeometry interface {
 	isValid(xMax uint32, yMax uint32) (valid bool, err error)
 	HasOverlap(_s ShapeGeometry) bool
 	containsVertex(vertices []Point) bool
+	getBounds() (min Point, max Point)
+	Cells(cellSize uint32) []Cell
+	SamplePoint(rng *rand.Rand) Point
+	Canonicalize() ShapeGeometry
+	Equal(_g ShapeGeometry) bool
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -457,6 +1494,67 @@ func (p PathGeometry) computePerimeter() (perimiter uint64) {
 	return
 }
 
+// Computes the ink for the outline of a shape with several sub-paths.
+// Any part of a sub-path that retraces a segment of an earlier sub-path
+// is free, since those pixels are already inked. Single crossing points
+// are charged twice, just as they are within one sub-path.
+func (p PathGeometry) computeSubpathPerimeter() (perimeter uint64) {
+	for i, lineSegments := range p.LineSegmentSets {
+		for _, l := range lineSegments {
+			var covered []LineSegment
+			for _, _lineSegments := range p.LineSegmentSets[:i] {
+				for _, _l := range _lineSegments {
+					if overlap, exists := l.getColinearOverlap(_l); exists {
+						covered = append(covered, overlap)
+					}
+				}
+			}
+
+			perimeter = perimeter + l.uncoveredLength(covered)
+		}
+	}
+
+	return
+}
+
+// Computes the filled area of a shape with several closed sub-paths
+// using the even-odd rule: a sub-path nested within an odd number of
+// other sub-paths is a hole, and its area is removed from the area of
+// the sub-path enclosing it. Sub-paths can't intersect (see isValid), so
+// each one lies entirely inside or entirely outside every other.
+func (p PathGeometry) computeEvenOddArea() (area uint64) {
+	var filled, holes uint64
+	for i := range p.VertexSets {
+		depth := 0
+		for j, vSet := range p.VertexSets {
+			if i != j && polygonContains(vSet, p.VertexSets[i][0]) {
+				depth++
+			}
+		}
+
+		if depth%2 == 0 {
+			filled = filled + p.getSubpath(i).computeArea()
+		} else {
+			holes = holes + p.getSubpath(i).computeArea()
+		}
+	}
+
+	if holes > filled {
+		return 0
+	}
+	return filled - holes
+}
+
+// Returns the geometry of a single sub-path of this shape
+func (p PathGeometry) getSubpath(i int) (subpath PathGeometry) {
+	subpath = p
+	subpath.VertexSets = p.VertexSets[i : i+1]
+	subpath.LineSegmentSets = p.LineSegmentSets[i : i+1]
+	subpath.Min, subpath.Max = getVertexBounds(p.VertexSets[i])
+
+	return
+}
+
 // Computes the total area within a polygon using a scanline
 // descending down the y-axis
 // NOTE: This computes the actual number of pixels required to draw shape
@@ -529,8 +1627,12 @@ func (p PathGeometry) computeArea() (area uint64) {
 // Computes the ink required for the given shape according
 // to the fill specification.
 func (p PathGeometry) GetInkCost() (inkUnits uint64) {
-	if p.Fill == "transparent" {
+	if p.Fill == "transparent" && len(p.VertexSets) > 1 {
+		inkUnits = p.computeSubpathPerimeter()
+	} else if p.Fill == "transparent" {
 		inkUnits = p.computePerimeter()
+	} else if len(p.VertexSets) > 1 {
+		inkUnits = p.computeEvenOddArea()
 	} else {
 		inkUnits = p.computeArea()
 	}
@@ -540,19 +1642,17 @@ func (p PathGeometry) GetInkCost() (inkUnits uint64) {
 
 // Determines if the following conditions hold:
 // - The shape is within the given bounding requirements
-// - The shape is non-overlapping if not transparent
+// - The shape (and each of its sub-paths) is non-overlapping if not transparent
 func (p PathGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error) {
 	valid = true
 
-	for _, vertex := range p.getAllVertices() {
-		if valid = vertex.inBound(xMax, yMax); !valid {
-			err = new(OutOfBoundsError)
-			return
-		}
+	min, max := getVertexBounds(p.getAllVertices())
+	if overrun := getBoundsOverrun(min, max, xMax, yMax); overrun != "" {
+		return false, OutOfBoundsError(overrun)
 	}
 
 	if p.Fill != "transparent" {
-		lineSegments := p.LineSegmentSets[0]
+		lineSegments := p.getAllLineSegments()
 		for i := range lineSegments {
 			curSeg := lineSegments[i]
 
@@ -561,46 +1661,179 @@ func (p PathGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error)
 					valid = false
 					err = InvalidShapeSvgStringError(p.ShapeSvgString)
 
-					return
-				}
-			}
+					return
+				}
+			}
+
+			if !valid {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// Determines if a proposed shape overlape this shape.
+func (g PathGeometry) HasOverlap(_g ShapeGeometry) bool {
+	if strings.HasSuffix(reflect.TypeOf(_g).String(), "PathGeometry") {
+		_gP, _ := _g.(PathGeometry)
+		return g.hasPathOverlap(_gP)
+	} else {
+		_gC, _ := _g.(CircleGeometry)
+		return g.hasCircleOverlap(_gC)
+	}
+
+	return false
+}
+
+func (g PathGeometry) hasPathOverlap(_g PathGeometry) (overlap bool) {
+	if intersectExists(g.getAllLineSegments(), _g.getAllLineSegments()) {
+		overlap = true
+	} else if g.Fill != "transparent" && g.containsVertex(_g.getAllVertices()) {
+		overlap = true
+	} else if _g.Fill != "transparent" && _g.containsVertex(g.getAllVertices()) {
+		overlap = true
+	}
+
+	return
+}
+
+func (p PathGeometry) hasCircleOverlap(_c CircleGeometry) bool {
+	return _c.HasOverlap(p)
+}
+
+// Returns the corners of the smallest rectangle holding the path
+func (p PathGeometry) getBounds() (min Point, max Point) {
+	return getVertexBounds(p.getAllVertices())
+}
+
+// Returns the cells of a grid of cellSize squares that the path's outline
+// or fill touches, ordered by row and then column
+func (p PathGeometry) Cells(cellSize uint32) []Cell {
+	lineSegments := p.getAllLineSegments()
+
+	return getCellsInRange(p.Min, p.Max, cellSize, func(cell Cell) bool {
+		minX, minY, maxX, maxY := cell.getBounds(cellSize)
+		for _, l := range lineSegments {
+			if l.intersectsRect(minX, minY, maxX, maxY) {
+				return true
+			}
+		}
+
+		// A cell that no edge crosses is either entirely inside the fill or
+		// entirely outside it, so any one of its pixels will do
+		return p.Fill != "transparent" && p.fillContains(Point{cell.X * int64(cellSize), cell.Y * int64(cellSize)})
+	})
+}
+
+// Returns a pixel of the path chosen uniformly at random from its fill and
+// outline, or from along its outline if it is transparent
+func (p PathGeometry) SamplePoint(rng *rand.Rand) Point {
+	lineSegments := p.getAllLineSegments()
+	if p.Fill == "transparent" {
+		return sampleLineSegments(lineSegments, p.Min, rng)
+	}
+
+	// Every vertex is on the outline, so a pixel is always found
+	for {
+		v := Point{p.Min.X + rng.Int63n(p.Max.X-p.Min.X+1), p.Min.Y + rng.Int63n(p.Max.Y-p.Min.Y+1)}
+		if p.fillContains(v) {
+			return v
+		}
+		for _, l := range lineSegments {
+			if l.distanceTo(v) <= 0.5 {
+				return v
+			}
+		}
+	}
+}
+
+// Returns the length of the path's outline, the sum of the exact lengths
+// of its line segments in pixels, sub-path after sub-path. Moves between
+// sub-paths don't count. Unlike the ink cost this isn't rounded, so that
+// it can be used to animate along the path; nothing on the chain uses it.
+func (p PathGeometry) TotalLength() (length float64) {
+	for _, l := range p.getAllLineSegments() {
+		length = length + l.Start.getDist(l.End)
+	}
+
+	return
+}
+
+// Returns the point that is t pixels along the path's outline from its
+// first vertex, as drawn, so that moving t from 0 to TotalLength traces
+// the path. Sub-paths are traced in order, jumping from the end of one to
+// the start of the next. A t below 0 gives the first vertex and a t past
+// the end gives the last.
+func (p PathGeometry) PointAtLength(t float64) (x float64, y float64) {
+	lineSegments := p.getAllLineSegments()
+	if len(lineSegments) == 0 {
+		return float64(p.Min.X), float64(p.Min.Y)
+	}
 
-			if !valid {
-				break
+	for _, l := range lineSegments {
+		length := l.Start.getDist(l.End)
+		if t <= length {
+			if t <= 0 || length == 0 {
+				return float64(l.Start.X), float64(l.Start.Y)
 			}
+			f := t / length
+			return float64(l.Start.X) + f*float64(l.End.X-l.Start.X), float64(l.Start.Y) + f*float64(l.End.Y-l.Start.Y)
 		}
+		t = t - length
 	}
 
-	return
+	end := lineSegments[len(lineSegments)-1].End
+	return float64(end.X), float64(end.Y)
 }
 
-// Determines if a proposed shape overlape this shape.
-func (g PathGeometry) HasOverlap(_g ShapeGeometry) bool {
-	if strings.HasSuffix(reflect.TypeOf(_g).String(), "PathGeometry") {
-		_gP, _ := _g.(PathGeometry)
-		return g.hasPathOverlap(_gP)
-	} else {
-		_gC, _ := _g.(CircleGeometry)
-		return g.hasCircleOverlap(_gC)
+// Returns the same path in canonical form, with a canonical svg string:
+// each closed sub-path starts at its smallest vertex and runs in whichever
+// direction is smaller, each open sub-path runs in whichever direction is
+// smaller, and the sub-paths are sorted (see canonicalVertexSet)
+func (p PathGeometry) Canonicalize() ShapeGeometry {
+	canonical := p
+	canonical.VertexSets = make([]VertexSet, len(p.VertexSets))
+	for i, vSet := range p.VertexSets {
+		canonical.VertexSets[i] = canonicalVertexSet(vSet)
 	}
+	sort.Slice(canonical.VertexSets, func(i, j int) bool {
+		return compareVertices(canonical.VertexSets[i], canonical.VertexSets[j]) < 0
+	})
 
-	return false
+	canonical.LineSegmentSets = make([]LineSegmentSet, len(canonical.VertexSets))
+	for i, vSet := range canonical.VertexSets {
+		canonical.LineSegmentSets[i] = getLineSegments(vSet)
+	}
+	canonical.ShapeSvgString = canonicalPathString(canonical.VertexSets)
+
+	return canonical
 }
 
-func (g PathGeometry) hasPathOverlap(_g PathGeometry) (overlap bool) {
-	if intersectExists(g.getAllLineSegments(), _g.getAllLineSegments()) {
-		overlap = true
-	} else if g.Fill != "transparent" && g.containsVertex(_g.getAllVertices()) {
-		overlap = true
-	} else if _g.Fill != "transparent" && _g.containsVertex(g.getAllVertices()) {
-		overlap = true
+// Determines if a geometry is the same path as this one, whichever vertex
+// each sub-path starts at, the direction it runs in and the order of the
+// sub-paths. Colours aren't compared, only whether both are transparent.
+func (p PathGeometry) Equal(_g ShapeGeometry) bool {
+	_p, isPath := _g.(PathGeometry)
+	if !isPath || (p.Fill == "transparent") != (_p.Fill == "transparent") {
+		return false
 	}
 
-	return
+	return canonicalPathString(p.Canonicalize().(PathGeometry).VertexSets) ==
+		canonicalPathString(_p.Canonicalize().(PathGeometry).VertexSets)
 }
 
-func (p PathGeometry) hasCircleOverlap(_c CircleGeometry) bool {
-	return _c.HasOverlap(p)
+// Determines if a point not on the path's outline is inside its fill, with
+// sub-paths filled using the even-odd rule
+func (p PathGeometry) fillContains(v Point) (inside bool) {
+	for _, vertices := range p.VertexSets {
+		if polygonContains(vertices, v) {
+			inside = !inside
+		}
+	}
+
+	return
 }
 
 // Determines if any of the vertices are contained with a polygon, using a scanline.
@@ -709,7 +1942,7 @@ func (c CircleGeometry) getLineIntersects(l LineSegment) (intersects []Point) {
 }
 
 func (c CircleGeometry) computePerimeter() (perimeter uint64) {
-	return uint64(math.Ceil(2 * math.Pi * float64(c.Radius)))
+	return roundLength(2 * math.Pi * float64(c.Radius))
 }
 
 func (c CircleGeometry) computeArea() (area uint64) {
@@ -721,7 +1954,7 @@ func (c CircleGeometry) computeArea() (area uint64) {
 
 			area = area + lineSegment.Length()
 		} else if len(intersects) == 1 {
-			area = area + 1
+			area = area + TANGENT_PIXELS
 		}
 	}
 
@@ -741,7 +1974,7 @@ func (c CircleGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error
 	if c.Min.inBound(xMax, yMax) && c.Max.inBound(xMax, yMax) {
 		return true, nil
 	} else {
-		return false, new(OutOfBoundsError)
+		return false, OutOfBoundsError(getBoundsOverrun(c.Min, c.Max, xMax, yMax))
 	}
 }
 
@@ -757,18 +1990,27 @@ func (c CircleGeometry) HasOverlap(_g ShapeGeometry) bool {
 	return false
 }
 
+// Determines if a path overlaps this circle. A filled circle overlaps any
+// path that reaches into it, but a transparent circle only overlaps paths
+// that touch its outline or filled polygons that contain it.
 func (c CircleGeometry) hasPathOverlap(p PathGeometry) bool {
 	vertices := p.getAllVertices()
 	lineSegments := p.getAllLineSegments()
+	r := float64(c.Radius)
 
 	// Does the circle contain any of the polygons vertices?
 	if c.Fill != "transparent" && c.containsVertex(vertices) {
 		return true
 	}
 
-	// Does the circle intersect any of the polygons line segments?
+	// Does any of the polygons line segments reach the circle? A segment
+	// reaches into the circle if its nearest point is within the radius, and
+	// also touches the outline if its farthest point (always an end point)
+	// isn't inside the radius.
 	for _, l := range lineSegments {
-		if len(c.getLineIntersects(l)) > 0 {
+		nearest := l.distanceTo(c.Center)
+		farthest := math.Max(c.Center.getDist(l.Start), c.Center.getDist(l.End))
+		if nearest <= r && (c.Fill != "transparent" || farthest >= r) {
 			return true
 		}
 	}
@@ -811,6 +2053,62 @@ func (c CircleGeometry) hasCircleOverlap(_c CircleGeometry) bool {
 	return false
 }
 
+// Returns the corners of the smallest square holding the circle
+func (c CircleGeometry) getBounds() (min Point, max Point) {
+	return Point{c.Center.X - c.Radius, c.Center.Y - c.Radius}, Point{c.Center.X + c.Radius, c.Center.Y + c.Radius}
+}
+
+// Returns the cells of a grid of cellSize squares that the circle's outline
+// or fill touches, ordered by row and then column. A cell touches the outline
+// if its nearest point is within the radius and its farthest point isn't.
+func (c CircleGeometry) Cells(cellSize uint32) []Cell {
+	xC, yC, r := float64(c.Center.X), float64(c.Center.Y), float64(c.Radius)
+
+	return getCellsInRange(c.Min, c.Max, cellSize, func(cell Cell) bool {
+		minX, minY, maxX, maxY := cell.getBounds(cellSize)
+		nearest := math.Hypot(xC-math.Max(minX, math.Min(xC, maxX)), yC-math.Max(minY, math.Min(yC, maxY)))
+		farthest := math.Hypot(math.Max(xC-minX, maxX-xC), math.Max(yC-minY, maxY-yC))
+
+		return nearest <= r && (c.Fill != "transparent" || farthest >= r)
+	})
+}
+
+// Returns a pixel of the circle chosen uniformly at random from within
+// it, or from along its circumference if it is transparent
+func (c CircleGeometry) SamplePoint(rng *rand.Rand) Point {
+	if c.Fill == "transparent" {
+		angle := rng.Float64() * 2 * math.Pi
+		x := float64(c.Center.X) + float64(c.Radius)*math.Cos(angle)
+		y := float64(c.Center.Y) + float64(c.Radius)*math.Sin(angle)
+		return Point{int64(math.Round(x)), int64(math.Round(y))}
+	}
+
+	// The center is within the circle, so a pixel is always found
+	for {
+		v := Point{c.Min.X + rng.Int63n(c.Max.X-c.Min.X+1), c.Min.Y + rng.Int63n(c.Max.Y-c.Min.Y+1)}
+		if c.Center.getDist(v) <= float64(c.Radius) {
+			return v
+		}
+	}
+}
+
+// Returns the same circle with a canonical svg string
+func (c CircleGeometry) Canonicalize() ShapeGeometry {
+	canonical := c
+	canonical.ShapeSvgString = canonicalCircleString(c.Center, c.Radius)
+
+	return canonical
+}
+
+// Determines if a geometry is the same circle as this one. Colours aren't
+// compared, only whether both are transparent.
+func (c CircleGeometry) Equal(_g ShapeGeometry) bool {
+	_c, isCircle := _g.(CircleGeometry)
+
+	return isCircle && c.Center == _c.Center && c.Radius == _c.Radius &&
+		(c.Fill == "transparent") == (_c.Fill == "transparent")
+}
+
 func (c CircleGeometry) containsVertex(vertices []Point) bool {
 	for _, v := range vertices {
 		if c.Center.getDist(v) <= float64(c.Radius) {
@@ -840,6 +2138,25 @@ func (p Point) inBound(xMax uint32, yMax uint32) bool {
 	return p.X >= 0 && p.Y >= 0 && p.X < int64(xMax) && p.Y < int64(yMax)
 }
 
+// Describes by how much and in which directions a bounding box crosses the
+// edges of the canvas, e.g. "exceeds xMax by 14". The canvas spans
+// 0 <= x < xMax and 0 <= y < yMax, so xMin and yMin are crossed by going
+// below 0. Returns "" if the box is inside the canvas.
+func getBoundsOverrun(min Point, max Point, xMax uint32, yMax uint32) string {
+	var overruns []string
+	addOverrun := func(edge string, by int64) {
+		if by > 0 {
+			overruns = append(overruns, "exceeds "+edge+" by "+strconv.FormatInt(by, 10))
+		}
+	}
+	addOverrun("xMin", -min.X)
+	addOverrun("xMax", max.X-int64(xMax)+1)
+	addOverrun("yMin", -min.Y)
+	addOverrun("yMax", max.Y-int64(yMax)+1)
+
+	return strings.Join(overruns, ", ")
+}
+
 func (p Point) getDist(_p Point) float64 {
 	x1, x2, y1, y2 := p.X, _p.X, p.Y, _p.Y
 	return math.Sqrt(math.Pow(float64(x2-x1), 2) + math.Pow(float64(y2-y1), 2))
@@ -848,6 +2165,317 @@ func (p Point) getDist(_p Point) float64 {
 // </POINT>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
+////////////////////////////////////////////////////////////////////////////////////////////
+// <CELL>
+
+// Represents a square of a grid laid over the canvas, by column and row.
+// With cells of cellSize pixels a side, cell (X, Y) holds the pixels from
+// (X*cellSize, Y*cellSize) to ((X+1)*cellSize-1, (Y+1)*cellSize-1).
+type Cell struct {
+	X int64
+	Y int64
+}
+
+// Returns the cell of a grid that holds the given pixel
+func getCell(p Point, cellSize uint32) Cell {
+	size := float64(cellSize)
+	return Cell{int64(math.Floor(float64(p.X) / size)), int64(math.Floor(float64(p.Y) / size))}
+}
+
+// Returns the edges of a cell, half a pixel beyond its outermost pixels so
+// that neighbouring cells meet
+func (c Cell) getBounds(cellSize uint32) (minX, minY, maxX, maxY float64) {
+	size := float64(cellSize)
+	return float64(c.X)*size - 0.5, float64(c.Y)*size - 0.5, float64(c.X+1)*size - 0.5, float64(c.Y+1)*size - 0.5
+}
+
+// Returns the cells holding the pixels from min to max that touches returns
+// true for, ordered by row and then column. A cellSize of 0 has no cells.
+func getCellsInRange(min Point, max Point, cellSize uint32, touches func(Cell) bool) (cells []Cell) {
+	if cellSize == 0 {
+		return
+	}
+
+	minCell, maxCell := getCell(min, cellSize), getCell(max, cellSize)
+	for y := minCell.Y; y <= maxCell.Y; y++ {
+		for x := minCell.X; x <= maxCell.X; x++ {
+			if cell := (Cell{x, y}); touches(cell) {
+				cells = append(cells, cell)
+			}
+		}
+	}
+
+	return
+}
+
+// </CELL>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <CANVAS OCCUPANCY>
+
+// Default number of pixels a side of the cells a CanvasOccupancy indexes
+// shapes by
+const DEFAULT_OCCUPANCY_CELL_SIZE uint32 = 64
+
+// The geometries of the shapes on a canvas, keyed by an identifier such as
+// the signature of the op that added them. Each shape is indexed by the
+// cells of a grid that its bounding box covers, so that a new shape is
+// only checked for overlap against the shapes whose bounding boxes share a
+// cell with its own.
+type CanvasOccupancy struct {
+	cellSize   uint32
+	engine     GeometryEngine
+	geometries map[string]ShapeGeometry
+	cells      map[Cell]map[string]bool
+}
+
+// Creates an empty occupancy indexed by cells of cellSize pixels a side.
+// Large cells make bulk updates cheaper, small ones overlap checks.
+func NewCanvasOccupancy(cellSize uint32) *CanvasOccupancy {
+	return NewCanvasOccupancyWithEngine(cellSize, DefaultEngine)
+}
+
+// Creates an empty occupancy whose overlap checks are done by the engine
+func NewCanvasOccupancyWithEngine(cellSize uint32, engine GeometryEngine) *CanvasOccupancy {
+	if cellSize == 0 {
+		cellSize = DEFAULT_OCCUPANCY_CELL_SIZE
+	}
+	return &CanvasOccupancy{
+		cellSize:   cellSize,
+		engine:     engine,
+		geometries: make(map[string]ShapeGeometry),
+		cells:      make(map[Cell]map[string]bool)}
+}
+
+// Adds a shape, replacing the shape with the same key if there is one
+func (o *CanvasOccupancy) Add(key string, geometry ShapeGeometry) {
+	o.Remove(key)
+	o.geometries[key] = geometry
+	for _, cell := range o.getCells(geometry) {
+		keys, exists := o.cells[cell]
+		if !exists {
+			keys = make(map[string]bool)
+			o.cells[cell] = keys
+		}
+		keys[key] = true
+	}
+}
+
+// Adds every shape in geometries, e.g. those of a block
+func (o *CanvasOccupancy) AddAll(geometries map[string]ShapeGeometry) {
+	for key, geometry := range geometries {
+		o.Add(key, geometry)
+	}
+}
+
+// Removes a shape. Does nothing if there is no shape with the key.
+func (o *CanvasOccupancy) Remove(key string) {
+	geometry, exists := o.geometries[key]
+	if !exists {
+		return
+	}
+	delete(o.geometries, key)
+	for _, cell := range o.getCells(geometry) {
+		delete(o.cells[cell], key)
+		if len(o.cells[cell]) == 0 {
+			delete(o.cells, cell)
+		}
+	}
+}
+
+// Removes every shape with one of the keys, e.g. those of a block
+func (o *CanvasOccupancy) RemoveAll(keys []string) {
+	for _, key := range keys {
+		o.Remove(key)
+	}
+}
+
+// Returns the shape with the given key, and whether there is one
+func (o *CanvasOccupancy) Get(key string) (geometry ShapeGeometry, exists bool) {
+	geometry, exists = o.geometries[key]
+	return
+}
+
+// Returns the number of shapes
+func (o *CanvasOccupancy) Len() int {
+	return len(o.geometries)
+}
+
+// Returns the keys of the shapes that the given shape overlaps, sorted
+func (o *CanvasOccupancy) Overlaps(geometry ShapeGeometry) (keys []string) {
+	checked := make(map[string]bool)
+	for _, cell := range o.getCells(geometry) {
+		for key := range o.cells[cell] {
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+			if o.engine.Overlap(o.geometries[key], geometry) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return
+}
+
+// Returns the cells covered by a shape's bounding box
+func (o *CanvasOccupancy) getCells(geometry ShapeGeometry) []Cell {
+	min, max := geometry.getBounds()
+	return getCellsInRange(min, max, o.cellSize, func(Cell) bool { return true })
+}
+
+// </CANVAS OCCUPANCY>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RASTER>
+
+// Colours that shapes may be filled or stroked with by name. Other names
+// are drawn in black.
+var namedColors = map[string]color.RGBA{
+	"black":   {0, 0, 0, 255},
+	"white":   {255, 255, 255, 255},
+	"red":     {255, 0, 0, 255},
+	"lime":    {0, 255, 0, 255},
+	"blue":    {0, 0, 255, 255},
+	"yellow":  {255, 255, 0, 255},
+	"cyan":    {0, 255, 255, 255},
+	"aqua":    {0, 255, 255, 255},
+	"magenta": {255, 0, 255, 255},
+	"fuchsia": {255, 0, 255, 255},
+	"gray":    {128, 128, 128, 255},
+	"grey":    {128, 128, 128, 255},
+	"silver":  {192, 192, 192, 255},
+	"maroon":  {128, 0, 0, 255},
+	"olive":   {128, 128, 0, 255},
+	"green":   {0, 128, 0, 255},
+	"purple":  {128, 0, 128, 255},
+	"teal":    {0, 128, 128, 255},
+	"navy":    {0, 0, 128, 255},
+	"orange":  {255, 165, 0, 255},
+}
+
+// Draws shapes, in order, onto a white image of a region of the canvas,
+// with scale pixels per canvas unit. Each pixel takes the colour of the
+// canvas at its centre: a shape's stroke is a line 1 unit wide (but at
+// least a pixel) drawn over its fill, which follows the even-odd rule.
+// Colours are "transparent", #rgb, #rrggbb or one of namedColors. Stroke
+// styles aren't drawn, and shapes without a valid geometry are left out.
+func RenderShapes(shapes []Shape, region image.Rectangle, scale float64, policy OpenPathPolicy) *image.RGBA {
+	width := int(math.Ceil(float64(region.Dx()) * scale))
+	height := int(math.Ceil(float64(region.Dy()) * scale))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	halfWidth := math.Max(0.5, 0.5/scale)
+	for _, shape := range shapes {
+		geometry, err := shape.GetGeometryWithPolicy(policy)
+		if err != nil {
+			continue
+		}
+		fill, filled := parseColor(shape.Fill)
+		stroke, stroked := parseColor(shape.Stroke)
+
+		// Only the pixels within the shape's bounds, widened by the stroke
+		min, max := geometry.getBounds()
+		toPixel := func(v int64, origin int, size int, widen float64) int {
+			pixel := int(math.Floor((float64(v-int64(origin)) + widen) * scale))
+			if pixel < 0 {
+				return 0
+			} else if pixel > size {
+				return size
+			}
+			return pixel
+		}
+		minPX, maxPX := toPixel(min.X, region.Min.X, width, -halfWidth), toPixel(max.X, region.Min.X, width, halfWidth+1)
+		minPY, maxPY := toPixel(min.Y, region.Min.Y, height, -halfWidth), toPixel(max.Y, region.Min.Y, height, halfWidth+1)
+
+		for py := minPY; py < maxPY; py++ {
+			y := float64(region.Min.Y) + (float64(py)+0.5)/scale
+			for px := minPX; px < maxPX; px++ {
+				x := float64(region.Min.X) + (float64(px)+0.5)/scale
+				if stroked && rasterStrokeContains(geometry, x, y, halfWidth) {
+					img.SetRGBA(px, py, stroke)
+				} else if filled && rasterFillContains(geometry, x, y) {
+					img.SetRGBA(px, py, fill)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// Parses a shape's fill or stroke. Returns false for "transparent".
+func parseColor(name string) (c color.RGBA, visible bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "transparent" || name == "none" {
+		return c, false
+	}
+	if named, exists := namedColors[name]; exists {
+		return named, true
+	}
+
+	c = color.RGBA{0, 0, 0, 255}
+	if strings.HasPrefix(name, "#") {
+		digits := name[1:]
+		if len(digits) == 3 {
+			digits = string([]byte{digits[0], digits[0], digits[1], digits[1], digits[2], digits[2]})
+		}
+		if value, err := strconv.ParseUint(digits, 16, 32); err == nil && len(digits) == 6 {
+			c.R, c.G, c.B = uint8(value>>16), uint8(value>>8), uint8(value)
+		}
+	}
+
+	return c, true
+}
+
+// Determines if a point on the canvas is within halfWidth of a shape's
+// outline
+func rasterStrokeContains(geometry ShapeGeometry, x float64, y float64, halfWidth float64) bool {
+	switch g := geometry.(type) {
+	case PathGeometry:
+		for _, lineSegment := range g.getAllLineSegments() {
+			if lineSegment.distanceToFloat(x, y) <= halfWidth {
+				return true
+			}
+		}
+	case CircleGeometry:
+		dist := math.Hypot(x-float64(g.Center.X), y-float64(g.Center.Y))
+		return math.Abs(dist-float64(g.Radius)) <= halfWidth
+	}
+
+	return false
+}
+
+// Determines if a point on the canvas is inside a shape's fill, with
+// sub-paths filled using the even-odd rule
+func rasterFillContains(geometry ShapeGeometry, x float64, y float64) (inside bool) {
+	switch g := geometry.(type) {
+	case PathGeometry:
+		// Count the edges crossed by a ray from the point towards +x
+		for _, l := range g.getAllLineSegments() {
+			startX, startY := float64(l.Start.X), float64(l.Start.Y)
+			endX, endY := float64(l.End.X), float64(l.End.Y)
+			if (startY > y) != (endY > y) && x < startX+(y-startY)*(endX-startX)/(endY-startY) {
+				inside = !inside
+			}
+		}
+	case CircleGeometry:
+		inside = math.Hypot(x-float64(g.Center.X), y-float64(g.Center.Y)) <= float64(g.Radius)
+	}
+
+	return
+}
+
+// </RASTER>
+////////////////////////////////////////////////////////////////////////////////////////////
+
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <LINE SEGMENT>
 
@@ -863,16 +2491,66 @@ type LineSegment struct {
 }
 
 // Determines the length of a given line segments
-// rounding to the nearest integer greater than the float
+// in whole pixels (see LENGTH_ROUNDING)
 func (l LineSegment) Length() uint64 {
 	if l.Start == l.End {
-		return 1
+		return POINT_PIXELS
 	} else {
 		a, b := float64(l.Start.X-l.End.X), float64(l.Start.Y-l.End.Y)
 		c := math.Sqrt(math.Pow(a, 2) + math.Pow(b, 2))
 
-		return uint64(math.Ceil(c))
+		return roundLength(c)
+	}
+}
+
+// Determines the shortest distance from a point to the line segment
+func (l LineSegment) distanceTo(p Point) float64 {
+	return l.distanceToFloat(float64(p.X), float64(p.Y))
+}
+
+func (l LineSegment) distanceToFloat(x float64, y float64) float64 {
+	dx, dy := float64(l.End.X-l.Start.X), float64(l.End.Y-l.Start.Y)
+	if dx == 0 && dy == 0 {
+		return math.Hypot(float64(l.Start.X)-x, float64(l.Start.Y)-y)
+	}
+
+	// Project the point onto the line, clamped to the segment's end points
+	t := ((x-float64(l.Start.X))*dx + (y-float64(l.Start.Y))*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+
+	return math.Hypot(float64(l.Start.X)+t*dx-x, float64(l.Start.Y)+t*dy-y)
+}
+
+// Determines if any part of the line segment lies within a rectangle, by
+// clipping the segment to each of the rectangle's edges in turn
+func (l LineSegment) intersectsRect(minX, minY, maxX, maxY float64) bool {
+	x, y := float64(l.Start.X), float64(l.Start.Y)
+	dx, dy := float64(l.End.X)-x, float64(l.End.Y)-y
+
+	// The segment is Start + t*(dx, dy) for t from tMin to tMax
+	tMin, tMax := 0.0, 1.0
+	for _, edge := range [][2]float64{{-dx, x - minX}, {dx, maxX - x}, {-dy, y - minY}, {dy, maxY - y}} {
+		towards, distance := edge[0], edge[1]
+		if towards == 0 {
+			if distance < 0 {
+				return false
+			}
+		} else if t := distance / towards; towards < 0 {
+			tMin = math.Max(tMin, t)
+		} else {
+			tMax = math.Min(tMax, t)
+		}
 	}
+
+	return tMin <= tMax
+}
+
+// Returns the point a fraction t of the way along the line segment,
+// rounded to the nearest pixel
+func (l LineSegment) pointAt(t float64) Point {
+	x := float64(l.Start.X) + t*float64(l.End.X-l.Start.X)
+	y := float64(l.Start.Y) + t*float64(l.End.Y-l.Start.Y)
+	return Point{int64(math.Round(x)), int64(math.Round(y))}
 }
 
 // Determines if a point lies on a line segment -- Assumes point found by intersection
@@ -964,23 +2642,97 @@ func (l LineSegment) Intersects(_l LineSegment) bool {
 	}
 }
 
-// </LINE SEGMENT>
-////////////////////////////////////////////////////////////////////////////////////////////
+// Determines if a point lies on the infinite line through a line segment
+func (l LineSegment) onLine(p Point) bool {
+	return l.A*p.X+l.B*p.Y == l.C
+}
 
-////////////////////////////////////////////////////////////////////////////////////////////
-// <FUNCTIONS>
+// Position of a point along a line segment, measured on the axis the
+// segment spans the most of
+func (l LineSegment) getKey(p Point) int64 {
+	if math.Abs(float64(l.End.X-l.Start.X)) >= math.Abs(float64(l.End.Y-l.Start.Y)) {
+		return p.X
+	}
+	return p.Y
+}
 
-// Determines if the given command exists in a set of commands
-func pathCommandExists(c PathCommand, commands []PathCommand) bool {
-	for _, command := range commands {
-		if c.CmdType == command.CmdType {
-			return true
+// Returns the part of this line segment that lies on _l, if the two
+// segments are colinear and share more than a single point
+func (l LineSegment) getColinearOverlap(_l LineSegment) (overlap LineSegment, exists bool) {
+	if l.Start == l.End || _l.Start == _l.End || !l.onLine(_l.Start) || !l.onLine(_l.End) {
+		return
+	}
+
+	start, end := l.Start, l.End
+	if l.getKey(start) > l.getKey(end) {
+		start, end = end, start
+	}
+	_start, _end := _l.Start, _l.End
+	if l.getKey(_start) > l.getKey(_end) {
+		_start, _end = _end, _start
+	}
+
+	if l.getKey(_start) > l.getKey(start) {
+		start = _start
+	}
+	if l.getKey(_end) < l.getKey(end) {
+		end = _end
+	}
+	if l.getKey(start) >= l.getKey(end) {
+		return
+	}
+
+	return getLineSegment(start, end), true
+}
+
+// Computes the length of the parts of this line segment not covered by
+// any of the given (colinear) line segments. Each uncovered part is
+// rounded on its own, so an uncovered segment has its usual Length.
+func (l LineSegment) uncoveredLength(covered []LineSegment) uint64 {
+	if len(covered) == 0 || l.Start == l.End {
+		return l.Length()
+	}
+
+	type interval struct{ from, to int64 }
+	from, to := l.getKey(l.Start), l.getKey(l.End)
+	if from > to {
+		from, to = to, from
+	}
+
+	intervals := make([]interval, len(covered))
+	for i, c := range covered {
+		intervals[i] = interval{l.getKey(c.Start), l.getKey(c.End)}
+		if intervals[i].from > intervals[i].to {
+			intervals[i].from, intervals[i].to = intervals[i].to, intervals[i].from
 		}
 	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].from < intervals[j].from })
 
-	return false
+	a, b := float64(l.Start.X-l.End.X), float64(l.Start.Y-l.End.Y)
+	lengthPerKey := math.Sqrt(math.Pow(a, 2)+math.Pow(b, 2)) / float64(to-from)
+
+	var length uint64
+	for _, c := range intervals {
+		if c.from > from {
+			length = length + roundLength(float64(c.from-from)*lengthPerKey)
+		}
+		if c.to > from {
+			from = c.to
+		}
+	}
+	if to > from {
+		length = length + roundLength(float64(to-from)*lengthPerKey)
+	}
+
+	return length
 }
 
+// </LINE SEGMENT>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <FUNCTIONS>
+
 // Determines if the given vertex exists in a set of vertices
 func vertexExists(v Point, vertices []Point) bool {
 	for _, vertex := range vertices {
@@ -992,6 +2744,47 @@ func vertexExists(v Point, vertices []Point) bool {
 	return false
 }
 
+// Splits a path's svg string into command letters and integers. Numbers
+// are separated from each other by whitespace, a comma, or the sign of the
+// second number. Returns false if the string contains anything else, e.g.
+// a decimal point or a sign without digits.
+func tokenizePath(svg string) (tokens []string, valid bool) {
+	for i := 0; i < len(svg); {
+		c := svg[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '-' || c == '+' || isDigit(c):
+			j := i + 1
+			for j < len(svg) && isDigit(svg[j]) {
+				j++
+			}
+			if !isDigit(svg[j-1]) {
+				return nil, false
+			}
+			tokens = append(tokens, svg[i:j])
+			i = j
+		default:
+			return nil, false
+		}
+	}
+
+	return tokens, true
+}
+
+// Determines whether a path token is a command letter rather than a number
+func isPathCommand(token string) bool {
+	c := token[0]
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
 // Normalizes SVG string removing all spaces and adding commas
 func normalizeSvgString(svg string) (normSvg string) {
 	// Set commas between numbers
@@ -1030,11 +2823,16 @@ func getLineSegment(v1 Point, v2 Point) (lineSegment LineSegment) {
 	return
 }
 
-// Determines if an intersect exists between two sets of line segments
+// Determines if an intersect exists between two sets of line segments.
+// Intersects skips a segment ending where the other starts (consecutive
+// segments of one path), but segments of different shapes that meet that
+// way still share a pixel, whichever direction the shapes were drawn in.
 func intersectExists(lineSegments []LineSegment, _lineSegments []LineSegment) bool {
 	for _, _lineSegment := range _lineSegments {
 		for _, lineSegment := range lineSegments {
-			if intersect := lineSegment.Intersects(_lineSegment); intersect {
+			if lineSegment.End == _lineSegment.Start || _lineSegment.End == lineSegment.Start {
+				return true
+			} else if intersect := lineSegment.Intersects(_lineSegment); intersect {
 				return true
 			}
 		}
@@ -1100,6 +2898,48 @@ func getLineSegments(vertices []Point) (lineSegments []LineSegment) {
 	return
 }
 
+// Returns a point chosen uniformly at random along the line segments, by
+// length. Returns def if the line segments have no length.
+func sampleLineSegments(lineSegments []LineSegment, def Point, rng *rand.Rand) Point {
+	var total float64
+	for _, l := range lineSegments {
+		total = total + l.Start.getDist(l.End)
+	}
+	if total == 0 {
+		return def
+	}
+
+	d := rng.Float64() * total
+	for _, l := range lineSegments {
+		length := l.Start.getDist(l.End)
+		if length > 0 && d <= length {
+			return l.pointAt(d / length)
+		}
+		d = d - length
+	}
+
+	// Only reached through rounding, at the very end of the last segment
+	return lineSegments[len(lineSegments)-1].End
+}
+
+// Determines if a point lies strictly within a closed polygon, by counting
+// how many of its edges a ray cast from the point in the +x direction
+// crosses. Points on the boundary may be reported either way.
+func polygonContains(vertices VertexSet, v Point) bool {
+	inside := false
+	for i := 0; i < len(vertices)-1; i++ {
+		v1, v2 := vertices[i], vertices[i+1]
+		if (v1.Y > v.Y) != (v2.Y > v.Y) {
+			x := float64(v1.X) + float64(v.Y-v1.Y)*float64(v2.X-v1.X)/float64(v2.Y-v1.Y)
+			if float64(v.X) < x {
+				inside = !inside
+			}
+		}
+	}
+
+	return inside
+}
+
 // Computes the regular geometric area of polygon
 // NOTE: This computes the 'geometric' area, but which doesnt match the actual pixel-based area
 func computeGeoArea(vertices []Point) uint64 {
@@ -1143,10 +2983,7 @@ func solveCircleForY(x float64, xC float64, yC float64, r float64, onLineSegment
 
 	for _, p := range _points {
 		if onLineSegment.hasFloatPoint(p[0], p[1]) {
-			x := int64(math.Ceil(p[0]))
-			y := int64(math.Ceil(p[1]))
-
-			points = append(points, Point{x, y})
+			points = append(points, roundCrossing(p[0], p[1]))
 		}
 	}
 
@@ -1178,10 +3015,7 @@ func solveCircleForX(y float64, xC float64, yC float64, r float64, onLineSegment
 
 	for _, p := range _points {
 		if onLineSegment.hasFloatPoint(p[0], p[1]) {
-			x := int64(math.Ceil(p[0]))
-			y := int64(math.Ceil(p[1]))
-
-			points = append(points, Point{x, y})
+			points = append(points, roundCrossing(p[0], p[1]))
 		}
 	}
 
@@ -8,8 +8,21 @@ IMPORTANT: import '. ../errorlib' in shape.go must be set to path relative to yo
 */
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+
+	. "proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
 )
 
 // Test normalization
@@ -71,6 +84,113 @@ func TestGetCommands(t *testing.T) {
 	}
 }
 
+// Test that circles must give each of X, Y and R exactly one value, with a
+// positive radius, and say what is wrong with those that don't
+func TestMalformedCircle(t *testing.T) {
+	valid := []string{"X 10 Y 10 R 5", "r 5 x 10 y 10", "X10Y10R5", "X 10, Y 10, R +5"}
+	for _, svg := range valid {
+		circle := Shape{ShapeType: CIRCLE, ShapeSvgString: svg}
+		if _, err := circle.getCircleGeometry(); err != nil {
+			t.Error("Expected", svg, "to be valid, got", err)
+		}
+	}
+
+	malformed := []struct {
+		svg     string
+		problem string
+	}{
+		{"", "Bad shape svg string"},
+		{"X 10 Y 10", "Circle has no R."},
+		{"Y 10 R 5", "Circle has no X."},
+		{"X 10 Y 10 R 5 X 20", "Circle has more than one X."},
+		{"X 10 Y 10 r 5 R 6", "Circle has more than one R."},
+		{"X 10 Y R 5", "Command Y has no value."},
+		{"X 10 Y 10 R", "Command R has no value."},
+		{"X 10 20 Y 10 R 5", "Value 20 has no command."},
+		{"10 X 10 Y 10 R 5", "Value 10 has no command."},
+		{"X 10 Y 10 R 5 L 20 20", "Circle has a path command L."},
+		{"M 10 10 R 5", "Circle has a path command M."},
+		{"X 10 Y 10 R 0", "Circle radius must be positive."},
+		{"X 10 Y 10 R -5", "Circle radius must be positive."},
+		{"X 10 Y 10 R 5.5", "Bad shape svg string"}}
+	for _, test := range malformed {
+		circle := Shape{ShapeType: CIRCLE, ShapeSvgString: test.svg}
+		if _, err := circle.getCircleGeometry(); err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Error("Expected", test.svg, "to fail with", test.problem, "got", err)
+		}
+	}
+}
+
+// Test the SVG semantics of each path command, including relative and
+// implicit commands and commands after a subpath is closed
+func TestPathSemantics(t *testing.T) {
+	tests := []struct {
+		name       string
+		svg        string
+		vertexSets []VertexSet
+	}{
+		{"absolute H and V keep the other coordinate", "M 10 10 L 20 30 V 40 H 5",
+			[]VertexSet{{{10, 10}, {20, 30}, {20, 40}, {5, 40}}}},
+		{"relative h and v move from the current point", "M 10 10 h 5 v -3",
+			[]VertexSet{{{10, 10}, {15, 10}, {15, 7}}}},
+		{"implicit L after M", "M 0 0 5 5 10 0",
+			[]VertexSet{{{0, 0}, {5, 5}, {10, 0}}}},
+		{"implicit l after m", "m 1 1 2 2 3 0",
+			[]VertexSet{{{1, 1}, {3, 3}, {6, 3}}}},
+		{"implicit L after L", "M 0 0 L 1 2 3 4",
+			[]VertexSet{{{0, 0}, {1, 2}, {3, 4}}}},
+		{"repeated h and v coordinates", "M 0 0 h 5 5 v 2 2",
+			[]VertexSet{{{0, 0}, {5, 0}, {10, 0}, {10, 2}, {10, 4}}}},
+		{"repeated H and V coordinates", "M 0 0 H 5 7 V 2 9",
+			[]VertexSet{{{0, 0}, {5, 0}, {7, 0}, {7, 2}, {7, 9}}}},
+		{"m after Z is relative to the subpath start", "M 10 10 h 5 v 5 Z m 1 1 h 2",
+			[]VertexSet{{{10, 10}, {15, 10}, {15, 15}, {10, 10}}, {{11, 11}, {13, 11}}}},
+		{"M after Z is absolute", "M 10 10 h 5 v 5 Z M 1 1 h 2",
+			[]VertexSet{{{10, 10}, {15, 10}, {15, 15}, {10, 10}}, {{1, 1}, {3, 1}}}},
+		{"drawing after z starts at the subpath start", "M 10 10 h 5 v 5 z l 0 -5",
+			[]VertexSet{{{10, 10}, {15, 10}, {15, 15}, {10, 10}}, {{10, 10}, {10, 5}}}},
+		{"closing a closed subpath does nothing", "M 0 0 h 5 v 5 Z Z",
+			[]VertexSet{{{0, 0}, {5, 0}, {5, 5}, {0, 0}}}},
+		{"numbers without spaces", "M10,10L-5-5l+3,0",
+			[]VertexSet{{{10, 10}, {-5, -5}, {-2, -5}}}},
+		{"whitespace around commas", " M 10 , 10\th\n5 ",
+			[]VertexSet{{{10, 10}, {15, 10}}}},
+		{"empty", "", nil},
+		{"no moveto first", "L 5 5", nil},
+		{"moveto missing a coordinate", "M 10", nil},
+		{"lineto with an odd number of coordinates", "M 0 0 L 1 2 3", nil},
+		{"command without coordinates", "M 0 0 h", nil},
+		{"coordinates after Z", "M 0 0 h 5 Z 5", nil},
+		{"decimal coordinate", "M 1.5 2", nil},
+		{"unsupported command", "M 1 2 Q 3 4 5 6", nil},
+		{"sign without digits", "M - 5 5", nil},
+		{"invalid characters", "M 0 0 L 5 5 <&>", nil},
+		{"coordinate out of range", "M 99999999999999999999 0", nil},
+	}
+
+	for _, test := range tests {
+		shape := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: test.svg}
+		geo, err := shape.getPathGeometry(REJECT_OPEN_PATHS)
+		if test.vertexSets == nil {
+			if err == nil {
+				t.Error("Expected an error for", test.name+", got", geo.VertexSets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error("Expected no error for", test.name+", got", err)
+		} else if !reflect.DeepEqual(geo.VertexSets, test.vertexSets) {
+			t.Error("Expected", test.vertexSets, "for", test.name+", got", geo.VertexSets)
+		}
+	}
+
+	// The bounds cover every vertex, including those H and V move to
+	geo, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 L 20 30 V 40 H 5"}.getPathGeometry(REJECT_OPEN_PATHS)
+	if geo.Min != (Point{5, 10}) || geo.Max != (Point{20, 40}) {
+		t.Error("Expected bounds {5 10} {20 40}, got", geo.Min, geo.Max)
+	}
+}
+
 // Test get geometry
 func TestGetPathGeometry(t *testing.T) {
 	shapeCircle1 := Shape{ShapeType: CIRCLE, ShapeSvgString: "X 10 Y 10 R 34"}
@@ -82,6 +202,7 @@ func TestGetPathGeometry(t *testing.T) {
 	shapeFilledClosed2 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 L 10 10"}
 	shapeFilledClosed3 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 L 10 10 Z m 10 10 h 3 l -1 3 L 10 10 Z"}
 	shapeFilledOpen := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3"}
+	shapeFilledOpen2 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 Z M 20 20 h 3 l -1 3"}
 
 	if _, err := shapeTransClosed.GetGeometry(); err != nil {
 		t.Error("Expected no error for transparent closed shape, got: ", err)
@@ -103,8 +224,12 @@ func TestGetPathGeometry(t *testing.T) {
 		t.Error("Expected no error for filled close shape, got: ", err)
 	}
 
-	if _, err := shapeFilledClosed3.GetGeometry(); err == nil {
-		t.Error("Expected error for filled closed shape with multiple 'moveto', but got none.")
+	if _, err := shapeFilledClosed3.GetGeometry(); err != nil {
+		t.Error("Expected no error for filled closed shape with multiple 'moveto', got: ", err)
+	}
+
+	if _, err := shapeFilledOpen2.GetGeometry(); err == nil {
+		t.Error("Expected error for filled shape with an open 'moveto', got none")
 	}
 
 	if _, err := shapeFilledOpen.GetGeometry(); err == nil {
@@ -120,6 +245,58 @@ func TestGetPathGeometry(t *testing.T) {
 	}
 }
 
+func TestAutoCloseOpenPaths(t *testing.T) {
+	open := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: "M 10 10 h 30 v 30 M 50 50 h 10 v 10 h -10 Z"}
+	closed := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: "M 10 10 h 30 v 30 Z M 50 50 h 10 v 10 h -10 Z"}
+
+	if _, _, err := open.IsValidWithPolicy(100, 100, REJECT_OPEN_PATHS); err == nil {
+		t.Error("Expected the open path to be rejected")
+	}
+	_, openGeo, err := open.IsValidWithPolicy(100, 100, AUTO_CLOSE_OPEN_PATHS)
+	if err != nil {
+		t.Fatal("Expected the open path to be closed, got", err)
+	}
+	closedGeo, _ := closed.GetGeometry()
+	if !openGeo.Equal(closedGeo) || openGeo.GetInkCost() != closedGeo.GetInkCost() {
+		t.Error("Expected the open path to cost as much as the closed one:", openGeo.GetInkCost(), closedGeo.GetInkCost())
+	}
+
+	// The closing edge counts for overlap
+	probe, _ := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 20 15 L 20 30"}.GetGeometry()
+	if !openGeo.HasOverlap(probe) {
+		t.Error("Expected a line inside the closed triangle to overlap it")
+	}
+
+	// Transparent paths are left open
+	line := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 10 10 h 30 v 30"}
+	lineGeo, _ := line.GetGeometryWithPolicy(AUTO_CLOSE_OPEN_PATHS)
+	if vertexSets := lineGeo.(PathGeometry).VertexSets; len(vertexSets[0]) != 3 {
+		t.Error("Expected the transparent path to stay open, got", vertexSets)
+	}
+}
+
+// Test that paths with too many vertices are rejected before their geometry
+// is built, and that repeated coordinates and closings count as vertices
+func TestCheckComplexity(t *testing.T) {
+	square := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: "M 0 0 h 10 v 10 h -10 Z"}
+	if err := square.CheckComplexity(5); err != nil {
+		t.Error("Expected a square to have 5 vertices, got", err)
+	}
+	if err := square.CheckComplexity(4); err == nil || !strings.Contains(err.Error(), "[4] vertices") {
+		t.Error("Expected a ComplexityExceededError, got", err)
+	}
+
+	zigzag := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 0 0 l 1 1 1 -1 1 1 1 -1"}
+	if err := zigzag.CheckComplexity(4); err == nil {
+		t.Error("Expected the implicit line commands to count")
+	}
+
+	circle := Shape{ShapeType: CIRCLE, Fill: "red", Stroke: "red", ShapeSvgString: "X 10 Y 10 R 5"}
+	if err := circle.CheckComplexity(0); err != nil {
+		t.Error("Expected a circle to have no vertices, got", err)
+	}
+}
+
 // Test vertices generated from commands
 func TestGetVertices(t *testing.T) {
 	shapeClosed := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 Z"}
@@ -320,6 +497,55 @@ func TestShapeValid(t *testing.T) {
 	if valid, _, err := shapeCircleOutOfBound.IsValid(xMax, yMax); valid != false || err == nil {
 		t.Error("Expected invalid shape, got valid")
 	}
+
+	// Out of bounds errors say how far, which way and, for paths, where
+	pathOutOfBounds := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M 50 50 h 10 v 63 h -55"}
+	if _, _, err := pathOutOfBounds.IsValid(xMax, yMax); err == nil || !strings.HasSuffix(err.Error(), "[exceeds yMax by 14 at command 3]") {
+		t.Error("Expected the path to exceed yMax by 14 at command 3, got", err)
+	}
+	if _, _, err := shapeCircleOutOfBound.IsValid(xMax, yMax); err == nil || !strings.HasSuffix(err.Error(), "[exceeds xMin by 1400, exceeds xMax by 1501, exceeds yMin by 1400, exceeds yMax by 1501]") {
+		t.Error("Expected the circle to exceed every edge, got", err)
+	}
+}
+
+func TestBoundsHelpers(t *testing.T) {
+	xMax := uint32(100)
+	yMax := uint32(100)
+
+	square := Shape{ShapeType: PATH, Stroke: "red", Fill: "non-transparent", ShapeSvgString: "M 90 -5 h 20 v 20 h -20 Z"}
+	translated, err := square.TranslateInBounds(xMax, yMax)
+	if err != nil || translated.ShapeSvgString != "M 79 0 L 99 0 L 99 20 L 79 20 Z" {
+		t.Error("Expected the square to move inside the canvas, got", translated.ShapeSvgString, err)
+	}
+	geo, _ := square.GetGeometry()
+	translatedGeo, _ := translated.GetGeometry()
+	if valid, _, err := translated.IsValid(xMax, yMax); !valid || translatedGeo.GetInkCost() != geo.GetInkCost() {
+		t.Error("Expected the moved square to be valid and cost the same ink, got", err)
+	}
+
+	clamped, err := square.ClampToBounds(xMax, yMax)
+	if err != nil || clamped.ShapeSvgString != "M 90 0 L 99 0 L 99 15 L 90 15 Z" {
+		t.Error("Expected the square to be clamped to the canvas, got", clamped.ShapeSvgString, err)
+	}
+
+	circle := Shape{ShapeType: CIRCLE, Stroke: "red", Fill: "non-transparent", ShapeSvgString: "X 95 Y 50 R 10"}
+	if translated, _ := circle.TranslateInBounds(xMax, yMax); translated.ShapeSvgString != "X 89 Y 50 R 10" {
+		t.Error("Expected X 89 Y 50 R 10, got", translated.ShapeSvgString)
+	}
+	if clamped, _ := circle.ClampToBounds(xMax, yMax); clamped.ShapeSvgString != "X 95 Y 50 R 4" {
+		t.Error("Expected X 95 Y 50 R 4, got", clamped.ShapeSvgString)
+	}
+
+	// A shape already inside is left alone, and one wider than the canvas
+	// can't be moved inside it
+	inside := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M 10 10 h 5"}
+	if translated, _ := inside.TranslateInBounds(xMax, yMax); translated != inside {
+		t.Error("Expected the shape to be unchanged, got", translated.ShapeSvgString)
+	}
+	wide := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M -10 10 h 150"}
+	if _, err := wide.TranslateInBounds(xMax, yMax); err == nil || !strings.HasSuffix(err.Error(), "[exceeds xMin by 10, exceeds xMax by 41]") {
+		t.Error("Expected an OutOfBoundsError, got", err)
+	}
 }
 
 // Test ink usage
@@ -381,6 +607,60 @@ func TestInkRequired(t *testing.T) {
 	}
 }
 
+// Test that the rounding policy and the ink costs it gives are unchanged.
+// A change to either splits consensus with miners that don't have it, so
+// these are only updated along with ROUNDING_POLICY_VERSION.
+func TestRoundingPolicy(t *testing.T) {
+	if ROUNDING_POLICY_VERSION != 1 || LENGTH_ROUNDING != ROUND_UP || CROSSING_ROUNDING != ROUND_UP || POINT_PIXELS != 1 || TANGENT_PIXELS != 1 {
+		t.Fatal("Expected rounding policy 1, got version", ROUNDING_POLICY_VERSION)
+	}
+
+	modes := []struct {
+		mode   RoundingMode
+		values []float64
+	}{
+		{ROUND_UP, []float64{2, 3, 3, 3}},
+		{ROUND_DOWN, []float64{2, 2, 2, 2}},
+		{ROUND_NEAREST, []float64{2, 2, 3, 3}},
+	}
+	for _, m := range modes {
+		for i, value := range []float64{2, 2.2, 2.5, 2.7} {
+			if rounded := m.mode.round(value); rounded != m.values[i] {
+				t.Error("Expected mode", m.mode, "to round", value, "to", m.values[i], "got", rounded)
+			}
+		}
+	}
+
+	golden := []struct {
+		shape Shape
+		ink   uint64
+	}{
+		{Shape{ShapeType: PATH, Fill: "red", ShapeSvgString: "M 5 5 h 5 v 5 h -5 Z"}, 30},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 5 5 h 5 v 5 h -5 Z"}, 20},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 1 1"}, 2},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 3 7"}, 8},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 5 5 L 5 5"}, 9},
+		{Shape{ShapeType: PATH, Fill: "red", ShapeSvgString: "M 0 0 L 7 3 L 2 9 Z"}, 29},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 7 3 L 2 9 Z"}, 26},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 h 10 M 3 0 h 3"}, 10},
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 9 3 M 3 1 L 6 2"}, 10},
+		{Shape{ShapeType: PATH, Fill: "red", ShapeSvgString: "M 0 0 h 20 v 20 h -20 Z M 5 5 h 10 v 10 h -10 Z"}, 310},
+		{Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 10 Y 10 R 1"}, 7},
+		{Shape{ShapeType: CIRCLE, Fill: "red", ShapeSvgString: "X 10 Y 10 R 1"}, 4},
+		{Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 20 Y 20 R 7"}, 44},
+		{Shape{ShapeType: CIRCLE, Fill: "red", ShapeSvgString: "X 20 Y 20 R 7"}, 148},
+		{Shape{ShapeType: CIRCLE, Fill: "red", ShapeSvgString: "X 50 Y 50 R 33"}, 3408},
+	}
+	for _, g := range golden {
+		geometry, err := g.shape.GetGeometry()
+		if err != nil {
+			t.Error(g.shape.ShapeSvgString, err)
+		} else if ink := geometry.GetInkCost(); ink != g.ink {
+			t.Error("Expected", g.shape.Fill, g.shape.ShapeSvgString, "to cost", g.ink, "ink units, got", ink)
+		}
+	}
+}
+
 // Test overlap
 func TestOverlap(t *testing.T) {
 	shapeCircle1 := Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 5"}
@@ -676,3 +956,1105 @@ func TestOverlap(t *testing.T) {
 	}
 
 }
+
+// Test mirroring shapes
+func TestMirror(t *testing.T) {
+	shapes := []Shape{
+		Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 5 5 h 4 l -2 5 z"},                       // Triangle
+		Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 10 5 L 26 5 l -4 15 l -4 -10 l -4 10 Z"}, // Dracula teeth
+		Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 10 5 L 26 5 l -4 15 l -4 -10 l -4 10 Z"},     // Dracula teeth
+		Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 30 35 l 20 5 l -20 10 Z"},                // Triangle
+		Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 10 10 l 5 5 M 20 20 l 5 8"},                  // Multiple moveto
+		Shape{ShapeType: CIRCLE, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "X 10 Y 10 R 10"},                         // Filled circle
+	}
+
+	for _, shape := range shapes {
+		geo, _ := shape.GetGeometry()
+		for _, mirror := range []func() (Shape, error){shape.MirrorX, shape.MirrorY} {
+			mirrored, err := mirror()
+			if err != nil {
+				t.Error("Expected no error mirroring "+shape.ShapeSvgString+", got", err)
+				continue
+			}
+
+			mirroredGeo, err := mirrored.GetGeometry()
+			if err != nil {
+				t.Error("Expected mirrored shape "+mirrored.ShapeSvgString+" to be valid, got", err)
+				continue
+			}
+
+			if mirroredGeo.GetInkCost() != geo.GetInkCost() {
+				t.Error("Expected "+strconv.FormatUint(geo.GetInkCost(), 10)+" ink units for "+mirrored.ShapeSvgString+", got", mirroredGeo.GetInkCost())
+			}
+
+			if valid, _, err := mirrored.IsValid(100, 100); !valid {
+				t.Error("Expected mirrored shape "+mirrored.ShapeSvgString+" to be valid, got", err)
+			}
+
+			if shape.isPath() {
+				min, max := getVertexBounds(geo.(PathGeometry).getAllVertices())
+				_min, _max := getVertexBounds(mirroredGeo.(PathGeometry).getAllVertices())
+				if min != _min || max != _max {
+					t.Error("Expected mirrored shape " + mirrored.ShapeSvgString + " to have the same bounds.")
+				}
+			} else if geo.(CircleGeometry).Min != mirroredGeo.(CircleGeometry).Min || geo.(CircleGeometry).Max != mirroredGeo.(CircleGeometry).Max {
+				t.Error("Expected mirrored shape " + mirrored.ShapeSvgString + " to have the same bounds.")
+			}
+		}
+	}
+
+	triangle := Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 5 5 h 4 l -2 5 z"}
+	mirrored, _ := triangle.MirrorX()
+	if mirrored.ShapeSvgString != "M 9 5 L 5 5 L 7 10 Z" {
+		t.Error("Expected M 9 5 L 5 5 L 7 10 Z, got", mirrored.ShapeSvgString)
+	}
+
+	mirrored, _ = triangle.MirrorY()
+	if mirrored.ShapeSvgString != "M 5 10 L 9 10 L 7 5 Z" {
+		t.Error("Expected M 5 10 L 9 10 L 7 5 Z, got", mirrored.ShapeSvgString)
+	}
+
+	// Scanline rounding charges this triangle differently once flipped
+	skewed := Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 0 0 L 7 3 L 2 9 Z"}
+	if _, err := skewed.MirrorX(); err != ErrMirrorInkCostMismatch {
+		t.Error("Expected ink cost mismatch, got", err)
+	}
+}
+
+// Test ink usage and validity of shapes with several sub-paths
+func TestSubpaths(t *testing.T) {
+	xMax := uint32(100)
+	yMax := uint32(100)
+
+	retraced := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M 10 10 l 5 5 M 10 10 l 5 5"}                                      // Line drawn twice
+	extended := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M 10 10 h 10 M 15 10 h 10"}                                        // Line half drawn twice
+	outlined := Shape{ShapeType: PATH, Stroke: "red", Fill: "transparent", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 10 10 h 20 v 20"}                      // Square with two sides drawn twice
+	squares := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 5 5 h 5 v 5 h -5 Z M 20 20 h 5 v 5 h -5 Z"}                               // Two squares
+	donut := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 15 15 h 10 v 10 h -10 Z"}                         // Square with a hole
+	island := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 15 15 h 10 v 10 h -10 Z M 18 18 h 4 v 4 h -4 Z"} // Square in a hole
+	crossed := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 15 15 h 20 v 10 h -20 Z"}                       // Overlapping squares
+	inHole := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 19 19 h 2 v 2 h -2 Z"}                                                     // Square inside the donut's hole
+	costs := map[Shape]uint64{retraced: 8, extended: 15, outlined: 80, squares: 60, donut: 420 - 110, island: 420 - 110 + 20}
+
+	for shape, cost := range costs {
+		valid, geo, err := shape.IsValid(xMax, yMax)
+		if !valid {
+			t.Error("Expected "+shape.ShapeSvgString+" to be valid, got", err)
+		} else if ink := geo.GetInkCost(); ink != cost {
+			t.Error("Expected "+strconv.FormatUint(cost, 10)+" ink units for "+shape.ShapeSvgString+", got", ink)
+		}
+	}
+
+	if valid, _, err := crossed.IsValid(xMax, yMax); valid || err == nil {
+		t.Error("Expected overlapping sub-paths to be invalid, got valid")
+	}
+
+	donutGeo, _ := donut.GetGeometry()
+	inHoleGeo, _ := inHole.GetGeometry()
+	if donutGeo.HasOverlap(inHoleGeo) || inHoleGeo.HasOverlap(donutGeo) {
+		t.Error("Expected shape inside a hole not to overlap")
+	}
+
+	// Holes are drawn as holes whichever way they run, but only filled
+	// shapes of several sub-paths need the even-odd rule
+	reversed := Shape{ShapeType: PATH, Stroke: "red", Fill: "red", ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z M 15 15 v 10 h 10 v -10 Z"}
+	circle := Shape{ShapeType: CIRCLE, Stroke: "red", Fill: "red", ShapeSvgString: "X 50 Y 50 R 10"}
+	fillRules := map[Shape]string{donut: "evenodd", reversed: "evenodd", island: "evenodd", squares: "evenodd", inHole: "", outlined: "", circle: ""}
+	for shape, fillRule := range fillRules {
+		if rule := shape.GetFillRule(); rule != fillRule {
+			t.Error("Expected fill-rule \""+fillRule+"\" for "+shape.ShapeSvgString+", got", rule)
+		}
+	}
+	if reversedGeo, _ := reversed.GetGeometry(); reversedGeo.GetInkCost() != costs[donut] {
+		t.Error("Expected a hole to cost the same whichever way it runs, got", reversedGeo.GetInkCost())
+	}
+}
+
+// Test that shapes encode as before versioning, and that fields from newer
+// versions survive a round trip
+func TestShapeEncoding(t *testing.T) {
+	shape := Shape{Owner: "abc", ShapeType: PATH, ShapeSvgString: "M 0 0 L 5 5 <&>", Fill: "transparent", Stroke: "red"}
+	unversioned := struct {
+		Owner          string
+		ShapeType      ShapeType
+		ShapeSvgString string
+		Fill           string
+		Stroke         string
+	}{shape.Owner, shape.ShapeType, shape.ShapeSvgString, shape.Fill, shape.Stroke}
+
+	expected, _ := json.Marshal(unversioned)
+	encoded, err := json.Marshal(shape)
+	if err != nil || !bytes.Equal(encoded, expected) {
+		t.Error("Expected "+string(expected)+", got", string(encoded), err)
+	}
+	shape.Version = 1
+	if encoded, _ = json.Marshal(shape); !bytes.Equal(encoded, expected) {
+		t.Error("Expected version 1 to encode without a version, got", string(encoded))
+	}
+
+	newer := []byte(`{"Owner":"abc","ShapeType":1,"ShapeSvgString":"X 5 Y 5 R 2","Fill":"red","Stroke":"red","Version":3,"Layer":2,"StrokeWidth":{"Value": 1.5}}`)
+	var decoded Shape
+	if err := json.Unmarshal(newer, &decoded); err != nil {
+		t.Fatal("Expected newer shape to decode, got", err)
+	}
+	if decoded.Version != 3 || decoded.ShapeType != CIRCLE || decoded.ShapeSvgString != "X 5 Y 5 R 2" {
+		t.Error("Unexpected decoded shape", decoded)
+	}
+	expected = []byte(`{"Owner":"abc","ShapeType":1,"ShapeSvgString":"X 5 Y 5 R 2","Fill":"red","Stroke":"red","Version":3,"Layer":2,"StrokeWidth":{"Value":1.5}}`)
+	if encoded, _ = json.Marshal(decoded); !bytes.Equal(encoded, expected) {
+		t.Error("Expected "+string(expected)+", got", string(encoded))
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(decoded); err != nil {
+		t.Fatal("Expected shape to gob encode, got", err)
+	}
+	var received Shape
+	if err := gob.NewDecoder(&buffer).Decode(&received); err != nil || received != decoded {
+		t.Error("Expected gob round trip to keep the shape, got", received, err)
+	}
+}
+
+// Test that gob encodes shapes as it did before versioning, so that
+// miners from before versioning and newer miners can exchange ops
+func TestShapeGobCompatibility(t *testing.T) {
+	type unversionedShape struct {
+		Owner          string
+		ShapeType      ShapeType
+		ShapeSvgString string
+		Fill           string
+		Stroke         string
+	}
+	type unversionedOp struct {
+		Shape   unversionedShape
+		InkCost uint32
+	}
+	type versionedOp struct {
+		Shape   Shape
+		InkCost uint32
+	}
+	shape := Shape{Owner: "abc", ShapeType: PATH, ShapeSvgString: "M 0 0 L 5 5", Fill: "transparent", Stroke: "red"}
+	old := unversionedOp{unversionedShape{shape.Owner, shape.ShapeType, shape.ShapeSvgString, shape.Fill, shape.Stroke}, 7}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(versionedOp{shape, 7}); err != nil {
+		t.Fatal(err)
+	}
+	var fromNew unversionedOp
+	if err := gob.NewDecoder(&buffer).Decode(&fromNew); err != nil || fromNew != old {
+		t.Error("Expected an old miner to decode the shape, got", fromNew, err)
+	}
+
+	buffer.Reset()
+	if err := gob.NewEncoder(&buffer).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	var fromOld versionedOp
+	if err := gob.NewDecoder(&buffer).Decode(&fromOld); err != nil || fromOld.Shape != shape || fromOld.InkCost != 7 {
+		t.Error("Expected the shape of an old miner to decode, got", fromOld, err)
+	}
+}
+
+// Test that shapes of a newer encoding version, or with fields this version
+// doesn't know, decode but aren't valid
+func TestShapeEncodingRejectsUnknown(t *testing.T) {
+	encodings := []string{
+		`{"Owner":"abc","ShapeType":0,"ShapeSvgString":"M 10 10 h 5","Fill":"transparent","Stroke":"red","Version":9,"StrokeWidth":500,"Junk":"xxxx"}`,
+		`{"Owner":"abc","ShapeType":0,"ShapeSvgString":"M 10 10 h 5","Fill":"transparent","Stroke":"red","Version":3}`,
+		`{"Owner":"abc","ShapeType":0,"ShapeSvgString":"M 10 10 h 5","Fill":"transparent","Stroke":"red","Version":2,"Junk":"xxxx"}`,
+		`{"Owner":"abc","ShapeType":0,"ShapeSvgString":"M 10 10 h 5","Fill":"transparent","Stroke":"red","Junk":"xxxx"}`,
+	}
+	for _, encoding := range encodings {
+		var shape Shape
+		if err := json.Unmarshal([]byte(encoding), &shape); err != nil {
+			t.Fatal("Expected "+encoding+" to decode, got", err)
+		}
+		if valid, _, err := shape.IsValid(100, 100); valid || !errors.Is(err, ValidationError("")) {
+			t.Error("Expected "+encoding+" to be invalid, got", valid, err)
+		}
+	}
+
+	var shape Shape
+	known := `{"Owner":"abc","ShapeType":0,"ShapeSvgString":"M 10 10 h 5","Fill":"transparent","Stroke":"red","Version":2,"StrokeLinecap":"round"}`
+	if err := json.Unmarshal([]byte(known), &shape); err != nil {
+		t.Fatal("Expected "+known+" to decode, got", err)
+	}
+	if valid, _, err := shape.IsValid(100, 100); !valid || err != nil {
+		t.Error("Expected "+known+" to be valid, got", valid, err)
+	}
+}
+
+// Test that stroke styles are checked, encoded from version 2 on, drawn
+// as SVG attributes and don't change a shape's ink cost
+func TestStrokeStyle(t *testing.T) {
+	square := Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 h 20 v 20 h -20 Z", Fill: "red", Stroke: "blue", Version: STROKE_STYLE_VERSION}
+	_, solidGeo, _ := square.IsValid(100, 100)
+
+	for _, style := range []StrokeStyle{{Dasharray: "5 3"}, {Dasharray: " 5, 3.5,.5 "}, {Dasharray: "none"}, {Linecap: "round", Linejoin: "bevel"}} {
+		styled := square
+		styled.Style = style
+		if _, geo, err := styled.IsValid(100, 100); err != nil {
+			t.Error("Expected style", style, "to be valid, got", err)
+		} else if geo.GetInkCost() != solidGeo.GetInkCost() {
+			t.Error("Expected style", style, "not to change the ink cost, got", geo.GetInkCost())
+		}
+	}
+	for _, style := range []StrokeStyle{{Dasharray: "5,,3"}, {Dasharray: "-5"}, {Dasharray: `5" onload="x`}, {Dasharray: strings.Repeat("1 ", 17)}, {Linecap: "flat"}, {Linejoin: "arcs"}} {
+		styled := square
+		styled.Style = style
+		if _, _, err := styled.IsValid(100, 100); err == nil {
+			t.Error("Expected style", style, "to be invalid")
+		}
+	}
+
+	styled := square
+	styled.Style = StrokeStyle{Dasharray: "5 3", Linecap: "round"}
+	if attributes := styled.Style.GetSvgAttributes(); attributes != ` stroke-dasharray="5 3" stroke-linecap="round"` {
+		t.Error("Unexpected SVG attributes", attributes)
+	}
+	styled.Version = 1
+	if _, _, err := styled.IsValid(100, 100); err == nil {
+		t.Error("Expected a version 1 shape with a style to be invalid")
+	}
+
+	// The style is signed with the rest of the shape
+	styled.Version = STROKE_STYLE_VERSION
+	expected := []byte(`{"Owner":"","ShapeType":0,"ShapeSvgString":"M 10 10 h 20 v 20 h -20 Z","Fill":"red","Stroke":"blue","Version":2,"StrokeDasharray":"5 3","StrokeLinecap":"round"}`)
+	encoded, _ := json.Marshal(styled)
+	if !bytes.Equal(encoded, expected) {
+		t.Error("Expected "+string(expected)+", got", string(encoded))
+	}
+	var decoded Shape
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != styled {
+		t.Error("Expected the style to survive a round trip, got", decoded, err)
+	}
+}
+
+// Test overlap between circles and paths, in both directions
+func TestCirclePathOverlap(t *testing.T) {
+	tests := []struct {
+		name       string
+		circle     Shape
+		path       Shape
+		overlapped bool
+	}{
+		{"chord through transparent circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 30 52 L 70 52"}, true},
+		{"segment tangent to circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 30 60 L 70 60"}, true},
+		{"segment just outside circle",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 30 61 L 70 61"}, false},
+		{"diagonal segment passing close to circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 50 66 L 66 50"}, false},
+		{"diagonal segment cutting circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 50 63 L 63 50"}, true},
+		{"segment pointing at circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 80 50 L 61 50"}, false},
+		{"zero length segment on outline",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 60 50 L 60 50"}, true},
+		{"open path inside transparent circle",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 45 45 L 55 55"}, false},
+		{"open path inside filled circle",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 45 45 L 55 55"}, true},
+		{"transparent circle inside filled polygon",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 20 20 h 60 v 60 h -60 Z"}, true},
+		{"transparent circle inside polygon hole",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"},
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 20 20 h 60 v 60 h -60 Z M 35 35 h 30 v 30 h -30 Z"}, false},
+		{"circle outside polygon",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 10 Y 10 R 5"},
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 20 20 h 60 v 60 h -60 Z"}, false},
+	}
+
+	for _, test := range tests {
+		circleGeo, err := test.circle.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		pathGeo, err := test.path.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if overlap := circleGeo.HasOverlap(pathGeo); overlap != test.overlapped {
+			t.Error("Expected circle overlap to be", test.overlapped, "for", test.name)
+		}
+		if overlap := pathGeo.HasOverlap(circleGeo); overlap != test.overlapped {
+			t.Error("Expected path overlap to be", test.overlapped, "for", test.name)
+		}
+	}
+}
+
+// Test which grid cells shapes touch
+func TestCells(t *testing.T) {
+	tests := []struct {
+		name     string
+		shape    Shape
+		cellSize uint32
+		cells    []Cell
+	}{
+		{"filled square",
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 10 v 10 h -10 Z"}, 10,
+			[]Cell{{1, 1}, {2, 1}, {1, 2}, {2, 2}}},
+		{"transparent square skips its inside",
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 5 5 h 20 v 20 h -20 Z"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}},
+		{"filled square covers its inside",
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 5 5 h 20 v 20 h -20 Z"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 1}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}},
+		{"filled square with a hole",
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 0 0 h 50 v 50 h -50 Z M 12 12 h 26 v 26 h -26 Z"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {0, 1}, {1, 1}, {2, 1}, {3, 1}, {4, 1}, {5, 1},
+				{0, 2}, {1, 2}, {3, 2}, {4, 2}, {5, 2}, {0, 3}, {1, 3}, {2, 3}, {3, 3}, {4, 3}, {5, 3},
+				{0, 4}, {1, 4}, {2, 4}, {3, 4}, {4, 4}, {5, 4}, {0, 5}, {1, 5}, {2, 5}, {3, 5}, {4, 5}, {5, 5}}},
+		{"line crossing cells",
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 2 L 25 7"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}}},
+		{"line at negative coordinates",
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M -5 -5 h 10"}, 10,
+			[]Cell{{-1, -1}, {0, -1}}},
+		{"transparent circle skips its center",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 15 Y 15 R 14"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}},
+		{"filled circle covers its center",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 15 Y 15 R 14"}, 10,
+			[]Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 1}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}},
+		{"circle misses corner cells",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 50 Y 50 R 12"}, 10,
+			[]Cell{{4, 3}, {5, 3}, {3, 4}, {4, 4}, {5, 4}, {6, 4}, {3, 5}, {4, 5}, {5, 5}, {6, 5}, {4, 6}, {5, 6}}},
+		{"no cells of size 0",
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 10 10"}, 0,
+			nil},
+	}
+
+	for _, test := range tests {
+		geo, err := test.shape.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		cells := geo.Cells(test.cellSize)
+		if len(cells) != len(test.cells) {
+			t.Error("Expected", test.cells, "for", test.name+", got", cells)
+			continue
+		}
+		for i := range cells {
+			if cells[i] != test.cells[i] {
+				t.Error("Expected", test.cells, "for", test.name+", got", cells)
+				break
+			}
+		}
+	}
+}
+
+// Test that sampled points lie on the shape, and that they are spread over
+// it in proportion to area (or, for transparent shapes, length)
+func TestSamplePoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		shape    Shape
+		region   func(Point) bool
+		fraction float64
+	}{
+		{"filled square by half",
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 0 0 h 99 v 99 h -99 Z"},
+			func(v Point) bool { return v.X < 50 }, 0.5},
+		{"filled square with a hole skips the hole",
+			Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 0 0 h 100 v 100 h -100 Z M 25 25 h 50 v 50 h -50 Z"},
+			func(v Point) bool { return v.X > 25 && v.X < 75 && v.Y > 25 && v.Y < 75 }, 0},
+		{"transparent rectangle by its long sides",
+			Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 h 300 v 100 h -300 Z"},
+			func(v Point) bool { return v.Y == 0 || v.Y == 100 }, 0.75},
+		{"filled circle by half",
+			Shape{ShapeType: CIRCLE, Fill: "non-transparent", ShapeSvgString: "X 50 Y 50 R 40"},
+			func(v Point) bool { return v.Y < 50 }, 0.5},
+		{"transparent circle by its center",
+			Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 40"},
+			func(v Point) bool { return v.X == 50 && v.Y == 50 }, 0},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	numSamples := 4000
+	for _, test := range tests {
+		geo, err := test.shape.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		inRegion := 0
+		for i := 0; i < numSamples; i++ {
+			v := geo.SamplePoint(rng)
+			if !sampleOnShape(geo, v) {
+				t.Error("Expected", v, "to be on", test.name)
+				break
+			}
+			if test.region(v) {
+				inRegion++
+			}
+		}
+		if fraction := float64(inRegion) / float64(numSamples); math.Abs(fraction-test.fraction) > 0.05 {
+			t.Error("Expected about", test.fraction, "of the samples in the region of", test.name+", got", fraction)
+		}
+	}
+}
+
+// Determines if a sampled point is one of the shape's pixels, allowing for
+// points along an outline being rounded to the nearest pixel
+func sampleOnShape(geo ShapeGeometry, v Point) bool {
+	switch g := geo.(type) {
+	case PathGeometry:
+		for _, l := range g.getAllLineSegments() {
+			if l.distanceTo(v) <= math.Sqrt2/2 {
+				return true
+			}
+		}
+		return g.Fill != "transparent" && g.fillContains(v)
+	case CircleGeometry:
+		dist := g.Center.getDist(v)
+		if g.Fill == "transparent" {
+			return math.Abs(dist-float64(g.Radius)) <= math.Sqrt2/2
+		}
+		return dist <= float64(g.Radius)
+	}
+	return false
+}
+
+// Test that paths are traced at constant speed along their outlines as
+// drawn, sub-path after sub-path, and that lengths off either end are
+// clamped to the ends
+func TestPointAtLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		svg    string
+		length float64
+		points map[float64][2]float64
+	}{
+		{"closed square", "M 0 0 h 10 v 10 h -10 Z", 40,
+			map[float64][2]float64{-5: {0, 0}, 0: {0, 0}, 5: {5, 0}, 15: {10, 5}, 30: {0, 10}, 40: {0, 0}, 50: {0, 0}}},
+		{"open diagonal", "M 0 0 L 3 4 L 3 10", 11,
+			map[float64][2]float64{2.5: {1.5, 2}, 5: {3, 4}, 8: {3, 7}, 12: {3, 10}}},
+		{"jumps between sub-paths", "M 0 0 h 10 M 20 0 v 10", 20,
+			map[float64][2]float64{10: {10, 0}, 10.5: {20, 0.5}, 15: {20, 5}}},
+		{"single point", "M 5 5", 0,
+			map[float64][2]float64{0: {5, 5}, 1: {5, 5}}},
+	}
+
+	for _, test := range tests {
+		shape := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: test.svg}
+		geo, err := shape.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		path := geo.(PathGeometry)
+
+		if length := path.TotalLength(); math.Abs(length-test.length) > 1e-9 {
+			t.Error(test.name, "expected length", test.length, "got", length)
+		}
+		for at, expected := range test.points {
+			if x, y := path.PointAtLength(at); math.Abs(x-expected[0]) > 1e-9 || math.Abs(y-expected[1]) > 1e-9 {
+				t.Error(test.name, "expected", expected, "at", at, "got", x, y)
+			}
+		}
+	}
+}
+
+func TestGeometryEqual(t *testing.T) {
+	square := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 0 0 h 10 v 10 h -10 Z"}
+	withSvg := func(shape Shape, svg string) Shape {
+		shape.ShapeSvgString = svg
+		return shape
+	}
+	withFill := func(shape Shape, fill string) Shape {
+		shape.Fill = fill
+		return shape
+	}
+	line := withFill(withSvg(square, "M 0 0 L 10 0 L 10 5"), "transparent")
+	circle := Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 40"}
+
+	tests := []struct {
+		name  string
+		a, b  Shape
+		equal bool
+	}{
+		{"same square", square, square, true},
+		{"absolute square", square, withSvg(square, "M 0 0 L 10 0 L 10 10 L 0 10 Z"), true},
+		{"square from another corner", square, withSvg(square, "M 10 10 h -10 v -10 h 10 Z"), true},
+		{"reversed square", square, withSvg(square, "M 0 0 v 10 h 10 v -10 Z"), true},
+		{"reversed square from another corner", square, withSvg(square, "M 10 0 L 0 0 L 0 10 L 10 10 Z"), true},
+		{"different colour", square, withFill(withSvg(square, "M 10 10 h -10 v -10 h 10 Z"), "blue"), true},
+		{"transparent square", square, withFill(square, "transparent"), false},
+		{"bigger square", square, withSvg(square, "M 0 0 h 20 v 20 h -20 Z"), false},
+		{"three sides of the square", withFill(square, "transparent"), withSvg(line, "M 0 0 h 10 v 10 h -10"), false},
+		{"reversed line", line, withSvg(line, "M 10 5 L 10 0 L 0 0"), true},
+		{"line with other end points", line, withSvg(line, "M 10 0 L 0 0 L 10 5"), false},
+		{"swapped sub-paths",
+			withSvg(square, "M 0 0 h 10 v 10 h -10 Z M 20 20 h 5 v 5 Z"),
+			withSvg(square, "M 25 25 L 20 20 h 5 Z M 10 10 h -10 v -10 h 10 Z"), true},
+		{"same circle", circle, withFill(circle, "red"), false},
+		{"same transparent circle", circle, circle, true},
+		{"bigger circle", circle, withSvg(circle, "X 50 Y 50 R 41"), false},
+		{"circle and square", circle, square, false},
+	}
+
+	for _, test := range tests {
+		a, err := test.a.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		b, err := test.b.GetGeometry()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		if a.Equal(b) != test.equal || b.Equal(a) != test.equal {
+			t.Error("Expected", test.name, "Equal to be", test.equal)
+		}
+		sameSvg := getCanonicalSvg(a) == getCanonicalSvg(b)
+		if test.a.Fill == test.b.Fill && sameSvg != test.equal {
+			t.Error("Expected", test.name, "canonical svg strings to match:", test.equal)
+		}
+		if !a.Canonicalize().Equal(a) {
+			t.Error("Expected", test.name, "to equal its canonical form")
+		}
+	}
+}
+
+func getCanonicalSvg(geo ShapeGeometry) string {
+	switch g := geo.Canonicalize().(type) {
+	case PathGeometry:
+		return g.ShapeSvgString
+	case CircleGeometry:
+		return g.ShapeSvgString
+	}
+	return ""
+}
+
+// Test that an occupancy finds the same overlapping shapes as checking
+// every shape, including shapes inside a large filled one, and forgets
+// removed shapes
+func TestRenderShapes(t *testing.T) {
+	shapes := []Shape{
+		Shape{ShapeType: PATH, Fill: "#00f", Stroke: "red", ShapeSvgString: "M 0 0 h 10 v 10 h -10 Z M 3 3 h 4 v 4 h -4 Z"}, // Square with a hole
+		Shape{ShapeType: CIRCLE, Fill: "transparent", Stroke: "#00ff00", ShapeSvgString: "X 15 Y 5 R 3"},
+	}
+	img := RenderShapes(shapes, image.Rect(0, 0, 20, 10), 1, REJECT_OPEN_PATHS)
+	if size := img.Bounds().Size(); size.X != 20 || size.Y != 10 {
+		t.Fatal("Expected a 20x10 image, got", size)
+	}
+
+	expected := map[image.Point]color.RGBA{
+		image.Pt(0, 5):  {255, 0, 0, 255},     // Outline
+		image.Pt(1, 5):  {0, 0, 255, 255},     // Fill
+		image.Pt(3, 5):  {255, 0, 0, 255},     // Outline of the hole
+		image.Pt(5, 5):  {255, 255, 255, 255}, // Hole
+		image.Pt(15, 2): {0, 255, 0, 255},     // Circle
+		image.Pt(15, 5): {255, 255, 255, 255}, // Inside the transparent circle
+		image.Pt(19, 0): {255, 255, 255, 255}, // Background
+	}
+	for pixel, c := range expected {
+		if img.RGBAAt(pixel.X, pixel.Y) != c {
+			t.Error("Expected", c, "at", pixel, "got", img.RGBAAt(pixel.X, pixel.Y))
+		}
+	}
+
+	// A region away from the origin, scaled up
+	img = RenderShapes(shapes, image.Rect(12, 2, 18, 8), 3, REJECT_OPEN_PATHS)
+	if size := img.Bounds().Size(); size.X != 18 || size.Y != 18 || img.RGBAAt(10, 1) != (color.RGBA{0, 255, 0, 255}) || img.RGBAAt(10, 9) != (color.RGBA{255, 255, 255, 255}) {
+		t.Error("Expected an 18x18 image of the circle, got", size, img.RGBAAt(10, 1), img.RGBAAt(10, 9))
+	}
+}
+
+func TestCanvasOccupancy(t *testing.T) {
+	getGeometry := func(shapeType ShapeType, svg string) ShapeGeometry {
+		geo, err := Shape{ShapeType: shapeType, Fill: "non-transparent", ShapeSvgString: svg}.GetGeometry()
+		if err != nil {
+			t.Fatal(svg, err)
+		}
+		return geo
+	}
+
+	occupancy := NewCanvasOccupancy(16)
+	shapes := map[string]ShapeGeometry{
+		"large":  getGeometry(PATH, "M 0 0 h 300 v 300 h -300 Z"),
+		"circle": getGeometry(CIRCLE, "X 400 Y 400 R 30"),
+	}
+	for i := 0; i < 10; i++ {
+		shapes["square"+strconv.Itoa(i)] = getGeometry(PATH, "M "+strconv.Itoa(320+i*40)+" 100 h 30 v 30 h -30 Z")
+	}
+	occupancy.AddAll(shapes)
+	if occupancy.Len() != len(shapes) {
+		t.Fatal("Expected", len(shapes), "shapes, got", occupancy.Len())
+	}
+
+	probes := []ShapeGeometry{
+		getGeometry(PATH, "M 150 150 h 5 v 5 h -5 Z"),
+		getGeometry(PATH, "M 290 110 h 70 v 5 h -70 Z"),
+		getGeometry(CIRCLE, "X 430 Y 400 R 5"),
+		getGeometry(PATH, "M 600 600 h 5 v 5 h -5 Z"),
+	}
+	for _, probe := range probes {
+		var expected []string
+		for key, geo := range shapes {
+			if geo.HasOverlap(probe) {
+				expected = append(expected, key)
+			}
+		}
+		sort.Strings(expected)
+		if keys := occupancy.Overlaps(probe); !reflect.DeepEqual(keys, expected) {
+			t.Error("Expected", expected, "got", keys)
+		}
+	}
+
+	occupancy.RemoveAll([]string{"large", "square0"})
+	if keys := occupancy.Overlaps(probes[1]); !reflect.DeepEqual(keys, []string{"square1"}) {
+		t.Error("Expected removed shapes to be forgotten, got", keys)
+	}
+	if _, exists := occupancy.Get("large"); exists || len(occupancy.cells[Cell{9, 9}]) != 0 {
+		t.Error("Expected the large shape to be removed from every cell")
+	}
+
+	occupancy.Add("circle", getGeometry(CIRCLE, "X 600 Y 600 R 10"))
+	if keys := occupancy.Overlaps(probes[2]); len(keys) != 0 {
+		t.Error("Expected a replaced shape to be forgotten, got", keys)
+	}
+	if keys := occupancy.Overlaps(probes[3]); !reflect.DeepEqual(keys, []string{"circle"}) {
+		t.Error("Expected the replacement shape, got", keys)
+	}
+}
+
+// An engine that works on canonical geometries, which must agree with the
+// reference engine
+type canonicalEngine struct {
+	ReferenceEngine
+}
+
+func (canonicalEngine) Name() string {
+	return "canonical"
+}
+
+func (e canonicalEngine) Validate(s Shape, rules ShapeRules) (geometry ShapeGeometry, err error) {
+	if geometry, err = e.ReferenceEngine.Validate(s, rules); err == nil {
+		geometry = geometry.Canonicalize()
+	}
+	return
+}
+
+// An engine that overcharges circles and never finds overlaps
+type faultyEngine struct {
+	ReferenceEngine
+}
+
+func (e faultyEngine) Cost(geometry ShapeGeometry) uint64 {
+	if _, isCircle := geometry.(CircleGeometry); isCircle {
+		return e.ReferenceEngine.Cost(geometry) + 1
+	}
+	return e.ReferenceEngine.Cost(geometry)
+}
+
+func (faultyEngine) Overlap(a ShapeGeometry, b ShapeGeometry) bool {
+	return false
+}
+
+func TestGeometryEngines(t *testing.T) {
+	rules := ShapeRules{XMax: 1024, YMax: 1024, MaxVertices: 100}
+	freehand := "M 10 10"
+	for i := 0; i < 100; i++ {
+		freehand += " l 1 0 l 0 1"
+	}
+	shapes := []Shape{
+		Shape{ShapeType: PATH, ShapeSvgString: "M 900 100 h 50 v 50 h -50 Z", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 h 100 v 100 h -100 Z", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: CIRCLE, ShapeSvgString: "X 300 Y 300 R 100", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: PATH, ShapeSvgString: freehand, Fill: "transparent", Stroke: "red"},
+		Shape{ShapeType: PATH, ShapeSvgString: "M 600 600 h 200 v 200 h -200 Z M 650 650 h 100 v 100 h -100 Z M 675 675 h 50 v 50 h -50 Z", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: PATH, ShapeSvgString: "M 850 50 h 100 v 100 h -100 Z", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: PATH, ShapeSvgString: "M 1000 0 h 100 v 10 h -100 Z", Fill: "red", Stroke: "red"},
+		Shape{ShapeType: CIRCLE, ShapeSvgString: "X 320 Y 320 R 10", Fill: "transparent", Stroke: "red"},
+	}
+
+	// The freehand shape is over the vertex limit and one square is out of bounds
+	if mismatches := CompareEngines(ReferenceEngine{}, canonicalEngine{}, shapes, rules); len(mismatches) != 0 {
+		t.Error("Expected the canonical engine to agree with the reference, got", mismatches)
+	}
+	if _, err := (ReferenceEngine{}).Validate(shapes[3], rules); !strings.HasSuffix(err.Error(), "[100] vertices allowed") {
+		t.Error("Expected the freehand shape to be too complex, got", err)
+	}
+
+	mismatches := CompareEngines(ReferenceEngine{}, faultyEngine{}, shapes, rules)
+	var costs, overlaps int
+	for _, mismatch := range mismatches {
+		if strings.Contains(mismatch, " costs ") {
+			costs++
+		} else if strings.Contains(mismatch, " overlap ") {
+			overlaps++
+		}
+	}
+	if costs != 2 || overlaps != 4 || len(mismatches) != 6 {
+		t.Error("Expected both circles' costs and both directions of both overlaps to mismatch, got", mismatches)
+	}
+
+	occupancy := NewCanvasOccupancyWithEngine(0, faultyEngine{})
+	probeGeo, _ := (ReferenceEngine{}).Validate(shapes[0], rules)
+	overlappingGeo, _ := (ReferenceEngine{}).Validate(shapes[5], rules)
+	occupancy.Add("probe", probeGeo)
+	if keys := occupancy.Overlaps(overlappingGeo); len(keys) != 0 {
+		t.Error("Expected the occupancy to check overlap with its engine, got", keys)
+	}
+
+	RegisterEngine(canonicalEngine{}, ENGINE_API_VERSION)
+	if engine, exists := GetEngine("canonical"); !exists || engine.Name() != "canonical" {
+		t.Error("Expected the registered engine to be found")
+	}
+	if names := GetEngineNames(); !reflect.DeepEqual(names, []string{"canonical", REFERENCE_ENGINE}) {
+		t.Error("Expected the canonical and reference engines, got", names)
+	}
+	for _, apiVersion := range []uint32{ENGINE_API_VERSION, ENGINE_API_VERSION + 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected registering with API version", apiVersion, "to panic")
+				}
+			}()
+			RegisterEngine(faultyEngine{}, apiVersion)
+		}()
+	}
+}
+
+// A closed axis-aligned rectangle from (X0, Y0) to (X1, Y1), as the model
+// validator below sees a shape. The model shares no code with the package:
+// it parses, prices and intersects rectangles on its own, so that the
+// property tests can check the geometry consensus depends on against it.
+type modelRect struct {
+	X0, Y0, X1, Y1 int64
+	Filled         bool
+}
+
+// Parses a path of one rectangle, written with any mix of absolute and
+// relative M, L, H, V and Z commands separated by spaces. Anything else
+// is a bad svg string as far as the model is concerned.
+func parseModelRect(svg string, fill string) (rect modelRect, ok bool) {
+	tokens := strings.Fields(svg)
+	next := func() (v int64, ok bool) {
+		if len(tokens) == 0 {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(tokens[0], 10, 64)
+		tokens = tokens[1:]
+		return v, err == nil
+	}
+
+	var corners [][2]int64
+	closed := false
+	for len(tokens) > 0 && !closed {
+		cmd := tokens[0]
+		tokens = tokens[1:]
+		var x, y int64
+		if len(corners) > 0 {
+			x, y = corners[len(corners)-1][0], corners[len(corners)-1][1]
+		}
+		relative := cmd == strings.ToLower(cmd)
+		var dx, dy int64
+		var okX, okY bool
+		switch strings.ToUpper(cmd) {
+		case "M", "L":
+			if (strings.ToUpper(cmd) == "M") != (len(corners) == 0) {
+				return
+			}
+			dx, okX = next()
+			dy, okY = next()
+			if !relative {
+				x, y = 0, 0
+			}
+			x, y = x+dx, y+dy
+		case "H":
+			dx, okX = next()
+			okY = true
+			if !relative {
+				x = 0
+			}
+			x = x + dx
+		case "V":
+			dy, okY = next()
+			okX = true
+			if !relative {
+				y = 0
+			}
+			y = y + dy
+		case "Z":
+			closed, okX, okY = true, true, true
+		}
+		if !okX || !okY {
+			return
+		}
+		if !closed {
+			corners = append(corners, [2]int64{x, y})
+		}
+	}
+	if !closed || len(tokens) != 0 || len(corners) != 4 {
+		return
+	}
+
+	// Every side (including the closing one) must be horizontal or
+	// vertical, alternating between the two
+	for i := range corners {
+		a, b, c := corners[i], corners[(i+1)%4], corners[(i+2)%4]
+		horizontal := a[1] == b[1] && a[0] != b[0]
+		vertical := a[0] == b[0] && a[1] != b[1]
+		if !horizontal && !vertical || horizontal == (b[1] == c[1]) {
+			return
+		}
+	}
+	rect = modelRect{corners[0][0], corners[0][1], corners[2][0], corners[2][1], fill != "transparent"}
+	if rect.X0 > rect.X1 {
+		rect.X0, rect.X1 = rect.X1, rect.X0
+	}
+	if rect.Y0 > rect.Y1 {
+		rect.Y0, rect.Y1 = rect.Y1, rect.Y0
+	}
+	return rect, true
+}
+
+// Every pixel of a valid rectangle lies on the canvas
+func (r modelRect) inBounds(xMax uint32, yMax uint32) bool {
+	return r.X0 >= 0 && r.Y0 >= 0 && r.X1 < int64(xMax) && r.Y1 < int64(yMax)
+}
+
+// A transparent rectangle costs its outline. A filled one costs a scanline
+// of its width for each row it covers, both edges included.
+func (r modelRect) cost() uint64 {
+	w, h := uint64(r.X1-r.X0), uint64(r.Y1-r.Y0)
+	if r.Filled {
+		return w * (h + 1)
+	}
+	return 2 * (w + h)
+}
+
+// Rectangles overlap when they share a pixel, unless one lies strictly
+// inside a transparent one, missing its outline
+func (r modelRect) overlaps(o modelRect) bool {
+	if r.X0 > o.X1 || o.X0 > r.X1 || r.Y0 > o.Y1 || o.Y0 > r.Y1 {
+		return false
+	}
+	return !(!r.Filled && r.strictlyContains(o)) && !(!o.Filled && o.strictlyContains(r))
+}
+
+func (r modelRect) strictlyContains(o modelRect) bool {
+	return r.X0 < o.X0 && o.X1 < r.X1 && r.Y0 < o.Y0 && o.Y1 < r.Y1
+}
+
+// Generates a random rectangle near a size x size canvas (sometimes
+// crossing its edges), spelled with a random start corner, direction and
+// mix of commands, and sometimes mangled into a bad svg string
+func randomModelShape(r *rand.Rand, size int64) Shape {
+	x0, y0 := r.Int63n(size+8)-4, r.Int63n(size+8)-4
+	corners := [][2]int64{{x0, y0}, {x0 + 1 + r.Int63n(size/3), y0}, {0, 0}, {x0, 0}}
+	corners[2] = [2]int64{corners[1][0], y0 + 1 + r.Int63n(size/3)}
+	corners[3][1] = corners[2][1]
+
+	start, step := r.Intn(4), 1+2*r.Intn(2)
+	current := corners[start]
+	svg := []string{"M", strconv.FormatInt(current[0], 10), strconv.FormatInt(current[1], 10)}
+	if r.Intn(2) == 0 {
+		svg[0] = "m"
+	}
+	for i := 1; i < 4; i++ {
+		target := corners[(start+i*step)%4]
+		dx, dy := target[0]-current[0], target[1]-current[1]
+		relative := r.Intn(2) == 0
+		cmd, args := "L", []int64{target[0], target[1]}
+		if r.Intn(2) == 0 && dy == 0 {
+			cmd, args = "H", []int64{target[0]}
+		} else if r.Intn(2) == 0 && dx == 0 {
+			cmd, args = "V", []int64{target[1]}
+		}
+		if relative {
+			cmd = strings.ToLower(cmd)
+			if len(args) == 2 {
+				args = []int64{dx, dy}
+			} else if cmd == "h" {
+				args = []int64{dx}
+			} else {
+				args = []int64{dy}
+			}
+		}
+		svg = append(svg, cmd)
+		for _, arg := range args {
+			svg = append(svg, strconv.FormatInt(arg, 10))
+		}
+		current = target
+	}
+	svg = append(svg, []string{"Z", "z"}[r.Intn(2)])
+
+	switch r.Intn(10) {
+	case 0:
+		svg = svg[1:]
+	case 1:
+		i := 1 + r.Intn(len(svg)-1)
+		svg = append(svg[:i], append([]string{"Q"}, svg[i:]...)...)
+	case 2:
+		svg = append(svg, "M")
+	}
+
+	fill := "red"
+	if r.Intn(2) == 0 {
+		fill = "transparent"
+	}
+	return Shape{ShapeType: PATH, ShapeSvgString: strings.Join(svg, " "), Fill: fill, Stroke: "red"}
+}
+
+// Names the outcome of validating a shape, ignoring the error's details
+func getValidationClass(err error) string {
+	if err == nil {
+		return "valid"
+	} else if errors.Is(err, InvalidShapeSvgStringError("")) {
+		return "bad svg"
+	} else if errors.Is(err, OutOfBoundsError("")) {
+		return "out of bounds"
+	}
+	return Describe(err)
+}
+
+// Checks random shapes' validity, cost and overlaps on every path consensus
+// takes through the package against the model validator
+func TestModelConsensus(t *testing.T) {
+	const shapeCount = 400
+	r := rand.New(rand.NewSource(416))
+	rules := ShapeRules{XMax: 64, YMax: 64}
+
+	var shapes []Shape
+	var rects []modelRect
+	geometries := make(map[string]ShapeGeometry)
+	classes := make(map[string]int)
+	for i := 0; i < shapeCount; i++ {
+		s := randomModelShape(r, int64(rules.XMax))
+		shapes = append(shapes, s)
+
+		rect, parsed := parseModelRect(s.ShapeSvgString, s.Fill)
+		expected := "valid"
+		if !parsed {
+			expected = "bad svg"
+		} else if !rect.inBounds(rules.XMax, rules.YMax) {
+			expected = "out of bounds"
+		}
+		classes[expected]++
+
+		valid, geo, err := s.IsValidWithPolicy(rules.XMax, rules.YMax, rules.Policy)
+		engineGeo, engineErr := DefaultEngine.Validate(s, rules)
+		if got := getValidationClass(err); got != expected || valid != (err == nil) {
+			t.Error("Expected", s.ShapeSvgString, "to be", expected, "got", got)
+			continue
+		} else if got := getValidationClass(engineErr); got != expected {
+			t.Error("Expected the default engine to find", s.ShapeSvgString, expected, "got", got)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		if cost, engineCost := geo.GetInkCost(), DefaultEngine.Cost(engineGeo); cost != rect.cost() || engineCost != rect.cost() {
+			t.Error("Expected", s.ShapeSvgString, s.Fill, "to cost", rect.cost(), "got", cost, engineCost)
+		}
+		key := strconv.Itoa(len(rects))
+		rects = append(rects, rect)
+		geometries[key] = geo
+	}
+	for _, class := range []string{"valid", "bad svg", "out of bounds"} {
+		if classes[class] == 0 {
+			t.Error("Expected some shapes to be", class, "got", classes)
+		}
+	}
+
+	occupancy := NewCanvasOccupancy(8)
+	occupancy.AddAll(geometries)
+	var overlapping int
+	for i, rect := range rects {
+		geo := geometries[strconv.Itoa(i)]
+		var expected []string
+		for j, other := range rects {
+			overlap := rect.overlaps(other)
+			otherGeo := geometries[strconv.Itoa(j)]
+			if geo.HasOverlap(otherGeo) != overlap || DefaultEngine.Overlap(geo, otherGeo) != overlap {
+				t.Error("Expected overlap of", rect, "and", other, "to be", overlap)
+			}
+			if overlap {
+				expected = append(expected, strconv.Itoa(j))
+			}
+			if overlap && i != j {
+				overlapping++
+			}
+		}
+		sort.Strings(expected)
+		if keys := occupancy.Overlaps(geo); !reflect.DeepEqual(keys, expected) {
+			t.Error("Expected the occupancy to find", expected, "overlapping", rect, "got", keys)
+		}
+	}
+	if overlapping == 0 || overlapping == len(rects)*(len(rects)-1) {
+		t.Error("Expected some but not all pairs of shapes to overlap, got", overlapping)
+	}
+
+	// Canonical shapes must be judged the same way
+	if mismatches := CompareEngines(ReferenceEngine{}, canonicalEngine{}, shapes, rules); len(mismatches) != 0 {
+		t.Error("Expected canonical shapes to agree with the model, got", mismatches)
+	}
+}
+
+// Test that importing an SVG path leniently keeps what BlockArt supports,
+// approximates curves and fractions, and reports everything it changed
+func TestImportPathSvg(t *testing.T) {
+	tests := []struct {
+		d         string
+		svg       string
+		omissions []PathOmission
+	}{
+		{"M 0 0 L 10 0 L 10 10 Z", "M 0 0 L 10 0 L 10 10 Z", nil},
+		{"M 10 10 C 20 20, 30 30, 40 10 L 40 40 Z", "M 10 10 L 40 10 L 40 40 Z",
+			[]PathOmission{{8, "C", "curve replaced by a line to its end point"}}},
+		{"M0.4,0h10.6q1,1 2,2v10X5h-13z", "M 0 0 h 11 l 2 2 v 10 h -13 z", []PathOmission{
+			{1, "0.4", "coordinate rounded to an integer"},
+			{7, "10.6", "coordinate rounded to an integer"},
+			{11, "q", "curve replaced by a line to its end point"},
+			{22, "X", "unsupported command"}}},
+		{"L 5 5 M 0 0 L 5 5 7; Z 3", "M 0 0 L 5 5 Z", []PathOmission{
+			{19, ";", "unexpected character"},
+			{0, "L", "command before the first move"},
+			{18, "7", "incomplete coordinates"},
+			{23, "3", "coordinates after a close path"}}},
+		{"M 0 0 a 5 5 0 0 1 10 0 5 5 0 0 1 10 -10 V 1e1", "M 0 0 l 10 0 l 10 -10 V 10", []PathOmission{
+			{6, "a", "curve replaced by a line to its end point"}}},
+	}
+
+	for _, test := range tests {
+		svg, omissions, err := ImportPathSvg(test.d)
+		if err != nil || svg != test.svg {
+			t.Error("Expected", test.d, "to import as", test.svg, "got", svg, err)
+		} else if !reflect.DeepEqual(omissions, test.omissions) {
+			t.Error("Expected", test.d, "to omit", test.omissions, "got", omissions)
+		}
+	}
+
+	for _, d := range []string{"", "C 1 2 3", "L 5 5", "M 1"} {
+		if _, _, err := ImportPathSvg(d); !errors.Is(err, InvalidShapeSvgStringError(d)) {
+			t.Error("Expected nothing to be recovered from", d, "got", err)
+		}
+	}
+
+	curved := Shape{ShapeType: PATH, ShapeSvgString: "M 0 0 H 10 Q 15 5 10 10 H 0 Z", Fill: "red", Stroke: "red"}
+	if _, err := curved.GetGeometry(); err == nil {
+		t.Error("Expected a curve to be invalid when parsed strictly")
+	}
+	square := Shape{ShapeType: PATH, ShapeSvgString: "M 0 0 H 10 L 10 10 H 0 Z", Fill: "red", Stroke: "red"}
+	squareGeometry, _ := square.GetGeometry()
+	geometry, omissions, err := curved.GetGeometryLenient(REJECT_OPEN_PATHS)
+	if err != nil || len(omissions) != 1 {
+		t.Fatal("Expected the curve to be approximated, got", omissions, err)
+	} else if !geometry.Equal(squareGeometry) || geometry.(PathGeometry).ShapeSvgString != square.ShapeSvgString {
+		t.Error("Expected the approximated square, got", geometry.(PathGeometry).ShapeSvgString)
+	}
+}